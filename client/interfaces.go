@@ -375,6 +375,7 @@ type InstanceServer interface {
 	GetStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshotName string) (snapshot *api.StorageVolumeSnapshot, ETag string, err error)
 	RenameStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshotName string, snapshot api.StorageVolumeSnapshotPost) (op Operation, err error)
 	UpdateStoragePoolVolumeSnapshot(pool string, volumeType string, volumeName string, snapshotName string, volume api.StorageVolumeSnapshotPut, ETag string) (err error)
+	UpdateStoragePoolVolumeSnapshotSendParent(pool string, volumeType string, volumeName string, snapshotName string, sendParent api.StorageVolumeSnapshotSendParentPost) (refCount *api.StorageVolumeSnapshotSendParent, err error)
 
 	// Storage volume backup functions ("custom_volume_backup" API extension)
 	GetStoragePoolVolumeBackupNames(pool string, volName string) (names []string, err error)
@@ -331,6 +331,26 @@ func (r *ProtocolLXD) UpdateStoragePoolVolumeSnapshot(pool string, volumeType st
 	return nil
 }
 
+// UpdateStoragePoolVolumeSnapshotSendParent increments or decrements the number of incremental sends relying on the
+// snapshot as their parent, and returns the new value.
+func (r *ProtocolLXD) UpdateStoragePoolVolumeSnapshotSendParent(pool string, volumeType string, volumeName string, snapshotName string, sendParent api.StorageVolumeSnapshotSendParentPost) (*api.StorageVolumeSnapshotSendParent, error) {
+	err := r.CheckExtension("storage_volume_snapshot_send_parent")
+	if err != nil {
+		return nil, err
+	}
+
+	refCount := api.StorageVolumeSnapshotSendParent{}
+
+	// Send the request
+	path := fmt.Sprintf("/storage-pools/%s/volumes/%s/%s/snapshots/%s/send-parent", url.PathEscape(pool), url.PathEscape(volumeType), url.PathEscape(volumeName), url.PathEscape(snapshotName))
+	_, err = r.queryStruct("POST", path, sendParent, "", &refCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &refCount, nil
+}
+
 // MigrateStoragePoolVolume requests that LXD prepares for a storage volume migration.
 func (r *ProtocolLXD) MigrateStoragePoolVolume(pool string, volume api.StorageVolumePost) (Operation, error) {
 	if !r.HasExtension("storage_api_remote_volume_handling") {
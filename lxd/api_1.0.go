@@ -107,6 +107,7 @@ var api10 = []APIEndpoint{
 	storagePoolVolumesCmd,
 	storagePoolVolumeSnapshotsTypeCmd,
 	storagePoolVolumeSnapshotTypeCmd,
+	storagePoolVolumeSnapshotTypeSendParentCmd,
 	storagePoolVolumesTypeCmd,
 	storagePoolVolumeTypeCmd,
 	storagePoolVolumeTypeCustomBackupsCmd,
@@ -16,6 +16,7 @@ import (
 	runtimeDebug "runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"golang.org/x/sys/unix"
@@ -23,11 +24,13 @@ import (
 	"github.com/lxc/lxd/lxd/backup"
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/db/cluster"
+	"github.com/lxc/lxd/lxd/db/operationtype"
 	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/lxc/lxd/lxd/db/warningtype"
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/response"
 	"github.com/lxc/lxd/lxd/revert"
@@ -39,6 +42,7 @@ import (
 	"github.com/lxc/lxd/shared/logger"
 	"github.com/lxc/lxd/shared/osarch"
 	"github.com/lxc/lxd/shared/units"
+	"github.com/lxc/lxd/shared/validate"
 )
 
 var apiInternal = []APIEndpoint{
@@ -54,11 +58,44 @@ var apiInternal = []APIEndpoint{
 	internalContainerOnStopNSCmd,
 	internalGarbageCollectorCmd,
 	internalImageOptimizeCmd,
+	internalImageInstancesCmd,
 	internalImageRefreshCmd,
 	internalRAFTSnapshotCmd,
 	internalReadyCmd,
 	internalShutdownCmd,
 	internalSQLCmd,
+	internalStoragePoolMountsCmd,
+	internalStoragePoolRebalanceCmd,
+	internalStoragePoolEmergencyFreeCmd,
+	internalStoragePoolSharingCmd,
+	internalStoragePoolLayoutCmd,
+	internalStoragePoolHealthCmd,
+	internalStoragePoolReclaimableCmd,
+	internalStoragePoolSnapshotEstimateCmd,
+	internalStoragePoolSnapshotIndexCmd,
+	internalStoragePoolPathSnapshotCmd,
+	internalStoragePoolStraySubvolumesCmd,
+	internalStoragePoolSubvolumeIDsCmd,
+	internalStoragePoolConfigDriftCmd,
+	internalStoragePoolVerifyMountsCmd,
+	internalStoragePoolQuiesceCmd,
+	internalStoragePoolResumeCmd,
+	internalInstanceSnapshotsDiffCmd,
+	internalInstanceSnapshotsInfoCmd,
+	internalInstanceImageDiffCmd,
+	internalInstanceSnapshotsOverdueCmd,
+	internalInstanceSnapshotsDeleteCmd,
+	internalSnapshotGroupsCmd,
+	internalInstanceImportTreesCmd,
+	internalInstanceImportStreamCmd,
+	internalStoragePoolOCIExportCmd,
+	internalStoragePoolRepairReadonlyCmd,
+	internalStoragePoolPruneSnapshotDirsCmd,
+	internalStoragePoolRebuildSnapshotSymlinksCmd,
+	internalStoragePoolSnapshotArchiveCmd,
+	internalStoragePoolSnapshotArchiveRestoreCmd,
+	internalStoragePoolUsageHistoryCmd,
+	internalStoragePoolRecoveryBundleCmd,
 	internalWarningCreateCmd,
 }
 
@@ -123,69 +160,1483 @@ var internalImageOptimizeCmd = APIEndpoint{
 	Post: APIEndpointAction{Handler: internalOptimizeImage},
 }
 
+var internalImageInstancesCmd = APIEndpoint{
+	Path: "image-instances/{fingerprint}",
+
+	Get: APIEndpointAction{Handler: internalImageInstances},
+}
+
 var internalWarningCreateCmd = APIEndpoint{
 	Path: "testing/warnings",
 
-	Post: APIEndpointAction{Handler: internalCreateWarning},
+	Post: APIEndpointAction{Handler: internalCreateWarning},
+}
+
+var internalBGPStateCmd = APIEndpoint{
+	Path: "testing/bgp",
+
+	Get: APIEndpointAction{Handler: internalBGPState},
+}
+
+var internalStoragePoolMountsCmd = APIEndpoint{
+	Path: "debug/storage-pools/{poolName}/mounts",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolMounts},
+}
+
+var internalStoragePoolUsageHistoryCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/usage-history",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolUsageHistory},
+}
+
+var internalStoragePoolRecoveryBundleCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/recovery-bundle",
+
+	Get:  APIEndpointAction{Handler: internalStoragePoolRecoveryBundleGet},
+	Post: APIEndpointAction{Handler: internalStoragePoolRecoveryBundlePost},
+}
+
+var internalStoragePoolRebalanceCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/rebalance",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolRebalance},
+}
+
+var internalStoragePoolEmergencyFreeCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/emergency-free",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolEmergencyFree},
+}
+
+var internalStoragePoolSharingCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/sharing",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolSharing},
+}
+
+var internalStoragePoolLayoutCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/layout",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolLayout},
+}
+
+var internalStoragePoolHealthCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/health",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolHealth},
+}
+
+var internalStoragePoolReclaimableCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/reclaimable",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolReclaimable},
+}
+
+var internalStoragePoolSnapshotEstimateCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/snapshot-estimate",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolSnapshotEstimate},
+}
+
+var internalStoragePoolSnapshotIndexCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/snapshot-index",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolSnapshotIndex},
+}
+
+var internalStoragePoolPathSnapshotCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/path-snapshot",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolPathSnapshot},
+}
+
+var internalStoragePoolSubvolumeIDsCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/subvolume-ids",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolSubvolumeIDs},
+}
+
+var internalStoragePoolConfigDriftCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/config-drift",
+
+	Get:  APIEndpointAction{Handler: internalStoragePoolConfigDriftGet},
+	Post: APIEndpointAction{Handler: internalStoragePoolConfigDriftPost},
+}
+
+var internalStoragePoolVerifyMountsCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/verify-mounts",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolVerifyMounts},
+}
+
+var internalStoragePoolQuiesceCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/quiesce",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolQuiesce},
+}
+
+var internalStoragePoolResumeCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/resume",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolResume},
+}
+
+var internalStoragePoolStraySubvolumesCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/stray-subvolumes",
+
+	Get: APIEndpointAction{Handler: internalStoragePoolStraySubvolumes},
+}
+
+var internalStoragePoolOCIExportCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/oci-export",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolOCIExport},
+}
+
+var internalStoragePoolRepairReadonlyCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/repair-readonly",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolRepairReadonly},
+}
+
+var internalStoragePoolPruneSnapshotDirsCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/prune-snapshot-dirs",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolPruneSnapshotDirs},
+}
+
+var internalStoragePoolRebuildSnapshotSymlinksCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/rebuild-snapshot-symlinks",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolRebuildSnapshotSymlinks},
+}
+
+var internalStoragePoolSnapshotArchiveCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/snapshot-archive",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolSnapshotArchive},
+}
+
+var internalStoragePoolSnapshotArchiveRestoreCmd = APIEndpoint{
+	Path: "storage-pools/{poolName}/snapshot-archive-restore",
+
+	Post: APIEndpointAction{Handler: internalStoragePoolSnapshotArchiveRestore},
+}
+
+var internalInstanceSnapshotsOverdueCmd = APIEndpoint{
+	Path: "instances/snapshots-overdue",
+
+	Get: APIEndpointAction{Handler: internalInstanceSnapshotsOverdue},
+}
+
+var internalInstanceSnapshotsDeleteCmd = APIEndpoint{
+	Path: "instances/snapshots-delete",
+
+	Post: APIEndpointAction{Handler: internalInstanceSnapshotsDelete},
+}
+
+var internalSnapshotGroupsCmd = APIEndpoint{
+	Path: "snapshot-groups",
+
+	Post: APIEndpointAction{Handler: internalSnapshotGroupCreate},
+}
+
+var internalInstanceImportTreesCmd = APIEndpoint{
+	Path: "instances/import-trees",
+
+	Post: APIEndpointAction{Handler: internalInstanceImportTrees},
+}
+
+var internalInstanceImportStreamCmd = APIEndpoint{
+	Path: "instances/import-stream",
+
+	Post: APIEndpointAction{Handler: internalInstanceImportStream},
+}
+
+var internalInstanceSnapshotsDiffCmd = APIEndpoint{
+	Path: "instances/{name}/snapshots-diff",
+
+	Get: APIEndpointAction{Handler: internalInstanceSnapshotsDiff},
+}
+
+var internalInstanceSnapshotsInfoCmd = APIEndpoint{
+	Path: "instances/{name}/snapshots-info",
+
+	Get: APIEndpointAction{Handler: internalInstanceSnapshotsInfo},
+}
+
+var internalInstanceImageDiffCmd = APIEndpoint{
+	Path: "instances/{name}/image-diff",
+
+	Get: APIEndpointAction{Handler: internalInstanceImageDiff},
+}
+
+type internalStoragePoolRebalancePost struct {
+	Project string   `json:"project" yaml:"project"`
+	Volumes []string `json:"volumes" yaml:"volumes"`
+}
+
+type internalInstanceSnapshotsDeletePost struct {
+	Project   string   `json:"project" yaml:"project"`
+	Snapshots []string `json:"snapshots" yaml:"snapshots"` // Named "<instance>/<snapshot>".
+}
+
+type internalSnapshotGroupPost struct {
+	Project   string                            `json:"project" yaml:"project"`
+	Name      string                            `json:"name" yaml:"name"`
+	Instances []string                          `json:"instances" yaml:"instances"`
+	Volumes   []internalSnapshotGroupPostVolume `json:"volumes" yaml:"volumes"`
+}
+
+type internalSnapshotGroupPostVolume struct {
+	Pool string `json:"pool" yaml:"pool"`
+	Name string `json:"name" yaml:"name"`
+}
+
+type internalInstanceImportTreesPost struct {
+	Project     string   `json:"project" yaml:"project"`
+	Source      string   `json:"source" yaml:"source"`
+	Profiles    []string `json:"profiles" yaml:"profiles"`
+	Parallelism int      `json:"parallelism" yaml:"parallelism"`
+}
+
+type internalInstanceImportStreamPost struct {
+	Project  string   `json:"project" yaml:"project"`
+	Name     string   `json:"name" yaml:"name"`
+	URL      string   `json:"url" yaml:"url"`
+	Checksum string   `json:"checksum" yaml:"checksum"`
+	Profiles []string `json:"profiles" yaml:"profiles"`
+}
+
+type internalStoragePoolOCIExportPost struct {
+	Project string                         `json:"project" yaml:"project"`
+	Volume  string                         `json:"volume" yaml:"volume"`
+	Config  *storageDrivers.OCIImageConfig `json:"config" yaml:"config"`
+}
+
+type internalStoragePoolPathSnapshotPost struct {
+	Project string `json:"project" yaml:"project"`
+	Volume  string `json:"volume" yaml:"volume"`
+	Path    string `json:"path" yaml:"path"`
+	Name    string `json:"name" yaml:"name"`
+}
+
+type internalStoragePoolSnapshotArchiveRestorePost struct {
+	Project     string `json:"project" yaml:"project"`
+	ArchivePool string `json:"archive_pool" yaml:"archive_pool"`
+	Archive     string `json:"archive" yaml:"archive"`
+	Name        string `json:"name" yaml:"name"`
+}
+
+type internalImageOptimizePost struct {
+	Image api.Image `json:"image" yaml:"image"`
+	Pool  string    `json:"pool" yaml:"pool"`
+}
+
+type internalWarningCreatePost struct {
+	Location       string `json:"location" yaml:"location"`
+	Project        string `json:"project" yaml:"project"`
+	EntityTypeCode int    `json:"entity_type_code" yaml:"entity_type_code"`
+	EntityID       int    `json:"entity_id" yaml:"entity_id"`
+	TypeCode       int    `json:"type_code" yaml:"type_code"`
+	Message        string `json:"message" yaml:"message"`
+}
+
+// internalCreateWarning creates a warning, and is used for testing only.
+func internalCreateWarning(d *Daemon, r *http.Request) response.Response {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return response.InternalError(err)
+	}
+
+	rdr1 := io.NopCloser(bytes.NewBuffer(body))
+	rdr2 := io.NopCloser(bytes.NewBuffer(body))
+
+	reqRaw := shared.Jmap{}
+	err = json.NewDecoder(rdr1).Decode(&reqRaw)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	req := internalWarningCreatePost{}
+	err = json.NewDecoder(rdr2).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	req.EntityTypeCode, _ = reqRaw.GetInt("entity_type_code")
+	req.EntityID, _ = reqRaw.GetInt("entity_id")
+
+	// Check if the entity exists, and fail if it doesn't.
+	_, ok := cluster.EntityNames[req.EntityTypeCode]
+	if req.EntityTypeCode != -1 && !ok {
+		return response.SmartError(fmt.Errorf("Invalid entity type"))
+	}
+
+	err = d.db.Cluster.UpsertWarning(req.Location, req.Project, req.EntityTypeCode, req.EntityID, warningtype.Type(req.TypeCode), req.Message)
+	if err != nil {
+		return response.SmartError(fmt.Errorf("Failed to create warning: %w", err))
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalStoragePoolMounts lists the mounts currently active under a storage pool's mount path.
+// This is used for debugging operations failing because of leftover mounts.
+func internalStoragePoolMounts(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	mounts, err := storageDrivers.PoolActiveMounts(pool.Name())
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, mounts)
+}
+
+// internalStoragePoolUsageHistory returns the recent usage samples recorded for a storage pool.
+func internalStoragePoolUsageHistory(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, storagePools.UsageHistory(pool.Name()))
+}
+
+// internalStoragePoolRecoveryBundleGet returns the recovery bundle of a storage pool.
+func internalStoragePoolRecoveryBundleGet(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	bundle, err := storagePoolRecoveryBundleExport(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, bundle)
+}
+
+// internalStoragePoolRecoveryBundlePost recreates a storage pool and its custom volume records from a recovery
+// bundle. The pool must not exist yet.
+func internalStoragePoolRecoveryBundlePost(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	bundle := storagePools.RecoveryBundle{}
+
+	err = json.NewDecoder(r.Body).Decode(&bundle)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if bundle.Pool.Name != poolName {
+		return response.BadRequest(fmt.Errorf("Recovery bundle is for storage pool %q", bundle.Pool.Name))
+	}
+
+	err = storagePoolRecoveryBundleImport(d.State(), &bundle)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalStoragePoolRebalance starts an operation spreading the data of a storage pool evenly across its
+// devices, relocating the requested volumes if needed. The operation can be cancelled.
+func internalStoragePoolRebalance(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	req := internalStoragePoolRebalancePost{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	run := func(op *operations.Operation) error {
+		defer cancel()
+
+		return pool.Rebalance(ctx, req.Project, req.Volumes, op)
+	}
+
+	onCancel := func(op *operations.Operation) error {
+		cancel()
+		return nil
+	}
+
+	resources := map[string][]string{}
+	resources["storage_pools"] = []string{poolName}
+
+	op, err := operations.OperationCreate(d.State(), req.Project, operations.OperationClassTask, operationtype.StoragePoolRebalance, resources, nil, run, onCancel, nil, r)
+	if err != nil {
+		cancel()
+		return response.InternalError(err)
+	}
+
+	return operations.OperationResponse(op)
+}
+
+// internalStoragePoolEmergencyFree frees space on a storage pool which has run out of it so that it can be
+// recovered, for example by deleting volumes. As this is irreversible, the "confirm" query parameter must be set
+// to the pool name or to the confirmation code returned when the "dry-run" query parameter is set.
+func internalStoragePoolEmergencyFree(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if shared.IsTrue(queryParam(r, "dry-run")) {
+		confirmation, err := storagePools.NewConfirmationCode(pool.Name(), "emergency-free", time.Now())
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		return response.SyncResponse(true, confirmation)
+	}
+
+	err = storagePools.CheckConfirmation(pool.Name(), "emergency-free", queryParam(r, "confirm"), time.Now())
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	err = pool.EmergencyFree(nil)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot free space: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalStoragePoolSharing returns an estimate of the physical space saved by the volumes passed in the
+// "volume" query parameters (as "<type>/<name>") sharing data.
+func internalStoragePoolSharing(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	volNames := r.URL.Query()["volume"]
+	if len(volNames) == 0 {
+		return response.BadRequest(fmt.Errorf("At least one volume must be specified"))
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	estimate, err := pool.EstimateSharing(projectParam(r), volNames)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot estimate sharing: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, estimate)
+}
+
+// internalStoragePoolLayout returns a report of the differences between the on-disk layout of a storage pool
+// and the expected one, for diagnostics. The pool isn't modified.
+func internalStoragePoolLayout(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	report, err := pool.ValidateLayout()
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot validate its layout: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, report)
+}
+
+// internalStoragePoolHealth returns a report of the problems of a storage pool which need an action from the
+// administrator, such as inconsistent quota accounting or writable snapshots and images. The writable snapshots
+// and images are made read-only again if the "repair" query parameter is true.
+func internalStoragePoolHealth(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	report, err := pool.CheckHealth(shared.IsTrue(queryParam(r, "repair")))
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot check its health: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, report)
+}
+
+// internalStoragePoolReclaimable returns the snapshots of the volume passed in the "volume" query parameter (as
+// "<type>/<name>") sorted by the space deleting them would free, largest first.
+func internalStoragePoolReclaimable(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	volName := queryParam(r, "volume")
+	if volName == "" {
+		return response.BadRequest(fmt.Errorf("A volume must be specified"))
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	report, err := pool.GetSnapshotsReclaimableSpace(projectParam(r), volName)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot compute reclaimable space: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, report)
+}
+
+// internalStoragePoolSnapshotEstimate returns the estimated time (in seconds) a snapshot of the volume passed in
+// the "volume" query parameter (as "<type>/<name>") would take, so that clients can warn before slow snapshots.
+func internalStoragePoolSnapshotEstimate(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	volName := queryParam(r, "volume")
+	if volName == "" {
+		return response.BadRequest(fmt.Errorf("A volume must be specified"))
+	}
+
+	estimate, err := storagePools.SnapshotTimeEstimate(d.State(), projectParam(r), poolName, volName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, map[string]float64{"seconds": estimate.Seconds()})
+}
+
+// internalStoragePoolSnapshotIndex returns the snapshots of the instance volume passed in the "volume" query
+// parameter (as "<type>/<name>") whose file index contains the file passed in the "path" query parameter.
+func internalStoragePoolSnapshotIndex(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	volName := queryParam(r, "volume")
+	if volName == "" {
+		return response.BadRequest(fmt.Errorf("A volume must be specified"))
+	}
+
+	path := queryParam(r, "path")
+	if path == "" {
+		return response.BadRequest(fmt.Errorf("A path must be specified"))
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	matches, err := pool.FindSnapshotsWithPath(projectParam(r), volName, path)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, matches)
+}
+
+// internalStoragePoolPathSnapshot snapshots only a directory within an instance or custom volume (given as
+// "<type>/<name>"), converting it to a subvolume on pools which need it, and returns the path of the snapshot.
+func internalStoragePoolPathSnapshot(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	req := internalStoragePoolPathSnapshotPost{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.Volume == "" || req.Path == "" || req.Name == "" {
+		return response.BadRequest(fmt.Errorf("A volume, path and snapshot name must be specified"))
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	snapPath, err := pool.SnapshotVolumePath(req.Project, req.Volume, req.Path, req.Name, nil)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot snapshot paths within volumes: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, snapPath)
+}
+
+// internalStoragePoolStraySubvolumes returns the subvolumes of a storage pool which don't belong to any volume
+// known to LXD, so that they can be reviewed. Nothing is deleted.
+func internalStoragePoolStraySubvolumes(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	subvols, err := pool.FindStraySubvolumes()
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot look for stray subvolumes: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, subvols)
+}
+
+// internalStoragePoolSubvolumeIDs returns the volumes of a storage pool keyed by the ID of their subvolume, to
+// relate the output of the storage tools, which only shows IDs, to volumes.
+func internalStoragePoolSubvolumeIDs(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	vols, err := pool.GetSubvolumeVolumes()
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot list subvolume IDs: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, vols)
+}
+
+// internalStoragePoolConfigDriftGet returns the current config of a storage pool and of its volumes, including
+// the limits of their qgroups, to be used as the baseline of later drift checks.
+func internalStoragePoolConfigDriftGet(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	configState, err := pool.ConfigState()
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, configState)
+}
+
+// internalStoragePoolConfigDriftPost returns the differences between the current config of a storage pool and of
+// its volumes and the baseline passed in the request, as returned by internalStoragePoolConfigDriftGet. The
+// volatile keys are ignored.
+func internalStoragePoolConfigDriftPost(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	baseline := storagePools.PoolConfigState{}
+	err = json.NewDecoder(r.Body).Decode(&baseline)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	diffs, err := pool.ConfigDrift(baseline)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, diffs)
+}
+
+// internalStoragePoolVerifyMounts starts an operation mounting each volume of a storage pool read-only, snapshots
+// included, and unmounting it straight away. The volumes which failed to mount are reported in the "report" field
+// of the operation metadata, the operation failing if there are any.
+func internalStoragePoolVerifyMounts(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if pool.Driver().Info().Name != "btrfs" {
+		return response.NotImplemented(fmt.Errorf("Storage pool %q cannot verify volume mounts", poolName))
+	}
+
+	run := func(op *operations.Operation) error {
+		report, err := pool.VerifyVolumeMounts(op)
+		if err != nil {
+			return err
+		}
+
+		_ = op.UpdateMetadata(map[string]any{"report": report})
+
+		if len(report.Failures) > 0 {
+			return fmt.Errorf("Failed mounting %d of %d volumes", len(report.Failures), report.Verified)
+		}
+
+		return nil
+	}
+
+	resources := map[string][]string{}
+	resources["storage_pools"] = []string{poolName}
+
+	op, err := operations.OperationCreate(d.State(), project.Default, operations.OperationClassTask, operationtype.StoragePoolVerifyMounts, resources, nil, run, nil, nil, r)
+	if err != nil {
+		return response.InternalError(err)
+	}
+
+	return operations.OperationResponse(op)
+}
+
+// internalStoragePoolOCIExport streams a volume as an OCI image layer tarball, or as an OCI image layout when an
+// image config is provided, so that it can be consumed by container runtimes.
+func internalStoragePoolOCIExport(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	req := internalStoragePoolOCIExportPost{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.Volume == "" {
+		return response.BadRequest(fmt.Errorf("A volume must be specified"))
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if pool.Driver().Info().Name != "btrfs" {
+		return response.NotImplemented(fmt.Errorf("Storage pool %q cannot export volumes as OCI layers", poolName))
+	}
+
+	return response.ManualResponse(func(w http.ResponseWriter) error {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.WriteHeader(http.StatusOK)
+
+		return pool.ExportVolumeOCI(req.Project, req.Volume, w, req.Config, nil)
+	})
+}
+
+// internalStoragePoolRepairReadonly makes the image volumes of a storage pool which were found writable read-only
+// again and returns the paths which were corrected.
+func internalStoragePoolRepairReadonly(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	repaired, err := pool.RepairImagesReadonly(nil)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot repair read-only flags: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, repaired)
+}
+
+// internalStoragePoolQuiesce pauses the new operations on a storage pool and flushes its pending writes to disk,
+// freezing its filesystem if the "freeze" query parameter is true, until the pool is resumed or the number of
+// seconds in the "timeout" query parameter (ten minutes by default) has passed. This provides a consistent window
+// for snapshotting or backing up the host.
+func internalStoragePoolQuiesce(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	timeout := storagePools.PoolQuiesceDefaultTimeout
+	if queryParam(r, "timeout") != "" {
+		seconds, err := strconv.ParseUint(queryParam(r, "timeout"), 10, 32)
+		if err != nil || seconds == 0 {
+			return response.BadRequest(fmt.Errorf("Invalid timeout %q", queryParam(r, "timeout")))
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	err = pool.Quiesce(shared.IsTrue(queryParam(r, "freeze")), timeout)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot be quiesced: %w", poolName, err))
+		}
+
+		var busyErr storagePools.ErrPoolBusy
+		if errors.As(err, &busyErr) {
+			return response.Conflict(err)
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalStoragePoolResume thaws a storage pool quiesced by internalStoragePoolQuiesce and lets the paused
+// operations proceed. The filesystem is thawed even if the pool isn't known to be quiesced, such as after a restart.
+func internalStoragePoolResume(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	err = pool.Resume()
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot be resumed: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalImageInstances returns the instances whose volume was created from the image with the given
+// fingerprint, as recorded on their volume when created.
+func internalImageInstances(d *Daemon, r *http.Request) response.Response {
+	fingerprint, err := url.PathUnescape(mux.Vars(r)["fingerprint"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	instances, err := storagePools.InstancesFromImage(d.State(), fingerprint)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, instances)
+}
+
+// internalStoragePoolPruneSnapshotDirs removes the empty parent snapshot directories and dangling snapshot symlinks
+// of a storage pool and returns the paths which were removed.
+func internalStoragePoolPruneSnapshotDirs(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pruned, err := pool.PruneSnapshotDirs(nil)
+	if err != nil {
+		if errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.NotImplemented(fmt.Errorf("Storage pool %q cannot prune snapshot directories: %w", poolName, err))
+		}
+
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, pruned)
+}
+
+// internalStoragePoolRebuildSnapshotSymlinks rebuilds the instance snapshot symlinks of a storage pool from the
+// instances of the pool and their snapshot directories, and returns the symlinks which were changed.
+func internalStoragePoolRebuildSnapshotSymlinks(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	rebuilt, err := pool.RebuildSnapshotSymlinks(nil)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, rebuilt)
+}
+
+// internalStoragePoolSnapshotArchive archives the snapshots of the custom volumes of a storage pool older than
+// their snapshots.archive.age now rather than waiting for the hourly task. Only custom volume snapshots are
+// archived, instance snapshots are left as is.
+func internalStoragePoolSnapshotArchive(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	_, err = storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	allVolumes, err := customVolumesToArchive(r.Context(), d.State())
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	volumes := make([]db.StorageVolumeArgs, 0, len(allVolumes))
+	for _, v := range allVolumes {
+		if v.PoolName == poolName {
+			volumes = append(volumes, v)
+		}
+	}
+
+	err = archiveCustomVolumeSnapshots(d.shutdownCtx, d, volumes, time.Now(), nil)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
+}
+
+// internalStoragePoolSnapshotArchiveRestore creates a custom volume on a storage pool from the archive of one of
+// its snapshots on an archive pool.
+func internalStoragePoolSnapshotArchiveRestore(d *Daemon, r *http.Request) response.Response {
+	poolName, err := url.PathUnescape(mux.Vars(r)["poolName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	req := internalStoragePoolSnapshotArchiveRestorePost{}
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.ArchivePool == "" || req.Archive == "" || req.Name == "" {
+		return response.BadRequest(fmt.Errorf("An archive pool, archive volume and volume name must be specified"))
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	err = pool.RestoreCustomVolumeSnapshotArchive(req.Project, req.ArchivePool, req.Archive, req.Name, nil)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.EmptySyncResponse
 }
 
-var internalBGPStateCmd = APIEndpoint{
-	Path: "testing/bgp",
+// internalInstanceSnapshotsDiff compares the stored config, devices and profiles of two snapshots of an instance,
+// given by the from and to query parameters.
+func internalInstanceSnapshotsDiff(d *Daemon, r *http.Request) response.Response {
+	instName, err := url.PathUnescape(mux.Vars(r)["name"])
+	if err != nil {
+		return response.SmartError(err)
+	}
 
-	Get: APIEndpointAction{Handler: internalBGPState},
+	snapshots := make([]*api.InstanceSnapshot, 0, 2)
+	for _, param := range []string{"from", "to"} {
+		snapName := queryParam(r, param)
+		if snapName == "" {
+			return response.BadRequest(fmt.Errorf("A %q snapshot must be specified", param))
+		}
+
+		snapInst, err := instance.LoadByProjectAndName(d.State(), projectParam(r), instName+shared.SnapshotDelimiter+snapName)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		render, _, err := snapInst.Render()
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		snapshot, ok := render.(*api.InstanceSnapshot)
+		if !ok {
+			return response.InternalError(fmt.Errorf("Unexpected render of snapshot %q", snapInst.Name()))
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return response.SyncResponse(true, instance.SnapshotConfigDiff(snapshots[0], snapshots[1]))
 }
 
-type internalImageOptimizePost struct {
-	Image api.Image `json:"image" yaml:"image"`
-	Pool  string    `json:"pool" yaml:"pool"`
+// internalInstanceSnapshotsInfo returns the metadata of the snapshots of an instance, their database records
+// cross-referenced with the on-disk metadata listed by the pool.
+func internalInstanceSnapshotsInfo(d *Daemon, r *http.Request) response.Response {
+	instName, err := url.PathUnescape(mux.Vars(r)["name"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	inst, err := instance.LoadByProjectAndName(d.State(), projectParam(r), instName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByInstance(d.State(), inst)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	snapshots, err := pool.GetInstanceSnapshotsInfo(inst)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, snapshots)
 }
 
-type internalWarningCreatePost struct {
-	Location       string `json:"location" yaml:"location"`
-	Project        string `json:"project" yaml:"project"`
-	EntityTypeCode int    `json:"entity_type_code" yaml:"entity_type_code"`
-	EntityID       int    `json:"entity_id" yaml:"entity_id"`
-	TypeCode       int    `json:"type_code" yaml:"type_code"`
-	Message        string `json:"message" yaml:"message"`
+// internalInstanceImageDiff starts an operation comparing the volume of a container with the volume of the image it
+// was created from. The paths added, modified and deleted since are reported in the "diff" field of the operation
+// metadata.
+func internalInstanceImageDiff(d *Daemon, r *http.Request) response.Response {
+	s := d.State()
+
+	projectName := projectParam(r)
+	instName, err := url.PathUnescape(mux.Vars(r)["name"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	inst, err := instance.LoadByProjectAndName(s, projectName, instName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if inst.Type() != instancetype.Container {
+		return response.BadRequest(fmt.Errorf("Only containers can be compared with their image"))
+	}
+
+	pool, err := storagePools.LoadByInstance(s, inst)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	run := func(op *operations.Operation) error {
+		diff, err := pool.DiffInstanceWithImage(inst, op)
+		if err != nil {
+			return err
+		}
+
+		_ = op.UpdateMetadata(map[string]any{"diff": diff})
+
+		return nil
+	}
+
+	resources := map[string][]string{}
+	resources["instances"] = []string{instName}
+
+	op, err := operations.OperationCreate(s, projectName, operations.OperationClassTask, operationtype.InstanceImageDiff, resources, nil, run, nil, nil, r)
+	if err != nil {
+		return response.InternalError(err)
+	}
+
+	return operations.OperationResponse(op)
 }
 
-// internalCreateWarning creates a warning, and is used for testing only.
-func internalCreateWarning(d *Daemon, r *http.Request) response.Response {
-	body, err := io.ReadAll(r.Body)
+// internalInstanceSnapshotsOverdue lists the instances of the project missing their scheduled snapshots.
+func internalInstanceSnapshotsOverdue(d *Daemon, r *http.Request) response.Response {
+	overdue, err := overdueInstanceSnapshots(d.State(), projectParam(r), time.Now())
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, overdue)
+}
+
+// internalInstanceSnapshotsDelete starts an operation deleting a set of instance snapshots together. All of them
+// are checked to be deletable first, nothing being deleted otherwise.
+func internalInstanceSnapshotsDelete(d *Daemon, r *http.Request) response.Response {
+	s := d.State()
+
+	req := internalInstanceSnapshotsDeletePost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	if len(req.Snapshots) == 0 {
+		return response.BadRequest(fmt.Errorf("No snapshots specified"))
+	}
+
+	run := func(op *operations.Operation) error {
+		return deleteInstanceSnapshotsAtomically(s, req.Project, req.Snapshots)
+	}
+
+	resources := map[string][]string{}
+	for _, name := range req.Snapshots {
+		parentName, _, _ := api.GetParentAndSnapshotName(name)
+		if !shared.StringInSlice(parentName, resources["instances"]) {
+			resources["instances"] = append(resources["instances"], parentName)
+		}
+	}
+
+	op, err := operations.OperationCreate(s, req.Project, operations.OperationClassTask, operationtype.SnapshotDelete, resources, nil, run, nil, nil, r)
 	if err != nil {
 		return response.InternalError(err)
 	}
 
-	rdr1 := io.NopCloser(bytes.NewBuffer(body))
-	rdr2 := io.NopCloser(bytes.NewBuffer(body))
+	return operations.OperationResponse(op)
+}
 
-	reqRaw := shared.Jmap{}
-	err = json.NewDecoder(rdr1).Decode(&reqRaw)
+// internalSnapshotGroupCreate starts an operation taking a snapshot of the same name of a group of instances and
+// custom volumes, all of them being frozen so that the snapshots are consistent with each other.
+func internalSnapshotGroupCreate(d *Daemon, r *http.Request) response.Response {
+	s := d.State()
+
+	req := internalSnapshotGroupPost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		return response.BadRequest(err)
 	}
 
-	req := internalWarningCreatePost{}
-	err = json.NewDecoder(rdr2).Decode(&req)
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	err = validate.IsURLSegmentSafe(req.Name)
+	if err != nil {
+		return response.BadRequest(fmt.Errorf("Invalid snapshot name: %w", err))
+	}
+
+	if len(req.Instances)+len(req.Volumes) < 2 {
+		return response.BadRequest(fmt.Errorf("Snapshot groups need at least two members"))
+	}
+
+	err = s.DB.Cluster.Transaction(r.Context(), func(ctx context.Context, tx *db.ClusterTx) error {
+		dbProject, err := cluster.GetProject(ctx, tx.Tx(), req.Project)
+		if err != nil {
+			return err
+		}
+
+		p, err := dbProject.ToAPI(ctx, tx.Tx())
+		if err != nil {
+			return err
+		}
+
+		return project.AllowSnapshotCreation(p)
+	})
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	now := time.Now()
+	members := make([]snapshotGroupMember, 0, len(req.Instances)+len(req.Volumes))
+	instMembers := make([]*instanceSnapshotGroupMember, 0, len(req.Instances))
+	volMembers := make([]*volumeSnapshotGroupMember, 0, len(req.Volumes))
+
+	resources := map[string][]string{}
+
+	for _, name := range req.Instances {
+		inst, err := instance.LoadByProjectAndName(s, req.Project, name)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		expiry, err := shared.GetExpiry(now, inst.ExpandedConfig()["snapshots.expiry"])
+		if err != nil {
+			return response.BadRequest(err)
+		}
+
+		member := &instanceSnapshotGroupMember{s: s, inst: inst, expiry: expiry}
+		instMembers = append(instMembers, member)
+		members = append(members, member)
+		resources["instances"] = append(resources["instances"], name)
+	}
+
+	volProjectName, err := project.StorageVolumeProject(s.DB.Cluster, req.Project, db.StoragePoolVolumeTypeCustom)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	for _, vol := range req.Volumes {
+		pool, err := storagePools.LoadByName(s, vol.Pool)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		dbVol, err := storagePools.VolumeDBGet(pool, volProjectName, vol.Name, storageDrivers.VolumeTypeCustom)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		expiry, err := shared.GetExpiry(now, dbVol.Config["snapshots.expiry"])
+		if err != nil {
+			return response.BadRequest(err)
+		}
+
+		member := &volumeSnapshotGroupMember{pool: pool, projectName: volProjectName, volName: vol.Name, expiry: expiry}
+		volMembers = append(volMembers, member)
+		members = append(members, member)
+		resources["storage_volumes"] = append(resources["storage_volumes"], fmt.Sprintf("%s/volumes/custom/%s", vol.Pool, vol.Name))
+	}
+
+	run := func(op *operations.Operation) error {
+		for _, member := range instMembers {
+			member.inst.SetOperation(op)
+		}
+
+		for _, member := range volMembers {
+			member.op = op
+		}
+
+		return snapshotGroupCreate(members, req.Name)
+	}
+
+	op, err := operations.OperationCreate(s, req.Project, operations.OperationClassTask, operationtype.SnapshotCreate, resources, nil, run, nil, nil, r)
+	if err != nil {
+		return response.InternalError(err)
+	}
+
+	return operations.OperationResponse(op)
+}
+
+// internalInstanceImportTrees starts an operation importing each subdirectory of a directory of the host as a new
+// container whose rootfs is a copy of it. The result of each import is reported in the operation metadata.
+func internalInstanceImportTrees(d *Daemon, r *http.Request) response.Response {
+	s := d.State()
+
+	req := internalInstanceImportTreesPost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		return response.BadRequest(err)
 	}
 
-	req.EntityTypeCode, _ = reqRaw.GetInt("entity_type_code")
-	req.EntityID, _ = reqRaw.GetInt("entity_id")
+	if req.Project == "" {
+		req.Project = project.Default
+	}
 
-	// Check if the entity exists, and fail if it doesn't.
-	_, ok := cluster.EntityNames[req.EntityTypeCode]
-	if req.EntityTypeCode != -1 && !ok {
-		return response.SmartError(fmt.Errorf("Invalid entity type"))
+	if !filepath.IsAbs(req.Source) || !shared.IsDir(req.Source) {
+		return response.BadRequest(fmt.Errorf("Import source %q must be an absolute path to a directory", req.Source))
 	}
 
-	err = d.db.Cluster.UpsertWarning(req.Location, req.Project, req.EntityTypeCode, req.EntityID, warningtype.Type(req.TypeCode), req.Message)
+	if req.Parallelism < 0 {
+		return response.BadRequest(fmt.Errorf("Invalid parallelism %d", req.Parallelism))
+	}
+
+	var profiles []api.Profile
+	if req.Profiles != nil {
+		profiles, err = s.DB.Cluster.GetProfiles(req.Project, req.Profiles)
+		if err != nil {
+			return response.BadRequest(err)
+		}
+	}
+
+	run := func(op *operations.Operation) error {
+		results, err := instanceImportTrees(d, req.Project, req.Source, profiles, req.Parallelism)
+		if err != nil {
+			return err
+		}
+
+		_ = op.UpdateMetadata(map[string]any{"results": results})
+
+		failed := 0
+		for _, result := range results {
+			if result.Error != "" {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("Failed importing %d of %d trees", failed, len(results))
+		}
+
+		return nil
+	}
+
+	op, err := operations.OperationCreate(s, req.Project, operations.OperationClassTask, operationtype.InstanceCreate, nil, nil, run, nil, nil, r)
 	if err != nil {
-		return response.SmartError(fmt.Errorf("Failed to create warning: %w", err))
+		return response.InternalError(err)
 	}
 
-	return response.EmptySyncResponse
+	return operations.OperationResponse(op)
+}
+
+// internalInstanceImportStream starts an operation creating a container from the native send stream of its root
+// volume served at an HTTP(S) URL, such as by a remote image server, verifying its checksum.
+func internalInstanceImportStream(d *Daemon, r *http.Request) response.Response {
+	s := d.State()
+
+	req := internalInstanceImportStreamPost{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if req.Project == "" {
+		req.Project = project.Default
+	}
+
+	if req.Name == "" || req.URL == "" || req.Checksum == "" {
+		return response.BadRequest(fmt.Errorf("An instance name, stream URL and checksum must be specified"))
+	}
+
+	// Pre-fill default profile.
+	if req.Profiles == nil {
+		req.Profiles = []string{"default"}
+	}
+
+	_, err = s.DB.Cluster.GetProfiles(req.Project, req.Profiles)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	run := func(op *operations.Operation) error {
+		return instanceImportStream(d, req.Project, req.Name, req.URL, req.Checksum, req.Profiles, op)
+	}
+
+	resources := map[string][]string{}
+	resources["instances"] = []string{req.Name}
+
+	op, err := operations.OperationCreate(s, req.Project, operations.OperationClassTask, operationtype.InstanceCreate, resources, nil, run, nil, nil, r)
+	if err != nil {
+		return response.InternalError(err)
+	}
+
+	return operations.OperationResponse(op)
 }
 
 func internalOptimizeImage(d *Daemon, r *http.Request) response.Response {
@@ -601,6 +2052,12 @@ func internalImportFromBackup(d *Daemon, projectName string, instName string, fo
 			volStorageName := project.Instance(projectName, instName)
 			instanceMntPoint := storageDrivers.GetVolumeMountPath(poolName, volType, volStorageName)
 
+			// Use the volume layout of the pool if it is still known.
+			pool, err := storagePools.LoadByName(d.State(), poolName)
+			if err == nil {
+				instanceMntPoint = pool.GetVolume(volType, storageDrivers.ContentTypeFS, volStorageName, nil).MountPath()
+			}
+
 			if shared.PathExists(instanceMntPoint) {
 				instanceMountPoints = append(instanceMountPoints, instanceMntPoint)
 				instancePoolName = poolName
@@ -889,9 +2346,10 @@ func internalImportFromBackup(d *Daemon, projectName string, instName string, fo
 
 		// Recreate missing mountpoints and symlinks.
 		volStorageName := project.Instance(projectName, snapInstName)
-		snapshotMountPoint := storageDrivers.GetVolumeMountPath(instancePoolName, instanceVolType, volStorageName)
+		snapVol := pool.GetVolume(instanceVolType, storageDrivers.ContentTypeFS, volStorageName, nil)
+		snapshotMountPoint := snapVol.MountPath()
 		snapshotPath := storagePools.InstancePath(instanceType, projectName, backupConf.Container.Name, true)
-		snapshotTargetPath := storageDrivers.GetVolumeSnapshotDir(instancePoolName, instanceVolType, volStorageName)
+		snapshotTargetPath := snapVol.SnapshotsDir()
 
 		err = storagePools.CreateSnapshotMountpoint(snapshotMountPoint, snapshotTargetPath, snapshotPath)
 		if err != nil {
@@ -24,6 +24,7 @@ import (
 	"github.com/lxc/lxd/lxd/request"
 	"github.com/lxc/lxd/lxd/response"
 	"github.com/lxc/lxd/lxd/state"
+	storagePools "github.com/lxc/lxd/lxd/storage"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
@@ -967,6 +968,11 @@ func projectStateGet(d *Daemon, r *http.Request) response.Response {
 		return response.SmartError(err)
 	}
 
+	state.StorageUsage, err = storagePools.ProjectStorageUsage(d.State(), name)
+	if err != nil {
+		logger.Warn("Failed getting project storage usage", logger.Ctx{"project": name, "err": err})
+	}
+
 	return response.SyncResponse(true, &state)
 }
 
@@ -1091,8 +1097,9 @@ func projectValidateConfig(s *state.State, config map[string]string) error {
 		"restricted.networks.subnets": validate.Optional(func(value string) error {
 			return projectValidateRestrictedSubnets(s, value)
 		}),
-		"restricted.networks.zones": validate.IsListOf(validate.IsAny),
-		"restricted.snapshots":      isEitherAllowOrBlock,
+		"restricted.networks.zones":  validate.IsListOf(validate.IsAny),
+		"restricted.snapshots":       isEitherAllowOrBlock,
+		"snapshots.min_per_instance": validate.Optional(validate.IsUint32),
 	}
 
 	for k, v := range config {
@@ -702,6 +702,68 @@ func (cg *CGroup) SetBlkioLimit(dev string, oType string, uType string, limit in
 	return ErrUnknownVersion
 }
 
+// SetBlkioLimits sets the read and write limits for a device at once. Limits of 0 are left untouched, so that the
+// limits set on the device by others aren't overridden, and negative limits are removed.
+func (cg *CGroup) SetBlkioLimits(dev string, readBps int64, readIops int64, writeBps int64, writeIops int64) error {
+	limits := []struct {
+		v1Key string
+		v2Key string
+		value int64
+	}{
+		{"blkio.throttle.read_bps_device", "rbps", readBps},
+		{"blkio.throttle.read_iops_device", "riops", readIops},
+		{"blkio.throttle.write_bps_device", "wbps", writeBps},
+		{"blkio.throttle.write_iops_device", "wiops", writeIops},
+	}
+
+	version := cgControllers["blkio"]
+	switch version {
+	case Unavailable:
+		return ErrControllerMissing
+	case V1:
+		for _, limit := range limits {
+			if limit.value == 0 {
+				continue
+			}
+
+			// A limit of 0 removes it.
+			value := limit.value
+			if value < 0 {
+				value = 0
+			}
+
+			err := cg.rw.Set(version, "blkio", limit.v1Key, fmt.Sprintf("%s %d", dev, value))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case V2:
+		values := []string{}
+		for _, limit := range limits {
+			if limit.value == 0 {
+				continue
+			}
+
+			value := "max"
+			if limit.value > 0 {
+				value = fmt.Sprintf("%d", limit.value)
+			}
+
+			values = append(values, fmt.Sprintf("%s=%s", limit.v2Key, value))
+		}
+
+		if len(values) == 0 {
+			return nil
+		}
+
+		return cg.rw.Set(version, "io", "io.max", fmt.Sprintf("%s %s", dev, strings.Join(values, " ")))
+	}
+
+	return ErrUnknownVersion
+}
+
 // SetCPUShare sets the weight of each group in the same hierarchy.
 func (cg *CGroup) SetCPUShare(limit int64) error {
 	version := cgControllers["cpu"]
@@ -0,0 +1,55 @@
+package cgroup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingReadWriter records the values written to the cgroup.
+type recordingReadWriter struct {
+	values map[string][]string
+}
+
+func (rw *recordingReadWriter) Get(version Backend, controller string, key string) (string, error) {
+	return "", nil
+}
+
+func (rw *recordingReadWriter) Set(version Backend, controller string, key string, value string) error {
+	rw.values[key] = append(rw.values[key], value)
+	return nil
+}
+
+func TestSetBlkioLimits(t *testing.T) {
+	defer func(controllers map[string]Backend) { cgControllers = controllers }(cgControllers)
+
+	rw := &recordingReadWriter{values: map[string][]string{}}
+	cg, err := New(rw)
+	require.NoError(t, err)
+
+	cgControllers = map[string]Backend{"blkio": V2}
+
+	// Unset limits are left untouched and negative ones are removed.
+	err = cg.SetBlkioLimits("7:0", 10485760, 0, -1, 200)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"7:0 rbps=10485760 wbps=max wiops=200"}, rw.values["io.max"])
+
+	err = cg.SetBlkioLimits("7:0", 0, 0, 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, rw.values["io.max"], 1)
+
+	cgControllers = map[string]Backend{"blkio": V1}
+
+	err = cg.SetBlkioLimits("8:16", 10485760, 0, -1, 200)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"8:16 10485760"}, rw.values["blkio.throttle.read_bps_device"])
+	assert.Empty(t, rw.values["blkio.throttle.read_iops_device"])
+	assert.Equal(t, []string{"8:16 0"}, rw.values["blkio.throttle.write_bps_device"])
+	assert.Equal(t, []string{"8:16 200"}, rw.values["blkio.throttle.write_iops_device"])
+
+	cgControllers = map[string]Backend{}
+
+	err = cg.SetBlkioLimits("8:0", 1, 1, 1, 1)
+	assert.ErrorIs(t, err, ErrControllerMissing)
+}
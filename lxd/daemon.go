@@ -1583,6 +1583,9 @@ func (d *Daemon) init() error {
 		// Remove expired custom volume snapshots (minutely)
 		d.tasks.Add(pruneExpireCustomVolumeSnapshotsTask(d))
 
+		// Archive old custom volume snapshots (hourly)
+		d.tasks.Add(archiveCustomVolumeSnapshotsTask(d))
+
 		// Take snapshot of custom volumes (minutely check of configurable cron expression)
 		d.tasks.Add(autoCreateCustomVolumeSnapshotsTask(d))
 
@@ -1594,6 +1597,9 @@ func (d *Daemon) init() error {
 
 		// Remove expired tokens (hourly)
 		d.tasks.Add(autoRemoveExpiredTokensTask(d))
+
+		// Sample storage pool usage (minutely check of configurable interval)
+		d.tasks.Add(storagePoolsUsageHistoryTask(d))
 	}
 
 	// Start all background tasks
@@ -192,7 +192,7 @@ func daemonStorageValidate(s *state.State, target string) error {
 
 	// Validate volume is empty (ignore lost+found).
 	volStorageName := project.StorageVolume(project.Default, volumeName)
-	mountpoint := storageDrivers.GetVolumeMountPath(poolName, storageDrivers.VolumeTypeCustom, volStorageName)
+	mountpoint := pool.GetVolume(storageDrivers.VolumeTypeCustom, storageDrivers.ContentTypeFS, volStorageName, nil).MountPath()
 
 	entries, err := os.ReadDir(mountpoint)
 	if err != nil {
@@ -316,7 +316,7 @@ func daemonStorageMove(s *state.State, storageType string, target string) error
 
 	// Set ownership & mode.
 	volStorageName := project.StorageVolume(project.Default, volumeName)
-	mountpoint := storageDrivers.GetVolumeMountPath(poolName, storageDrivers.VolumeTypeCustom, volStorageName)
+	mountpoint := pool.GetVolume(storageDrivers.VolumeTypeCustom, storageDrivers.ContentTypeFS, volStorageName, nil).MountPath()
 	destPath = mountpoint
 
 	err = os.Chmod(mountpoint, 0700)
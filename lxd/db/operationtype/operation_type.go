@@ -69,6 +69,11 @@ const (
 	RemoveOrphanedOperations
 	RenewServerCertificate
 	RemoveExpiredTokens
+	StoragePoolRebalance
+	CustomVolumeSnapshotsArchive
+	StoragePoolVerifyMounts
+	InstanceImageDiff
+	SnapshotIndex
 )
 
 // Description return a human-readable description of the operation type.
@@ -188,6 +193,16 @@ func (t Type) Description() string {
 		return "Renewing server certificate"
 	case RemoveExpiredTokens:
 		return "Remove expired tokens"
+	case StoragePoolRebalance:
+		return "Rebalancing storage pool"
+	case CustomVolumeSnapshotsArchive:
+		return "Archiving volume snapshots"
+	case StoragePoolVerifyMounts:
+		return "Verifying storage pool volumes mount"
+	case InstanceImageDiff:
+		return "Comparing instance with its image"
+	case SnapshotIndex:
+		return "Indexing instance snapshot"
 	default:
 		return "Executing operation"
 	}
@@ -259,6 +274,8 @@ func (t Type) Permission() string {
 
 	case CustomVolumeSnapshotsExpire:
 		return "operate-volumes"
+	case CustomVolumeSnapshotsArchive:
+		return "operate-volumes"
 	case CustomVolumeBackupCreate:
 		return "manage-storage-volumes"
 	case CustomVolumeBackupRemove:
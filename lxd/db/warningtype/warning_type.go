@@ -58,6 +58,8 @@ const (
 	StoragePoolUnvailable
 	// UnableToUpdateClusterCertificate represents the unable to update cluster certificate warning.
 	UnableToUpdateClusterCertificate
+	// StoragePoolDeviceErrors represents errors reported by the devices backing a storage pool.
+	StoragePoolDeviceErrors
 )
 
 // TypeNames associates a warning code to its name.
@@ -88,6 +90,7 @@ var TypeNames = map[Type]string{
 	InstanceTypeNotOperational:             "Instance type not operational",
 	StoragePoolUnvailable:                  "Storage pool unavailable",
 	UnableToUpdateClusterCertificate:       "Unable to update cluster certificate",
+	StoragePoolDeviceErrors:                "Storage pool device errors",
 }
 
 // Severity returns the severity of the warning type.
@@ -145,6 +148,8 @@ func (t Type) Severity() Severity {
 		return SeverityHigh
 	case UnableToUpdateClusterCertificate:
 		return SeverityLow
+	case StoragePoolDeviceErrors:
+		return SeverityHigh
 	}
 
 	return SeverityLow
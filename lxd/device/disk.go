@@ -9,7 +9,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -31,7 +30,6 @@ import (
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/logger"
-	"github.com/lxc/lxd/shared/units"
 	"github.com/lxc/lxd/shared/validate"
 )
 
@@ -1184,7 +1182,7 @@ func (d *disk) mountPoolVolume() (func(), string, error) {
 	}
 
 	volStorageName := project.StorageVolume(storageProjectName, volumeName)
-	srcPath = storageDrivers.GetVolumeMountPath(d.config["pool"], storageDrivers.VolumeTypeCustom, volStorageName)
+	srcPath = d.pool.GetVolume(storageDrivers.VolumeTypeCustom, storageDrivers.ContentTypeFS, volStorageName, nil).MountPath()
 
 	err = d.pool.MountCustomVolume(storageProjectName, volumeName, nil)
 	if err != nil {
@@ -1810,37 +1808,12 @@ func (d *disk) getDiskLimits() (map[string]diskBlockLimit, error) {
 }
 
 func (d *disk) parseDiskLimit(readSpeed string, writeSpeed string) (int64, int64, int64, int64, error) {
-	parseValue := func(value string) (int64, int64, error) {
-		var err error
-
-		bps := int64(0)
-		iops := int64(0)
-
-		if value == "" {
-			return bps, iops, nil
-		}
-
-		if strings.HasSuffix(value, "iops") {
-			iops, err = strconv.ParseInt(strings.TrimSuffix(value, "iops"), 10, 64)
-			if err != nil {
-				return -1, -1, err
-			}
-		} else {
-			bps, err = units.ParseByteSizeString(value)
-			if err != nil {
-				return -1, -1, err
-			}
-		}
-
-		return bps, iops, nil
-	}
-
-	readBps, readIops, err := parseValue(readSpeed)
+	readBps, readIops, err := shared.ParseDiskLimit(readSpeed)
 	if err != nil {
 		return -1, -1, -1, -1, err
 	}
 
-	writeBps, writeIops, err := parseValue(writeSpeed)
+	writeBps, writeIops, err := shared.ParseDiskLimit(writeSpeed)
 	if err != nil {
 		return -1, -1, -1, -1, err
 	}
@@ -17,6 +17,7 @@ import (
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/instance/operationlock"
+	"github.com/lxc/lxd/lxd/node"
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/revert"
@@ -515,8 +516,9 @@ func autoCreateInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 				continue
 			}
 
-			// Check if snapshot is scheduled.
-			if !snapshotIsScheduledNow(schedule, int64(inst.ID())) {
+			// Check if snapshot is scheduled, or was refused by snapshots.create_rate on the previous run.
+			retry := scheduledSnapshotRetryTake(inst.ID())
+			if !retry && !snapshotIsScheduledNow(schedule, int64(inst.ID())) {
 				continue
 			}
 
@@ -533,7 +535,7 @@ func autoCreateInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 		}
 
 		opRun := func(op *operations.Operation) error {
-			return autoCreateInstanceSnapshots(ctx, d, instances)
+			return autoCreateInstanceSnapshots(ctx, d, instances, op)
 		}
 
 		op, err := operations.OperationCreate(s, "", operations.OperationClassTask, operationtype.SnapshotCreate, nil, nil, opRun, nil, nil, nil)
@@ -568,42 +570,143 @@ func autoCreateInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	return f, schedule
 }
 
-func autoCreateInstanceSnapshots(ctx context.Context, d *Daemon, instances []instance.Instance) error {
+func autoCreateInstanceSnapshots(ctx context.Context, d *Daemon, instances []instance.Instance, op *operations.Operation) error {
+	s := d.State()
+
+	var concurrency int64
+	err := s.DB.Node.Transaction(ctx, func(ctx context.Context, tx *db.NodeTx) error {
+		nodeConfig, err := node.ConfigLoad(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		concurrency = nodeConfig.StorageSnapshotsConcurrency()
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed loading member configuration: %w", err)
+	}
+
+	// Get the pool of each instance, so that the concurrency applies per pool.
+	pools := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		poolName, err := inst.StoragePool()
+		if err != nil {
+			logger.Warn("Failed getting instance storage pool for snapshot task", logger.Ctx{"project": inst.Project().Name, "instance": inst.Name(), "err": err})
+		}
+
+		pools = append(pools, poolName)
+	}
+
 	// Make the snapshots.
+	result := runScheduledSnapshots(ctx, pools, int(concurrency), func(i int) error {
+		inst := instances[i]
+		l := logger.AddContext(logger.Log, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+
+		snapshotName, err := instance.NextSnapshotName(s, inst, "snap%d")
+		if err != nil {
+			l.Error("Error retrieving next snapshot name", logger.Ctx{"err": err})
+			return err
+		}
+
+		expiry, err := shared.GetExpiry(time.Now(), inst.ExpandedConfig()["snapshots.expiry"])
+		if err != nil {
+			l.Error("Error getting expiry date", logger.Ctx{"err": err})
+			return err
+		}
+
+		err = snapshotWithConsistency(inst, func() error {
+			return inst.Snapshot(snapshotName, expiry, false)
+		})
+		if errors.Is(err, storagePools.ErrRateLimited) {
+			l.Warn("Scheduled snapshot refused by snapshots.create_rate, retrying on the next run", logger.Ctx{"err": err})
+			scheduledSnapshotRetryAdd(inst.ID())
+			return err
+		} else if err != nil {
+			l.Error("Error creating snapshots", logger.Ctx{"err": err})
+			return err
+		}
+
+		return nil
+	})
+
+	logger.Info("Created scheduled instance snapshots", logger.Ctx{"created": result.Created, "failed": result.Failed, "rateLimited": result.RateLimited, "skipped": result.Skipped})
+
+	if op != nil {
+		_ = op.UpdateMetadata(map[string]any{"created": result.Created, "failed": result.Failed, "rate_limited": result.RateLimited, "skipped": result.Skipped})
+	}
+
+	return nil
+}
+
+// instanceSnapshotsOverdue is an instance missing its scheduled snapshots.
+type instanceSnapshotsOverdue struct {
+	Project      string     `json:"project" yaml:"project"`
+	Name         string     `json:"name" yaml:"name"`
+	Schedule     string     `json:"schedule" yaml:"schedule"`
+	LastSnapshot *time.Time `json:"last_snapshot" yaml:"last_snapshot"` // Nil if the instance has no snapshots.
+	ExpectedAt   time.Time  `json:"expected_at" yaml:"expected_at"`
+}
+
+// overdueInstanceSnapshots returns the instances of the project on this member whose latest snapshot (or their
+// creation if they have none) predates the last time their snapshot schedule should have created one at now.
+// Instances the snapshot task skips, such as stopped instances not scheduled while stopped, aren't reported.
+func overdueInstanceSnapshots(s *state.State, projectName string, now time.Time) ([]instanceSnapshotsOverdue, error) {
+	instances, err := instanceLoadNodeProjectAll(s, projectName, instancetype.Any)
+	if err != nil {
+		return nil, err
+	}
+
+	overdue := []instanceSnapshotsOverdue{}
 	for _, inst := range instances {
-		ch := make(chan error)
-		go func(inst instance.Instance) {
-			l := logger.AddContext(logger.Log, logger.Ctx{"project": inst.Project(), "instance": inst.Name()})
+		schedule := inst.ExpandedConfig()["snapshots.schedule"]
+		if schedule == "" {
+			continue
+		}
 
-			snapshotName, err := instance.NextSnapshotName(d.State(), inst, "snap%d")
-			if err != nil {
-				l.Error("Error retrieving next snapshot name", logger.Ctx{"err": err})
-				ch <- nil
-				return
-			}
+		p := inst.Project()
+		if project.AllowSnapshotCreation(&p) != nil {
+			continue
+		}
 
-			expiry, err := shared.GetExpiry(time.Now(), inst.ExpandedConfig()["snapshots.expiry"])
-			if err != nil {
-				logger.Error("Error getting expiry date")
-				ch <- nil
-				return
-			}
+		if shared.IsFalseOrEmpty(inst.ExpandedConfig()["snapshots.schedule.stopped"]) && !inst.IsRunning() {
+			continue
+		}
 
-			err = inst.Snapshot(snapshotName, expiry, false)
-			if err != nil {
-				logger.Error("Error creating snapshots", logger.Ctx{"err": err})
+		snapshots, err := inst.Snapshots()
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading snapshots of instance %q: %w", inst.Name(), err)
+		}
+
+		var lastSnapshot *time.Time
+		for _, snap := range snapshots {
+			createdAt := snap.CreationDate()
+			if lastSnapshot == nil || createdAt.After(*lastSnapshot) {
+				lastSnapshot = &createdAt
 			}
+		}
 
-			ch <- nil
-		}(inst)
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ch:
+		last := inst.CreationDate()
+		if lastSnapshot != nil {
+			last = *lastSnapshot
+		}
+
+		expectedAt, isOverdue := snapshotScheduleOverdue(schedule, int64(inst.ID()), last, now)
+		if !isOverdue {
+			continue
 		}
+
+		overdue = append(overdue, instanceSnapshotsOverdue{
+			Project:      inst.Project().Name,
+			Name:         inst.Name(),
+			Schedule:     schedule,
+			LastSnapshot: lastSnapshot,
+			ExpectedAt:   expectedAt,
+		})
 	}
 
-	return nil
+	return overdue, nil
 }
 
 func pruneExpiredInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
@@ -680,6 +783,26 @@ func pruneExpiredInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 			return
 		}
 
+		// Add the snapshots which aren't kept by their instance's retention policy.
+		retentionSnapshots, err := getRetentionExpiredInstanceSnapshots(s, time.Now())
+		if err != nil {
+			logger.Error("Failed getting instance snapshots outside of retention policy", logger.Ctx{"err": err})
+		}
+
+		for _, retentionSnapshot := range retentionSnapshots {
+			found := false
+			for _, expiredSnapshot := range expiredSnapshotInstances {
+				if expiredSnapshot.ID() == retentionSnapshot.ID() {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				expiredSnapshotInstances = append(expiredSnapshotInstances, retentionSnapshot)
+			}
+		}
+
 		// Skip if no expired snapshots.
 		if len(expiredSnapshotInstances) == 0 {
 			return
@@ -721,6 +844,50 @@ func pruneExpiredInstanceSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	return f, schedule
 }
 
+// getRetentionExpiredInstanceSnapshots returns the snapshots of local instances which aren't kept by the
+// instance's snapshots.retention policy at the given time.
+func getRetentionExpiredInstanceSnapshots(s *state.State, now time.Time) ([]instance.Instance, error) {
+	instances, err := instance.LoadNodeAll(s, instancetype.Any)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiredSnapshots []instance.Instance
+	for _, inst := range instances {
+		if inst.IsSnapshot() {
+			continue
+		}
+
+		rules, err := shared.ParseSnapshotRetention(inst.ExpandedConfig()["snapshots.retention"])
+		if err != nil {
+			logger.Error("Invalid snapshot retention policy", logger.Ctx{"project": inst.Project().Name, "instance": inst.Name(), "err": err})
+			continue
+		}
+
+		if len(rules) == 0 {
+			continue
+		}
+
+		snapshots, err := inst.Snapshots()
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading snapshots of instance %q in project %q: %w", inst.Name(), inst.Project().Name, err)
+		}
+
+		entries := make([]shared.SnapshotRetentionEntry, 0, len(snapshots))
+		snapshotsByName := make(map[string]instance.Instance, len(snapshots))
+		for _, snapshot := range snapshots {
+			entries = append(entries, shared.SnapshotRetentionEntry{Name: snapshot.Name(), CreationDate: snapshot.CreationDate()})
+			snapshotsByName[snapshot.Name()] = snapshot
+		}
+
+		for _, name := range shared.SnapshotRetentionExpired(rules, entries, now) {
+			expiredSnapshots = append(expiredSnapshots, snapshotsByName[name])
+		}
+	}
+
+	return expiredSnapshots, nil
+}
+
 var instSnapshotsPruneRunning = sync.Map{}
 
 func pruneExpiredInstanceSnapshots(ctx context.Context, d *Daemon, snapshots []instance.Instance) error {
@@ -742,3 +909,81 @@ func pruneExpiredInstanceSnapshots(ctx context.Context, d *Daemon, snapshots []i
 
 	return nil
 }
+
+// deleteInstanceSnapshotsAtomically deletes the snapshots of the project, named "<instance>/<snapshot>", once all
+// of them were found to be deletable, so that snapshots which must go together (such as a step of a retention
+// policy) are either all deleted or none are.
+func deleteInstanceSnapshotsAtomically(s *state.State, projectName string, names []string) error {
+	snapshots := map[string]instance.Instance{}
+
+	check := func(names []string) error {
+		problems := []string{}
+		poolNames := []string{}
+		pools := map[string]storagePools.Pool{}
+		poolSnapshots := map[string][]instance.Instance{}
+
+		for _, name := range names {
+			if !shared.IsSnapshot(name) {
+				problems = append(problems, fmt.Sprintf("%q isn't a snapshot", name))
+				continue
+			}
+
+			snapshot, err := instance.LoadByProjectAndName(s, projectName, name)
+			if err != nil {
+				if api.StatusErrorCheck(err, http.StatusNotFound) {
+					problems = append(problems, fmt.Sprintf("Snapshot %q doesn't exist", name))
+					continue
+				}
+
+				return err
+			}
+
+			_, deleting := instSnapshotsPruneRunning.Load(snapshot.ID())
+			if deleting {
+				problems = append(problems, fmt.Sprintf("Snapshot %q is already being deleted", name))
+				continue
+			}
+
+			pool, err := storagePools.LoadByInstance(s, snapshot)
+			if err != nil {
+				return fmt.Errorf("Failed loading storage pool of snapshot %q: %w", name, err)
+			}
+
+			if pools[pool.Name()] == nil {
+				poolNames = append(poolNames, pool.Name())
+				pools[pool.Name()] = pool
+			}
+
+			poolSnapshots[pool.Name()] = append(poolSnapshots[pool.Name()], snapshot)
+			snapshots[name] = snapshot
+		}
+
+		if len(problems) > 0 {
+			return fmt.Errorf("None of the snapshots were deleted: %s", strings.Join(problems, "; "))
+		}
+
+		for _, poolName := range poolNames {
+			err := pools[poolName].CheckInstanceSnapshotsDelete(poolSnapshots[poolName], nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	remove := func(name string) error {
+		snapshot := snapshots[name]
+
+		_, loaded := instSnapshotsPruneRunning.LoadOrStore(snapshot.ID(), struct{}{})
+		if loaded {
+			return fmt.Errorf("Snapshot %q is already being deleted", name)
+		}
+
+		defer instSnapshotsPruneRunning.Delete(snapshot.ID())
+
+		return snapshot.Delete(false)
+	}
+
+	return storagePools.DeleteSnapshotsAtomically(names, check, remove)
+}
@@ -1194,6 +1194,19 @@ func (d *lxc) initLXC(config bool) error {
 		}
 	}
 
+	// Disk I/O limits, not preventing the instance from starting if the block device of its pool can't be found.
+	if d.expandedConfig["limits.disk.read"] != "" || d.expandedConfig["limits.disk.write"] != "" {
+		devs, err := d.poolDiskDevices()
+		if err != nil {
+			d.logger.Warn("Skipping disk I/O limits", logger.Ctx{"err": err})
+		} else {
+			err = d.setDiskIOLimits(cg, devs, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// Processes
 	if d.state.OS.CGInfo.Supports(cgroup.Pids, cg) {
 		processes := d.expandedConfig["limits.processes"]
@@ -3638,7 +3651,7 @@ func (d *lxc) delete(force bool) error {
 	} else if pool != nil {
 		if d.IsSnapshot() {
 			// Remove snapshot volume and database record.
-			err = pool.DeleteInstanceSnapshot(d, nil)
+			err = pool.DeleteInstanceSnapshot(d, force, nil)
 			if err != nil {
 				return err
 			}
@@ -3911,6 +3924,58 @@ func (d *lxc) CGroupSet(key string, value string) error {
 	return nil
 }
 
+// poolDiskDevices returns the "major:minor" of the disks backing the instance's storage pool.
+func (d *lxc) poolDiskDevices() ([]string, error) {
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return nil, err
+	}
+
+	devs, err := storageDrivers.PoolDiskDevices(pool.Name())
+	if err != nil {
+		return nil, fmt.Errorf("Failed resolving block devices of storage pool %q: %w", pool.Name(), err)
+	}
+
+	return devs, nil
+}
+
+// setDiskIOLimits applies limits.disk.read and limits.disk.write to each of devs, the disks backing the instance's
+// storage pool. Unset limits are left untouched (they may be set by disk devices) unless they were set in
+// oldConfig, in which case they are removed, so that it can be used to update the limits of a running instance.
+func (d *lxc) setDiskIOLimits(cg *cgroup.CGroup, devs []string, oldConfig map[string]string) error {
+	if !d.state.OS.CGInfo.Supports(cgroup.Blkio, cg) {
+		return fmt.Errorf("Cannot apply limits.disk.read and limits.disk.write as blkio cgroup controller is missing")
+	}
+
+	limits := make([]int64, 0, 4)
+	for _, key := range []string{"limits.disk.read", "limits.disk.write"} {
+		bps, iops, err := shared.ParseDiskLimit(d.expandedConfig[key])
+		if err != nil {
+			return fmt.Errorf("Invalid %s: %w", key, err)
+		}
+
+		oldBps, oldIops, _ := shared.ParseDiskLimit(oldConfig[key])
+		if bps == 0 && oldBps > 0 {
+			bps = -1
+		}
+
+		if iops == 0 && oldIops > 0 {
+			iops = -1
+		}
+
+		limits = append(limits, bps, iops)
+	}
+
+	for _, dev := range devs {
+		err := cg.SetBlkioLimits(dev, limits[0], limits[1], limits[2], limits[3])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Update applies updated config.
 func (d *lxc) Update(args db.InstanceArgs, userRequested bool) error {
 	// Setup a new operation
@@ -4317,6 +4382,16 @@ func (d *lxc) Update(args db.InstanceArgs, userRequested bool) error {
 				if err != nil {
 					return err
 				}
+			} else if key == "limits.disk.read" || key == "limits.disk.write" {
+				devs, err := d.poolDiskDevices()
+				if err != nil {
+					return err
+				}
+
+				err = d.setDiskIOLimits(cg, devs, oldExpandedConfig)
+				if err != nil {
+					return err
+				}
 			} else if key == "limits.memory" || strings.HasPrefix(key, "limits.memory.") {
 				// Skip if no memory CGroup
 				if !d.state.OS.CGInfo.Supports(cgroup.Memory, cg) {
@@ -7050,8 +7125,13 @@ func (d *lxc) getFSStats() (*metrics.MetricSet, error) {
 				volType = storageDrivers.VolumeTypeContainer
 			}
 
+			pool, err := storagePools.LoadByName(d.state, dev["pool"])
+			if err != nil {
+				continue
+			}
+
 			// Check that we have a mountpoint.
-			mountpoint := storageDrivers.GetVolumeMountPath(dev["pool"], volType, volName)
+			mountpoint := pool.GetVolume(volType, storageDrivers.ContentTypeFS, volName, nil).MountPath()
 			if mountpoint == "" || !shared.PathExists(mountpoint) {
 				continue
 			}
@@ -915,6 +915,73 @@ func (d *qemu) saveState(monitor *qmp.Monitor) error {
 	return nil
 }
 
+// qemuStateSaver pauses a running VM, saves its memory and CPU state and resumes it.
+type qemuStateSaver interface {
+	Pause() error
+	SaveState() error
+	Resume() error
+}
+
+// qemuMonitorStateSaver saves the state of a running VM to its state file through the QMP monitor.
+type qemuMonitorStateSaver struct {
+	d       *qemu
+	monitor *qmp.Monitor
+}
+
+// Pause stops the emulation.
+func (s *qemuMonitorStateSaver) Pause() error {
+	return s.monitor.Pause()
+}
+
+// SaveState dumps the state of the paused VM to its state file.
+func (s *qemuMonitorStateSaver) SaveState() error {
+	return s.d.saveState(s.monitor)
+}
+
+// Resume restarts the emulation and removes the state file from the main volume, the state only being kept in
+// the snapshot.
+func (s *qemuMonitorStateSaver) Resume() error {
+	err := s.monitor.Start()
+
+	removeErr := os.Remove(s.d.StatePath())
+	if err != nil {
+		return err
+	}
+
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+
+	return nil
+}
+
+// withSavedState pauses the VM and saves its state before running fn, so that the state and the disk snapshot
+// taken by fn are captured at the same point and a restore resumes from the exact running state. The VM is
+// always resumed before returning, including when pausing, saving the state or fn fail.
+func (d *qemu) withSavedState(saver qemuStateSaver, fn func() error) (err error) {
+	defer func() {
+		resumeErr := saver.Resume()
+		if resumeErr != nil {
+			d.logger.Error("Failed resuming VM", logger.Ctx{"err": resumeErr})
+			if err == nil {
+				err = fmt.Errorf("Failed resuming VM: %w", resumeErr)
+			}
+		}
+	}()
+
+	err = saver.Pause()
+	if err != nil {
+		return fmt.Errorf("Failed pausing VM: %w", err)
+	}
+
+	err = saver.SaveState()
+	if err != nil {
+		return fmt.Errorf("Failed saving VM state: %w", err)
+	}
+
+	return fn()
+}
+
 // validateStartup checks any constraints that would prevent start up from succeeding under normal circumstances.
 func (d *qemu) validateStartup(stateful bool) error {
 	// Because the root disk is special and is mounted before the root disk device is setup we duplicate the
@@ -2102,6 +2169,10 @@ func (d *qemu) monitorPath() string {
 	return filepath.Join(d.LogPath(), "qemu.monitor")
 }
 
+func (d *qemu) guestAgentPath() string {
+	return filepath.Join(d.LogPath(), "qemu.guest-agent")
+}
+
 func (d *qemu) nvramPath() string {
 	return filepath.Join(d.Path(), "qemu.nvram")
 }
@@ -2684,6 +2755,9 @@ func (d *qemu) generateQemuConfigFile(mountInfo *storagePools.MountInfo, busName
 
 	cfg = append(cfg, qemuSerial(&serialOpts)...)
 
+	// QEMU guest agent channel, used to freeze the guest filesystems during snapshots.
+	cfg = append(cfg, qemuGuestAgent(&qemuGuestAgentOpts{d.guestAgentPath()})...)
+
 	// s390x doesn't really have USB.
 	if d.architecture != osarch.ARCH_64BIT_S390_BIG_ENDIAN {
 		devBus, devAddr, multi = bus.allocate(busFunctionGroupGeneric)
@@ -4091,9 +4165,6 @@ func (d *qemu) IsPrivileged() bool {
 
 // Snapshot takes a new snapshot.
 func (d *qemu) Snapshot(name string, expiry time.Time, stateful bool) error {
-	var err error
-	var monitor *qmp.Monitor
-
 	// Deal with state.
 	if stateful {
 		// Confirm the instance has stateful migration enabled.
@@ -4107,39 +4178,25 @@ func (d *qemu) Snapshot(name string, expiry time.Time, stateful bool) error {
 		}
 
 		// Connect to the monitor.
-		monitor, err = qmp.Connect(d.monitorPath(), qemuSerialChardevName, d.getMonitorEventHandler())
+		monitor, err := qmp.Connect(d.monitorPath(), qemuSerialChardevName, d.getMonitorEventHandler())
 		if err != nil {
 			return err
 		}
 
-		// Dump the state.
-		err = d.saveState(monitor)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Create the snapshot.
-	err = d.snapshotCommon(d, name, expiry, stateful)
-	if err != nil {
-		return err
+		// Capture the state and the disk snapshot at the same point, resuming the VM whatever happens.
+		return d.withSavedState(&qemuMonitorStateSaver{d: d, monitor: monitor}, func() error {
+			return d.snapshotCommon(d, name, expiry, stateful)
+		})
 	}
 
-	// Resume the VM once the disk state has been saved.
-	if stateful {
-		// Remove the state from the main volume.
-		err = os.Remove(d.StatePath())
-		if err != nil {
-			return err
-		}
-
-		err = monitor.Start()
-		if err != nil {
-			return err
-		}
+	// Create the snapshot, with the guest filesystems frozen if the VM is running.
+	if d.IsRunning() {
+		return d.withFrozenFS(d.guestAgentFreezer, func() error {
+			return d.snapshotCommon(d, name, expiry, stateful)
+		})
 	}
 
-	return nil
+	return d.snapshotCommon(d, name, expiry, stateful)
 }
 
 // Restore restores an instance snapshot.
@@ -5119,7 +5176,7 @@ func (d *qemu) delete(force bool) error {
 	} else if pool != nil {
 		if d.IsSnapshot() {
 			// Remove snapshot volume and database record.
-			err = pool.DeleteInstanceSnapshot(d, nil)
+			err = pool.DeleteInstanceSnapshot(d, force, nil)
 			if err != nil {
 				return err
 			}
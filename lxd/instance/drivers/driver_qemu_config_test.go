@@ -708,6 +708,30 @@ func TestQemuConfigTemplates(t *testing.T) {
 		}
 	})
 
+	t.Run("qemu_guest_agent", func(t *testing.T) {
+		testCases := []struct {
+			opts     qemuGuestAgentOpts
+			expected string
+		}{{
+			qemuGuestAgentOpts{"/var/log/lxd/vm1/qemu.guest-agent"},
+			`# QEMU guest agent
+			[chardev "qemu_guest-agent-chardev"]
+			backend = "socket"
+			path = "/var/log/lxd/vm1/qemu.guest-agent"
+			server = "on"
+			wait = "off"
+
+			[device "qemu_guest-agent"]
+			driver = "virtserialport"
+			name = "org.qemu.guest_agent.0"
+			chardev = "qemu_guest-agent-chardev"
+			bus = "dev-qemu_serial.0"`,
+		}}
+		for _, tc := range testCases {
+			runTest(tc.expected, qemuGuestAgent(&tc.opts))
+		}
+	})
+
 	t.Run("qemu_drive_firmware", func(t *testing.T) {
 		testCases := []struct {
 			opts     qemuDriveFirmwareOpts
@@ -0,0 +1,209 @@
+package drivers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// qemuGuestAgentSyncTimeout is how long to wait for the guest agent to answer the initial sync.
+// It is kept short as most guests don't run the QEMU guest agent.
+var qemuGuestAgentSyncTimeout = 2 * time.Second
+
+// qemuGuestAgentCommandTimeout is how long to wait for the guest agent to answer a command.
+var qemuGuestAgentCommandTimeout = 30 * time.Second
+
+// qemuFSFreezer freezes and thaws the filesystems of a guest.
+type qemuFSFreezer interface {
+	FSFreeze() (int, error)
+	FSThaw() (int, error)
+	Close() error
+}
+
+// qemuGuestAgentClient is a minimal client for the QEMU guest agent protocol.
+type qemuGuestAgentClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type qemuGuestAgentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// qemuGuestAgentConnect connects to the guest agent socket and checks that the agent is responding.
+func qemuGuestAgentConnect(path string) (*qemuGuestAgentClient, error) {
+	conn, err := net.DialTimeout("unix", path, qemuGuestAgentSyncTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed connecting to guest agent: %w", err)
+	}
+
+	agent := newQemuGuestAgentClient(conn)
+
+	err = agent.sync()
+	if err != nil {
+		_ = agent.Close()
+		return nil, err
+	}
+
+	return agent, nil
+}
+
+// newQemuGuestAgentClient returns a guest agent client using an existing connection.
+func newQemuGuestAgentClient(conn net.Conn) *qemuGuestAgentClient {
+	return &qemuGuestAgentClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// sync discards any stale data left on the channel (e.g. from a previous client) by waiting for the response
+// to a guest-sync with a random identifier.
+func (a *qemuGuestAgentClient) sync() error {
+	id := rand.Int63()
+
+	err := a.send("guest-sync", map[string]any{"id": id}, qemuGuestAgentSyncTimeout)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := a.receive(qemuGuestAgentSyncTimeout)
+		if err != nil {
+			return fmt.Errorf("Guest agent not responding: %w", err)
+		}
+
+		var respID int64
+		err = json.Unmarshal(resp.Return, &respID)
+		if err == nil && respID == id {
+			return nil
+		}
+	}
+}
+
+// send writes a command to the guest agent.
+func (a *qemuGuestAgentClient) send(command string, args map[string]any, timeout time.Duration) error {
+	req := map[string]any{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	_ = a.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = a.conn.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("Failed sending %q to guest agent: %w", command, err)
+	}
+
+	return nil
+}
+
+// receive reads the next response from the guest agent.
+func (a *qemuGuestAgentClient) receive(timeout time.Duration) (*qemuGuestAgentResponse, error) {
+	_ = a.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := a.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	resp := qemuGuestAgentResponse{}
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid guest agent response %q: %w", string(line), err)
+	}
+
+	return &resp, nil
+}
+
+// execute runs a command on the guest agent and decodes its return value into out.
+func (a *qemuGuestAgentClient) execute(command string, out any) error {
+	err := a.send(command, nil, qemuGuestAgentCommandTimeout)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.receive(qemuGuestAgentCommandTimeout)
+	if err != nil {
+		return fmt.Errorf("Failed reading %q response from guest agent: %w", command, err)
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("Guest agent %q failed: %s: %s", command, resp.Error.Class, resp.Error.Desc)
+	}
+
+	if out != nil {
+		err = json.Unmarshal(resp.Return, out)
+		if err != nil {
+			return fmt.Errorf("Invalid guest agent %q return value: %w", command, err)
+		}
+	}
+
+	return nil
+}
+
+// FSFreeze freezes the guest filesystems and returns the number of filesystems frozen.
+func (a *qemuGuestAgentClient) FSFreeze() (int, error) {
+	var count int
+	err := a.execute("guest-fsfreeze-freeze", &count)
+	return count, err
+}
+
+// FSThaw thaws the guest filesystems and returns the number of filesystems thawed.
+func (a *qemuGuestAgentClient) FSThaw() (int, error) {
+	var count int
+	err := a.execute("guest-fsfreeze-thaw", &count)
+	return count, err
+}
+
+// Close closes the connection to the guest agent.
+func (a *qemuGuestAgentClient) Close() error {
+	return a.conn.Close()
+}
+
+// guestAgentFreezer connects to the guest agent of the running instance.
+func (d *qemu) guestAgentFreezer() (qemuFSFreezer, error) {
+	return qemuGuestAgentConnect(d.guestAgentPath())
+}
+
+// withFrozenFS runs fn with the guest filesystems frozen through the guest agent so that disk snapshots taken
+// by fn are consistent. If the guest agent is unavailable or the freeze fails, fn is still run resulting in a
+// crash-consistent snapshot. The filesystems are always thawed before returning.
+func (d *qemu) withFrozenFS(connect func() (qemuFSFreezer, error), fn func() error) (err error) {
+	freezer, err := connect()
+	if err != nil {
+		d.logger.Warn("Guest agent unavailable, snapshot will only be crash-consistent", logger.Ctx{"err": err})
+		return fn()
+	}
+
+	defer func() { _ = freezer.Close() }()
+
+	// Thaw on any exit path, including a partially failed freeze.
+	defer func() {
+		_, thawErr := freezer.FSThaw()
+		if thawErr != nil {
+			d.logger.Error("Failed thawing guest filesystems", logger.Ctx{"err": thawErr})
+			if err == nil {
+				err = fmt.Errorf("Failed thawing guest filesystems: %w", thawErr)
+			}
+		}
+	}()
+
+	count, err := freezer.FSFreeze()
+	if err != nil {
+		d.logger.Warn("Failed freezing guest filesystems, snapshot will only be crash-consistent", logger.Ctx{"err": err})
+		return fn()
+	}
+
+	d.logger.Debug("Froze guest filesystems", logger.Ctx{"count": count})
+
+	return fn()
+}
@@ -0,0 +1,153 @@
+package drivers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/shared/logger"
+)
+
+type mockFSFreezer struct {
+	freezeErr error
+	thawErr   error
+	calls     []string
+}
+
+func (m *mockFSFreezer) FSFreeze() (int, error) {
+	m.calls = append(m.calls, "freeze")
+	return 1, m.freezeErr
+}
+
+func (m *mockFSFreezer) FSThaw() (int, error) {
+	m.calls = append(m.calls, "thaw")
+	return 1, m.thawErr
+}
+
+func (m *mockFSFreezer) Close() error {
+	m.calls = append(m.calls, "close")
+	return nil
+}
+
+// Test that withFrozenFS always thaws the guest and falls back to crash-consistent snapshots.
+func TestQemuWithFrozenFS(t *testing.T) {
+	d := &qemu{}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	testCases := []struct {
+		name          string
+		freezer       *mockFSFreezer
+		connectErr    error
+		snapshotErr   error
+		expectedCalls []string
+		expectedErr   bool
+	}{
+		{
+			name:          "Success",
+			freezer:       &mockFSFreezer{},
+			expectedCalls: []string{"freeze", "snapshot", "thaw", "close"},
+		}, {
+			name:          "Snapshot failure is thawed",
+			freezer:       &mockFSFreezer{},
+			snapshotErr:   fmt.Errorf("Snapshot failed"),
+			expectedCalls: []string{"freeze", "snapshot", "thaw", "close"},
+			expectedErr:   true,
+		}, {
+			name:          "Freeze failure falls back and is thawed",
+			freezer:       &mockFSFreezer{freezeErr: fmt.Errorf("Freeze failed")},
+			expectedCalls: []string{"freeze", "snapshot", "thaw", "close"},
+		}, {
+			name:          "Thaw failure is reported",
+			freezer:       &mockFSFreezer{thawErr: fmt.Errorf("Thaw failed")},
+			expectedCalls: []string{"freeze", "snapshot", "thaw", "close"},
+			expectedErr:   true,
+		}, {
+			name:          "Agent unavailable falls back",
+			freezer:       &mockFSFreezer{},
+			connectErr:    fmt.Errorf("Guest agent not responding"),
+			expectedCalls: []string{"snapshot"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			connect := func() (qemuFSFreezer, error) {
+				if tc.connectErr != nil {
+					return nil, tc.connectErr
+				}
+
+				return tc.freezer, nil
+			}
+
+			err := d.withFrozenFS(connect, func() error {
+				tc.freezer.calls = append(tc.freezer.calls, "snapshot")
+				return tc.snapshotErr
+			})
+
+			assert.Equal(t, tc.expectedCalls, tc.freezer.calls)
+			if tc.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// Test the guest agent protocol against a mocked agent.
+func TestQemuGuestAgent(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	received := make(chan string, 10)
+
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			req := struct {
+				Execute   string `json:"execute"`
+				Arguments struct {
+					ID int64 `json:"id"`
+				} `json:"arguments"`
+			}{}
+
+			_ = json.Unmarshal(scanner.Bytes(), &req)
+			received <- req.Execute
+
+			var resp string
+			switch req.Execute {
+			case "guest-sync":
+				// Send a stale response first, as left behind by a previous client.
+				_, _ = server.Write([]byte("{\"return\": 1}\n"))
+				resp = fmt.Sprintf("{\"return\": %d}\n", req.Arguments.ID)
+			case "guest-fsfreeze-freeze":
+				resp = "{\"return\": 2}\n"
+			case "guest-fsfreeze-thaw":
+				resp = "{\"error\": {\"class\": \"GenericError\", \"desc\": \"fsfreeze is only supported on frozen filesystems\"}}\n"
+			}
+
+			_, _ = server.Write([]byte(resp))
+		}
+	}()
+
+	agent := newQemuGuestAgentClient(client)
+	defer func() { _ = agent.Close() }()
+
+	err := agent.sync()
+	assert.NoError(t, err)
+
+	count, err := agent.FSFreeze()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = agent.FSThaw()
+	assert.ErrorContains(t, err, "GenericError")
+
+	assert.Equal(t, "guest-sync", <-received)
+	assert.Equal(t, "guest-fsfreeze-freeze", <-received)
+	assert.Equal(t, "guest-fsfreeze-thaw", <-received)
+}
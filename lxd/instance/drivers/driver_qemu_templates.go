@@ -534,6 +534,31 @@ func qemuConsole(opts *qemuConsoleOpts) []cfgSection {
 	}}
 }
 
+type qemuGuestAgentOpts struct {
+	path string
+}
+
+func qemuGuestAgent(opts *qemuGuestAgentOpts) []cfgSection {
+	return []cfgSection{{
+		name:    `chardev "qemu_guest-agent-chardev"`,
+		comment: "QEMU guest agent",
+		entries: []cfgEntry{
+			{key: "backend", value: "socket"},
+			{key: "path", value: opts.path},
+			{key: "server", value: "on"},
+			{key: "wait", value: "off"},
+		},
+	}, {
+		name: `device "qemu_guest-agent"`,
+		entries: []cfgEntry{
+			{key: "driver", value: "virtserialport"},
+			{key: "name", value: "org.qemu.guest_agent.0"},
+			{key: "chardev", value: "qemu_guest-agent-chardev"},
+			{key: "bus", value: "dev-qemu_serial.0"},
+		},
+	}}
+}
+
 type qemuDriveFirmwareOpts struct {
 	roPath    string
 	nvramPath string
@@ -0,0 +1,81 @@
+package drivers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/shared/logger"
+)
+
+type mockStateSaver struct {
+	pauseErr  error
+	saveErr   error
+	resumeErr error
+	calls     []string
+}
+
+func (m *mockStateSaver) Pause() error {
+	m.calls = append(m.calls, "pause")
+	return m.pauseErr
+}
+
+func (m *mockStateSaver) SaveState() error {
+	m.calls = append(m.calls, "save")
+	return m.saveErr
+}
+
+func (m *mockStateSaver) Resume() error {
+	m.calls = append(m.calls, "resume")
+	return m.resumeErr
+}
+
+// Test that stateful snapshots pause, save the state, snapshot the disk and always resume the VM.
+func TestQemuWithSavedState(t *testing.T) {
+	d := &qemu{}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	var saver *mockStateSaver
+	snapshot := func(snapshotErr error) func() error {
+		return func() error {
+			saver.calls = append(saver.calls, "snapshot")
+			return snapshotErr
+		}
+	}
+
+	// Successful snapshot.
+	saver = &mockStateSaver{}
+	err := d.withSavedState(saver, snapshot(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pause", "save", "snapshot", "resume"}, saver.calls)
+
+	// Failed pause doesn't save nor snapshot but still resumes.
+	saver = &mockStateSaver{pauseErr: fmt.Errorf("pause failed")}
+	err = d.withSavedState(saver, snapshot(nil))
+	assert.ErrorContains(t, err, "pause failed")
+	assert.Equal(t, []string{"pause", "resume"}, saver.calls)
+
+	// Failed state save doesn't snapshot the disk but still resumes.
+	saver = &mockStateSaver{saveErr: fmt.Errorf("save failed")}
+	err = d.withSavedState(saver, snapshot(nil))
+	assert.ErrorContains(t, err, "save failed")
+	assert.Equal(t, []string{"pause", "save", "resume"}, saver.calls)
+
+	// Failed disk snapshot still resumes.
+	snapshotErr := fmt.Errorf("snapshot failed")
+	saver = &mockStateSaver{}
+	err = d.withSavedState(saver, snapshot(snapshotErr))
+	assert.ErrorIs(t, err, snapshotErr)
+	assert.Equal(t, []string{"pause", "save", "snapshot", "resume"}, saver.calls)
+
+	// A failed resume is reported, without masking an earlier error.
+	saver = &mockStateSaver{resumeErr: fmt.Errorf("resume failed")}
+	err = d.withSavedState(saver, snapshot(nil))
+	assert.ErrorContains(t, err, "resume failed")
+
+	saver = &mockStateSaver{resumeErr: fmt.Errorf("resume failed")}
+	err = d.withSavedState(saver, snapshot(snapshotErr))
+	assert.ErrorIs(t, err, snapshotErr)
+	assert.Equal(t, []string{"pause", "save", "snapshot", "resume"}, saver.calls)
+}
@@ -2,7 +2,27 @@ package instance
 
 import (
 	"fmt"
+	"strings"
 )
 
 // ErrNotImplemented is the "Not implemented" error.
 var ErrNotImplemented = fmt.Errorf("Not implemented")
+
+// SnapshotsDeleteError is returned when some of the snapshots of an instance couldn't be deleted, the instance
+// being left in place along with them.
+type SnapshotsDeleteError struct {
+	Instance  string           // Name of the instance.
+	Total     int              // Number of snapshots the instance had.
+	Remaining []string         // Names of the snapshots which couldn't be deleted, in deletion order.
+	Errors    map[string]error // Error deleting each of the remaining snapshots.
+}
+
+// Error returns the number of snapshots which couldn't be deleted, followed by each of them and why.
+func (e *SnapshotsDeleteError) Error() string {
+	failures := make([]string, 0, len(e.Remaining))
+	for _, name := range e.Remaining {
+		failures = append(failures, fmt.Sprintf("%s (%v)", name, e.Errors[name]))
+	}
+
+	return fmt.Sprintf("Failed deleting %d of %d snapshots of instance %q, remaining: %s", len(e.Remaining), e.Total, e.Instance, strings.Join(failures, ", "))
+}
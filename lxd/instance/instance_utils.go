@@ -471,7 +471,10 @@ func LoadFromBackup(s *state.State, projectName string, instancePath string, app
 	return inst, nil
 }
 
-// DeleteSnapshots calls the Delete() function on each of the supplied instance's snapshots.
+// DeleteSnapshots calls the Delete() function on each of the supplied instance's snapshots, newest first so that
+// snapshots are deleted before the ones they may depend on. A failure doesn't prevent trying the other snapshots
+// and a *SnapshotsDeleteError listing the snapshots which remain is returned, so that the instance itself isn't
+// deleted while it still has snapshots.
 func DeleteSnapshots(inst Instance) error {
 	snapInsts, err := inst.Snapshots()
 	if err != nil {
@@ -479,6 +482,7 @@ func DeleteSnapshots(inst Instance) error {
 	}
 
 	snapInstsCount := len(snapInsts)
+	deleteErr := &SnapshotsDeleteError{Instance: inst.Name(), Total: snapInstsCount, Errors: map[string]error{}}
 
 	for k := range snapInsts {
 		// Delete the snapshots in reverse order.
@@ -486,9 +490,17 @@ func DeleteSnapshots(inst Instance) error {
 		err = snapInsts[k].Delete(true)
 		if err != nil {
 			logger.Error("Failed deleting snapshot", logger.Ctx{"project": snapInsts[k].Project(), "instance": snapInsts[k].Name(), "err": err})
+
+			_, snapName, _ := api.GetParentAndSnapshotName(snapInsts[k].Name())
+			deleteErr.Remaining = append(deleteErr.Remaining, snapName)
+			deleteErr.Errors[snapName] = err
 		}
 	}
 
+	if len(deleteErr.Remaining) > 0 {
+		return deleteErr
+	}
+
 	return nil
 }
 
@@ -0,0 +1,64 @@
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+// fakeSnapshotsInstance is an instance recording the deletion of its snapshots, failing to delete those in
+// failing.
+type fakeSnapshotsInstance struct {
+	Instance
+
+	name      string
+	snapshots []Instance
+	failing   map[string]bool
+	deleted   *[]string
+}
+
+func (i *fakeSnapshotsInstance) Name() string                   { return i.name }
+func (i *fakeSnapshotsInstance) Project() api.Project           { return api.Project{Name: "default"} }
+func (i *fakeSnapshotsInstance) Snapshots() ([]Instance, error) { return i.snapshots, nil }
+
+func (i *fakeSnapshotsInstance) Delete(force bool) error {
+	if i.failing[i.name] {
+		return fmt.Errorf("Device or resource busy")
+	}
+
+	*i.deleted = append(*i.deleted, i.name)
+	return nil
+}
+
+// Test that the snapshots are deleted newest first and that those which couldn't be deleted are all reported.
+func TestDeleteSnapshots(t *testing.T) {
+	deleted := []string{}
+	failing := map[string]bool{"c1/snap1": true}
+
+	inst := &fakeSnapshotsInstance{name: "c1", failing: failing, deleted: &deleted}
+	for _, name := range []string{"c1/snap0", "c1/snap1", "c1/snap2"} {
+		inst.snapshots = append(inst.snapshots, &fakeSnapshotsInstance{name: name, failing: failing, deleted: &deleted})
+	}
+
+	err := DeleteSnapshots(inst)
+
+	var deleteErr *SnapshotsDeleteError
+	require.True(t, errors.As(err, &deleteErr))
+	assert.Equal(t, 3, deleteErr.Total)
+	assert.Equal(t, []string{"snap1"}, deleteErr.Remaining)
+	assert.Equal(t, `Failed deleting 1 of 3 snapshots of instance "c1", remaining: snap1 (Device or resource busy)`, err.Error())
+
+	// The other snapshots were still deleted, newest first.
+	assert.Equal(t, []string{"c1/snap2", "c1/snap0"}, deleted)
+
+	// Once the snapshot can be deleted nothing is reported.
+	delete(failing, "c1/snap1")
+	inst.snapshots = inst.snapshots[1:2]
+	require.NoError(t, DeleteSnapshots(inst))
+	assert.Equal(t, []string{"c1/snap2", "c1/snap0", "c1/snap1"}, deleted)
+}
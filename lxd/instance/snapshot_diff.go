@@ -0,0 +1,150 @@
+package instance
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// Kinds of change reported by a snapshot diff.
+const (
+	SnapshotDiffAdded    = "added"
+	SnapshotDiffRemoved  = "removed"
+	SnapshotDiffModified = "modified"
+)
+
+// SnapshotConfigChange is a config key which differs between two snapshots.
+type SnapshotConfigChange struct {
+	Key    string `json:"key" yaml:"key"`
+	Change string `json:"change" yaml:"change"`
+	Before string `json:"before" yaml:"before"`
+	After  string `json:"after" yaml:"after"`
+}
+
+// SnapshotDeviceChange is a device which differs between two snapshots.
+type SnapshotDeviceChange struct {
+	Name   string            `json:"name" yaml:"name"`
+	Change string            `json:"change" yaml:"change"`
+	Before map[string]string `json:"before" yaml:"before"`
+	After  map[string]string `json:"after" yaml:"after"`
+}
+
+// SnapshotProfilesChange records the profiles of two snapshots when they differ.
+type SnapshotProfilesChange struct {
+	Before []string `json:"before" yaml:"before"`
+	After  []string `json:"after" yaml:"after"`
+}
+
+// SnapshotDiff is the difference between the stored configuration of two snapshots of an instance.
+type SnapshotDiff struct {
+	From     string                  `json:"from" yaml:"from"`
+	To       string                  `json:"to" yaml:"to"`
+	Config   []SnapshotConfigChange  `json:"config" yaml:"config"`
+	Devices  []SnapshotDeviceChange  `json:"devices" yaml:"devices"`
+	Profiles *SnapshotProfilesChange `json:"profiles" yaml:"profiles"`
+}
+
+// SnapshotConfigDiff compares the local config, devices and profiles of two snapshots.
+// Volatile keys are ignored as they record runtime state rather than configuration.
+// Config changes are sorted by key and device changes by name.
+func SnapshotConfigDiff(from *api.InstanceSnapshot, to *api.InstanceSnapshot) SnapshotDiff {
+	diff := SnapshotDiff{
+		From:    from.Name,
+		To:      to.Name,
+		Config:  []SnapshotConfigChange{},
+		Devices: []SnapshotDeviceChange{},
+	}
+
+	keys := map[string]struct{}{}
+	for _, config := range []map[string]string{from.Config, to.Config} {
+		for key := range config {
+			if !strings.HasPrefix(key, shared.ConfigVolatilePrefix) {
+				keys[key] = struct{}{}
+			}
+		}
+	}
+
+	for key := range keys {
+		before, inBefore := from.Config[key]
+		after, inAfter := to.Config[key]
+
+		change := snapshotDiffChange(inBefore, inAfter, before == after)
+		if change != "" {
+			diff.Config = append(diff.Config, SnapshotConfigChange{Key: key, Change: change, Before: before, After: after})
+		}
+	}
+
+	sort.Slice(diff.Config, func(i, j int) bool { return diff.Config[i].Key < diff.Config[j].Key })
+
+	names := map[string]struct{}{}
+	for _, devices := range []map[string]map[string]string{from.Devices, to.Devices} {
+		for name := range devices {
+			names[name] = struct{}{}
+		}
+	}
+
+	for name := range names {
+		before, inBefore := from.Devices[name]
+		after, inAfter := to.Devices[name]
+
+		change := snapshotDiffChange(inBefore, inAfter, snapshotDiffSameMap(before, after))
+		if change != "" {
+			diff.Devices = append(diff.Devices, SnapshotDeviceChange{Name: name, Change: change, Before: before, After: after})
+		}
+	}
+
+	sort.Slice(diff.Devices, func(i, j int) bool { return diff.Devices[i].Name < diff.Devices[j].Name })
+
+	if !snapshotDiffSameList(from.Profiles, to.Profiles) {
+		diff.Profiles = &SnapshotProfilesChange{Before: from.Profiles, After: to.Profiles}
+	}
+
+	return diff
+}
+
+// snapshotDiffChange returns the kind of change of an entry, or an empty string if it didn't change.
+func snapshotDiffChange(inBefore bool, inAfter bool, same bool) string {
+	switch {
+	case inBefore && !inAfter:
+		return SnapshotDiffRemoved
+	case !inBefore && inAfter:
+		return SnapshotDiffAdded
+	case !same:
+		return SnapshotDiffModified
+	}
+
+	return ""
+}
+
+// snapshotDiffSameMap returns whether two device configs are identical.
+func snapshotDiffSameMap(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for key, value := range a {
+		other, ok := b[key]
+		if !ok || other != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// snapshotDiffSameList returns whether two profile lists are identical (order matters).
+func snapshotDiffSameList(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
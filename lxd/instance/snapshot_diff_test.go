@@ -0,0 +1,73 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+// Test the diff of two snapshots differing in a config key and a device.
+func TestSnapshotConfigDiff(t *testing.T) {
+	from := &api.InstanceSnapshot{
+		Name: "snap0",
+		Config: map[string]string{
+			"limits.cpu":             "2",
+			"security.nesting":       "true",
+			"volatile.eth0.hwaddr":   "00:16:3e:00:00:01",
+			"volatile.last_state.ip": "10.0.0.2",
+		},
+		Devices: map[string]map[string]string{
+			"root": {"type": "disk", "path": "/", "pool": "default"},
+			"data": {"type": "disk", "path": "/data", "source": "/srv/data"},
+		},
+		Profiles: []string{"default"},
+	}
+
+	to := &api.InstanceSnapshot{
+		Name: "snap1",
+		Config: map[string]string{
+			"limits.cpu":           "4",
+			"security.nesting":     "true",
+			"volatile.eth0.hwaddr": "00:16:3e:00:00:02",
+		},
+		Devices: map[string]map[string]string{
+			"root": {"type": "disk", "path": "/", "pool": "default"},
+			"data": {"type": "disk", "path": "/data", "source": "/srv/other"},
+		},
+		Profiles: []string{"default"},
+	}
+
+	diff := SnapshotConfigDiff(from, to)
+	assert.Equal(t, "snap0", diff.From)
+	assert.Equal(t, "snap1", diff.To)
+	assert.Equal(t, []SnapshotConfigChange{{Key: "limits.cpu", Change: SnapshotDiffModified, Before: "2", After: "4"}}, diff.Config)
+	assert.Equal(t, []SnapshotDeviceChange{{Name: "data", Change: SnapshotDiffModified, Before: from.Devices["data"], After: to.Devices["data"]}}, diff.Devices)
+	assert.Nil(t, diff.Profiles)
+
+	// Keys, devices and profiles which only exist on one side.
+	to.Config["limits.memory"] = "1GiB"
+	delete(to.Config, "security.nesting")
+	to.Devices["eth0"] = map[string]string{"type": "nic", "network": "lxdbr0"}
+	delete(to.Devices, "data")
+	to.Profiles = []string{"default", "gpu"}
+
+	diff = SnapshotConfigDiff(from, to)
+	assert.Equal(t, []SnapshotConfigChange{
+		{Key: "limits.cpu", Change: SnapshotDiffModified, Before: "2", After: "4"},
+		{Key: "limits.memory", Change: SnapshotDiffAdded, After: "1GiB"},
+		{Key: "security.nesting", Change: SnapshotDiffRemoved, Before: "true"},
+	}, diff.Config)
+	assert.Equal(t, []SnapshotDeviceChange{
+		{Name: "data", Change: SnapshotDiffRemoved, Before: from.Devices["data"]},
+		{Name: "eth0", Change: SnapshotDiffAdded, After: to.Devices["eth0"]},
+	}, diff.Devices)
+	assert.Equal(t, &SnapshotProfilesChange{Before: []string{"default"}, After: []string{"default", "gpu"}}, diff.Profiles)
+
+	// Identical snapshots have no differences.
+	diff = SnapshotConfigDiff(from, from)
+	assert.Empty(t, diff.Config)
+	assert.Empty(t, diff.Devices)
+	assert.Nil(t, diff.Profiles)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/revert"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	"github.com/lxc/lxd/lxd/util"
+)
+
+// instanceImportStream creates a container named name with the profiles named profileNames ("default" if nil)
+// from the native send stream of its root volume served at streamURL. The stream is received by the storage pool as
+// it's downloaded, without being staged on disk, and its SHA256 checksum is verified before the container is
+// finalized.
+func instanceImportStream(d *Daemon, projectName string, name string, streamURL string, checksum string, profileNames []string, op *operations.Operation) error {
+	err := instance.ValidName(name, false)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(streamURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Stream URL %q must be an HTTP(S) URL", streamURL)
+	}
+
+	// The stream is received as root straight into the pool so it must be the one expected.
+	if checksum == "" {
+		return fmt.Errorf("A checksum of the stream must be specified")
+	}
+
+	if profileNames == nil {
+		profileNames = []string{"default"}
+	}
+
+	profiles, err := d.State().DB.Cluster.GetProfiles(projectName, profileNames)
+	if err != nil {
+		return err
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	args := db.InstanceArgs{
+		Project:  projectName,
+		Type:     instancetype.Container,
+		Name:     name,
+		Profiles: profiles,
+	}
+
+	inst, instOp, cleanup, err := instance.CreateInternal(d.State(), args, true)
+	if err != nil {
+		return fmt.Errorf("Failed creating instance record: %w", err)
+	}
+
+	revert.Add(cleanup)
+	defer instOp.Done(err)
+
+	pool, err := storagePools.LoadByInstance(d.State(), inst)
+	if err != nil {
+		return fmt.Errorf("Failed loading instance storage pool: %w", err)
+	}
+
+	client, err := util.HTTPClient("", d.proxy)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(streamURL)
+	if err != nil {
+		return fmt.Errorf("Failed downloading stream %q: %w", streamURL, err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed downloading stream %q: %s", streamURL, resp.Status)
+	}
+
+	err = pool.CreateInstanceFromStream(inst, resp.Body, checksum, op)
+	if err != nil {
+		return fmt.Errorf("Failed creating instance from stream %q: %w", streamURL, err)
+	}
+
+	revert.Add(func() { _ = inst.Delete(true) })
+
+	err = inst.UpdateBackupFile()
+	if err != nil {
+		return err
+	}
+
+	revert.Success()
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/lxc/lxd/lxd/instance"
+)
+
+type instanceImportStreamTestSuite struct {
+	lxdTestSuite
+}
+
+// Without profiles the container gets the default one, and with it its root disk on the pool the stream is
+// received into.
+func (suite *instanceImportStreamTestSuite) TestInstanceImportStream_DefaultProfile() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("stream"))
+	}))
+	defer server.Close()
+
+	checksum := "dca83e717b1f64eb141057a7415a330ad1361f51703efa2e4776f40047898a04"
+	err := instanceImportStream(suite.d, "default", "c1", server.URL, checksum, nil, nil)
+	suite.Req.Nil(err)
+	suite.Req.Equal(1, requests)
+
+	inst, err := instance.LoadByProjectAndName(suite.d.State(), "default", "c1")
+	suite.Req.Nil(err)
+	defer func() { _ = inst.Delete(true) }()
+
+	suite.Req.Len(inst.Profiles(), 1)
+	suite.Req.Equal("default", inst.Profiles()[0].Name)
+	suite.Req.Equal(lxdTestSuiteDefaultStoragePool, inst.ExpandedDevices()["root"]["pool"])
+}
+
+// Unknown profiles are refused without creating the container.
+func (suite *instanceImportStreamTestSuite) TestInstanceImportStream_UnknownProfile() {
+	err := instanceImportStream(suite.d, "default", "c1", "http://127.0.0.1/stream", "abc", []string{"missing"}, nil)
+	suite.Req.NotNil(err)
+
+	_, err = instance.LoadByProjectAndName(suite.d.State(), "default", "c1")
+	suite.Req.NotNil(err)
+}
+
+// Streams without a checksum are refused before being downloaded.
+func (suite *instanceImportStreamTestSuite) TestInstanceImportStream_NoChecksum() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	err := instanceImportStream(suite.d, "default", "c1", server.URL, "", nil, nil)
+	suite.Req.ErrorContains(err, "checksum")
+	suite.Req.Equal(0, requests)
+
+	_, err = instance.LoadByProjectAndName(suite.d.State(), "default", "c1")
+	suite.Req.NotNil(err)
+}
+
+// A failed download doesn't leave the container behind.
+func (suite *instanceImportStreamTestSuite) TestInstanceImportStream_NotFound() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	err := instanceImportStream(suite.d, "default", "c1", server.URL, "abc", nil, nil)
+	suite.Req.ErrorContains(err, "404")
+
+	_, err = instance.LoadByProjectAndName(suite.d.State(), "default", "c1")
+	suite.Req.NotNil(err)
+}
+
+// Only HTTP(S) URLs are accepted.
+func (suite *instanceImportStreamTestSuite) TestInstanceImportStream_InvalidURL() {
+	err := instanceImportStream(suite.d, "default", "c1", "file:///etc/passwd", "abc", nil, nil)
+	suite.Req.ErrorContains(err, "must be an HTTP(S) URL")
+}
+
+func TestInstanceImportStreamTestSuite(t *testing.T) {
+	suite.Run(t, new(instanceImportStreamTestSuite))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/lxd/revert"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// instanceImportTreesDefaultParallelism is the number of trees imported at the same time unless specified.
+const instanceImportTreesDefaultParallelism = 4
+
+// instanceImportTreeResult is the result of importing a rootfs tree as an instance.
+type instanceImportTreeResult struct {
+	Name  string `json:"name" yaml:"name"`
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// instanceImportTrees imports each subdirectory of sourcePath as a new container of the project named after it,
+// the subdirectory being its rootfs. Up to parallelism trees are imported at the same time and the failure to
+// import one of them doesn't prevent importing the others. Returns the result of each import, sorted by name.
+func instanceImportTrees(d *Daemon, projectName string, sourcePath string, profiles []api.Profile, parallelism int) ([]instanceImportTreeResult, error) {
+	entries, err := os.ReadDir(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading import directory %q: %w", sourcePath, err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	if parallelism <= 0 {
+		parallelism = instanceImportTreesDefaultParallelism
+	}
+
+	results := make([]instanceImportTreeResult, len(names))
+	sem := make(chan struct{}, parallelism)
+	wg := sync.WaitGroup{}
+
+	for i, name := range names {
+		results[i].Name = name
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(result *instanceImportTreeResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := instanceImportTree(d, projectName, result.Name, filepath.Join(sourcePath, result.Name), profiles)
+			if err != nil {
+				logger.Error("Failed importing instance tree", logger.Ctx{"project": projectName, "instance": result.Name, "err": err})
+				result.Error = err.Error()
+			}
+		}(&results[i])
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+// instanceImportTree creates a container named name whose rootfs is a copy of the tree at treePath. The content
+// is reflinked when the pool supports it.
+func instanceImportTree(d *Daemon, projectName string, name string, treePath string, profiles []api.Profile) error {
+	err := instance.ValidName(name, false)
+	if err != nil {
+		return err
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	args := db.InstanceArgs{
+		Project:  projectName,
+		Type:     instancetype.Container,
+		Name:     name,
+		Profiles: profiles,
+	}
+
+	inst, err := instanceCreateAsEmpty(d, args)
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() { _ = inst.Delete(true) })
+
+	pool, err := storagePools.LoadByInstance(d.State(), inst)
+	if err != nil {
+		return fmt.Errorf("Failed loading instance storage pool: %w", err)
+	}
+
+	_, err = pool.MountInstance(inst, nil)
+	if err != nil {
+		return fmt.Errorf("Failed mounting instance: %w", err)
+	}
+
+	defer func() { _ = pool.UnmountInstance(inst, nil) }()
+
+	rootfsPath := inst.RootfsPath()
+	err = os.MkdirAll(rootfsPath, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed creating rootfs: %w", err)
+	}
+
+	_, err = shared.RunCommand("cp", "-a", "--reflink=auto", fmt.Sprintf("%s/.", treePath), rootfsPath)
+	if err != nil {
+		return fmt.Errorf("Failed copying tree %q: %w", treePath, err)
+	}
+
+	revert.Success()
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/lxc/lxd/lxd/instance"
+)
+
+type instanceImportTreesTestSuite struct {
+	lxdTestSuite
+}
+
+// Each subdirectory of the import directory becomes a container with the tree as its rootfs.
+func (suite *instanceImportTreesTestSuite) TestInstanceImportTrees() {
+	sourcePath := suite.T().TempDir()
+	names := []string{"c1", "c2", "c3"}
+
+	for _, name := range names {
+		err := os.MkdirAll(filepath.Join(sourcePath, name, "etc"), 0755)
+		suite.Req.Nil(err)
+
+		err = os.WriteFile(filepath.Join(sourcePath, name, "etc", "hostname"), []byte(name+"\n"), 0644)
+		suite.Req.Nil(err)
+	}
+
+	// Files next to the trees are ignored.
+	err := os.WriteFile(filepath.Join(sourcePath, "README"), []byte("trees\n"), 0644)
+	suite.Req.Nil(err)
+
+	results, err := instanceImportTrees(suite.d, "default", sourcePath, nil, 2)
+	suite.Req.Nil(err)
+	suite.Req.Len(results, 3)
+
+	for i, name := range names {
+		suite.Req.Equal(name, results[i].Name)
+		suite.Req.Empty(results[i].Error)
+
+		inst, err := instance.LoadByProjectAndName(suite.d.State(), "default", name)
+		suite.Req.Nil(err)
+
+		content, err := os.ReadFile(filepath.Join(inst.RootfsPath(), "etc", "hostname"))
+		suite.Req.Nil(err)
+		suite.Req.Equal(name+"\n", string(content))
+
+		_ = inst.Delete(true)
+	}
+}
+
+// A tree which can't be imported is reported without preventing the import of the others.
+func (suite *instanceImportTreesTestSuite) TestInstanceImportTrees_InvalidName() {
+	sourcePath := suite.T().TempDir()
+
+	for _, name := range []string{"c1", "-invalid"} {
+		err := os.Mkdir(filepath.Join(sourcePath, name), 0755)
+		suite.Req.Nil(err)
+	}
+
+	results, err := instanceImportTrees(suite.d, "default", sourcePath, nil, 0)
+	suite.Req.Nil(err)
+	suite.Req.Len(results, 2)
+	suite.Req.Equal("-invalid", results[0].Name)
+	suite.Req.NotEmpty(results[0].Error)
+	suite.Req.Equal("c1", results[1].Name)
+	suite.Req.Empty(results[1].Error)
+
+	inst, err := instance.LoadByProjectAndName(suite.d.State(), "default", "c1")
+	suite.Req.Nil(err)
+	_ = inst.Delete(true)
+}
+
+func TestInstanceImportTreesTestSuite(t *testing.T) {
+	suite.Run(t, new(instanceImportTreesTestSuite))
+}
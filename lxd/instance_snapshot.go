@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -315,6 +316,21 @@ func instanceSnapshotsPost(d *Daemon, r *http.Request) response.Response {
 		}
 	}
 
+	// Refuse the snapshot upfront rather than failing the operation if snapshots.create_rate is exceeded.
+	pool, err := storagePools.LoadByInstance(d.State(), inst)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	err = pool.CheckInstanceSnapshotRate(inst)
+	if err != nil {
+		if errors.Is(err, storagePools.ErrRateLimited) {
+			return response.SmartError(api.StatusErrorf(http.StatusTooManyRequests, "%v", err))
+		}
+
+		return response.SmartError(err)
+	}
+
 	snapshot := func(op *operations.Operation) error {
 		inst.SetOperation(op)
 		return inst.Snapshot(req.Name, expiry, req.Stateful)
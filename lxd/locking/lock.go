@@ -31,27 +31,7 @@ func Lock(lockName string) UnlockFunc {
 			locks[lockName] = waitCh
 			locksMutex.Unlock()
 
-			// Return a function that will complete the operation.
-			return func() {
-				// Get exclusive access to the map.
-				locksMutex.Lock()
-				doneCh, ok := locks[lockName]
-
-				// Load our existing operation.
-				if ok {
-					// Close the channel to indicate to other waiting users
-					// they can now try again to create a new operation.
-					close(doneCh)
-
-					// Remove our existing operation entry from the map.
-					delete(locks, lockName)
-				}
-
-				// Release the lock now that the done channel is closed and the
-				// map entry has been deleted, this will allow any waiting users
-				// to try and get access to the map to create a new operation.
-				locksMutex.Unlock()
-			}
+			return unlockFunc(lockName)
 		}
 
 		// An existing operation is ongoing, lets wait for that to finish and then try
@@ -60,3 +40,42 @@ func Lock(lockName string) UnlockFunc {
 		<-waitCh
 	}
 }
+
+// TryLock creates a lock like Lock but doesn't wait if the lock is already held, in which case it returns false.
+func TryLock(lockName string) (UnlockFunc, bool) {
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+
+	_, ok := locks[lockName]
+	if ok {
+		return nil, false
+	}
+
+	locks[lockName] = make(chan struct{})
+
+	return unlockFunc(lockName), true
+}
+
+// unlockFunc returns a function that will complete the operation of lockName.
+func unlockFunc(lockName string) UnlockFunc {
+	return func() {
+		// Get exclusive access to the map.
+		locksMutex.Lock()
+		doneCh, ok := locks[lockName]
+
+		// Load our existing operation.
+		if ok {
+			// Close the channel to indicate to other waiting users
+			// they can now try again to create a new operation.
+			close(doneCh)
+
+			// Remove our existing operation entry from the map.
+			delete(locks, lockName)
+		}
+
+		// Release the lock now that the done channel is closed and the
+		// map entry has been deleted, this will allow any waiting users
+		// to try and get access to the map to create a new operation.
+		locksMutex.Unlock()
+	}
+}
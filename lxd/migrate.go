@@ -25,8 +25,10 @@ import (
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/idmap"
+	"github.com/lxc/lxd/shared/ioprogress"
 	"github.com/lxc/lxd/shared/logger"
 	"github.com/lxc/lxd/shared/tcp"
+	"github.com/lxc/lxd/shared/units"
 )
 
 // migrationControlResponse encapsulates migration.MigrationControl with a receive error.
@@ -390,3 +392,45 @@ func (s *migrationSink) Connect(op *operations.Operation, r *http.Request, w htt
 
 	return nil
 }
+
+// migrationRateLimiter returns a rate limiter for the migration streams initialised from the pool's
+// limits.network setting. The limit can be changed while the migration is running by updating the operation.
+func migrationRateLimiter(poolConfig map[string]string, op *operations.Operation) (*ioprogress.RateLimiter, error) {
+	parseLimit := func(value string) (int64, error) {
+		if value == "" {
+			return 0, nil
+		}
+
+		limit, err := units.ParseByteSizeString(value)
+		if err != nil {
+			return -1, fmt.Errorf("Invalid limits.network value %q: %w", value, err)
+		}
+
+		return limit, nil
+	}
+
+	limit, err := parseLimit(poolConfig["limits.network"])
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := ioprogress.NewRateLimiter(limit)
+
+	op.SetOnUpdate(func(op *operations.Operation, config map[string]string) error {
+		value, ok := config["limits.network"]
+		if !ok {
+			return fmt.Errorf("Only limits.network can be changed during a migration")
+		}
+
+		limit, err := parseLimit(value)
+		if err != nil {
+			return err
+		}
+
+		limiter.SetLimit(limit)
+
+		return nil
+	})
+
+	return limiter, nil
+}
@@ -477,6 +477,11 @@ func (s *migrationSourceWs) Do(state *state.State, migrateOp *operations.Operati
 		return abort(fmt.Errorf("Failed to negotiate migration type: %w", err))
 	}
 
+	rateLimiter, err := migrationRateLimiter(pool.Driver().Config(), migrateOp)
+	if err != nil {
+		return abort(err)
+	}
+
 	volSourceArgs := &migration.VolumeSourceArgs{
 		IndexHeaderVersion: respHeader.GetIndexHeaderVersion(), // Enable index header frame if supported.
 		Name:               s.instance.Name(),
@@ -487,6 +492,7 @@ func (s *migrationSourceWs) Do(state *state.State, migrateOp *operations.Operati
 		AllowInconsistent:  s.migrationFields.allowInconsistent,
 		VolumeOnly:         s.instanceOnly,
 		Info:               &migration.Info{Config: srcConfig},
+		RateLimiter:        rateLimiter,
 	}
 
 	// Only send the snapshots that the target requests when refreshing.
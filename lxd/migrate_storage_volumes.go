@@ -116,6 +116,12 @@ func (s *migrationSourceWs) DoStorage(state *state.State, projectName string, po
 		return err
 	}
 
+	rateLimiter, err := migrationRateLimiter(pool.Driver().Config(), migrateOp)
+	if err != nil {
+		s.sendControl(err)
+		return err
+	}
+
 	volSourceArgs := &migration.VolumeSourceArgs{
 		IndexHeaderVersion: respHeader.GetIndexHeaderVersion(), // Enable index header frame if supported.
 		Name:               volName,
@@ -125,6 +131,7 @@ func (s *migrationSourceWs) DoStorage(state *state.State, projectName string, po
 		ContentType:        srcConfig.Volume.ContentType,
 		Info:               &migration.Info{Config: srcConfig},
 		VolumeOnly:         s.volumeOnly,
+		RateLimiter:        rateLimiter,
 	}
 
 	// Only send the snapshots that the target requests when refreshing.
@@ -15,7 +15,8 @@ import (
 
 // Info represents the index frame sent if supported.
 type Info struct {
-	Config *backupConfig.Config `json:"config,omitempty" yaml:"config,omitempty"` // Equivalent of backup.yaml but embedded in index.
+	Config       *backupConfig.Config `json:"config,omitempty" yaml:"config,omitempty"`               // Equivalent of backup.yaml but embedded in index.
+	SizeEstimate int64                `json:"size_estimate,omitempty" yaml:"size_estimate,omitempty"` // Estimated space in bytes needed on the target, 0 if unknown.
 }
 
 // InfoResponse represents the response to the index frame sent if supported.
@@ -26,6 +27,10 @@ type InfoResponse struct {
 	StatusCode int
 	Error      string
 	Refresh    *bool // This is used to let the source know whether to actually refresh a volume.
+
+	// ResumeReceivedUUID is the source UUID of the last snapshot kept by the target from an interrupted
+	// migration of the volume, allowing the source to only send the snapshots after it (empty if none).
+	ResumeReceivedUUID string
 }
 
 // Err returns the error of the response.
@@ -59,6 +64,8 @@ type VolumeSourceArgs struct {
 	Refresh            bool
 	Info               *Info
 	VolumeOnly         bool
+	RateLimiter        *ioprogress.RateLimiter // Optional limit on the throughput of the volume data sent.
+	ResumeReceivedUUID string                  // Source UUID of the last snapshot the target kept from an interrupted migration.
 }
 
 // VolumeTargetArgs represents the arguments needed to setup a volume migration sink.
@@ -75,6 +82,7 @@ type VolumeTargetArgs struct {
 	VolumeSize         int64
 	ContentType        string
 	VolumeOnly         bool
+	SizeEstimate       int64 // Estimated space in bytes needed for the volume, 0 if unknown.
 }
 
 // TypesToHeader converts one or more Types to a MigrationHeader. It uses the first type argument
@@ -118,6 +118,12 @@ func (c *Config) StorageImagesVolume() string {
 	return c.m.GetString("storage.images_volume")
 }
 
+// StorageSnapshotsConcurrency returns the maximum number of instances snapshotted at the same time on each storage
+// pool by the scheduled snapshot task.
+func (c *Config) StorageSnapshotsConcurrency() int64 {
+	return c.m.GetInt64("storage.snapshots.concurrency")
+}
+
 // Dump current configuration keys and their values. Keys with values matching
 // their defaults are omitted.
 func (c *Config) Dump() map[string]any {
@@ -185,4 +191,7 @@ var ConfigSchema = config.Schema{
 	// Storage volumes to store backups/images on
 	"storage.backups_volume": {},
 	"storage.images_volume":  {},
+
+	// Maximum number of instances snapshotted at the same time by the scheduled snapshot task
+	"storage.snapshots.concurrency": {Type: config.Int64, Default: "4", Validator: validate.IsInRange(1, 1024)},
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -33,6 +34,7 @@ var operationCmd = APIEndpoint{
 
 	Delete: APIEndpointAction{Handler: operationDelete, AccessHandler: allowAuthenticated},
 	Get:    APIEndpointAction{Handler: operationGet, AccessHandler: allowAuthenticated},
+	Patch:  APIEndpointAction{Handler: operationPatch, AccessHandler: allowAuthenticated},
 }
 
 var operationsCmd = APIEndpoint{
@@ -269,8 +271,78 @@ func operationDelete(d *Daemon, r *http.Request) response.Response {
 	}
 
 	// Then check if the query is from an operation on another node, and, if so, forward it
+	return operationForwardedResponse(d, r, id)
+}
+
+// swagger:operation PATCH /1.0/operations/{id} operations operation_patch
+//
+// Partially update the operation
+//
+// Changes settings of the running operation if supported.
+//
+// ---
+// consumes:
+//   - application/json
+// produces:
+//   - application/json
+// parameters:
+//   - in: body
+//     name: operation
+//     description: Operation settings
+//     required: true
+//     schema:
+//       $ref: "#/definitions/OperationPut"
+// responses:
+//   "200":
+//     $ref: "#/responses/EmptySyncResponse"
+//   "400":
+//     $ref: "#/responses/BadRequest"
+//   "403":
+//     $ref: "#/responses/Forbidden"
+//   "500":
+//     $ref: "#/responses/InternalServerError"
+func operationPatch(d *Daemon, r *http.Request) response.Response {
+	id, err := url.PathUnescape(mux.Vars(r)["id"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// First check if the query is for a local operation from this node
+	op, err := operations.OperationGetInternal(id)
+	if err == nil {
+		projectName := op.Project()
+		if op.Permission() != "" {
+			if projectName == "" {
+				projectName = project.Default
+			}
+
+			if !rbac.UserHasPermission(r, projectName, op.Permission()) {
+				return response.Forbidden(nil)
+			}
+		}
+
+		req := api.OperationPut{}
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return response.BadRequest(err)
+		}
+
+		err = op.Update(req.Config)
+		if err != nil {
+			return response.BadRequest(err)
+		}
+
+		return response.EmptySyncResponse
+	}
+
+	// Then check if the query is from an operation on another node, and, if so, forward it
+	return operationForwardedResponse(d, r, id)
+}
+
+// operationForwardedResponse forwards the request to the member running the operation.
+func operationForwardedResponse(d *Daemon, r *http.Request, id string) response.Response {
 	var address string
-	err = d.db.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+	err := d.db.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
 		filter := dbCluster.OperationFilter{UUID: &id}
 		ops, err := dbCluster.GetOperations(ctx, tx.Tx(), filter)
 		if err != nil {
@@ -112,6 +112,7 @@ type Operation struct {
 	onRun     func(*Operation) error
 	onCancel  func(*Operation) error
 	onConnect func(*Operation, *http.Request, http.ResponseWriter) error
+	onUpdate  func(*Operation, map[string]string) error
 
 	// Indicates if operation has finished.
 	finished *cancel.Canceller
@@ -655,6 +656,39 @@ func (op *Operation) SetCanceler(canceler *cancel.HTTPRequestCanceller) {
 	op.canceler = canceler
 }
 
+// SetOnUpdate sets the function called to apply settings changed while the operation is running.
+func (op *Operation) SetOnUpdate(onUpdate func(*Operation, map[string]string) error) {
+	op.lock.Lock()
+	op.onUpdate = onUpdate
+	op.lock.Unlock()
+}
+
+// Update applies changed settings to a running operation. If the operation cannot be updated, it returns an
+// error.
+func (op *Operation) Update(config map[string]string) error {
+	op.lock.Lock()
+	status := op.status
+	onUpdate := op.onUpdate
+	op.lock.Unlock()
+
+	if status != api.Running {
+		return fmt.Errorf("Only running operations can be updated")
+	}
+
+	if onUpdate == nil {
+		return fmt.Errorf("This operation can't be updated")
+	}
+
+	err := onUpdate(op, config)
+	if err != nil {
+		return err
+	}
+
+	op.logger.Debug("Updated operation", logger.Ctx{"config": config})
+
+	return nil
+}
+
 // Permission returns the operation permission.
 func (op *Operation) Permission() string {
 	return op.permission
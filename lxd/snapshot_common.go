@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 
+	storagePools "github.com/lxc/lxd/lxd/storage"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
 )
@@ -97,6 +101,181 @@ func getObfuscatedTimeValuesForSubject(subjectID int64) (string, string) {
 	return minuteResult, hourResult
 }
 
+// snapshotScheduleGracePeriod is how late a scheduled snapshot can be before being considered missed, leaving
+// time for the snapshot task, which runs once a minute, to create it.
+const snapshotScheduleGracePeriod = 5 * time.Minute
+
+// snapshotScheduleOverdue returns when spec first scheduled a snapshot after last and whether that snapshot is
+// overdue at now. Entries of spec which aren't cron expressions (such as "@startup") are ignored.
+func snapshotScheduleOverdue(spec string, subjectID int64, last time.Time, now time.Time) (time.Time, bool) {
+	var expected time.Time
+
+	for _, curSpec := range buildCronSpecs(spec, subjectID) {
+		sched, err := cron.ParseStandard(curSpec)
+		if err != nil {
+			continue
+		}
+
+		// Use local time like the snapshot task does.
+		next := sched.Next(last.Local())
+		if expected.IsZero() || next.Before(expected) {
+			expected = next
+		}
+	}
+
+	if expected.IsZero() {
+		return expected, false
+	}
+
+	return expected, expected.Add(snapshotScheduleGracePeriod).Before(now)
+}
+
+// snapshotConsistencyInstance is the part of an instance needed to snapshot it with its configured consistency.
+type snapshotConsistencyInstance interface {
+	ExpandedConfig() map[string]string
+	IsRunning() bool
+	IsFrozen() bool
+	Freeze() error
+	Unfreeze() error
+}
+
+// snapshotWithConsistency calls snapshot to snapshot the instance. With "snapshots.consistency" set to
+// "application", a running instance is frozen for the duration of the snapshot so that it doesn't write to its
+// filesystem while the snapshot is taken. Stopped instances are always consistent so are never frozen, and nor are
+// instances which are already frozen, which are left as they are.
+func snapshotWithConsistency(inst snapshotConsistencyInstance, snapshot func() error) error {
+	if inst.ExpandedConfig()["snapshots.consistency"] != "application" || !inst.IsRunning() || inst.IsFrozen() {
+		return snapshot()
+	}
+
+	err := inst.Freeze()
+	if err != nil {
+		return fmt.Errorf("Failed freezing instance: %w", err)
+	}
+
+	err = snapshot()
+	unfreezeErr := inst.Unfreeze()
+	if err != nil {
+		return err
+	}
+
+	if unfreezeErr != nil {
+		return fmt.Errorf("Failed unfreezing instance: %w", unfreezeErr)
+	}
+
+	return nil
+}
+
+// scheduledSnapshotsResult is the aggregate result of a run of the scheduled snapshot task.
+type scheduledSnapshotsResult struct {
+	Created     int `json:"created" yaml:"created"`
+	Failed      int `json:"failed" yaml:"failed"`
+	RateLimited int `json:"rate_limited" yaml:"rate_limited"` // Refused by snapshots.create_rate, retried on the next run.
+	Skipped     int `json:"skipped" yaml:"skipped"`           // Not started as the run was cancelled.
+}
+
+// runScheduledSnapshots calls snapshot with the index of each of the instances to snapshot, pools holding the
+// storage pool of each of them. Up to concurrency instances of each pool are snapshotted at the same time, so that
+// a pool with many instances doesn't hold up the others. Once ctx is cancelled no more snapshots are started, and
+// the run returns once the ones in progress are done.
+func runScheduledSnapshots(ctx context.Context, pools []string, concurrency int, snapshot func(i int) error) scheduledSnapshotsResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Group the instances by pool, keeping their order.
+	poolNames := []string{}
+	poolInstances := map[string][]int{}
+	for i, poolName := range pools {
+		_, ok := poolInstances[poolName]
+		if !ok {
+			poolNames = append(poolNames, poolName)
+		}
+
+		poolInstances[poolName] = append(poolInstances[poolName], i)
+	}
+
+	result := scheduledSnapshotsResult{}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, poolName := range poolNames {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+
+			sem := make(chan struct{}, concurrency)
+			poolWg := sync.WaitGroup{}
+
+			for n, i := range indexes {
+				if ctx.Err() == nil {
+					select {
+					case sem <- struct{}{}:
+					case <-ctx.Done():
+					}
+				}
+
+				if ctx.Err() != nil {
+					mu.Lock()
+					result.Skipped += len(indexes) - n
+					mu.Unlock()
+					break
+				}
+
+				poolWg.Add(1)
+				go func(i int) {
+					defer poolWg.Done()
+					defer func() { <-sem }()
+
+					err := snapshot(i)
+
+					mu.Lock()
+					defer mu.Unlock()
+
+					if errors.Is(err, storagePools.ErrRateLimited) {
+						result.RateLimited++
+					} else if err != nil {
+						result.Failed++
+					} else {
+						result.Created++
+					}
+				}(i)
+			}
+
+			poolWg.Wait()
+		}(poolInstances[poolName])
+	}
+
+	wg.Wait()
+
+	return result
+}
+
+// scheduledSnapshotRetries records the IDs of the instances whose scheduled snapshot was refused by their
+// snapshots.create_rate, so that the next run of the scheduled snapshot task retries it.
+var scheduledSnapshotRetries = map[int]bool{}
+
+// scheduledSnapshotRetriesMu is used to access scheduledSnapshotRetries safely.
+var scheduledSnapshotRetriesMu sync.Mutex
+
+// scheduledSnapshotRetryAdd records that the scheduled snapshot of the instance must be retried.
+func scheduledSnapshotRetryAdd(instanceID int) {
+	scheduledSnapshotRetriesMu.Lock()
+	scheduledSnapshotRetries[instanceID] = true
+	scheduledSnapshotRetriesMu.Unlock()
+}
+
+// scheduledSnapshotRetryTake returns whether the scheduled snapshot of the instance must be retried, forgetting it.
+func scheduledSnapshotRetryTake(instanceID int) bool {
+	scheduledSnapshotRetriesMu.Lock()
+	defer scheduledSnapshotRetriesMu.Unlock()
+
+	retry := scheduledSnapshotRetries[instanceID]
+	delete(scheduledSnapshotRetries, instanceID)
+
+	return retry
+}
+
 func cronSpecIsNow(spec string) (bool, error) {
 	sched, err := cron.ParseStandard(spec)
 	if err != nil {
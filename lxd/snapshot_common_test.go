@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
+	storagePools "github.com/lxc/lxd/lxd/storage"
 )
 
 func (suite *containerTestSuite) TestSnapshotScheduling() {
@@ -35,6 +42,207 @@ func (suite *containerTestSuite) TestSnapshotScheduling() {
 	op.Done(nil)
 }
 
+func (suite *containerTestSuite) TestSnapshotScheduleOverdue() {
+	last := time.Date(2022, 1, 1, 10, 5, 0, 0, time.Local)
+
+	// The next hourly snapshot is only due at 11:00.
+	expected, overdue := snapshotScheduleOverdue("0 * * * *", 1, last, last.Add(30*time.Minute))
+	suite.Req.False(overdue)
+	suite.Req.Equal(time.Date(2022, 1, 1, 11, 0, 0, 0, time.Local), expected)
+
+	// Within the grace period.
+	_, overdue = snapshotScheduleOverdue("0 * * * *", 1, last, expected.Add(time.Minute))
+	suite.Req.False(overdue)
+
+	_, overdue = snapshotScheduleOverdue("0 * * * *", 1, last, last.Add(90*time.Minute))
+	suite.Req.True(overdue)
+
+	// The earliest of several schedules applies and non-cron entries are ignored.
+	expected, overdue = snapshotScheduleOverdue("@startup, 30 10 * * *, 0 * * * *", 1, last, last.Add(40*time.Minute))
+	suite.Req.True(overdue)
+	suite.Req.Equal(time.Date(2022, 1, 1, 10, 30, 0, 0, time.Local), expected)
+
+	_, overdue = snapshotScheduleOverdue("@startup", 1, last, last.Add(48*time.Hour))
+	suite.Req.False(overdue)
+}
+
+func (suite *containerTestSuite) TestOverdueInstanceSnapshots() {
+	args := db.InstanceArgs{
+		Type:      instancetype.Container,
+		Ephemeral: false,
+		Name:      "hal9000",
+		Config: map[string]string{
+			"snapshots.schedule":         "@hourly",
+			"snapshots.schedule.stopped": "true",
+		},
+	}
+
+	c, op, _, err := instance.CreateInternal(suite.d.State(), args, true)
+	suite.Req.Nil(err)
+	op.Done(nil)
+
+	// An instance which was just created isn't overdue yet.
+	overdue, err := overdueInstanceSnapshots(suite.d.State(), "default", time.Now())
+	suite.Req.Nil(err)
+	suite.Req.Len(overdue, 0)
+
+	// Its latest snapshot predates the hourly schedule.
+	snapCreatedAt := time.Now().Add(-3 * time.Hour).UTC()
+	snapArgs := db.InstanceArgs{
+		Type:         instancetype.Container,
+		Snapshot:     true,
+		Name:         "hal9000/snap0",
+		CreationDate: snapCreatedAt,
+	}
+
+	_, op, _, err = instance.CreateInternal(suite.d.State(), snapArgs, true)
+	suite.Req.Nil(err)
+	op.Done(nil)
+
+	overdue, err = overdueInstanceSnapshots(suite.d.State(), "default", time.Now())
+	suite.Req.Nil(err)
+	suite.Req.Len(overdue, 1)
+	suite.Req.Equal(c.Name(), overdue[0].Name)
+	suite.Req.Equal("@hourly", overdue[0].Schedule)
+	suite.Req.NotNil(overdue[0].LastSnapshot)
+	suite.Req.WithinDuration(snapCreatedAt, *overdue[0].LastSnapshot, time.Second)
+	suite.Req.True(overdue[0].ExpectedAt.After(snapCreatedAt))
+}
+
+type snapshotConsistencyInstanceFake struct {
+	config  map[string]string
+	running bool
+	frozen  bool
+	calls   []string
+}
+
+func (f *snapshotConsistencyInstanceFake) ExpandedConfig() map[string]string { return f.config }
+func (f *snapshotConsistencyInstanceFake) IsRunning() bool                   { return f.running }
+func (f *snapshotConsistencyInstanceFake) IsFrozen() bool                    { return f.frozen }
+
+func (f *snapshotConsistencyInstanceFake) Freeze() error {
+	f.calls = append(f.calls, "freeze")
+	return nil
+}
+
+func (f *snapshotConsistencyInstanceFake) Unfreeze() error {
+	f.calls = append(f.calls, "unfreeze")
+	return nil
+}
+
+// Instances are only frozen while snapshotted if they are running and have "application" consistency.
+func TestSnapshotWithConsistency(t *testing.T) {
+	cases := []struct {
+		consistency string
+		running     bool
+		frozen      bool
+		calls       []string
+	}{
+		{"", true, false, []string{"snapshot"}},
+		{"crash", true, false, []string{"snapshot"}},
+		{"crash", false, false, []string{"snapshot"}},
+		{"application", false, false, []string{"snapshot"}},
+		{"application", true, false, []string{"freeze", "snapshot", "unfreeze"}},
+		{"application", true, true, []string{"snapshot"}},
+	}
+
+	for _, c := range cases {
+		inst := &snapshotConsistencyInstanceFake{
+			config:  map[string]string{"snapshots.consistency": c.consistency},
+			running: c.running,
+			frozen:  c.frozen,
+		}
+
+		err := snapshotWithConsistency(inst, func() error {
+			inst.calls = append(inst.calls, "snapshot")
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, c.calls, inst.calls, "consistency %q, running %v, frozen %v", c.consistency, c.running, c.frozen)
+	}
+}
+
+// The instance is unfrozen even if the snapshot fails.
+func TestSnapshotWithConsistency_Failure(t *testing.T) {
+	inst := &snapshotConsistencyInstanceFake{
+		config:  map[string]string{"snapshots.consistency": "application"},
+		running: true,
+	}
+
+	err := snapshotWithConsistency(inst, func() error {
+		inst.calls = append(inst.calls, "snapshot")
+		return fmt.Errorf("Failed")
+	})
+	assert.EqualError(t, err, "Failed")
+	assert.Equal(t, []string{"freeze", "snapshot", "unfreeze"}, inst.calls)
+}
+
+// Many scheduled instances are snapshotted in parallel, never more than the concurrency at the same time on a pool.
+func TestRunScheduledSnapshots(t *testing.T) {
+	mu := sync.Mutex{}
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	snapshotted := make([]bool, 50)
+
+	pools := make([]string, len(snapshotted))
+	for i := range pools {
+		pools[i] = fmt.Sprintf("pool%d", i%2)
+	}
+
+	result := runScheduledSnapshots(context.Background(), pools, 4, func(i int) error {
+		mu.Lock()
+		running[pools[i]]++
+		if running[pools[i]] > maxRunning[pools[i]] {
+			maxRunning[pools[i]] = running[pools[i]]
+		}
+
+		snapshotted[i] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[pools[i]]--
+		mu.Unlock()
+
+		if i%10 == 0 {
+			return fmt.Errorf("Failed")
+		}
+
+		if i%10 == 1 {
+			return fmt.Errorf("Too many snapshots: %w", storagePools.ErrRateLimited)
+		}
+
+		return nil
+	})
+
+	assert.Equal(t, scheduledSnapshotsResult{Created: 40, Failed: 5, RateLimited: 5}, result)
+	assert.Equal(t, map[string]int{"pool0": 4, "pool1": 4}, maxRunning)
+	assert.NotContains(t, snapshotted, false)
+}
+
+// No snapshot is started once the run is cancelled.
+func TestRunScheduledSnapshots_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	result := runScheduledSnapshots(ctx, make([]string, 10), 1, func(i int) error {
+		cancel()
+		return nil
+	})
+
+	assert.Equal(t, scheduledSnapshotsResult{Created: 1, Skipped: 9}, result)
+}
+
+// Rate limited scheduled snapshots are retried once.
+func TestScheduledSnapshotRetry(t *testing.T) {
+	assert.False(t, scheduledSnapshotRetryTake(1))
+
+	scheduledSnapshotRetryAdd(1)
+	assert.True(t, scheduledSnapshotRetryTake(1))
+	assert.False(t, scheduledSnapshotRetryTake(1))
+}
+
 func TestSnapshotCommon(t *testing.T) {
 	suite.Run(t, new(containerTestSuite))
 }
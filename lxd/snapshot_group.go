@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lxc/lxd/lxd/instance"
+	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/revert"
+	"github.com/lxc/lxd/lxd/state"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	storageDrivers "github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// snapshotGroupMember is an instance or custom volume snapshotted as part of a consistency group.
+type snapshotGroupMember interface {
+	String() string
+	Freeze() error
+	Unfreeze() error
+	Snapshot(snapName string) error
+	DeleteSnapshot(snapName string) error
+}
+
+// snapshotGroupCreate takes a snapshot named snapName of all the members so that the snapshots are consistent with
+// each other. All the members are frozen before the first snapshot is taken and thawed once the last one is.
+// If any member fails to be frozen or snapshotted, the snapshots already taken are deleted so that either all the
+// members or none of them have the snapshot. The frozen members are always thawed.
+func snapshotGroupCreate(members []snapshotGroupMember, snapName string) (err error) {
+	frozen := make([]snapshotGroupMember, 0, len(members))
+
+	defer func() {
+		for _, member := range frozen {
+			thawErr := member.Unfreeze()
+			if thawErr != nil {
+				logger.Error("Failed thawing snapshot group member", logger.Ctx{"member": member.String(), "err": thawErr})
+
+				if err == nil {
+					err = fmt.Errorf("Failed thawing %s: %w", member, thawErr)
+				}
+			}
+		}
+	}()
+
+	for _, member := range members {
+		err := member.Freeze()
+		if err != nil {
+			return fmt.Errorf("Failed freezing %s: %w", member, err)
+		}
+
+		frozen = append(frozen, member)
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	for _, member := range members {
+		err := member.Snapshot(snapName)
+		if err != nil {
+			return fmt.Errorf("Failed snapshotting %s: %w", member, err)
+		}
+
+		member := member
+		revert.Add(func() {
+			err := member.DeleteSnapshot(snapName)
+			if err != nil {
+				logger.Error("Failed deleting snapshot of snapshot group member", logger.Ctx{"member": member.String(), "snapshot": snapName, "err": err})
+			}
+		})
+	}
+
+	revert.Success()
+	return nil
+}
+
+// instanceSnapshotGroupMember is an instance member of a snapshot consistency group.
+// Running instances are frozen unless they already were, in which case they are left frozen.
+type instanceSnapshotGroupMember struct {
+	s      *state.State
+	inst   instance.Instance
+	expiry time.Time
+	froze  bool
+}
+
+// String returns a description of the member for error messages.
+func (m *instanceSnapshotGroupMember) String() string {
+	return fmt.Sprintf("instance %q", m.inst.Name())
+}
+
+// Freeze freezes the instance if it is running.
+func (m *instanceSnapshotGroupMember) Freeze() error {
+	if !m.inst.IsRunning() || m.inst.IsFrozen() {
+		return nil
+	}
+
+	err := m.inst.Freeze()
+	if err != nil {
+		return err
+	}
+
+	m.froze = true
+	return nil
+}
+
+// Unfreeze thaws the instance if it was frozen by Freeze.
+func (m *instanceSnapshotGroupMember) Unfreeze() error {
+	if !m.froze {
+		return nil
+	}
+
+	err := m.inst.Unfreeze()
+	if err != nil {
+		return err
+	}
+
+	m.froze = false
+	return nil
+}
+
+// Snapshot takes a snapshot of the instance.
+func (m *instanceSnapshotGroupMember) Snapshot(snapName string) error {
+	return m.inst.Snapshot(snapName, m.expiry, false)
+}
+
+// DeleteSnapshot deletes a snapshot of the instance.
+func (m *instanceSnapshotGroupMember) DeleteSnapshot(snapName string) error {
+	snap, err := instance.LoadByProjectAndName(m.s, m.inst.Project().Name, m.inst.Name()+shared.SnapshotDelimiter+snapName)
+	if err != nil {
+		return err
+	}
+
+	return snap.Delete(true)
+}
+
+// volumeSnapshotGroupMember is a custom volume member of a snapshot consistency group.
+// Custom volumes have nothing to freeze of their own, their consistency depends on the instances using them.
+type volumeSnapshotGroupMember struct {
+	pool        storagePools.Pool
+	projectName string
+	volName     string
+	expiry      time.Time
+	op          *operations.Operation
+}
+
+// String returns a description of the member for error messages.
+func (m *volumeSnapshotGroupMember) String() string {
+	return fmt.Sprintf("volume %q on storage pool %q", m.volName, m.pool.Name())
+}
+
+// Freeze does nothing.
+func (m *volumeSnapshotGroupMember) Freeze() error {
+	return nil
+}
+
+// Unfreeze does nothing.
+func (m *volumeSnapshotGroupMember) Unfreeze() error {
+	return nil
+}
+
+// Snapshot takes a snapshot of the volume.
+func (m *volumeSnapshotGroupMember) Snapshot(snapName string) error {
+	return m.pool.CreateCustomVolumeSnapshot(m.projectName, m.volName, snapName, m.expiry, m.op)
+}
+
+// DeleteSnapshot deletes a snapshot of the volume.
+func (m *volumeSnapshotGroupMember) DeleteSnapshot(snapName string) error {
+	return m.pool.DeleteCustomVolumeSnapshot(m.projectName, storageDrivers.GetSnapshotVolumeName(m.volName, snapName), m.op)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSnapshotGroupMember records the calls made to it and fails the ones it's told to.
+type fakeSnapshotGroupMember struct {
+	name         string
+	failFreeze   bool
+	failSnapshot bool
+
+	frozen    bool
+	snapshots map[string]bool
+	calls     []string
+}
+
+func (m *fakeSnapshotGroupMember) String() string {
+	return m.name
+}
+
+func (m *fakeSnapshotGroupMember) Freeze() error {
+	m.calls = append(m.calls, "freeze")
+	if m.failFreeze {
+		return fmt.Errorf("Freeze failed")
+	}
+
+	m.frozen = true
+	return nil
+}
+
+func (m *fakeSnapshotGroupMember) Unfreeze() error {
+	m.calls = append(m.calls, "unfreeze")
+	m.frozen = false
+	return nil
+}
+
+func (m *fakeSnapshotGroupMember) Snapshot(snapName string) error {
+	m.calls = append(m.calls, "snapshot")
+	if !m.frozen {
+		return fmt.Errorf("Not frozen")
+	}
+
+	if m.failSnapshot {
+		return fmt.Errorf("Snapshot failed")
+	}
+
+	if m.snapshots == nil {
+		m.snapshots = map[string]bool{}
+	}
+
+	m.snapshots[snapName] = true
+	return nil
+}
+
+func (m *fakeSnapshotGroupMember) DeleteSnapshot(snapName string) error {
+	m.calls = append(m.calls, "delete")
+	delete(m.snapshots, snapName)
+	return nil
+}
+
+// All the members are snapshotted while all of them are frozen, and thawed afterwards.
+func TestSnapshotGroupCreate(t *testing.T) {
+	a := &fakeSnapshotGroupMember{name: "a"}
+	b := &fakeSnapshotGroupMember{name: "b"}
+
+	err := snapshotGroupCreate([]snapshotGroupMember{a, b}, "snap0")
+	require.NoError(t, err)
+
+	for _, m := range []*fakeSnapshotGroupMember{a, b} {
+		assert.True(t, m.snapshots["snap0"], m.name)
+		assert.False(t, m.frozen, m.name)
+		assert.Equal(t, []string{"freeze", "snapshot", "unfreeze"}, m.calls, m.name)
+	}
+}
+
+// When the snapshot of a member fails, the snapshots already taken are deleted and all the members are thawed.
+func TestSnapshotGroupCreate_SnapshotFailure(t *testing.T) {
+	a := &fakeSnapshotGroupMember{name: "a"}
+	b := &fakeSnapshotGroupMember{name: "b", failSnapshot: true}
+
+	err := snapshotGroupCreate([]snapshotGroupMember{a, b}, "snap0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed snapshotting b")
+
+	for _, m := range []*fakeSnapshotGroupMember{a, b} {
+		assert.Empty(t, m.snapshots, m.name)
+		assert.False(t, m.frozen, m.name)
+	}
+
+	assert.Equal(t, []string{"freeze", "snapshot", "delete", "unfreeze"}, a.calls)
+	assert.Equal(t, []string{"freeze", "snapshot", "unfreeze"}, b.calls)
+}
+
+// When a member fails to freeze, no snapshot is taken and the members already frozen are thawed.
+func TestSnapshotGroupCreate_FreezeFailure(t *testing.T) {
+	a := &fakeSnapshotGroupMember{name: "a"}
+	b := &fakeSnapshotGroupMember{name: "b", failFreeze: true}
+
+	err := snapshotGroupCreate([]snapshotGroupMember{a, b}, "snap0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed freezing b")
+
+	assert.Equal(t, []string{"freeze", "unfreeze"}, a.calls)
+	assert.Equal(t, []string{"freeze"}, b.calls)
+	assert.False(t, a.frozen)
+	assert.Empty(t, a.snapshots)
+}
@@ -99,6 +99,20 @@ func storageStartup(s *state.State, forceCheck bool) error {
 	initPool := func(poolName string) bool {
 		logger.Debug("Initializing storage pool", logger.Ctx{"pool": poolName})
 
+		// Mark the pool as unavailable rather than failing when used if the tools its driver needs are missing.
+		if !s.OS.MockMode {
+			poolID, dbPool, _, err := s.DB.Cluster.GetStoragePoolInAnyState(poolName)
+			if err == nil {
+				err = storagePools.CheckRequiredTools(poolName, dbPool.Driver)
+				if err != nil {
+					logger.Warn("Storage pool is unavailable as its driver is missing required tools", logger.Ctx{"pool": poolName, "driver": dbPool.Driver, "err": err})
+					_ = s.DB.Cluster.UpsertWarningLocalNode("", cluster.TypeStoragePool, int(poolID), warningtype.StoragePoolUnvailable, err.Error())
+
+					return false
+				}
+			}
+		}
+
 		pool, err := storagePools.LoadByName(s, poolName)
 		if err != nil {
 			if response.IsNotFoundError(err) {
@@ -118,6 +132,11 @@ func storageStartup(s *state.State, forceCheck bool) error {
 			return false
 		}
 
+		// Clean up the mounts left behind by a crash if requested, as they would get in the way of the volumes.
+		if shared.IsTrue(pool.Driver().Config()["cleanup_stale_mounts"]) {
+			storagePoolCleanupStaleMounts(s, pool)
+		}
+
 		logger.Info("Initialized storage pool", logger.Ctx{"pool": poolName})
 		_ = warnings.ResolveWarningsByLocalNodeAndProjectAndTypeAndEntity(s.DB.Cluster, "", warningtype.StoragePoolUnvailable, cluster.TypeStoragePool, int(pool.ID()))
 
@@ -232,3 +251,23 @@ func storagePoolDriversCacheUpdate(s *state.State) {
 	storagePoolSupportedDriversCacheVal.Store(supportedDrivers)
 	storagePoolDriversCacheLock.Unlock()
 }
+
+// storagePoolCleanupStaleMounts unmounts the stale mounts of the pool, keeping the volumes of the instances
+// running on this member. Failures are only logged as they don't prevent the pool from being used.
+func storagePoolCleanupStaleMounts(s *state.State, pool storagePools.Pool) {
+	insts, err := instance.LoadNodeAll(s, instancetype.Any)
+	if err != nil {
+		logger.Warn("Failed loading instances to clean up stale mounts", logger.Ctx{"pool": pool.Name(), "err": err})
+		return
+	}
+
+	mounts, err := pool.CleanupStaleMounts(insts)
+	if err != nil {
+		logger.Warn("Failed cleaning up stale mounts", logger.Ctx{"pool": pool.Name(), "err": err})
+		return
+	}
+
+	for _, mount := range mounts {
+		logger.Info("Unmounted stale mount", logger.Ctx{"pool": pool.Name(), "path": mount.Target})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +25,8 @@ import (
 	"github.com/lxc/lxd/lxd/cluster/request"
 	"github.com/lxc/lxd/lxd/db"
 	"github.com/lxc/lxd/lxd/db/cluster"
+	"github.com/lxc/lxd/lxd/db/operationtype"
+	"github.com/lxc/lxd/lxd/db/warningtype"
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
 	"github.com/lxc/lxd/lxd/instance"
 	"github.com/lxc/lxd/lxd/instance/instancetype"
@@ -41,14 +44,17 @@ import (
 	"github.com/lxc/lxd/lxd/storage/s3"
 	"github.com/lxc/lxd/lxd/storage/s3/miniod"
 	"github.com/lxc/lxd/lxd/util"
+	"github.com/lxc/lxd/lxd/warnings"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/instancewriter"
 	"github.com/lxc/lxd/shared/ioprogress"
 	"github.com/lxc/lxd/shared/logger"
 )
 
-var unavailablePools = make(map[string]struct{})
+// unavailablePools records the pools which are unavailable on the local server, along with the reason if known.
+var unavailablePools = make(map[string]string)
 var unavailablePoolsMu = sync.Mutex{}
 
 // instanceDiskVolumeEffectiveFields fields from the instance disks that are applied to the volume's effective
@@ -254,7 +260,961 @@ func (b *lxdBackend) GetResources() (*api.ResourcesStoragePool, error) {
 	l.Debug("GetResources started")
 	defer l.Debug("GetResources finished")
 
-	return b.driver.GetResources()
+	res, err := b.driver.GetResources()
+	if err != nil {
+		return nil, err
+	}
+
+	b.warnDeviceErrors(res.Devices)
+
+	reserved, err := reservedSpace(b.db.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	applyReservedSpace(res, reserved)
+
+	return res, nil
+}
+
+// warnDeviceErrors raises a persistent warning for the pool if any of its devices reports errors, or resolves
+// it once none do.
+func (b *lxdBackend) warnDeviceErrors(devices []api.ResourcesStoragePoolDevice) {
+	failing := []string{}
+	for _, dev := range devices {
+		total := dev.ReadErrors + dev.WriteErrors + dev.FlushErrors + dev.CorruptionErrors + dev.GenerationErrors
+		if total > 0 {
+			failing = append(failing, fmt.Sprintf("%s (read %d, write %d, flush %d, corruption %d, generation %d)", dev.Device, dev.ReadErrors, dev.WriteErrors, dev.FlushErrors, dev.CorruptionErrors, dev.GenerationErrors))
+		}
+	}
+
+	var err error
+	if len(failing) > 0 {
+		b.logger.Warn("Storage pool devices report errors", logger.Ctx{"devices": failing})
+		err = b.state.DB.Cluster.UpsertWarningLocalNode("", cluster.TypeStoragePool, int(b.ID()), warningtype.StoragePoolDeviceErrors, strings.Join(failing, ", "))
+	} else {
+		err = warnings.ResolveWarningsByLocalNodeAndProjectAndTypeAndEntity(b.state.DB.Cluster, "", warningtype.StoragePoolDeviceErrors, cluster.TypeStoragePool, int(b.ID()))
+	}
+
+	if err != nil {
+		b.logger.Warn("Failed updating storage pool device errors warning", logger.Ctx{"err": err})
+	}
+}
+
+// Rebalance spreads the pool data evenly across its devices, relocating the supplied volumes if needed.
+// The volumes are specified as "<type>/<name>" and must not be in use.
+func (b *lxdBackend) Rebalance(ctx context.Context, projectName string, volNames []string, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volNames": volNames})
+	l.Debug("Rebalance started")
+	defer l.Debug("Rebalance finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockPoolMaintenance(b.name, "rebalance")
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	vols := make([]drivers.Volume, 0, len(volNames))
+	for _, volName := range volNames {
+		volType, name, err := b.typedVolume(projectName, volName)
+		if err != nil {
+			return err
+		}
+
+		if volType == drivers.VolumeTypeContainer || volType == drivers.VolumeTypeVM {
+			inst, err := instance.LoadByProjectAndName(b.state, projectName, name)
+			if err != nil {
+				return err
+			}
+
+			if inst.IsRunning() {
+				return fmt.Errorf("Instance %q must be stopped to be relocated", name)
+			}
+		}
+
+		vol, err := b.typedVolumeGet(projectName, volType, name)
+		if err != nil {
+			return err
+		}
+
+		vols = append(vols, vol)
+	}
+
+	return b.driver.Rebalance(ctx, vols, op)
+}
+
+// EstimateSharing estimates the physical space saved by the supplied volumes sharing data.
+// The volumes are specified as "<type>/<name>".
+func (b *lxdBackend) EstimateSharing(projectName string, volNames []string) (*drivers.SpaceSharingEstimate, error) {
+	vols := make([]drivers.Volume, 0, len(volNames))
+	for _, volName := range volNames {
+		volType, name, err := b.typedVolume(projectName, volName)
+		if err != nil {
+			return nil, err
+		}
+
+		vol, err := b.typedVolumeGet(projectName, volType, name)
+		if err != nil {
+			return nil, err
+		}
+
+		vols = append(vols, vol)
+	}
+
+	return b.driver.EstimateSharing(vols)
+}
+
+// EmergencyFree frees space on a pool which has run out of it (such as a pool with exhausted metadata on which
+// even deletions fail) so that it can be recovered.
+func (b *lxdBackend) EmergencyFree(op *operations.Operation) error {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("EmergencyFree started")
+	defer l.Debug("EmergencyFree finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockPoolMaintenance(b.name, "emergency-free")
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	return b.driver.EmergencyFree(op)
+}
+
+// ValidateLayout checks that the on-disk layout of the pool matches the one expected by LXD, without modifying
+// it, and returns a report of the deviations found.
+func (b *lxdBackend) ValidateLayout() (*drivers.LayoutReport, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("ValidateLayout started")
+	defer l.Debug("ValidateLayout finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.driver.ValidateLayout()
+}
+
+// CheckHealth checks the pool for problems which need an action from the administrator, such as inconsistent
+// quota accounting or snapshots and images which became writable, and returns a report of the issues found.
+// If repairReadonly is true, the snapshots and images found writable are made read-only again.
+func (b *lxdBackend) CheckHealth(repairReadonly bool) (*drivers.PoolHealthReport, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"repairReadonly": repairReadonly})
+	l.Debug("CheckHealth started")
+	defer l.Debug("CheckHealth finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := b.driver.CheckHealth()
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are used as the parents of incremental sends and images as the base of instances, so they must
+	// stay read-only.
+	var readonlyVols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range vols {
+			if vol.IsSnapshot() || vol.Type() == drivers.VolumeTypeImage {
+				readonlyVols = append(readonlyVols, vol)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issues, err := b.driver.CheckReadonly(readonlyVols, repairReadonly)
+	if err != nil && (repairReadonly || !errors.Is(err, drivers.ErrNotSupported)) {
+		return nil, err
+	}
+
+	report.Issues = append(report.Issues, issues...)
+	report.Healthy = len(report.Issues) == 0
+
+	return report, nil
+}
+
+// GetProjectVolumeUsage returns the disk space used by the instance or custom volume, specified as
+// "<type>/<name>". Only drivers which track usage (quotas or qgroups) report it, volumes are never walked.
+func (b *lxdBackend) GetProjectVolumeUsage(projectName string, volName string) (int64, error) {
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return -1, err
+	}
+
+	vol, err := b.typedVolumeGet(projectName, volType, name)
+	if err != nil {
+		return -1, err
+	}
+
+	return b.driver.GetVolumeUsage(vol)
+}
+
+// FindStraySubvolumes returns the subvolumes of the pool (relative to its mount path) which don't correspond to
+// any of the instances, snapshots, images, custom volumes or buckets recorded in the database for this member.
+// They are only reported, never deleted.
+func (b *lxdBackend) FindStraySubvolumes() ([]string, error) {
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	memberSpecific := !b.driver.Info().Remote
+
+	var vols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		memberVols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		vols = memberVols
+
+		poolID := b.id
+		buckets, err := tx.GetStoragePoolBuckets(ctx, memberSpecific, db.StorageBucketFilter{PoolID: &poolID})
+		if err != nil {
+			return fmt.Errorf("Failed loading storage buckets: %w", err)
+		}
+
+		for _, bucket := range buckets {
+			vols = append(vols, b.GetVolume(drivers.VolumeTypeBucket, drivers.ContentTypeFS, bucket.Name, nil))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.driver.FindStraySubvolumes(vols)
+}
+
+// SubvolumeVolume represents the volume a subvolume of a pool belongs to.
+type SubvolumeVolume struct {
+	Project string `json:"project" yaml:"project"` // Project of the volume (empty for images).
+	Type    string `json:"type" yaml:"type"`       // Volume type (such as "containers" or "custom").
+	Name    string `json:"name" yaml:"name"`       // Volume name, including the snapshot name for snapshots.
+}
+
+// GetSubvolumeVolumes returns the volumes recorded in the database for this member, snapshots included, keyed by
+// the ID of their subvolume. This relates the IDs shown by the storage tools to volumes. Volumes without a
+// subvolume are left out.
+func (b *lxdBackend) GetSubvolumeVolumes() (map[string]SubvolumeVolume, error) {
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	var vols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err = b.memberVolumes(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	volsByID, err := b.driver.GetSubvolumeIDs(vols)
+	if err != nil {
+		return nil, err
+	}
+
+	subvolVols := make(map[string]SubvolumeVolume, len(volsByID))
+	for id, vol := range volsByID {
+		subvolVol := SubvolumeVolume{Type: string(vol.Type())}
+		subvolVol.Project, subvolVol.Name = volumeProjectParts(vol)
+		subvolVols[id] = subvolVol
+	}
+
+	return subvolVols, nil
+}
+
+// volumeProjectParts returns the project and the name within it of the volume. The project is empty for the
+// volumes which don't belong to a project, such as images.
+func volumeProjectParts(vol drivers.Volume) (string, string) {
+	switch vol.Type() {
+	case drivers.VolumeTypeContainer, drivers.VolumeTypeVM:
+		return project.InstanceParts(vol.Name())
+	case drivers.VolumeTypeCustom:
+		return project.StorageVolumeParts(vol.Name())
+	}
+
+	return "", vol.Name()
+}
+
+// ConfigState returns the config of the pool and of the volumes recorded in the database for this member,
+// along with the limits of the qgroups of the volumes if the pool supports them. Snapshots are left out as they
+// come and go with the snapshot schedules and expiries rather than being configuration changes.
+func (b *lxdBackend) ConfigState() (*PoolConfigState, error) {
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	var vols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		memberVols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range memberVols {
+			if !vol.IsSnapshot() {
+				vols = append(vols, vol)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	configState := &PoolConfigState{
+		Config:  make(map[string]string, len(b.db.Config)),
+		Volumes: make(map[string]map[string]string, len(vols)),
+	}
+
+	for k, v := range b.db.Config {
+		configState.Config[k] = v
+	}
+
+	for _, vol := range vols {
+		configState.Volumes[fmt.Sprintf("%s/%s", vol.Type(), vol.Name())] = vol.Config()
+	}
+
+	configState.QGroupLimits, err = b.driver.GetQGroupLimits(vols)
+	if err != nil {
+		if !errors.Is(err, drivers.ErrNotSupported) {
+			return nil, fmt.Errorf("Failed getting qgroup limits: %w", err)
+		}
+
+		configState.QGroupLimits = map[string]int64{}
+	}
+
+	return configState, nil
+}
+
+// ConfigDrift returns the differences between the current config of the pool (as returned by ConfigState) and
+// the baseline, ignoring the volatile keys.
+func (b *lxdBackend) ConfigDrift(baseline PoolConfigState) ([]PoolConfigDifference, error) {
+	current, err := b.ConfigState()
+	if err != nil {
+		return nil, err
+	}
+
+	return diffPoolConfig(baseline, *current), nil
+}
+
+// VolumeMountFailure represents a volume of a pool which failed to mount.
+type VolumeMountFailure struct {
+	Project string `json:"project" yaml:"project"` // Project of the volume (empty for images).
+	Type    string `json:"type" yaml:"type"`       // Volume type (such as "containers" or "custom").
+	Name    string `json:"name" yaml:"name"`       // Volume name, including the snapshot name for snapshots.
+	Error   string `json:"error" yaml:"error"`     // Why the volume failed to mount.
+}
+
+// VolumeMountReport represents the result of verifying that the volumes of a pool mount.
+type VolumeMountReport struct {
+	Verified int                  `json:"verified" yaml:"verified"` // Number of volumes verified.
+	Failures []VolumeMountFailure `json:"failures" yaml:"failures"` // Volumes which failed to mount.
+}
+
+// VerifyVolumeMounts mounts each volume recorded in the database for this member, snapshots included, read-only
+// and unmounts it straight away, reporting the volumes which failed to mount. This confirms that a pool can be
+// trusted, such as after a recovery, before the volumes are used.
+func (b *lxdBackend) VerifyVolumeMounts(op *operations.Operation) (*VolumeMountReport, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("VerifyVolumeMounts started")
+	defer l.Debug("VerifyVolumeMounts finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	var vols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err = b.memberVolumes(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	failures, err := b.driver.VerifyMounts(vols, op)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VolumeMountReport{Verified: len(vols), Failures: make([]VolumeMountFailure, 0, len(failures))}
+	for _, failure := range failures {
+		mountFailure := VolumeMountFailure{Type: string(failure.Volume.Type()), Error: failure.Err.Error()}
+		mountFailure.Project, mountFailure.Name = volumeProjectParts(failure.Volume)
+		report.Failures = append(report.Failures, mountFailure)
+
+		l.Warn("Volume failed to mount", logger.Ctx{"project": mountFailure.Project, "type": mountFailure.Type, "volume": mountFailure.Name, "err": failure.Err})
+	}
+
+	return report, nil
+}
+
+// Quiesce pauses the new operations on the pool until Resume is called, or until timeout has passed, and brings
+// the pool to a consistent state on disk, freezing its filesystem if freeze is set, so that the host (or the disks
+// holding the pool) can be snapshotted or backed up. The operations already in progress carry on, their writes
+// being held by the freeze.
+func (b *lxdBackend) Quiesce(freeze bool, timeout time.Duration) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"freeze": freeze, "timeout": timeout})
+	l.Debug("Quiesce started")
+	defer l.Debug("Quiesce finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return err
+	}
+
+	return quiescePool(b.name, freeze, timeout, b.driver.QuiescePool, b.driver.ResumePool)
+}
+
+// Resume thaws the filesystem of the pool, which is attempted even if the pool isn't known to be quiesced (such
+// as after a restart), and lets the paused operations proceed.
+func (b *lxdBackend) Resume() error {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("Resume started")
+	defer l.Debug("Resume finished")
+
+	return resumePool(b.name, b.driver.ResumePool)
+}
+
+// CleanupStaleMounts lazily unmounts the mounts below the pool's mount path which don't belong to a volume in use,
+// such as the mounts left behind by a crash, and returns them. Volumes are in use when mounted by an ongoing
+// operation or when they are the root or a disk of one of the supplied instances which is running.
+func (b *lxdBackend) CleanupStaleMounts(insts []instance.Instance) ([]drivers.MountInfo, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("CleanupStaleMounts started")
+	defer l.Debug("CleanupStaleMounts finished")
+
+	activePaths := []string{}
+
+	err := b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range vols {
+			if vol.MountInUse() {
+				activePaths = append(activePaths, vol.MountPath())
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, inst := range insts {
+		if !inst.IsRunning() {
+			continue
+		}
+
+		poolName, err := inst.StoragePool()
+		if err == nil && poolName == b.name {
+			volType, err := InstanceTypeToVolumeType(inst.Type())
+			if err != nil {
+				return nil, err
+			}
+
+			activePaths = append(activePaths, b.GetVolume(volType, drivers.ContentTypeFS, project.Instance(inst.Project().Name, inst.Name()), nil).MountPath())
+		}
+
+		for _, dev := range inst.ExpandedDevices() {
+			if dev["type"] != "disk" || dev["pool"] != b.name || dev["path"] == "/" || dev["source"] == "" {
+				continue
+			}
+
+			volProjectName, err := project.StorageVolumeProject(b.state.DB.Cluster, inst.Project().Name, db.StoragePoolVolumeTypeCustom)
+			if err != nil {
+				return nil, err
+			}
+
+			activePaths = append(activePaths, b.GetVolume(drivers.VolumeTypeCustom, drivers.ContentTypeFS, project.StorageVolume(volProjectName, dev["source"]), nil).MountPath())
+		}
+	}
+
+	return drivers.PoolCleanupStaleMounts(b.name, activePaths)
+}
+
+// memberVolumes returns the instance, image and custom volumes (including snapshots) of the pool recorded in
+// the database for this member, along with their config.
+func (b *lxdBackend) memberVolumes(ctx context.Context, tx *db.ClusterTx) ([]drivers.Volume, error) {
+	dbVols, err := tx.GetStoragePoolVolumes(ctx, b.id, !b.driver.Info().Remote)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading storage volumes: %w", err)
+	}
+
+	vols := make([]drivers.Volume, 0, len(dbVols))
+	for _, dbVol := range dbVols {
+		volDBType, err := VolumeTypeNameToDBType(dbVol.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		volType, err := VolumeDBTypeToType(volDBType)
+		if err != nil {
+			return nil, err
+		}
+
+		volStorageName := dbVol.Name
+		switch volType {
+		case drivers.VolumeTypeContainer, drivers.VolumeTypeVM:
+			volStorageName = project.Instance(dbVol.Project, dbVol.Name)
+		case drivers.VolumeTypeCustom:
+			volStorageName = project.StorageVolume(dbVol.Project, dbVol.Name)
+		}
+
+		vols = append(vols, b.GetVolume(volType, drivers.ContentType(dbVol.ContentType), volStorageName, dbVol.Config))
+	}
+
+	return vols, nil
+}
+
+// RepairImagesReadonly makes the image volumes of the pool which were found writable read-only again, so that the
+// images instances are created from stay immutable. It returns the paths (relative to the pool) it corrected.
+func (b *lxdBackend) RepairImagesReadonly(op *operations.Operation) ([]string, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("RepairImagesReadonly started")
+	defer l.Debug("RepairImagesReadonly finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range vols {
+			if vol.Type() == drivers.VolumeTypeImage {
+				images = append(images, vol)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.driver.RepairReadonly(images, op)
+}
+
+// RebuildSnapshotSymlinks rebuilds the instance snapshot symlinks of the LXD directory for the pool: the local
+// instances of the pool whose snapshot directory exists get a symlink to it, and the other symlinks of the
+// instances of the pool or pointing into the pool are removed. The symlinks of the other pools are left alone.
+func (b *lxdBackend) RebuildSnapshotSymlinks(op *operations.Operation) (*SnapshotSymlinksRebuild, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("RebuildSnapshotSymlinks started")
+	defer l.Debug("RebuildSnapshotSymlinks finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	insts, err := instance.LoadNodeAll(b.state, instancetype.Any)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading instances: %w", err)
+	}
+
+	symlinksPaths := []string{shared.VarPath("snapshots"), shared.VarPath("virtual-machines-snapshots")}
+	expected := map[string]map[string]string{}
+	for _, symlinksPath := range symlinksPaths {
+		expected[symlinksPath] = map[string]string{}
+	}
+
+	poolSymlinks := map[string]bool{}
+
+	for _, inst := range insts {
+		poolName, err := inst.StoragePool()
+		if err != nil || poolName != b.name {
+			continue
+		}
+
+		volType, err := InstanceTypeToVolumeType(inst.Type())
+		if err != nil {
+			return nil, err
+		}
+
+		snapshotSymlink := InstancePath(inst.Type(), inst.Project().Name, inst.Name(), true)
+		poolSymlinks[snapshotSymlink] = true
+
+		snapshotTargetPath := b.GetVolume(volType, drivers.ContentTypeFS, project.Instance(inst.Project().Name, inst.Name()), nil).SnapshotsDir()
+		if !shared.PathExists(snapshotTargetPath) {
+			continue
+		}
+
+		expected[filepath.Dir(snapshotSymlink)][filepath.Base(snapshotSymlink)] = snapshotTargetPath
+	}
+
+	poolPaths := []string{drivers.GetPoolMountPath(b.name), drivers.GetPoolSnapshotsPath(b.name, b.db.Config["snapshots.mount_base"])}
+
+	result := &SnapshotSymlinksRebuild{}
+
+	for _, symlinksPath := range symlinksPaths {
+		owned := func(name string, target string) bool {
+			if poolSymlinks[filepath.Join(symlinksPath, name)] {
+				return true
+			}
+
+			for _, poolPath := range poolPaths {
+				if strings.HasPrefix(target, poolPath+"/") {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		err = reconcileSnapshotSymlinks(symlinksPath, expected[symlinksPath], owned, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// PruneSnapshotDirs removes the empty parent snapshot directories and dangling symlinks left in the snapshots area
+// of the pool, as well as the instance snapshot symlinks of the LXD directory pointing to missing snapshot
+// directories of the pool. It returns the absolute paths which were removed.
+func (b *lxdBackend) PruneSnapshotDirs(op *operations.Operation) ([]string, error) {
+	l := logger.AddContext(b.logger, nil)
+	l.Debug("PruneSnapshotDirs started")
+	defer l.Debug("PruneSnapshotDirs finished")
+
+	err := b.isStatusReady()
+	if err != nil {
+		return nil, err
+	}
+
+	relPaths, err := b.driver.PruneSnapshotDirs(op)
+	if err != nil {
+		return nil, err
+	}
+
+	poolPath := drivers.GetPoolMountPath(b.name)
+
+	pruned := make([]string, 0, len(relPaths))
+	for _, relPath := range relPaths {
+		pruned = append(pruned, filepath.Join(poolPath, relPath))
+	}
+
+	for _, symlinksPath := range []string{shared.VarPath("snapshots"), shared.VarPath("virtual-machines-snapshots")} {
+		entries, err := os.ReadDir(symlinksPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Failed listing %q: %w", symlinksPath, err)
+		}
+
+		for _, entry := range entries {
+			if entry.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+
+			snapshotSymlink := filepath.Join(symlinksPath, entry.Name())
+
+			target, err := os.Readlink(snapshotSymlink)
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading symlink %q: %w", snapshotSymlink, err)
+			}
+
+			// Only consider the symlinks pointing into this pool.
+			if !strings.HasPrefix(target, poolPath+"/") || shared.PathExists(target) {
+				continue
+			}
+
+			err = os.Remove(snapshotSymlink)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("Failed to remove symlink %q: %w", snapshotSymlink, err)
+			}
+
+			pruned = append(pruned, snapshotSymlink)
+		}
+	}
+
+	return pruned, nil
+}
+
+// GetSnapshotsReclaimableSpace returns the space which deleting each snapshot of the instance or custom volume,
+// specified as "<type>/<name>", would free, largest first. On dir pools this is approximated by the size of the
+// snapshots.
+func (b *lxdBackend) GetSnapshotsReclaimableSpace(projectName string, volName string) (*drivers.ReclaimableSpaceReport, error) {
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := b.typedVolumeGet(projectName, volType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSnapshots, err := VolumeDBSnapshotsGet(b, projectName, name, volType)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]string, 0, len(dbSnapshots))
+	for _, dbSnapshot := range dbSnapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(dbSnapshot.Name)
+		snapshots = append(snapshots, snapName)
+	}
+
+	report, err := b.driver.GetSnapshotsReclaimableSpace(vol, snapshots)
+	if !errors.Is(err, drivers.ErrNotSupported) || b.driver.Info().Name != "dir" || vol.ContentType() != drivers.ContentTypeFS {
+		return report, err
+	}
+
+	report = &drivers.ReclaimableSpaceReport{Method: drivers.ReclaimableMethodSize, Snapshots: make([]drivers.SnapshotReclaimableSpace, 0, len(snapshots))}
+	for _, snapName := range snapshots {
+		snapVol, err := vol.NewSnapshot(snapName)
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := walkUsage(snapVol.MountPath())
+		if err != nil {
+			return nil, err
+		}
+
+		report.Snapshots = append(report.Snapshots, drivers.SnapshotReclaimableSpace{Name: snapName, Reclaimable: size})
+	}
+
+	drivers.SortReclaimableSpace(report.Snapshots)
+
+	return report, nil
+}
+
+// OrderVolumeSnapshots returns the names of the recorded snapshots of the instance or custom volume, specified as
+// "<type>/<name>", in the given order (one of SnapshotOrders). Creation times are read from the storage backend,
+// falling back to the database records on pools which don't track them, and sizes are the reclaimable space.
+func (b *lxdBackend) OrderVolumeSnapshots(projectName string, volName string, order string) ([]string, error) {
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSnapshots, err := VolumeDBSnapshotsGet(b, projectName, name, volType)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]string, 0, len(dbSnapshots))
+	creationTimes := make(map[string]time.Time, len(dbSnapshots))
+	for _, dbSnapshot := range dbSnapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(dbSnapshot.Name)
+		snapshots = append(snapshots, snapName)
+		creationTimes[snapName] = dbSnapshot.CreationDate
+	}
+
+	var sizes map[string]int64
+
+	switch order {
+	case SnapshotOrderCreationTime:
+		vol, err := b.typedVolumeGet(projectName, volType, name)
+		if err != nil {
+			return nil, err
+		}
+
+		backendTimes, err := b.driver.VolumeSnapshotsCreationTime(vol, snapshots)
+		if err != nil && !errors.Is(err, drivers.ErrNotSupported) {
+			return nil, err
+		}
+
+		for snapName, creationTime := range backendTimes {
+			if !creationTime.IsZero() {
+				creationTimes[snapName] = creationTime
+			}
+		}
+
+	case SnapshotOrderSize:
+		report, err := b.GetSnapshotsReclaimableSpace(projectName, volName)
+		if err != nil {
+			return nil, err
+		}
+
+		if report.Unavailable != "" {
+			return nil, fmt.Errorf("Snapshot sizes are unavailable: %s", report.Unavailable)
+		}
+
+		sizes = make(map[string]int64, len(report.Snapshots))
+		for _, snapshot := range report.Snapshots {
+			sizes[snapshot.Name] = snapshot.Reclaimable
+		}
+	}
+
+	err = sortSnapshots(snapshots, order, creationTimes, sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// ExportVolumeOCI writes the volume (given as "<type>/<name>") to w as an OCI image layer tarball, or as an OCI
+// image layout including config if set. The files of unprivileged containers are unshifted with their disk idmap.
+func (b *lxdBackend) ExportVolumeOCI(projectName string, volName string, w io.Writer, config *drivers.OCIImageConfig, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volume": volName})
+	l.Debug("ExportVolumeOCI started")
+	defer l.Debug("ExportVolumeOCI finished")
+
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return err
+	}
+
+	// Get IDMap to unshift container as the layer is created.
+	var idmapSet *idmap.IdmapSet
+	if volType == drivers.VolumeTypeContainer {
+		inst, err := instance.LoadByProjectAndName(b.state, projectName, name)
+		if err != nil {
+			return err
+		}
+
+		c, ok := inst.(instance.Container)
+		if !ok {
+			return fmt.Errorf("Instance %q isn't a container", name)
+		}
+
+		idmapSet, err = c.DiskIdmap()
+		if err != nil {
+			return fmt.Errorf("Error getting container IDMAP: %w", err)
+		}
+	}
+
+	vol, err := b.typedVolumeGet(projectName, volType, name)
+	if err != nil {
+		return err
+	}
+
+	return b.driver.ExportVolumeOCI(vol, w, config, idmapSet, op)
+}
+
+// GetSnapshotTimeEstimate returns the estimated time taken by a snapshot of the instance or custom volume,
+// specified as "<type>/<name>". Snapshots are near-instant unless the driver copies the volume's data (dir), in
+// which case the estimate is based on the volume's usage and the copy throughput measured on the pool.
+func (b *lxdBackend) GetSnapshotTimeEstimate(projectName string, volName string) (time.Duration, error) {
+	if !snapshotsCopyData(b.driver.Info().Name) {
+		return snapshotTimeEstimate(false, 0, 0), nil
+	}
+
+	usage, err := b.GetProjectVolumeUsage(projectName, volName)
+	if err != nil {
+		return -1, err
+	}
+
+	return snapshotTimeEstimate(true, usage, snapshotThroughput(b.name)), nil
+}
+
+// recordSnapshotCopy records the copy throughput of the snapshot volume created in elapsed when the driver copies
+// the volume's data, which is used to estimate the time taken by the next snapshots. The size of the snapshot is
+// measured in the background so that the snapshot creation doesn't wait for it, one snapshot at a time per pool
+// (the snapshots created meanwhile not being sampled).
+func (b *lxdBackend) recordSnapshotCopy(snapVol drivers.Volume, elapsed time.Duration) {
+	if !snapshotsCopyData(b.driver.Info().Name) {
+		return
+	}
+
+	unlock, ok := locking.TryLock(fmt.Sprintf("SnapshotThroughputSample_%s", b.name))
+	if !ok {
+		return
+	}
+
+	go func() {
+		defer unlock()
+
+		size, err := walkUsage(snapVol.MountPath())
+		if err != nil {
+			// The snapshot may have been deleted in the meantime.
+			b.logger.Debug("Failed measuring snapshot size", logger.Ctx{"volName": snapVol.Name(), "err": err})
+			return
+		}
+
+		recordSnapshotThroughput(b.name, size, elapsed)
+	}()
+}
+
+// typedVolume parses a volume specified as "<type>/<name>" and returns its type and name.
+// Only instance and custom volumes are supported.
+func (b *lxdBackend) typedVolume(projectName string, volName string) (drivers.VolumeType, string, error) {
+	volTypeName, name, found := strings.Cut(volName, "/")
+	if !found || name == "" || shared.IsSnapshot(name) {
+		return "", "", fmt.Errorf("Invalid volume %q, expected <type>/<name>", volName)
+	}
+
+	volDBType, err := VolumeTypeNameToDBType(volTypeName)
+	if err != nil {
+		return "", "", err
+	}
+
+	volType, err := VolumeDBTypeToType(volDBType)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch volType {
+	case drivers.VolumeTypeContainer, drivers.VolumeTypeVM, drivers.VolumeTypeCustom:
+		return volType, name, nil
+	}
+
+	return "", "", fmt.Errorf("Volumes of type %q are not supported", volTypeName)
+}
+
+// typedVolumeGet returns the instance or custom volume of the given type and name.
+func (b *lxdBackend) typedVolumeGet(projectName string, volType drivers.VolumeType, name string) (drivers.Volume, error) {
+	dbVol, err := VolumeDBGet(b, projectName, name, volType)
+	if err != nil {
+		return drivers.Volume{}, err
+	}
+
+	volStorageName := project.Instance(projectName, name)
+	if volType == drivers.VolumeTypeCustom {
+		volStorageName = project.StorageVolume(projectName, name)
+	}
+
+	return b.GetVolume(volType, drivers.ContentType(dbVol.ContentType), volStorageName, dbVol.Config), nil
 }
 
 // IsUsed returns whether the storage pool is used by any volumes or profiles (excluding image volumes).
@@ -326,8 +1286,15 @@ func (b *lxdBackend) Delete(clientType request.ClientType, op *operations.Operat
 	l.Debug("Delete started")
 	defer l.Debug("Delete finished")
 
+	unlock, err := lockPoolMaintenance(b.name, "delete")
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
 	// Delete any persistent warnings for pool.
-	err := b.warningsDelete()
+	err = b.warningsDelete()
 	if err != nil {
 		return err
 	}
@@ -360,6 +1327,30 @@ func (b *lxdBackend) Delete(clientType request.ClientType, op *operations.Operat
 		// from being deleted, because they should not exist by this point and we don't want to end up
 		// removing an instance or custom volume accidentally.
 		// Errors listing volumes are ignored, as we should still try and delete the storage pool.
+		// Instances found recorded on the pool are never deleted along with it though.
+		instances := []string{}
+		err := b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+			memberVols, err := b.memberVolumes(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			for _, vol := range memberVols {
+				if !vol.IsSnapshot() && (vol.Type() == drivers.VolumeTypeContainer || vol.Type() == drivers.VolumeTypeVM) {
+					instances = append(instances, vol.Name())
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			l.Warn("Failed listing instance volumes of the storage pool", logger.Ctx{"err": err})
+		}
+
+		if len(instances) > 0 {
+			return fmt.Errorf("Refusing to delete storage pool %q as it still has instance volumes: %s", b.name, strings.Join(instances, ", "))
+		}
+
 		vols, _ := b.driver.ListVolumes()
 		for _, vol := range vols {
 			if vol.Type() == drivers.VolumeTypeImage {
@@ -373,7 +1364,7 @@ func (b *lxdBackend) Delete(clientType request.ClientType, op *operations.Operat
 		}
 
 		// Delete the low-level storage.
-		err := b.driver.Delete(op)
+		err = b.driver.Delete(op)
 		if err != nil {
 			return err
 		}
@@ -389,6 +1380,13 @@ func (b *lxdBackend) Delete(clientType request.ClientType, op *operations.Operat
 	delete(unavailablePools, b.Name())
 	unavailablePoolsMu.Unlock()
 
+	forgetSnapshotThroughput(b.name)
+
+	err = os.RemoveAll(shared.VarPath("snapshot-indexes", b.name))
+	if err != nil {
+		return fmt.Errorf("Failed removing snapshot indexes: %w", err)
+	}
+
 	return nil
 }
 
@@ -402,7 +1400,7 @@ func (b *lxdBackend) Mount() (bool, error) {
 
 	revert.Add(func() {
 		unavailablePoolsMu.Lock()
-		unavailablePools[b.Name()] = struct{}{}
+		unavailablePools[b.Name()] = ""
 		unavailablePoolsMu.Unlock()
 	})
 
@@ -533,7 +1531,7 @@ func (b *lxdBackend) ensureInstanceSnapshotSymlink(instanceType instancetype.Typ
 	snapshotSymlink := InstancePath(instanceType, projectName, parentName, true)
 	volStorageName := project.Instance(projectName, parentName)
 
-	snapshotTargetPath := drivers.GetVolumeSnapshotDir(b.name, volType, volStorageName)
+	snapshotTargetPath := b.GetVolume(volType, drivers.ContentTypeFS, volStorageName, nil).SnapshotsDir()
 
 	// Remove any old symlinks left over by previous bugs that may point to a different pool.
 	if shared.PathExists(snapshotSymlink) {
@@ -562,53 +1560,160 @@ func (b *lxdBackend) removeInstanceSnapshotSymlinkIfUnused(instanceType instance
 		return err
 	}
 
-	parentName, _, _ := api.GetParentAndSnapshotName(instanceName)
-	snapshotSymlink := InstancePath(instanceType, projectName, parentName, true)
-	volStorageName := project.Instance(projectName, parentName)
-
-	snapshotTargetPath := drivers.GetVolumeSnapshotDir(b.name, volType, volStorageName)
-
-	// If snapshot parent directory doesn't exist, remove symlink.
-	if !shared.PathExists(snapshotTargetPath) {
-		if shared.PathExists(snapshotSymlink) {
-			err := os.Remove(snapshotSymlink)
-			if err != nil {
-				return fmt.Errorf("Failed to remove symlink %q: %w", snapshotSymlink, err)
-			}
-		}
+	parentName, _, _ := api.GetParentAndSnapshotName(instanceName)
+	snapshotSymlink := InstancePath(instanceType, projectName, parentName, true)
+	volStorageName := project.Instance(projectName, parentName)
+
+	snapshotTargetPath := b.GetVolume(volType, drivers.ContentTypeFS, volStorageName, nil).SnapshotsDir()
+
+	// If snapshot parent directory doesn't exist, remove symlink.
+	if !shared.PathExists(snapshotTargetPath) {
+		if shared.PathExists(snapshotSymlink) {
+			err := os.Remove(snapshotSymlink)
+			if err != nil {
+				return fmt.Errorf("Failed to remove symlink %q: %w", snapshotSymlink, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyInstanceRootOwner gives the root directory of the volume of an unprivileged container the ownership of the
+// root user of its next ID map when the volume is created. Containers using idmapped storage are skipped as their
+// files aren't shifted.
+func (b *lxdBackend) applyInstanceRootOwner(inst instance.Instance, vol *drivers.Volume) error {
+	c, ok := inst.(instance.Container)
+	if !ok || vol.ContentType() != drivers.ContentTypeFS {
+		return nil
+	}
+
+	nextIdmap, err := c.NextIdmap()
+	if err != nil {
+		return err
+	}
+
+	// Privileged containers don't have an ID map.
+	if nextIdmap == nil {
+		return nil
+	}
+
+	if c.IdmappedStorage(drivers.GetPoolMountPath(b.name)) != idmap.IdmapStorageNone {
+		return nil
+	}
+
+	uid, gid := nextIdmap.ShiftFromNs(0, 0)
+	if uid < 0 || gid < 0 {
+		return fmt.Errorf("The root user of instance %q isn't mapped", inst.Name())
+	}
+
+	vol.SetRootOwner(int(uid), int(gid))
+
+	return nil
+}
+
+// applyInstanceRootDiskOverrides applies the instance's root disk config to the volume's config.
+func (b *lxdBackend) applyInstanceRootDiskOverrides(inst instance.Instance, vol *drivers.Volume) error {
+	_, rootDiskConf, err := shared.GetRootDiskDevice(inst.ExpandedDevices().CloneNative())
+	if err != nil {
+		return err
+	}
+
+	for _, k := range instanceDiskVolumeEffectiveFields {
+		if rootDiskConf[k] != "" {
+			switch k {
+			case "size":
+				vol.SetConfigSize(rootDiskConf[k])
+			case "size.state":
+				vol.SetConfigStateSize(rootDiskConf[k])
+			default:
+				return fmt.Errorf("Unsupported instance disk volume override field %q", k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateInstance creates an empty instance.
+func (b *lxdBackend) CreateInstance(inst instance.Instance, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+	l.Debug("CreateInstance started")
+	defer l.Debug("CreateInstance finished")
+
+	waitPoolResumed(b.name)
+
+	err := b.isStatusReady()
+	if err != nil {
+		return err
+	}
+
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Validate config and create database entry for new storage volume.
+	volumeConfig := make(map[string]string)
+	err = VolumeDBCreate(b, inst.Project().Name, inst.Name(), "", volType, false, volumeConfig, inst.CreationDate(), time.Time{}, contentType, false)
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() { _ = VolumeDBDelete(b, inst.Project().Name, inst.Name(), volType) })
+
+	// Generate the effective root device volume for instance.
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	vol := b.GetVolume(volType, contentType, volStorageName, volumeConfig)
+	err = b.applyInstanceRootDiskOverrides(inst, &vol)
+	if err != nil {
+		return err
+	}
+
+	err = b.applyInstanceRootOwner(inst, &vol)
+	if err != nil {
+		return err
+	}
+
+	err = b.checkReservedSpaceGrowth("", vol.ConfigSize())
+	if err != nil {
+		return err
+	}
+
+	err = b.driver.CreateVolume(vol, nil, op)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	revert.Add(func() { _ = b.DeleteInstance(inst, op) })
 
-// applyInstanceRootDiskOverrides applies the instance's root disk config to the volume's config.
-func (b *lxdBackend) applyInstanceRootDiskOverrides(inst instance.Instance, vol *drivers.Volume) error {
-	_, rootDiskConf, err := shared.GetRootDiskDevice(inst.ExpandedDevices().CloneNative())
+	err = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, inst.Name(), vol.MountPath())
 	if err != nil {
 		return err
 	}
 
-	for _, k := range instanceDiskVolumeEffectiveFields {
-		if rootDiskConf[k] != "" {
-			switch k {
-			case "size":
-				vol.SetConfigSize(rootDiskConf[k])
-			case "size.state":
-				vol.SetConfigStateSize(rootDiskConf[k])
-			default:
-				return fmt.Errorf("Unsupported instance disk volume override field %q", k)
-			}
-		}
+	err = inst.DeferTemplateApply(instance.TemplateTriggerCreate)
+	if err != nil {
+		return err
 	}
 
+	revert.Success()
 	return nil
 }
 
-// CreateInstance creates an empty instance.
-func (b *lxdBackend) CreateInstance(inst instance.Instance, op *operations.Operation) error {
-	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
-	l.Debug("CreateInstance started")
-	defer l.Debug("CreateInstance finished")
+// CreateInstanceFromStream creates the instance's volume from a native send stream of it, such as one downloaded
+// from a remote server, verifying the SHA256 checksum of the stream (if not empty) before finalizing the volume.
+func (b *lxdBackend) CreateInstanceFromStream(inst instance.Instance, r io.Reader, checksum string, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name(), "checksum": checksum})
+	l.Debug("CreateInstanceFromStream started")
+	defer l.Debug("CreateInstanceFromStream finished")
+
+	waitPoolResumed(b.name)
 
 	err := b.isStatusReady()
 	if err != nil {
@@ -642,7 +1747,12 @@ func (b *lxdBackend) CreateInstance(inst instance.Instance, op *operations.Opera
 		return err
 	}
 
-	err = b.driver.CreateVolume(vol, nil, op)
+	err = b.checkReservedSpaceGrowth("", vol.ConfigSize())
+	if err != nil {
+		return err
+	}
+
+	err = b.driver.CreateVolumeFromStream(vol, r, checksum, op)
 	if err != nil {
 		return err
 	}
@@ -673,6 +1783,8 @@ func (b *lxdBackend) CreateInstanceFromBackup(srcBackup backup.Info, srcData io.
 	l.Debug("CreateInstanceFromBackup started")
 	defer l.Debug("CreateInstanceFromBackup finished")
 
+	waitPoolResumed(b.name)
+
 	// Get the volume name on storage.
 	volStorageName := project.Instance(srcBackup.Project, srcBackup.Name)
 
@@ -909,6 +2021,8 @@ func (b *lxdBackend) CreateInstanceFromCopy(inst instance.Instance, src instance
 	l.Debug("CreateInstanceFromCopy started")
 	defer l.Debug("CreateInstanceFromCopy finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -1118,6 +2232,19 @@ func (b *lxdBackend) CreateInstanceFromCopy(inst instance.Instance, src instance
 		}
 	}
 
+	// Copy the file indexes of the snapshots so that moving the instance keeps them.
+	srcStorageName := project.Instance(src.Project().Name, src.Name())
+	revert.Add(func() { _ = os.RemoveAll(snapshotIndexDir(b.name, volType, vol.Name())) })
+
+	for _, snapName := range snapshotNames {
+		unlock := locking.Lock(snapshotIndexLockName(srcPool.Name(), volType, srcStorageName, snapName))
+		err = copySnapshotIndex(snapshotIndexPath(srcPool.Name(), volType, srcStorageName, snapName), snapshotIndexPath(b.name, volType, vol.Name(), snapName))
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
 	revert.Success()
 	return nil
 }
@@ -1130,6 +2257,8 @@ func (b *lxdBackend) RefreshCustomVolume(projectName string, srcProjectName stri
 	l.Debug("RefreshCustomVolume started")
 	defer l.Debug("RefreshCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -1395,6 +2524,8 @@ func (b *lxdBackend) RefreshInstance(inst instance.Instance, src instance.Instan
 	l.Debug("RefreshInstance started")
 	defer l.Debug("RefreshInstance finished")
 
+	waitPoolResumed(b.name)
+
 	if inst.Type() != src.Type() {
 		return fmt.Errorf("Instance types must match")
 	}
@@ -1610,6 +2741,8 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 	l.Debug("CreateInstanceFromImage started")
 	defer l.Debug("CreateInstanceFromImage finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -1627,6 +2760,7 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 
 	// Validate config and create database entry for new storage volume.
 	volumeConfig := make(map[string]string) // Capture any default config generated by VolumeDBCreate.
+	volumeConfig[VolumeBaseImageKey] = fingerprint
 	err = VolumeDBCreate(b, inst.Project().Name, inst.Name(), "", volType, false, volumeConfig, inst.CreationDate(), time.Time{}, contentType, false)
 	if err != nil {
 		return err
@@ -1642,6 +2776,16 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 		return err
 	}
 
+	err = b.applyInstanceRootOwner(inst, &vol)
+	if err != nil {
+		return err
+	}
+
+	err = b.checkReservedSpaceGrowth("", vol.ConfigSize())
+	if err != nil {
+		return err
+	}
+
 	// Leave reverting on failure to caller, they are expected to call DeleteInstance().
 
 	// If the driver doesn't support optimized image volumes then create a new empty volume and
@@ -1659,8 +2803,12 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 	} else {
 		// If the driver supports optimized images then ensure the optimized image volume has been created
 		// for the images's fingerprint and that it matches the pool's current volume settings, and if not
-		// recreating using the pool's current volume settings.
-		err = b.EnsureImage(fingerprint, op)
+		// recreating using the pool's current volume settings. The image lock is held until the image volume
+		// has been copied so that it isn't pruned from the images cache meanwhile.
+		unlock := locking.Lock(b.imageLockName(fingerprint))
+		defer unlock()
+
+		err = b.ensureImage(fingerprint, op)
 		if err != nil {
 			return err
 		}
@@ -1711,6 +2859,14 @@ func (b *lxdBackend) CreateInstanceFromImage(inst instance.Instance, fingerprint
 		}
 	}
 
+	// Record the base image on the volume itself too where supported for it to follow the volume around. This is
+	// best-effort as the DB already records it, and writing it can be refused (such as trusted extended attributes
+	// within a user namespace).
+	err = b.driver.SetVolumeBaseImage(vol, fingerprint)
+	if err != nil && !errors.Is(err, drivers.ErrNotSupported) {
+		l.Warn("Failed recording base image on volume", logger.Ctx{"err": err})
+	}
+
 	err = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, inst.Name(), vol.MountPath())
 	if err != nil {
 		return err
@@ -1732,6 +2888,8 @@ func (b *lxdBackend) CreateInstanceFromMigration(inst instance.Instance, conn io
 	l.Debug("CreateInstanceFromMigration started")
 	defer l.Debug("CreateInstanceFromMigration finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -1750,12 +2908,22 @@ func (b *lxdBackend) CreateInstanceFromMigration(inst instance.Instance, conn io
 
 	// Receive index header from source if applicable and respond confirming receipt.
 	// This will also communicate the args.Refresh setting back to the source (in case it was changed by the
-	// caller if the instance DB record already exists).
-	srcInfo, err := b.migrationIndexHeaderReceive(l, args.IndexHeaderVersion, conn, args.Refresh)
+	// caller if the instance DB record already exists), along with what can be resumed of an interrupted
+	// migration of the volume.
+	resumeReceivedUUID := ""
+	if !args.Refresh {
+		resumeReceivedUUID = drivers.MigrationResumeReceivedUUID(b.name, volType, project.Instance(inst.Project().Name, inst.Name()))
+	}
+
+	srcInfo, err := b.migrationIndexHeaderReceive(l, args.IndexHeaderVersion, conn, args.Refresh, resumeReceivedUUID)
 	if err != nil {
 		return err
 	}
 
+	if srcInfo != nil {
+		args.SizeEstimate = srcInfo.SizeEstimate
+	}
+
 	var volumeDescription string
 	var volumeConfig map[string]string
 
@@ -1777,6 +2945,11 @@ func (b *lxdBackend) CreateInstanceFromMigration(inst instance.Instance, conn io
 		volumeDescription = args.Description
 	}
 
+	// Sources which don't record the base image on the volume still have it in the instance config.
+	if dbVol == nil && volumeConfig[VolumeBaseImageKey] == "" && inst.ExpandedConfig()["volatile.base_image"] != "" {
+		volumeConfig[VolumeBaseImageKey] = inst.ExpandedConfig()["volatile.base_image"]
+	}
+
 	// Check if the volume exists on storage.
 	volStorageName := project.Instance(inst.Project().Name, inst.Name())
 	vol := b.GetVolume(volType, contentType, volStorageName, volumeConfig)
@@ -1948,6 +3121,8 @@ func (b *lxdBackend) RenameInstance(inst instance.Instance, newName string, op *
 	l.Debug("RenameInstance started")
 	defer l.Debug("RenameInstance finished")
 
+	waitPoolResumed(b.name)
+
 	if inst.IsSnapshot() {
 		return fmt.Errorf("Instance cannot be a snapshot")
 	}
@@ -2033,10 +3208,10 @@ func (b *lxdBackend) RenameInstance(inst instance.Instance, newName string, op *
 	}
 
 	revert.Add(func() {
-		_ = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, inst.Name(), drivers.GetVolumeMountPath(b.name, volType, volStorageName))
+		_ = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, inst.Name(), b.GetVolume(volType, drivers.ContentTypeFS, volStorageName, nil).MountPath())
 	})
 
-	err = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, newName, drivers.GetVolumeMountPath(b.name, volType, newVolStorageName))
+	err = b.ensureInstanceSymlink(inst.Type(), inst.Project().Name, newName, b.GetVolume(volType, drivers.ContentTypeFS, newVolStorageName, nil).MountPath())
 	if err != nil {
 		return err
 	}
@@ -2045,6 +3220,29 @@ func (b *lxdBackend) RenameInstance(inst instance.Instance, newName string, op *
 		_ = b.removeInstanceSymlink(inst.Type(), inst.Project().Name, newName)
 	})
 
+	// Move the file indexes of the snapshots if there are any, once any indexing of the snapshots is done.
+	unlocks := make([]func(), 0, len(snapshots))
+	for _, srcSnapshot := range snapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(srcSnapshot)
+		unlocks = append(unlocks, locking.Lock(snapshotIndexLockName(b.name, volType, volStorageName, snapName)))
+	}
+
+	indexDir := snapshotIndexDir(b.name, volType, volStorageName)
+	newIndexDir := snapshotIndexDir(b.name, volType, newVolStorageName)
+	err = os.Rename(indexDir, newIndexDir)
+
+	for _, unlock := range unlocks {
+		unlock()
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed renaming snapshot indexes: %w", err)
+	}
+
+	if err == nil {
+		revert.Add(func() { _ = os.Rename(newIndexDir, indexDir) })
+	}
+
 	// Remove old instance snapshot symlink and create a new one if needed.
 	err = b.removeInstanceSnapshotSymlinkIfUnused(inst.Type(), inst.Project().Name, inst.Name())
 	if err != nil {
@@ -2068,6 +3266,8 @@ func (b *lxdBackend) DeleteInstance(inst instance.Instance, op *operations.Opera
 	l.Debug("DeleteInstance started")
 	defer l.Debug("DeleteInstance finished")
 
+	waitPoolResumed(b.name)
+
 	if inst.IsSnapshot() {
 		return fmt.Errorf("Instance must not be a snapshot")
 	}
@@ -2078,17 +3278,6 @@ func (b *lxdBackend) DeleteInstance(inst instance.Instance, op *operations.Opera
 		return err
 	}
 
-	// Get any snapshots the instance has in the format <instance name>/<snapshot name>.
-	snapshots, err := b.state.DB.Cluster.GetInstanceSnapshotsNames(inst.Project().Name, inst.Name())
-	if err != nil {
-		return err
-	}
-
-	// Check all snapshots are already removed.
-	if len(snapshots) > 0 {
-		return fmt.Errorf("Cannot remove an instance volume that has snapshots")
-	}
-
 	// Get the volume name on storage.
 	volStorageName := project.Instance(inst.Project().Name, inst.Name())
 	contentType := InstanceContentType(inst)
@@ -2096,15 +3285,41 @@ func (b *lxdBackend) DeleteInstance(inst instance.Instance, op *operations.Opera
 	// There's no need to pass config as it's not needed when deleting a volume.
 	vol := b.GetVolume(volType, contentType, volStorageName, nil)
 
-	// Delete the volume from the storage device. Must come after snapshots are removed.
-	// Must come before DB VolumeDBDelete so that the volume ID is still available.
-	l.Debug("Deleting instance volume", logger.Ctx{"volName": volStorageName})
+	// Get any snapshots the instance has in the format <instance name>/<snapshot name>.
+	snapshots := func() ([]string, error) {
+		return b.state.DB.Cluster.GetInstanceSnapshotsNames(inst.Project().Name, inst.Name())
+	}
+
+	// Delete the volume from the storage device once all snapshots are removed, holding off the creation of
+	// new ones. Must come before DB VolumeDBDelete so that the volume ID is still available.
+	lockName := drivers.OperationLockName("CreateInstanceSnapshot", b.name, vol.Type(), contentType, inst.Name())
+	err = deleteVolumeWithoutSnapshots(lockName, snapshots, func() error {
+		l.Debug("Deleting instance volume", logger.Ctx{"volName": volStorageName})
+
+		if !b.driver.HasVolume(vol) {
+			return nil
+		}
+
+		// Check the instance isn't running in case its state got out of sync with the database.
+		err := drivers.CheckVolumeNotInUse(vol.MountPath(), inst.IsRunning(), nil)
+		if err != nil {
+			return err
+		}
+
+		// As the volume has no snapshots, skip the snapshot checks and cleanup of DeleteVolume if possible.
+		err = b.driver.DeleteVolumeWithoutSnapshots(vol, op)
+		if errors.Is(err, drivers.ErrNotSupported) {
+			err = b.driver.DeleteVolume(vol, op)
+		}
 
-	if b.driver.HasVolume(vol) {
-		err = b.driver.DeleteVolume(vol, op)
 		if err != nil {
 			return fmt.Errorf("Error deleting storage volume: %w", err)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// Remove symlinks.
@@ -2124,6 +3339,13 @@ func (b *lxdBackend) DeleteInstance(inst instance.Instance, op *operations.Opera
 		return err
 	}
 
+	err = os.RemoveAll(snapshotIndexDir(b.name, vol.Type(), vol.Name()))
+	if err != nil {
+		return fmt.Errorf("Failed removing snapshot indexes: %w", err)
+	}
+
+	snapshotCreateForget(project.Instance(inst.Project().Name, inst.Name()))
+
 	return nil
 }
 
@@ -2133,6 +3355,8 @@ func (b *lxdBackend) UpdateInstance(inst instance.Instance, newDesc string, newC
 	l.Debug("UpdateInstance started")
 	defer l.Debug("UpdateInstance finished")
 
+	waitPoolResumed(b.name)
+
 	if inst.IsSnapshot() {
 		return fmt.Errorf("Instance cannot be a snapshot")
 	}
@@ -2290,6 +3514,8 @@ func (b *lxdBackend) MigrateInstance(inst instance.Instance, conn io.ReadWriteCl
 
 	// Send migration index header frame with volume info and wait for receipt if not doing final sync.
 	if !args.FinalSync {
+		args.Info.SizeEstimate = drivers.MigrationSizeEstimate(b.driver, vol, args.Snapshots)
+
 		resp, err := b.migrationIndexHeaderSend(l, args.IndexHeaderVersion, conn, args.Info)
 		if err != nil {
 			return err
@@ -2298,6 +3524,8 @@ func (b *lxdBackend) MigrateInstance(inst instance.Instance, conn io.ReadWriteCl
 		if resp.Refresh != nil {
 			args.Refresh = *resp.Refresh
 		}
+
+		args.ResumeReceivedUUID = resp.ResumeReceivedUUID
 	}
 
 	// Freeze the instance only when the underlying driver doesn't support it, and allowInconsistent is not set (and it's
@@ -2398,6 +3626,83 @@ func (b *lxdBackend) GetInstanceUsage(inst instance.Instance) (int64, error) {
 	return b.driver.GetVolumeUsage(vol)
 }
 
+// GetInstanceGeneration returns a token of the content of the instance's root volume which changes whenever the
+// volume changes. Returns drivers.ErrNotSupported if the pool can't report it.
+func (b *lxdBackend) GetInstanceGeneration(inst instance.Instance) (uint64, error) {
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return 0, err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	// There's no need to pass config as it's not needed when retrieving the volume generation.
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	vol := b.GetVolume(volType, contentType, volStorageName, nil)
+
+	return b.driver.GetVolumeGeneration(vol)
+}
+
+// GetInstanceSnapshotsInfo returns the metadata of the instance's snapshots, cross-referencing their database
+// records with the on-disk metadata which the driver lists for all of them at once. The recorded snapshots come
+// first, in the database order, followed by the ones only found on disk. Returns drivers.ErrNotSupported if the
+// pool can't list the on-disk metadata.
+func (b *lxdBackend) GetInstanceSnapshotsInfo(inst instance.Instance) ([]SnapshotInfo, error) {
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	// There's no need to pass config as it's not needed when listing the snapshots.
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	vol := b.GetVolume(volType, contentType, volStorageName, nil)
+
+	volSnapshots, err := b.driver.VolumeSnapshotsInfo(vol, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSnapshots, err := VolumeDBSnapshotsGet(b, inst.Project().Name, inst.Name(), volType)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshotsInfo(dbSnapshots, volSnapshots), nil
+}
+
+// InstanceTotalFootprint returns the space used by the instance's root volume and all its snapshots combined,
+// counting the data they share once rather than summing their usage.
+func (b *lxdBackend) InstanceTotalFootprint(inst instance.Instance) (int64, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+	l.Debug("InstanceTotalFootprint started")
+	defer l.Debug("InstanceTotalFootprint finished")
+
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return -1, err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	vol := b.GetVolume(volType, contentType, volStorageName, nil)
+
+	dbSnapshots, err := VolumeDBSnapshotsGet(b, inst.Project().Name, inst.Name(), volType)
+	if err != nil {
+		return -1, err
+	}
+
+	snapshots := make([]string, 0, len(dbSnapshots))
+	for _, dbSnapshot := range dbSnapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(dbSnapshot.Name)
+		snapshots = append(snapshots, snapName)
+	}
+
+	return b.driver.InstanceTotalFootprint(vol, snapshots)
+}
+
 // SetInstanceQuota sets the quota on the instance's root volume.
 // Returns ErrInUse if the instance is running and the storage driver doesn't support online resizing.
 func (b *lxdBackend) SetInstanceQuota(inst instance.Instance, size string, vmStateSize string, op *operations.Operation) error {
@@ -2417,6 +3722,19 @@ func (b *lxdBackend) SetInstanceQuota(inst instance.Instance, size string, vmSta
 	// Apply the main volume quota.
 	// There's no need to pass config as it's not needed when setting quotas.
 	vol := b.GetVolume(volType, contentVolume, volStorageName, nil)
+
+	// Check the space the volume can grow by against the reserved space of the pool.
+	usedSize := ""
+	used, err := b.driver.GetVolumeUsage(vol)
+	if err == nil && used > 0 {
+		usedSize = fmt.Sprintf("%d", used)
+	}
+
+	err = b.checkReservedSpaceGrowth(usedSize, size)
+	if err != nil {
+		return err
+	}
+
 	err = b.driver.SetVolumeQuota(vol, size, false, op)
 	if err != nil {
 		return err
@@ -2502,48 +3820,121 @@ func (b *lxdBackend) MountInstance(inst instance.Instance, op *operations.Operat
 		DiskPath: diskPath,
 	}
 
-	revert.Success() // From here on it is up to caller to call UnmountInstance() when done.
-	return mountInfo, nil
-}
+	revert.Success() // From here on it is up to caller to call UnmountInstance() when done.
+	return mountInfo, nil
+}
+
+// UnmountInstance unmounts the instance's root volume.
+func (b *lxdBackend) UnmountInstance(inst instance.Instance, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+	l.Debug("UnmountInstance started")
+	defer l.Debug("UnmountInstance finished")
+
+	// Check we can convert the instance to the volume type needed.
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	// Get the volume.
+	var vol drivers.Volume
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+
+	if inst.ID() > -1 {
+		// Load storage volume from database.
+		dbVol, err := VolumeDBGet(b, inst.Project().Name, inst.Name(), volType)
+		if err != nil {
+			return err
+		}
+
+		// Generate the effective root device volume for instance.
+		vol = b.GetVolume(volType, contentType, volStorageName, dbVol.Config)
+		err = b.applyInstanceRootDiskOverrides(inst, &vol)
+		if err != nil {
+			return err
+		}
+	} else {
+		vol = b.GetVolume(volType, contentType, volStorageName, nil)
+	}
+
+	_, err = b.driver.UnmountVolume(vol, false, op)
+
+	return err
+}
+
+// DiffInstanceWithImage returns the paths added, modified and deleted in the volume of the container compared to
+// the volume of the image it was created from, which must still exist on the pool. The volumes are compared file
+// by file if the driver can't compare them itself.
+func (b *lxdBackend) DiffInstanceWithImage(inst instance.Instance, op *operations.Operation) (*drivers.VolumeDiff, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+	l.Debug("DiffInstanceWithImage started")
+	defer l.Debug("DiffInstanceWithImage finished")
+
+	if inst.Type() != instancetype.Container {
+		return nil, fmt.Errorf("Only containers can be compared with their image")
+	}
+
+	volType, err := InstanceTypeToVolumeType(inst.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := InstanceContentType(inst)
+
+	dbVol, err := VolumeDBGet(b, inst.Project().Name, inst.Name(), volType)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := dbVol.Config[VolumeBaseImageKey]
+	if fingerprint == "" {
+		return nil, fmt.Errorf("Instance volume doesn't record the image it was created from")
+	}
+
+	imgDBVol, err := VolumeDBGet(b, project.Default, fingerprint, drivers.VolumeTypeImage)
+	if err != nil {
+		return nil, fmt.Errorf("Image %q of the instance isn't available on the pool: %w", fingerprint, err)
+	}
+
+	// Get the idmap the volume is shifted with, as the files of the image aren't.
+	c, ok := inst.(instance.Container)
+	if !ok {
+		return nil, fmt.Errorf("Instance %q isn't a container", inst.Name())
+	}
+
+	diskIdmap, err := c.DiskIdmap()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting container idmap: %w", err)
+	}
 
-// UnmountInstance unmounts the instance's root volume.
-func (b *lxdBackend) UnmountInstance(inst instance.Instance, op *operations.Operation) error {
-	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
-	l.Debug("UnmountInstance started")
-	defer l.Debug("UnmountInstance finished")
+	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	vol := b.GetVolume(volType, contentType, volStorageName, dbVol.Config)
+	imgVol := b.GetVolume(drivers.VolumeTypeImage, contentType, fingerprint, imgDBVol.Config)
 
-	// Check we can convert the instance to the volume type needed.
-	volType, err := InstanceTypeToVolumeType(inst.Type())
+	err = b.driver.MountVolume(vol, op)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	contentType := InstanceContentType(inst)
+	defer func() { _, _ = b.driver.UnmountVolume(vol, false, op) }()
 
-	// Get the volume.
-	var vol drivers.Volume
-	volStorageName := project.Instance(inst.Project().Name, inst.Name())
+	err = b.driver.MountVolume(imgVol, op)
+	if err != nil {
+		return nil, err
+	}
 
-	if inst.ID() > -1 {
-		// Load storage volume from database.
-		dbVol, err := VolumeDBGet(b, inst.Project().Name, inst.Name(), volType)
-		if err != nil {
-			return err
-		}
+	defer func() { _, _ = b.driver.UnmountVolume(imgVol, false, op) }()
 
-		// Generate the effective root device volume for instance.
-		vol = b.GetVolume(volType, contentType, volStorageName, dbVol.Config)
-		err = b.applyInstanceRootDiskOverrides(inst, &vol)
-		if err != nil {
-			return err
-		}
-	} else {
-		vol = b.GetVolume(volType, contentType, volStorageName, nil)
+	diff, err := b.driver.DiffVolume(vol, imgVol, diskIdmap, op)
+	if errors.Is(err, drivers.ErrNotSupported) {
+		return drivers.DiffVolumePaths(imgVol.MountPath(), vol.MountPath(), diskIdmap)
+	} else if err != nil {
+		return nil, err
 	}
 
-	_, err = b.driver.UnmountVolume(vol, false, op)
-
-	return err
+	return diff, nil
 }
 
 // getInstanceDisk returns the location of the disk.
@@ -2575,12 +3966,29 @@ func (b *lxdBackend) getInstanceDisk(inst instance.Instance) (string, error) {
 	return diskPath, nil
 }
 
+// CheckInstanceSnapshotRate returns an ErrRateLimited error if a snapshot of the instance would currently be
+// refused by snapshots.create_rate. It doesn't count against the rate.
+func (b *lxdBackend) CheckInstanceSnapshotRate(inst instance.Instance) error {
+	rate, err := b.instanceSnapshotCreateRate(inst)
+	if err != nil {
+		return err
+	}
+
+	if !snapshotCreateAvailable(project.Instance(inst.Project().Name, inst.Name()), rate, time.Now()) {
+		return fmt.Errorf("Instance %q cannot create more than %d snapshots per minute: %w", inst.Name(), rate, ErrRateLimited)
+	}
+
+	return nil
+}
+
 // CreateInstanceSnapshot creates a snaphot of an instance volume.
 func (b *lxdBackend) CreateInstanceSnapshot(inst instance.Instance, src instance.Instance, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name(), "src": src.Name()})
 	l.Debug("CreateInstanceSnapshot started")
 	defer l.Debug("CreateInstanceSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	if inst.Type() != src.Type() {
 		return fmt.Errorf("Instance types must match")
 	}
@@ -2593,6 +4001,22 @@ func (b *lxdBackend) CreateInstanceSnapshot(inst instance.Instance, src instance
 		return fmt.Errorf("Source instance cannot be a snapshot")
 	}
 
+	rate, err := b.instanceSnapshotCreateRate(src)
+	if err != nil {
+		return err
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	rateKey := project.Instance(src.Project().Name, src.Name())
+	if !snapshotCreateAllowed(rateKey, rate, time.Now()) {
+		return fmt.Errorf("Instance %q cannot create more than %d snapshots per minute: %w", src.Name(), rate, ErrRateLimited)
+	}
+
+	// Failed snapshots don't count against the rate.
+	revert.Add(func() { snapshotCreateRefund(rateKey, rate) })
+
 	// Check we can convert the instance to the volume type needed.
 	volType, err := InstanceTypeToVolumeType(inst.Type())
 	if err != nil {
@@ -2607,9 +4031,6 @@ func (b *lxdBackend) CreateInstanceSnapshot(inst instance.Instance, src instance
 		return err
 	}
 
-	revert := revert.New()
-	defer revert.Fail()
-
 	// Validate config and create database entry for new storage volume.
 	err = VolumeDBCreate(b, inst.Project().Name, inst.Name(), srcDBVol.Description, volType, true, srcDBVol.Config, inst.CreationDate(), time.Time{}, contentType, false)
 	if err != nil {
@@ -2643,26 +4064,174 @@ func (b *lxdBackend) CreateInstanceSnapshot(inst instance.Instance, src instance
 	unlock := locking.Lock(drivers.OperationLockName("CreateInstanceSnapshot", b.name, vol.Type(), contentType, src.Name()))
 	defer unlock()
 
+	start := time.Now()
 	err = b.driver.CreateVolumeSnapshot(vol, op)
 	if err != nil {
 		return err
 	}
 
+	b.recordSnapshotCopy(vol, time.Since(start))
+
+	revert.Add(func() { _ = b.driver.DeleteVolumeSnapshot(vol, op) })
+
 	err = b.ensureInstanceSnapshotSymlink(inst.Type(), inst.Project().Name, inst.Name())
 	if err != nil {
 		return err
 	}
 
 	revert.Success()
+
+	// Index the files of the snapshot in the background so that creating it isn't slowed down.
+	if src.Type() == instancetype.Container && shared.IsTrue(src.ExpandedConfig()["snapshots.index"]) {
+		b.indexInstanceSnapshot(inst, vol)
+	}
+
 	return nil
 }
 
+// indexInstanceSnapshot starts a background operation writing the file index of the instance snapshot whose volume
+// is snapVol. Failures are only logged as the snapshot itself was created.
+func (b *lxdBackend) indexInstanceSnapshot(inst instance.Instance, snapVol drivers.Volume) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
+
+	parentName, snapName, _ := api.GetParentAndSnapshotName(inst.Name())
+	parentStorageName := project.Instance(inst.Project().Name, parentName)
+
+	run := func(op *operations.Operation) error {
+		// Hold off the deletion and renaming of the snapshot's index until it's written.
+		unlock := locking.Lock(snapshotIndexLockName(b.name, snapVol.Type(), parentStorageName, snapName))
+		defer unlock()
+
+		// The snapshot may have been deleted or renamed before indexing started.
+		_, err := VolumeDBGet(b, inst.Project().Name, inst.Name(), snapVol.Type())
+		if err != nil {
+			l.Debug("Skipping index of snapshot", logger.Ctx{"err": err})
+			return nil
+		}
+
+		_, err = b.MountInstanceSnapshot(inst, nil)
+		if err != nil {
+			l.Warn("Failed mounting snapshot to index it", logger.Ctx{"err": err})
+			return nil
+		}
+
+		defer func() { _ = b.UnmountInstanceSnapshot(inst, nil) }()
+
+		indexPath := snapshotIndexPath(b.name, snapVol.Type(), parentStorageName, snapName)
+		err = writeSnapshotIndex(filepath.Join(snapVol.MountPath(), "rootfs"), indexPath)
+		if err != nil {
+			l.Warn("Failed indexing snapshot", logger.Ctx{"err": err})
+		}
+
+		return nil
+	}
+
+	resources := map[string][]string{}
+	resources["instances"] = []string{parentName}
+
+	op, err := operations.OperationCreate(b.state, inst.Project().Name, operations.OperationClassTask, operationtype.SnapshotIndex, resources, nil, run, nil, nil, nil)
+	if err != nil {
+		l.Warn("Failed creating snapshot index operation", logger.Ctx{"err": err})
+		return
+	}
+
+	err = op.Start()
+	if err != nil {
+		l.Warn("Failed starting snapshot index operation", logger.Ctx{"err": err})
+	}
+}
+
+// FindSnapshotsWithPath returns the snapshots of the instance volume, specified as "<type>/<name>", whose file
+// index contains path, oldest first. Only the snapshots indexed when created (see snapshots.index) are searched.
+func (b *lxdBackend) FindSnapshotsWithPath(projectName string, volName string, path string) ([]SnapshotIndexMatch, error) {
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := b.typedVolumeGet(projectName, volType, name)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSnapshots, err := VolumeDBSnapshotsGet(b, projectName, name, volType)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]string, 0, len(dbSnapshots))
+	for _, dbSnapshot := range dbSnapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(dbSnapshot.Name)
+		snapshots = append(snapshots, snapName)
+	}
+
+	return findInSnapshotIndexes(snapshotIndexDir(b.name, volType, vol.Name()), snapshots, path)
+}
+
+// SnapshotVolumePath creates a snapshot of only the directory at path within the instance or custom volume
+// (passed as "<type>/<name>"), so that it can be snapshotted independently of the rest of the volume. Returns the
+// path of the snapshot.
+func (b *lxdBackend) SnapshotVolumePath(projectName string, volName string, path string, snapshotName string, op *operations.Operation) (string, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName, "path": path, "snapshotName": snapshotName})
+	l.Debug("SnapshotVolumePath started")
+	defer l.Debug("SnapshotVolumePath finished")
+
+	volType, name, err := b.typedVolume(projectName, volName)
+	if err != nil {
+		return "", err
+	}
+
+	// The directory gets replaced by a subvolume, which running instances wouldn't notice.
+	switch volType {
+	case drivers.VolumeTypeContainer, drivers.VolumeTypeVM:
+		inst, err := instance.LoadByProjectAndName(b.state, projectName, name)
+		if err != nil {
+			return "", err
+		}
+
+		if inst.IsRunning() {
+			return "", fmt.Errorf("Instance %q must be stopped to snapshot a path within it", name)
+		}
+
+	case drivers.VolumeTypeCustom:
+		dbVol, err := VolumeDBGet(b, projectName, name, volType)
+		if err != nil {
+			return "", err
+		}
+
+		err = VolumeUsedByInstanceDevices(b.state, b.Name(), projectName, &dbVol.StorageVolume, true, func(dbInst db.InstanceArgs, project api.Project, usedByDevices []string) error {
+			inst, err := instance.Load(b.state, dbInst, project)
+			if err != nil {
+				return err
+			}
+
+			if inst.IsRunning() {
+				return fmt.Errorf("Cannot snapshot a path within a custom volume used by running instances")
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	vol, err := b.typedVolumeGet(projectName, volType, name)
+	if err != nil {
+		return "", err
+	}
+
+	return b.driver.SnapshotVolumePath(vol, path, snapshotName, op)
+}
+
 // RenameInstanceSnapshot renames an instance snapshot.
 func (b *lxdBackend) RenameInstanceSnapshot(inst instance.Instance, newName string, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name(), "newName": newName})
 	l.Debug("RenameInstanceSnapshot started")
 	defer l.Debug("RenameInstanceSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -2719,6 +4288,22 @@ func (b *lxdBackend) RenameInstanceSnapshot(inst instance.Instance, newName stri
 		_ = b.state.DB.Cluster.RenameStoragePoolVolume(inst.Project().Name, newVolName, inst.Name(), volDBType, b.ID())
 	})
 
+	// Rename the file index of the snapshot if it has one, once any indexing of the snapshot is done.
+	parentStorageName := project.Instance(inst.Project().Name, parentName)
+	unlockIndex := locking.Lock(snapshotIndexLockName(b.name, volType, parentStorageName, oldSnapshotName))
+	defer unlockIndex()
+
+	indexPath := snapshotIndexPath(b.name, volType, parentStorageName, oldSnapshotName)
+	newIndexPath := snapshotIndexPath(b.name, volType, parentStorageName, newName)
+	err = os.Rename(indexPath, newIndexPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed renaming snapshot index: %w", err)
+	}
+
+	if err == nil {
+		revert.Add(func() { _ = os.Rename(newIndexPath, indexPath) })
+	}
+
 	// Ensure the backup file reflects current config.
 	err = b.UpdateInstanceBackupFile(inst, op)
 	if err != nil {
@@ -2730,11 +4315,14 @@ func (b *lxdBackend) RenameInstanceSnapshot(inst instance.Instance, newName stri
 }
 
 // DeleteInstanceSnapshot removes the snapshot volume for the supplied snapshot instance.
-func (b *lxdBackend) DeleteInstanceSnapshot(inst instance.Instance, op *operations.Operation) error {
+// Unless force is true, the snapshot is only removed if the snapshot minimum policy allows it.
+func (b *lxdBackend) DeleteInstanceSnapshot(inst instance.Instance, force bool, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
 	l.Debug("DeleteInstanceSnapshot started")
 	defer l.Debug("DeleteInstanceSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	parentName, snapName, isSnap := api.GetParentAndSnapshotName(inst.Name())
 	if !inst.IsSnapshot() || !isSnap {
 		return fmt.Errorf("Instance must be a snapshot")
@@ -2757,29 +4345,200 @@ func (b *lxdBackend) DeleteInstanceSnapshot(inst instance.Instance, op *operatio
 
 	snapVolName := drivers.GetSnapshotVolumeName(parentStorageName, snapName)
 
-	// There's no need to pass config as it's not needed when deleting a volume snapshot.
-	vol := b.GetVolume(volType, contentType, snapVolName, nil)
+	// Pass the config so that the driver takes the recorded send parent ref counter into account.
+	volConfig, err := b.instanceSnapshotVolumeConfig(inst.Project().Name, inst.Name(), volType)
+	if err != nil {
+		return err
+	}
+
+	vol := b.GetVolume(volType, contentType, snapVolName, volConfig)
 
 	if b.driver.HasVolume(vol) {
+		// Enforce the snapshot minimum policy against the snapshots present on the storage device.
+		if !force {
+			minimum, err := b.instanceSnapshotMinimum(inst.Project().Name)
+			if err != nil {
+				return err
+			}
+
+			if minimum > 0 {
+				parentVol := b.GetVolume(volType, contentType, parentStorageName, nil)
+				err = drivers.CheckSnapshotMinimum(b.driver, parentVol, minimum, op)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
 		err = b.driver.DeleteVolumeSnapshot(vol, op)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Delete symlink if needed.
-	err = b.removeInstanceSnapshotSymlinkIfUnused(inst.Type(), inst.Project().Name, inst.Name())
-	if err != nil {
-		return err
+	// Delete symlink if needed.
+	err = b.removeInstanceSnapshotSymlinkIfUnused(inst.Type(), inst.Project().Name, inst.Name())
+	if err != nil {
+		return err
+	}
+
+	// Remove the snapshot volume record from the database if exists.
+	err = VolumeDBDelete(b, inst.Project().Name, inst.Name(), vol.Type())
+	if err != nil {
+		return err
+	}
+
+	// Remove the file index of the snapshot if it has one, once any indexing of the snapshot is done.
+	unlock := locking.Lock(snapshotIndexLockName(b.name, volType, parentStorageName, snapName))
+	defer unlock()
+
+	err = os.Remove(snapshotIndexPath(b.name, volType, parentStorageName, snapName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed removing snapshot index: %w", err)
+	}
+
+	return nil
+}
+
+// CheckInstanceSnapshotsDelete checks that the supplied instance snapshots can all be deleted together, that is
+// that they exist on the storage device, aren't mounted or used as the parent of an incremental send, and that
+// deleting them leaves their instances with as many snapshots as the snapshot minimum policy requires.
+func (b *lxdBackend) CheckInstanceSnapshotsDelete(snapshots []instance.Instance, op *operations.Operation) error {
+	projectNames := []string{}
+	projectSnapshots := map[string][]instance.Instance{}
+	for _, snapshot := range snapshots {
+		projectName := snapshot.Project().Name
+		if projectSnapshots[projectName] == nil {
+			projectNames = append(projectNames, projectName)
+		}
+
+		projectSnapshots[projectName] = append(projectSnapshots[projectName], snapshot)
+	}
+
+	for _, projectName := range projectNames {
+		minimum, err := b.instanceSnapshotMinimum(projectName)
+		if err != nil {
+			return err
+		}
+
+		names := []string{}
+		existing := map[string][]string{}
+		vols := map[string]drivers.Volume{}
+
+		for _, snapshot := range projectSnapshots[projectName] {
+			names = append(names, snapshot.Name())
+
+			parentName, snapName, isSnap := api.GetParentAndSnapshotName(snapshot.Name())
+			if !isSnap {
+				continue
+			}
+
+			volType, err := InstanceTypeToVolumeType(snapshot.Type())
+			if err != nil {
+				return err
+			}
+
+			contentType := InstanceContentType(snapshot)
+			parentStorageName := project.Instance(projectName, parentName)
+
+			_, ok := existing[parentName]
+			if !ok {
+				parentVol := b.GetVolume(volType, contentType, parentStorageName, nil)
+				existing[parentName], err = b.driver.VolumeSnapshots(parentVol, op)
+				if err != nil {
+					return fmt.Errorf("Failed listing snapshots of instance %q: %w", parentName, err)
+				}
+			}
+
+			volConfig, err := b.instanceSnapshotVolumeConfig(projectName, snapshot.Name(), volType)
+			if err != nil {
+				return err
+			}
+
+			vols[snapshot.Name()] = b.GetVolume(volType, contentType, drivers.GetSnapshotVolumeName(parentStorageName, snapName), volConfig)
+		}
+
+		inUse := func(snapshot string) bool {
+			return vols[snapshot].MountInUse() || vols[snapshot].SendParentInUse()
+		}
+
+		err = checkSnapshotsDeletable(names, existing, inUse, minimum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// instanceSnapshotVolumeConfig returns the config of the volume record of an instance snapshot, or nil if the
+// snapshot has no volume record.
+func (b *lxdBackend) instanceSnapshotVolumeConfig(projectName string, snapshotName string, volType drivers.VolumeType) (map[string]string, error) {
+	dbVol, err := VolumeDBGet(b, projectName, snapshotName, volType)
+	if err != nil {
+		if response.IsNotFoundError(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return dbVol.Config, nil
+}
+
+// instanceSnapshotCreateRate returns the maximum number of snapshots of the instance which can be created per
+// minute, 0 meaning no limit. The instance's snapshots.create_rate setting takes precedence over the pool's one.
+func (b *lxdBackend) instanceSnapshotCreateRate(inst instance.Instance) (uint64, error) {
+	value := inst.ExpandedConfig()["snapshots.create_rate"]
+	if value == "" {
+		value = b.db.Config["snapshots.create_rate"]
+	}
+
+	if value == "" {
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid snapshots.create_rate value %q: %w", value, err)
+	}
+
+	return rate, nil
+}
+
+// instanceSnapshotMinimum returns the minimum number of snapshots each instance must keep.
+// The project's snapshots.min_per_instance setting takes precedence over the pool's one.
+func (b *lxdBackend) instanceSnapshotMinimum(projectName string) (int, error) {
+	value := b.db.Config["snapshots.min_per_instance"]
+
+	var projectConfig map[string]string
+	err := b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		dbProject, err := cluster.GetProject(ctx, tx.Tx(), projectName)
+		if err != nil {
+			return err
+		}
+
+		projectConfig, err = cluster.GetProjectConfig(ctx, tx.Tx(), dbProject.ID)
+		return err
+	})
+	if err != nil {
+		return -1, fmt.Errorf("Failed loading project %q config: %w", projectName, err)
+	}
+
+	if projectConfig["snapshots.min_per_instance"] != "" {
+		value = projectConfig["snapshots.min_per_instance"]
 	}
 
-	// Remove the snapshot volume record from the database if exists.
-	err = VolumeDBDelete(b, inst.Project().Name, inst.Name(), vol.Type())
+	if value == "" {
+		return 0, nil
+	}
+
+	minimum, err := strconv.Atoi(value)
 	if err != nil {
-		return err
+		return -1, fmt.Errorf("Invalid snapshots.min_per_instance value %q: %w", value, err)
 	}
 
-	return nil
+	return minimum, nil
 }
 
 // RestoreInstanceSnapshot restores an instance snapshot.
@@ -2788,6 +4547,8 @@ func (b *lxdBackend) RestoreInstanceSnapshot(inst instance.Instance, src instanc
 	l.Debug("RestoreInstanceSnapshot started")
 	defer l.Debug("RestoreInstanceSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -3003,6 +4764,8 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 	l.Debug("EnsureImage started")
 	defer l.Debug("EnsureImage finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -3015,9 +4778,22 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 	// We need to lock this operation to ensure that the image is not being created multiple times.
 	// Uses a lock name of "EnsureImage_<fingerprint>" to avoid deadlocking with CreateVolume below that also
 	// establishes a lock on the volume type & name if it needs to mount the volume before filling.
-	unlock := locking.Lock(drivers.OperationLockName("EnsureImage", b.name, drivers.VolumeTypeImage, "", fingerprint))
+	unlock := locking.Lock(b.imageLockName(fingerprint))
 	defer unlock()
 
+	return b.ensureImage(fingerprint, op)
+}
+
+// imageLockName returns the name of the lock held while creating the optimized volume of the image and while
+// copying from it, so that it isn't pruned from the images cache meanwhile.
+func (b *lxdBackend) imageLockName(fingerprint string) string {
+	return drivers.OperationLockName("EnsureImage", b.name, drivers.VolumeTypeImage, "", fingerprint)
+}
+
+// ensureImage is EnsureImage for callers holding the image lock.
+func (b *lxdBackend) ensureImage(fingerprint string, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"fingerprint": fingerprint})
+
 	// Load image info from database.
 	_, image, err := b.state.DB.Cluster.GetImageFromAnyProject(fingerprint)
 	if err != nil {
@@ -3111,6 +4887,13 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 		}
 	}
 
+	// Make room for the new image volume if the images cache of the pool is bounded. The size of the image file
+	// is used as an estimate of the space it will take.
+	err = b.pruneImagesCache(fingerprint, image.Size, op)
+	if err != nil {
+		return err
+	}
+
 	volFiller := drivers.VolumeFiller{
 		Fingerprint: fingerprint,
 		Fill:        b.imageFiller(fingerprint, op),
@@ -3145,12 +4928,85 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 	return nil
 }
 
+// pruneImagesCache deletes the least recently used image volumes of the pool, other than the one of fingerprint,
+// once the space used by the images cache of the pool and the incoming bytes of the new image approach the limit
+// it is bounded by. The images being copied from are skipped.
+func (b *lxdBackend) pruneImagesCache(fingerprint string, incoming int64, op *operations.Operation) error {
+	usage, limit, err := b.driver.ImagesCacheUsage()
+	if err != nil {
+		if errors.Is(err, drivers.ErrNotSupported) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed getting images cache usage: %w", err)
+	}
+
+	if !imagesCacheNeedsPruning(usage, limit) {
+		return nil
+	}
+
+	var imgVols []drivers.Volume
+	err = b.state.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		vols, err := b.memberVolumes(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, vol := range vols {
+			if vol.Type() == drivers.VolumeTypeImage && vol.Name() != fingerprint {
+				imgVols = append(imgVols, vol)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	images := make([]imagesCacheEntry, 0, len(imgVols))
+	for _, imgVol := range imgVols {
+		entry := imagesCacheEntry{Fingerprint: imgVol.Name()}
+
+		_, image, err := b.state.DB.Cluster.GetImageFromAnyProject(imgVol.Name())
+		if err != nil && !response.IsNotFoundError(err) {
+			return err
+		}
+
+		if image != nil {
+			entry.LastUsedAt = image.LastUsedAt
+		}
+
+		volUsage, err := b.driver.GetVolumeUsage(imgVol)
+		if err == nil {
+			entry.Usage = volUsage
+		}
+
+		images = append(images, entry)
+	}
+
+	tryLock := func(imgFingerprint string) (locking.UnlockFunc, bool) {
+		return locking.TryLock(b.imageLockName(imgFingerprint))
+	}
+
+	deleteImage := func(imgFingerprint string) error {
+		b.logger.Info("Pruning image from images cache", logger.Ctx{"fingerprint": imgFingerprint, "usage": usage, "incoming": incoming, "limit": limit})
+		return b.DeleteImage(imgFingerprint, op)
+	}
+
+	_, err = pruneImages(images, usage, incoming, limit, tryLock, deleteImage)
+
+	return err
+}
+
 // DeleteImage removes an image from the database and underlying storage device if needed.
 func (b *lxdBackend) DeleteImage(fingerprint string, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"fingerprint": fingerprint})
 	l.Debug("DeleteImage started")
 	defer l.Debug("DeleteImage finished")
 
+	waitPoolResumed(b.name)
+
 	// We need to lock this operation to ensure that the image is not being deleted multiple times.
 	unlock := locking.Lock(drivers.OperationLockName("DeleteImage", b.name, drivers.VolumeTypeImage, "", fingerprint))
 	defer unlock()
@@ -3875,6 +5731,8 @@ func (b *lxdBackend) CreateCustomVolume(projectName string, volName string, desc
 	l.Debug("CreateCustomVolume started")
 	defer l.Debug("CreateCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -3902,6 +5760,11 @@ func (b *lxdBackend) CreateCustomVolume(projectName string, volName string, desc
 		return fmt.Errorf("Storage pool does not support custom volume type")
 	}
 
+	err = b.checkReservedSpaceGrowth("", vol.ConfigSize())
+	if err != nil {
+		return err
+	}
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -3932,6 +5795,8 @@ func (b *lxdBackend) CreateCustomVolumeFromCopy(projectName string, srcProjectNa
 	l.Debug("CreateCustomVolumeFromCopy started")
 	defer l.Debug("CreateCustomVolumeFromCopy finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -4210,8 +6075,9 @@ func (b *lxdBackend) migrationIndexHeaderSend(l logger.Logger, indexHeaderVersio
 }
 
 // migrationIndexHeaderReceive receives migration index header from source and sends confirmation of receipt.
+// The confirmation includes resumeReceivedUUID, if not empty, for the source to resume an interrupted migration.
 // Returns the received source index header info.
-func (b *lxdBackend) migrationIndexHeaderReceive(l logger.Logger, indexHeaderVersion uint32, conn io.ReadWriteCloser, refresh bool) (*migration.Info, error) {
+func (b *lxdBackend) migrationIndexHeaderReceive(l logger.Logger, indexHeaderVersion uint32, conn io.ReadWriteCloser, refresh bool, resumeReceivedUUID string) (*migration.Info, error) {
 	info := migration.Info{}
 
 	// Receive index header from source if applicable and respond confirming receipt.
@@ -4230,7 +6096,7 @@ func (b *lxdBackend) migrationIndexHeaderReceive(l logger.Logger, indexHeaderVer
 
 		l.Info("Received migration index header, sending response", logger.Ctx{"version": indexHeaderVersion})
 
-		infoResp := migration.InfoResponse{StatusCode: http.StatusOK, Refresh: &refresh}
+		infoResp := migration.InfoResponse{StatusCode: http.StatusOK, Refresh: &refresh, ResumeReceivedUUID: resumeReceivedUUID}
 		headerJSON, err := json.Marshal(infoResp)
 		if err != nil {
 			return nil, fmt.Errorf("Failed encoding migration index header response: %w", err)
@@ -4283,6 +6149,9 @@ func (b *lxdBackend) MigrateCustomVolume(projectName string, conn io.ReadWriteCl
 		return fmt.Errorf("Requested snapshots count (%d) doesn't match volume snapshot config count (%d)", len(args.Snapshots), len(args.Info.Config.VolumeSnapshots))
 	}
 
+	vol := b.GetVolume(drivers.VolumeTypeCustom, contentType, volStorageName, args.Info.Config.Volume.Config)
+	args.Info.SizeEstimate = drivers.MigrationSizeEstimate(b.driver, vol, args.Snapshots)
+
 	// Send migration index header frame with volume info and wait for receipt.
 	resp, err := b.migrationIndexHeaderSend(l, args.IndexHeaderVersion, conn, args.Info)
 	if err != nil {
@@ -4293,7 +6162,8 @@ func (b *lxdBackend) MigrateCustomVolume(projectName string, conn io.ReadWriteCl
 		args.Refresh = *resp.Refresh
 	}
 
-	vol := b.GetVolume(drivers.VolumeTypeCustom, contentType, volStorageName, args.Info.Config.Volume.Config)
+	args.ResumeReceivedUUID = resp.ResumeReceivedUUID
+
 	err = b.driver.MigrateVolume(vol, conn, args, op)
 	if err != nil {
 		return err
@@ -4308,6 +6178,8 @@ func (b *lxdBackend) CreateCustomVolumeFromMigration(projectName string, conn io
 	l.Debug("CreateCustomVolumeFromMigration started")
 	defer l.Debug("CreateCustomVolumeFromMigration finished")
 
+	waitPoolResumed(b.name)
+
 	err := b.isStatusReady()
 	if err != nil {
 		return err
@@ -4372,12 +6244,22 @@ func (b *lxdBackend) CreateCustomVolumeFromMigration(projectName string, conn io
 
 	// Receive index header from source if applicable and respond confirming receipt.
 	// This will also let the source know whether to actually perform a refresh, as the target
-	// will set Refresh to false if the volume doesn't exist.
-	srcInfo, err := b.migrationIndexHeaderReceive(l, args.IndexHeaderVersion, conn, args.Refresh)
+	// will set Refresh to false if the volume doesn't exist, along with what can be resumed of an
+	// interrupted migration of the volume.
+	resumeReceivedUUID := ""
+	if !args.Refresh {
+		resumeReceivedUUID = drivers.MigrationResumeReceivedUUID(b.name, drivers.VolumeTypeCustom, volStorageName)
+	}
+
+	srcInfo, err := b.migrationIndexHeaderReceive(l, args.IndexHeaderVersion, conn, args.Refresh, resumeReceivedUUID)
 	if err != nil {
 		return err
 	}
 
+	if srcInfo != nil {
+		args.SizeEstimate = srcInfo.SizeEstimate
+	}
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -4450,6 +6332,8 @@ func (b *lxdBackend) RenameCustomVolume(projectName string, volName string, newV
 	l.Debug("RenameCustomVolume started")
 	defer l.Debug("RenameCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	if shared.IsSnapshot(volName) {
 		return fmt.Errorf("Volume name cannot be a snapshot")
 	}
@@ -4570,6 +6454,8 @@ func (b *lxdBackend) UpdateCustomVolume(projectName string, volName string, newD
 	l.Debug("UpdateCustomVolume started")
 	defer l.Debug("UpdateCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	if shared.IsSnapshot(volName) {
 		return fmt.Errorf("Volume name cannot be a snapshot")
 	}
@@ -4614,6 +6500,13 @@ func (b *lxdBackend) UpdateCustomVolume(projectName string, volName string, newD
 			return fmt.Errorf("security.unmapped and security.shifted are mutually exclusive")
 		}
 
+		if changedConfig["size"] != "" {
+			err = b.checkReservedSpaceGrowth(curVol.Config["size"], changedConfig["size"])
+			if err != nil {
+				return err
+			}
+		}
+
 		// Check for config changing that is not allowed when running instances are using it.
 		if changedConfig["security.shifted"] != "" {
 			err = VolumeUsedByInstanceDevices(b.state, b.name, projectName, &curVol.StorageVolume, true, func(dbInst db.InstanceArgs, project api.Project, usedByDevices []string) error {
@@ -4705,12 +6598,171 @@ func (b *lxdBackend) UpdateCustomVolumeSnapshot(projectName string, volName stri
 	return nil
 }
 
+// SetCustomVolumeSnapshotMetadata replaces the user-defined metadata of a custom volume snapshot, stored in its
+// config. The metadata only lives in the database, the snapshot itself is left untouched.
+func (b *lxdBackend) SetCustomVolumeSnapshotMetadata(projectName string, volName string, metadata map[string]string, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName, "metadata": metadata})
+	l.Debug("SetCustomVolumeSnapshotMetadata started")
+	defer l.Debug("SetCustomVolumeSnapshotMetadata finished")
+
+	if !shared.IsSnapshot(volName) {
+		return fmt.Errorf("Volume must be a snapshot")
+	}
+
+	err := ValidateSnapshotMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	curVol, err := VolumeDBGet(b, projectName, volName, drivers.VolumeTypeCustom)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to do if the metadata is unchanged.
+	curMetadata := SnapshotMetadata(curVol.Config)
+	if len(curMetadata) == len(metadata) {
+		changed := false
+		for k, v := range metadata {
+			curValue, found := curMetadata[k]
+			if !found || curValue != v {
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+	}
+
+	curExpiryDate, err := b.state.DB.Cluster.GetStorageVolumeSnapshotExpiry(curVol.ID)
+	if err != nil {
+		return err
+	}
+
+	newConfig := make(map[string]string, len(curVol.Config)+len(metadata))
+	for k, v := range curVol.Config {
+		if !strings.HasPrefix(k, drivers.SnapshotMetadataConfigPrefix) {
+			newConfig[k] = v
+		}
+	}
+
+	for k, v := range metadata {
+		newConfig[drivers.SnapshotMetadataConfigPrefix+k] = v
+	}
+
+	err = b.state.DB.Cluster.UpdateStorageVolumeSnapshot(projectName, volName, db.StoragePoolVolumeTypeCustom, b.ID(), curVol.Description, newConfig, curExpiryDate)
+	if err != nil {
+		return err
+	}
+
+	vol := b.GetVolume(drivers.VolumeTypeCustom, drivers.ContentType(curVol.ContentType), project.StorageVolume(projectName, volName), newConfig)
+
+	b.state.Events.SendLifecycle(projectName, lifecycle.StorageVolumeSnapshotUpdated.Event(vol, string(vol.Type()), projectName, op, nil))
+
+	return nil
+}
+
+// UpdateVolumeSnapshotSendParentRefCount increments (or decrements) the number of incremental sends made outside of
+// LXD recorded as relying on a volume snapshot as their parent, and returns the new value. The counter is stored in
+// the snapshot's config so that it survives restarts, and prevents the snapshot from being deleted while >0.
+func (b *lxdBackend) UpdateVolumeSnapshotSendParentRefCount(projectName string, volName string, volType drivers.VolumeType, increment bool, op *operations.Operation) (uint, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName, "volType": volType, "increment": increment})
+	l.Debug("UpdateVolumeSnapshotSendParentRefCount started")
+	defer l.Debug("UpdateVolumeSnapshotSendParentRefCount finished")
+
+	if !shared.IsSnapshot(volName) {
+		return 0, fmt.Errorf("Volume must be a snapshot")
+	}
+
+	volDBType, err := VolumeTypeToDBType(volType)
+	if err != nil {
+		return 0, err
+	}
+
+	// Serialize the updates of the counter so that concurrent ones aren't lost.
+	unlock := locking.Lock(drivers.OperationLockName("SendParentRefCount", b.name, volType, "", project.StorageVolume(projectName, volName)))
+	defer unlock()
+
+	curVol, err := VolumeDBGet(b, projectName, volName, volType)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := drivers.SendParentRefCount(curVol.Config)
+	if err != nil {
+		return 0, err
+	}
+
+	if increment {
+		count++
+	} else {
+		if count == 0 {
+			return 0, api.StatusErrorf(http.StatusBadRequest, "Snapshot isn't in use as an incremental send parent")
+		}
+
+		count--
+	}
+
+	curExpiryDate, err := b.state.DB.Cluster.GetStorageVolumeSnapshotExpiry(curVol.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	newConfig := make(map[string]string, len(curVol.Config)+1)
+	for k, v := range curVol.Config {
+		newConfig[k] = v
+	}
+
+	if count > 0 {
+		newConfig[drivers.SendParentRefCountConfigKey] = strconv.FormatUint(uint64(count), 10)
+	} else {
+		delete(newConfig, drivers.SendParentRefCountConfigKey)
+	}
+
+	err = b.state.DB.Cluster.UpdateStorageVolumeSnapshot(projectName, volName, volDBType, b.ID(), curVol.Description, newConfig, curExpiryDate)
+	if err != nil {
+		return 0, err
+	}
+
+	if volType == drivers.VolumeTypeCustom {
+		vol := b.GetVolume(volType, drivers.ContentType(curVol.ContentType), project.StorageVolume(projectName, volName), newConfig)
+		b.state.Events.SendLifecycle(projectName, lifecycle.StorageVolumeSnapshotUpdated.Event(vol, string(vol.Type()), projectName, op, nil))
+	}
+
+	return count, nil
+}
+
+// GetCustomVolumeSnapshotUsage returns the disk space a custom volume snapshot shares with other volumes and
+// uniquely owns. Returns drivers.ErrNotSupported if the pool can't report it.
+func (b *lxdBackend) GetCustomVolumeSnapshotUsage(projectName string, volName string) (*api.StorageVolumeSnapshotUsage, error) {
+	if !shared.IsSnapshot(volName) {
+		return nil, fmt.Errorf("Volume must be a snapshot")
+	}
+
+	volume, err := VolumeDBGet(b, projectName, volName, drivers.VolumeTypeCustom)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the volume name on storage.
+	volStorageName := project.StorageVolume(projectName, volName)
+
+	// There's no need to pass config as it's not needed when getting the snapshot usage.
+	snapVol := b.GetVolume(drivers.VolumeTypeCustom, drivers.ContentType(volume.ContentType), volStorageName, nil)
+
+	return b.driver.GetVolumeSnapshotUsage(snapVol)
+}
+
 // DeleteCustomVolume removes a custom volume and its snapshots.
 func (b *lxdBackend) DeleteCustomVolume(projectName string, volName string, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName})
 	l.Debug("DeleteCustomVolume started")
 	defer l.Debug("DeleteCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	_, _, isSnap := api.GetParentAndSnapshotName(volName)
 	if isSnap {
 		return fmt.Errorf("Volume name cannot be a snapshot")
@@ -4813,6 +6865,23 @@ func (b *lxdBackend) GetCustomVolumeUsage(projectName, volName string) (int64, e
 	return b.driver.GetVolumeUsage(vol)
 }
 
+// GetCustomVolumeGeneration returns a token of the content of a custom volume which changes whenever the volume
+// changes. Returns drivers.ErrNotSupported if the pool can't report it.
+func (b *lxdBackend) GetCustomVolumeGeneration(projectName string, volName string) (uint64, error) {
+	volume, err := VolumeDBGet(b, projectName, volName, drivers.VolumeTypeCustom)
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the volume name on storage.
+	volStorageName := project.StorageVolume(projectName, volName)
+
+	// There's no need to pass config as it's not needed when getting the volume generation.
+	vol := b.GetVolume(drivers.VolumeTypeCustom, drivers.ContentType(volume.ContentType), volStorageName, nil)
+
+	return b.driver.GetVolumeGeneration(vol)
+}
+
 // MountCustomVolume mounts a custom volume.
 func (b *lxdBackend) MountCustomVolume(projectName, volName string, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName})
@@ -4866,6 +6935,8 @@ func (b *lxdBackend) ImportCustomVolume(projectName string, poolVol *backupConfi
 	l.Debug("ImportCustomVolume started")
 	defer l.Debug("ImportCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -4938,6 +7009,8 @@ func (b *lxdBackend) CreateCustomVolumeSnapshot(projectName, volName string, new
 	l.Debug("CreateCustomVolumeSnapshot started")
 	defer l.Debug("CreateCustomVolumeSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	if shared.IsSnapshot(volName) {
 		return fmt.Errorf("Volume cannot be snapshot")
 	}
@@ -4998,11 +7071,14 @@ func (b *lxdBackend) CreateCustomVolumeSnapshot(projectName, volName string, new
 	defer unlock()
 
 	// Create the snapshot on the storage device.
+	start := time.Now()
 	err = b.driver.CreateVolumeSnapshot(vol, op)
 	if err != nil {
 		return err
 	}
 
+	b.recordSnapshotCopy(vol, time.Since(start))
+
 	b.state.Events.SendLifecycle(projectName, lifecycle.StorageVolumeSnapshotCreated.Event(vol, string(vol.Type()), projectName, op, logger.Ctx{"type": vol.Type()}))
 
 	revert.Success()
@@ -5015,6 +7091,8 @@ func (b *lxdBackend) RenameCustomVolumeSnapshot(projectName, volName string, new
 	l.Debug("RenameCustomVolumeSnapshot started")
 	defer l.Debug("RenameCustomVolumeSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	parentName, oldSnapshotName, isSnap := api.GetParentAndSnapshotName(volName)
 	if !isSnap {
 		return fmt.Errorf("Volume name must be a snapshot")
@@ -5063,6 +7141,8 @@ func (b *lxdBackend) DeleteCustomVolumeSnapshot(projectName, volName string, op
 	l.Debug("DeleteCustomVolumeSnapshot started")
 	defer l.Debug("DeleteCustomVolumeSnapshot finished")
 
+	waitPoolResumed(b.name)
+
 	isSnap := shared.IsSnapshot(volName)
 
 	if !isSnap {
@@ -5089,8 +7169,8 @@ func (b *lxdBackend) DeleteCustomVolumeSnapshot(projectName, volName string, op
 	// Get the volume name on storage.
 	volStorageName := project.StorageVolume(projectName, volName)
 
-	// There's no need to pass config as it's not needed when deleting a volume snapshot.
-	vol := b.GetVolume(drivers.VolumeTypeCustom, contentType, volStorageName, nil)
+	// Pass the config so that the driver takes the recorded send parent ref counter into account.
+	vol := b.GetVolume(drivers.VolumeTypeCustom, contentType, volStorageName, volume.Config)
 
 	// Delete the snapshot from the storage device.
 	// Must come before DB VolumeDBDelete so that the volume ID is still available.
@@ -5112,12 +7192,88 @@ func (b *lxdBackend) DeleteCustomVolumeSnapshot(projectName, volName string, op
 	return nil
 }
 
+// ArchiveCustomVolumeSnapshot moves a custom volume snapshot to a custom volume of the archive pool, using the
+// migration between the two pools (optimized when both drivers support it), and then deletes the snapshot. The
+// archive volume records the snapshot it was created from. It returns the name of the archive volume.
+func (b *lxdBackend) ArchiveCustomVolumeSnapshot(projectName string, volName string, archivePoolName string, op *operations.Operation) (string, error) {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName, "archivePoolName": archivePoolName})
+	l.Debug("ArchiveCustomVolumeSnapshot started")
+	defer l.Debug("ArchiveCustomVolumeSnapshot finished")
+
+	if !shared.IsSnapshot(volName) {
+		return "", fmt.Errorf("Volume name must be a snapshot")
+	}
+
+	if archivePoolName == b.name {
+		return "", fmt.Errorf("Snapshots cannot be archived to their own pool")
+	}
+
+	archivePool, err := LoadByName(b.state, archivePoolName)
+	if err != nil {
+		return "", fmt.Errorf("Failed loading archive pool %q: %w", archivePoolName, err)
+	}
+
+	snapshot, err := VolumeDBGet(b, projectName, volName, drivers.VolumeTypeCustom)
+	if err != nil {
+		return "", err
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	archiveName := SnapshotArchiveVolumeName(b.name, volName)
+	config := snapshotArchiveConfig(snapshot.Config, b.name, volName, snapshot.CreatedAt)
+
+	err = archivePool.CreateCustomVolumeFromCopy(projectName, projectName, archiveName, snapshot.Description, config, b.name, volName, false, op)
+	if err != nil {
+		return "", fmt.Errorf("Failed archiving snapshot %q to pool %q: %w", volName, archivePoolName, err)
+	}
+
+	revert.Add(func() { _ = archivePool.DeleteCustomVolume(projectName, archiveName, op) })
+
+	err = b.DeleteCustomVolumeSnapshot(projectName, volName, op)
+	if err != nil {
+		return "", fmt.Errorf("Failed deleting archived snapshot %q: %w", volName, err)
+	}
+
+	revert.Success()
+
+	return archiveName, nil
+}
+
+// RestoreCustomVolumeSnapshotArchive creates the custom volume volName on the pool from the archive volume of a
+// snapshot on the archive pool. The archive volume is kept.
+func (b *lxdBackend) RestoreCustomVolumeSnapshotArchive(projectName string, archivePoolName string, archiveVolName string, volName string, op *operations.Operation) error {
+	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "archivePoolName": archivePoolName, "archiveVolName": archiveVolName, "volName": volName})
+	l.Debug("RestoreCustomVolumeSnapshotArchive started")
+	defer l.Debug("RestoreCustomVolumeSnapshotArchive finished")
+
+	archivePool, err := LoadByName(b.state, archivePoolName)
+	if err != nil {
+		return fmt.Errorf("Failed loading archive pool %q: %w", archivePoolName, err)
+	}
+
+	archive, err := VolumeDBGet(archivePool, projectName, archiveVolName, drivers.VolumeTypeCustom)
+	if err != nil {
+		return err
+	}
+
+	_, _, _, err = ParseSnapshotArchiveSource(archive.Config)
+	if err != nil {
+		return fmt.Errorf("Invalid archive volume %q: %w", archiveVolName, err)
+	}
+
+	return b.CreateCustomVolumeFromCopy(projectName, projectName, volName, archive.Description, snapshotArchiveRestoreConfig(archive.Config), archivePoolName, archiveVolName, false, op)
+}
+
 // RestoreCustomVolume restores a custom volume from a snapshot.
 func (b *lxdBackend) RestoreCustomVolume(projectName, volName string, snapshotName string, op *operations.Operation) error {
 	l := logger.AddContext(b.logger, logger.Ctx{"project": projectName, "volName": volName, "snapshotName": snapshotName})
 	l.Debug("RestoreCustomVolume started")
 	defer l.Debug("RestoreCustomVolume finished")
 
+	waitPoolResumed(b.name)
+
 	// Quick checks.
 	if shared.IsSnapshot(volName) {
 		return fmt.Errorf("Volume cannot be snapshot")
@@ -5192,8 +7348,20 @@ func (b *lxdBackend) RestoreCustomVolume(projectName, volName string, snapshotNa
 }
 
 func (b *lxdBackend) createStorageStructure(path string) error {
+	base := b.db.Config["snapshots.mount_base"]
+
 	for _, volType := range b.driver.Info().VolumeTypes {
 		for _, name := range drivers.BaseDirectories[volType] {
+			// Snapshots relocated with snapshots.mount_base are linked from the pool.
+			if base != "" && strings.HasSuffix(name, "-snapshots") {
+				err := drivers.LinkPoolSnapshotsDir(b.name, base, name)
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
 			path := filepath.Join(path, name)
 			err := os.MkdirAll(path, 0711)
 			if err != nil && !os.IsExist(err) {
@@ -6025,6 +8193,8 @@ func (b *lxdBackend) CreateCustomVolumeFromBackup(srcBackup backup.Info, srcData
 	l.Debug("CreateCustomVolumeFromBackup started")
 	defer l.Debug("CreateCustomVolumeFromBackup finished")
 
+	waitPoolResumed(b.name)
+
 	if srcBackup.Config == nil || srcBackup.Config.Volume == nil {
 		return fmt.Errorf("Valid volume config not found in index")
 	}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"net/url"
 	"time"
@@ -76,6 +77,98 @@ func (b *mockBackend) GetResources() (*api.ResourcesStoragePool, error) {
 	return nil, nil
 }
 
+func (b *mockBackend) Rebalance(ctx context.Context, projectName string, volNames []string, op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) EstimateSharing(projectName string, volNames []string) (*drivers.SpaceSharingEstimate, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) EmergencyFree(op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) ValidateLayout() (*drivers.LayoutReport, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) CheckHealth(repairReadonly bool) (*drivers.PoolHealthReport, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) GetSnapshotsReclaimableSpace(projectName string, volName string) (*drivers.ReclaimableSpaceReport, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) OrderVolumeSnapshots(projectName string, volName string, order string) ([]string, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) FindSnapshotsWithPath(projectName string, volName string, path string) ([]SnapshotIndexMatch, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) SnapshotVolumePath(projectName string, volName string, path string, snapshotName string, op *operations.Operation) (string, error) {
+	return "", nil
+}
+
+func (b *mockBackend) FindStraySubvolumes() ([]string, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) GetSubvolumeVolumes() (map[string]SubvolumeVolume, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) ConfigState() (*PoolConfigState, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) ConfigDrift(baseline PoolConfigState) ([]PoolConfigDifference, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) VerifyVolumeMounts(op *operations.Operation) (*VolumeMountReport, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) Quiesce(freeze bool, timeout time.Duration) error {
+	return nil
+}
+
+func (b *mockBackend) Resume() error {
+	return nil
+}
+
+func (b *mockBackend) GetSnapshotTimeEstimate(projectName string, volName string) (time.Duration, error) {
+	return 0, nil
+}
+
+func (b *mockBackend) RepairImagesReadonly(op *operations.Operation) ([]string, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) PruneSnapshotDirs(op *operations.Operation) ([]string, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) RebuildSnapshotSymlinks(op *operations.Operation) (*SnapshotSymlinksRebuild, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) CleanupStaleMounts(insts []instance.Instance) ([]drivers.MountInfo, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) ExportVolumeOCI(projectName string, volName string, w io.Writer, config *drivers.OCIImageConfig, op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) GetProjectVolumeUsage(projectName string, volName string) (int64, error) {
+	return 0, nil
+}
+
 func (b *mockBackend) IsUsed() (bool, error) {
 	return false, nil
 }
@@ -112,6 +205,11 @@ func (b *mockBackend) CreateInstance(inst instance.Instance, op *operations.Oper
 	return nil
 }
 
+func (b *mockBackend) CreateInstanceFromStream(inst instance.Instance, r io.Reader, checksum string, op *operations.Operation) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
 func (b *mockBackend) CreateInstanceFromBackup(srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (func(instance.Instance) error, revert.Hook, error) {
 	return nil, nil, nil
 }
@@ -184,10 +282,26 @@ func (b *mockBackend) GetInstanceUsage(inst instance.Instance) (int64, error) {
 	return 0, nil
 }
 
+func (b *mockBackend) GetInstanceGeneration(inst instance.Instance) (uint64, error) {
+	return 0, nil
+}
+
+func (b *mockBackend) GetInstanceSnapshotsInfo(inst instance.Instance) ([]SnapshotInfo, error) {
+	return nil, nil
+}
+
+func (b *mockBackend) InstanceTotalFootprint(inst instance.Instance) (int64, error) {
+	return 0, nil
+}
+
 func (b *mockBackend) SetInstanceQuota(inst instance.Instance, size string, vmStateSize string, op *operations.Operation) error {
 	return nil
 }
 
+func (b *mockBackend) DiffInstanceWithImage(inst instance.Instance, op *operations.Operation) (*drivers.VolumeDiff, error) {
+	return nil, nil
+}
+
 func (b *mockBackend) MountInstance(inst instance.Instance, op *operations.Operation) (*MountInfo, error) {
 	return &MountInfo{}, nil
 }
@@ -200,11 +314,19 @@ func (b *mockBackend) CreateInstanceSnapshot(i instance.Instance, src instance.I
 	return nil
 }
 
+func (b *mockBackend) CheckInstanceSnapshotRate(inst instance.Instance) error {
+	return nil
+}
+
 func (b *mockBackend) RenameInstanceSnapshot(inst instance.Instance, newName string, op *operations.Operation) error {
 	return nil
 }
 
-func (b *mockBackend) DeleteInstanceSnapshot(inst instance.Instance, op *operations.Operation) error {
+func (b *mockBackend) DeleteInstanceSnapshot(inst instance.Instance, force bool, op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) CheckInstanceSnapshotsDelete(snapshots []instance.Instance, op *operations.Operation) error {
 	return nil
 }
 
@@ -304,6 +426,10 @@ func (b *mockBackend) GetCustomVolumeUsage(projectName string, volName string) (
 	return 0, nil
 }
 
+func (b *mockBackend) GetCustomVolumeGeneration(projectName string, volName string) (uint64, error) {
+	return 0, nil
+}
+
 func (b *mockBackend) MountCustomVolume(projectName string, volName string, op *operations.Operation) error {
 	return nil
 }
@@ -332,10 +458,30 @@ func (b *mockBackend) UpdateCustomVolumeSnapshot(projectName string, volName str
 	return nil
 }
 
+func (b *mockBackend) SetCustomVolumeSnapshotMetadata(projectName string, volName string, metadata map[string]string, op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) ArchiveCustomVolumeSnapshot(projectName string, volName string, archivePoolName string, op *operations.Operation) (string, error) {
+	return "", nil
+}
+
+func (b *mockBackend) RestoreCustomVolumeSnapshotArchive(projectName string, archivePoolName string, archiveVolName string, volName string, op *operations.Operation) error {
+	return nil
+}
+
+func (b *mockBackend) GetCustomVolumeSnapshotUsage(projectName string, volName string) (*api.StorageVolumeSnapshotUsage, error) {
+	return nil, nil
+}
+
 func (b *mockBackend) RestoreCustomVolume(projectName string, volName string, snapshotName string, op *operations.Operation) error {
 	return nil
 }
 
+func (b *mockBackend) UpdateVolumeSnapshotSendParentRefCount(projectName string, volName string, volType drivers.VolumeType, increment bool, op *operations.Operation) (uint, error) {
+	return 0, nil
+}
+
 func (b *mockBackend) BackupCustomVolume(projectName string, volName string, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots bool, op *operations.Operation) error {
 	return nil
 }
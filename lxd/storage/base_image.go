@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/shared"
+)
+
+// VolumeBaseImageKey is the config key recording on instance volumes the fingerprint of the image they were
+// created from.
+const VolumeBaseImageKey = "volatile.base_image"
+
+// BaseImageInstance represents an instance whose volume was created from an image.
+type BaseImageInstance struct {
+	Project string `json:"project" yaml:"project"`
+	Name    string `json:"name" yaml:"name"`
+	Type    string `json:"type" yaml:"type"` // The instance volume type ("container" or "virtual-machine").
+	Pool    string `json:"pool" yaml:"pool"`
+}
+
+// InstancesFromImage returns the instances whose volume was created from the image with the given fingerprint,
+// as recorded in the VolumeBaseImageKey config key of their volume, sorted by project and name.
+func InstancesFromImage(s *state.State, fingerprint string) ([]BaseImageInstance, error) {
+	instances := []BaseImageInstance{}
+
+	err := s.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		volTypeNames := map[int]string{
+			db.StoragePoolVolumeTypeContainer: db.StoragePoolVolumeTypeNameContainer,
+			db.StoragePoolVolumeTypeVM:        db.StoragePoolVolumeTypeNameVM,
+		}
+
+		for volType, volTypeName := range volTypeNames {
+			vols, err := tx.GetStoragePoolVolumesWithType(ctx, volType)
+			if err != nil {
+				return err
+			}
+
+			instances = append(instances, instancesFromImage(vols, volTypeName, fingerprint)...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		if instances[i].Project != instances[j].Project {
+			return instances[i].Project < instances[j].Project
+		}
+
+		if instances[i].Name != instances[j].Name {
+			return instances[i].Name < instances[j].Name
+		}
+
+		return instances[i].Pool < instances[j].Pool
+	})
+
+	return instances, nil
+}
+
+// instancesFromImage returns the instances of the volumes of type volTypeName created from the image with the
+// given fingerprint. Snapshots are skipped as they carry the key of their parent volume.
+func instancesFromImage(vols []db.StorageVolumeArgs, volTypeName string, fingerprint string) []BaseImageInstance {
+	instances := []BaseImageInstance{}
+	if fingerprint == "" {
+		return instances
+	}
+
+	for _, vol := range vols {
+		if shared.IsSnapshot(vol.Name) || vol.Config[VolumeBaseImageKey] != fingerprint {
+			continue
+		}
+
+		instances = append(instances, BaseImageInstance{Project: vol.ProjectName, Name: vol.Name, Type: volTypeName, Pool: vol.PoolName})
+	}
+
+	return instances
+}
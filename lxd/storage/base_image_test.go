@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/lxd/db"
+)
+
+// Test that the instances created from an image are found by the image fingerprint.
+func TestInstancesFromImage(t *testing.T) {
+	jammy := "d1ae84747b4cec7e4bb07b8ea8b1480be1cc3a6c1ed0140b5bda9e3d66b7e1ab"
+	alpine := "7f1f8a1b8c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f"
+
+	vols := []db.StorageVolumeArgs{
+		{Name: "c1", ProjectName: "default", PoolName: "pool1", Config: map[string]string{VolumeBaseImageKey: jammy}},
+		{Name: "c1/snap0", ProjectName: "default", PoolName: "pool1", Config: map[string]string{VolumeBaseImageKey: jammy}},
+		{Name: "c2", ProjectName: "default", PoolName: "pool1", Config: map[string]string{VolumeBaseImageKey: alpine}},
+		{Name: "c3", ProjectName: "web", PoolName: "pool2", Config: map[string]string{VolumeBaseImageKey: jammy}},
+		{Name: "c4", ProjectName: "default", PoolName: "pool1", Config: map[string]string{}},
+	}
+
+	instances := instancesFromImage(vols, db.StoragePoolVolumeTypeNameContainer, jammy)
+	assert.Equal(t, []BaseImageInstance{
+		{Project: "default", Name: "c1", Type: "container", Pool: "pool1"},
+		{Project: "web", Name: "c3", Type: "container", Pool: "pool2"},
+	}, instances)
+
+	instances = instancesFromImage(vols, db.StoragePoolVolumeTypeNameContainer, alpine)
+	assert.Equal(t, []BaseImageInstance{{Project: "default", Name: "c2", Type: "container", Pool: "pool1"}}, instances)
+
+	// Volumes not created from an image aren't matched by an empty fingerprint.
+	instances = instancesFromImage(vols, db.StoragePoolVolumeTypeNameContainer, "")
+	assert.Empty(t, instances)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PoolConfigState represents the configuration of a pool and of its volumes, compared against a baseline to
+// detect configuration drift.
+type PoolConfigState struct {
+	Config       map[string]string            `json:"config" yaml:"config"`               // Config of the pool.
+	Volumes      map[string]map[string]string `json:"volumes" yaml:"volumes"`             // Config of each volume, keyed by "<type>/<name>".
+	QGroupLimits map[string]int64             `json:"qgroup_limits" yaml:"qgroup_limits"` // Limit of the qgroup of each volume which has one, keyed by "<type>/<name>".
+}
+
+// PoolConfigDifference represents a setting of a pool or of one of its volumes which differs from the baseline.
+// Values missing on either side are empty.
+type PoolConfigDifference struct {
+	Volume   string `json:"volume,omitempty" yaml:"volume,omitempty"` // Volume as "<type>/<name>", empty for the pool itself.
+	Key      string `json:"key" yaml:"key"`                           // Config key, poolConfigDriftQGroupLimit for the qgroup limit, empty for the volume's existence.
+	Baseline string `json:"baseline" yaml:"baseline"`                 // Value in the baseline.
+	Current  string `json:"current" yaml:"current"`                   // Current value.
+}
+
+// poolConfigDriftQGroupLimit is the key the differences of the qgroup limit of a volume are reported under.
+const poolConfigDriftQGroupLimit = "qgroup_limit"
+
+// poolConfigDriftPresent is the value reported for a volume which exists when it is missing on the other side.
+const poolConfigDriftPresent = "present"
+
+// diffConfigKeys appends to diffs the keys of volume (empty for the pool) whose value differs between baseline and
+// current, ignoring the volatile keys as they are set by LXD.
+func diffConfigKeys(diffs []PoolConfigDifference, volume string, baseline map[string]string, current map[string]string) []PoolConfigDifference {
+	keys := map[string]bool{}
+	for key := range baseline {
+		keys[key] = true
+	}
+
+	for key := range current {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		if strings.HasPrefix(key, "volatile.") || baseline[key] == current[key] {
+			continue
+		}
+
+		diffs = append(diffs, PoolConfigDifference{Volume: volume, Key: key, Baseline: baseline[key], Current: current[key]})
+	}
+
+	return diffs
+}
+
+// diffPoolConfig returns the differences between the baseline and current configuration of a pool, sorted by
+// volume and key. The volatile keys are ignored, and volumes which only exist on one side are reported along with
+// each of their settings.
+func diffPoolConfig(baseline PoolConfigState, current PoolConfigState) []PoolConfigDifference {
+	diffs := diffConfigKeys(nil, "", baseline.Config, current.Config)
+
+	volumes := map[string]bool{}
+	for volume := range baseline.Volumes {
+		volumes[volume] = true
+	}
+
+	for volume := range current.Volumes {
+		volumes[volume] = true
+	}
+
+	for volume := range volumes {
+		baselineConfig, inBaseline := baseline.Volumes[volume]
+		currentConfig, inCurrent := current.Volumes[volume]
+
+		if inBaseline != inCurrent {
+			diff := PoolConfigDifference{Volume: volume}
+			if inBaseline {
+				diff.Baseline = poolConfigDriftPresent
+			} else {
+				diff.Current = poolConfigDriftPresent
+			}
+
+			diffs = append(diffs, diff)
+		}
+
+		diffs = diffConfigKeys(diffs, volume, baselineConfig, currentConfig)
+	}
+
+	limits := map[string]bool{}
+	for volume := range baseline.QGroupLimits {
+		limits[volume] = true
+	}
+
+	for volume := range current.QGroupLimits {
+		limits[volume] = true
+	}
+
+	for volume := range limits {
+		baselineLimit, inBaseline := baseline.QGroupLimits[volume]
+		currentLimit, inCurrent := current.QGroupLimits[volume]
+		if inBaseline == inCurrent && baselineLimit == currentLimit {
+			continue
+		}
+
+		diff := PoolConfigDifference{Volume: volume, Key: poolConfigDriftQGroupLimit}
+		if inBaseline {
+			diff.Baseline = fmt.Sprintf("%d", baselineLimit)
+		}
+
+		if inCurrent {
+			diff.Current = fmt.Sprintf("%d", currentLimit)
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Volume != diffs[j].Volume {
+			return diffs[i].Volume < diffs[j].Volume
+		}
+
+		return diffs[i].Key < diffs[j].Key
+	})
+
+	return diffs
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that only the settings which drifted from the baseline are reported, ignoring the volatile keys.
+func TestDiffPoolConfig(t *testing.T) {
+	baseline := PoolConfigState{
+		Config: map[string]string{
+			"source":                     "/dev/sdb",
+			"btrfs.mount_options":        "user_subvol_rm_allowed",
+			"volatile.initial_source":    "/dev/sdb",
+			"snapshots.min_per_instance": "2",
+		},
+		Volumes: map[string]map[string]string{
+			"containers/c1": {"size": "10GiB", "volatile.uuid": "a"},
+			"custom/data":   {"size": "50GiB"},
+			"custom/old":    {},
+		},
+		QGroupLimits: map[string]int64{
+			"containers/c1": 10737418240,
+			"custom/data":   53687091200,
+		},
+	}
+
+	current := PoolConfigState{
+		Config: map[string]string{
+			"source":                  "/dev/sdb",
+			"btrfs.mount_options":     "user_subvol_rm_allowed,noatime",
+			"volatile.initial_source": "/dev/sdc",
+			"btrfs.snapshots_quota":   "5GiB",
+		},
+		Volumes: map[string]map[string]string{
+			"containers/c1": {"size": "10GiB", "volatile.uuid": "b"},
+			"custom/data":   {"size": "80GiB"},
+			"custom/new":    {"security.shifted": "true"},
+		},
+		QGroupLimits: map[string]int64{
+			"containers/c1": 10737418240,
+			"custom/data":   85899345920,
+			"custom/new":    1073741824,
+		},
+	}
+
+	expected := []PoolConfigDifference{
+		{Key: "btrfs.mount_options", Baseline: "user_subvol_rm_allowed", Current: "user_subvol_rm_allowed,noatime"},
+		{Key: "btrfs.snapshots_quota", Current: "5GiB"},
+		{Key: "snapshots.min_per_instance", Baseline: "2"},
+		{Volume: "custom/data", Key: "qgroup_limit", Baseline: "53687091200", Current: "85899345920"},
+		{Volume: "custom/data", Key: "size", Baseline: "50GiB", Current: "80GiB"},
+		{Volume: "custom/new", Current: "present"},
+		{Volume: "custom/new", Key: "qgroup_limit", Current: "1073741824"},
+		{Volume: "custom/new", Key: "security.shifted", Current: "true"},
+		{Volume: "custom/old", Baseline: "present"},
+	}
+
+	assert.Equal(t, expected, diffPoolConfig(baseline, current))
+
+	// A pool matching its baseline has no drift.
+	assert.Empty(t, diffPoolConfig(baseline, baseline))
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// confirmationCodeLifetime is how long a confirmation code returned by a dry-run can be used for.
+const confirmationCodeLifetime = 5 * time.Minute
+
+// ConfirmationCode represents a code which confirms an irreversible operation on a pool.
+type ConfirmationCode struct {
+	Code      string    `json:"code" yaml:"code"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
+}
+
+// confirmationCodes records the pending confirmation codes, keyed by pool name and operation.
+var confirmationCodes = map[string]ConfirmationCode{}
+
+// confirmationCodesMu is used to access confirmationCodes safely.
+var confirmationCodesMu sync.Mutex
+
+// confirmationKey returns the key of the confirmation codes of the named operation on the pool.
+func confirmationKey(poolName string, operation string) string {
+	return fmt.Sprintf("%s/%s", poolName, operation)
+}
+
+// NewConfirmationCode generates a code confirming the named irreversible operation on the pool, replacing any
+// previous one. It is valid for a single use until it expires.
+func NewConfirmationCode(poolName string, operation string, now time.Time) (*ConfirmationCode, error) {
+	code, err := shared.RandomCryptoString()
+	if err != nil {
+		return nil, fmt.Errorf("Failed generating confirmation code: %w", err)
+	}
+
+	confirmation := ConfirmationCode{
+		Code:      code,
+		ExpiresAt: now.Add(confirmationCodeLifetime),
+	}
+
+	confirmationCodesMu.Lock()
+	confirmationCodes[confirmationKey(poolName, operation)] = confirmation
+	confirmationCodesMu.Unlock()
+
+	return &confirmation, nil
+}
+
+// CheckConfirmation checks that the token confirms the named irreversible operation on the pool, the token being
+// either the pool name or an unexpired code returned by NewConfirmationCode, which is consumed.
+// Returns ErrConfirmationRequired otherwise.
+func CheckConfirmation(poolName string, operation string, token string, now time.Time) error {
+	if token != "" && token == poolName {
+		return nil
+	}
+
+	key := confirmationKey(poolName, operation)
+
+	confirmationCodesMu.Lock()
+	defer confirmationCodesMu.Unlock()
+
+	confirmation, ok := confirmationCodes[key]
+	if ok && now.After(confirmation.ExpiresAt) {
+		delete(confirmationCodes, key)
+		ok = false
+	}
+
+	if !ok || token == "" || token != confirmation.Code {
+		return fmt.Errorf("Operation %q on storage pool %q must be confirmed with the pool name or a confirmation code: %w", operation, poolName, ErrConfirmationRequired)
+	}
+
+	delete(confirmationCodes, key)
+
+	return nil
+}
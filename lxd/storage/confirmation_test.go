@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that an operation is only confirmed by the pool name or a valid confirmation code.
+func TestCheckConfirmation(t *testing.T) {
+	now := time.Now()
+
+	// Blocked without a valid token.
+	for _, token := range []string{"", "pool2", "POOL1"} {
+		err := CheckConfirmation("pool1", "delete", token, now)
+		assert.True(t, errors.Is(err, ErrConfirmationRequired), token)
+	}
+
+	// Proceeds with the pool name.
+	assert.NoError(t, CheckConfirmation("pool1", "delete", "pool1", now))
+
+	// Proceeds with a confirmation code, which can only be used once.
+	confirmation, err := NewConfirmationCode("pool1", "delete", now)
+	require.NoError(t, err)
+	assert.NotEmpty(t, confirmation.Code)
+
+	err = CheckConfirmation("pool1", "emergency-free", confirmation.Code, now)
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+
+	err = CheckConfirmation("pool2", "delete", confirmation.Code, now)
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+
+	assert.NoError(t, CheckConfirmation("pool1", "delete", confirmation.Code, now))
+
+	err = CheckConfirmation("pool1", "delete", confirmation.Code, now)
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+
+	// A new code replaces the previous one.
+	first, err := NewConfirmationCode("pool1", "delete", now)
+	require.NoError(t, err)
+
+	second, err := NewConfirmationCode("pool1", "delete", now)
+	require.NoError(t, err)
+
+	err = CheckConfirmation("pool1", "delete", first.Code, now)
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+
+	// An expired code is rejected.
+	err = CheckConfirmation("pool1", "delete", second.Code, second.ExpiresAt.Add(time.Second))
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+
+	err = CheckConfirmation("pool1", "delete", second.Code, now)
+	assert.True(t, errors.Is(err, ErrConfirmationRequired))
+}
@@ -1,10 +1,12 @@
 package drivers
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"golang.org/x/sys/unix"
@@ -14,6 +16,8 @@ import (
 	"github.com/lxc/lxd/lxd/storage/filesystem"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
+	"github.com/lxc/lxd/shared/logger"
 	"github.com/lxc/lxd/shared/units"
 	"github.com/lxc/lxd/shared/validate"
 	"github.com/lxc/lxd/shared/version"
@@ -41,11 +45,9 @@ func (d *btrfs) load() error {
 	}
 
 	// Validate the required binaries.
-	for _, tool := range []string{"btrfs"} {
-		_, err := exec.LookPath(tool)
-		if err != nil {
-			return fmt.Errorf("Required tool %q is missing", tool)
-		}
+	missingTools := MissingTools("btrfs")
+	if len(missingTools) > 0 {
+		return fmt.Errorf("Required tool %q is missing", missingTools[0])
 	}
 
 	// Detect and record the version.
@@ -106,11 +108,30 @@ func (d *btrfs) Create() error {
 	// Store the provided source as we are likely to be mangling it.
 	d.config["volatile.initial_source"] = d.config["source"]
 
+	// Record the volume layout so it stays fixed for the lifetime of the pool.
+	if d.config["btrfs.layout"] == "" {
+		d.config["btrfs.layout"] = PoolLayoutNested
+	}
+
 	loopPath := loopFilePath(d.name)
+	isNewFilesystem := d.config["source"] == "" || d.config["source"] == loopPath || btrfsIsBlockdevSource(d.config["source"])
+
+	// The snapshots are subvolume snapshots so they must be on the pool's filesystem, which rules out the
+	// filesystems formatted by LXD as nothing else can be on them yet.
+	if d.config["snapshots.mount_base"] != "" && isNewFilesystem {
+		return fmt.Errorf("snapshots.mount_base can only be used with pools on an existing btrfs filesystem")
+	}
+
 	if d.config["source"] == "" || d.config["source"] == loopPath {
 		// Create a loop based pool.
 		d.config["source"] = loopPath
 
+		// Check the requested raid profiles can be used with a single device.
+		err := btrfsValidateRaidProfiles(d.config["btrfs.data_raid"], d.config["btrfs.metadata_raid"], 1)
+		if err != nil {
+			return err
+		}
+
 		// Pick a default size of the loop file if not specified.
 		if d.config["size"] == "" {
 			defaultSize, err := loopFileSizeDefault()
@@ -133,22 +154,35 @@ func (d *btrfs) Create() error {
 		}
 
 		// Format the file.
-		_, err = makeFSType(d.config["source"], "btrfs", &mkfsOptions{Label: d.name})
+		_, err = d.makeFS(d.config["source"])
 		if err != nil {
 			return fmt.Errorf("Failed to format sparse file: %w", err)
 		}
-	} else if shared.IsBlockdevPath(d.config["source"]) {
+
+		// A freshly formatted filesystem defaults to its top-level subvolume.
+		d.config["volatile.btrfs.default_subvolume"] = strconv.FormatUint(btrfsTopLevelSubVolumeID, 10)
+	} else if btrfsIsBlockdevSource(d.config["source"]) {
 		// Unset size property since it's irrelevant.
 		d.config["size"] = ""
 
-		// Format the block device.
-		_, err := makeFSType(d.config["source"], "btrfs", &mkfsOptions{Label: d.name})
+		// Check the requested raid profiles can be used with the number of devices provided.
+		devices := btrfsSourceDevices(d.config["source"])
+		err := btrfsValidateRaidProfiles(d.config["btrfs.data_raid"], d.config["btrfs.metadata_raid"], len(devices))
+		if err != nil {
+			return err
+		}
+
+		// Format the block device(s).
+		_, err = d.makeFS(devices...)
 		if err != nil {
 			return fmt.Errorf("Failed to format block device: %w", err)
 		}
 
-		// Record the UUID as the source.
-		devUUID, err := fsUUID(d.config["source"])
+		// A freshly formatted filesystem defaults to its top-level subvolume.
+		d.config["volatile.btrfs.default_subvolume"] = strconv.FormatUint(btrfsTopLevelSubVolumeID, 10)
+
+		// Record the UUID as the source (all devices of a multi-device filesystem share the same UUID).
+		devUUID, err := fsUUID(devices[0])
 		if err != nil {
 			return err
 		}
@@ -157,13 +191,43 @@ func (d *btrfs) Create() error {
 		if tryExists(fmt.Sprintf("/dev/disk/by-uuid/%s", devUUID)) {
 			// Override the config to use the UUID.
 			d.config["source"] = devUUID
+		} else if len(devices) > 1 {
+			// Any member device can be used to mount a multi-device filesystem.
+			d.config["source"] = devices[0]
 		}
 	} else if d.config["source"] != "" {
 		// Unset size property since it's irrelevant.
 		d.config["size"] = ""
 
+		// Raid profiles can only be applied when LXD formats the filesystem.
+		if d.config["btrfs.data_raid"] != "" || d.config["btrfs.metadata_raid"] != "" {
+			return fmt.Errorf("Raid profiles can only be set for loop or block device backed pools")
+		}
+
 		hostPath := shared.HostPath(d.config["source"])
-		if d.isSubvolume(hostPath) {
+		hostPathExists, hostPathIsSubvol, err := btrfsPathStat(filesystem.Lstat, hostPath)
+		if err != nil {
+			return err
+		}
+
+		base := d.config["snapshots.mount_base"]
+		if base != "" {
+			fsPath := hostPath
+			if !hostPathExists {
+				fsPath = filepath.Dir(hostPath)
+			}
+
+			err = os.MkdirAll(base, 0711)
+			if err == nil {
+				err = btrfsCheckSameFilesystem(fsPath, base)
+			}
+
+			if err != nil {
+				return fmt.Errorf("Invalid snapshots.mount_base %q: %w", base, err)
+			}
+		}
+
+		if hostPathIsSubvol {
 			// Existing btrfs subvolume.
 			subvols, err := d.getSubvolumes(hostPath)
 			if err != nil {
@@ -179,7 +243,7 @@ func (d *btrfs) Create() error {
 			cleanSource := filepath.Clean(hostPath)
 			lxdDir := shared.VarPath()
 
-			if shared.PathExists(hostPath) {
+			if hostPathExists {
 				hostPathFS, _ := filesystem.Detect(hostPath)
 				if hostPathFS != "btrfs" {
 					return fmt.Errorf("Provided path does not reside on a btrfs filesystem")
@@ -204,7 +268,7 @@ func (d *btrfs) Create() error {
 			}
 
 			// Create the subvolume.
-			_, err := shared.RunCommand("btrfs", "subvolume", "create", hostPath)
+			err := btrfsSubVolumeCreate(hostPath, d.subvolumeMode(), nil)
 			if err != nil {
 				return err
 			}
@@ -227,24 +291,45 @@ func (d *btrfs) Delete(op *operations.Operation) error {
 	for _, volType := range d.Info().VolumeTypes {
 		for _, dir := range BaseDirectories[volType] {
 			path := filepath.Join(GetPoolMountPath(d.name), dir)
-			if !shared.PathExists(path) {
-				continue
+			exists, isSubvol, err := btrfsPathStat(filesystem.Lstat, path)
+			if err != nil {
+				return err
 			}
 
-			if !d.isSubvolume(path) {
+			if !exists || !isSubvol {
 				continue
 			}
 
-			err := d.deleteSubvolume(path, true)
+			err = d.deleteSubvolume(path, true)
 			if err != nil {
 				return fmt.Errorf("Failed deleting btrfs subvolume %q", path)
 			}
 		}
 	}
 
+	// Delete the snapshots kept by interrupted migrations.
+	resumeRoot := filepath.Join(GetPoolMountPath(d.name), btrfsMigrationResumeDir)
+	ents, err := os.ReadDir(resumeRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, ent := range ents {
+		err = d.deleteMigrationResumeDir(filepath.Join(resumeRoot, ent.Name()))
+		if err != nil {
+			return fmt.Errorf("Failed deleting migration resume directory %q: %w", ent.Name(), err)
+		}
+	}
+
+	// Delete the snapshots kept outside of the pool mount path.
+	err = d.deleteSnapshotsMountBase()
+	if err != nil {
+		return err
+	}
+
 	// On delete, wipe everything in the directory.
 	mountPath := GetPoolMountPath(d.name)
-	err := wipeDirectory(mountPath)
+	err = wipeDirectory(mountPath)
 	if err != nil {
 		return fmt.Errorf("Failed removing mount path %q: %w", mountPath, err)
 	}
@@ -255,9 +340,9 @@ func (d *btrfs) Delete(op *operations.Operation) error {
 		return err
 	}
 
-	// If the pool path is a subvolume itself, delete it.
+	// If the pool path is a subvolume itself, delete it along with any subvolume left in it.
 	if d.isSubvolume(mountPath) {
-		err := d.deleteSubvolume(mountPath, false)
+		err := PoolSubVolumeTeardown(mountPath, d.config["btrfs.layout"])
 		if err != nil {
 			return err
 		}
@@ -279,31 +364,145 @@ func (d *btrfs) Delete(op *operations.Operation) error {
 	return nil
 }
 
+// commonVolumeRules returns validation rules which are common for pool and volume.
+func (d *btrfs) commonVolumeRules() map[string]func(value string) error {
+	return map[string]func(value string) error{
+		"btrfs.file_flags":    validate.Optional(validateBtrfsFileFlags),
+		"btrfs.overlay":       validate.Optional(validate.IsBool),
+		"btrfs.snapshot_sync": validate.Optional(validate.IsOneOf(btrfsSnapshotSyncNone, btrfsSnapshotSyncMetadata, btrfsSnapshotSyncFull)),
+	}
+}
+
 // Validate checks that all provide keys are supported and that no conflicting or missing configuration is present.
 func (d *btrfs) Validate(config map[string]string) error {
 	rules := map[string]func(value string) error{
-		"size":                validate.Optional(validate.IsSize),
-		"btrfs.mount_options": validate.IsAny,
+		"size":                             validate.Optional(validate.IsSize),
+		"btrfs.cleanup_readonly_snapshots": validate.Optional(validate.IsBool),
+		"btrfs.mount_options":              validate.IsAny,
+		"btrfs.commit_interval":            validate.Optional(validateCommitInterval),
+		"btrfs.snapshot_mount_options":     validate.Optional(validateMountFlags),
+		"btrfs.images_quota":               validate.Optional(validate.IsSize),
+		"btrfs.snapshots_quota":            validate.Optional(validate.IsSize),
+		"btrfs.subvolume_mode":             validate.Optional(validateSubVolumeMode),
+		"btrfs.data_raid":                  validate.Optional(validate.IsOneOf(btrfsRaidProfiles...)),
+		"btrfs.metadata_raid":              validate.Optional(validate.IsOneOf(btrfsRaidProfiles...)),
+		"btrfs.layout":                     validate.Optional(validate.IsOneOf(PoolLayoutNested, PoolLayoutFlat)),
+		"btrfs.lease_duration":             validate.Optional(validate.IsUint32),
+		"btrfs.manage_qgroups":             validate.Optional(validate.IsBool),
+		"btrfs.quota_rescan_timeout":       validate.Optional(validate.IsUint32),
+		"volatile.btrfs.default_subvolume": validate.Optional(validate.IsInt64),
+		"snapshots.create_rate":            validate.Optional(validate.IsUint32),
+		"snapshots.min_per_instance":       validate.Optional(validate.IsUint32),
+		"snapshots.mount_base":             validate.Optional(validateSnapshotsMountBase),
+		"readahead_kb":                     validate.Optional(validate.IsUint32),
+		"temp_dir":                         validate.Optional(validateTempDir),
+	}
+
+	// Leases are recorded in trusted extended attributes, which can't be written from a user namespace.
+	if config["btrfs.lease_duration"] != "" && config["btrfs.lease_duration"] != "0" && d.state.OS.RunningInUserNS {
+		return fmt.Errorf("btrfs.lease_duration can't be used in a user namespace")
 	}
 
-	return d.validatePool(config, rules, nil)
+	// The snapshot directories are linked from the pool, which the flat layout doesn't have.
+	if config["snapshots.mount_base"] != "" && config["btrfs.layout"] == PoolLayoutFlat {
+		return fmt.Errorf("snapshots.mount_base can't be used with the %q layout", PoolLayoutFlat)
+	}
+
+	return d.validatePool(config, rules, d.commonVolumeRules())
 }
 
 // Update applies any driver changes required from a configuration change.
 func (d *btrfs) Update(changedConfig map[string]string) error {
-	// We only care about btrfs.mount_options.
-	val, ok := changedConfig["btrfs.mount_options"]
-	if !ok {
-		return nil
+	_, changed := changedConfig["btrfs.data_raid"]
+	if changed {
+		return fmt.Errorf("btrfs.data_raid cannot be changed")
+	}
+
+	_, changed = changedConfig["btrfs.metadata_raid"]
+	if changed {
+		return fmt.Errorf("btrfs.metadata_raid cannot be changed")
+	}
+
+	_, changed = changedConfig["btrfs.layout"]
+	if changed {
+		return fmt.Errorf("btrfs.layout cannot be changed")
+	}
+
+	_, changed = changedConfig["snapshots.mount_base"]
+	if changed {
+		return fmt.Errorf("snapshots.mount_base cannot be changed")
+	}
+
+	_, changed = changedConfig["readahead_kb"]
+	if changed {
+		d.config["readahead_kb"] = changedConfig["readahead_kb"]
+		d.applyReadAhead()
+	}
+
+	// Apply the new images cache limit right away so that a setting which can't be applied is refused.
+	_, changed = changedConfig["btrfs.images_quota"]
+	if changed {
+		oldQuota := d.config["btrfs.images_quota"]
+		d.config["btrfs.images_quota"] = changedConfig["btrfs.images_quota"]
+
+		_, err := d.createImagesDir()
+		if err != nil {
+			d.config["btrfs.images_quota"] = oldQuota
+			return fmt.Errorf("Failed applying btrfs.images_quota: %w", err)
+		}
+	}
+
+	// Apply the new snapshots limit to the existing snapshots, restoring the previous one if it can't be applied.
+	_, changed = changedConfig["btrfs.snapshots_quota"]
+	if changed {
+		oldQuota := d.config["btrfs.snapshots_quota"]
+		d.config["btrfs.snapshots_quota"] = changedConfig["btrfs.snapshots_quota"]
+
+		err := d.applySnapshotsQuota()
+		if err != nil {
+			d.config["btrfs.snapshots_quota"] = oldQuota
+			_ = d.applySnapshotsQuota()
+
+			return fmt.Errorf("Failed applying btrfs.snapshots_quota: %w", err)
+		}
+	}
+
+	// Grow loop file backed pools to the new size.
+	size := changedConfig["size"]
+	if size != "" {
+		if d.config["source"] != loopFilePath(d.name) {
+			return fmt.Errorf("size can only be changed for loop file backed pools")
+		}
+
+		sizeBytes, err := units.ParseByteSizeString(size)
+		if err != nil {
+			return err
+		}
+
+		err = btrfsLoopPoolGrow(d.name, sizeBytes)
+		if err != nil {
+			return err
+		}
+
+		d.config["size"] = size
+	}
+
+	// We only care about btrfs.mount_options and btrfs.commit_interval.
+	remount := false
+	for _, key := range []string{"btrfs.mount_options", "btrfs.commit_interval"} {
+		val, ok := changedConfig[key]
+		if ok {
+			d.config[key] = val
+			remount = true
+		}
 	}
 
 	// Custom mount options don't work inside containers
-	if d.state.OS.RunningInUserNS {
+	if !remount || d.state.OS.RunningInUserNS {
 		return nil
 	}
 
 	// Trigger a re-mount.
-	d.config["btrfs.mount_options"] = val
 	mntFlags, mntOptions := resolveMountOptions(d.getMountOptions())
 	mntFlags |= unix.MS_REMOUNT
 
@@ -317,6 +516,91 @@ func (d *btrfs) Update(changedConfig map[string]string) error {
 
 // Mount mounts the storage pool.
 func (d *btrfs) Mount() (bool, error) {
+	ourMount, err := d.mount()
+	if err != nil {
+		return false, err
+	}
+
+	// The snapshots can't be reached directly while the mount of the pool's filesystem holding
+	// snapshots.mount_base is missing, they are then mounted by subvolume ID when needed.
+	base := d.config["snapshots.mount_base"]
+	if base != "" {
+		err = btrfsCheckSameFilesystem(GetPoolMountPath(d.name), base)
+		if err != nil {
+			d.logger.Warn("Snapshots base isn't on the pool's filesystem", logger.Ctx{"base": base, "err": err})
+		}
+	}
+
+	// Delete the temporary read-only snapshots left behind by a previous LXD process, which would otherwise stay
+	// until the pool is deleted.
+	if !shared.IsFalse(d.config["btrfs.cleanup_readonly_snapshots"]) {
+		btrfsCleanupOrphanedReadonlySnapshots(runBtrfsCommand, d.isSubvolume, GetPoolMountPath(d.name), btrfsStartTime, d.logger)
+	}
+
+	return ourMount, nil
+}
+
+// deleteSnapshotsMountBase deletes the snapshot directories of the pool kept under snapshots.mount_base.
+func (d *btrfs) deleteSnapshotsMountBase() error {
+	if d.config["snapshots.mount_base"] == "" {
+		return nil
+	}
+
+	snapshotsPath := GetPoolSnapshotsPath(d.name, d.config["snapshots.mount_base"])
+
+	for _, volType := range d.Info().VolumeTypes {
+		for _, dir := range BaseDirectories[volType] {
+			if !strings.HasSuffix(dir, "-snapshots") {
+				continue
+			}
+
+			dirPath := filepath.Join(snapshotsPath, dir)
+			volDirs, err := os.ReadDir(dirPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				return fmt.Errorf("Failed listing %q: %w", dirPath, err)
+			}
+
+			for _, volDir := range volDirs {
+				volPath := filepath.Join(dirPath, volDir.Name())
+				snapshots, err := os.ReadDir(volPath)
+				if err != nil {
+					return fmt.Errorf("Failed listing %q: %w", volPath, err)
+				}
+
+				for _, snapshot := range snapshots {
+					snapPath := filepath.Join(volPath, snapshot.Name())
+					if !d.isSubvolume(snapPath) {
+						continue
+					}
+
+					err = d.deleteSubvolume(snapPath, true)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			err = os.RemoveAll(dirPath)
+			if err != nil {
+				return fmt.Errorf("Failed removing %q: %w", dirPath, err)
+			}
+		}
+	}
+
+	err := os.Remove(snapshotsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed removing %q: %w", snapshotsPath, err)
+	}
+
+	return nil
+}
+
+// mount mounts the storage pool.
+func (d *btrfs) mount() (bool, error) {
 	// Check if already mounted.
 	if filesystem.IsMountPoint(GetPoolMountPath(d.name)) {
 		return false, nil
@@ -376,6 +660,8 @@ func (d *btrfs) Mount() (bool, error) {
 			return false, err
 		}
 
+		d.applyReadAhead()
+
 		return true, nil
 	}
 
@@ -385,6 +671,27 @@ func (d *btrfs) Mount() (bool, error) {
 		return false, err
 	}
 
+	// The default subvolume is what gets mounted, restore it if it was changed and mount the pool again.
+	restored, err := d.restoreDefaultSubVolume(mntDst)
+	if err != nil {
+		_, _ = forceUnmount(mntDst)
+		return false, err
+	}
+
+	if restored {
+		_, err = forceUnmount(mntDst)
+		if err != nil {
+			return false, err
+		}
+
+		err = TryMount(mntSrc, mntDst, mntFilesystem, mntFlags, mntOptions)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	d.applyReadAhead()
+
 	return true, nil
 }
 
@@ -401,7 +708,452 @@ func (d *btrfs) Unmount() (bool, error) {
 
 // GetResources returns the pool resource usage information.
 func (d *btrfs) GetResources() (*api.ResourcesStoragePool, error) {
-	return genericVFSGetResources(d)
+	res, err := genericVFSGetResources(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Include the device error counters, without failing if they can't be retrieved.
+	devices, err := btrfsPoolDeviceStats(GetPoolMountPath(d.name))
+	if err != nil {
+		d.logger.Warn("Failed getting pool device stats", logger.Ctx{"err": err})
+	} else {
+		res.Devices = devices
+	}
+
+	return res, nil
+}
+
+// EmergencyFree frees space for metadata on the pool so that it can recover from metadata exhaustion.
+func (d *btrfs) EmergencyFree(op *operations.Operation) error {
+	return btrfsEmergencyFree(runBtrfsCommand, GetPoolMountPath(d.name))
+}
+
+// ValidateLayout checks that the pool has the expected base directories and that the volumes and snapshots
+// within them are subvolumes. It doesn't modify the pool.
+func (d *btrfs) ValidateLayout() (*LayoutReport, error) {
+	deviations, err := btrfsLayoutDeviations(GetPoolMountPath(d.name), GetPoolSnapshotsPath(d.name, d.config["snapshots.mount_base"]), d.config["btrfs.layout"], d.Info().VolumeTypes, btrfsIsSubVolume)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LayoutReport{Valid: len(deviations) == 0, Deviations: deviations}, nil
+}
+
+// PruneSnapshotDirs removes the empty parent snapshot directories and dangling symlinks left behind in the
+// snapshots directories of the pool, wherever the pool's layout puts them.
+func (d *btrfs) PruneSnapshotDirs(op *operations.Operation) ([]string, error) {
+	return pruneSnapshotDirs(GetPoolMountPath(d.name), d.config["btrfs.layout"])
+}
+
+// CheckHealth checks the pool for subvolumes whose quota accounting is inconsistent, such as after a crash, as
+// their usage is stale until the quotas are rescanned.
+func (d *btrfs) CheckHealth() (*PoolHealthReport, error) {
+	issues, err := btrfsQuotaHealthIssues(runBtrfsCommandWithWarnings, GetPoolMountPath(d.name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PoolHealthReport{Healthy: len(issues) == 0, Issues: issues}, nil
+}
+
+// CheckReadonly checks the read-only flag of the subvolumes of the supplied volumes (including the filesystem
+// volume of VM block volumes), such as the snapshots used as parents of incremental sends and the images instances
+// are created from, and returns an issue for each one found writable. If repair is true, the writable subvolumes
+// are made read-only again.
+func (d *btrfs) CheckReadonly(vols []Volume, repair bool) ([]PoolHealthIssue, error) {
+	issues := btrfsReadonlyHealthIssues(btrfsVolumesSubvolumePaths(vols), d.PoolRelPath, BTRFSSubVolumeIsRo)
+	for _, issue := range issues {
+		d.logger.Warn("Found writable read-only subvolume", logger.Ctx{"path": issue.Path})
+	}
+
+	if !repair || len(issues) == 0 {
+		return issues, nil
+	}
+
+	// The issues of the subvolumes repaired before any failure are still updated.
+	repaired, err := d.RepairReadonly(vols, nil)
+	btrfsReadonlyIssuesRepaired(issues, repaired)
+
+	return issues, err
+}
+
+// Rebalance spreads the pool data evenly across its devices.
+// It first runs a balance limited to enough data chunks of the fullest device to even it out with the emptiest
+// one, and then relocates the supplied volumes (largest first, until the devices are balanced) by sending them
+// to a new subvolume within the pool. Relocated volumes stop sharing extents with their snapshots.
+// Cancelling the context stops the balance and any in-progress relocation, leaving volumes already relocated
+// in place and the others untouched.
+func (d *btrfs) Rebalance(ctx context.Context, vols []Volume, op *operations.Operation) error {
+	progress := func(stage string) {
+		if op != nil {
+			_ = op.ExtendMetadata(map[string]any{"rebalance_progress": stage})
+		}
+	}
+
+	devices, err := d.getDevices()
+	if err != nil {
+		return err
+	}
+
+	if len(devices) < 2 {
+		return fmt.Errorf("Rebalancing requires a pool with multiple devices")
+	}
+
+	from, to, size := btrfsRebalanceTarget(devices)
+	chunks := size / btrfsDataChunkSize
+	if chunks > 0 {
+		progress(fmt.Sprintf("Balancing %d data chunks from %s to %s", chunks, from.Path, to.Path))
+
+		err = d.balance(ctx, fmt.Sprintf("-ddevid=%d,limit=%d", from.ID, chunks))
+		if err != nil {
+			return fmt.Errorf("Failed balancing pool: %w", err)
+		}
+	}
+
+	if len(vols) == 0 {
+		return nil
+	}
+
+	// Refresh the device usage following the balance.
+	devices, err = d.getDevices()
+	if err != nil {
+		return err
+	}
+
+	_, _, size = btrfsRebalanceTarget(devices)
+
+	candidates := make([]btrfsRebalanceCandidate, 0, len(vols))
+	for _, vol := range vols {
+		usage, err := d.GetVolumeUsage(vol)
+		if err != nil {
+			// Without quotas the volume size is unknown so always relocate it.
+			usage = 0
+		}
+
+		candidates = append(candidates, btrfsRebalanceCandidate{Name: vol.name, Size: usage})
+	}
+
+	selected := btrfsRebalanceSelect(candidates, size)
+	for i, name := range selected {
+		for _, vol := range vols {
+			if vol.name != name {
+				continue
+			}
+
+			progress(fmt.Sprintf("Relocating volume %q (%d/%d)", vol.name, i+1, len(selected)))
+
+			err = d.relocateVolume(ctx, vol)
+			if err != nil {
+				return fmt.Errorf("Failed relocating volume %q: %w", vol.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// EstimateSharing estimates the physical space saved by the supplied volumes sharing extents, using the
+// referenced and exclusive space of their qgroups. Returns ErrNotSupported if quotas are disabled on the pool.
+func (d *btrfs) EstimateSharing(vols []Volume) (*SpaceSharingEstimate, error) {
+	usages := make([]btrfsQGroupUsage, 0, len(vols))
+	for _, vol := range vols {
+		referenced, exclusive, err := btrfsSubVolumeQGroupUsage(vol.MountPath())
+		if err != nil {
+			if err == errBtrfsNoQuota {
+				return nil, ErrNotSupported
+			}
+
+			return nil, fmt.Errorf("Failed getting usage of volume %q: %w", vol.name, err)
+		}
+
+		usages = append(usages, btrfsQGroupUsage{Referenced: referenced, Exclusive: exclusive})
+	}
+
+	return btrfsEstimateSharing(usages), nil
+}
+
+// InstanceTotalFootprint returns the space used by the instance volume and its snapshots combined, counting the
+// extents they share once, as estimated from their qgroups. Returns ErrNotSupported if quotas are disabled.
+func (d *btrfs) InstanceTotalFootprint(vol Volume, snapshots []string) (int64, error) {
+	paths := []string{vol.MountPath()}
+	for _, snapName := range snapshots {
+		snapVol, err := vol.NewSnapshot(snapName)
+		if err != nil {
+			return -1, err
+		}
+
+		paths = append(paths, snapVol.MountPath())
+	}
+
+	footprint, err := btrfsInstanceFootprint(paths, btrfsSubVolumeQGroupUsage)
+	if err != nil {
+		if err == errBtrfsNoQuota {
+			return -1, ErrNotSupported
+		}
+
+		return -1, fmt.Errorf("Failed getting footprint of volume %q: %w", vol.name, err)
+	}
+
+	return footprint, nil
+}
+
+// FindStraySubvolumes returns the subvolumes of the pool (relative to its mount path) which don't belong to any
+// of the supplied volumes, such as subvolumes created manually within the pool. Nothing is deleted.
+func (d *btrfs) FindStraySubvolumes(vols []Volume) ([]string, error) {
+	subvols, err := BTRFSSubVolumesGet(d.PoolAbsPath(""))
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make([]string, 0, len(vols))
+	for _, vol := range vols {
+		path, err := d.PoolRelPath(vol.MountPath())
+		if err != nil {
+			return nil, err
+		}
+
+		managed = append(managed, path)
+	}
+
+	return btrfsStraySubvolumes(subvols, managed, d.config["btrfs.layout"], d.Info().VolumeTypes), nil
+}
+
+// GetSubvolumeIDs returns the supplied volumes which have a subvolume in the pool, keyed by subvolume ID, so that
+// the IDs shown by the btrfs tools can be related to volumes. The subvolumes are listed with a single command.
+func (d *btrfs) GetSubvolumeIDs(vols []Volume) (map[string]Volume, error) {
+	poolMount := GetPoolMountPath(d.name)
+
+	subvols, err := btrfsListSubvolumes(runBtrfsCommand, poolMount)
+	if err != nil {
+		return nil, err
+	}
+
+	poolSubvolPath, err := btrfsPoolSubvolumePath(runBtrfsCommand, poolMount, subvols)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(vols))
+	volsByPath := make(map[string]Volume, len(vols))
+	for _, vol := range vols {
+		path, err := d.PoolRelPath(vol.MountPath())
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, path)
+		volsByPath[path] = vol
+	}
+
+	volsByID := map[string]Volume{}
+	for id, path := range btrfsSubvolumeIDs(subvols, poolSubvolPath, paths) {
+		volsByID[id] = volsByPath[path]
+	}
+
+	return volsByID, nil
+}
+
+// GetQGroupLimits returns the referenced space limit of the level 0 qgroup of each of the supplied volumes which
+// has one, keyed by "<type>/<name>". Returns ErrNotSupported if quotas are disabled on the pool.
+func (d *btrfs) GetQGroupLimits(vols []Volume) (map[string]int64, error) {
+	volsByID, err := d.GetSubvolumeIDs(vols)
+	if err != nil {
+		return nil, err
+	}
+
+	poolMntPath := GetPoolMountPath(d.name)
+	output, err := runBtrfsCommand("qgroup", "show", "-r", "--raw", poolMntPath)
+	if err != nil {
+		err = btrfsQGroupShowError(poolMntPath, err)
+		if err == errBtrfsNoQuota {
+			return nil, ErrNotSupported
+		}
+
+		return nil, err
+	}
+
+	qgroupLimits, err := parseQGroupLimits(output)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := map[string]int64{}
+	for id, vol := range volsByID {
+		limit, ok := qgroupLimits[fmt.Sprintf("0/%s", id)]
+		if ok {
+			limits[fmt.Sprintf("%s/%s", vol.volType, vol.name)] = limit
+		}
+	}
+
+	return limits, nil
+}
+
+// QuiescePool flushes the dirty data of the pool's filesystem and commits its current transaction, then freezes
+// it if freeze is set so that nothing is written to it until ResumePool is called. Pools which are a directory of
+// another filesystem can't be frozen as that would freeze the whole filesystem.
+func (d *btrfs) QuiescePool(freeze bool) error {
+	if freeze && !d.ownsFilesystem() {
+		return fmt.Errorf("Cannot freeze storage pool %q as its source %q is a directory of another filesystem", d.name, d.config["source"])
+	}
+
+	return btrfsHostSyncOps.quiesce(GetPoolMountPath(d.name), freeze)
+}
+
+// ResumePool thaws the pool's filesystem frozen by QuiescePool. Filesystems which aren't frozen are left alone.
+func (d *btrfs) ResumePool() error {
+	if !d.ownsFilesystem() {
+		return nil
+	}
+
+	poolPath := GetPoolMountPath(d.name)
+
+	err := btrfsHostSyncOps.thaw(poolPath)
+	if err != nil {
+		// Thawing a filesystem which isn't frozen fails with EINVAL.
+		if strings.Contains(err.Error(), unix.EINVAL.Error()) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed thawing filesystem %q: %w", poolPath, err)
+	}
+
+	return nil
+}
+
+// ownsFilesystem returns whether the pool has a filesystem of its own (on a loop file or a block device), rather
+// than being a directory of an existing btrfs filesystem bind-mounted on the pool's mount path.
+func (d *btrfs) ownsFilesystem() bool {
+	source := d.config["source"]
+	if source == loopFilePath(d.name) || !filepath.IsAbs(source) {
+		return true
+	}
+
+	return shared.IsBlockdevPath(shared.HostPath(source))
+}
+
+// VerifyMounts mounts the subvolume of each of the supplied volumes read-only on its own, by subvolume ID, and
+// unmounts it straight away. Returns the volumes which failed to mount, such as those whose subvolume is missing
+// or damaged.
+func (d *btrfs) VerifyMounts(vols []Volume, op *operations.Operation) ([]VolumeMountFailure, error) {
+	if d.state.OS.RunningInUserNS {
+		return nil, fmt.Errorf("Cannot mount subvolumes in a user namespace: %w", ErrNotSupported)
+	}
+
+	poolMount := GetPoolMountPath(d.name)
+
+	subvols, err := btrfsListSubvolumes(runBtrfsCommand, poolMount)
+	if err != nil {
+		return nil, err
+	}
+
+	poolSubvolPath, err := btrfsPoolSubvolumePath(runBtrfsCommand, poolMount, subvols)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := shared.RunCommand("btrfs", "filesystem", "show", poolMount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing pool devices: %w", err)
+	}
+
+	devices := btrfsFilesystemDevices(output)
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("Failed finding the devices of pool %q", d.name)
+	}
+
+	mountPath, err := os.MkdirTemp("", "lxd_btrfs_verify_")
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating temporary mount point: %w", err)
+	}
+
+	defer func() { _ = os.Remove(mountPath) }()
+
+	mount := func(subvolID string) error {
+		// Not retried as failing to mount is what is being looked for.
+		err := unix.Mount(devices[0], mountPath, "btrfs", unix.MS_RDONLY, fmt.Sprintf("subvolid=%s", subvolID))
+		if err != nil {
+			return fmt.Errorf("Failed mounting subvolume %s: %w", subvolID, err)
+		}
+
+		return TryUnmount(mountPath, 0)
+	}
+
+	return btrfsVerifySubvolumeMounts(vols, subvols, poolSubvolPath, d.PoolRelPath, mount), nil
+}
+
+// RepairReadonly checks the read-only flag of the subvolumes of the supplied volumes (including the filesystem
+// volume of VM block volumes) and sets it again on those which were writable, returning their pool relative paths.
+func (d *btrfs) RepairReadonly(vols []Volume, op *operations.Operation) ([]string, error) {
+	// The read-only flag can't be changed from within a user namespace.
+	if d.state.OS.RunningInUserNS {
+		return nil, fmt.Errorf("Cannot change read-only flags in a user namespace: %w", ErrNotSupported)
+	}
+
+	makeRo := func(path string) error {
+		return d.setSubvolumeReadonlyProperty(path, true)
+	}
+
+	repaired, err := btrfsRepairReadonly(btrfsVolumesSubvolumePaths(vols), BTRFSSubVolumeIsRo, makeRo)
+
+	relPaths := make([]string, 0, len(repaired))
+	for _, path := range repaired {
+		relPath, relErr := d.PoolRelPath(path)
+		if relErr != nil {
+			relPath = path
+		}
+
+		d.logger.Warn("Made writable subvolume read-only again", logger.Ctx{"path": relPath})
+		relPaths = append(relPaths, relPath)
+	}
+
+	return relPaths, err
+}
+
+// ExportVolumeOCI writes a read-only snapshot of the volume to w as an OCI image layer tarball, or as an OCI image
+// layout including config if set, so the volume can be consumed by container runtimes. Only the rootfs of instance
+// volumes is exported, with the ownership of its files unshifted with idmapSet if set.
+func (d *btrfs) ExportVolumeOCI(vol Volume, w io.Writer, config *OCIImageConfig, idmapSet *idmap.IdmapSet, op *operations.Operation) error {
+	if vol.contentType != ContentTypeFS {
+		return fmt.Errorf("Only filesystem volumes can be exported as OCI layers: %w", ErrNotSupported)
+	}
+
+	err := btrfsCheckNotOverlay(vol.MountPath(), "export")
+	if err != nil {
+		return err
+	}
+
+	rootPath := vol.MountPath()
+
+	// Export from a read-only snapshot so that the layer is consistent, snapshots already being read-only.
+	if !vol.IsSnapshot() {
+		snapshotPath, cleanup, err := d.readonlySnapshot(vol)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+
+		rootPath = snapshotPath
+	}
+
+	// The layer holds the root filesystem of instances, not their metadata and templates.
+	if vol.volType == VolumeTypeContainer {
+		rootPath = filepath.Join(rootPath, "rootfs")
+	}
+
+	tmpDir, err := vol.TempDir(shared.VarPath("backups"), "")
+	if err != nil {
+		return err
+	}
+
+	return ociExport(w, rootPath, config, idmapSet, tmpDir)
+}
+
+// GetSnapshotsReclaimableSpace returns the space exclusively owned by each of the volume's snapshots, which is
+// what deleting them would free, largest first. This requires quotas to be enabled on the pool.
+func (d *btrfs) GetSnapshotsReclaimableSpace(vol Volume, snapshots []string) (*ReclaimableSpaceReport, error) {
+	return btrfsSnapshotsReclaimableSpace(vol, snapshots, btrfsSubVolumeQGroupUsage)
 }
 
 // MigrationType returns the type of transfer methods to be used when doing migrations between pools in preference order.
@@ -2,7 +2,10 @@ package drivers
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +14,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/pborman/uuid"
@@ -18,10 +23,15 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/lxc/lxd/lxd/backup"
+	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/revert"
+	"github.com/lxc/lxd/lxd/storage/filesystem"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/ioprogress"
 	"github.com/lxc/lxd/shared/logger"
+	"github.com/lxc/lxd/shared/units"
 )
 
 // Errors.
@@ -60,19 +70,199 @@ func setReceivedUUID(path string, UUID string) error {
 	return nil
 }
 
+// btrfsFilesystemID returns the UUID of the btrfs filesystem the path is on.
+func btrfsFilesystemID(path string) ([16]byte, error) {
+	type btrfsIoctlFsInfoArgs struct {
+		maxID      uint64
+		numDevices uint64
+		fsid       [16]byte
+		_          [992]byte // Remaining fields and padding.
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return [16]byte{}, fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	args := btrfsIoctlFsInfoArgs{}
+
+	// 0x8400941F = _IOR(BTRFS_IOCTL_MAGIC, 31, struct btrfs_ioctl_fs_info_args)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), 0x8400941F, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return [16]byte{}, fmt.Errorf("Failed getting filesystem info of %s: %w", path, unix.Errno(errno))
+	}
+
+	return args.fsid, nil
+}
+
+// btrfsCheckSameFilesystem returns an error unless path is on the btrfs filesystem mounted at poolMount.
+// Subvolumes can only be snapshotted and moved within the same filesystem.
+func btrfsCheckSameFilesystem(poolMount string, path string) error {
+	poolID, err := btrfsFilesystemID(poolMount)
+	if err != nil {
+		return err
+	}
+
+	pathID, err := btrfsFilesystemID(path)
+	if err != nil {
+		return fmt.Errorf("Not on a btrfs filesystem: %w", err)
+	}
+
+	if pathID != poolID {
+		return fmt.Errorf("Not on the btrfs filesystem of the pool")
+	}
+
+	return nil
+}
+
+// btrfsRaidProfiles lists the supported raid profiles for data and metadata.
+var btrfsRaidProfiles = []string{"single", "dup", "raid0", "raid1", "raid10"}
+
+// btrfsRaidProfileMinDevices is the minimum number of devices needed by each raid profile.
+var btrfsRaidProfileMinDevices = map[string]int{
+	"single": 1,
+	"dup":    1,
+	"raid0":  2,
+	"raid1":  2,
+	"raid10": 4,
+}
+
+// btrfsValidateRaidProfiles checks that the data and metadata raid profiles can be used with the given number
+// of devices. Empty profiles are ignored and left for mkfs.btrfs to pick.
+func btrfsValidateRaidProfiles(dataRaid string, metadataRaid string, devices int) error {
+	profiles := [][2]string{{"btrfs.data_raid", dataRaid}, {"btrfs.metadata_raid", metadataRaid}}
+	for _, entry := range profiles {
+		key, profile := entry[0], entry[1]
+		if profile == "" {
+			continue
+		}
+
+		minDevices, ok := btrfsRaidProfileMinDevices[profile]
+		if !ok {
+			return fmt.Errorf("Invalid %s profile %q", key, profile)
+		}
+
+		if devices < minDevices {
+			return fmt.Errorf("The %q profile for %s requires at least %d devices (%d provided)", profile, key, minDevices, devices)
+		}
+	}
+
+	return nil
+}
+
+// btrfsSourceDevices splits a comma separated pool source into its list of devices.
+func btrfsSourceDevices(source string) []string {
+	devices := []string{}
+	for _, device := range strings.Split(source, ",") {
+		device = strings.TrimSpace(device)
+		if device != "" {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+// btrfsIsBlockdevSource returns true if the pool source is made of one or more block devices.
+func btrfsIsBlockdevSource(source string) bool {
+	devices := btrfsSourceDevices(source)
+	if len(devices) == 0 {
+		return false
+	}
+
+	for _, device := range devices {
+		if !shared.IsBlockdevPath(device) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// makeFS formats the supplied devices as a single btrfs filesystem, applying any configured raid profiles.
+func (d *btrfs) makeFS(devices ...string) (string, error) {
+	args := []string{"-L", d.name}
+
+	if d.config["btrfs.data_raid"] != "" {
+		args = append(args, "-d", d.config["btrfs.data_raid"])
+	}
+
+	if d.config["btrfs.metadata_raid"] != "" {
+		args = append(args, "-m", d.config["btrfs.metadata_raid"])
+	}
+
+	// Always add the devices as the last arguments.
+	args = append(args, devices...)
+
+	msg, err := shared.TryRunCommand("mkfs.btrfs", args...)
+	if err != nil {
+		return msg, err
+	}
+
+	return "", nil
+}
+
 func (d *btrfs) getMountOptions() string {
 	// Allow overriding the default options.
+	mntOptions := "user_subvol_rm_allowed"
 	if d.config["btrfs.mount_options"] != "" {
-		return d.config["btrfs.mount_options"]
+		mntOptions = d.config["btrfs.mount_options"]
+	}
+
+	if d.config["btrfs.commit_interval"] == "" {
+		return mntOptions
+	}
+
+	// btrfs.commit_interval takes precedence over any commit option in btrfs.mount_options.
+	opts := []string{}
+	for _, opt := range strings.Split(mntOptions, ",") {
+		if !strings.HasPrefix(opt, "commit=") {
+			opts = append(opts, opt)
+		}
+	}
+
+	return strings.Join(append(opts, "commit="+d.config["btrfs.commit_interval"]), ",")
+}
+
+// validateCommitInterval checks that value is a commit interval (in seconds) btrfs handles sensibly.
+// The kernel warns above 300s and 0 means its default, which is better expressed by leaving the key unset.
+func validateCommitInterval(value string) error {
+	interval, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid commit interval %q: %w", value, err)
+	}
+
+	if interval < 1 || interval > 300 {
+		return fmt.Errorf("Commit interval must be between 1 and 300 seconds")
+	}
+
+	return nil
+}
+
+// getSnapshotMountFlags returns the flags used when mounting snapshots from btrfs.snapshot_mount_options.
+// Snapshots are always mounted read-only.
+func (d *btrfs) getSnapshotMountFlags() uintptr {
+	mntFlags, _ := resolveMountOptions(d.config["btrfs.snapshot_mount_options"])
+
+	return mntFlags | unix.MS_RDONLY
+}
+
+// subvolumeMode returns the mode of the subvolumes created on the pool.
+func (d *btrfs) subvolumeMode() os.FileMode {
+	mode, err := parseSubVolumeMode(d.config["btrfs.subvolume_mode"])
+	if err != nil {
+		return btrfsSubVolumeDefaultMode
 	}
 
-	return "user_subvol_rm_allowed"
+	return mode
 }
 
 func (d *btrfs) isSubvolume(path string) bool {
 	// Stat the path.
 	fs := unix.Stat_t{}
-	err := unix.Lstat(path, &fs)
+	err := filesystem.Lstat(path, &fs)
 	if err != nil {
 		return false
 	}
@@ -86,21 +276,35 @@ func (d *btrfs) isSubvolume(path string) bool {
 }
 
 func (d *btrfs) getSubvolumes(path string) ([]string, error) {
-	result := []string{}
+	return btrfsSubVolumesGet(path, d.isSubvolume, nil)
+}
 
-	// Make sure the path has a trailing slash.
-	if !strings.HasSuffix(path, "/") {
-		path = path + "/"
+// btrfsSubVolumesGet returns the subvolumes below path (relative to it) which isSubvolume reports as such. The
+// entries whose relative path matches one of the exclude glob patterns (as supported by filepath.Match) are
+// neither returned nor descended into, so that the subvolumes below them are left out too.
+func btrfsSubVolumesGet(path string, isSubvolume func(path string) bool, exclude []string) ([]string, error) {
+	for _, pattern := range exclude {
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern %q: %w", pattern, err)
+		}
 	}
 
+	result := []string{}
+
 	// Walk through the entire tree looking for subvolumes.
 	err := filepath.Walk(path, func(fpath string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		relPath, err := relPathUnder(path, fpath)
+		if err != nil {
+			return err
+		}
+
 		// Ignore the base path.
-		if strings.TrimRight(fpath, "/") == strings.TrimRight(path, "/") {
+		if relPath == "." {
 			return nil
 		}
 
@@ -109,9 +313,17 @@ func (d *btrfs) getSubvolumes(path string) ([]string, error) {
 			return nil
 		}
 
+		// Skip the excluded areas entirely.
+		for _, pattern := range exclude {
+			matched, _ := filepath.Match(pattern, relPath)
+			if matched {
+				return filepath.SkipDir
+			}
+		}
+
 		// Check if a subvolume.
-		if d.isSubvolume(fpath) {
-			result = append(result, strings.TrimPrefix(fpath, path))
+		if isSubvolume(fpath) {
+			result = append(result, relPath)
 		}
 
 		return nil
@@ -124,13 +336,25 @@ func (d *btrfs) getSubvolumes(path string) ([]string, error) {
 }
 
 // snapshotSubvolume creates a snapshot of the specified path at the dest supplied. If recursion is true and
-// sub volumes are found below the path then they are created at the relative location in dest.
-func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool) error {
-	// Single subvolume deletion.
+// sub volumes are found below the path then they are created at the relative location in dest. If owner isn't
+// nil, the root of the snapshot is given its ownership.
+func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool, owner *volumeOwner) error {
+	return d.snapshotSubvolumeInQGroup(path, dest, recursion, owner, "")
+}
+
+// snapshotSubvolumeInQGroup is like snapshotSubvolume, also assigning the created subvolumes to qgroup unless it
+// is empty.
+func (d *btrfs) snapshotSubvolumeInQGroup(path string, dest string, recursion bool, owner *volumeOwner, qgroup string) error {
+	// Single subvolume snapshot.
 	snapshot := func(path string, dest string) error {
-		_, err := shared.RunCommand("btrfs", "subvolume", "snapshot", path, dest)
+		args := []string{"subvolume", "snapshot"}
+		if qgroup != "" {
+			args = append(args, "-i", qgroup)
+		}
+
+		_, err := shared.RunCommand("btrfs", append(args, path, dest)...)
 		if err != nil {
-			return err
+			return btrfsSubVolumeError(path, err)
 		}
 
 		return nil
@@ -142,6 +366,11 @@ func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool) erro
 		return err
 	}
 
+	err = btrfsSubVolumeChown(dest, owner)
+	if err != nil {
+		return err
+	}
+
 	// Now snapshot all subvolumes of the root.
 	if recursion {
 		// Get the subvolumes list.
@@ -169,78 +398,184 @@ func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool) erro
 }
 
 func (d *btrfs) deleteSubvolume(rootPath string, recursion bool) error {
-	// Single subvolume deletion.
-	destroy := func(path string) error {
+	return d.deleteSubvolumeProgress(rootPath, recursion, nil)
+}
+
+// deleteSubvolumeProgress deletes a subvolume (and its sub volumes if recursion is true), calling progress (if
+// not nil) with the number of subvolumes deleted so far and the total as each one is removed.
+func (d *btrfs) deleteSubvolumeProgress(rootPath string, recursion bool, progress func(current int, total int)) error {
+	// Prepare a subvolume for deletion.
+	prepare := func(path string) {
 		// Attempt (but don't fail on) to delete any qgroup on the subvolume.
-		qgroup, _, err := d.getQGroup(path)
-		if err == nil {
-			_, _ = shared.RunCommand("btrfs", "qgroup", "destroy", qgroup, path)
-		}
+		btrfsDestroySubvolumeQGroup(runBtrfsCommand, d.config, path)
+
+		// Clear the file flags which prevent removing the subvolume.
+		_ = btrfsSetFileFlags(path, 0, btrfsFileFlagsMask(btrfsProtectionFileFlags, btrfsProtectionFileFlags, false))
 
 		// Temporarily change ownership & mode to help with nesting.
 		_ = os.Chmod(path, 0700)
 		_ = os.Chown(path, 0, 0)
-
-		// Delete the subvolume itself.
-		_, err = shared.RunCommand("btrfs", "subvolume", "delete", path)
-
-		return err
 	}
 
 	err := d.setSubvolumeReadonlyProperty(rootPath, false)
 	if err != nil {
-		return fmt.Errorf("Failed setting subvolume writable %q: %w", rootPath, err)
+		return fmt.Errorf("Failed setting subvolume writable %q: %w", rootPath, btrfsSubVolumeError(rootPath, err))
 	}
 
 	// Attempt to delete the root subvol itself (short path).
-	err = destroy(rootPath)
+	prepare(rootPath)
+	err = btrfsDeleteSubvolumes([]string{rootPath}, false, progress)
 	if err == nil {
 		return nil
 	}
 
-	// Delete subsubvols.
-	if recursion {
-		// Get the subvolumes list.
-		subSubVols, err := d.getSubvolumes(rootPath)
+	if !recursion {
+		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, btrfsSubVolumeError(rootPath, err))
+	}
+
+	// Get the subvolumes list.
+	subSubVols, err := d.getSubvolumes(rootPath)
+	if err != nil {
+		return err
+	}
+
+	// Perform a first pass and ensure all sub volumes are writable.
+	sort.Sort(sort.StringSlice(subSubVols))
+	for _, subSubVol := range subSubVols {
+		subSubVolPath := filepath.Join(rootPath, subSubVol)
+		err = d.setSubvolumeReadonlyProperty(subSubVolPath, false)
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed setting subvolume writable %q: %w", subSubVolPath, err)
 		}
+	}
 
-		// Perform a first pass and ensure all sub volumes are writable.
-		sort.Sort(sort.StringSlice(subSubVols))
-		for _, subSubVol := range subSubVols {
-			subSubVolPath := filepath.Join(rootPath, subSubVol)
-			err = d.setSubvolumeReadonlyProperty(subSubVolPath, false)
+	// Perform a second pass to delete the sub volumes and the root subvol in a single batch.
+	paths := btrfsSubvolumeDeleteOrder(rootPath, subSubVols)
+	for _, path := range paths {
+		prepare(path)
+	}
+
+	err = btrfsDeleteSubvolumes(paths, false, progress)
+	if err != nil {
+		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+	}
+
+	return nil
+}
+
+// btrfsSubvolumeDeleteOrder returns the paths of the sub volumes (relative to rootPath) and of the root itself in
+// the order they must be deleted, children before their parents.
+func btrfsSubvolumeDeleteOrder(rootPath string, subSubVols []string) []string {
+	sorted := append([]string{}, subSubVols...)
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	paths := make([]string, 0, len(sorted)+1)
+	for _, subSubVol := range sorted {
+		paths = append(paths, filepath.Join(rootPath, subSubVol))
+	}
+
+	return append(paths, rootPath)
+}
+
+// btrfsDeleteSubvolumes deletes the subvolumes in the order given. By default all the deletions are issued in a
+// single command waiting for one transaction commit at the end. If commitEach is true a commit is done after each
+// deletion instead. If progress isn't nil, it's called with the number of subvolumes deleted so far and the total
+// as each one is removed.
+func btrfsDeleteSubvolumes(paths []string, commitEach bool, progress func(current int, total int)) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	if commitEach {
+		for i, path := range paths {
+			_, err := shared.RunCommand("btrfs", "subvolume", "delete", "--commit-each", path)
 			if err != nil {
-				return fmt.Errorf("Failed setting subvolume writable %q: %w", subSubVolPath, err)
+				return err
 			}
-		}
 
-		// Perform a second pass to delete subvolumes.
-		sort.Sort(sort.Reverse(sort.StringSlice(subSubVols)))
-		for _, subSubVol := range subSubVols {
-			subSubVolPath := filepath.Join(rootPath, subSubVol)
-			err := destroy(subSubVolPath)
-			if err != nil {
-				return fmt.Errorf("Failed deleting subvolume %q: %w", subSubVolPath, err)
+			if progress != nil {
+				progress(i+1, len(paths))
 			}
 		}
+
+		return nil
 	}
 
-	// Delete the root subvol itself.
-	err = destroy(rootPath)
-	if err != nil {
-		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+	// The command reports each subvolume as it deletes it.
+	args := append([]string{"subvolume", "delete", "--commit-after"}, paths...)
+	return shared.RunCommandWithFds(context.TODO(), nil, &btrfsDeleteProgressWriter{total: len(paths), progress: progress}, "btrfs", args...)
+}
+
+// btrfsDeleteProgress returns a progress callback reporting the subvolumes deleted so far in the metadata of op,
+// or nil if there is no operation.
+func btrfsDeleteProgress(op *operations.Operation) func(current int, total int) {
+	if op == nil {
+		return nil
 	}
 
-	return nil
+	return func(current int, total int) {
+		_ = op.ExtendMetadata(map[string]any{"delete_progress": fmt.Sprintf("%d%% (%d/%d)", current*100/total, current, total)})
+	}
+}
+
+// btrfsDeleteProgressWriter parses the output of "btrfs subvolume delete", calling progress (if not nil) for each
+// subvolume reported as deleted.
+type btrfsDeleteProgressWriter struct {
+	total    int
+	current  int
+	progress func(current int, total int)
+	buf      []byte
+}
+
+// Write parses the complete lines written so far.
+func (w *btrfsDeleteProgressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		end := bytes.IndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := w.buf[:end]
+		w.buf = w.buf[end+1:]
+
+		if !bytes.HasPrefix(line, []byte("Delete subvolume")) || w.current >= w.total {
+			continue
+		}
+
+		w.current++
+		if w.progress != nil {
+			w.progress(w.current, w.total)
+		}
+	}
+
+	return len(p), nil
+}
+
+// btrfsDestroySubvolumeQGroup destroys the qgroup of the subvolume at path ahead of its deletion, ignoring any
+// failure. Nothing is done if the "btrfs.manage_qgroups" pool setting leaves the qgroups to an external system.
+func btrfsDestroySubvolumeQGroup(run btrfsCommandFunc, poolConfig map[string]string, path string) {
+	if shared.IsFalse(poolConfig["btrfs.manage_qgroups"]) {
+		return
+	}
+
+	qgroup, _, err := btrfsGetQGroup(run, path)
+	if err == nil {
+		_, _ = run("qgroup", "destroy", qgroup, path)
+	}
 }
 
 func (d *btrfs) getQGroup(path string) (string, int64, error) {
+	return btrfsGetQGroup(runBtrfsCommand, path)
+}
+
+// btrfsGetQGroup returns the identifier and the referenced usage of the qgroup of the subvolume at path.
+func btrfsGetQGroup(run btrfsCommandFunc, path string) (string, int64, error) {
 	// Try to get the qgroup details.
-	output, err := shared.RunCommand("btrfs", "qgroup", "show", "-e", "-f", "--raw", path)
+	output, err := run("qgroup", "show", "-e", "-f", "--raw", path)
 	if err != nil {
-		return "", -1, errBtrfsNoQuota
+		return "", -1, btrfsQGroupShowError(path, err)
 	}
 
 	// Parse to extract the qgroup identifier.
@@ -272,331 +607,4724 @@ func (d *btrfs) getQGroup(path string) (string, int64, error) {
 	return qgroup, usage, nil
 }
 
-func (d *btrfs) sendSubvolume(path string, parent string, conn io.ReadWriteCloser, tracker *ioprogress.ProgressTracker) error {
-	// Assemble btrfs send command.
-	args := []string{"send"}
-	if parent != "" {
-		args = append(args, "-p", parent)
+// createQGroup creates the level 0 qgroup of the subvolume at path and returns its identifier.
+func (d *btrfs) createQGroup(path string) (string, error) {
+	// Find the volume ID.
+	output, err := shared.RunCommand("btrfs", "subvolume", "show", path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get subvol information: %w", err)
 	}
 
-	args = append(args, path)
-	cmd := exec.Command("btrfs", args...)
+	id := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Subvolume ID:") {
+			fields := strings.Split(line, ":")
+			id = strings.TrimSpace(fields[len(fields)-1])
+		}
+	}
 
-	// Prepare stdout/stderr.
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+	if id == "" {
+		return "", fmt.Errorf("Failed to find subvolume id for %q", path)
 	}
 
-	stderr, err := cmd.StderrPipe()
+	// Create a qgroup.
+	_, err = shared.RunCommand("btrfs", "qgroup", "create", fmt.Sprintf("0/%s", id), path)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Setup progress tracker.
-	stdoutPipe := stdout
-	if tracker != nil {
-		stdoutPipe = &ioprogress.ProgressReader{
-			ReadCloser: stdout,
-			Tracker:    tracker,
-		}
-	}
+	// Try to get the qgroup again.
+	qgroup, _, err := d.getQGroup(path)
 
-	// Forward any output on stdout.
-	chStdoutPipe := make(chan error, 1)
-	go func() {
-		_, err := io.Copy(conn, stdoutPipe)
-		chStdoutPipe <- err
-		_ = conn.Close()
-		_ = cmd.Process.Kill() // This closes stderr.
-	}()
+	return qgroup, err
+}
 
-	// Run the command.
-	err = cmd.Start()
-	if err != nil {
-		return err
+// ensureQGroup creates the qgroup of the subvolume at path if quotas are enabled and it doesn't have one.
+func (d *btrfs) ensureQGroup(path string) error {
+	_, _, err := d.getQGroup(path)
+	if err == errBtrfsNoQuota {
+		return nil
 	}
 
-	// Read any error.
-	output, err := io.ReadAll(stderr)
-	if err != nil {
-		logger.Errorf("Problem reading btrfs send stderr: %s", err)
+	if err == errBtrfsNoQGroup {
+		_, err = d.createQGroup(path)
 	}
 
-	// Handle errors.
-	errs := []error{}
-	chStdoutPipeErr := <-chStdoutPipe
+	return err
+}
 
-	err = cmd.Wait()
+// btrfsSubVolumeQGroupUsage returns the space referenced by the subvolume and the space exclusively owned by it.
+func btrfsSubVolumeQGroupUsage(path string) (int64, int64, error) {
+	output, err := shared.RunCommand("btrfs", "qgroup", "show", "-e", "-f", "--raw", path)
 	if err != nil {
-		errs = append(errs, err)
-
-		if chStdoutPipeErr != nil {
-			errs = append(errs, chStdoutPipeErr)
-		}
+		return -1, -1, btrfsQGroupShowError(path, err)
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("Btrfs send failed: %v (%s)", errs, string(output))
+	return parseQGroupUsage(output)
+}
+
+// btrfsQGroupShowError returns errBtrfsNoQuota if the "btrfs qgroup show" error is due to quotas being disabled on
+// the filesystem and wraps any other error.
+func btrfsQGroupShowError(path string, err error) error {
+	if strings.Contains(strings.ToLower(err.Error()), "quotas not enabled") {
+		return errBtrfsNoQuota
 	}
 
-	return nil
+	return fmt.Errorf("Failed getting qgroups of %q: %w", path, err)
 }
 
-// setSubvolumeReadonlyProperty sets the readonly property on the subvolume to true or false.
-func (d *btrfs) setSubvolumeReadonlyProperty(path string, readonly bool) error {
-	// Silently ignore requests to set subvolume readonly property if running in a user namespace as we won't
-	// be able to change it if it is readonly already, and making it readonly will mean we cannot undo it.
-	if d.state.OS.RunningInUserNS {
-		return nil
+// btrfsStraySubvolumes returns the subvolumes (relative to the pool mount path) which aren't one of the managed
+// volumes, within one (such as subvolumes created by the workload of an instance) or containing one (such as
+// the snapshot directory of a volume), sorted by path. The base directories of the volume types aren't reported.
+// The paths are those of the given pool layout.
+func btrfsStraySubvolumes(subvols []string, managed []string, layout string, volTypes []VolumeType) []string {
+	managedPaths := make([]string, 0, len(managed))
+	expected := make(map[string]bool, len(managed))
+	for _, path := range managed {
+		path = filepath.Clean(path)
+		managedPaths = append(managedPaths, path)
+		expected[path] = true
 	}
 
-	args := []string{"property", "set"}
-	if btrfsPropertyForce {
-		args = append(args, "-f")
+	for _, volType := range volTypes {
+		for _, dir := range BaseDirectories[volType] {
+			expected[dir] = true
+		}
 	}
 
-	args = append(args, "-ts", path, "ro", fmt.Sprintf("%t", readonly))
+	stray := []string{}
+	for _, subvol := range subvols {
+		subvol = filepath.Clean(subvol)
+		if expected[subvol] {
+			continue
+		}
 
-	_, err := shared.RunCommand("btrfs", args...)
+		// The snapshots of paths within volumes are managed along with their volume.
+		if btrfsIsPathSnapshotOfManaged(subvol, expected, layout, volTypes) {
+			continue
+		}
+
+		related := false
+		for _, path := range managedPaths {
+			if strings.HasPrefix(subvol, path+"/") || strings.HasPrefix(path, subvol+"/") {
+				related = true
+				break
+			}
+		}
+
+		if !related {
+			stray = append(stray, subvol)
+		}
+	}
+
+	sort.Strings(stray)
+
+	return stray
+}
+
+// btrfsRepairReadonly makes the subvolumes at paths which isRo reports as writable read-only with makeRo.
+// Missing paths are skipped. It returns the paths it corrected, even if it failed on a later one.
+func btrfsRepairReadonly(paths []string, isRo func(path string) bool, makeRo func(path string) error) ([]string, error) {
+	repaired := []string{}
+	for _, path := range paths {
+		if !shared.PathExists(path) || isRo(path) {
+			continue
+		}
+
+		err := makeRo(path)
+		if err != nil {
+			return repaired, fmt.Errorf("Failed making subvolume %q read-only: %w", path, err)
+		}
+
+		repaired = append(repaired, path)
+	}
+
+	return repaired, nil
+}
+
+// btrfsVolumesSubvolumePaths returns the paths of the subvolumes of the supplied volumes, including the filesystem
+// volume of VM block volumes.
+func btrfsVolumesSubvolumePaths(vols []Volume) []string {
+	paths := make([]string, 0, len(vols))
+	for _, vol := range vols {
+		paths = append(paths, vol.MountPath())
+
+		if vol.IsVMBlock() {
+			paths = append(paths, vol.NewVMBlockFilesystemVolume().MountPath())
+		}
+	}
+
+	return paths
+}
+
+// btrfsReadonlyHealthIssues returns an issue for each of the existing subvolumes at paths which isRo reports as
+// writable, relPath giving their path relative to the pool.
+func btrfsReadonlyHealthIssues(paths []string, relPath func(path string) (string, error), isRo func(path string) bool) []PoolHealthIssue {
+	issues := []PoolHealthIssue{}
+	for _, path := range paths {
+		if !shared.PathExists(path) || isRo(path) {
+			continue
+		}
+
+		poolPath, err := relPath(path)
+		if err != nil {
+			poolPath = path
+		}
+
+		issues = append(issues, PoolHealthIssue{
+			Check:          HealthCheckReadonly,
+			Path:           poolPath,
+			Message:        fmt.Sprintf("Subvolume %q is writable but is expected to be read-only", poolPath),
+			Recommendation: fmt.Sprintf("Find out what made it writable and make it read-only again with \"btrfs property set %s ro true\"", path),
+		})
+	}
+
+	return issues
+}
+
+// btrfsReadonlyIssuesRepaired updates the issues of the subvolumes whose path relative to the pool is in repaired
+// to report that they have been made read-only again.
+func btrfsReadonlyIssuesRepaired(issues []PoolHealthIssue, repaired []string) {
+	for i := range issues {
+		if !shared.StringInSlice(issues[i].Path, repaired) {
+			continue
+		}
+
+		issues[i].Message = fmt.Sprintf("Subvolume %q was writable and has been made read-only again", issues[i].Path)
+		issues[i].Recommendation = "Find out what made it writable"
+	}
+}
+
+// btrfsSnapshotsReclaimableSpace returns the exclusive space of each of the volume's snapshots, using usage to
+// get the referenced and exclusive space of a subvolume. The report notes when quotas are disabled.
+func btrfsSnapshotsReclaimableSpace(vol Volume, snapshots []string, usage func(path string) (int64, int64, error)) (*ReclaimableSpaceReport, error) {
+	report := &ReclaimableSpaceReport{Method: ReclaimableMethodExclusive, Snapshots: make([]SnapshotReclaimableSpace, 0, len(snapshots))}
+
+	for _, snapName := range snapshots {
+		snapVol, err := vol.NewSnapshot(snapName)
+		if err != nil {
+			return nil, err
+		}
+
+		_, exclusive, err := usage(snapVol.MountPath())
+		if err != nil {
+			if err == errBtrfsNoQuota {
+				return &ReclaimableSpaceReport{Unavailable: "Quotas are disabled on the pool", Snapshots: []SnapshotReclaimableSpace{}}, nil
+			}
+
+			return nil, fmt.Errorf("Failed getting usage of snapshot %q: %w", snapVol.name, err)
+		}
+
+		report.Snapshots = append(report.Snapshots, SnapshotReclaimableSpace{Name: snapName, Reclaimable: exclusive})
+	}
+
+	SortReclaimableSpace(report.Snapshots)
+
+	return report, nil
+}
+
+// parseQGroupUsage parses the output of "btrfs qgroup show -e -f --raw" and returns the referenced and
+// exclusive bytes of the subvolume's qgroup.
+func parseQGroupUsage(output string) (int64, int64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || strings.HasPrefix(line, "qgroupid") || strings.HasPrefix(line, "---") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+
+		referenced, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Failed parsing referenced size %q: %w", fields[1], err)
+		}
+
+		exclusive, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Failed parsing exclusive size %q: %w", fields[2], err)
+		}
+
+		return referenced, exclusive, nil
+	}
+
+	return -1, -1, errBtrfsNoQGroup
+}
+
+// btrfsSnapshotUsage splits the space referenced by a snapshot into the part shared with other subvolumes
+// and the part exclusively owned by the snapshot.
+func btrfsSnapshotUsage(referenced int64, exclusive int64) *api.StorageVolumeSnapshotUsage {
+	sharedSize := referenced - exclusive
+	if sharedSize < 0 {
+		// Qgroup accounting can be briefly inconsistent after a rescan.
+		sharedSize = 0
+	}
+
+	return &api.StorageVolumeSnapshotUsage{
+		Shared:    sharedSize,
+		Exclusive: exclusive,
+	}
+}
+
+// btrfsQGroupUsage represents the space referenced by a subvolume and the part of it exclusively owned by it.
+type btrfsQGroupUsage struct {
+	Referenced int64
+	Exclusive  int64
+}
+
+// btrfsSharingMethod describes how btrfsEstimateSharing computes its estimate.
+const btrfsSharingMethod = "Estimate based on btrfs qgroups: the space shared by each volume (referenced minus exclusive) is assumed to be the same data shared by all of them (e.g. a common base image), so it is counted once"
+
+// btrfsEstimateSharing estimates the physical space used by a set of subvolumes and the space saved by sharing.
+// Qgroups only tell how much of each subvolume is shared, not with which subvolumes, so the physical space is
+// estimated as the sum of the exclusive space plus the largest shared space. This is exact when all subvolumes
+// share the same data and overestimates the savings otherwise.
+func btrfsEstimateSharing(usages []btrfsQGroupUsage) *SpaceSharingEstimate {
+	estimate := &SpaceSharingEstimate{Method: btrfsSharingMethod}
+
+	var maxShared int64
+	for _, usage := range usages {
+		usageShared := usage.Referenced - usage.Exclusive
+		if usageShared < 0 {
+			usageShared = 0
+		}
+
+		if usageShared > maxShared {
+			maxShared = usageShared
+		}
+
+		estimate.Referenced += usage.Referenced
+		estimate.Physical += usage.Exclusive
+	}
+
+	estimate.Physical += maxShared
+	estimate.Savings = estimate.Referenced - estimate.Physical
+	if estimate.Savings < 0 {
+		estimate.Savings = 0
+	}
+
+	return estimate
+}
+
+// btrfsSnapshotTx creates a snapshot subvolume and runs the steps completing it, removing the snapshot if any
+// of them fails so that no orphaned subvolume is left behind.
+// If the snapshot already exists (such as when retrying after an ambiguous failure) and matches reports it as
+// an up to date snapshot of the expected source, it isn't created again and only the steps are run, without
+// removing it on failure as it wasn't created by this transaction. A snapshot which doesn't match is a leftover
+// (of another source, or taken before the source changed) and is deleted and created again.
+type btrfsSnapshotTx struct {
+	path    string
+	create  func(path string) error
+	delete  func(path string) error
+	matches func(path string) (bool, error)
+}
+
+// run creates the snapshot and then runs the steps in order.
+func (tx btrfsSnapshotTx) run(steps ...func() error) error {
+	revert := revert.New()
+	defer revert.Fail()
+
+	match := false
+	if tx.matches != nil && shared.PathExists(tx.path) {
+		var err error
+		match, err = tx.matches(tx.path)
+		if err != nil {
+			return fmt.Errorf("Failed checking existing snapshot %q: %w", tx.path, err)
+		}
+
+		if !match {
+			err = tx.cleanup()
+			if err != nil {
+				return fmt.Errorf("Failed removing leftover snapshot: %w", err)
+			}
+		}
+	}
+
+	if !match {
+		// Registered before creating the snapshot to also clean up after a partially failed creation.
+		revert.Add(func() { _ = tx.cleanup() })
+
+		err := tx.create(tx.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, step := range steps {
+		err := step()
+		if err != nil {
+			return err
+		}
+	}
+
+	revert.Success()
+	return nil
+}
+
+// cleanup removes the snapshot if it exists, so calling it more than once is safe.
+func (tx btrfsSnapshotTx) cleanup() error {
+	if !shared.PathExists(tx.path) {
+		return nil
+	}
+
+	err := tx.delete(tx.path)
+	if err != nil {
+		return fmt.Errorf("Failed deleting snapshot %q: %w", tx.path, err)
+	}
+
+	return nil
+}
+
+// Sync levels of the "btrfs.snapshot_sync" volume option.
+const (
+	btrfsSnapshotSyncNone     = "none"
+	btrfsSnapshotSyncMetadata = "metadata"
+	btrfsSnapshotSyncFull     = "full"
+)
+
+// btrfsSyncOps are the operations syncing a btrfs filesystem, around the creation of snapshots or to quiesce it.
+type btrfsSyncOps struct {
+	// syncFS flushes the dirty data and metadata of the filesystem to disk.
+	syncFS func(path string) error
+
+	// freeze and thaw suspend and resume the writes to the filesystem.
+	freeze func(path string) error
+	thaw   func(path string) error
+
+	// commit commits the current transaction of the filesystem.
+	commit func(path string) error
+}
+
+// btrfsHostSyncOps syncs the filesystems of the host.
+var btrfsHostSyncOps = btrfsSyncOps{
+	syncFS: filesystem.SyncFS,
+	freeze: func(path string) error {
+		_, err := shared.RunCommand("fsfreeze", "--freeze", path)
+		return err
+	},
+	thaw: func(path string) error {
+		_, err := shared.RunCommand("fsfreeze", "--unfreeze", path)
+		return err
+	},
+	commit: func(path string) error {
+		_, err := runBtrfsCommand("filesystem", "sync", path)
+		return err
+	},
+}
+
+// beforeSnapshot runs the sync operations of the level due before creating a snapshot on the filesystem mounted
+// at poolPath. The levels are:
+//   - "none" (the default) doesn't sync, the changes made to the snapshot once created (such as making it and its
+//     nested subvolumes read-only) reach the disk with the next background commit of btrfs.
+//   - "metadata" commits the transaction once the snapshot is set up, so that it's on disk as set up once created.
+//   - "full" also flushes all the data of the filesystem to disk before creating the snapshot, with syncfs and by
+//     freezing it to bring it to a consistent state. The filesystem is thawed before creating the snapshot as the
+//     creation would block on a frozen filesystem.
+func (ops btrfsSyncOps) beforeSnapshot(level string, poolPath string) error {
+	if level != btrfsSnapshotSyncFull {
+		return nil
+	}
+
+	err := ops.syncFS(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed syncing filesystem %q: %w", poolPath, err)
+	}
+
+	err = ops.freeze(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed freezing filesystem %q: %w", poolPath, err)
+	}
+
+	err = ops.thaw(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed thawing filesystem %q: %w", poolPath, err)
+	}
+
+	return nil
+}
+
+// afterSnapshot runs the sync operations of the level due once a snapshot is created on the filesystem mounted
+// at poolPath (see beforeSnapshot).
+func (ops btrfsSyncOps) afterSnapshot(level string, poolPath string) error {
+	if level != btrfsSnapshotSyncMetadata && level != btrfsSnapshotSyncFull {
+		return nil
+	}
+
+	err := ops.commit(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed committing filesystem %q: %w", poolPath, err)
+	}
+
+	return nil
+}
+
+// quiesce brings the filesystem mounted at poolPath to a consistent state on disk: its dirty data is flushed with
+// syncfs and its current transaction committed, so that the pending deletions and snapshots are on disk too. It is
+// then frozen if freeze is set, until thawed.
+func (ops btrfsSyncOps) quiesce(poolPath string, freeze bool) error {
+	err := ops.syncFS(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed syncing filesystem %q: %w", poolPath, err)
+	}
+
+	err = ops.commit(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed committing filesystem %q: %w", poolPath, err)
+	}
+
+	if !freeze {
+		return nil
+	}
+
+	err = ops.freeze(poolPath)
+	if err != nil {
+		return fmt.Errorf("Failed freezing filesystem %q: %w", poolPath, err)
+	}
+
+	return nil
+}
+
+// sendSubvolume sends the subvolume at path (relative to parent if set) to conn, logging to l.
+func (d *btrfs) sendSubvolume(path string, parent string, conn io.ReadWriteCloser, tracker *ioprogress.ProgressTracker, limiter *ioprogress.RateLimiter, l logger.Logger) error {
+	// Assemble btrfs send command.
+	args := []string{"send"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+
+	args = append(args, path)
+	cmd := exec.Command("btrfs", args...)
+
+	// Prepare stdout/stderr.
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	// Setup progress tracker.
+	stdoutPipe := stdout
+	if tracker != nil {
+		stdoutPipe = &ioprogress.ProgressReader{
+			ReadCloser: stdout,
+			Tracker:    tracker,
+		}
+	}
+
+	// Throttle the stream if requested.
+	if limiter != nil {
+		stdoutPipe = &ioprogress.RateLimitedReader{
+			ReadCloser: stdoutPipe,
+			Limiter:    limiter,
+		}
+	}
+
+	// Forward any output on stdout.
+	chStdoutPipe := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, stdoutPipe)
+		chStdoutPipe <- err
+		_ = conn.Close()
+		_ = cmd.Process.Kill() // This closes stderr.
+	}()
+
+	// Run the command.
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Read any error.
+	output, err := io.ReadAll(stderr)
+	if err != nil {
+		l.Error("Failed reading btrfs send stderr", logger.Ctx{"err": err})
+	}
+
+	// Handle errors.
+	errs := []error{}
+	chStdoutPipeErr := <-chStdoutPipe
+
+	err = cmd.Wait()
+	if err != nil {
+		errs = append(errs, err)
+
+		if chStdoutPipeErr != nil {
+			errs = append(errs, chStdoutPipeErr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Btrfs send failed: %v (%s)", errs, string(output))
+	}
+
+	return nil
+}
+
+// btrfsOverlayDir is the directory of the container volumes created with "btrfs.overlay" holding the read-only
+// snapshot of their image used as base and the directories of the writable overlay mounted on their rootfs.
+const btrfsOverlayDir = ".overlay"
+
+// btrfsOverlayPaths returns the paths of the base subvolume and of the upper and work directories of the overlay
+// of the volume at volPath.
+func btrfsOverlayPaths(volPath string) (base string, upper string, work string) {
+	overlayPath := filepath.Join(volPath, btrfsOverlayDir)
+	return filepath.Join(overlayPath, "base"), filepath.Join(overlayPath, "upper"), filepath.Join(overlayPath, "work")
+}
+
+// btrfsIsOverlayVolume returns whether the rootfs of the volume at volPath is an overlay on a read-only base.
+func btrfsIsOverlayVolume(volPath string) bool {
+	return shared.PathExists(filepath.Join(volPath, btrfsOverlayDir))
+}
+
+// btrfsCheckNotOverlay returns an error if the rootfs of the volume at volPath is an overlay. The data of such
+// volumes is split between their base subvolume and their upper directory and their rootfs is only populated while
+// mounted, so reading their subvolume directly, as snapshots, backups, copies and migrations do, would miss it.
+func btrfsCheckNotOverlay(volPath string, action string) error {
+	if btrfsIsOverlayVolume(volPath) {
+		return fmt.Errorf("Cannot %s a volume whose rootfs is an overlay (%q is set)", action, "btrfs.overlay")
+	}
+
+	return nil
+}
+
+// btrfsCreateOverlayDirs creates the upper and work directories of the overlay of the volume at volPath once its
+// base is in place, as well as the rootfs directory the overlay is mounted on. The upper directory takes the
+// ownership and mode of the rootfs of the base as they are those of the root of the overlay.
+func btrfsCreateOverlayDirs(volPath string) error {
+	base, upper, work := btrfsOverlayPaths(volPath)
+
+	info, err := os.Stat(filepath.Join(base, "rootfs"))
+	if err != nil {
+		return fmt.Errorf("Failed getting rootfs of overlay base %q: %w", base, err)
+	}
+
+	mode, uid, gid := shared.GetOwnerMode(info)
+	for _, path := range []string{upper, work, filepath.Join(volPath, "rootfs")} {
+		err = os.Mkdir(path, 0700)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Failed creating overlay directory %q: %w", path, err)
+		}
+	}
+
+	for _, path := range []string{upper, filepath.Join(volPath, "rootfs")} {
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return fmt.Errorf("Failed setting ownership of %q: %w", path, err)
+		}
+
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return fmt.Errorf("Failed setting mode of %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// btrfsMountOverlay mounts the writable overlay of the volume at volPath on its rootfs directory unless already
+// mounted. Returns true if it was mounted.
+func btrfsMountOverlay(volPath string) (bool, error) {
+	rootfsPath := filepath.Join(volPath, "rootfs")
+	if filesystem.IsMountPoint(rootfsPath) {
+		return false, nil
+	}
+
+	base, upper, work := btrfsOverlayPaths(volPath)
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", filepath.Join(base, "rootfs"), upper, work)
+	err := unix.Mount("overlay", rootfsPath, "overlay", 0, options)
+	if err != nil {
+		return false, fmt.Errorf("Failed mounting overlay on %q: %w", rootfsPath, err)
+	}
+
+	return true, nil
+}
+
+// btrfsUnmountOverlay unmounts the writable overlay of the volume at volPath. Returns true if it was mounted.
+func btrfsUnmountOverlay(volPath string) (bool, error) {
+	return forceUnmount(filepath.Join(volPath, "rootfs"))
+}
+
+// setSubvolumeReadonlyProperty sets the readonly property on the subvolume to true or false.
+func (d *btrfs) setSubvolumeReadonlyProperty(path string, readonly bool) error {
+	// Silently ignore requests to set subvolume readonly property if running in a user namespace as we won't
+	// be able to change it if it is readonly already, and making it readonly will mean we cannot undo it.
+	if d.state.OS.RunningInUserNS {
+		return nil
+	}
+
+	args := []string{"property", "set"}
+	if btrfsPropertyForce {
+		args = append(args, "-f")
+	}
+
+	args = append(args, "-ts", path, "ro", fmt.Sprintf("%t", readonly))
+
+	_, err := shared.RunCommand("btrfs", args...)
+	return err
+}
+
+// BTRFSSubVolume is the structure used to store information about a subvolume.
+// Note: This is used by both migration and backup subsystems so do not modify without considering both!
+type BTRFSSubVolume struct {
+	Path     string `json:"path" yaml:"path"`         // Path inside the volume where the subvolume belongs (so / is the top of the volume tree).
+	Snapshot string `json:"snapshot" yaml:"snapshot"` // Snapshot name the subvolume belongs to.
+	Readonly bool   `json:"readonly" yaml:"readonly"` // Is the sub volume read only or not.
+	UUID     string `json:"uuid" yaml:"uuid"`         // The subvolume UUID.
+
+	// UUID carried by a send stream of the subvolume, which is its received UUID if it was itself received and
+	// its UUID otherwise. Empty if unknown.
+	SentUUID string `json:"sent_uuid,omitempty" yaml:"sent_uuid,omitempty"`
+}
+
+// getSubvolumesMetaData retrieves subvolume meta data with paths relative to the root volume.
+// The first item in the returned list is the root subvolume itself.
+func (d *btrfs) getSubvolumesMetaData(vol Volume) ([]BTRFSSubVolume, error) {
+	var subVols []BTRFSSubVolume
+
+	snapName := ""
+	if vol.IsSnapshot() {
+		_, snapName, _ = api.GetParentAndSnapshotName(vol.name)
+	}
+
+	// Add main root volume to subvolumes list first.
+	subVols = append(subVols, BTRFSSubVolume{
+		Snapshot: snapName,
+		Path:     string(filepath.Separator),
+		Readonly: BTRFSSubVolumeIsRo(vol.MountPath()),
+	})
+
+	// Find any subvolumes in volume.
+	subVolPaths, err := d.getSubvolumes(vol.MountPath())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(subVolPaths)
+
+	// Add any subvolumes under the root subvolume with relative path to root.
+	for _, subVolPath := range subVolPaths {
+		subVols = append(subVols, BTRFSSubVolume{
+			Snapshot: snapName,
+			Path:     fmt.Sprintf("%s%s", string(filepath.Separator), subVolPath),
+			Readonly: BTRFSSubVolumeIsRo(filepath.Join(vol.MountPath(), subVolPath)),
+		})
+	}
+
+	stdout := strings.Builder{}
+
+	if !d.state.OS.RunningInUserNS {
+		// List all subvolumes in the given filesystem with their UUIDs and received UUIDs.
+		err = shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", "-u", "-R", d.PoolAbsPath(""))
+		if err != nil {
+			return nil, err
+		}
+
+		uuidMap := make(map[string]string)
+		receivedUUIDMap := make(map[string]string)
+
+		scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) != 13 {
+				continue
+			}
+
+			uuidMap[d.PoolAbsPath(fields[12])] = fields[10]
+
+			if fields[8] != "-" {
+				receivedUUIDMap[d.PoolAbsPath(fields[12])] = fields[8]
+			}
+		}
+
+		for i, subVol := range subVols {
+			subVolPath := filepath.Join(vol.MountPath(), subVol.Path)
+			subVols[i].UUID = uuidMap[subVolPath]
+			subVols[i].SentUUID = subVols[i].UUID
+
+			receivedUUID, ok := receivedUUIDMap[subVolPath]
+			if ok {
+				subVols[i].SentUUID = receivedUUID
+			}
+		}
+	}
+
+	return subVols, nil
+}
+
+func (d *btrfs) getSubVolumeReceivedUUID(vol Volume) (string, error) {
+	stdout := strings.Builder{}
+
+	// List all subvolumes in the given filesystem with their UUIDs.
+	err := shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", "-R", d.PoolAbsPath(""))
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 11 {
+			continue
+		}
+
+		if vol.MountPath() == d.PoolAbsPath(fields[10]) && fields[8] != "-" {
+			return fields[8], nil
+		}
+	}
+
+	return "", nil
+}
+
+// btrfsVerifyReceivedUUID checks that the received UUID of the subvolume received at path is the UUID carried by
+// the send stream of subVol, as announced by the sender in its migration header, confirming that the intended
+// source was received. Nothing is checked if the sender didn't announce it.
+func btrfsVerifyReceivedUUID(subVol BTRFSSubVolume, path string, receivedUUID string) error {
+	if subVol.SentUUID == "" || receivedUUID == subVol.SentUUID {
+		return nil
+	}
+
+	return fmt.Errorf("Subvolume %q received for %q has received UUID %q instead of %q: %w", path, subVol.Path, receivedUUID, subVol.SentUUID, ErrReceivedUUIDMismatch)
+}
+
+// btrfsIsSnapshotOf returns whether the subvolume at snapPath is a snapshot of the subvolume at srcPath, that is
+// whether its parent UUID is the UUID of the source.
+func btrfsIsSnapshotOf(snapPath string, srcPath string) (bool, error) {
+	output, err := shared.RunCommand("btrfs", "subvolume", "show", srcPath)
+	if err != nil {
+		return false, btrfsSubVolumeError(srcPath, err)
+	}
+
+	srcUUID, _ := parseBtrfsSubVolumeShowUUIDs(output)
+
+	output, err = shared.RunCommand("btrfs", "subvolume", "show", snapPath)
+	if err != nil {
+		return false, btrfsSubVolumeError(snapPath, err)
+	}
+
+	_, parentUUID := parseBtrfsSubVolumeShowUUIDs(output)
+
+	return srcUUID != "" && parentUUID == srcUUID, nil
+}
+
+// btrfsIsCurrentSnapshotOf returns whether the subvolume at snapPath is a snapshot of the subvolume at srcPath
+// taken from its current state, the source not having been modified since.
+func btrfsIsCurrentSnapshotOf(snapPath string, srcPath string) (bool, error) {
+	srcOutput, err := shared.RunCommand("btrfs", "subvolume", "show", srcPath)
+	if err != nil {
+		return false, btrfsSubVolumeError(srcPath, err)
+	}
+
+	snapOutput, err := shared.RunCommand("btrfs", "subvolume", "show", snapPath)
+	if err != nil {
+		return false, btrfsSubVolumeError(snapPath, err)
+	}
+
+	return btrfsSnapshotMatches(srcOutput, snapOutput)
+}
+
+// btrfsSnapshotMatches compares the "btrfs subvolume show" outputs of a source subvolume and of a snapshot and
+// returns whether the snapshot was taken from the source and the source wasn't modified since, its generation
+// (last transaction modifying it) being at most the generation the snapshot was created at.
+func btrfsSnapshotMatches(srcOutput string, snapOutput string) (bool, error) {
+	srcUUID, _ := parseBtrfsSubVolumeShowUUIDs(srcOutput)
+	_, parentUUID := parseBtrfsSubVolumeShowUUIDs(snapOutput)
+	if srcUUID == "" || parentUUID != srcUUID {
+		return false, nil
+	}
+
+	srcGeneration, err := parseBtrfsSubVolumeShowGeneration(srcOutput)
+	if err != nil {
+		return false, err
+	}
+
+	snapCreation, err := parseBtrfsSubVolumeShowField(snapOutput, "Gen at creation")
+	if err != nil {
+		return false, err
+	}
+
+	return srcGeneration <= snapCreation, nil
+}
+
+// parseBtrfsSubVolumeShowUUIDs parses the output of "btrfs subvolume show" and returns the UUID and parent UUID
+// of the subvolume, the parent UUID being empty if it isn't a snapshot.
+func parseBtrfsSubVolumeShowUUIDs(output string) (string, string) {
+	var subvolUUID, parentUUID string
+
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "-" {
+			value = ""
+		}
+
+		switch key {
+		case "UUID":
+			subvolUUID = value
+		case "Parent UUID":
+			parentUUID = value
+		}
+	}
+
+	return subvolUUID, parentUUID
+}
+
+// btrfsSubVolumeGeneration returns the generation of the subvolume, that is the ID of the last transaction which
+// modified it. It only increases, once the changes are committed, so comparing it over time tells whether the
+// subvolume changed without scanning it.
+func btrfsSubVolumeGeneration(subvol string) (uint64, error) {
+	output, err := shared.RunCommand("btrfs", "subvolume", "show", subvol)
+	if err != nil {
+		return 0, btrfsSubVolumeError(subvol, err)
+	}
+
+	return parseBtrfsSubVolumeShowGeneration(output)
+}
+
+// parseBtrfsSubVolumeShowGeneration parses the output of "btrfs subvolume show" and returns the generation of the
+// subvolume.
+func parseBtrfsSubVolumeShowGeneration(output string) (uint64, error) {
+	return parseBtrfsSubVolumeShowField(output, "Generation")
+}
+
+// parseBtrfsSubVolumeShowField parses the output of "btrfs subvolume show" and returns the numeric field key, such
+// as "Generation" or "Gen at creation".
+func parseBtrfsSubVolumeShowField(output string, key string) (uint64, error) {
+	for _, line := range strings.Split(output, "\n") {
+		lineKey, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found || lineKey != key {
+			continue
+		}
+
+		number, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Failed parsing subvolume %s %q: %w", strings.ToLower(key), value, err)
+		}
+
+		return number, nil
+	}
+
+	return 0, fmt.Errorf("Failed finding subvolume %s", strings.ToLower(key))
+}
+
+// btrfsSubVolumeCreationTime returns the time the subvolume was created at, as recorded in its root item.
+func btrfsSubVolumeCreationTime(run btrfsCommandFunc, subvol string) (time.Time, error) {
+	output, err := run("subvolume", "show", subvol)
+	if err != nil {
+		return time.Time{}, btrfsSubVolumeError(subvol, err)
+	}
+
+	return parseBtrfsSubVolumeShowCreationTime(output)
+}
+
+// parseBtrfsSubVolumeShowCreationTime parses the output of "btrfs subvolume show" and returns the creation time
+// of the subvolume, zero if it isn't recorded.
+func parseBtrfsSubVolumeShowCreationTime(output string) (time.Time, error) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found || key != "Creation time" {
+			continue
+		}
+
+		// Subvolumes created by old kernels have no creation time.
+		value = strings.TrimSpace(value)
+		if value == "-" {
+			return time.Time{}, nil
+		}
+
+		creationTime, err := time.Parse("2006-01-02 15:04:05 -0700", value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Failed parsing subvolume creation time %q: %w", value, err)
+		}
+
+		return creationTime, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Failed finding subvolume creation time")
+}
+
+// btrfsTopLevelSubVolumeID is the ID of the top-level subvolume (FS_TREE) of a btrfs filesystem.
+const btrfsTopLevelSubVolumeID = uint64(5)
+
+// btrfsGetDefaultSubVolume returns the ID of the default subvolume of the filesystem mounted at poolMount.
+// This is the subvolume mounted when no subvol or subvolid option is provided.
+func btrfsGetDefaultSubVolume(poolMount string) (uint64, error) {
+	output, err := shared.RunCommand("btrfs", "subvolume", "get-default", poolMount)
+	if err != nil {
+		return 0, fmt.Errorf("Failed getting default subvolume of %q: %w", poolMount, err)
+	}
+
+	return parseBtrfsDefaultSubVolume(output)
+}
+
+// btrfsSetDefaultSubVolume sets the subvolume with the given ID as the default subvolume of the filesystem mounted
+// at poolMount.
+func btrfsSetDefaultSubVolume(poolMount string, id uint64) error {
+	_, err := shared.RunCommand("btrfs", "subvolume", "set-default", strconv.FormatUint(id, 10), poolMount)
+	if err != nil {
+		return fmt.Errorf("Failed setting default subvolume of %q to %d: %w", poolMount, id, err)
+	}
+
+	return nil
+}
+
+// parseBtrfsDefaultSubVolume parses the subvolume ID from the output of "btrfs subvolume get-default", such as
+// "ID 5 (FS_TREE)" or "ID 256 gen 8 top level 5 path data".
+func parseBtrfsDefaultSubVolume(output string) (uint64, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 2 || fields[0] != "ID" {
+		return 0, fmt.Errorf("Unexpected default subvolume output %q", strings.TrimSpace(output))
+	}
+
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid default subvolume ID %q: %w", fields[1], err)
+	}
+
+	return id, nil
+}
+
+// expectedDefaultSubVolume returns the default subvolume ID recorded when the filesystem was created and whether
+// one was recorded. It isn't for the pools created before it was recorded, whose default subvolume (possibly chosen
+// by an administrator) is what has been mounted all along and is unknown.
+func (d *btrfs) expectedDefaultSubVolume() (uint64, bool, error) {
+	if d.config["volatile.btrfs.default_subvolume"] == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseUint(d.config["volatile.btrfs.default_subvolume"], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid recorded default subvolume %q: %w", d.config["volatile.btrfs.default_subvolume"], err)
+	}
+
+	return id, true, nil
+}
+
+// restoreDefaultSubVolume checks the default subvolume of the filesystem mounted at mntDst and restores the
+// recorded one if it was changed outside of LXD. It returns whether it was restored, in which case the wrong
+// subvolume is mounted at mntDst and the pool needs to be mounted again. Nothing is done for a pool which has no
+// recorded default subvolume.
+func (d *btrfs) restoreDefaultSubVolume(mntDst string) (bool, error) {
+	expected, recorded, err := d.expectedDefaultSubVolume()
+	if err != nil || !recorded {
+		return false, err
+	}
+
+	current, err := btrfsGetDefaultSubVolume(mntDst)
+	if err != nil {
+		return false, err
+	}
+
+	if current == expected {
+		return false, nil
+	}
+
+	d.logger.Warn("Restoring default subvolume changed outside of LXD", logger.Ctx{"current": current, "expected": expected})
+
+	err = btrfsSetDefaultSubVolume(mntDst, expected)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// applyReadAhead sets the read-ahead configured by readahead_kb on the block devices backing the pool.
+// Failures are only logged as they shouldn't prevent the pool from being used.
+func (d *btrfs) applyReadAhead() {
+	if d.config["readahead_kb"] == "" || d.state.OS.RunningInUserNS {
+		return
+	}
+
+	readAheadKB, err := strconv.ParseUint(d.config["readahead_kb"], 10, 32)
+	if err != nil {
+		d.logger.Warn("Invalid readahead_kb", logger.Ctx{"value": d.config["readahead_kb"], "err": err})
+		return
+	}
+
+	output, err := shared.RunCommand("btrfs", "filesystem", "show", GetPoolMountPath(d.name))
+	if err != nil {
+		d.logger.Warn("Failed listing pool devices for read-ahead", logger.Ctx{"err": err})
+		return
+	}
+
+	for _, devPath := range btrfsFilesystemDevices(output) {
+		sysPath, err := blockDevSysPath(devPath)
+		if err != nil {
+			// Skip anything which isn't backed by a block device.
+			if !errors.Is(err, ErrNotSupported) {
+				d.logger.Warn("Failed resolving pool device for read-ahead", logger.Ctx{"dev": devPath, "err": err})
+			}
+
+			continue
+		}
+
+		err = setBlockDevReadAhead(sysPath, readAheadKB)
+		if err != nil {
+			d.logger.Warn("Failed setting read-ahead", logger.Ctx{"dev": devPath, "err": err})
+			continue
+		}
+
+		d.logger.Debug("Set read-ahead", logger.Ctx{"dev": devPath, "readahead_kb": readAheadKB})
+	}
+}
+
+// btrfsFilesystemDevices returns the device paths listed in the output of "btrfs filesystem show".
+func btrfsFilesystemDevices(output string) []string {
+	devices := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 2 || fields[0] != "devid" || fields[len(fields)-2] != "path" {
+			continue
+		}
+
+		devices = append(devices, fields[len(fields)-1])
+	}
+
+	return devices
+}
+
+// btrfsDataChunkSize is the usual size of a btrfs data chunk, the unit relocated by a balance.
+const btrfsDataChunkSize = 1024 * 1024 * 1024
+
+// btrfsDevice represents a device of a btrfs filesystem and its allocated space.
+type btrfsDevice struct {
+	ID   int64
+	Path string
+	Size int64
+	Used int64
+}
+
+// getDevices returns the devices of the pool.
+func (d *btrfs) getDevices() ([]btrfsDevice, error) {
+	output, err := shared.RunCommand("btrfs", "filesystem", "show", "--raw", GetPoolMountPath(d.name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing pool devices: %w", err)
+	}
+
+	return parseBtrfsDevices(output)
+}
+
+// parseBtrfsDevices parses the devices listed in the output of "btrfs filesystem show --raw".
+func parseBtrfsDevices(output string) ([]btrfsDevice, error) {
+	devices := []btrfsDevice{}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Expect "devid <id> size <size> used <used> path <path>".
+		if len(fields) != 8 || fields[0] != "devid" || fields[2] != "size" || fields[4] != "used" || fields[6] != "path" {
+			continue
+		}
+
+		dev := btrfsDevice{Path: fields[7]}
+
+		var err error
+		for i, value := range []*int64{&dev.ID, &dev.Size, &dev.Used} {
+			*value, err = strconv.ParseInt(fields[(i*2)+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Failed parsing %s of device %q: %w", fields[i*2], dev.Path, err)
+			}
+		}
+
+		devices = append(devices, dev)
+	}
+
+	return devices, nil
+}
+
+// btrfsPoolDeviceStats returns the error counters of the devices of the filesystem mounted at poolMount.
+func btrfsPoolDeviceStats(poolMount string) ([]api.ResourcesStoragePoolDevice, error) {
+	output, err := shared.RunCommand("btrfs", "device", "stats", poolMount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting device stats of %q: %w", poolMount, err)
+	}
+
+	return parseBtrfsDeviceStats(output)
+}
+
+// parseBtrfsDeviceStats parses the output of "btrfs device stats", listing devices in the order they appear.
+func parseBtrfsDeviceStats(output string) ([]api.ResourcesStoragePoolDevice, error) {
+	devices := []api.ResourcesStoragePoolDevice{}
+	deviceIndex := map[string]int{}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Expect "[<device>].<counter> <value>".
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "[") {
+			continue
+		}
+
+		devPath, counter, found := strings.Cut(strings.TrimPrefix(fields[0], "["), "].")
+		if !found {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing %s of device %q: %w", counter, devPath, err)
+		}
+
+		i, ok := deviceIndex[devPath]
+		if !ok {
+			i = len(devices)
+			deviceIndex[devPath] = i
+			devices = append(devices, api.ResourcesStoragePoolDevice{Device: devPath})
+		}
+
+		switch counter {
+		case "read_io_errs":
+			devices[i].ReadErrors = value
+		case "write_io_errs":
+			devices[i].WriteErrors = value
+		case "flush_io_errs":
+			devices[i].FlushErrors = value
+		case "corruption_errs":
+			devices[i].CorruptionErrors = value
+		case "generation_errs":
+			devices[i].GenerationErrors = value
+		}
+	}
+
+	return devices, nil
+}
+
+// btrfsRebalanceTarget returns the most and least used devices (relative to their size) and the amount of data
+// to move from the former to the latter for both to be used evenly.
+func btrfsRebalanceTarget(devices []btrfsDevice) (btrfsDevice, btrfsDevice, int64) {
+	if len(devices) == 0 {
+		return btrfsDevice{}, btrfsDevice{}, 0
+	}
+
+	ratio := func(dev btrfsDevice) float64 {
+		if dev.Size <= 0 {
+			return 1
+		}
+
+		return float64(dev.Used) / float64(dev.Size)
+	}
+
+	from := devices[0]
+	to := devices[0]
+	for _, dev := range devices[1:] {
+		if ratio(dev) > ratio(from) {
+			from = dev
+		}
+
+		if ratio(dev) < ratio(to) {
+			to = dev
+		}
+	}
+
+	if from.Size+to.Size <= 0 {
+		return from, to, 0
+	}
+
+	// Solve (from.Used - size) / from.Size == (to.Used + size) / to.Size.
+	size := (float64(from.Used)*float64(to.Size) - float64(to.Used)*float64(from.Size)) / float64(from.Size+to.Size)
+	if size < 0 {
+		return from, to, 0
+	}
+
+	return from, to, int64(size)
+}
+
+// btrfsRebalanceCandidate is a volume which may be relocated to rebalance a pool.
+type btrfsRebalanceCandidate struct {
+	Name string
+	Size int64 // The space used by the volume (0 if unknown).
+}
+
+// btrfsRebalanceSelect returns the names of the candidates to relocate in order to move up to size bytes,
+// largest first. Candidates with an unknown size are always selected unless the pool is already balanced.
+func btrfsRebalanceSelect(candidates []btrfsRebalanceCandidate, size int64) []string {
+	sorted := append([]btrfsRebalanceCandidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+
+	selected := []string{}
+	remaining := size
+	for _, candidate := range sorted {
+		if remaining <= 0 {
+			break
+		}
+
+		if candidate.Size > remaining {
+			continue
+		}
+
+		selected = append(selected, candidate.Name)
+		remaining -= candidate.Size
+	}
+
+	return selected
+}
+
+// balance runs a balance of the pool with the supplied filters. Cancelling the context cancels the balance,
+// leaving the chunks already relocated in place.
+func (d *btrfs) balance(ctx context.Context, filters ...string) error {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	args := append([]string{"balance", "start"}, filters...)
+	args = append(args, poolMountPath)
+
+	chBalance := make(chan error, 1)
+	go func() {
+		_, err := shared.RunCommand("btrfs", args...)
+		chBalance <- err
+	}()
+
+	select {
+	case err := <-chBalance:
+		return err
+	case <-ctx.Done():
+		// Killing the btrfs command wouldn't stop the balance running in the kernel.
+		_, err := shared.RunCommand("btrfs", "balance", "cancel", poolMountPath)
+		<-chBalance
+
+		if err != nil {
+			return fmt.Errorf("Failed cancelling balance: %w", err)
+		}
+
+		return ctx.Err()
+	}
+}
+
+// relocateVolume rewrites the volume's data to newly allocated extents by sending a read-only snapshot of it
+// to a new subvolume and swapping it in. The volume must not be in use.
+func (d *btrfs) relocateVolume(ctx context.Context, vol Volume) error {
+	unlock := vol.MountLock()
+	defer unlock()
+
+	if vol.MountInUse() {
+		return ErrInUse
+	}
+
+	volPath := vol.MountPath()
+
+	subSubVols, err := d.getSubvolumes(volPath)
+	if err != nil {
+		return err
+	}
+
+	if len(subSubVols) > 0 {
+		return fmt.Errorf("Volumes with nested subvolumes cannot be relocated")
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Take a read-only snapshot to send from.
+	roPath := fmt.Sprintf("%s.rebalance-ro", volPath)
+	_, err = shared.RunCommandContext(ctx, "btrfs", "subvolume", "snapshot", "-r", volPath, roPath)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = d.deleteSubvolume(roPath, false) }()
+
+	// Receive it into a temporary directory, rewriting all of its data.
+	receivePath := fmt.Sprintf("%s.rebalance", volPath)
+	err = os.Mkdir(receivePath, 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating %q: %w", receivePath, err)
+	}
+
+	defer func() { _ = os.Remove(receivePath) }()
+
+	reader, writer := io.Pipe()
+	chSend := make(chan error, 1)
+	go func() {
+		err := shared.RunCommandWithFds(ctx, nil, writer, "btrfs", "send", roPath)
+		_ = writer.CloseWithError(err)
+		chSend <- err
+	}()
+
+	err = shared.RunCommandWithFds(ctx, reader, nil, "btrfs", "receive", "-e", receivePath)
+	_ = reader.Close()
+	sendErr := <-chSend
+
+	receivedPath := filepath.Join(receivePath, filepath.Base(roPath))
+	if shared.PathExists(receivedPath) {
+		defer func() { _ = d.deleteSubvolume(receivedPath, false) }()
+	}
+
+	if sendErr != nil {
+		return fmt.Errorf("Failed sending volume: %w", sendErr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed receiving volume: %w", err)
+	}
+
+	// Make a writable copy of the received subvolume, sharing its newly allocated extents.
+	newPath := fmt.Sprintf("%s.rebalance-new", volPath)
+	_, err = shared.RunCommandContext(ctx, "btrfs", "subvolume", "snapshot", receivedPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() { _ = d.deleteSubvolume(newPath, false) })
+
+	// Last chance to cancel before swapping the volume.
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	oldPath := fmt.Sprintf("%s.rebalance-old", volPath)
+	err = os.Rename(volPath, oldPath)
+	if err != nil {
+		return fmt.Errorf("Failed renaming %q to %q: %w", volPath, oldPath, err)
+	}
+
+	revert.Add(func() { _ = os.Rename(oldPath, volPath) })
+
+	err = os.Rename(newPath, volPath)
+	if err != nil {
+		return fmt.Errorf("Failed renaming %q to %q: %w", newPath, volPath, err)
+	}
+
+	revert.Add(func() { _ = os.Rename(volPath, newPath) })
+
+	// Re-apply the quota to the new subvolume.
+	if vol.contentType == ContentTypeFS && vol.ConfigSize() != "" {
+		err = d.SetVolumeQuota(vol, vol.ConfigSize(), false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	revert.Success()
+
+	err = d.deleteSubvolume(oldPath, false)
+	if err != nil {
+		d.logger.Warn("Failed deleting relocated volume's old subvolume", logger.Ctx{"path": oldPath, "err": err})
+	}
+
+	return nil
+}
+
+// btrfsSnapshotUUIDs holds the identifiers of a snapshot subvolume.
+type btrfsSnapshotUUIDs struct {
+	Name         string // The snapshot name.
+	UUID         string // The subvolume UUID.
+	ReceivedUUID string // The UUID of the subvolume this one was received from (empty if not received).
+}
+
+// getSubvolumesUUIDs returns the UUID and received UUID of all subvolumes in the pool, keyed by their path.
+func (d *btrfs) getSubvolumesUUIDs(poolName string) (map[string]btrfsSnapshotUUIDs, error) {
+	stdout := strings.Builder{}
+
+	poolMountPath := GetPoolMountPath(poolName)
+
+	err := shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", "-u", "-R", poolMountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSubvolumesUUIDs(stdout.String(), poolMountPath), nil
+}
+
+// parseSubvolumesUUIDs parses the output of "btrfs subvolume list -u -R".
+func parseSubvolumesUUIDs(output string, poolMountPath string) map[string]btrfsSnapshotUUIDs {
+	uuids := make(map[string]btrfsSnapshotUUIDs)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 13 {
+			continue
+		}
+
+		subvolUUIDs := btrfsSnapshotUUIDs{UUID: fields[10]}
+		if fields[8] != "-" {
+			subvolUUIDs.ReceivedUUID = fields[8]
+		}
+
+		uuids[filepath.Join(poolMountPath, fields[12])] = subvolUUIDs
+	}
+
+	return uuids
+}
+
+// btrfsCommonSnapshot returns the name of the most recent source snapshot which the target also has, that is
+// the source snapshot which the latest matching target snapshot was received from. Both lists must be
+// ordered from oldest to newest. An empty string is returned if there is no common snapshot.
+func btrfsCommonSnapshot(srcSnapshots []btrfsSnapshotUUIDs, targetSnapshots []btrfsSnapshotUUIDs) string {
+	for i := len(targetSnapshots) - 1; i >= 0; i-- {
+		receivedUUID := targetSnapshots[i].ReceivedUUID
+		if receivedUUID == "" {
+			continue
+		}
+
+		for j := len(srcSnapshots) - 1; j >= 0; j-- {
+			// A snapshot sent on from a received source snapshot carries the source's received UUID.
+			if receivedUUID == srcSnapshots[j].UUID || receivedUUID == srcSnapshots[j].ReceivedUUID {
+				return srcSnapshots[j].Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// btrfsMigrationResumeDir is the directory of the pool holding the snapshots received by incomplete migrations.
+const btrfsMigrationResumeDir = "migration-resume"
+
+// btrfsMigrationCheckpointFile is the file of a migration resume directory recording the snapshots received so far.
+const btrfsMigrationCheckpointFile = "checkpoint.yaml"
+
+// btrfsMigrationResumeExpiry is how long the snapshots kept by an interrupted migration are kept for it to be
+// resumed, from when the last of them was received.
+const btrfsMigrationResumeExpiry = 24 * time.Hour
+
+// btrfsMigrationCheckpoint records the snapshots fully received by a migration, in the order they were received,
+// so that if the migration is interrupted the next migration of the same volume can resume after the last of them.
+type btrfsMigrationCheckpoint struct {
+	Snapshots []btrfsMigrationCheckpointSnapshot `yaml:"snapshots"`
+}
+
+// btrfsMigrationCheckpointSnapshot is a snapshot fully received by a migration.
+type btrfsMigrationCheckpointSnapshot struct {
+	Name       string                              `yaml:"name"`
+	UUID       string                              `yaml:"uuid"` // UUID of the snapshot's root subvolume on the source.
+	Subvolumes []btrfsMigrationCheckpointSubvolume `yaml:"subvolumes"`
+}
+
+// btrfsMigrationCheckpointSubvolume is a received subvolume of a snapshot.
+type btrfsMigrationCheckpointSubvolume struct {
+	Path         string `yaml:"path"`          // Path inside the snapshot where the subvolume belongs.
+	Received     string `yaml:"received"`      // Path of the received subvolume relative to the resume directory.
+	ReceivedUUID string `yaml:"received_uuid"` // Received UUID of the subvolume.
+}
+
+// btrfsMigrationResumePath returns the directory where the snapshots received by a migration of a volume are kept
+// until the migration completes.
+func btrfsMigrationResumePath(poolName string, volType VolumeType, volName string) string {
+	return filepath.Join(GetPoolMountPath(poolName), btrfsMigrationResumeDir, fmt.Sprintf("%s_%s", volType, volName))
+}
+
+// loadBtrfsMigrationCheckpoint reads the checkpoint of the resume directory dir. An empty checkpoint is returned if
+// there is none.
+func loadBtrfsMigrationCheckpoint(dir string) (*btrfsMigrationCheckpoint, error) {
+	checkpoint := &btrfsMigrationCheckpoint{}
+
+	content, err := os.ReadFile(filepath.Join(dir, btrfsMigrationCheckpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checkpoint, nil
+		}
+
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(content, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing migration checkpoint in %q: %w", dir, err)
+	}
+
+	return checkpoint, nil
+}
+
+// save writes the checkpoint to the resume directory dir, replacing the previous one only once fully written.
+func (c *btrfsMigrationCheckpoint) save(dir string) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, btrfsMigrationCheckpointFile)
+
+	err = os.WriteFile(path+".tmp", content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// lastUUID returns the source UUID of the last snapshot received, or an empty string if there is none.
+func (c *btrfsMigrationCheckpoint) lastUUID() string {
+	if len(c.Snapshots) == 0 {
+		return ""
+	}
+
+	return c.Snapshots[len(c.Snapshots)-1].UUID
+}
+
+// resumeFrom returns the snapshots received up to and including snapName, or false if snapName wasn't received.
+func (c *btrfsMigrationCheckpoint) resumeFrom(snapName string) ([]btrfsMigrationCheckpointSnapshot, bool) {
+	for i, snap := range c.Snapshots {
+		if snap.Name == snapName {
+			return c.Snapshots[:i+1], true
+		}
+	}
+
+	return nil, false
+}
+
+// MigrationResumeReceivedUUID returns the source UUID of the last snapshot kept from an interrupted migration of a
+// volume, which the source can send the following snapshots from, or an empty string if there is none.
+func MigrationResumeReceivedUUID(poolName string, volType VolumeType, volName string) string {
+	checkpoint, err := loadBtrfsMigrationCheckpoint(btrfsMigrationResumePath(poolName, volType, volName))
+	if err != nil {
+		return ""
+	}
+
+	return checkpoint.lastUUID()
+}
+
+// btrfsResumeSnapshots returns the snapshot (from the ones to send, oldest first) whose root subvolume has the
+// UUID reported by the target as the last one it received, along with the snapshots left to send after it.
+// If there is no such snapshot, all the snapshots are left to send.
+func btrfsResumeSnapshots(subvolumes []BTRFSSubVolume, snapshots []string, receivedUUID string) (string, []string) {
+	if receivedUUID == "" {
+		return "", snapshots
+	}
+
+	for _, subVol := range subvolumes {
+		if subVol.Snapshot == "" || subVol.Path != string(filepath.Separator) || subVol.UUID != receivedUUID {
+			continue
+		}
+
+		for i, snapName := range snapshots {
+			if snapName == subVol.Snapshot {
+				return snapName, snapshots[i+1:]
+			}
+		}
+	}
+
+	return "", snapshots
+}
+
+// deleteMigrationResumeDir deletes a migration resume directory along with the subvolumes in it.
+func (d *btrfs) deleteMigrationResumeDir(dir string) error {
+	return d.pruneMigrationResumeDir(dir, nil, true)
+}
+
+// deleteExpiredMigrationResumeDirs deletes the resume directories of the pool whose migration was interrupted more
+// than btrfsMigrationResumeExpiry before now, other than keepDir.
+func (d *btrfs) deleteExpiredMigrationResumeDirs(now time.Time, keepDir string) error {
+	resumeRoot := filepath.Join(GetPoolMountPath(d.name), btrfsMigrationResumeDir)
+	ents, err := os.ReadDir(resumeRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, ent := range ents {
+		dir := filepath.Join(resumeRoot, ent.Name())
+		if dir == keepDir {
+			continue
+		}
+
+		// The checkpoint is saved after each snapshot received.
+		fi, err := os.Stat(filepath.Join(dir, btrfsMigrationCheckpointFile))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+
+			fi, err = ent.Info()
+			if err != nil {
+				return err
+			}
+		}
+
+		if now.Sub(fi.ModTime()) < btrfsMigrationResumeExpiry {
+			continue
+		}
+
+		err = d.deleteMigrationResumeDir(dir)
+		if err != nil {
+			return fmt.Errorf("Failed deleting expired migration resume directory %q: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// pruneMigrationResumeDir deletes the subvolumes of the resume directory dir not belonging to the snapshots to
+// keep, such as the ones partially received by an interrupted migration. The directory itself is deleted if
+// removeDir is true.
+func (d *btrfs) pruneMigrationResumeDir(dir string, keep []btrfsMigrationCheckpointSnapshot, removeDir bool) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	kept := make(map[string]bool, len(keep))
+	for _, snap := range keep {
+		kept[snap.Name] = true
+	}
+
+	for _, ent := range ents {
+		if kept[ent.Name()] || ent.Name() == btrfsMigrationCheckpointFile {
+			continue
+		}
+
+		path := filepath.Join(dir, ent.Name())
+		if ent.IsDir() {
+			subEnts, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+
+			// Snapshots are received in a directory of their own.
+			for _, subEnt := range subEnts {
+				subPath := filepath.Join(path, subEnt.Name())
+				if btrfsIsSubVolume(subPath) {
+					err = d.deleteSubvolume(subPath, true)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if removeDir {
+		return os.RemoveAll(dir)
+	}
+
+	return nil
+}
+
+// BTRFSMetaDataHeader is the meta data header about the volumes being sent/stored.
+// Note: This is used by both migration and backup subsystems so do not modify without considering both!
+type BTRFSMetaDataHeader struct {
+	Subvolumes []BTRFSSubVolume `json:"subvolumes" yaml:"subvolumes"`                       // Sub volumes inside the volume (including the top level ones).
+	ResumeFrom string           `json:"resume_from,omitempty" yaml:"resume_from,omitempty"` // Snapshot after which an interrupted migration resumes (migration only).
+}
+
+// restorationHeader scans the volume and any specified snapshots, returning a header containing subvolume metadata
+// for use in restoring a volume and its snapshots onto another system. The metadata returned represents how the
+// subvolumes should be restored, not necessarily how they are on disk now. Most of the time this is the same,
+// however in circumstances where the volume being scanned is itself a snapshot, the returned metadata will
+// not report the volume as readonly or as being a snapshot, as the expectation is that this volume will be
+// restored on the target system as a normal volume and not a snapshot.
+func (d *btrfs) restorationHeader(vol Volume, snapshots []string) (*BTRFSMetaDataHeader, error) {
+	var migrationHeader BTRFSMetaDataHeader
+
+	// Add snapshots to volumes list.
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+
+		// Add snapshot root volume to volumes list.
+		subVols, err := d.getSubvolumesMetaData(snapVol)
+		if err != nil {
+			return nil, err
+		}
+
+		migrationHeader.Subvolumes = append(migrationHeader.Subvolumes, subVols...)
+	}
+
+	// Add main root volume to volumes list.
+	subVols, err := d.getSubvolumesMetaData(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	// If vol is a snapshot itself, we force the volume as writable (even if it isn't on disk) and remove the
+	// snapshot name indicator as the expectation is that this volume is going to be restored on the target
+	// system as a normal (non-snapshot) writable volume.
+	if vol.IsSnapshot() {
+		subVols[0].Readonly = false
+		for i := range subVols {
+			subVols[i].Snapshot = ""
+		}
+	}
+
+	migrationHeader.Subvolumes = append(migrationHeader.Subvolumes, subVols...)
+	return &migrationHeader, nil
+}
+
+// loadOptimizedBackupHeader extracts optimized backup header from a given ReadSeeker.
+func (d *btrfs) loadOptimizedBackupHeader(r io.ReadSeeker, mountPath string) (*BTRFSMetaDataHeader, error) {
+	header := BTRFSMetaDataHeader{}
+
+	// Extract.
+	tr, cancelFunc, err := backup.TarReader(r, d.state.OS, mountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cancelFunc()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // End of archive.
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error reading backup file for optimized backup header file: %w", err)
+		}
+
+		if hdr.Name == "backup/optimized_header.yaml" {
+			err = yaml.NewDecoder(tr).Decode(&header)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing optimized backup header file: %w", err)
+			}
+
+			cancelFunc()
+			return &header, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Optimized backup header file not found")
+}
+
+// receiveSubVolume receives a subvolume from an io.Reader into the receivePath and returns the path to the received subvolume.
+func (d *btrfs) receiveSubVolume(r io.Reader, receivePath string) (string, error) {
+	files, err := os.ReadDir(receivePath)
+	if err != nil {
+		return "", fmt.Errorf("Failed listing contents of %q: %w", receivePath, err)
+	}
+
+	err = shared.RunCommandWithFds(context.TODO(), r, nil, "btrfs", "receive", "-e", receivePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Check contents of target path is expected after receive.
+	newFiles, err := os.ReadDir(receivePath)
+	if err != nil {
+		return "", fmt.Errorf("Failed listing contents of %q: %w", receivePath, err)
+	}
+
+	filename := ""
+
+	// Identify the latest received path.
+	for _, a := range newFiles {
+		found := false
+
+		for _, b := range files {
+			if a.Name() == b.Name() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			filename = a.Name()
+			break
+		}
+	}
+
+	if filename == "" {
+		return "", fmt.Errorf("Failed to determine received subvolume")
+	}
+
+	subVolPath := filepath.Join(receivePath, filename)
+
+	return subVolPath, nil
+}
+
+// BTRFSQGroupLimits maps the path of subvolumes (relative to the pool mount) to their referenced data limit in bytes.
+// Note: This is serialized so that quota configuration can be restored after recovering a pool.
+type BTRFSQGroupLimits map[string]int64
+
+// btrfsCommandFunc runs a btrfs command with the supplied arguments and returns its output.
+type btrfsCommandFunc func(args ...string) (string, error)
+
+// runBtrfsCommand runs a btrfs command on the host.
+func runBtrfsCommand(args ...string) (string, error) {
+	return shared.RunCommand("btrfs", args...)
+}
+
+// QGroupExport returns the referenced data limits of the subvolumes of the pool mounted at poolMount.
+// Subvolumes without a limit aren't included. Returns ErrNotSupported if quotas are disabled on the pool.
+func QGroupExport(poolMount string) (BTRFSQGroupLimits, error) {
+	limits, err := btrfsQGroupExport(runBtrfsCommand, poolMount)
+	if err == errBtrfsNoQuota {
+		return nil, ErrNotSupported
+	}
+
+	return limits, err
+}
+
+// QGroupImport applies the limits to the subvolumes of the pool mounted at poolMount, matching them by path.
+// Subvolumes which no longer exist are skipped with a warning.
+func QGroupImport(poolMount string, limits BTRFSQGroupLimits) error {
+	return btrfsQGroupImport(runBtrfsCommand, poolMount, limits)
+}
+
+func btrfsQGroupExport(run btrfsCommandFunc, poolMount string) (BTRFSQGroupLimits, error) {
+	subvols, err := btrfsListSubvolumes(run, poolMount)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := run("qgroup", "show", "-r", "--raw", poolMount)
+	if err != nil {
+		return nil, btrfsQGroupShowError(poolMount, err)
+	}
+
+	qgroupLimits, err := parseQGroupLimits(output)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := BTRFSQGroupLimits{}
+	for id, path := range subvols {
+		limit, ok := qgroupLimits[fmt.Sprintf("0/%s", id)]
+		if ok {
+			limits[path] = limit
+		}
+	}
+
+	return limits, nil
+}
+
+func btrfsQGroupImport(run btrfsCommandFunc, poolMount string, limits BTRFSQGroupLimits) error {
+	subvols, err := btrfsListSubvolumes(run, poolMount)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(subvols))
+	for _, path := range subvols {
+		existing[path] = true
+	}
+
+	paths := make([]string, 0, len(limits))
+	for path := range limits {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if !existing[path] {
+			logger.Warn("Skipping qgroup limit of missing subvolume", logger.Ctx{"pool": poolMount, "path": path})
+			continue
+		}
+
+		subvolPath := filepath.Join(poolMount, path)
+		_, err = run("qgroup", "limit", fmt.Sprintf("%d", limits[path]), subvolPath)
+		if err != nil {
+			return fmt.Errorf("Failed applying qgroup limit to %q: %w", subvolPath, err)
+		}
+	}
+
+	return nil
+}
+
+// btrfsStartTime is when this process started, the temporary directories created before it being orphans.
+var btrfsStartTime = time.Now()
+
+// btrfsFindOrphanedReadonlySnapshots returns the temporary "backup." directories, holding the read-only snapshots
+// taken to send volumes consistently or the volumes unpacked from backups, which are directly within the pool at
+// poolMount or its volume type directories and were created before since. These were left behind by a process
+// which stopped before removing them, such as on a crash.
+func btrfsFindOrphanedReadonlySnapshots(poolMount string, since time.Time) ([]string, error) {
+	orphans := []string{}
+	for _, pattern := range []string{filepath.Join(poolMount, "backup.*"), filepath.Join(poolMount, "*", "backup.*")} {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			fi, err := os.Lstat(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			if fi.IsDir() && fi.ModTime().Before(since) {
+				orphans = append(orphans, path)
+			}
+		}
+	}
+
+	sort.Strings(orphans)
+
+	return orphans, nil
+}
+
+// btrfsDeleteOrphanedReadonlySnapshots deletes the temporary directory at tmpDir along with the subvolumes within
+// it, as identified by isSubvolume, deepest first.
+func btrfsDeleteOrphanedReadonlySnapshots(run btrfsCommandFunc, isSubvolume func(path string) bool, tmpDir string) error {
+	subvols := []string{}
+	err := filepath.Walk(tmpDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != tmpDir && fi.IsDir() && isSubvolume(path) {
+			subvols = append(subvols, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed listing subvolumes of %q: %w", tmpDir, err)
+	}
+
+	// A subvolume sorts after its parents, so the reverse order deletes the children first.
+	sort.Sort(sort.Reverse(sort.StringSlice(subvols)))
+
+	for _, subvol := range subvols {
+		// Read-only subvolumes can't be deleted.
+		_, _ = run("property", "set", "-ts", subvol, "ro", "false")
+
+		_, err = run("subvolume", "delete", subvol)
+		if err != nil {
+			return fmt.Errorf("Failed deleting subvolume %q: %w", subvol, err)
+		}
+	}
+
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", tmpDir, err)
+	}
+
+	return nil
+}
+
+// btrfsCleanupOrphanedReadonlySnapshots deletes the orphaned temporary directories of the pool at poolMount (see
+// btrfsFindOrphanedReadonlySnapshots), logging each of them. Failures are only logged.
+func btrfsCleanupOrphanedReadonlySnapshots(run btrfsCommandFunc, isSubvolume func(path string) bool, poolMount string, since time.Time, l logger.Logger) {
+	orphans, err := btrfsFindOrphanedReadonlySnapshots(poolMount, since)
+	if err != nil {
+		l.Warn("Failed looking for orphaned read-only snapshots", logger.Ctx{"err": err})
+		return
+	}
+
+	for _, orphan := range orphans {
+		err = btrfsDeleteOrphanedReadonlySnapshots(run, isSubvolume, orphan)
+		if err != nil {
+			l.Warn("Failed deleting orphaned read-only snapshot", logger.Ctx{"path": orphan, "err": err})
+			continue
+		}
+
+		l.Info("Deleted orphaned read-only snapshot", logger.Ctx{"path": orphan})
+	}
+}
+
+// PoolSubVolumeTeardown deletes the btrfs subvolume at poolMount along with all the subvolumes nested in it,
+// deleting the children before their parents. It refuses to if instance volumes are still present in the pool,
+// in the given pool layout. Callers are expected to have checked that no instance is recorded on the pool.
+func PoolSubVolumeTeardown(poolMount string, layout string) error {
+	return btrfsSubVolumeTeardown(runBtrfsCommand, btrfsIsSubVolume, poolMount, layout)
+}
+
+// btrfsSubVolumeTeardown deletes the subvolume at poolMount and the subvolumes nested in it, as identified by
+// isSubvolume, deepest first.
+func btrfsSubVolumeTeardown(run btrfsCommandFunc, isSubvolume func(path string) bool, poolMount string, layout string) error {
+	// Refuse to delete the volumes of instances.
+	instances := []string{}
+	for _, volType := range []VolumeType{VolumeTypeContainer, VolumeTypeVM} {
+		dir := BaseDirectories[volType][0]
+		names, err := listPoolLayoutEntries(poolMount, layout, dir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			instances = append(instances, poolLayoutEntryPath(layout, dir, name))
+		}
+	}
+
+	if len(instances) > 0 {
+		return fmt.Errorf("Refusing to delete pool subvolume %q as it still has instances: %s", poolMount, strings.Join(instances, ", "))
+	}
+
+	subvols := []string{}
+	err := filepath.Walk(poolMount, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Subvolumes can only be directories.
+		if path == poolMount || !fi.IsDir() {
+			return nil
+		}
+
+		if isSubvolume(path) {
+			subvols = append(subvols, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed listing subvolumes of %q: %w", poolMount, err)
+	}
+
+	// A subvolume sorts after its parents, so the reverse order deletes the children first.
+	sort.Sort(sort.Reverse(sort.StringSlice(subvols)))
+	subvols = append(subvols, poolMount)
+
+	for _, subvol := range subvols {
+		// Attempt (but don't fail on) to delete any qgroup on the subvolume.
+		btrfsDestroySubvolumeQGroup(run, nil, subvol)
+
+		// Read-only subvolumes can't be deleted.
+		_, _ = run("property", "set", "-ts", subvol, "ro", "false")
+
+		_, err = run("subvolume", "delete", subvol)
+		if err != nil {
+			return fmt.Errorf("Failed deleting subvolume %q: %w", subvol, err)
+		}
+	}
+
+	return nil
+}
+
+// Methods used to mount snapshots.
+const (
+	btrfsSnapshotMountBind     = "bind"     // Bind mount of the subvolume accessible through an existing mount.
+	btrfsSnapshotMountSubvolID = "subvolid" // Mount of the subvolume by ID from the pool's device.
+)
+
+// btrfsSnapshotMountMethod returns how to mount the snapshot at snapPath: a bind mount is cheaper and used when
+// the snapshot subvolume is already accessible there, falling back to mounting it by ID otherwise (such as when
+// the mount of snapshots.mount_base holding it is missing).
+func btrfsSnapshotMountMethod(snapPath string, isSubvolume func(path string) bool) string {
+	if isSubvolume(snapPath) {
+		return btrfsSnapshotMountBind
+	}
+
+	return btrfsSnapshotMountSubvolID
+}
+
+// btrfsPoolSubvolumePath returns the path relative to the filesystem root of the subvolume mounted at poolMount,
+// found among subvols (paths relative to the filesystem root keyed by ID), or "" if it's the top level subvolume.
+func btrfsPoolSubvolumePath(run btrfsCommandFunc, poolMount string, subvols map[string]string) (string, error) {
+	output, err := run("inspect-internal", "rootid", poolMount)
+	if err != nil {
+		return "", fmt.Errorf("Failed getting subvolume ID of %q: %w", poolMount, err)
+	}
+
+	id := strings.TrimSpace(output)
+	if id == "5" {
+		return "", nil
+	}
+
+	path, ok := subvols[id]
+	if !ok {
+		return "", fmt.Errorf("Failed finding subvolume %s of %q", id, poolMount)
+	}
+
+	return path, nil
+}
+
+// btrfsFindSubvolumeID returns the ID of the subvolume at relPath (relative to the pool) among subvols (paths
+// relative to the filesystem root keyed by ID), poolSubvolPath being the path of the pool's own subvolume as
+// returned by btrfsPoolSubvolumePath.
+func btrfsFindSubvolumeID(subvols map[string]string, poolSubvolPath string, relPath string) (string, error) {
+	fullPath := relPath
+	if poolSubvolPath != "" {
+		fullPath = poolSubvolPath + "/" + relPath
+	}
+
+	for id, path := range subvols {
+		if path == fullPath {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("Failed finding subvolume %q", relPath)
+}
+
+// btrfsVerifySubvolumeMounts calls mount with the ID of the subvolume of each volume, found among subvols (paths
+// relative to the filesystem root keyed by ID) from its path relative to the pool as returned by relPath (see
+// btrfsFindSubvolumeID for poolSubvolPath). Returns the volumes whose subvolume is missing or failed to mount, in
+// the order of vols.
+func btrfsVerifySubvolumeMounts(vols []Volume, subvols map[string]string, poolSubvolPath string, relPath func(path string) (string, error), mount func(subvolID string) error) []VolumeMountFailure {
+	failures := []VolumeMountFailure{}
+	for _, vol := range vols {
+		path, err := relPath(vol.MountPath())
+		if err != nil {
+			failures = append(failures, VolumeMountFailure{Volume: vol, Err: err})
+			continue
+		}
+
+		subvolID, err := btrfsFindSubvolumeID(subvols, poolSubvolPath, path)
+		if err != nil {
+			failures = append(failures, VolumeMountFailure{Volume: vol, Err: err})
+			continue
+		}
+
+		err = mount(subvolID)
+		if err != nil {
+			failures = append(failures, VolumeMountFailure{Volume: vol, Err: err})
+		}
+	}
+
+	return failures
+}
+
+// btrfsSubvolumeIDs returns the paths (relative to the pool mount) which are among subvols (paths relative to the
+// filesystem root keyed by ID), keyed by subvolume ID. Paths without a subvolume are left out. See
+// btrfsFindSubvolumeID for poolSubvolPath.
+func btrfsSubvolumeIDs(subvols map[string]string, poolSubvolPath string, paths []string) map[string]string {
+	ids := map[string]string{}
+	for _, path := range paths {
+		id, err := btrfsFindSubvolumeID(subvols, poolSubvolPath, path)
+		if err != nil {
+			continue
+		}
+
+		ids[id] = path
+	}
+
+	return ids
+}
+
+// btrfsListSubvolumes returns the paths (relative to the pool mount) of the subvolumes of the pool keyed by ID.
+func btrfsListSubvolumes(run btrfsCommandFunc, poolMount string) (map[string]string, error) {
+	output, err := run("subvolume", "list", poolMount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing subvolumes of %q: %w", poolMount, err)
+	}
+
+	subvols := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		// Expect "ID <id> gen <gen> top level <id> path <path>".
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "ID" {
+			continue
+		}
+
+		_, path, found := strings.Cut(line, " path ")
+		if !found {
+			continue
+		}
+
+		subvols[fields[1]] = path
+	}
+
+	return subvols, nil
+}
+
+// parseQGroupLimits parses the output of "btrfs qgroup show -r --raw" and returns the referenced data limit of
+// each qgroup which has one.
+func parseQGroupLimits(output string) (map[string]int64, error) {
+	limits := map[string]int64{}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || strings.HasPrefix(line, "qgroupid") || strings.HasPrefix(line, "Qgroupid") || strings.HasPrefix(line, "---") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] == "none" {
+			continue
+		}
+
+		limit, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing limit of qgroup %q: %w", fields[0], err)
+		}
+
+		limits[fields[0]] = limit
+	}
+
+	return limits, nil
+}
+
+// btrfsInstanceFootprint returns the space used by the subvolumes at paths combined, counting the data they share
+// once. It is estimated from the referenced and exclusive space of their existing qgroups, read with usage, so
+// that nothing needs creating or rescanning (see btrfsEstimateSharing).
+func btrfsInstanceFootprint(paths []string, usage func(path string) (int64, int64, error)) (int64, error) {
+	usages := make([]btrfsQGroupUsage, 0, len(paths))
+	for _, path := range paths {
+		referenced, exclusive, err := usage(path)
+		if err != nil {
+			return -1, err
+		}
+
+		usages = append(usages, btrfsQGroupUsage{Referenced: referenced, Exclusive: exclusive})
+	}
+
+	return btrfsEstimateSharing(usages).Physical, nil
+}
+
+// parseQGroupShow parses the output of "btrfs qgroup show --raw" and returns the usage of each qgroup.
+func parseQGroupShow(output string) (map[string]btrfsQGroupUsage, error) {
+	usages := map[string]btrfsQGroupUsage{}
+
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || strings.HasPrefix(line, "qgroupid") || strings.HasPrefix(line, "Qgroupid") || strings.HasPrefix(line, "---") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		referenced, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing referenced size of qgroup %q: %w", fields[0], err)
+		}
+
+		exclusive, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing exclusive size of qgroup %q: %w", fields[0], err)
+		}
+
+		usages[fields[0]] = btrfsQGroupUsage{Referenced: referenced, Exclusive: exclusive}
+	}
+
+	return usages, nil
+}
+
+// btrfsQGroupInconsistentWarning is the warning printed by "btrfs qgroup show" when the qgroup data is inconsistent.
+const btrfsQGroupInconsistentWarning = "qgroup data inconsistent"
+
+// runBtrfsCommandWithWarnings runs a btrfs command on the host and returns the warnings it printed on stderr
+// followed by its output.
+func runBtrfsCommandWithWarnings(args ...string) (string, error) {
+	stdout, stderr, err := shared.RunCommandSplit(context.TODO(), nil, nil, "btrfs", args...)
+	if err != nil {
+		return "", err
+	}
+
+	return stderr + stdout, nil
+}
+
+// parseQGroupInconsistencies parses the output of "btrfs qgroup show --sync --raw", including its warnings, and
+// returns the sorted subvolume qgroups whose data is marked inconsistent. As btrfs tracks the consistency of the
+// qgroup data for the whole filesystem, all of them are returned when it's inconsistent and none otherwise.
+func parseQGroupInconsistencies(output string) []string {
+	if !strings.Contains(output, btrfsQGroupInconsistentWarning) {
+		return []string{}
+	}
+
+	qgroups := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+
+		// Skip the top level subvolume which isn't a volume.
+		if fields[0] == "0/5" {
+			continue
+		}
+
+		qgroups = append(qgroups, fields[0])
+	}
+
+	sort.Strings(qgroups)
+
+	return qgroups
+}
+
+// btrfsQuotaHealthIssues returns an issue for each subvolume of the pool mounted at poolMount whose qgroup data
+// is inconsistent, recommending a quota rescan. Nothing is reported if quotas are disabled.
+func btrfsQuotaHealthIssues(run btrfsCommandFunc, poolMount string) ([]PoolHealthIssue, error) {
+	issues := []PoolHealthIssue{}
+
+	output, err := run("qgroup", "show", "--sync", "--raw", poolMount)
+	if err != nil {
+		err = btrfsQGroupShowError(poolMount, err)
+		if err == errBtrfsNoQuota {
+			return issues, nil
+		}
+
+		return nil, err
+	}
+
+	qgroups := parseQGroupInconsistencies(output)
+	if len(qgroups) == 0 {
+		return issues, nil
+	}
+
+	subvols, err := btrfsListSubvolumes(run, poolMount)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, qgroup := range qgroups {
+		// Skip the qgroups left behind by deleted subvolumes.
+		path, ok := subvols[strings.TrimPrefix(qgroup, "0/")]
+		if !ok {
+			continue
+		}
+
+		issues = append(issues, PoolHealthIssue{
+			Check:          HealthCheckQuotaConsistency,
+			Path:           path,
+			Message:        fmt.Sprintf("Quota accounting of qgroup %q is inconsistent", qgroup),
+			Recommendation: fmt.Sprintf("Rescan the quotas with \"btrfs quota rescan %s\"", poolMount),
+		})
+	}
+
+	return issues, nil
+}
+
+// btrfsQuotaRescanTimeout is the default number of seconds to wait for a quota rescan to complete.
+const btrfsQuotaRescanTimeout = 30
+
+// btrfsQuotaRescanInterval is how often the progress of a quota rescan is checked.
+var btrfsQuotaRescanInterval = time.Second
+
+// quotaRescan rescans the quotas of the pool, reporting the progress on the operation.
+// If the rescan takes longer than btrfs.quota_rescan_timeout it is left running in the background.
+func (d *btrfs) quotaRescan(op *operations.Operation) error {
+	timeout := time.Duration(btrfsQuotaRescanTimeout) * time.Second
+	if d.config["btrfs.quota_rescan_timeout"] != "" {
+		seconds, err := strconv.ParseUint(d.config["btrfs.quota_rescan_timeout"], 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid btrfs.quota_rescan_timeout: %w", err)
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	progress := func(stage string) {
+		if op != nil {
+			_ = op.ExtendMetadata(map[string]any{"quota_rescan_progress": stage})
+		}
+	}
+
+	poolMount := GetPoolMountPath(d.name)
+	completed, err := btrfsQuotaRescan(runBtrfsCommand, poolMount, timeout, progress)
+	if err != nil {
+		return err
+	}
+
+	if !completed {
+		d.logger.Warn("Quota rescan still running in the background, usage may be inaccurate until it completes", logger.Ctx{"timeout": timeout})
+	}
+
+	return nil
+}
+
+// btrfsQuotaRescan starts a quota rescan of the pool mounted at poolMount and waits for at most timeout for it
+// to complete, passing its status to progress. A rescan already in progress, such as the one started when
+// enabling quotas, is waited for instead. It returns whether the rescan completed.
+func btrfsQuotaRescan(run btrfsCommandFunc, poolMount string, timeout time.Duration, progress func(string)) (bool, error) {
+	_, err := run("quota", "rescan", poolMount)
+	if err != nil && !strings.Contains(err.Error(), unix.EINPROGRESS.Error()) {
+		return false, fmt.Errorf("Failed starting quota rescan of %q: %w", poolMount, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := run("quota", "rescan", "-s", poolMount)
+		if err != nil {
+			return false, fmt.Errorf("Failed getting quota rescan status of %q: %w", poolMount, err)
+		}
+
+		running, key := parseQuotaRescanStatus(output)
+		if !running {
+			progress("Quota rescan complete")
+			return true, nil
+		}
+
+		progress(fmt.Sprintf("Quota rescan running (current key %s)", key))
+
+		if !time.Now().Before(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(btrfsQuotaRescanInterval)
+	}
+}
+
+// parseQuotaRescanStatus parses the output of "btrfs quota rescan -s" and returns whether a rescan is running
+// and its current key.
+func parseQuotaRescanStatus(output string) (bool, string) {
+	// Expect "rescan operation running (current key <key>)" or "no rescan operation in progress".
+	_, key, found := strings.Cut(output, "current key ")
+	if !found {
+		return false, ""
+	}
+
+	key, _, _ = strings.Cut(key, ")")
+
+	return true, strings.TrimSpace(key)
+}
+
+// btrfsSubVolumeSwap atomically exchanges the subvolumes at paths a and b using RENAME_EXCHANGE, so that each
+// path references the other's content without any intermediate state where either is missing.
+func btrfsSubVolumeSwap(a string, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if err != nil {
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("Failed swapping subvolumes %q and %q: RENAME_EXCHANGE not supported: %w", a, b, err)
+		}
+
+		return fmt.Errorf("Failed swapping subvolumes %q and %q: %w", a, b, err)
+	}
+
+	return nil
+}
+
+// btrfsMetadataChunkSize is the usual size of a btrfs metadata chunk.
+const btrfsMetadataChunkSize = 256 * 1024 * 1024
+
+// btrfsMetadataFullPercent is the metadata usage (in percent) above which the metadata is considered near full
+// if no new metadata chunk can be allocated.
+const btrfsMetadataFullPercent = 95
+
+// btrfsMetadataUsage represents the metadata space of a btrfs filesystem.
+type btrfsMetadataUsage struct {
+	Size        int64 // Space allocated to metadata chunks.
+	Used        int64 // Space used within the metadata chunks.
+	Unallocated int64 // Space not allocated to any chunk yet.
+}
+
+// nearFull returns whether the metadata is almost exhausted with no space left to allocate a new chunk.
+// In that state even deleting data can fail as it needs metadata space.
+func (u btrfsMetadataUsage) nearFull() bool {
+	if u.Size <= 0 || u.Unallocated >= btrfsMetadataChunkSize {
+		return false
+	}
+
+	return u.Used*100 >= u.Size*btrfsMetadataFullPercent
+}
+
+// parseBtrfsMetadataUsage parses the output of "btrfs filesystem usage -b".
+func parseBtrfsMetadataUsage(output string) (btrfsMetadataUsage, error) {
+	usage := btrfsMetadataUsage{}
+	foundMetadata := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		// Expect "Device unallocated: <bytes>".
+		if strings.HasPrefix(line, "Device unallocated:") {
+			value := strings.TrimSpace(strings.TrimPrefix(line, "Device unallocated:"))
+			unallocated, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return usage, fmt.Errorf("Failed parsing unallocated space %q: %w", value, err)
+			}
+
+			usage.Unallocated = unallocated
+			continue
+		}
+
+		// Expect "Metadata,<profile>: Size:<bytes>, Used:<bytes> (<percent>)".
+		if !strings.HasPrefix(line, "Metadata,") {
+			continue
+		}
+
+		fields := strings.Fields(strings.ReplaceAll(line, ",", " "))
+		for _, field := range fields {
+			for prefix, dest := range map[string]*int64{"Size:": &usage.Size, "Used:": &usage.Used} {
+				if !strings.HasPrefix(field, prefix) {
+					continue
+				}
+
+				value := strings.TrimPrefix(field, prefix)
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return usage, fmt.Errorf("Failed parsing metadata %s %q: %w", strings.TrimSuffix(prefix, ":"), value, err)
+				}
+
+				*dest = size
+			}
+		}
+
+		foundMetadata = true
+	}
+
+	if !foundMetadata {
+		return usage, fmt.Errorf("Metadata usage not found")
+	}
+
+	return usage, nil
+}
+
+// btrfsEmergencyFree frees space for metadata on the filesystem mounted at poolMount by balancing away empty
+// and almost empty data chunks, returning their space to the unallocated pool from which new metadata chunks
+// can be allocated. Balancing empty chunks doesn't itself need metadata space so it works on an exhausted
+// filesystem, while operations such as deletes can rely on the kernel's global reserve meanwhile.
+func btrfsEmergencyFree(run btrfsCommandFunc, poolMount string) error {
+	filters := []string{"-dusage=0", "-dusage=5"}
+
+	var err error
+	failures := 0
+	for _, filter := range filters {
+		_, err = run("balance", "start", filter, poolMount)
+		if err != nil {
+			failures++
+		}
+	}
+
+	// Only fail if no space could be freed at all.
+	if failures == len(filters) {
+		return fmt.Errorf("Failed freeing metadata space on %q: %w", poolMount, err)
+	}
+
+	return nil
+}
+
+// btrfsEnsureMetadataSpace checks whether the metadata of the filesystem mounted at poolMount is near full and
+// if so frees space for it. It returns whether space had to be freed.
+func btrfsEnsureMetadataSpace(run btrfsCommandFunc, poolMount string) (bool, error) {
+	output, err := run("filesystem", "usage", "-b", poolMount)
+	if err != nil {
+		return false, fmt.Errorf("Failed getting filesystem usage of %q: %w", poolMount, err)
+	}
+
+	usage, err := parseBtrfsMetadataUsage(output)
+	if err != nil {
+		return false, err
+	}
+
+	if !usage.nearFull() {
+		return false, nil
+	}
+
+	return true, btrfsEmergencyFree(run, poolMount)
+}
+
+// btrfsMetadataCheckInterval is how long metadata found not to be near full is trusted before being checked again.
+const btrfsMetadataCheckInterval = time.Minute
+
+// btrfsMetadataChecked records, by pool mount path, when the metadata was last found not to be near full.
+var btrfsMetadataChecked = map[string]time.Time{}
+var btrfsMetadataCheckedMu sync.Mutex
+
+// btrfsMetadataCheckDue returns whether the metadata of the pool mounted at poolMount needs checking at now, that
+// is unless it was found not to be near full less than btrfsMetadataCheckInterval before.
+func btrfsMetadataCheckDue(poolMount string, now time.Time) bool {
+	btrfsMetadataCheckedMu.Lock()
+	defer btrfsMetadataCheckedMu.Unlock()
+
+	checked, ok := btrfsMetadataChecked[poolMount]
+
+	return !ok || now.Sub(checked) >= btrfsMetadataCheckInterval
+}
+
+// btrfsMetadataCheckDone records the result of checking the metadata of the pool mounted at poolMount at now.
+// Pools which were near full or couldn't be checked are checked again on next use.
+func btrfsMetadataCheckDone(poolMount string, now time.Time, ok bool) {
+	btrfsMetadataCheckedMu.Lock()
+	defer btrfsMetadataCheckedMu.Unlock()
+
+	if ok {
+		btrfsMetadataChecked[poolMount] = now
+	} else {
+		delete(btrfsMetadataChecked, poolMount)
+	}
+}
+
+// ensureMetadataSpace frees space for metadata if the pool is about to run out of it, so that deletions can
+// still succeed. Failures are only logged, leaving the caller to attempt the operation regardless.
+// The check runs a btrfs command, so it is skipped for btrfsMetadataCheckInterval once the metadata was found not
+// to be near full rather than done on every deletion.
+func (d *btrfs) ensureMetadataSpace() {
+	poolMount := GetPoolMountPath(d.name)
+
+	now := time.Now()
+	if !btrfsMetadataCheckDue(poolMount, now) {
+		return
+	}
+
+	freed, err := btrfsEnsureMetadataSpace(runBtrfsCommand, poolMount)
+	if err != nil {
+		d.logger.Warn("Failed ensuring free metadata space", logger.Ctx{"err": err})
+	} else if freed {
+		d.logger.Warn("Freed metadata space on near full pool")
+	}
+
+	btrfsMetadataCheckDone(poolMount, now, err == nil && !freed)
+}
+
+// btrfsReceiveMetadataPercent is the metadata space (in percent of the data, per metadata copy) reserved on top
+// of the data when checking whether a receive fits on a pool.
+const btrfsReceiveMetadataPercent = 2
+
+// btrfsFreeSpace represents the space left for new data on a btrfs filesystem.
+type btrfsFreeSpace struct {
+	Free          int64   // Estimated free space for data, accounting for the data profile.
+	MetadataRatio float64 // Number of copies of the metadata.
+}
+
+// parseBtrfsFreeSpace parses the output of "btrfs filesystem usage -b".
+func parseBtrfsFreeSpace(output string) (btrfsFreeSpace, error) {
+	space := btrfsFreeSpace{Free: -1, MetadataRatio: 1}
+
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch key {
+		case "Free (estimated)":
+			// Expect "Free (estimated): <bytes> (min: <bytes>)".
+			free, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return space, fmt.Errorf("Failed parsing free space %q: %w", fields[0], err)
+			}
+
+			space.Free = free
+		case "Metadata ratio":
+			ratio, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				return space, fmt.Errorf("Failed parsing metadata ratio %q: %w", fields[0], err)
+			}
+
+			if ratio >= 1 {
+				space.MetadataRatio = ratio
+			}
+		}
+	}
+
+	if space.Free < 0 {
+		return space, fmt.Errorf("Free space not found")
+	}
+
+	return space, nil
+}
+
+// btrfsCheckReceiveSpace returns an error if the filesystem mounted at poolMount doesn't have enough free space
+// to receive estimate bytes of data along with the metadata btrfs needs for it.
+func btrfsCheckReceiveSpace(run btrfsCommandFunc, poolMount string, estimate int64) error {
+	output, err := run("filesystem", "usage", "-b", poolMount)
+	if err != nil {
+		return fmt.Errorf("Failed getting filesystem usage of %q: %w", poolMount, err)
+	}
+
+	space, err := parseBtrfsFreeSpace(output)
+	if err != nil {
+		return err
+	}
+
+	metadata := int64(float64(estimate) * space.MetadataRatio * btrfsReceiveMetadataPercent / 100)
+	needed := estimate + metadata
+	if needed > space.Free {
+		return fmt.Errorf("Not enough free space on the storage pool to receive the volume: %d bytes needed (%d bytes of data and %d bytes of metadata) but only %d bytes free", needed, estimate, metadata, space.Free)
+	}
+
+	return nil
+}
+
+// btrfsLayoutDeviations compares the layout of the pool mounted at poolMount, with its snapshot directories in
+// snapshotsPath, with the one expected for the supported volume types. The base directories must be plain
+// directories, the volumes directly within them subvolumes, and the snapshots directories must contain a directory
+// per volume holding snapshot subvolumes. Entries are checked in name order so that the report is stable.
+func btrfsLayoutDeviations(poolMount string, snapshotsPath string, layout string, volTypes []VolumeType, isSubvolume func(string) bool) ([]LayoutDeviation, error) {
+	deviations := []LayoutDeviation{}
+
+	report := func(path string, problem string, format string, args ...any) {
+		relPath, err := relPathUnder(poolMount, path)
+		if err != nil {
+			relPath = path
+		}
+
+		deviations = append(deviations, LayoutDeviation{Path: relPath, Problem: problem, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// checkDir reports path unless it's a directory and returns its entries.
+	checkDir := func(path string) ([]os.DirEntry, bool, error) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				report(path, LayoutProblemMissing, "Directory %q is missing", path)
+				return nil, false, nil
+			}
+
+			return nil, false, fmt.Errorf("Failed checking %q: %w", path, err)
+		}
+
+		if !info.IsDir() {
+			report(path, LayoutProblemNotDirectory, "%q isn't a directory", path)
+			return nil, false, nil
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed listing %q: %w", path, err)
+		}
+
+		return entries, true, nil
+	}
+
+	// checkSubvolumes reports the paths which aren't subvolumes.
+	checkSubvolumes := func(paths []string) error {
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err != nil {
+				return fmt.Errorf("Failed checking %q: %w", path, err)
+			}
+
+			if !info.IsDir() {
+				report(path, LayoutProblemUnexpectedEntry, "%q isn't a volume subvolume", path)
+				continue
+			}
+
+			if !isSubvolume(path) {
+				report(path, LayoutProblemNotSubvolume, "Volume %q isn't a subvolume", path)
+			}
+		}
+
+		return nil
+	}
+
+	for _, volType := range volTypes {
+		for _, baseDir := range BaseDirectories[volType] {
+			root := poolMount
+			if strings.HasSuffix(baseDir, "-snapshots") {
+				root = snapshotsPath
+			}
+
+			// The flat layout has no base directories to check, only the entries at the root of the pool.
+			if layout != PoolLayoutFlat {
+				_, ok, err := checkDir(filepath.Join(root, baseDir))
+				if err != nil {
+					return nil, err
+				}
+
+				if !ok {
+					continue
+				}
+			}
+
+			names, err := listPoolLayoutEntries(root, layout, baseDir)
+			if err != nil {
+				return nil, err
+			}
+
+			paths := make([]string, 0, len(names))
+			for _, name := range names {
+				paths = append(paths, filepath.Join(root, poolLayoutEntryPath(layout, baseDir, name)))
+			}
+
+			if !strings.HasSuffix(baseDir, "-snapshots") {
+				err = checkSubvolumes(paths)
+				if err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			// Snapshots are grouped in a plain directory per parent volume.
+			for _, parentDir := range paths {
+				snapshots, ok, err := checkDir(parentDir)
+				if err != nil {
+					return nil, err
+				}
+
+				if !ok {
+					continue
+				}
+
+				snapshotPaths := make([]string, 0, len(snapshots))
+				for _, snapshot := range snapshots {
+					snapshotPaths = append(snapshotPaths, filepath.Join(parentDir, snapshot.Name()))
+				}
+
+				err = checkSubvolumes(snapshotPaths)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return deviations, nil
+}
+
+// Btrfs send stream format.
+const (
+	btrfsSendStreamMagic     = "btrfs-stream\x00"
+	btrfsSendStreamHeaderLen = len(btrfsSendStreamMagic) + 4 // Magic followed by a little-endian version.
+	btrfsSendCmdHeaderLen    = 10                            // Payload length (4), command (2) and CRC (4).
+	btrfsSendCmdSubvol       = 1
+	btrfsSendCmdSnapshot     = 2
+	btrfsSendCmdEnd          = 21
+	btrfsSendAttrUUID        = 1
+	btrfsSendAttrPath        = 15
+	btrfsSendAttrCloneUUID   = 20
+)
+
+// btrfsReceiveFunc receives the subvolume in the btrfs send stream r into dir.
+type btrfsReceiveFunc func(dir string, r io.Reader) error
+
+// btrfsReceive receives a subvolume from a btrfs send stream on the host.
+func btrfsReceive(dir string, r io.Reader) error {
+	return shared.RunCommandWithFds(context.TODO(), r, nil, "btrfs", "receive", dir)
+}
+
+// btrfsStreamSubvolume represents a subvolume contained in a btrfs send stream.
+type btrfsStreamSubvolume struct {
+	Name       string // Name of the subvolume as sent.
+	UUID       string // UUID of the sent subvolume (the received UUID of the received subvolume).
+	ParentUUID string // UUID of the subvolume it was sent relative to (empty if sent in full).
+	Path       string // Path of the received subvolume.
+}
+
+// parseBtrfsSendStreamAttrs parses the attributes of a btrfs send stream command, keyed by attribute type.
+func parseBtrfsSendStreamAttrs(payload []byte) (map[uint16][]byte, error) {
+	attrs := map[uint16][]byte{}
+
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("Truncated send stream attribute")
+		}
+
+		attrType := binary.LittleEndian.Uint16(payload[0:2])
+		attrLen := int(binary.LittleEndian.Uint16(payload[2:4]))
+		if len(payload) < 4+attrLen {
+			return nil, fmt.Errorf("Truncated send stream attribute %d", attrType)
+		}
+
+		attrs[attrType] = payload[4 : 4+attrLen]
+		payload = payload[4+attrLen:]
+	}
+
+	return attrs, nil
+}
+
+// parseBtrfsStreamSubvolume parses the attributes of a subvolume or snapshot command of a btrfs send stream.
+func parseBtrfsStreamSubvolume(payload []byte) (btrfsStreamSubvolume, error) {
+	subvol := btrfsStreamSubvolume{}
+
+	attrs, err := parseBtrfsSendStreamAttrs(payload)
+	if err != nil {
+		return subvol, err
+	}
+
+	for _, attrType := range []uint16{btrfsSendAttrUUID, btrfsSendAttrCloneUUID} {
+		value, ok := attrs[attrType]
+		if !ok {
+			continue
+		}
+
+		if len(value) != 16 {
+			return subvol, fmt.Errorf("Invalid UUID length %d in send stream", len(value))
+		}
+
+		if attrType == btrfsSendAttrUUID {
+			subvol.UUID = uuid.UUID(value).String()
+		} else {
+			subvol.ParentUUID = uuid.UUID(value).String()
+		}
+	}
+
+	subvol.Name = string(attrs[btrfsSendAttrPath])
+
+	if subvol.Name == "" || subvol.UUID == "" {
+		return subvol, fmt.Errorf("Send stream subvolume is missing its path or UUID")
+	}
+
+	return subvol, nil
+}
+
+// btrfsSnapshotExport writes a btrfs send stream of the read-only subvolumes at paths to w, each subvolume being
+// sent relative to the previous one. The paths must be ordered from oldest to newest.
+func btrfsSnapshotExport(w io.Writer, paths []string) error {
+	for i, path := range paths {
+		args := []string{"send", "-q"}
+		if i > 0 {
+			args = append(args, "-p", paths[i-1])
+		}
+
+		args = append(args, path)
+
+		err := shared.RunCommandWithFds(context.TODO(), nil, w, "btrfs", args...)
+		if err != nil {
+			return fmt.Errorf("Failed sending subvolume %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// btrfsSnapshotImport receives the subvolumes of a btrfs send stream in order, each into its own numbered
+// directory within receiveDir, and returns them. The stream can be made of several concatenated send streams
+// or of a single stream containing several subvolumes. Before receiving a subvolume sent relative to a parent,
+// it checks that the parent is either one of the subvolumes received before it or one of knownUUIDs.
+// On failure all the subvolumes received so far, including any partially received one, are deleted.
+func btrfsSnapshotImport(run btrfsCommandFunc, receive btrfsReceiveFunc, r io.Reader, receiveDir string, knownUUIDs map[string]bool) (_ []btrfsStreamSubvolume, err error) {
+	reader := bufio.NewReader(r)
+	received := []btrfsStreamSubvolume{}
+	known := make(map[string]bool, len(knownUUIDs))
+	for k, v := range knownUUIDs {
+		known[k] = v
+	}
+
+	var current *btrfsStreamSubvolume
+	var pipeWriter *io.PipeWriter
+	var receiveErr chan error
+
+	// finish waits for the current subvolume to be received.
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+
+		_ = pipeWriter.Close()
+		err := <-receiveErr
+
+		// Track the subvolume even if it failed so that it gets cleaned up.
+		subvol := *current
+		received = append(received, subvol)
+		current = nil
+
+		if err != nil {
+			return fmt.Errorf("Failed receiving subvolume %q: %w", subvol.Name, err)
+		}
+
+		known[subvol.UUID] = true
+
+		return nil
+	}
+
+	// write forwards data to the receiver of the current subvolume.
+	write := func(data []byte) error {
+		_, err := pipeWriter.Write(data)
+		if err != nil {
+			name := current.Name
+
+			// Prefer the error of the receiver which stopped reading.
+			finishErr := finish()
+			if finishErr != nil {
+				return finishErr
+			}
+
+			return fmt.Errorf("Failed receiving subvolume %q: %w", name, err)
+		}
+
+		return nil
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if current != nil {
+			_ = pipeWriter.CloseWithError(err)
+			<-receiveErr
+			received = append(received, *current)
+		}
+
+		for i := len(received) - 1; i >= 0; i-- {
+			if !shared.PathExists(received[i].Path) {
+				continue
+			}
+
+			_, deleteErr := run("subvolume", "delete", received[i].Path)
+			if deleteErr != nil {
+				logger.Warn("Failed deleting partially received subvolume", logger.Ctx{"path": received[i].Path, "err": deleteErr})
+			}
+		}
+	}()
+
+	var streamHeader []byte
+	for {
+		// Each concatenated stream starts with its own header.
+		peek, err := reader.Peek(len(btrfsSendStreamMagic))
+		if err == io.EOF && len(peek) == 0 && streamHeader != nil {
+			break
+		}
+
+		if err == nil && string(peek) == btrfsSendStreamMagic {
+			streamHeader = make([]byte, btrfsSendStreamHeaderLen)
+			_, err = io.ReadFull(reader, streamHeader)
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading send stream header: %w", err)
+			}
+
+			continue
+		}
+
+		if streamHeader == nil {
+			return nil, fmt.Errorf("Invalid send stream header")
+		}
+
+		cmd := make([]byte, btrfsSendCmdHeaderLen)
+		_, err = io.ReadFull(reader, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading send stream command: %w", err)
+		}
+
+		payloadLen := binary.LittleEndian.Uint32(cmd[0:4])
+		cmdType := binary.LittleEndian.Uint16(cmd[4:6])
+
+		cmd = append(cmd, make([]byte, payloadLen)...)
+		_, err = io.ReadFull(reader, cmd[btrfsSendCmdHeaderLen:])
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading send stream command: %w", err)
+		}
+
+		if cmdType == btrfsSendCmdSubvol || cmdType == btrfsSendCmdSnapshot {
+			err = finish()
+			if err != nil {
+				return nil, err
+			}
+
+			subvol, err := parseBtrfsStreamSubvolume(cmd[btrfsSendCmdHeaderLen:])
+			if err != nil {
+				return nil, err
+			}
+
+			if cmdType == btrfsSendCmdSnapshot && !known[subvol.ParentUUID] {
+				return nil, fmt.Errorf("Parent %q of subvolume %q isn't available", subvol.ParentUUID, subvol.Name)
+			}
+
+			dir := filepath.Join(receiveDir, strconv.Itoa(len(received)))
+			err = os.Mkdir(dir, 0700)
+			if err != nil {
+				return nil, fmt.Errorf("Failed creating directory %q: %w", dir, err)
+			}
+
+			subvol.Path = filepath.Join(dir, subvol.Name)
+			current = &subvol
+
+			var pipeReader *io.PipeReader
+			pipeReader, pipeWriter = io.Pipe()
+			receiveErr = make(chan error, 1)
+			go func(dir string) {
+				err := receive(dir, pipeReader)
+
+				// Unblock the stream if the receiver stopped reading.
+				_ = pipeReader.CloseWithError(io.ErrClosedPipe)
+				receiveErr <- err
+			}(dir)
+
+			// Each subvolume is received from a stream of its own.
+			err = write(streamHeader)
+			if err != nil {
+				return nil, err
+			}
+		} else if current == nil {
+			if cmdType == btrfsSendCmdEnd {
+				continue
+			}
+
+			return nil, fmt.Errorf("Unexpected send stream command %d outside of a subvolume", cmdType)
+		}
+
+		err = write(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		if cmdType == btrfsSendCmdEnd {
+			err = finish()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A stream ending before the end command of its last subvolume was interrupted.
+	if current != nil {
+		return nil, fmt.Errorf("Send stream of subvolume %q is incomplete", current.Name)
+	}
+
+	return received, nil
+}
+
+// exportVolumeStream writes a btrfs send stream of the volume's snapshots (ordered from oldest to newest)
+// followed by the volume itself to w, each subvolume being sent relative to the previous one.
+// Only root subvolumes are included.
+func (d *btrfs) exportVolumeStream(vol Volume, snapshots []string, w io.Writer) error {
+	paths := make([]string, 0, len(snapshots)+1)
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+		paths = append(paths, snapVol.MountPath())
+	}
+
+	// The volume itself must be read-only to be sent, so send a temporary snapshot of it.
+	volumesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
+	tmpDir, err := os.MkdirTemp(volumesPath, "export.")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", volumesPath, err)
+	}
+
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	tmpPath := filepath.Join(tmpDir, vol.name)
+	_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", vol.MountPath(), tmpPath)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = d.deleteSubvolume(tmpPath, false) }()
+
+	return btrfsSnapshotExport(w, append(paths, tmpPath))
+}
+
+// importVolumeStream restores the volume and its snapshots from a btrfs send stream generated by
+// exportVolumeStream. The subvolumes are received in order, all but the last one being restored as snapshots
+// named after the sent subvolumes and the last one as the volume itself. If set, verify is called with the
+// received subvolumes once the whole stream has been received and nothing is restored if it fails.
+func (d *btrfs) importVolumeStream(vol Volume, r io.Reader, verify func(subvols []btrfsStreamSubvolume) error) error {
+	exists, _, err := d.volumeExists(vol)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("Cannot restore volume, already exists on target")
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Parents can also be subvolumes already on the pool, matched either directly or by received UUID.
+	poolSubvolumes, err := d.getSubvolumesUUIDs(d.name)
+	if err != nil {
+		return err
+	}
+
+	knownUUIDs := make(map[string]bool, len(poolSubvolumes)*2)
+	for _, subvol := range poolSubvolumes {
+		knownUUIDs[subvol.UUID] = true
+		if subvol.ReceivedUUID != "" {
+			knownUUIDs[subvol.ReceivedUUID] = true
+		}
+	}
+
+	volumesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
+	tmpDir, err := os.MkdirTemp(volumesPath, "import.")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", volumesPath, err)
+	}
+
+	// Delete the subvolumes still in the temporary directory, such as those partially received or not restored
+	// because of a failure, before removing it.
+	defer func() {
+		entries, _ := os.ReadDir(tmpDir)
+		for _, entry := range entries {
+			_ = d.deleteSubvolume(filepath.Join(tmpDir, entry.Name()), true)
+		}
+
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	subvols, err := btrfsSnapshotImport(runBtrfsCommand, btrfsReceive, r, tmpDir, knownUUIDs)
+	if err != nil {
+		return err
+	}
+
+	if len(subvols) == 0 {
+		return fmt.Errorf("No subvolume found in stream")
+	}
+
+	if verify != nil {
+		err = verify(subvols)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move the snapshots into place, oldest first.
+	snapshots := subvols[:len(subvols)-1]
+	if len(snapshots) > 0 {
+		err = createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, subvol := range snapshots {
+		snapVol, err := vol.NewSnapshot(subvol.Name)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(subvol.Path, snapVol.MountPath())
+		if err != nil {
+			return fmt.Errorf("Failed restoring snapshot %q: %w", subvol.Name, err)
+		}
+
+		target := snapVol.MountPath()
+		revert.Add(func() { _ = d.deleteSubvolume(target, false) })
+	}
+
+	// Received subvolumes are read-only, make the volume writable before moving it into place.
+	main := subvols[len(subvols)-1]
+	err = d.setSubvolumeReadonlyProperty(main.Path, false)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(main.Path, vol.MountPath())
+	if err != nil {
+		return fmt.Errorf("Failed restoring volume %q: %w", vol.name, err)
+	}
+
+	revert.Success()
+	return nil
+}
+
+// btrfsLeaseXattr is the extended attribute recording which node currently operates on a subvolume.
+// It is in the trusted namespace so that it can't be altered from within the instances.
+const btrfsLeaseXattr = "trusted.lxd.lease"
+
+// btrfsLease is the ownership marker of a subvolume: the node operating on it and when its lease expires.
+type btrfsLease struct {
+	Node   string
+	Expiry time.Time
+}
+
+// btrfsReadLease returns the lease recorded on the subvolume at path, or nil if it has none.
+func btrfsReadLease(path string) (*btrfsLease, error) {
+	buf := make([]byte, 512)
+	n, err := unix.Getxattr(path, btrfsLeaseXattr, buf)
+	if err != nil {
+		if err == unix.ENODATA {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed reading lease of %q: %w", path, err)
+	}
+
+	fields := strings.Fields(string(buf[:n]))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Invalid lease %q on %q", string(buf[:n]), path)
+	}
+
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid lease expiry %q on %q: %w", fields[1], path, err)
+	}
+
+	return &btrfsLease{Node: fields[0], Expiry: time.Unix(expiry, 0)}, nil
+}
+
+// btrfsWriteLease records the lease on the subvolume at path.
+func btrfsWriteLease(path string, lease btrfsLease) error {
+	value := fmt.Sprintf("%s %d", lease.Node, lease.Expiry.Unix())
+	err := unix.Setxattr(path, btrfsLeaseXattr, []byte(value), 0)
+	if err != nil {
+		return fmt.Errorf("Failed writing lease of %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// btrfsAcquireLease leases the subvolume at path to node for duration from now, renewing the lease if the node
+// already holds it. It fails if another node holds a lease which hasn't expired yet, an expired lease being
+// taken over so that the subvolumes of dead nodes don't stay locked. The lease is checked and written while
+// holding an exclusive flock of the subvolume, so that concurrent acquisitions can't both succeed.
+func btrfsAcquireLease(path string, node string, duration time.Duration, now time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed opening %q: %w", path, err)
+	}
+
+	// Closing the file releases the lock.
+	defer func() { _ = f.Close() }()
+
+	err = filesystem.RetryEINTR(func() error { return unix.Flock(int(f.Fd()), unix.LOCK_EX) })
+	if err != nil {
+		return fmt.Errorf("Failed locking %q: %w", path, err)
+	}
+
+	lease, err := btrfsReadLease(path)
+	if err != nil {
+		return err
+	}
+
+	if lease != nil && lease.Node != node && now.Before(lease.Expiry) {
+		return fmt.Errorf("Subvolume %q is leased by node %q until %s", path, lease.Node, lease.Expiry.UTC().Format(time.RFC3339))
+	}
+
+	return btrfsWriteLease(path, btrfsLease{Node: node, Expiry: now.Add(duration)})
+}
+
+// btrfsBaseImageXattr is the extended attribute recording on the subvolume of an instance the fingerprint of the
+// image it was created from, so that its provenance is carried along by btrfs send streams.
+const btrfsBaseImageXattr = "trusted.lxd.base_image"
+
+// btrfsWriteBaseImage records the fingerprint of the image the subvolume at path was created from.
+func btrfsWriteBaseImage(path string, fingerprint string) error {
+	err := unix.Setxattr(path, btrfsBaseImageXattr, []byte(fingerprint), 0)
+	if err != nil {
+		return fmt.Errorf("Failed recording base image of %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// btrfsReadBaseImage returns the fingerprint of the image the subvolume at path was created from, or an empty
+// string if it isn't recorded.
+func btrfsReadBaseImage(path string) (string, error) {
+	buf := make([]byte, 128)
+	n, err := unix.Getxattr(path, btrfsBaseImageXattr, buf)
+	if err != nil {
+		if err == unix.ENODATA {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Failed reading base image of %q: %w", path, err)
+	}
+
+	return string(buf[:n]), nil
+}
+
+// leaseVolume leases the subvolume of the volume to this node before it is modified when the pool has
+// "btrfs.lease_duration" set, failing if another node currently holds it. Snapshots are read-only so the lease of
+// their parent volume is used for them.
+func (d *btrfs) leaseVolume(vol Volume) error {
+	duration, _ := strconv.ParseUint(d.config["btrfs.lease_duration"], 10, 32)
+	if duration == 0 {
+		return nil
+	}
+
+	// The lease is recorded in a trusted extended attribute, which can't be written from a user namespace.
+	if d.state.OS.RunningInUserNS {
+		return fmt.Errorf("Cannot lease subvolumes in a user namespace: %w", ErrNotSupported)
+	}
+
+	path := vol.MountPath()
+	if vol.IsSnapshot() {
+		parentName, _, _ := api.GetParentAndSnapshotName(vol.name)
+		path = getVolumeMountPath(d.name, d.config, vol.volType, parentName)
+	}
+
+	node := "none"
+	if d.state != nil && d.state.ServerName != "" {
+		node = d.state.ServerName
+	}
+
+	return btrfsAcquireLease(path, node, time.Duration(duration)*time.Second, time.Now())
+}
+
+// snapshotsListPrefix returns the prefix of the paths of the volume's snapshots in the output of
+// "btrfs subvolume list" on the pool, which lists the paths relative to the root of the filesystem.
+func (d *btrfs) snapshotsListPrefix(vol Volume) (string, error) {
+	snapshotDir := vol.SnapshotsDir()
+
+	relPath, err := d.PoolRelPath(snapshotDir)
+	if err != nil {
+		return "", err
+	}
+
+	base := d.config["snapshots.mount_base"]
+	if base == "" {
+		return fmt.Sprintf("%s/", relPath), nil
+	}
+
+	// The snapshots are under snapshots.mount_base, so on another mount of the pool's filesystem.
+	snapshotDir = filepath.Join(GetPoolSnapshotsPath(d.name, base), relPath)
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", fmt.Errorf("Failed opening mountinfo: %w", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	fsPath, err := parseMountInfoFilesystemPath(f, snapshotDir)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/", strings.TrimPrefix(fsPath, "/")), nil
+}
+
+// btrfsListSnapshotsInfo returns the metadata of the snapshot subvolumes directly within the directory whose path
+// relative to the filesystem root is snapshotPrefix, in creation order. All the subvolumes of the pool mounted at
+// poolMount are listed with a single command.
+func btrfsListSnapshotsInfo(run btrfsCommandFunc, poolMount string, snapshotPrefix string) ([]VolumeSnapshotInfo, error) {
+	output, err := run("subvolume", "list", "-u", "-q", "-R", poolMount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing subvolumes of %q: %w", poolMount, err)
+	}
+
+	return parseBtrfsSnapshotsInfo(output, snapshotPrefix)
+}
+
+// parseBtrfsSnapshotsInfo parses the output of "btrfs subvolume list -u -q -R" and returns the metadata of the
+// subvolumes directly within snapshotPrefix, in the listing order which is the order of creation.
+func parseBtrfsSnapshotsInfo(output string, snapshotPrefix string) ([]VolumeSnapshotInfo, error) {
+	snapshots := []VolumeSnapshotInfo{}
+
+	for _, line := range strings.Split(output, "\n") {
+		// Expect "ID <id> gen <gen> top level <id> parent_uuid <uuid> received_uuid <uuid> uuid <uuid> path <path>".
+		columns, path, found := strings.Cut(line, " path ")
+		if !found || !strings.HasPrefix(path, snapshotPrefix) {
+			continue
+		}
+
+		// Exclude subvolumes of snapshots.
+		name := strings.TrimPrefix(path, snapshotPrefix)
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+
+		values := map[string]string{}
+		fields := strings.Fields(strings.Replace(columns, "top level", "top_level", 1))
+		for i := 0; i+1 < len(fields); i += 2 {
+			value := fields[i+1]
+			if value == "-" {
+				value = ""
+			}
+
+			values[fields[i]] = value
+		}
+
+		generation, err := strconv.ParseUint(values["gen"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid generation of subvolume %q: %w", path, err)
+		}
+
+		snapshots = append(snapshots, VolumeSnapshotInfo{
+			Name:         name,
+			Generation:   generation,
+			UUID:         values["uuid"],
+			ParentUUID:   values["parent_uuid"],
+			ReceivedUUID: values["received_uuid"],
+		})
+	}
+
+	return snapshots, nil
+}
+
+// btrfsFileFlags are the inode flags (as set by chattr) which can be set on the root directory of volumes with
+// "btrfs.file_flags", keyed by name.
+var btrfsFileFlags = map[string]uint32{
+	"append":     0x00000020, // FS_APPEND_FL (chattr +a)
+	"compress":   0x00000004, // FS_COMPR_FL (chattr +c)
+	"dirsync":    0x00010000, // FS_DIRSYNC_FL (chattr +D)
+	"immutable":  0x00000010, // FS_IMMUTABLE_FL (chattr +i)
+	"noatime":    0x00000080, // FS_NOATIME_FL (chattr +A)
+	"nocompress": 0x00000400, // FS_NOCOMP_FL (chattr +m)
+	"nodatacow":  0x00800000, // FS_NOCOW_FL (chattr +C)
+	"nodump":     0x00000040, // FS_NODUMP_FL (chattr +d)
+	"sync":       0x00000008, // FS_SYNC_FL (chattr +S)
+}
+
+// btrfsCreationFileFlags are the flags which only apply to the files created after they are set. They are set
+// before the volume is filled and can't be changed afterwards.
+var btrfsCreationFileFlags = []string{"compress", "nocompress", "nodatacow"}
+
+// btrfsProtectionFileFlags are the flags preventing the entries of the volume's root directory from being
+// removed or renamed. They are set once the volume is filled and only allowed on custom volumes, as LXD keeps its
+// own files at the root of instance and image volumes.
+var btrfsProtectionFileFlags = []string{"append", "immutable"}
+
+// btrfsConflictingFileFlags are the pairs of flags which can't be combined.
+var btrfsConflictingFileFlags = [][2]string{
+	{"append", "immutable"},
+	{"compress", "nocompress"},
+	{"compress", "nodatacow"},
+}
+
+// parseBtrfsFileFlags parses a comma separated list of file flag names, rejecting the unknown ones and the
+// conflicting combinations. Returns the flag names sorted.
+func parseBtrfsFileFlags(value string) ([]string, error) {
+	flags := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		_, ok := btrfsFileFlags[name]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported file flag %q", name)
+		}
+
+		if !shared.StringInSlice(name, flags) {
+			flags = append(flags, name)
+		}
+	}
+
+	for _, conflict := range btrfsConflictingFileFlags {
+		if shared.StringInSlice(conflict[0], flags) && shared.StringInSlice(conflict[1], flags) {
+			return nil, fmt.Errorf("File flags %q and %q can't be combined", conflict[0], conflict[1])
+		}
+	}
+
+	sort.Strings(flags)
+
+	return flags, nil
+}
+
+// validateBtrfsFileFlags validates the "btrfs.file_flags" volume option.
+func validateBtrfsFileFlags(value string) error {
+	_, err := parseBtrfsFileFlags(value)
 	return err
 }
 
-// BTRFSSubVolume is the structure used to store information about a subvolume.
-// Note: This is used by both migration and backup subsystems so do not modify without considering both!
-type BTRFSSubVolume struct {
-	Path     string `json:"path" yaml:"path"`         // Path inside the volume where the subvolume belongs (so / is the top of the volume tree).
-	Snapshot string `json:"snapshot" yaml:"snapshot"` // Snapshot name the subvolume belongs to.
-	Readonly bool   `json:"readonly" yaml:"readonly"` // Is the sub volume read only or not.
-	UUID     string `json:"uuid" yaml:"uuid"`         // The subvolume UUID.
+// btrfsFileFlagsMask returns the inode flags of the named file flags which are in (or not in if exclude is true)
+// the subset of names.
+func btrfsFileFlagsMask(flags []string, subset []string, exclude bool) uint32 {
+	var mask uint32
+	for _, name := range flags {
+		if shared.StringInSlice(name, subset) != exclude {
+			mask |= btrfsFileFlags[name]
+		}
+	}
+
+	return mask
+}
+
+// btrfsSetFileFlags sets the inode flags in set and clears the ones in clear on path.
+func btrfsSetFileFlags(path string, set uint32, clear uint32) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed opening %q: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return fmt.Errorf("Failed getting file flags of %q: %w", path, err)
+	}
+
+	newFlags := (flags | set) &^ clear
+	if newFlags == flags {
+		return nil
+	}
+
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(newFlags))
+	if err != nil {
+		return fmt.Errorf("Failed setting file flags of %q: %w", path, err)
+	}
+
+	return nil
+}
+
+// btrfsGetFileFlags returns the inode flags of path.
+func btrfsGetFileFlags(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Failed opening %q: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return 0, fmt.Errorf("Failed getting file flags of %q: %w", path, err)
+	}
+
+	return flags, nil
+}
+
+// validateVolumeFileFlags checks that the protection file flags are only set on custom volumes.
+func validateVolumeFileFlags(vol Volume) error {
+	flags, err := parseBtrfsFileFlags(vol.ExpandedConfig("btrfs.file_flags"))
+	if err != nil {
+		return err
+	}
+
+	if vol.volType == VolumeTypeCustom {
+		return nil
+	}
+
+	for _, name := range btrfsProtectionFileFlags {
+		if shared.StringInSlice(name, flags) {
+			return fmt.Errorf("File flag %q can only be set on custom volumes", name)
+		}
+	}
+
+	return nil
+}
+
+// applyFileFlags sets the file flags of the volume's "btrfs.file_flags" on its root directory: the creation flags
+// if creation is true, which must be done before the volume is filled, and the other flags otherwise.
+func (d *btrfs) applyFileFlags(vol Volume, creation bool) error {
+	flags, err := parseBtrfsFileFlags(vol.ExpandedConfig("btrfs.file_flags"))
+	if err != nil {
+		return err
+	}
+
+	set := btrfsFileFlagsMask(flags, btrfsCreationFileFlags, !creation)
+	if set == 0 {
+		return nil
+	}
+
+	return btrfsSetFileFlags(vol.MountPath(), set, 0)
+}
+
+// applyCopiedFileFlags sets all the file flags of the volume's "btrfs.file_flags" on the root directory of a volume
+// whose files were copied or received rather than created in it. The copied files keep their own flags, the
+// creation flags only apply to the files created afterwards.
+func (d *btrfs) applyCopiedFileFlags(vol Volume) error {
+	for _, creation := range []bool{true, false} {
+		err := d.applyFileFlags(vol, creation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// btrfsCreationFileFlagsVolume returns a copy of vol whose "btrfs.file_flags" only keeps the creation flags, for
+// creating it through the generic functions which fill it after CreateVolume returns and would otherwise be
+// prevented from doing so by flags such as "immutable". The other flags are applied once it's filled.
+func btrfsCreationFileFlagsVolume(vol Volume) (Volume, error) {
+	flags, err := parseBtrfsFileFlags(vol.ExpandedConfig("btrfs.file_flags"))
+	if err != nil {
+		return Volume{}, err
+	}
+
+	creationFlags := []string{}
+	for _, name := range flags {
+		if shared.StringInSlice(name, btrfsCreationFileFlags) {
+			creationFlags = append(creationFlags, name)
+		}
+	}
+
+	config := make(map[string]string, len(vol.config)+1)
+	for k, v := range vol.config {
+		config[k] = v
+	}
+
+	config["btrfs.file_flags"] = strings.Join(creationFlags, ",")
+
+	newVol := vol
+	newVol.config = config
+
+	return newVol, nil
+}
+
+// checkNoProtectionFileFlags returns an error if the volume has a file flag preventing it from being moved, as the
+// operation would fail on it.
+func (d *btrfs) checkNoProtectionFileFlags(vol Volume, operation string) error {
+	flags, err := parseBtrfsFileFlags(vol.ExpandedConfig("btrfs.file_flags"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range btrfsProtectionFileFlags {
+		if shared.StringInSlice(name, flags) {
+			return fmt.Errorf("Volumes with the %q file flag can't be %s, remove it from %q first", name, operation, "btrfs.file_flags")
+		}
+	}
+
+	return nil
+}
+
+// updateFileFlags changes the file flags of the volume's root directory from its current "btrfs.file_flags" to
+// value. The creation flags can't be changed as they wouldn't apply to the existing files.
+func (d *btrfs) updateFileFlags(vol Volume, value string) error {
+	oldFlags, err := parseBtrfsFileFlags(vol.ExpandedConfig("btrfs.file_flags"))
+	if err != nil {
+		return err
+	}
+
+	newFlags, err := parseBtrfsFileFlags(value)
+	if err != nil {
+		return err
+	}
+
+	if btrfsFileFlagsMask(oldFlags, btrfsCreationFileFlags, false) != btrfsFileFlagsMask(newFlags, btrfsCreationFileFlags, false) {
+		return fmt.Errorf("The %q file flags can only be set when creating the volume", strings.Join(btrfsCreationFileFlags, ", "))
+	}
+
+	set := btrfsFileFlagsMask(newFlags, btrfsCreationFileFlags, true)
+	clear := btrfsFileFlagsMask(oldFlags, btrfsCreationFileFlags, true) &^ set
+
+	return btrfsSetFileFlags(vol.MountPath(), set, clear)
+}
+
+// btrfsPathSnapshotsDir returns the base directory holding the snapshots of paths within the volumes of volType,
+// in a directory per volume like the volume snapshots.
+func btrfsPathSnapshotsDir(volType VolumeType) string {
+	dirs := BaseDirectories[volType]
+	if len(dirs) < 3 {
+		return ""
+	}
+
+	return dirs[2]
 }
 
-// getSubvolumesMetaData retrieves subvolume meta data with paths relative to the root volume.
-// The first item in the returned list is the root subvolume itself.
-func (d *btrfs) getSubvolumesMetaData(vol Volume) ([]BTRFSSubVolume, error) {
-	var subVols []BTRFSSubVolume
+// btrfsPathSnapshotsPath returns the directory holding the snapshots of paths within the volume.
+func btrfsPathSnapshotsPath(poolName string, poolConfig map[string]string, volType VolumeType, volName string) string {
+	return getPoolEntryPath(poolName, poolConfig, btrfsPathSnapshotsDir(volType), volName)
+}
+
+// btrfsIsPathSnapshotOfManaged returns whether subvol (relative to the pool) is a snapshot of a path within one of
+// the managed volumes, whose relative paths in the given pool layout are the keys of managed.
+func btrfsIsPathSnapshotOfManaged(subvol string, managed map[string]bool, layout string, volTypes []VolumeType) bool {
+	for _, volType := range volTypes {
+		dir := btrfsPathSnapshotsDir(volType)
+		if dir == "" {
+			continue
+		}
+
+		volName, _, ok := splitPoolLayoutEntryPath(layout, dir, subvol)
+		if !ok {
+			continue
+		}
+
+		return managed[poolLayoutEntryPath(layout, BaseDirectories[volType][0], volName)]
+	}
+
+	return false
+}
+
+// btrfsSnapshotPath creates a read-only snapshot at snapPath of only the directory at relPath within the volume
+// at volPath. As only subvolumes can be snapshotted, the directory is first replaced by a subvolume holding the
+// same content (reflinked from it) and accounted like the volume, unless it's already one (e.g. converted by an
+// earlier snapshot). The directory must be within the volume, symlinks included, and mustn't contain a subvolume.
+func btrfsSnapshotPath(run btrfsCommandFunc, isSubvolume func(string) bool, volPath string, relPath string, snapPath string) error {
+	realVolPath, err := filepath.EvalSymlinks(volPath)
+	if err != nil {
+		return fmt.Errorf("Failed resolving %q: %w", volPath, err)
+	}
+
+	// Resolve symlinks so that a path leading outside of the volume is rejected.
+	path, err := filepath.EvalSymlinks(filepath.Join(realVolPath, filepath.Join("/", relPath)))
+	if err != nil {
+		return fmt.Errorf("Failed resolving %q within the volume: %w", relPath, err)
+	}
+
+	_, err = relPathUnder(realVolPath, path)
+	if err != nil || path == realVolPath {
+		return fmt.Errorf("Path %q isn't a directory within the volume", relPath)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Failed checking %q: %w", path, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("Path %q isn't a directory", relPath)
+	}
+
+	// Subvolumes within the directory would be copied as plain directories.
+	err = filepath.WalkDir(path, func(subPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if subPath != path && entry.IsDir() && isSubvolume(subPath) {
+			return fmt.Errorf("Path %q contains subvolume %q", relPath, subPath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if shared.PathExists(snapPath) {
+		return fmt.Errorf("Snapshot %q already exists", snapPath)
+	}
+
+	if isSubvolume(path) {
+		err = os.MkdirAll(filepath.Dir(snapPath), 0700)
+		if err != nil {
+			return fmt.Errorf("Failed creating snapshot directory: %w", err)
+		}
+
+		_, err = run("subvolume", "snapshot", "-r", path, snapPath)
+		if err != nil {
+			return fmt.Errorf("Failed snapshotting %q: %w", path, err)
+		}
+
+		return nil
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	newPath := path + ".lxd-subvol"
+	oldPath := path + ".lxd-dir"
+	for _, tmpPath := range []string{newPath, oldPath} {
+		if shared.PathExists(tmpPath) {
+			return fmt.Errorf("Temporary path %q already exists", tmpPath)
+		}
+	}
+
+	_, err = run("subvolume", "create", newPath)
+	if err != nil {
+		return fmt.Errorf("Failed creating subvolume %q: %w", newPath, err)
+	}
+
+	revert.Add(func() { _, _ = run("subvolume", "delete", newPath) })
+
+	// The space used by the subvolume would otherwise escape the quota of the volume.
+	err = btrfsSubVolumeInheritQGroup(run, realVolPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	// Copying the content of the directory onto the subvolume also copies the mode and ownership of the directory.
+	_, err = shared.RunCommand("cp", "-a", "--reflink=auto", path+"/.", newPath)
+	if err != nil {
+		return fmt.Errorf("Failed copying %q to subvolume %q: %w", path, newPath, err)
+	}
+
+	err = os.Rename(path, oldPath)
+	if err != nil {
+		return fmt.Errorf("Failed moving %q: %w", path, err)
+	}
+
+	revert.Add(func() { _ = os.Rename(oldPath, path) })
+
+	err = os.Rename(newPath, path)
+	if err != nil {
+		return fmt.Errorf("Failed moving subvolume %q to %q: %w", newPath, path, err)
+	}
+
+	revert.Add(func() { _ = os.Rename(path, newPath) })
+
+	err = os.MkdirAll(filepath.Dir(snapPath), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating snapshot directory: %w", err)
+	}
+
+	_, err = run("subvolume", "snapshot", "-r", path, snapPath)
+	if err != nil {
+		return fmt.Errorf("Failed snapshotting %q: %w", path, err)
+	}
+
+	revert.Success()
+
+	err = os.RemoveAll(oldPath)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", oldPath, err)
+	}
+
+	return nil
+}
+
+// snapshotsQuota returns the "btrfs.snapshots_quota" pool setting in bytes, 0 if unset.
+func (d *btrfs) snapshotsQuota() (int64, error) {
+	if d.config["btrfs.snapshots_quota"] == "" {
+		return 0, nil
+	}
+
+	return units.ParseByteSizeString(d.config["btrfs.snapshots_quota"])
+}
+
+// createSnapshotsDir makes sure the directory holding the snapshots of the volume exists, as a subvolume bounded
+// by the "btrfs.snapshots_quota" pool setting if it is set, and returns the qgroup the new snapshots must be
+// assigned to (empty if their space isn't bounded).
+func (d *btrfs) createSnapshotsDir(volType VolumeType, volName string) (string, error) {
+	size, err := d.snapshotsQuota()
+	if err != nil {
+		return "", err
+	}
+
+	createSubvolume := func(path string) error { return btrfsSubVolumeCreate(path, 0700, nil) }
+	snapshotsPath := getVolumeSnapshotDir(d.name, d.config, volType, volName)
+
+	qgroup, err := btrfsCreateSnapshotsDir(runBtrfsCommand, d.isSubvolume, createSubvolume, snapshotsPath, size)
+	if err != nil {
+		return "", err
+	}
+
+	if size > 0 && qgroup == "" {
+		d.logger.Warn("Snapshots aren't bounded by btrfs.snapshots_quota as their directory predates it", logger.Ctx{"path": snapshotsPath})
+	}
+
+	return qgroup, nil
+}
+
+// applySnapshotsQuota applies the "btrfs.snapshots_quota" pool setting to the snapshots directories of the existing
+// volumes, warning about those which can't be bounded.
+func (d *btrfs) applySnapshotsQuota() error {
+	size, err := d.snapshotsQuota()
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for _, volType := range d.Info().VolumeTypes {
+		dirs := BaseDirectories[volType]
+		if len(dirs) < 2 {
+			continue
+		}
+
+		names, err := listPoolLayoutEntries(GetPoolMountPath(d.name), d.config["btrfs.layout"], dirs[1])
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			paths = append(paths, getVolumeSnapshotDir(d.name, d.config, volType, name))
+		}
+	}
+
+	unbounded, err := btrfsApplySnapshotsQuota(runBtrfsCommand, d.isSubvolume, paths, size)
+	if err != nil {
+		return err
+	}
+
+	if size > 0 && len(unbounded) > 0 {
+		d.logger.Warn("Snapshots aren't bounded by btrfs.snapshots_quota as their directories predate it", logger.Ctx{"paths": unbounded})
+	}
+
+	return nil
+}
+
+// deleteSnapshotsDirIfEmpty removes the directory holding the snapshots of the volume if it is empty.
+func (d *btrfs) deleteSnapshotsDirIfEmpty(volType VolumeType, volName string) error {
+	err := btrfsDeleteSnapshotsDirIfEmpty(runBtrfsCommand, d.isSubvolume, d.config, getVolumeSnapshotDir(d.name, d.config, volType, volName))
+	if err != nil {
+		return err
+	}
+
+	return deleteParentSnapshotDirIfEmpty(d.name, d.config, volType, volName)
+}
+
+// btrfsSnapshotsQGroup returns the level 1 qgroup bounding the snapshots stored in the snapshots subvolume whose
+// ID is id.
+func btrfsSnapshotsQGroup(id string) string {
+	return fmt.Sprintf("1/%s", id)
+}
+
+// btrfsSubVolumeSetQuota creates the level 1 qgroup of the subvolume at path and limits the space referenced by
+// the subvolumes assigned to it to size bytes. The qgroup of a subvolume only accounts for its own extents and not
+// for those of the subvolumes nested in it, so these must be assigned to the returned qgroup to be bounded.
+func btrfsSubVolumeSetQuota(run btrfsCommandFunc, path string, size int64) (string, error) {
+	output, err := run("inspect-internal", "rootid", path)
+	if err != nil {
+		return "", fmt.Errorf("Failed getting subvolume ID of %q: %w", path, err)
+	}
+
+	qgroup := btrfsSnapshotsQGroup(strings.TrimSpace(output))
+
+	_, err = run("qgroup", "create", qgroup, path)
+	if err != nil {
+		return "", fmt.Errorf("Failed creating qgroup %q: %w", qgroup, err)
+	}
+
+	_, err = run("qgroup", "limit", fmt.Sprintf("%d", size), qgroup, path)
+	if err != nil {
+		_, _ = run("qgroup", "destroy", qgroup, path)
+		return "", fmt.Errorf("Failed applying qgroup limit to %q: %w", qgroup, err)
+	}
+
+	return qgroup, nil
+}
+
+// btrfsCreateSnapshotsDir makes sure the directory holding the snapshots of a volume exists at snapshotsPath and
+// returns the qgroup the new snapshots must be assigned to, or an empty string if their space isn't bounded. When
+// size is greater than 0, a missing directory is created as a subvolume by createSubvolume and its qgroup limits
+// the combined space of the snapshots to size bytes. An existing empty directory which isn't a subvolume is
+// replaced by such a subvolume, while a non-empty one is left as is and its snapshots aren't bounded. Fails if the
+// space of the snapshots of an existing snapshots subvolume has reached its limit, without affecting the volume
+// itself.
+func btrfsCreateSnapshotsDir(run btrfsCommandFunc, isSubvolume func(path string) bool, createSubvolume func(path string) error, snapshotsPath string, size int64) (string, error) {
+	if size > 0 && shared.PathExists(snapshotsPath) && !isSubvolume(snapshotsPath) {
+		isEmpty, err := shared.PathIsEmpty(snapshotsPath)
+		if err != nil {
+			return "", err
+		}
+
+		if isEmpty {
+			err = os.Remove(snapshotsPath)
+			if err != nil {
+				return "", fmt.Errorf("Failed removing empty snapshots directory %q: %w", snapshotsPath, err)
+			}
+		}
+	}
+
+	if !shared.PathExists(snapshotsPath) {
+		if size <= 0 {
+			err := os.Mkdir(snapshotsPath, 0700)
+			if err != nil {
+				return "", fmt.Errorf("Failed to create parent snapshot directory %q: %w", snapshotsPath, err)
+			}
+
+			return "", nil
+		}
+
+		err := createSubvolume(snapshotsPath)
+		if err != nil {
+			return "", err
+		}
+
+		qgroup, err := btrfsSubVolumeSetQuota(run, snapshotsPath, size)
+		if err != nil {
+			_, _ = run("subvolume", "delete", snapshotsPath)
+			return "", err
+		}
+
+		return qgroup, nil
+	}
+
+	if !isSubvolume(snapshotsPath) {
+		return "", nil
+	}
+
+	qgroup, usage, limit, err := btrfsSubVolumeQuotaUsage(run, snapshotsPath)
+	if err != nil || qgroup == "" {
+		return "", err
+	}
+
+	if limit >= 0 && usage >= limit {
+		return "", fmt.Errorf("Snapshots in %q have reached their quota of %d bytes", snapshotsPath, limit)
+	}
+
+	return qgroup, nil
+}
+
+// btrfsApplySnapshotsQuota limits the combined space of the snapshots held in each of the snapshots subvolumes at
+// paths to size bytes (unlimited if size is 0), through the qgroups set by btrfsSubVolumeSetQuota. The non-empty
+// directories which aren't such subvolumes, such as those created while no quota was set, are returned as their
+// snapshots can't be bounded. Empty ones are turned into subvolumes by btrfsCreateSnapshotsDir when next used.
+func btrfsApplySnapshotsQuota(run btrfsCommandFunc, isSubvolume func(path string) bool, paths []string, size int64) ([]string, error) {
+	limit := "none"
+	if size > 0 {
+		limit = fmt.Sprintf("%d", size)
+	}
+
+	unbounded := []string{}
+	for _, path := range paths {
+		qgroup := ""
+		if isSubvolume(path) {
+			var err error
+			qgroup, _, _, err = btrfsSubVolumeQuotaUsage(run, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if qgroup == "" {
+			isEmpty, err := shared.PathIsEmpty(path)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isEmpty {
+				unbounded = append(unbounded, path)
+			}
+
+			continue
+		}
+
+		_, err := run("qgroup", "limit", limit, qgroup, path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed applying qgroup limit to %q: %w", qgroup, err)
+		}
+	}
+
+	return unbounded, nil
+}
+
+// btrfsSubVolumeQuotaUsage returns the level 1 qgroup set by btrfsSubVolumeSetQuota on the subvolume at path,
+// along with the space referenced by the subvolumes assigned to it and its limit. The returned qgroup is empty if
+// the subvolume has no such qgroup, such as when it was created by something else than LXD, and the limit is -1
+// if the qgroup isn't limited.
+func btrfsSubVolumeQuotaUsage(run btrfsCommandFunc, path string) (string, int64, int64, error) {
+	output, err := run("inspect-internal", "rootid", path)
+	if err != nil {
+		return "", -1, -1, fmt.Errorf("Failed getting subvolume ID of %q: %w", path, err)
+	}
+
+	qgroup := btrfsSnapshotsQGroup(strings.TrimSpace(output))
+
+	output, err = run("qgroup", "show", "-r", "--raw", path)
+	if err != nil {
+		return "", -1, -1, btrfsQGroupShowError(path, err)
+	}
+
+	limits, err := parseQGroupLimits(output)
+	if err != nil {
+		return "", -1, -1, err
+	}
+
+	usages, err := parseQGroupShow(output)
+	if err != nil {
+		return "", -1, -1, err
+	}
+
+	usage, ok := usages[qgroup]
+	if !ok {
+		return "", -1, -1, nil
+	}
+
+	limit, ok := limits[qgroup]
+	if !ok {
+		limit = -1
+	}
+
+	return qgroup, usage.Referenced, limit, nil
+}
+
+// btrfsDeleteSnapshotsDirIfEmpty deletes the snapshots subvolume at snapshotsPath, along with its qgroups, once
+// it no longer holds snapshots. Nothing is done if the directory doesn't exist or isn't a subvolume.
+func btrfsDeleteSnapshotsDirIfEmpty(run btrfsCommandFunc, isSubvolume func(path string) bool, poolConfig map[string]string, snapshotsPath string) error {
+	if !shared.PathExists(snapshotsPath) || !isSubvolume(snapshotsPath) {
+		return nil
+	}
+
+	isEmpty, err := shared.PathIsEmpty(snapshotsPath)
+	if err != nil || !isEmpty {
+		return err
+	}
+
+	if !shared.IsFalse(poolConfig["btrfs.manage_qgroups"]) {
+		output, err := run("inspect-internal", "rootid", snapshotsPath)
+		if err == nil {
+			_, _ = run("qgroup", "destroy", btrfsSnapshotsQGroup(strings.TrimSpace(output)), snapshotsPath)
+		}
+	}
+
+	btrfsDestroySubvolumeQGroup(run, poolConfig, snapshotsPath)
+
+	_, err = run("subvolume", "delete", snapshotsPath)
+	if err != nil {
+		return fmt.Errorf("Failed deleting snapshots subvolume %q: %w", snapshotsPath, err)
+	}
+
+	return nil
+}
+
+// btrfsLoopPoolGrow grows the loop file backing the mounted pool to newSizeBytes, along with its loop device and
+// filesystem. Shrinking isn't supported.
+func btrfsLoopPoolGrow(poolName string, newSizeBytes int64) error {
+	return btrfsLoopFileGrow(runBtrfsCommand, loopFilePath(poolName), GetPoolMountPath(poolName), newSizeBytes)
+}
+
+// btrfsLoopFileGrow grows the loop file at loopPath to newSizeBytes, then the loop device attached to it and the
+// filesystem mounted from it at mountPath. Returns ErrCannotBeShrunk if newSizeBytes is smaller than the size of
+// the loop file, as the space may be in use.
+func btrfsLoopFileGrow(run btrfsCommandFunc, loopPath string, mountPath string, newSizeBytes int64) error {
+	fi, err := os.Stat(loopPath)
+	if err != nil {
+		return fmt.Errorf("Failed getting size of loop file %q: %w", loopPath, err)
+	}
+
+	if newSizeBytes < fi.Size() {
+		return fmt.Errorf("Loop file %q of %d bytes can't be resized to %d bytes: %w", loopPath, fi.Size(), newSizeBytes, ErrCannotBeShrunk)
+	}
+
+	if newSizeBytes == fi.Size() {
+		return nil
+	}
 
-	snapName := ""
-	if vol.IsSnapshot() {
-		_, snapName, _ = api.GetParentAndSnapshotName(vol.name)
+	// Look for the loop device first so that the loop file isn't grown if the filesystem can't be.
+	loopDevPath, err := loopDeviceFind(loopPath)
+	if err != nil {
+		return fmt.Errorf("Failed finding loop device of %q: %w", loopPath, err)
 	}
 
-	// Add main root volume to subvolumes list first.
-	subVols = append(subVols, BTRFSSubVolume{
-		Snapshot: snapName,
-		Path:     string(filepath.Separator),
-		Readonly: BTRFSSubVolumeIsRo(vol.MountPath()),
-	})
+	if loopDevPath == "" {
+		return fmt.Errorf("Loop file %q isn't attached to a loop device", loopPath)
+	}
 
-	// Find any subvolumes in volume.
-	subVolPaths, err := d.getSubvolumes(vol.MountPath())
+	err = ensureSparseFile(loopPath, newSizeBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	sort.Strings(subVolPaths)
+	err = loopDeviceSetCapacity(loopDevPath)
+	if err != nil {
+		return err
+	}
 
-	// Add any subvolumes under the root subvolume with relative path to root.
-	for _, subVolPath := range subVolPaths {
-		subVols = append(subVols, BTRFSSubVolume{
-			Snapshot: snapName,
-			Path:     fmt.Sprintf("%s%s", string(filepath.Separator), subVolPath),
-			Readonly: BTRFSSubVolumeIsRo(filepath.Join(vol.MountPath(), subVolPath)),
-		})
+	_, err = run("filesystem", "resize", "max", mountPath)
+	if err != nil {
+		return fmt.Errorf("Failed growing filesystem mounted at %q: %w", mountPath, err)
 	}
 
-	stdout := strings.Builder{}
+	return nil
+}
 
-	poolMountPath := GetPoolMountPath(vol.pool)
+// btrfsTmpDir is the directory of the pool holding the temporary subvolumes of the driver, away from the volume
+// directories so that those left behind by a crash aren't taken for volumes.
+const btrfsTmpDir = "tmp"
 
-	if !d.state.OS.RunningInUserNS {
-		// List all subvolumes in the given filesystem with their UUIDs and received UUIDs.
-		err = shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", "-u", "-R", poolMountPath)
-		if err != nil {
-			return nil, err
-		}
+// Btrfs send stream commands changing entries.
+const (
+	btrfsSendCmdMkfile  = 3
+	btrfsSendCmdMkdir   = 4
+	btrfsSendCmdMknod   = 5
+	btrfsSendCmdMkfifo  = 6
+	btrfsSendCmdMksock  = 7
+	btrfsSendCmdSymlink = 8
+	btrfsSendCmdRename  = 9
+	btrfsSendCmdLink    = 10
+	btrfsSendCmdUnlink  = 11
+	btrfsSendCmdRmdir   = 12
+	btrfsSendCmdWrite   = 15
+	btrfsSendCmdChmod   = 18
+	btrfsSendCmdChown   = 19
+	btrfsSendCmdUtimes  = 20
+	btrfsSendAttrUID    = 6
+	btrfsSendAttrGID    = 7
+	btrfsSendAttrPathTo = 16
+)
 
-		uuidMap := make(map[string]string)
-		receivedUUIDMap := make(map[string]string)
+// btrfsSendStreamChanges tracks the paths changed by the commands of a btrfs send stream. The stream creates new
+// entries under temporary names before renaming them, and can rename replaced or deleted entries to temporary
+// names before deleting them, so the renames are followed to report the final paths.
+type btrfsSendStreamChanges struct {
+	added    map[string]bool
+	modified map[string]bool
+	deleted  map[string]bool
+	origins  map[string]string // Original path of the renamed existing entries, keyed by their current path.
+}
 
-		scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+// origin returns the path which the entry at path had in the parent subvolume.
+func (c *btrfsSendStreamChanges) origin(path string) string {
+	// Use the closest renamed entry as entries within a renamed directory can be renamed too.
+	match := ""
+	for current := range c.origins {
+		if (path == current || strings.HasPrefix(path, current+"/")) && len(current) > len(match) {
+			match = current
+		}
+	}
 
-		for scanner.Scan() {
-			fields := strings.Fields(scanner.Text())
+	if match == "" {
+		return path
+	}
 
-			if len(fields) != 13 {
-				continue
-			}
+	return c.origins[match] + path[len(match):]
+}
 
-			uuidMap[filepath.Join(poolMountPath, fields[12])] = fields[10]
+// rename follows the rename of the entry at from, and of the entries below it, to to.
+func (c *btrfsSendStreamChanges) rename(from string, to string) {
+	wasAdded := c.added[from]
+	orig := c.origin(from)
 
-			if fields[8] != "-" {
-				receivedUUIDMap[filepath.Join(poolMountPath, fields[12])] = fields[8]
+	move := func(paths map[string]bool) {
+		moved := []string{}
+		for path := range paths {
+			if path == from || strings.HasPrefix(path, from+"/") {
+				moved = append(moved, path)
 			}
 		}
 
-		for i, subVol := range subVols {
-			subVols[i].UUID = uuidMap[filepath.Join(vol.MountPath(), subVol.Path)]
+		for _, path := range moved {
+			delete(paths, path)
+			paths[to+path[len(from):]] = true
 		}
 	}
 
-	return subVols, nil
+	move(c.added)
+	move(c.modified)
+
+	for current := range c.origins {
+		if current == from || strings.HasPrefix(current, from+"/") {
+			c.origins[to+current[len(from):]] = c.origins[current]
+			delete(c.origins, current)
+		}
+	}
+
+	// An existing entry being moved is deleted from where it was and added where it goes.
+	if !wasAdded {
+		c.origins[to] = orig
+		c.deleted[orig] = true
+		c.added[to] = true
+	}
 }
 
-func (d *btrfs) getSubVolumeReceivedUUID(vol Volume) (string, error) {
-	stdout := strings.Builder{}
+// remove records the deletion of the entry at path.
+func (c *btrfsSendStreamChanges) remove(path string) {
+	if c.added[path] {
+		delete(c.added, path)
+	} else {
+		c.deleted[c.origin(path)] = true
+	}
 
-	poolMountPath := GetPoolMountPath(vol.pool)
+	delete(c.modified, path)
+	delete(c.origins, path)
+}
 
-	// List all subvolumes in the given filesystem with their UUIDs.
-	err := shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", "-R", poolMountPath)
+// diff returns the changes, an entry both deleted and added being reported as modified.
+func (c *btrfsSendStreamChanges) diff() *VolumeDiff {
+	diff := &VolumeDiff{Added: []string{}, Modified: []string{}, Deleted: []string{}}
+
+	for path := range c.deleted {
+		if c.added[path] {
+			c.modified[path] = true
+			delete(c.added, path)
+		} else {
+			diff.Deleted = append(diff.Deleted, path)
+		}
+	}
+
+	for path := range c.added {
+		diff.Added = append(diff.Added, path)
+	}
+
+	for path := range c.modified {
+		if path != "/" {
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.Deleted)
+
+	return diff
+}
+
+// btrfsSendStreamDiff reads the btrfs send stream r of a subvolume sent relative to a parent and returns the
+// paths it adds, modifies and deletes compared to the parent. Entries whose timestamps only changed aren't
+// reported, nor is the root of the subvolume. A renamed entry is reported as deleted and added. If ownerChanged
+// isn't nil, it's called with the path in the parent and the new owner of the existing entries changing owner,
+// and those for which it returns false aren't reported.
+func btrfsSendStreamDiff(r io.Reader, ownerChanged func(path string, uid int64, gid int64) (bool, error)) (*VolumeDiff, error) {
+	reader := bufio.NewReader(r)
+
+	header := make([]byte, btrfsSendStreamHeaderLen)
+	_, err := io.ReadFull(reader, header)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("Failed reading send stream header: %w", err)
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+	if string(header[:len(btrfsSendStreamMagic)]) != btrfsSendStreamMagic {
+		return nil, fmt.Errorf("Invalid send stream header")
+	}
 
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
+	changes := &btrfsSendStreamChanges{
+		added:    map[string]bool{},
+		modified: map[string]bool{},
+		deleted:  map[string]bool{},
+		origins:  map[string]string{},
+	}
 
-		if len(fields) != 11 {
+	for {
+		cmd := make([]byte, btrfsSendCmdHeaderLen)
+		_, err = io.ReadFull(reader, cmd)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading send stream command: %w", err)
+		}
+
+		payload := make([]byte, binary.LittleEndian.Uint32(cmd[0:4]))
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading send stream command: %w", err)
+		}
+
+		cmdType := binary.LittleEndian.Uint16(cmd[4:6])
+		if cmdType == btrfsSendCmdEnd {
+			break
+		}
+
+		if cmdType == btrfsSendCmdSubvol || cmdType == btrfsSendCmdSnapshot || cmdType == btrfsSendCmdUtimes {
 			continue
 		}
 
-		if vol.MountPath() == filepath.Join(poolMountPath, fields[10]) && fields[8] != "-" {
-			return fields[8], nil
+		attrs, err := parseBtrfsSendStreamAttrs(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join("/", string(attrs[btrfsSendAttrPath]))
+
+		switch cmdType {
+		case btrfsSendCmdMkfile, btrfsSendCmdMkdir, btrfsSendCmdMknod, btrfsSendCmdMkfifo, btrfsSendCmdMksock, btrfsSendCmdSymlink, btrfsSendCmdLink:
+			changes.added[path] = true
+		case btrfsSendCmdRename:
+			changes.rename(path, filepath.Join("/", string(attrs[btrfsSendAttrPathTo])))
+		case btrfsSendCmdUnlink, btrfsSendCmdRmdir:
+			changes.remove(path)
+		case btrfsSendCmdChown:
+			if changes.added[path] {
+				continue
+			}
+
+			if ownerChanged != nil {
+				uid, gid := attrs[btrfsSendAttrUID], attrs[btrfsSendAttrGID]
+				if len(uid) != 8 || len(gid) != 8 {
+					return nil, fmt.Errorf("Invalid owner of %q in send stream", path)
+				}
+
+				changed, err := ownerChanged(changes.origin(path), int64(binary.LittleEndian.Uint64(uid)), int64(binary.LittleEndian.Uint64(gid)))
+				if err != nil {
+					return nil, err
+				}
+
+				if !changed {
+					continue
+				}
+			}
+
+			changes.modified[path] = true
+		default:
+			if !changes.added[path] {
+				changes.modified[path] = true
+			}
 		}
 	}
 
-	return "", nil
+	return changes.diff(), nil
 }
 
-// BTRFSMetaDataHeader is the meta data header about the volumes being sent/stored.
-// Note: This is used by both migration and backup subsystems so do not modify without considering both!
-type BTRFSMetaDataHeader struct {
-	Subvolumes []BTRFSSubVolume `json:"subvolumes" yaml:"subvolumes"` // Sub volumes inside the volume (including the top level ones).
-}
+// btrfsSendDiff returns the paths added, modified and deleted in the read-only subvolume at path compared to the
+// read-only subvolume at parentPath, as listed by a send stream of only its metadata relative to the parent. The
+// owners of the subvolume at path are shifted out of idmapSet, if not nil, before being compared.
+func btrfsSendDiff(parentPath string, path string, idmapSet *idmap.IdmapSet) (*VolumeDiff, error) {
+	pipeReader, pipeWriter := io.Pipe()
 
-// restorationHeader scans the volume and any specified snapshots, returning a header containing subvolume metadata
-// for use in restoring a volume and its snapshots onto another system. The metadata returned represents how the
-// subvolumes should be restored, not necessarily how they are on disk now. Most of the time this is the same,
-// however in circumstances where the volume being scanned is itself a snapshot, the returned metadata will
-// not report the volume as readonly or as being a snapshot, as the expectation is that this volume will be
-// restored on the target system as a normal volume and not a snapshot.
-func (d *btrfs) restorationHeader(vol Volume, snapshots []string) (*BTRFSMetaDataHeader, error) {
-	var migrationHeader BTRFSMetaDataHeader
+	sendErr := make(chan error, 1)
+	go func() {
+		err := shared.RunCommandWithFds(context.TODO(), nil, pipeWriter, "btrfs", "send", "-q", "--no-data", "-p", parentPath, path)
+		if err != nil {
+			err = fmt.Errorf("Failed sending subvolume %q: %w", path, err)
+		}
 
-	// Add snapshots to volumes list.
-	for _, snapName := range snapshots {
-		snapVol, _ := vol.NewSnapshot(snapName)
+		// The reader gets the error of the sender, if any.
+		_ = pipeWriter.CloseWithError(err)
+		sendErr <- err
+	}()
 
-		// Add snapshot root volume to volumes list.
-		subVols, err := d.getSubvolumesMetaData(snapVol)
+	ownerChanged := func(relPath string, uid int64, gid int64) (bool, error) {
+		fi, err := os.Lstat(filepath.Join(parentPath, relPath))
 		if err != nil {
-			return nil, err
+			return false, fmt.Errorf("Failed checking %q: %w", relPath, err)
 		}
 
-		migrationHeader.Subvolumes = append(migrationHeader.Subvolumes, subVols...)
+		return diffVolumeOwnerChanged(fi, uid, gid, idmapSet), nil
 	}
 
-	// Add main root volume to volumes list.
-	subVols, err := d.getSubvolumesMetaData(vol)
+	diff, err := btrfsSendStreamDiff(pipeReader, ownerChanged)
+
+	// Unblock the sender if the stream wasn't read through.
+	_ = pipeReader.Close()
+	errSend := <-sendErr
+
 	if err != nil {
 		return nil, err
 	}
 
-	// If vol is a snapshot itself, we force the volume as writable (even if it isn't on disk) and remove the
-	// snapshot name indicator as the expectation is that this volume is going to be restored on the target
-	// system as a normal (non-snapshot) writable volume.
-	if vol.IsSnapshot() {
-		subVols[0].Readonly = false
-		for i := range subVols {
-			subVols[i].Snapshot = ""
+	if errSend != nil {
+		return nil, errSend
+	}
+
+	return diff, nil
+}
+
+// imagesDir returns the directory of the pool holding its image volumes.
+func (d *btrfs) imagesDir() string {
+	return filepath.Join(GetPoolMountPath(d.name), BaseDirectories[VolumeTypeImage][0])
+}
+
+// createImagesDir makes sure the directory holding the image volumes of the pool is a subvolume bounded by the
+// "btrfs.images_quota" pool setting if it is set, and returns the qgroup the new image volumes must be assigned
+// to (empty if their space isn't bounded).
+func (d *btrfs) createImagesDir() (string, error) {
+	var size int64
+	if d.config["btrfs.images_quota"] != "" {
+		var err error
+		size, err = units.ParseByteSizeString(d.config["btrfs.images_quota"])
+		if err != nil {
+			return "", err
 		}
 	}
 
-	migrationHeader.Subvolumes = append(migrationHeader.Subvolumes, subVols...)
-	return &migrationHeader, nil
+	createSubvolume := func(path string) error { return btrfsSubVolumeCreate(path, 0711, nil) }
+
+	return btrfsCreateImagesDir(runBtrfsCommand, d.isSubvolume, createSubvolume, d.imagesDir(), size)
 }
 
-// loadOptimizedBackupHeader extracts optimized backup header from a given ReadSeeker.
-func (d *btrfs) loadOptimizedBackupHeader(r io.ReadSeeker, mountPath string) (*BTRFSMetaDataHeader, error) {
-	header := BTRFSMetaDataHeader{}
+// ImagesCacheUsage returns the space referenced by the image volumes of the pool and the limit set on it by the
+// "btrfs.images_quota" pool setting. The limit is 0 if the images cache isn't bounded.
+func (d *btrfs) ImagesCacheUsage() (int64, int64, error) {
+	imagesPath := d.imagesDir()
+	if d.config["btrfs.images_quota"] == "" || !shared.PathExists(imagesPath) || !d.isSubvolume(imagesPath) {
+		return 0, 0, nil
+	}
 
-	// Extract.
-	tr, cancelFunc, err := backup.TarReader(r, d.state.OS, mountPath)
+	qgroup, usage, limit, err := btrfsSubVolumeQuotaUsage(runBtrfsCommand, imagesPath)
 	if err != nil {
-		return nil, err
+		if err == errBtrfsNoQuota {
+			return -1, -1, ErrNotSupported
+		}
+
+		return -1, -1, err
 	}
 
-	defer cancelFunc()
+	if qgroup == "" || limit < 0 {
+		return usage, 0, nil
+	}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break // End of archive.
+	return usage, limit, nil
+}
+
+// btrfsCreateImagesDir makes the directory holding the image volumes of a pool at imagesPath a subvolume whose
+// qgroup limits the combined space of the image volumes to size bytes, and returns that qgroup. A missing or empty
+// directory is replaced by a subvolume created by createSubvolume, while an existing directory holding images
+// which isn't a subvolume can't be bounded and is an error. The limit of an existing images subvolume is updated
+// to size, and lifted when size isn't greater than 0, in which case an empty qgroup is returned.
+func btrfsCreateImagesDir(run btrfsCommandFunc, isSubvolume func(path string) bool, createSubvolume func(path string) error, imagesPath string, size int64) (string, error) {
+	exists := shared.PathExists(imagesPath)
+
+	if exists && isSubvolume(imagesPath) {
+		qgroup, _, limit, err := btrfsSubVolumeQuotaUsage(run, imagesPath)
+		if err != nil || qgroup == "" {
+			return "", err
 		}
 
-		if err != nil {
-			return nil, fmt.Errorf("Error reading backup file for optimized backup header file: %w", err)
+		if size <= 0 {
+			if limit >= 0 {
+				_, err = run("qgroup", "limit", "none", qgroup, imagesPath)
+				if err != nil {
+					return "", fmt.Errorf("Failed removing qgroup limit of %q: %w", qgroup, err)
+				}
+			}
+
+			return "", nil
 		}
 
-		if hdr.Name == "backup/optimized_header.yaml" {
-			err = yaml.NewDecoder(tr).Decode(&header)
+		if limit != size {
+			_, err = run("qgroup", "limit", fmt.Sprintf("%d", size), qgroup, imagesPath)
 			if err != nil {
-				return nil, fmt.Errorf("Error parsing optimized backup header file: %w", err)
+				return "", fmt.Errorf("Failed applying qgroup limit to %q: %w", qgroup, err)
 			}
-
-			cancelFunc()
-			return &header, nil
 		}
+
+		return qgroup, nil
 	}
 
-	return nil, fmt.Errorf("Optimized backup header file not found")
-}
+	if size <= 0 {
+		return "", nil
+	}
 
-// receiveSubVolume receives a subvolume from an io.Reader into the receivePath and returns the path to the received subvolume.
-func (d *btrfs) receiveSubVolume(r io.Reader, receivePath string) (string, error) {
-	files, err := os.ReadDir(receivePath)
+	if exists {
+		isEmpty, err := shared.PathIsEmpty(imagesPath)
+		if err != nil {
+			return "", err
+		}
+
+		if !isEmpty {
+			return "", fmt.Errorf("Images directory %q already holds images which can't be bounded, delete them first", imagesPath)
+		}
+
+		err = os.Remove(imagesPath)
+		if err != nil {
+			return "", fmt.Errorf("Failed removing images directory %q: %w", imagesPath, err)
+		}
+	}
+
+	err := createSubvolume(imagesPath)
 	if err != nil {
-		return "", fmt.Errorf("Failed listing contents of %q: %w", receivePath, err)
+		_ = os.Mkdir(imagesPath, 0711)
+		return "", err
 	}
 
-	err = shared.RunCommandWithFds(context.TODO(), r, nil, "btrfs", "receive", "-e", receivePath)
+	qgroup, err := btrfsSubVolumeSetQuota(run, imagesPath, size)
 	if err != nil {
+		_, _ = run("subvolume", "delete", imagesPath)
+		_ = os.Mkdir(imagesPath, 0711)
 		return "", err
 	}
 
-	// Check contents of target path is expected after receive.
-	newFiles, err := os.ReadDir(receivePath)
+	return qgroup, nil
+}
+
+// btrfsSubVolumeInheritQGroup accounts the subvolume at path, nested in the volume at volPath, like the volume: it's
+// assigned to the higher level qgroups the volume belongs to and gets the referenced limit of the volume. Nothing is
+// done when quotas are disabled.
+func btrfsSubVolumeInheritQGroup(run btrfsCommandFunc, volPath string, path string) error {
+	volQGroup, _, err := btrfsGetQGroup(run, volPath)
 	if err != nil {
-		return "", fmt.Errorf("Failed listing contents of %q: %w", receivePath, err)
+		if errors.Is(err, errBtrfsNoQuota) || errors.Is(err, errBtrfsNoQGroup) {
+			return nil
+		}
+
+		return err
 	}
 
-	filename := ""
+	output, err := run("qgroup", "show", "-f", "-p", "-r", "--raw", volPath)
+	if err != nil {
+		return fmt.Errorf("Failed getting qgroup %q of %q: %w", volQGroup, volPath, err)
+	}
 
-	// Identify the latest received path.
-	for _, a := range newFiles {
-		found := false
+	// The columns are the qgroup, its referenced and exclusive usage, its referenced limit and its parents.
+	limit := "none"
+	parents := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != volQGroup {
+			continue
+		}
 
-		for _, b := range files {
-			if a.Name() == b.Name() {
-				found = true
-				break
+		limit = fields[3]
+		for _, parent := range strings.Split(fields[4], ",") {
+			if parent != "" && strings.Trim(parent, "-") != "" {
+				parents = append(parents, parent)
 			}
 		}
 
-		if !found {
-			filename = a.Name()
-			break
+		break
+	}
+
+	for _, parent := range parents {
+		err = btrfsSubVolumeAssignQGroup(run, path, parent)
+		if err != nil {
+			return err
 		}
 	}
 
-	if filename == "" {
-		return "", fmt.Errorf("Failed to determine received subvolume")
+	if limit == "none" {
+		return nil
 	}
 
-	subVolPath := filepath.Join(receivePath, filename)
+	qgroup, _, err := btrfsGetQGroup(run, path)
+	if err != nil {
+		return fmt.Errorf("Failed getting qgroup of %q: %w", path, err)
+	}
 
-	return subVolPath, nil
+	_, err = run("qgroup", "limit", limit, qgroup, path)
+	if err != nil {
+		return fmt.Errorf("Failed limiting qgroup %q of %q: %w", qgroup, path, err)
+	}
+
+	return nil
+}
+
+// btrfsSubVolumeAssignQGroup assigns the subvolume at path to qgroup, so that its space is accounted to it.
+func btrfsSubVolumeAssignQGroup(run btrfsCommandFunc, path string, qgroup string) error {
+	output, err := run("inspect-internal", "rootid", path)
+	if err != nil {
+		return fmt.Errorf("Failed getting subvolume ID of %q: %w", path, err)
+	}
+
+	member := fmt.Sprintf("0/%s", strings.TrimSpace(output))
+
+	_, err = run("qgroup", "assign", "--no-rescan", member, qgroup, path)
+	if err != nil {
+		return fmt.Errorf("Failed assigning qgroup %q to %q: %w", member, qgroup, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,3645 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/lxd/sys"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// Test btrfsValidateRaidProfiles.
+func TestBtrfsValidateRaidProfiles(t *testing.T) {
+	tests := []struct {
+		dataRaid     string
+		metadataRaid string
+		devices      int
+		valid        bool
+	}{
+		// Valid combinations.
+		{dataRaid: "", metadataRaid: "", devices: 1, valid: true},
+		{dataRaid: "single", metadataRaid: "dup", devices: 1, valid: true},
+		{dataRaid: "raid0", metadataRaid: "raid1", devices: 2, valid: true},
+		{dataRaid: "raid1", metadataRaid: "raid1", devices: 3, valid: true},
+		{dataRaid: "raid10", metadataRaid: "raid10", devices: 4, valid: true},
+		// Invalid combinations.
+		{dataRaid: "raid1", metadataRaid: "", devices: 1, valid: false},
+		{dataRaid: "", metadataRaid: "raid0", devices: 1, valid: false},
+		{dataRaid: "raid10", metadataRaid: "raid1", devices: 3, valid: false},
+		{dataRaid: "raid5", metadataRaid: "", devices: 4, valid: false},
+	}
+
+	for _, test := range tests {
+		err := btrfsValidateRaidProfiles(test.dataRaid, test.metadataRaid, test.devices)
+		if test.valid {
+			assert.NoError(t, err, "data=%q metadata=%q devices=%d", test.dataRaid, test.metadataRaid, test.devices)
+		} else {
+			assert.Error(t, err, "data=%q metadata=%q devices=%d", test.dataRaid, test.metadataRaid, test.devices)
+		}
+	}
+}
+
+// Test btrfsSourceDevices.
+func TestBtrfsSourceDevices(t *testing.T) {
+	assert.Equal(t, []string{"/dev/sdb"}, btrfsSourceDevices("/dev/sdb"))
+	assert.Equal(t, []string{"/dev/sdb", "/dev/sdc"}, btrfsSourceDevices("/dev/sdb, /dev/sdc,"))
+	assert.Empty(t, btrfsSourceDevices(""))
+}
+
+// Test parseSubvolumesUUIDs.
+func TestParseSubvolumesUUIDs(t *testing.T) {
+	output := `ID 256 gen 10 top level 5 received_uuid - uuid 0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d001 path containers/c1
+ID 257 gen 11 top level 5 received_uuid - uuid 0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d002 path containers-snapshots/c1/snap0
+ID 258 gen 12 top level 5 received_uuid 0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d002 uuid 0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d003 path containers-snapshots/c2/snap0
+`
+
+	uuids := parseSubvolumesUUIDs(output, "/pool")
+	assert.Len(t, uuids, 3)
+	assert.Equal(t, btrfsSnapshotUUIDs{UUID: "0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d001"}, uuids["/pool/containers/c1"])
+	assert.Equal(t, btrfsSnapshotUUIDs{UUID: "0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d003", ReceivedUUID: "0e2e1d3c-5a1a-4d4e-8e7a-63b1f0a2d002"}, uuids["/pool/containers-snapshots/c2/snap0"])
+}
+
+// Test that btrfsCommonSnapshot finds the snapshot to refresh from after both sides were modified.
+func TestBtrfsCommonSnapshot(t *testing.T) {
+	src := []btrfsSnapshotUUIDs{
+		{Name: "snap0", UUID: "uuid-src-0"},
+		{Name: "snap1", UUID: "uuid-src-1"},
+		{Name: "snap2", UUID: "uuid-src-2", ReceivedUUID: "uuid-remote-2"},
+		{Name: "snap3", UUID: "uuid-src-3"}, // Taken on the source after the last refresh.
+	}
+
+	// The target received snap0 and snap1 and then had a snapshot of its own taken.
+	target := []btrfsSnapshotUUIDs{
+		{Name: "snap0", UUID: "uuid-tgt-0", ReceivedUUID: "uuid-src-0"},
+		{Name: "snap1", UUID: "uuid-tgt-1", ReceivedUUID: "uuid-src-1"},
+		{Name: "local", UUID: "uuid-tgt-local"},
+	}
+
+	assert.Equal(t, "snap1", btrfsCommonSnapshot(src, target))
+
+	// A snapshot sent on from a received source snapshot carries the original received UUID.
+	target = append(target, btrfsSnapshotUUIDs{Name: "snap2", UUID: "uuid-tgt-2", ReceivedUUID: "uuid-remote-2"})
+	assert.Equal(t, "snap2", btrfsCommonSnapshot(src, target))
+
+	// A target snapshot with the same name but not received from the source isn't common.
+	target = []btrfsSnapshotUUIDs{{Name: "snap0", UUID: "uuid-tgt-0"}}
+	assert.Equal(t, "", btrfsCommonSnapshot(src, target))
+
+	// No snapshots on either side.
+	assert.Equal(t, "", btrfsCommonSnapshot(nil, nil))
+}
+
+// Test btrfsFilesystemDevices.
+func TestBtrfsFilesystemDevices(t *testing.T) {
+	output := `Label: 'default'  uuid: 14dc8ad1-8e49-4e3c-8d3a-9c51d6f1a02e
+	Total devices 2 FS bytes used 1.50GiB
+	devid    1 size 30.00GiB used 4.03GiB path /dev/sdb
+	devid    2 size 30.00GiB used 4.03GiB path /dev/loop3
+
+`
+
+	assert.Equal(t, []string{"/dev/sdb", "/dev/loop3"}, btrfsFilesystemDevices(output))
+	assert.Empty(t, btrfsFilesystemDevices(""))
+}
+
+// Test parseQGroupUsage and btrfsSnapshotUsage.
+func TestBtrfsSnapshotUsage(t *testing.T) {
+	// A 100MiB snapshot of which 20MiB was overwritten in the volume since it was taken.
+	output := `qgroupid         rfer         excl     max_excl
+--------         ----         ----     --------
+0/259       104857600     20971520         none
+`
+
+	referenced, exclusive, err := parseQGroupUsage(output)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(104857600), referenced)
+	assert.Equal(t, int64(20971520), exclusive)
+
+	usage := btrfsSnapshotUsage(referenced, exclusive)
+	assert.Equal(t, int64(83886080), usage.Shared)
+	assert.Equal(t, int64(20971520), usage.Exclusive)
+
+	// A snapshot identical to its volume only has shared data.
+	usage = btrfsSnapshotUsage(104857600, 0)
+	assert.Equal(t, int64(104857600), usage.Shared)
+	assert.Equal(t, int64(0), usage.Exclusive)
+
+	// No qgroup found.
+	_, _, err = parseQGroupUsage("qgroupid rfer excl max_excl\n")
+	assert.ErrorIs(t, err, errBtrfsNoQGroup)
+}
+
+// Test that only the failures due to disabled quotas are reported as such by btrfsQGroupShowError.
+func TestBtrfsQGroupShowError(t *testing.T) {
+	err := btrfsQGroupShowError("/pool", fmt.Errorf("Failed to run: btrfs qgroup show /pool: exit status 1 (ERROR: can't list qgroups: quotas not enabled)"))
+	assert.Equal(t, errBtrfsNoQuota, err)
+
+	permErr := fmt.Errorf("Failed to run: btrfs qgroup show /pool: exit status 1 (ERROR: can't access '/pool': Permission denied)")
+	err = btrfsQGroupShowError("/pool", permErr)
+	assert.NotErrorIs(t, err, errBtrfsNoQuota)
+	assert.ErrorIs(t, err, permErr)
+}
+
+// Test that rebalancing a synthesized two-device pool moves data toward the emptier device.
+func TestBtrfsRebalance(t *testing.T) {
+	// A 10GiB device holding 8GiB of data and a newly added 10GiB device holding 1GiB.
+	output := `Label: none  uuid: 3b4e3f7e-8f40-4e36-a2e5-5b4d5a0f8d1c
+	Total devices 2 FS bytes used 9663676416
+	devid    1 size 10737418240 used 8589934592 path /dev/loop0
+	devid    2 size 10737418240 used 1073741824 path /dev/loop1
+`
+
+	devices, err := parseBtrfsDevices(output)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	assert.Equal(t, btrfsDevice{ID: 2, Path: "/dev/loop1", Size: 10737418240, Used: 1073741824}, devices[1])
+
+	from, to, size := btrfsRebalanceTarget(devices)
+	assert.Equal(t, "/dev/loop0", from.Path)
+	assert.Equal(t, "/dev/loop1", to.Path)
+	assert.Equal(t, int64(3758096384), size) // 3.5GiB, leaving 4.5GiB on each device.
+
+	// Relocate volumes, largest first, without moving more than needed.
+	candidates := []btrfsRebalanceCandidate{
+		{Name: "c1", Size: 1073741824},
+		{Name: "c2", Size: 3221225472},
+		{Name: "c3", Size: 2147483648},
+		{Name: "c4", Size: 0}, // Unknown size.
+	}
+
+	selected := btrfsRebalanceSelect(candidates, size)
+	assert.Equal(t, []string{"c2", "c4"}, selected)
+
+	// Apply the relocation and check that the devices became more even.
+	var moved int64
+	for _, candidate := range candidates {
+		for _, name := range selected {
+			if candidate.Name == name {
+				moved += candidate.Size
+			}
+		}
+	}
+
+	from.Used -= moved
+	to.Used += moved
+	assert.Greater(t, to.Used, devices[1].Used)
+	assert.Less(t, from.Used-to.Used, devices[0].Used-devices[1].Used)
+
+	// A balanced pool requires no relocation.
+	_, _, size = btrfsRebalanceTarget([]btrfsDevice{from, {ID: 2, Size: from.Size, Used: from.Used}})
+	assert.Equal(t, int64(0), size)
+	assert.Empty(t, btrfsRebalanceSelect(candidates, size))
+}
+
+// btrfsTestPool returns the driver of a pool backed by a new btrfs filesystem of the given size on a loop file,
+// mounted at the pool mount path (under LXD_DIR which must be set) with the base directories of containers.
+// The test is skipped if loop devices or btrfs filesystems can't be created.
+func btrfsTestPool(t *testing.T, name string, size int64) *btrfs {
+	d := &btrfs{}
+	d.name = name
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	loopPath := shared.VarPath("disks", fmt.Sprintf("%s.img", name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(loopPath), 0700))
+	require.NoError(t, ensureSparseFile(loopPath, size))
+
+	loopDevPath, err := loopDeviceSetup(loopPath)
+	if err != nil {
+		t.Skipf("Test requires loop devices: %v", err)
+	}
+
+	t.Cleanup(func() { _ = loopDeviceAutoDetach(loopDevPath) })
+
+	_, err = shared.RunCommand("mkfs.btrfs", "-f", loopDevPath)
+	if err != nil {
+		t.Skipf("Test requires creating btrfs filesystems: %v", err)
+	}
+
+	poolMountPath := GetPoolMountPath(d.name)
+	require.NoError(t, os.MkdirAll(poolMountPath, 0711))
+	require.NoError(t, unix.Mount(loopDevPath, poolMountPath, "btrfs", 0, ""))
+	t.Cleanup(func() { _ = unix.Unmount(poolMountPath, unix.MNT_DETACH) })
+
+	for _, dir := range BaseDirectories[VolumeTypeContainer] {
+		require.NoError(t, os.MkdirAll(filepath.Join(poolMountPath, dir), 0711))
+	}
+
+	return d
+}
+
+// Test that rebalancing a real pool after adding an empty device balances data chunks toward it and relocates the
+// supplied volumes without losing their content.
+func TestBtrfsRebalance_Pool(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "rebalance.")
+	require.NoError(t, err)
+
+	// Removed once the pool is unmounted.
+	t.Cleanup(func() { _ = os.RemoveAll(lxdDir) })
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	// Devices large enough for btrfs to use 1GiB data chunks.
+	d := btrfsTestPool(t, "testpool", 20*1024*1024*1024)
+	poolMountPath := GetPoolMountPath(d.name)
+
+	loopPath := filepath.Join(lxdDir, "disk1.img")
+	require.NoError(t, ensureSparseFile(loopPath, 20*1024*1024*1024))
+
+	loopDevPath, err := loopDeviceSetup(loopPath)
+	require.NoError(t, err)
+	defer func() { _ = loopDeviceAutoDetach(loopDevPath) }()
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "data"), []byte("c1"), 0600))
+
+	// Allocate data chunks on the first device only.
+	f, err := os.Create(filepath.Join(poolMountPath, "filler"))
+	require.NoError(t, err)
+	require.NoError(t, unix.Fallocate(int(f.Fd()), 0, 0, 4*1024*1024*1024))
+	_ = f.Close()
+
+	_, err = shared.RunCommand("btrfs", "filesystem", "sync", poolMountPath)
+	require.NoError(t, err)
+
+	_, err = shared.RunCommand("btrfs", "device", "add", "-f", loopDevPath, poolMountPath)
+	require.NoError(t, err)
+
+	before, err := d.getDevices()
+	require.NoError(t, err)
+	require.Len(t, before, 2)
+	_, _, size := btrfsRebalanceTarget(before)
+	require.Greater(t, size, int64(btrfsDataChunkSize))
+
+	require.NoError(t, d.Rebalance(context.Background(), []Volume{vol}, nil))
+
+	after, err := d.getDevices()
+	require.NoError(t, err)
+	require.Len(t, after, 2)
+	assert.Less(t, after[0].Used, before[0].Used)
+	assert.Greater(t, after[1].Used, before[1].Used)
+
+	// The relocated volume is still a subvolume with the same content, and no temporary subvolume is left.
+	assert.True(t, btrfsIsSubVolume(vol.MountPath()))
+	data, err := os.ReadFile(filepath.Join(vol.MountPath(), "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "c1", string(data))
+
+	for _, suffix := range []string{".rebalance", ".rebalance-ro", ".rebalance-new", ".rebalance-old"} {
+		assert.False(t, shared.PathExists(vol.MountPath()+suffix))
+	}
+}
+
+// Test btrfsEstimateSharing.
+func TestBtrfsEstimateSharing(t *testing.T) {
+	const mib = 1024 * 1024
+
+	// Three instances created from the same 500MiB image, each having written some data of its own.
+	usages := []btrfsQGroupUsage{
+		{Referenced: 500 * mib, Exclusive: 0}, // The image volume.
+		{Referenced: 520 * mib, Exclusive: 20 * mib},
+		{Referenced: 550 * mib, Exclusive: 50 * mib},
+		{Referenced: 500 * mib, Exclusive: 10 * mib}, // Overwrote 10MiB of the image data.
+	}
+
+	estimate := btrfsEstimateSharing(usages)
+	assert.Equal(t, btrfsSharingMethod, estimate.Method)
+	assert.Equal(t, int64(2070*mib), estimate.Referenced)
+	assert.Equal(t, int64(580*mib), estimate.Physical)
+
+	// Actual savings are 3 copies of the image minus the 10MiB overwritten by the last instance.
+	assert.GreaterOrEqual(t, estimate.Savings, int64(1490*mib))
+	assert.LessOrEqual(t, estimate.Savings, int64(1500*mib))
+
+	// No sharing.
+	estimate = btrfsEstimateSharing([]btrfsQGroupUsage{{Referenced: 100 * mib, Exclusive: 100 * mib}, {Referenced: 50 * mib, Exclusive: 50 * mib}})
+	assert.Equal(t, int64(150*mib), estimate.Physical)
+	assert.Equal(t, int64(0), estimate.Savings)
+}
+
+// Test that btrfsSnapshotTx removes the snapshot when a step following its creation fails.
+func TestBtrfsSnapshotTx(t *testing.T) {
+	snapPath := filepath.Join(t.TempDir(), "snap0")
+
+	deleted := 0
+	tx := btrfsSnapshotTx{
+		path:   snapPath,
+		create: func(path string) error { return os.Mkdir(path, 0700) },
+		delete: func(path string) error {
+			deleted++
+			return os.RemoveAll(path)
+		},
+	}
+
+	// Failure after the snapshot was created.
+	err := tx.run(func() error { return nil }, func() error { return fmt.Errorf("Failed setting readonly") })
+	assert.ErrorContains(t, err, "Failed setting readonly")
+	assert.NoDirExists(t, snapPath)
+	assert.Equal(t, 1, deleted)
+
+	// Cleanup is idempotent.
+	assert.NoError(t, tx.cleanup())
+	assert.Equal(t, 1, deleted)
+
+	// Partially failed creation.
+	tx.create = func(path string) error {
+		err := os.Mkdir(path, 0700)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("Failed snapshotting nested subvolume")
+	}
+
+	err = tx.run()
+	assert.ErrorContains(t, err, "Failed snapshotting nested subvolume")
+	assert.NoDirExists(t, snapPath)
+	assert.Equal(t, 2, deleted)
+
+	// Success keeps the snapshot.
+	tx.create = func(path string) error { return os.Mkdir(path, 0700) }
+
+	err = tx.run(func() error { return nil })
+	assert.NoError(t, err)
+	assert.DirExists(t, snapPath)
+	assert.Equal(t, 2, deleted)
+}
+
+// Test that creating a snapshot again after it was created successfully is a no-op.
+func TestBtrfsSnapshotTxRetry(t *testing.T) {
+	snapPath := filepath.Join(t.TempDir(), "snap0")
+
+	created, deleted, steps := 0, 0, 0
+	source := "c1"
+	tx := btrfsSnapshotTx{
+		path: snapPath,
+		create: func(path string) error {
+			created++
+			return os.WriteFile(path, []byte(source), 0600)
+		},
+		delete: func(path string) error {
+			deleted++
+			return os.Remove(path)
+		},
+		matches: func(path string) (bool, error) {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return false, err
+			}
+
+			return string(content) == source, nil
+		},
+	}
+
+	step := func() error {
+		steps++
+		return nil
+	}
+
+	err := tx.run(step)
+	require.NoError(t, err)
+
+	// The retry succeeds without creating the snapshot again, still running the steps.
+	err = tx.run(step)
+	require.NoError(t, err)
+	assert.Equal(t, 1, created)
+	assert.Equal(t, 2, steps)
+	assert.FileExists(t, snapPath)
+
+	// A failing step doesn't remove the existing snapshot as it wasn't created by the retry.
+	err = tx.run(func() error { return fmt.Errorf("Failed setting readonly") })
+	assert.ErrorContains(t, err, "Failed setting readonly")
+	assert.FileExists(t, snapPath)
+	assert.Equal(t, 0, deleted)
+
+	// A leftover snapshot of another source (or of an older state of the source) is replaced.
+	source = "c2"
+	err = tx.run(step)
+	require.NoError(t, err)
+	assert.Equal(t, 2, created)
+	assert.Equal(t, 1, deleted)
+
+	content, err := os.ReadFile(snapPath)
+	require.NoError(t, err)
+	assert.Equal(t, "c2", string(content))
+}
+
+// Test that a snapshot only matches its source as long as the source wasn't modified since.
+func TestBtrfsSnapshotMatches(t *testing.T) {
+	show := func(uuid string, parentUUID string, generation int, creation int) string {
+		return fmt.Sprintf("subvol\n\tUUID: \t\t%s\n\tParent UUID: \t\t%s\n\tGeneration: \t\t%d\n\tGen at creation: \t%d\n", uuid, parentUUID, generation, creation)
+	}
+
+	src := show("uuid-src", "-", 120, 10)
+
+	// Snapshot taken from the source, which wasn't modified since.
+	match, err := btrfsSnapshotMatches(src, show("uuid-snap", "uuid-src", 121, 120))
+	require.NoError(t, err)
+	assert.True(t, match)
+
+	// The source was modified after the snapshot.
+	match, err = btrfsSnapshotMatches(src, show("uuid-snap", "uuid-src", 110, 100))
+	require.NoError(t, err)
+	assert.False(t, match)
+
+	// Snapshot of another source.
+	match, err = btrfsSnapshotMatches(src, show("uuid-snap", "uuid-other", 121, 120))
+	require.NoError(t, err)
+	assert.False(t, match)
+
+	// Missing generation.
+	_, err = btrfsSnapshotMatches(src, "subvol\n\tParent UUID: uuid-src\n")
+	assert.Error(t, err)
+}
+
+// Test parsing the UUIDs of a subvolume.
+func TestParseBtrfsSubVolumeShowUUIDs(t *testing.T) {
+	output := `containers-snapshots/c1/snap0
+	Name: 			snap0
+	UUID: 			9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02
+	Parent UUID: 		9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01
+	Received UUID: 		-
+	Subvolume ID: 		258
+`
+	subvolUUID, parentUUID := parseBtrfsSubVolumeShowUUIDs(output)
+	assert.Equal(t, "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02", subvolUUID)
+	assert.Equal(t, "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01", parentUUID)
+
+	subvolUUID, parentUUID = parseBtrfsSubVolumeShowUUIDs("containers/c1\n\tUUID: 9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01\n\tParent UUID: -\n")
+	assert.Equal(t, "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01", subvolUUID)
+	assert.Empty(t, parentUUID)
+}
+
+// Test that a received subvolume is checked against the UUID announced by the sender.
+func TestBtrfsVerifyReceivedUUID(t *testing.T) {
+	subVol := BTRFSSubVolume{
+		Snapshot: "snap0",
+		Path:     "/",
+		UUID:     "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01",
+		SentUUID: "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01",
+	}
+
+	assert.NoError(t, btrfsVerifyReceivedUUID(subVol, "/pool/containers/migration.1/snap0/c1", "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01"))
+
+	// A subvolume received from another source is rejected.
+	err := btrfsVerifyReceivedUUID(subVol, "/pool/containers/migration.1/snap0/c1", "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02")
+	assert.ErrorIs(t, err, ErrReceivedUUIDMismatch)
+	assert.ErrorContains(t, err, `has received UUID "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02" instead of "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01"`)
+
+	// A subvolume which was itself received is sent with its received UUID.
+	subVol.SentUUID = "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c00"
+	assert.NoError(t, btrfsVerifyReceivedUUID(subVol, "/pool/containers/migration.1/snap0/c1", "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c00"))
+	assert.ErrorIs(t, btrfsVerifyReceivedUUID(subVol, "/pool/containers/migration.1/snap0/c1", "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01"), ErrReceivedUUIDMismatch)
+
+	// Nothing is checked when the sender didn't announce the UUID.
+	subVol.SentUUID = ""
+	assert.NoError(t, btrfsVerifyReceivedUUID(subVol, "/pool/containers/migration.1/snap0/c1", "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02"))
+}
+
+// Test that snapshot mounts use the snapshot specific mount options.
+func TestBtrfsSnapshotMountFlags(t *testing.T) {
+	d := &btrfs{}
+
+	d.config = map[string]string{"btrfs.mount_options": "noatime,nodev"}
+	assert.Equal(t, uintptr(unix.MS_RDONLY), d.getSnapshotMountFlags())
+
+	d.config = map[string]string{"btrfs.snapshot_mount_options": "noatime,nosuid"}
+	assert.Equal(t, uintptr(unix.MS_RDONLY|unix.MS_NOATIME|unix.MS_NOSUID), d.getSnapshotMountFlags())
+
+	// Snapshots stay read-only.
+	d.config = map[string]string{"btrfs.snapshot_mount_options": "rw,noexec"}
+	assert.Equal(t, uintptr(unix.MS_RDONLY|unix.MS_NOEXEC), d.getSnapshotMountFlags())
+
+	assert.NoError(t, validateMountFlags("noatime,nodev,nosuid"))
+	assert.Error(t, validateMountFlags("noatime,compress=zstd"))
+	assert.Error(t, validateMountFlags("noatime,"))
+}
+
+// Test that the commit interval ends up in the pool mount options.
+func TestBtrfsCommitIntervalMountOptions(t *testing.T) {
+	d := &btrfs{}
+
+	d.config = map[string]string{}
+	assert.Equal(t, "user_subvol_rm_allowed", d.getMountOptions())
+
+	d.config = map[string]string{"btrfs.commit_interval": "60"}
+	_, mntOptions := resolveMountOptions(d.getMountOptions())
+	assert.Equal(t, "user_subvol_rm_allowed,commit=60", mntOptions)
+
+	// The commit interval overrides a commit option in the mount options.
+	d.config = map[string]string{"btrfs.mount_options": "noatime,commit=5,compress=zstd", "btrfs.commit_interval": "120"}
+	mntFlags, mntOptions := resolveMountOptions(d.getMountOptions())
+	assert.Equal(t, uintptr(unix.MS_NOATIME), mntFlags)
+	assert.Equal(t, "compress=zstd,commit=120", mntOptions)
+
+	assert.NoError(t, validateCommitInterval("1"))
+	assert.NoError(t, validateCommitInterval("300"))
+
+	for _, value := range []string{"0", "301", "-5", "30s", ""} {
+		assert.Error(t, validateCommitInterval(value), value)
+	}
+}
+
+// Test parsing the default subvolume of a filesystem.
+func TestParseBtrfsDefaultSubVolume(t *testing.T) {
+	id, err := parseBtrfsDefaultSubVolume("ID 5 (FS_TREE)\n")
+	assert.NoError(t, err)
+	assert.Equal(t, btrfsTopLevelSubVolumeID, id)
+
+	id, err = parseBtrfsDefaultSubVolume("ID 256 gen 8 top level 5 path data\n")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(256), id)
+
+	for _, output := range []string{"", "ID", "ID abc (FS_TREE)", "ERROR: not a btrfs filesystem"} {
+		_, err = parseBtrfsDefaultSubVolume(output)
+		assert.Error(t, err, output)
+	}
+}
+
+// Test that only a recorded default subvolume is restored.
+func TestBtrfsExpectedDefaultSubVolume(t *testing.T) {
+	d := &btrfs{}
+	d.config = map[string]string{}
+
+	// Without a recorded default subvolume, the current one is left alone.
+	_, recorded, err := d.expectedDefaultSubVolume()
+	require.NoError(t, err)
+	assert.False(t, recorded)
+
+	d.config["volatile.btrfs.default_subvolume"] = "256"
+	id, recorded, err := d.expectedDefaultSubVolume()
+	require.NoError(t, err)
+	assert.True(t, recorded)
+	assert.Equal(t, uint64(256), id)
+
+	d.config["volatile.btrfs.default_subvolume"] = "data"
+	_, _, err = d.expectedDefaultSubVolume()
+	assert.Error(t, err)
+}
+
+// Test that setting and getting the default subvolume round-trips on a real filesystem.
+func TestBtrfsDefaultSubVolume(t *testing.T) {
+	testDir := btrfsTestDir(t)
+
+	original, err := btrfsGetDefaultSubVolume(testDir)
+	require.NoError(t, err)
+
+	subvolPath := filepath.Join(testDir, "default-subvol")
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", subvolPath)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = btrfsSetDefaultSubVolume(testDir, original)
+		_, _ = shared.RunCommand("btrfs", "subvolume", "delete", subvolPath)
+	}()
+
+	output, err := shared.RunCommand("btrfs", "inspect-internal", "rootid", subvolPath)
+	require.NoError(t, err)
+
+	id, err := strconv.ParseUint(strings.TrimSpace(output), 10, 64)
+	require.NoError(t, err)
+
+	require.NoError(t, btrfsSetDefaultSubVolume(testDir, id))
+
+	current, err := btrfsGetDefaultSubVolume(testDir)
+	require.NoError(t, err)
+	assert.Equal(t, id, current)
+
+	require.NoError(t, btrfsSetDefaultSubVolume(testDir, original))
+
+	current, err = btrfsGetDefaultSubVolume(testDir)
+	require.NoError(t, err)
+	assert.Equal(t, original, current)
+}
+
+// Test that the subvolumes matching the exclude patterns, and those below them, are left out.
+func TestBtrfsSubVolumesGet(t *testing.T) {
+	rootPath := t.TempDir()
+	subvols := map[string]bool{}
+	for _, relPath := range []string{"a", "a/b", "images", "images/fp1", "images/fp2", "trash/x", "c/.trash", "c/.trash/y", "c/d"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootPath, relPath), 0700))
+		subvols[filepath.Join(rootPath, relPath)] = true
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(rootPath, "a", "file"), nil, 0600))
+
+	isSubvolume := func(path string) bool { return subvols[path] }
+
+	all, err := btrfsSubVolumesGet(rootPath, isSubvolume, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "a/b", "images", "images/fp1", "images/fp2", "trash/x", "c/.trash", "c/.trash/y", "c/d"}, all)
+
+	// Patterns match the whole relative path, excluding the subvolumes within matching directories.
+	filtered, err := btrfsSubVolumesGet(rootPath, isSubvolume, []string{"images", "trash", "*/.trash"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "a/b", "c/d"}, filtered)
+
+	// Patterns can select nested entries only.
+	filtered, err = btrfsSubVolumesGet(rootPath, isSubvolume, []string{"images/fp*"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "a/b", "images", "trash/x", "c/.trash", "c/.trash/y", "c/d"}, filtered)
+
+	_, err = btrfsSubVolumesGet(rootPath, isSubvolume, []string{"["})
+	assert.ErrorIs(t, err, filepath.ErrBadPattern)
+}
+
+// Test that sub volumes are deleted before their parents.
+func TestBtrfsSubvolumeDeleteOrder(t *testing.T) {
+	subSubVols := []string{"a", "a/b", "c", "a/b/d", "a/e"}
+
+	paths := btrfsSubvolumeDeleteOrder("/pool/vol", subSubVols)
+	assert.Equal(t, []string{"/pool/vol/c", "/pool/vol/a/e", "/pool/vol/a/b/d", "/pool/vol/a/b", "/pool/vol/a", "/pool/vol"}, paths)
+
+	// The input isn't modified.
+	assert.Equal(t, []string{"a", "a/b", "c", "a/b/d", "a/e"}, subSubVols)
+}
+
+// btrfsTestDir returns the directory on a btrfs filesystem passed in LXD_BTRFS_TEST_DIR, skipping if unset.
+// Tests and benchmarks using it need to run as root.
+func btrfsTestDir(tb testing.TB) string {
+	dir := os.Getenv("LXD_BTRFS_TEST_DIR")
+	if dir == "" {
+		tb.Skip("LXD_BTRFS_TEST_DIR not set")
+	}
+
+	return dir
+}
+
+// Benchmark deleting a tree of subvolumes with a commit per deletion against a single commit for the batch.
+func BenchmarkBtrfsDeleteSubvolumes(b *testing.B) {
+	benchDir := btrfsTestDir(b)
+
+	// Create a root subvolume with 4 children each having 4 children.
+	createTree := func(rootPath string) []string {
+		subSubVols := []string{}
+		for i := 0; i < 4; i++ {
+			child := fmt.Sprintf("child%d", i)
+			subSubVols = append(subSubVols, child)
+
+			for j := 0; j < 4; j++ {
+				subSubVols = append(subSubVols, filepath.Join(child, fmt.Sprintf("child%d", j)))
+			}
+		}
+
+		_, err := shared.RunCommand("btrfs", "subvolume", "create", rootPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, subSubVol := range subSubVols {
+			_, err := shared.RunCommand("btrfs", "subvolume", "create", filepath.Join(rootPath, subSubVol))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		return btrfsSubvolumeDeleteOrder(rootPath, subSubVols)
+	}
+
+	for _, commitEach := range []bool{true, false} {
+		name := "CommitAfter"
+		if commitEach {
+			name = "CommitEach"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				paths := createTree(filepath.Join(benchDir, fmt.Sprintf("tree%d", i)))
+				b.StartTimer()
+
+				err := btrfsDeleteSubvolumes(paths, commitEach, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Test parsing the error counters of "btrfs device stats".
+func TestParseBtrfsDeviceStats(t *testing.T) {
+	output := `[/dev/sdb].write_io_errs    0
+[/dev/sdb].read_io_errs     0
+[/dev/sdb].flush_io_errs    0
+[/dev/sdb].corruption_errs  0
+[/dev/sdb].generation_errs  0
+[/dev/sdc].write_io_errs    1
+[/dev/sdc].read_io_errs     4
+[/dev/sdc].flush_io_errs    0
+[/dev/sdc].corruption_errs  12
+[/dev/sdc].generation_errs  2
+`
+
+	devices, err := parseBtrfsDeviceStats(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ResourcesStoragePoolDevice{
+		{Device: "/dev/sdb"},
+		{Device: "/dev/sdc", ReadErrors: 4, WriteErrors: 1, CorruptionErrors: 12, GenerationErrors: 2},
+	}, devices)
+
+	_, err = parseBtrfsDeviceStats("[/dev/sdb].corruption_errs  many\n")
+	assert.Error(t, err)
+}
+
+// Test that exported qgroup limits are restored on import, skipping missing subvolumes.
+func TestBtrfsQGroupExportImport(t *testing.T) {
+	poolMount := "/pool"
+	subvols := map[string]string{"257": "containers/c1", "258": "containers/c2", "259": "custom/default_vol1"}
+	limits := map[string]string{"0/257": "10737418240", "0/259": "1073741824"}
+
+	// Fake btrfs keeping the subvolumes and qgroup limits in memory.
+	run := func(args ...string) (string, error) {
+		cmd := strings.Join(args[:2], " ")
+		switch cmd {
+		case "subvolume list":
+			output := ""
+			for id, path := range subvols {
+				output += fmt.Sprintf("ID %s gen 10 top level 5 path %s\n", id, path)
+			}
+
+			return output, nil
+		case "qgroup show":
+			output := "qgroupid         rfer         excl     max_rfer\n--------         ----         ----     --------\n0/5 16384 16384 none\n"
+			for id := range subvols {
+				limit, ok := limits["0/"+id]
+				if !ok {
+					limit = "none"
+				}
+
+				output += fmt.Sprintf("0/%s 16384 16384 %s\n", id, limit)
+			}
+
+			return output, nil
+		case "qgroup limit":
+			for id, path := range subvols {
+				if filepath.Join(poolMount, path) == args[3] {
+					limits["0/"+id] = args[2]
+					return "", nil
+				}
+			}
+
+			return "", fmt.Errorf("Subvolume %q not found", args[3])
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	exported, err := btrfsQGroupExport(run, poolMount)
+	assert.NoError(t, err)
+	assert.Equal(t, BTRFSQGroupLimits{"containers/c1": 10737418240, "custom/default_vol1": 1073741824}, exported)
+
+	// Clear the limits and remove a subvolume.
+	limits = map[string]string{}
+	delete(subvols, "259")
+
+	err = btrfsQGroupImport(run, poolMount, exported)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"0/257": "10737418240"}, limits)
+
+	restored, err := btrfsQGroupExport(run, poolMount)
+	assert.NoError(t, err)
+	assert.Equal(t, BTRFSQGroupLimits{"containers/c1": 10737418240}, restored)
+}
+
+// Test that the quota rescan progress is reported and that it's left running once the timeout is reached.
+func TestBtrfsQuotaRescan(t *testing.T) {
+	btrfsQuotaRescanInterval = time.Millisecond
+
+	// Fake btrfs with a rescan completing after the given number of status checks.
+	mockRescan := func(checks int) btrfsCommandFunc {
+		return func(args ...string) (string, error) {
+			if len(args) == 4 && args[2] == "-s" {
+				if checks <= 0 {
+					return "no rescan operation in progress\n", nil
+				}
+
+				checks--
+				return fmt.Sprintf("rescan operation running (current key %d)\n", 1000-checks*100), nil
+			}
+
+			return "quota rescan started\n", nil
+		}
+	}
+
+	progress := []string{}
+	completed, err := btrfsQuotaRescan(mockRescan(2), "/pool", time.Minute, func(stage string) { progress = append(progress, stage) })
+	assert.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []string{"Quota rescan running (current key 900)", "Quota rescan running (current key 1000)", "Quota rescan complete"}, progress)
+
+	// A rescan taking longer than the timeout continues in the background.
+	progress = []string{}
+	completed, err = btrfsQuotaRescan(mockRescan(1000000), "/pool", 10*time.Millisecond, func(stage string) { progress = append(progress, stage) })
+	assert.NoError(t, err)
+	assert.False(t, completed)
+	assert.NotEmpty(t, progress)
+	assert.NotContains(t, progress, "Quota rescan complete")
+
+	// A rescan already in progress, such as the one started by enabling quotas, is waited for.
+	inProgress := func(checks int) btrfsCommandFunc {
+		run := mockRescan(checks)
+		return func(args ...string) (string, error) {
+			if len(args) == 3 {
+				return "", fmt.Errorf("ERROR: quota rescan failed: %v", unix.EINPROGRESS)
+			}
+
+			return run(args...)
+		}
+	}
+
+	progress = []string{}
+	completed, err = btrfsQuotaRescan(inProgress(1), "/pool", time.Minute, func(stage string) { progress = append(progress, stage) })
+	assert.NoError(t, err)
+	assert.True(t, completed)
+	assert.Equal(t, []string{"Quota rescan running (current key 1000)", "Quota rescan complete"}, progress)
+
+	// Other failures to start the rescan are reported.
+	_, err = btrfsQuotaRescan(func(args ...string) (string, error) { return "", fmt.Errorf("Permission denied") }, "/pool", time.Minute, func(string) {})
+	assert.Error(t, err)
+}
+
+// Test that both paths reference the swapped content after btrfsSubVolumeSwap.
+func TestBtrfsSubVolumeSwap(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live")
+	staging := filepath.Join(dir, "staging")
+
+	for path, content := range map[string]string{live: "v1", staging: "v2"} {
+		assert.NoError(t, os.Mkdir(path, 0700))
+		assert.NoError(t, os.WriteFile(filepath.Join(path, "version"), []byte(content), 0600))
+	}
+
+	err := btrfsSubVolumeSwap(live, staging)
+	if err != nil && strings.Contains(err.Error(), "RENAME_EXCHANGE not supported") {
+		t.Skip(err)
+	}
+
+	assert.NoError(t, err)
+
+	for path, content := range map[string]string{live: "v2", staging: "v1"} {
+		data, err := os.ReadFile(filepath.Join(path, "version"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+
+	// Swapping with a missing path fails and leaves the other in place.
+	assert.Error(t, btrfsSubVolumeSwap(live, filepath.Join(dir, "missing")))
+	assert.DirExists(t, live)
+}
+
+// Test that a clone gets its own qgroup, even if the source has none, and that writing to it doesn't affect the
+// exclusive usage of the source.
+func TestBtrfsCloneQGroup(t *testing.T) {
+	dir := btrfsTestDir(t)
+	d := &btrfs{}
+
+	srcPath := filepath.Join(dir, "clone-src")
+	clonePath := filepath.Join(dir, "clone-dst")
+
+	sync := func() {
+		_, err := shared.RunCommand("btrfs", "filesystem", "sync", dir)
+		assert.NoError(t, err)
+	}
+
+	_, err := shared.RunCommand("btrfs", "quota", "enable", dir)
+	assert.NoError(t, err)
+
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", srcPath)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(srcPath, true) }()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(srcPath, "data"), make([]byte, 1024*1024), 0600))
+
+	// Clone a source without a qgroup.
+	qgroup, _, err := d.getQGroup(srcPath)
+	assert.NoError(t, err)
+	_, err = shared.RunCommand("btrfs", "qgroup", "destroy", qgroup, srcPath)
+	assert.NoError(t, err)
+
+	err = d.snapshotSubvolume(srcPath, clonePath, true, nil)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(clonePath, true) }()
+
+	err = d.ensureQGroup(clonePath)
+	assert.NoError(t, err)
+
+	// Track the source again to measure its usage.
+	err = d.ensureQGroup(srcPath)
+	assert.NoError(t, err)
+	_, err = shared.RunCommand("btrfs", "quota", "rescan", "-w", dir)
+	assert.NoError(t, err)
+
+	sync()
+	_, srcExclusive, err := btrfsSubVolumeQGroupUsage(srcPath)
+	assert.NoError(t, err)
+
+	// Write to the clone.
+	assert.NoError(t, os.WriteFile(filepath.Join(clonePath, "new"), make([]byte, 4*1024*1024), 0600))
+	sync()
+
+	_, exclusive, err := btrfsSubVolumeQGroupUsage(srcPath)
+	assert.NoError(t, err)
+	assert.Equal(t, srcExclusive, exclusive)
+
+	_, cloneExclusive, err := btrfsSubVolumeQGroupUsage(clonePath)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, cloneExclusive, int64(4*1024*1024))
+}
+
+// Test that deletions succeed on a pool with exhausted metadata once the emergency path freed space.
+func TestBtrfsEnsureMetadataSpace(t *testing.T) {
+	usageOutput := func(unallocated int64, metadataUsed int64) string {
+		return fmt.Sprintf(`Overall:
+    Device size:                 10737418240
+    Device allocated:            %d
+    Device unallocated:          %d
+    Used:                        9663676416
+    Global reserve:              3670016	(used: 0)
+
+Data,single: Size:9663676416, Used:8589934592 (88.89%%)
+   /dev/sdb	9663676416
+
+Metadata,DUP: Size:536870912, Used:%d (99.00%%)
+   /dev/sdb	1073741824
+`, 10737418240-unallocated, unallocated, metadataUsed)
+	}
+
+	// Fake btrfs whose deletions fail until empty data chunks are balanced away.
+	metadataFull := true
+	balanced := []string{}
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "filesystem usage":
+			if metadataFull {
+				return usageOutput(0, 531502203), nil
+			}
+
+			return usageOutput(1073741824, 531502203), nil
+		case "balance start":
+			balanced = append(balanced, args[2])
+			metadataFull = false
+			return "", nil
+		case "subvolume delete":
+			if metadataFull {
+				return "", fmt.Errorf("ERROR: Could not destroy subvolume/snapshot: No space left on device")
+			}
+
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	// A normal delete fails under metadata pressure.
+	_, err := run("subvolume", "delete", "/pool/containers/c1")
+	assert.Error(t, err)
+
+	freed, err := btrfsEnsureMetadataSpace(run, "/pool")
+	assert.NoError(t, err)
+	assert.True(t, freed)
+	assert.Equal(t, []string{"-dusage=0", "-dusage=5"}, balanced)
+
+	_, err = run("subvolume", "delete", "/pool/containers/c1")
+	assert.NoError(t, err)
+
+	// Nothing is done once there is space again.
+	freed, err = btrfsEnsureMetadataSpace(run, "/pool")
+	assert.NoError(t, err)
+	assert.False(t, freed)
+	assert.Len(t, balanced, 2)
+
+	usage, err := parseBtrfsMetadataUsage(usageOutput(0, 531502203))
+	assert.NoError(t, err)
+	assert.Equal(t, btrfsMetadataUsage{Size: 536870912, Used: 531502203, Unallocated: 0}, usage)
+}
+
+// Test that the metadata of a pool is only checked again once the interval passed, unless it was near full.
+func TestBtrfsMetadataCheckDue(t *testing.T) {
+	poolMount := "/var/lib/lxd/storage-pools/metadata-check"
+	defer btrfsMetadataCheckDone(poolMount, time.Time{}, false)
+
+	now := time.Now()
+	assert.True(t, btrfsMetadataCheckDue(poolMount, now))
+
+	btrfsMetadataCheckDone(poolMount, now, true)
+	assert.False(t, btrfsMetadataCheckDue(poolMount, now.Add(btrfsMetadataCheckInterval/2)))
+	assert.True(t, btrfsMetadataCheckDue(poolMount, now.Add(btrfsMetadataCheckInterval)))
+
+	// Other pools are checked independently.
+	assert.True(t, btrfsMetadataCheckDue("/var/lib/lxd/storage-pools/other", now))
+
+	// Near full pools are checked on every use.
+	btrfsMetadataCheckDone(poolMount, now, false)
+	assert.True(t, btrfsMetadataCheckDue(poolMount, now))
+
+	// The metadata of a real filesystem with space left isn't near full.
+	freed, err := btrfsEnsureMetadataSpace(runBtrfsCommand, btrfsTestDir(t))
+	assert.NoError(t, err)
+	assert.False(t, freed)
+}
+
+// Test that a receive is refused when its estimated size and metadata don't fit in the free space.
+func TestBtrfsCheckReceiveSpace(t *testing.T) {
+	// 10GiB free with DUP metadata.
+	usageOutput := `Overall:
+    Device size:                 21474836480
+    Device allocated:            11811160064
+    Device unallocated:           9663676416
+    Used:                         8589934592
+    Free (estimated):            10737418240	(min: 5905580032)
+    Free (statfs, df):           10737418240
+    Data ratio:                         1.00
+    Metadata ratio:                     2.00
+    Global reserve:                  3670016	(used: 0)
+
+Data,single: Size:10737418240, Used:8589934592 (80.00%)
+   /dev/sdb	10737418240
+`
+
+	var ran []string
+	run := func(args ...string) (string, error) {
+		ran = append(ran, strings.Join(args, " "))
+		return usageOutput, nil
+	}
+
+	space, err := parseBtrfsFreeSpace(usageOutput)
+	assert.NoError(t, err)
+	assert.Equal(t, btrfsFreeSpace{Free: 10737418240, MetadataRatio: 2}, space)
+
+	// 5GiB with 4% of metadata fits.
+	assert.NoError(t, btrfsCheckReceiveSpace(run, "/pool", 5368709120))
+	assert.Equal(t, []string{"filesystem usage -b /pool"}, ran)
+
+	// 12GiB doesn't.
+	err = btrfsCheckReceiveSpace(run, "/pool", 12884901888)
+	assert.EqualError(t, err, "Not enough free space on the storage pool to receive the volume: 13400297963 bytes needed (12884901888 bytes of data and 515396075 bytes of metadata) but only 10737418240 bytes free")
+
+	// 10GiB of data would fit but not with its metadata.
+	assert.Error(t, btrfsCheckReceiveSpace(run, "/pool", 10737418240))
+
+	_, err = parseBtrfsFreeSpace("Overall:\n    Device size: 21474836480\n")
+	assert.Error(t, err)
+}
+
+// Test that each deviation of a malformed pool layout is reported.
+func TestBtrfsLayoutDeviations(t *testing.T) {
+	poolMount := t.TempDir()
+
+	subvolumes := map[string]bool{}
+	mkdir := func(path string, subvolume bool) {
+		assert.NoError(t, os.MkdirAll(filepath.Join(poolMount, path), 0700))
+		if subvolume {
+			subvolumes[filepath.Join(poolMount, path)] = true
+		}
+	}
+
+	mkfile := func(path string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(poolMount, path), nil, 0600))
+	}
+
+	// Expected layout.
+	mkdir("containers", false)
+	mkdir("containers/default_c1", true)
+	mkdir("containers-snapshots/default_c1/snap0", true)
+	mkdir("containers-path-snapshots", false)
+	mkdir("virtual-machines", false)
+	mkdir("virtual-machines/default_v1", true)
+	mkdir("virtual-machines-path-snapshots", false)
+
+	// Deviations.
+	mkdir("containers-snapshots/default_c1/snap1", false)
+	mkdir("images/fingerprint", false)
+	mkfile("images/stray")
+	mkfile("custom-snapshots")
+	mkdir("virtual-machines-snapshots", false)
+	mkfile("virtual-machines-snapshots/default_v1")
+
+	isSubvolume := func(path string) bool { return subvolumes[path] }
+
+	volTypes := []VolumeType{VolumeTypeContainer, VolumeTypeVM, VolumeTypeCustom, VolumeTypeImage}
+	deviations, err := btrfsLayoutDeviations(poolMount, poolMount, PoolLayoutNested, volTypes, isSubvolume)
+	assert.NoError(t, err)
+
+	found := map[string]string{}
+	for _, deviation := range deviations {
+		found[deviation.Path] = deviation.Problem
+		assert.NotEmpty(t, deviation.Message)
+	}
+
+	assert.Equal(t, map[string]string{
+		"containers-snapshots/default_c1/snap1": LayoutProblemNotSubvolume,
+		"virtual-machines-snapshots/default_v1": LayoutProblemNotDirectory,
+		"custom":                                LayoutProblemMissing,
+		"custom-snapshots":                      LayoutProblemNotDirectory,
+		"custom-path-snapshots":                 LayoutProblemMissing,
+		"images/fingerprint":                    LayoutProblemNotSubvolume,
+		"images/stray":                          LayoutProblemUnexpectedEntry,
+	}, found)
+
+	// A valid layout has no deviations.
+	poolMount = t.TempDir()
+	for _, volType := range volTypes {
+		for _, dir := range BaseDirectories[volType] {
+			mkdir(dir, false)
+		}
+	}
+
+	deviations, err = btrfsLayoutDeviations(poolMount, poolMount, PoolLayoutNested, volTypes, isSubvolume)
+	assert.NoError(t, err)
+	assert.Empty(t, deviations)
+
+	// The flat layout has no base directories and its entries are at the root of the pool.
+	poolMount = t.TempDir()
+	mkdir("containers_default_c1", true)
+	mkdir("containers-snapshots_default_c1/snap0", true)
+	mkdir("custom_default_vol", true)
+
+	deviations, err = btrfsLayoutDeviations(poolMount, poolMount, PoolLayoutFlat, volTypes, isSubvolume)
+	assert.NoError(t, err)
+	assert.Empty(t, deviations)
+
+	mkdir("virtual-machines_default_v1", false)
+	mkdir("containers-snapshots_default_c1/snap1", false)
+	mkfile("custom-snapshots_default_vol")
+
+	deviations, err = btrfsLayoutDeviations(poolMount, poolMount, PoolLayoutFlat, volTypes, isSubvolume)
+	assert.NoError(t, err)
+
+	found = map[string]string{}
+	for _, deviation := range deviations {
+		found[deviation.Path] = deviation.Problem
+	}
+
+	assert.Equal(t, map[string]string{
+		"containers-snapshots_default_c1/snap1": LayoutProblemNotSubvolume,
+		"custom-snapshots_default_vol":          LayoutProblemNotDirectory,
+		"virtual-machines_default_v1":           LayoutProblemNotSubvolume,
+	}, found)
+}
+
+// btrfsTestStream returns a send stream with a subvolume command per subvolume, followed by a file creation.
+// A parent is referenced through a snapshot command.
+func btrfsTestStream(subvols ...btrfsStreamSubvolume) []byte {
+	attr := func(attrType uint16, value []byte) []byte {
+		buf := make([]byte, 4, 4+len(value))
+		binary.LittleEndian.PutUint16(buf[0:2], attrType)
+		binary.LittleEndian.PutUint16(buf[2:4], uint16(len(value)))
+		return append(buf, value...)
+	}
+
+	cmd := func(cmdType uint16, payload []byte) []byte {
+		buf := make([]byte, btrfsSendCmdHeaderLen, btrfsSendCmdHeaderLen+len(payload))
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint16(buf[4:6], cmdType)
+		return append(buf, payload...)
+	}
+
+	stream := []byte{}
+	for _, subvol := range subvols {
+		stream = append(stream, []byte(btrfsSendStreamMagic+"\x01\x00\x00\x00")...)
+
+		payload := attr(btrfsSendAttrPath, []byte(subvol.Name))
+		payload = append(payload, attr(btrfsSendAttrUUID, uuid.Parse(subvol.UUID))...)
+		if subvol.ParentUUID != "" {
+			payload = append(payload, attr(btrfsSendAttrCloneUUID, uuid.Parse(subvol.ParentUUID))...)
+			stream = append(stream, cmd(btrfsSendCmdSnapshot, payload)...)
+		} else {
+			stream = append(stream, cmd(btrfsSendCmdSubvol, payload)...)
+		}
+
+		stream = append(stream, cmd(3, attr(btrfsSendAttrPath, []byte("file")))...)
+		stream = append(stream, cmd(btrfsSendCmdEnd, nil)...)
+	}
+
+	return stream
+}
+
+// Test that subvolumes are received in order, that the parent chain is checked before receiving and that
+// partially received subvolumes are deleted on failure.
+func TestBtrfsSnapshotImport(t *testing.T) {
+	snap0 := btrfsStreamSubvolume{Name: "snap0", UUID: "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c01"}
+	snap1 := btrfsStreamSubvolume{Name: "snap1", UUID: "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c02", ParentUUID: snap0.UUID}
+	vol := btrfsStreamSubvolume{Name: "c1", UUID: "9e7e3c4e-8dc0-4a2a-9d0a-2f8e0a6b0c03", ParentUUID: snap1.UUID}
+
+	var deleted []string
+	run := func(args ...string) (string, error) {
+		if strings.Join(args[:2], " ") == "subvolume delete" {
+			deleted = append(deleted, args[2])
+			return "", os.RemoveAll(args[2])
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	// Fake receive checking that each subvolume gets a stream of its own.
+	var receivedCmds [][]byte
+	failOn := ""
+	receive := func(dir string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(string(data), btrfsSendStreamMagic) {
+			return fmt.Errorf("Missing stream header")
+		}
+
+		cmd := data[btrfsSendStreamHeaderLen:]
+		payloadLen := binary.LittleEndian.Uint32(cmd[0:4])
+		subvol, err := parseBtrfsStreamSubvolume(cmd[btrfsSendCmdHeaderLen : btrfsSendCmdHeaderLen+payloadLen])
+		if err != nil {
+			return err
+		}
+
+		err = os.Mkdir(filepath.Join(dir, subvol.Name), 0700)
+		if err != nil {
+			return err
+		}
+
+		if subvol.Name == failOn {
+			return fmt.Errorf("Receive failed")
+		}
+
+		receivedCmds = append(receivedCmds, data)
+		return nil
+	}
+
+	// Full chain.
+	dir := t.TempDir()
+	subvols, err := btrfsSnapshotImport(run, receive, bytes.NewReader(btrfsTestStream(snap0, snap1, vol)), dir, nil)
+	assert.NoError(t, err)
+	assert.Len(t, subvols, 3)
+	assert.Len(t, receivedCmds, 3)
+
+	for i, expected := range []btrfsStreamSubvolume{snap0, snap1, vol} {
+		expected.Path = filepath.Join(dir, strconv.Itoa(i), expected.Name)
+		assert.Equal(t, expected, subvols[i])
+		assert.DirExists(t, expected.Path)
+	}
+
+	assert.Empty(t, deleted)
+
+	// Missing parent in the chain is detected before receiving the subvolume.
+	dir = t.TempDir()
+	receivedCmds = nil
+	_, err = btrfsSnapshotImport(run, receive, bytes.NewReader(btrfsTestStream(snap0, vol)), dir, nil)
+	assert.ErrorContains(t, err, "isn't available")
+	assert.Len(t, receivedCmds, 1)
+	assert.Equal(t, []string{filepath.Join(dir, "0", "snap0")}, deleted)
+
+	// A parent already on the target satisfies the chain.
+	dir = t.TempDir()
+	deleted = nil
+	subvols, err = btrfsSnapshotImport(run, receive, bytes.NewReader(btrfsTestStream(vol)), dir, map[string]bool{snap1.UUID: true})
+	assert.NoError(t, err)
+	assert.Len(t, subvols, 1)
+
+	// A failed receive deletes the partially received subvolume and the ones received before it.
+	dir = t.TempDir()
+	failOn = "snap1"
+	_, err = btrfsSnapshotImport(run, receive, bytes.NewReader(btrfsTestStream(snap0, snap1, vol)), dir, nil)
+	assert.ErrorContains(t, err, "Receive failed")
+	assert.Equal(t, []string{filepath.Join(dir, "1", "snap1"), filepath.Join(dir, "0", "snap0")}, deleted)
+
+	// Truncated and invalid streams are rejected.
+	stream := btrfsTestStream(snap0)
+	_, err = btrfsSnapshotImport(run, receive, bytes.NewReader(stream[:len(stream)-15]), t.TempDir(), nil)
+	assert.Error(t, err)
+
+	// So are streams interrupted between two commands, nothing being left behind.
+	dir = t.TempDir()
+	_, err = btrfsSnapshotImport(run, receive, bytes.NewReader(stream[:len(stream)-btrfsSendCmdHeaderLen]), dir, nil)
+	assert.ErrorContains(t, err, "incomplete")
+	assert.NoDirExists(t, filepath.Join(dir, "0", "snap0"))
+
+	_, err = btrfsSnapshotImport(run, receive, bytes.NewReader([]byte("not a stream")), t.TempDir(), nil)
+	assert.ErrorContains(t, err, "Invalid send stream header")
+}
+
+// Test exporting an instance volume with snapshots, wiping it and restoring it from the stream.
+func TestBtrfsVolumeStreamExportImport(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "stream.")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(lxdDir) }()
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	for _, dir := range BaseDirectories[VolumeTypeContainer] {
+		assert.NoError(t, os.MkdirAll(filepath.Join(GetPoolMountPath(d.name), dir), 0711))
+	}
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+	assert.NoError(t, err)
+	assert.NoError(t, createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name))
+
+	// Write a different version before each snapshot.
+	snapshots := []string{"snap0", "snap1"}
+	for i, snapName := range snapshots {
+		assert.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "version"), []byte(strconv.Itoa(i)), 0600))
+
+		snapVol, _ := vol.NewSnapshot(snapName)
+		_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", vol.MountPath(), snapVol.MountPath())
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "version"), []byte("current"), 0600))
+
+	stream := bytes.Buffer{}
+	err = d.exportVolumeStream(vol, snapshots, &stream)
+	assert.NoError(t, err)
+
+	// Wipe the volume and its snapshots.
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+		assert.NoError(t, d.deleteSubvolume(snapVol.MountPath(), false))
+	}
+
+	assert.NoError(t, d.deleteSubvolume(vol.MountPath(), false))
+	assert.NoError(t, os.Remove(getVolumeSnapshotDir(d.name, d.config, vol.volType, vol.name)))
+
+	err = d.importVolumeStream(vol, &stream, nil)
+	assert.NoError(t, err)
+
+	for i, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+		data, err := os.ReadFile(filepath.Join(snapVol.MountPath(), "version"))
+		assert.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(data))
+	}
+
+	data, err := os.ReadFile(filepath.Join(vol.MountPath(), "version"))
+	assert.NoError(t, err)
+	assert.Equal(t, "current", string(data))
+
+	// The restored volume is writable.
+	assert.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "version"), []byte("new"), 0600))
+
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+		_ = d.deleteSubvolume(snapVol.MountPath(), false)
+	}
+
+	_ = d.deleteSubvolume(vol.MountPath(), false)
+}
+
+// Test creating a volume from a send stream served over HTTP, incomplete streams or ones not matching the
+// checksum leaving nothing behind.
+func TestBtrfsCreateVolumeFromStream(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "stream.")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(lxdDir) }()
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	for _, dir := range BaseDirectories[VolumeTypeContainer] {
+		require.NoError(t, os.MkdirAll(filepath.Join(GetPoolMountPath(d.name), dir), 0711))
+	}
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "hello"), []byte("world"), 0600))
+
+	stream := bytes.Buffer{}
+	require.NoError(t, d.exportVolumeStream(vol, nil, &stream))
+	require.NoError(t, d.deleteSubvolume(vol.MountPath(), false))
+
+	sum := sha256.Sum256(stream.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(stream.Len()))
+
+		// Simulate an interrupted download by only sending half of the stream.
+		if r.URL.Path == "/truncated" {
+			_, _ = w.Write(stream.Bytes()[:stream.Len()/2])
+			return
+		}
+
+		_, _ = w.Write(stream.Bytes())
+	}))
+	defer server.Close()
+
+	create := func(path string, checksum string) error {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		return d.CreateVolumeFromStream(vol, resp.Body, checksum, nil)
+	}
+
+	// Nothing is left behind, only the volumes directory remaining.
+	assertEmpty := func() {
+		assert.False(t, d.HasVolume(vol))
+
+		entries, err := os.ReadDir(getVolumeMountPath(d.name, d.config, vol.volType, ""))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+
+	err = create("/truncated", checksum)
+	assert.Error(t, err)
+	assertEmpty()
+
+	err = create("/stream", strings.Repeat("0", 64))
+	assert.ErrorContains(t, err, "doesn't match")
+	assertEmpty()
+
+	err = create("/stream", checksum)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(vol.MountPath(), "hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+
+	// The created volume is writable.
+	assert.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), "hello"), []byte("again"), 0600))
+
+	_ = d.deleteSubvolume(vol.MountPath(), false)
+}
+
+// Test that created subvolumes and their parent directories get the configured mode under a restrictive umask.
+func TestBtrfsSubVolumeCreateMode(t *testing.T) {
+	dir, err := os.MkdirTemp(btrfsTestDir(t), "mode.")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldUmask := unix.Umask(0077)
+	defer unix.Umask(oldUmask)
+
+	d := &btrfs{}
+	d.config = map[string]string{"btrfs.subvolume_mode": "0751"}
+
+	subvolPath := filepath.Join(dir, "parent", "subvol")
+	err = btrfsSubVolumeCreate(subvolPath, d.subvolumeMode(), nil)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(subvolPath, false) }()
+
+	for _, path := range []string{filepath.Dir(subvolPath), subvolPath} {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0751), info.Mode().Perm(), path)
+	}
+
+	assert.True(t, btrfsIsSubVolume(subvolPath))
+}
+
+// Test that the root of created subvolumes and snapshots is owned by the mapped root ids.
+func TestBtrfsSubVolumeCreateOwner(t *testing.T) {
+	dir, err := os.MkdirTemp(btrfsTestDir(t), "owner.")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	d := &btrfs{}
+	owner := &volumeOwner{uid: 1000000, gid: 1000000}
+
+	assertOwner := func(path string, uid int, gid int) {
+		st := unix.Stat_t{}
+		assert.NoError(t, unix.Lstat(path, &st))
+		assert.Equal(t, uid, int(st.Uid), path)
+		assert.Equal(t, gid, int(st.Gid), path)
+	}
+
+	subvolPath := filepath.Join(dir, "subvol")
+	err = btrfsSubVolumeCreate(subvolPath, d.subvolumeMode(), owner)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(subvolPath, true) }()
+
+	assertOwner(subvolPath, 1000000, 1000000)
+
+	// Snapshots of an already shifted source keep its ownership.
+	shiftedSnapPath := filepath.Join(dir, "shifted-snap")
+	err = d.snapshotSubvolume(subvolPath, shiftedSnapPath, true, owner)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(shiftedSnapPath, true) }()
+
+	assertOwner(shiftedSnapPath, 1000000, 1000000)
+
+	// Snapshots of an unshifted source get the ownership.
+	unshiftedPath := filepath.Join(dir, "unshifted")
+	err = btrfsSubVolumeCreate(unshiftedPath, d.subvolumeMode(), nil)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(unshiftedPath, true) }()
+
+	assertOwner(unshiftedPath, 0, 0)
+
+	snapPath := filepath.Join(dir, "snap")
+	err = d.snapshotSubvolume(unshiftedPath, snapPath, true, owner)
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(snapPath, true) }()
+
+	assertOwner(snapPath, 1000000, 1000000)
+	assertOwner(unshiftedPath, 0, 0)
+}
+
+// Test that snapshots are sorted by the space exclusively owned by them and that disabled quotas are reported.
+func TestBtrfsSnapshotsReclaimableSpace(t *testing.T) {
+	d := &btrfs{}
+	vol := NewVolume(d, "testpool", VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+
+	exclusive := map[string]int64{"snap0": 4096, "snap1": 10 * 1024 * 1024, "snap2": 0, "snap3": 4096, "snap4": 512 * 1024}
+	usage := func(path string) (int64, int64, error) {
+		return 20 * 1024 * 1024, exclusive[filepath.Base(path)], nil
+	}
+
+	report, err := btrfsSnapshotsReclaimableSpace(vol, []string{"snap0", "snap1", "snap2", "snap3", "snap4"}, usage)
+	assert.NoError(t, err)
+	assert.Equal(t, ReclaimableMethodExclusive, report.Method)
+	assert.Empty(t, report.Unavailable)
+
+	names := []string{}
+	for i, snapshot := range report.Snapshots {
+		assert.Equal(t, exclusive[snapshot.Name], snapshot.Reclaimable)
+		if i > 0 {
+			assert.GreaterOrEqual(t, report.Snapshots[i-1].Reclaimable, snapshot.Reclaimable)
+		}
+
+		names = append(names, snapshot.Name)
+	}
+
+	assert.Equal(t, []string{"snap1", "snap4", "snap0", "snap3", "snap2"}, names)
+
+	// Quotas disabled.
+	noQuota := func(path string) (int64, int64, error) { return -1, -1, errBtrfsNoQuota }
+	report, err = btrfsSnapshotsReclaimableSpace(vol, []string{"snap0"}, noQuota)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Method)
+	assert.NotEmpty(t, report.Unavailable)
+	assert.Empty(t, report.Snapshots)
+}
+
+// Test that subvolumes not belonging to any managed volume are flagged.
+func TestBtrfsStraySubvolumes(t *testing.T) {
+	managed := []string{
+		"containers/default_c1",
+		"containers-snapshots/default_c1/snap0",
+		"images/fingerprint",
+		"custom/default_vol1",
+	}
+
+	subvols := []string{
+		"containers",                          // Base directory of an older pool.
+		"containers/default_c1",               // Instance.
+		"containers/default_c1/var/lib/media", // Created by the instance workload.
+		"containers-snapshots/default_c1",     // Contains a snapshot.
+		"containers-snapshots/default_c1/snap0",
+		"images/fingerprint",
+		"custom/default_vol1",
+		"custom/manual",                               // Created manually.
+		"containers/default_gone",                     // Instance deleted from the database.
+		"backup",                                      // Created manually at the pool root.
+		"containers-path-snapshots/default_c1/data",   // Snapshot of a path within an instance.
+		"containers-path-snapshots/default_gone/data", // Snapshot of a path within a deleted instance.
+	}
+
+	volTypes := []VolumeType{VolumeTypeContainer, VolumeTypeVM, VolumeTypeCustom, VolumeTypeImage}
+	stray := btrfsStraySubvolumes(subvols, managed, PoolLayoutNested, volTypes)
+	assert.Equal(t, []string{"backup", "containers-path-snapshots/default_gone/data", "containers/default_gone", "custom/manual"}, stray)
+
+	// Nothing is flagged when all subvolumes are managed.
+	assert.Empty(t, btrfsStraySubvolumes(managed, managed, PoolLayoutNested, volTypes))
+
+	// The flat layout keeps the volumes and snapshot directories at the root of the pool.
+	managed = []string{
+		"containers_default_c1",
+		"containers-snapshots_default_c1/snap0",
+		"custom_default_vol1",
+	}
+
+	subvols = []string{
+		"containers_default_c1",
+		"containers_default_c1/var/lib/media",
+		"containers-snapshots_default_c1/snap0",
+		"custom_default_vol1",
+		"custom_manual",
+		"containers-path-snapshots_default_c1/data",
+		"containers-path-snapshots_default_gone/data",
+	}
+
+	stray = btrfsStraySubvolumes(subvols, managed, PoolLayoutFlat, volTypes)
+	assert.Equal(t, []string{"containers-path-snapshots_default_gone/data", "custom_manual"}, stray)
+}
+
+// Test that only writable subvolumes are made read-only and that failures are reported.
+func TestBtrfsRepairReadonly(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{}
+	for _, name := range []string{"ro", "rw1", "rw2"} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.Mkdir(path, 0700))
+		paths = append(paths, path)
+	}
+
+	readonly := map[string]bool{paths[0]: true}
+	isRo := func(path string) bool { return readonly[path] }
+	makeRo := func(path string) error {
+		readonly[path] = true
+		return nil
+	}
+
+	// Missing subvolumes are skipped.
+	repaired, err := btrfsRepairReadonly(append(paths, filepath.Join(dir, "missing")), isRo, makeRo)
+	assert.NoError(t, err)
+	assert.Equal(t, paths[1:], repaired)
+	assert.True(t, readonly[paths[1]])
+	assert.True(t, readonly[paths[2]])
+
+	// Nothing left to repair.
+	repaired, err = btrfsRepairReadonly(paths, isRo, makeRo)
+	assert.NoError(t, err)
+	assert.Empty(t, repaired)
+
+	// Corrections made before a failure are still reported.
+	readonly = map[string]bool{}
+	repaired, err = btrfsRepairReadonly(paths, isRo, func(path string) error {
+		if path == paths[1] {
+			return fmt.Errorf("Permission denied")
+		}
+
+		readonly[path] = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, paths[:1], repaired)
+}
+
+// Test that an image subvolume made writable is made read-only again.
+func TestBtrfsRepairReadonlyImage(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "readonly.")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(lxdDir) }()
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	vol := NewVolume(d, d.name, VolumeTypeImage, ContentTypeFS, "fingerprint", nil, nil)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(vol.MountPath()), 0700))
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+	assert.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(vol.MountPath(), false) }()
+
+	// Flip the image to read-write.
+	assert.NoError(t, d.setSubvolumeReadonlyProperty(vol.MountPath(), false))
+	assert.False(t, BTRFSSubVolumeIsRo(vol.MountPath()))
+
+	repaired, err := d.RepairReadonly([]Volume{vol}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"images/fingerprint"}, repaired)
+	assert.True(t, BTRFSSubVolumeIsRo(vol.MountPath()))
+
+	// Read-only images are left alone.
+	repaired, err = d.RepairReadonly([]Volume{vol}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, repaired)
+}
+
+// Test that writable subvolumes expected to be read-only are reported, and updated once repaired.
+func TestBtrfsReadonlyHealthIssues(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{}
+	for _, name := range []string{"ro", "rw1", "rw2"} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.Mkdir(path, 0700))
+		paths = append(paths, path)
+	}
+
+	relPath := func(path string) (string, error) { return relPathUnder(dir, path) }
+	readonly := map[string]bool{paths[0]: true}
+	isRo := func(path string) bool { return readonly[path] }
+
+	// Missing subvolumes are skipped.
+	issues := btrfsReadonlyHealthIssues(append(paths, filepath.Join(dir, "missing")), relPath, isRo)
+	require.Len(t, issues, 2)
+	for i, name := range []string{"rw1", "rw2"} {
+		assert.Equal(t, HealthCheckReadonly, issues[i].Check)
+		assert.Equal(t, name, issues[i].Path)
+		assert.Contains(t, issues[i].Message, "is writable")
+		assert.Contains(t, issues[i].Recommendation, "btrfs property set "+paths[i+1]+" ro true")
+	}
+
+	// Only the repaired subvolumes are reported as such.
+	btrfsReadonlyIssuesRepaired(issues, []string{"rw2"})
+	assert.Contains(t, issues[0].Message, "is writable")
+	assert.Contains(t, issues[1].Message, "has been made read-only again")
+	assert.Equal(t, "Find out what made it writable", issues[1].Recommendation)
+
+	// Nothing left to report.
+	readonly[paths[1]] = true
+	readonly[paths[2]] = true
+	assert.Empty(t, btrfsReadonlyHealthIssues(paths, relPath, isRo))
+}
+
+// Test that a snapshot made writable is reported by the health check and made read-only again when repairing.
+func TestBtrfsCheckReadonlySnapshot(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "readonly.")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(lxdDir) }()
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	snapVol, err := vol.NewSnapshot("snap0")
+	require.NoError(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(vol.MountPath()), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Dir(snapVol.MountPath()), 0700))
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+	require.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(vol.MountPath(), false) }()
+
+	_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", vol.MountPath(), snapVol.MountPath())
+	require.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(snapVol.MountPath(), false) }()
+
+	// A read-only snapshot is healthy.
+	issues, err := d.CheckReadonly([]Volume{snapVol}, false)
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	// Flip the snapshot to read-write.
+	require.NoError(t, d.setSubvolumeReadonlyProperty(snapVol.MountPath(), false))
+
+	issues, err = d.CheckReadonly([]Volume{snapVol}, false)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.Equal(t, HealthCheckReadonly, issues[0].Check)
+	assert.Equal(t, "containers-snapshots/c1/snap0", issues[0].Path)
+	assert.False(t, BTRFSSubVolumeIsRo(snapVol.MountPath()))
+
+	// Repairing makes it read-only again.
+	issues, err = d.CheckReadonly([]Volume{snapVol}, true)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	assert.True(t, BTRFSSubVolumeIsRo(snapVol.MountPath()))
+
+	issues, err = d.CheckReadonly([]Volume{snapVol}, false)
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	// Repairing isn't possible from within a user namespace.
+	require.NoError(t, d.setSubvolumeReadonlyProperty(snapVol.MountPath(), false))
+	d.state.OS.RunningInUserNS = true
+	issues, err = d.CheckReadonly([]Volume{snapVol}, true)
+	assert.ErrorIs(t, err, ErrNotSupported)
+	require.Len(t, issues, 1)
+	assert.Contains(t, issues[0].Message, "is writable")
+}
+
+// Test that the deletion progress is reported once per deleted subvolume, in order.
+func TestBtrfsDeleteProgressWriter(t *testing.T) {
+	type call struct{ current, total int }
+	calls := []call{}
+
+	w := &btrfsDeleteProgressWriter{total: 3, progress: func(current int, total int) {
+		calls = append(calls, call{current, total})
+	}}
+
+	output := "Delete subvolume (no-commit): '/pool/c1/a/b'\nDelete subvolume (no-commit): '/pool/c1/a'\nWARNING: unrelated\nDelete subvolume (no-commit): '/pool/c1'\n"
+
+	// Output is split arbitrarily across writes.
+	for _, chunk := range []string{output[:10], output[10:60], output[60:]} {
+		n, err := w.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+
+	assert.Equal(t, []call{{1, 3}, {2, 3}, {3, 3}}, calls)
+
+	// The callback is optional.
+	w = &btrfsDeleteProgressWriter{total: 1}
+	_, err := w.Write([]byte("Delete subvolume (no-commit): '/pool/c1'\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, w.current)
+}
+
+// Test that deleting a tree of subvolumes reports progress for each of them.
+func TestBtrfsDeleteSubvolumeProgress(t *testing.T) {
+	dir, err := os.MkdirTemp(btrfsTestDir(t), "progress.")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	d := &btrfs{}
+	d.state = &state.State{OS: &sys.OS{}}
+
+	rootPath := filepath.Join(dir, "root")
+	for _, path := range []string{rootPath, filepath.Join(rootPath, "a"), filepath.Join(rootPath, "a", "b"), filepath.Join(rootPath, "c")} {
+		_, err = shared.RunCommand("btrfs", "subvolume", "create", path)
+		assert.NoError(t, err)
+	}
+
+	currents := []int{}
+	err = d.deleteSubvolumeProgress(rootPath, true, func(current int, total int) {
+		assert.Equal(t, 4, total)
+		currents = append(currents, current)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, currents)
+	assert.NoDirExists(t, rootPath)
+}
+
+// Test that the footprint of an instance and its snapshots counts the extents they share once.
+func TestBtrfsInstanceFootprint(t *testing.T) {
+	// An instance sharing 1000 bytes of image data with its snapshot, with data written before and after it.
+	usages := map[string][2]int64{
+		"/pool/containers/c1":                 {1350, 50},
+		"/pool/containers-snapshots/c1/snap0": {1300, 0},
+	}
+
+	usage := func(path string) (int64, int64, error) {
+		u, ok := usages[path]
+		if !ok {
+			return -1, -1, errBtrfsNoQuota
+		}
+
+		return u[0], u[1], nil
+	}
+
+	paths := []string{"/pool/containers/c1", "/pool/containers-snapshots/c1/snap0"}
+	footprint, err := btrfsInstanceFootprint(paths, usage)
+	require.NoError(t, err)
+
+	// Summing the usage of the subvolumes counts the shared data for each of them.
+	assert.Equal(t, int64(1350), footprint)
+	assert.Less(t, footprint, int64(1350+1300))
+
+	// Without quotas.
+	_, err = btrfsInstanceFootprint([]string{"/pool/containers/c2"}, usage)
+	assert.ErrorIs(t, err, errBtrfsNoQuota)
+}
+
+func TestBtrfsDestroySubvolumeQGroup(t *testing.T) {
+	var destroyed []string
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "qgroup show":
+			return "qgroupid         rfer         excl     max_excl\n--------         ----         ----     --------\n0/257        16384        16384         none\n", nil
+		case "qgroup destroy":
+			destroyed = append(destroyed, args[2])
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	// Qgroups are destroyed by default.
+	btrfsDestroySubvolumeQGroup(run, map[string]string{}, "/pool/containers/c1")
+	assert.Equal(t, []string{"0/257"}, destroyed)
+
+	btrfsDestroySubvolumeQGroup(run, map[string]string{"btrfs.manage_qgroups": "true"}, "/pool/containers/c1")
+	assert.Equal(t, []string{"0/257", "0/257"}, destroyed)
+
+	// The destroy command is skipped when the qgroups are managed externally.
+	destroyed = nil
+	btrfsDestroySubvolumeQGroup(run, map[string]string{"btrfs.manage_qgroups": "false"}, "/pool/containers/c1")
+	assert.Empty(t, destroyed)
+}
+
+// btrfsTestFrameConn is one end of an in-memory migration connection. As with the websocket connections used by
+// migrations, Close ends the frame being written and reads return io.EOF at the end of each frame.
+type btrfsTestFrameConn struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	frame  *bytes.Reader // Frame being read.
+	buf    bytes.Buffer  // Frame being written.
+	frames int           // Frames which can still be written before the connection drops, unlimited if negative.
+	sent   int           // Frames written.
+}
+
+// newBtrfsTestFrameConns returns the two ends of a migration connection, the first one dropping the connection
+// after writing the given number of frames (unlimited if negative).
+func newBtrfsTestFrameConns(frames int) (*btrfsTestFrameConn, *btrfsTestFrameConn) {
+	a := make(chan []byte, 16)
+	b := make(chan []byte, 16)
+
+	return &btrfsTestFrameConn{in: a, out: b, frames: frames}, &btrfsTestFrameConn{in: b, out: a, frames: -1}
+}
+
+func (c *btrfsTestFrameConn) Read(p []byte) (int, error) {
+	if c.frame == nil {
+		frame, ok := <-c.in
+		if !ok {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		c.frame = bytes.NewReader(frame)
+	}
+
+	n, err := c.frame.Read(p)
+	if err == io.EOF {
+		c.frame = nil
+	}
+
+	return n, err
+}
+
+func (c *btrfsTestFrameConn) Write(p []byte) (int, error) {
+	if c.frames == 0 {
+		return 0, fmt.Errorf("Connection lost")
+	}
+
+	return c.buf.Write(p)
+}
+
+func (c *btrfsTestFrameConn) Close() error {
+	if c.frames == 0 {
+		return fmt.Errorf("Connection lost")
+	}
+
+	c.out <- append([]byte{}, c.buf.Bytes()...)
+	c.buf.Reset()
+	c.sent++
+
+	if c.frames > 0 {
+		c.frames--
+		if c.frames == 0 {
+			close(c.out)
+		}
+	}
+
+	return nil
+}
+
+// Test that a migration of a volume with snapshots interrupted while sending the last snapshot is resumed by
+// the next migration from the last snapshot received, sending only the following ones.
+func TestBtrfsMigrationResume(t *testing.T) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(t), "migration-resume.")
+	require.NoError(t, err)
+
+	// Removed once the pools are unmounted.
+	t.Cleanup(func() { _ = os.RemoveAll(lxdDir) })
+
+	t.Setenv("LXD_DIR", lxdDir)
+
+	src := btrfsTestPool(t, "src", 1024*1024*1024)
+	dst := btrfsTestPool(t, "dst", 1024*1024*1024)
+
+	// Source volume with three snapshots, each one of a different version.
+	srcVol := NewVolume(src, src.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", srcVol.MountPath())
+	require.NoError(t, err)
+	require.NoError(t, createParentSnapshotDirIfMissing(src.name, src.config, srcVol.volType, srcVol.name))
+
+	snapshots := []string{"snap0", "snap1", "snap2"}
+	for i, snapName := range snapshots {
+		require.NoError(t, os.WriteFile(filepath.Join(srcVol.MountPath(), "version"), []byte(strconv.Itoa(i)), 0600))
+
+		snapVol, _ := srcVol.NewSnapshot(snapName)
+		_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", srcVol.MountPath(), snapVol.MountPath())
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(srcVol.MountPath(), "version"), []byte("current"), 0600))
+
+	migrationType := migration.Type{
+		FSType:   migration.MigrationFSType_BTRFS,
+		Features: []string{migration.BTRFSFeatureMigrationHeader, migration.BTRFSFeatureSubvolumes},
+	}
+
+	dstVol := NewVolume(dst, dst.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+
+	// migrate runs a migration of the volume between the pools, over a connection dropping after the source
+	// wrote the given number of frames. It returns the errors of the source and target, and the frames sent.
+	migrate := func(frames int, resumeReceivedUUID string) (error, error, int) {
+		srcConn, dstConn := newBtrfsTestFrameConns(frames)
+
+		chDst := make(chan error, 1)
+		go func() {
+			chDst <- dst.CreateVolumeFromMigration(dstVol, dstConn, migration.VolumeTargetArgs{
+				Name:          dstVol.name,
+				MigrationType: migrationType,
+				Snapshots:     snapshots,
+			}, nil, nil)
+		}()
+
+		srcErr := src.MigrateVolume(srcVol, srcConn, &migration.VolumeSourceArgs{
+			Name:               srcVol.name,
+			MigrationType:      migrationType,
+			Snapshots:          append([]string{}, snapshots...),
+			ResumeReceivedUUID: resumeReceivedUUID,
+		}, nil)
+
+		// Let the target see the end of the connection if the source stopped before dropping it.
+		if frames < 0 || srcConn.frames != 0 {
+			close(srcConn.out)
+		}
+
+		return srcErr, <-chDst, srcConn.sent
+	}
+
+	// The connection drops after the header frame and the first two snapshots.
+	srcErr, dstErr, _ := migrate(3, "")
+	assert.Error(t, srcErr)
+	assert.Error(t, dstErr)
+	assert.False(t, shared.PathExists(dstVol.MountPath()))
+
+	// The target kept the snapshots it fully received and reports the last one.
+	resumeDir := btrfsMigrationResumePath(dst.name, dstVol.volType, dstVol.name)
+	checkpoint, err := loadBtrfsMigrationCheckpoint(resumeDir)
+	require.NoError(t, err)
+	require.Len(t, checkpoint.Snapshots, 2)
+	assert.Equal(t, "snap1", checkpoint.Snapshots[1].Name)
+
+	resumeReceivedUUID := MigrationResumeReceivedUUID(dst.name, dstVol.volType, dstVol.name)
+	assert.Equal(t, checkpoint.lastUUID(), resumeReceivedUUID)
+	assert.NotEmpty(t, resumeReceivedUUID)
+
+	// Resuming only sends the header frame, the last snapshot and the volume.
+	srcErr, dstErr, sent := migrate(-1, resumeReceivedUUID)
+	require.NoError(t, srcErr)
+	require.NoError(t, dstErr)
+	assert.Equal(t, 3, sent)
+
+	for i, snapName := range snapshots {
+		snapVol, _ := dstVol.NewSnapshot(snapName)
+		version, err := os.ReadFile(filepath.Join(snapVol.MountPath(), "version"))
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(version))
+	}
+
+	version, err := os.ReadFile(filepath.Join(dstVol.MountPath(), "version"))
+	require.NoError(t, err)
+	assert.Equal(t, "current", string(version))
+
+	// The resume directory is deleted once the migration completes.
+	assert.NoDirExists(t, resumeDir)
+	assert.Empty(t, MigrationResumeReceivedUUID(dst.name, dstVol.volType, dstVol.name))
+}
+
+// Test that the resume directories of interrupted migrations are deleted once expired, unless in use.
+func TestBtrfsDeleteExpiredMigrationResumeDirs(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+	d.name = "testpool"
+
+	now := time.Now()
+	dirs := map[string]time.Time{
+		"container_expired": now.Add(-btrfsMigrationResumeExpiry - time.Minute),
+		"container_recent":  now.Add(-time.Hour),
+		"container_in_use":  now.Add(-btrfsMigrationResumeExpiry - time.Minute),
+	}
+
+	for name, mtime := range dirs {
+		dir := btrfsMigrationResumePath(d.name, VolumeTypeContainer, strings.TrimPrefix(name, "container_"))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "snap0"), 0700))
+
+		checkpointPath := filepath.Join(dir, btrfsMigrationCheckpointFile)
+		require.NoError(t, os.WriteFile(checkpointPath, []byte("snapshots: []\n"), 0600))
+		require.NoError(t, os.Chtimes(checkpointPath, mtime, mtime))
+	}
+
+	// Resume directories without a checkpoint expire based on their own modification time.
+	noCheckpoint := btrfsMigrationResumePath(d.name, VolumeTypeContainer, "no_checkpoint")
+	require.NoError(t, os.MkdirAll(noCheckpoint, 0700))
+	expired := now.Add(-btrfsMigrationResumeExpiry - time.Minute)
+	require.NoError(t, os.Chtimes(noCheckpoint, expired, expired))
+
+	inUse := btrfsMigrationResumePath(d.name, VolumeTypeContainer, "in_use")
+	require.NoError(t, d.deleteExpiredMigrationResumeDirs(now, inUse))
+
+	assert.NoDirExists(t, btrfsMigrationResumePath(d.name, VolumeTypeContainer, "expired"))
+	assert.NoDirExists(t, noCheckpoint)
+	assert.DirExists(t, btrfsMigrationResumePath(d.name, VolumeTypeContainer, "recent"))
+	assert.DirExists(t, inUse)
+
+	// Pools without any migration resume directory.
+	d.name = "otherpool"
+	assert.NoError(t, d.deleteExpiredMigrationResumeDirs(now, ""))
+}
+
+// Test that each level syncs, freezes, thaws and commits the filesystem in order around the snapshot creation.
+func TestBtrfsSnapshotSync(t *testing.T) {
+	var calls []string
+	record := func(name string) func(path string) error {
+		return func(path string) error {
+			calls = append(calls, name+" "+path)
+			return nil
+		}
+	}
+
+	ops := btrfsSyncOps{
+		syncFS: record("syncfs"),
+		freeze: record("freeze"),
+		thaw:   record("thaw"),
+		commit: record("commit"),
+	}
+
+	tests := []struct {
+		level string
+		calls []string
+	}{
+		{level: "", calls: []string{"snapshot"}},
+		{level: "none", calls: []string{"snapshot"}},
+		{level: "metadata", calls: []string{"snapshot", "commit /pool"}},
+		{level: "full", calls: []string{"syncfs /pool", "freeze /pool", "thaw /pool", "snapshot", "commit /pool"}},
+	}
+
+	for _, test := range tests {
+		calls = nil
+
+		err := ops.beforeSnapshot(test.level, "/pool")
+		require.NoError(t, err)
+
+		calls = append(calls, "snapshot")
+
+		err = ops.afterSnapshot(test.level, "/pool")
+		require.NoError(t, err)
+
+		assert.Equal(t, test.calls, calls, test.level)
+	}
+
+	// The filesystem isn't frozen when it can't be synced.
+	calls = nil
+	ops.syncFS = func(path string) error { return fmt.Errorf("Sync failed") }
+	assert.Error(t, ops.beforeSnapshot("full", "/pool"))
+	assert.Empty(t, calls)
+
+	// A commit failure is reported so that the snapshot is removed.
+	ops.commit = func(path string) error { return fmt.Errorf("Commit failed") }
+	assert.Error(t, ops.afterSnapshot("metadata", "/pool"))
+
+	// The host filesystem is committed once a snapshot is made read-only on it.
+	dir := btrfsTestDir(t)
+	volPath := filepath.Join(dir, "snapshot-sync-vol")
+	snapPath := filepath.Join(dir, "snapshot-sync-snap")
+
+	_, err := runBtrfsCommand("subvolume", "create", volPath)
+	require.NoError(t, err)
+	defer func() { _, _ = runBtrfsCommand("subvolume", "delete", volPath) }()
+
+	_, err = runBtrfsCommand("subvolume", "snapshot", volPath, snapPath)
+	require.NoError(t, err)
+	defer func() {
+		_, _ = runBtrfsCommand("property", "set", "-ts", snapPath, "ro", "false")
+		_, _ = runBtrfsCommand("subvolume", "delete", snapPath)
+	}()
+
+	_, err = runBtrfsCommand("property", "set", "-ts", snapPath, "ro", "true")
+	require.NoError(t, err)
+	require.NoError(t, btrfsHostSyncOps.afterSnapshot("metadata", dir))
+
+	output, err := runBtrfsCommand("property", "get", "-ts", snapPath, "ro")
+	require.NoError(t, err)
+	assert.Equal(t, "ro=true", strings.TrimSpace(output))
+}
+
+func TestBtrfsQuiesce(t *testing.T) {
+	var calls []string
+	record := func(name string) func(path string) error {
+		return func(path string) error {
+			calls = append(calls, name+" "+path)
+			return nil
+		}
+	}
+
+	ops := btrfsSyncOps{
+		syncFS: record("syncfs"),
+		freeze: record("freeze"),
+		thaw:   record("thaw"),
+		commit: record("commit"),
+	}
+
+	err := ops.quiesce("/pool", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"syncfs /pool", "commit /pool"}, calls)
+
+	calls = nil
+	err = ops.quiesce("/pool", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"syncfs /pool", "commit /pool", "freeze /pool"}, calls)
+
+	// The filesystem isn't frozen when its transaction can't be committed.
+	calls = nil
+	ops.commit = func(path string) error { return fmt.Errorf("Commit failed") }
+
+	err = ops.quiesce("/pool", true)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"syncfs /pool"}, calls)
+}
+
+func TestBtrfsOverlayRoot(t *testing.T) {
+	poolPath := t.TempDir()
+
+	// Two containers sharing the same base.
+	vol1 := filepath.Join(poolPath, "containers", "c1")
+	vol2 := filepath.Join(poolPath, "containers", "c2")
+	base, _, _ := btrfsOverlayPaths(vol1)
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "rootfs", "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "rootfs", "etc", "hostname"), []byte("base\n"), 0644))
+
+	base2, _, _ := btrfsOverlayPaths(vol2)
+	require.NoError(t, os.MkdirAll(filepath.Dir(base2), 0700))
+	require.NoError(t, os.Symlink(base, base2))
+
+	for _, volPath := range []string{vol1, vol2} {
+		assert.True(t, btrfsIsOverlayVolume(volPath))
+		require.NoError(t, btrfsCreateOverlayDirs(volPath))
+
+		mounted, err := btrfsMountOverlay(volPath)
+		if err != nil {
+			t.Skipf("Test requires mounting overlays: %v", err)
+		}
+
+		assert.True(t, mounted)
+
+		volPath := volPath
+		t.Cleanup(func() { _, _ = btrfsUnmountOverlay(volPath) })
+
+		// Mounting again is a no-op.
+		mounted, err = btrfsMountOverlay(volPath)
+		require.NoError(t, err)
+		assert.False(t, mounted)
+	}
+
+	// Write to the rootfs of the first container.
+	require.NoError(t, os.WriteFile(filepath.Join(vol1, "rootfs", "etc", "hostname"), []byte("c1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(vol1, "rootfs", "new"), []byte("c1\n"), 0644))
+
+	// The base is left unmodified, the writes going to the upper directory of the first container only.
+	content, err := os.ReadFile(filepath.Join(base, "rootfs", "etc", "hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "base\n", string(content))
+	assert.NoFileExists(t, filepath.Join(base, "rootfs", "new"))
+
+	_, upper1, _ := btrfsOverlayPaths(vol1)
+	content, err = os.ReadFile(filepath.Join(upper1, "etc", "hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "c1\n", string(content))
+
+	content, err = os.ReadFile(filepath.Join(vol2, "rootfs", "etc", "hostname"))
+	require.NoError(t, err)
+	assert.Equal(t, "base\n", string(content))
+	assert.NoFileExists(t, filepath.Join(vol2, "rootfs", "new"))
+
+	// The writes are kept in the upper directory once unmounted.
+	unmounted, err := btrfsUnmountOverlay(vol1)
+	require.NoError(t, err)
+	assert.True(t, unmounted)
+	assert.NoFileExists(t, filepath.Join(vol1, "rootfs", "new"))
+	assert.FileExists(t, filepath.Join(upper1, "new"))
+}
+
+func TestParseBtrfsSubVolumeShowGeneration(t *testing.T) {
+	output := `containers/c1
+	Name: 			c1
+	UUID: 			12c2e2a6-0e6a-4a4f-8a0b-5d1f6f0d3c1e
+	Parent UUID: 		-
+	Received UUID: 		-
+	Creation time: 		2022-10-14 10:00:00 +0000
+	Subvolume ID: 		257
+	Generation: 		1042
+	Gen at creation: 	8
+	Parent ID: 		5
+	Top level ID: 		5
+	Flags: 			-
+`
+
+	generation, err := parseBtrfsSubVolumeShowGeneration(output)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1042), generation)
+
+	_, err = parseBtrfsSubVolumeShowGeneration("containers/c1\n\tName: c1\n")
+	assert.Error(t, err)
+}
+
+func TestBtrfsSubVolumeCreationTime(t *testing.T) {
+	run := func(args ...string) (string, error) {
+		return fmt.Sprintf("%s\n\tName: \t\t\tsnap0\n\tCreation time: \t\t2022-10-14 10:00:00 +0200\n\tGeneration: \t\t1042\n", args[2]), nil
+	}
+
+	creationTime, err := btrfsSubVolumeCreationTime(run, "containers-snapshots/c1/snap0")
+	require.NoError(t, err)
+	assert.True(t, time.Date(2022, time.October, 14, 8, 0, 0, 0, time.UTC).Equal(creationTime))
+
+	_, err = parseBtrfsSubVolumeShowCreationTime("containers/c1\n\tName: c1\n")
+	assert.Error(t, err)
+
+	creationTime, err = parseBtrfsSubVolumeShowCreationTime("containers/c1\n\tCreation time: \t\t-\n")
+	require.NoError(t, err)
+	assert.True(t, creationTime.IsZero())
+
+	_, err = parseBtrfsSubVolumeShowCreationTime("containers/c1\n\tCreation time: \t\tyesterday\n")
+	assert.Error(t, err)
+}
+
+// Test that the generation of a subvolume increases once data written to it is committed.
+func TestBtrfsSubVolumeGeneration(t *testing.T) {
+	dir, err := os.MkdirTemp(btrfsTestDir(t), "generation.")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	d := &btrfs{}
+	subvolPath := filepath.Join(dir, "subvol")
+	err = btrfsSubVolumeCreate(subvolPath, d.subvolumeMode(), nil)
+	require.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(subvolPath, false) }()
+
+	before, err := btrfsSubVolumeGeneration(subvolPath)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(subvolPath, "data"), []byte("data"), 0600)
+	require.NoError(t, err)
+
+	_, err = shared.RunCommand("btrfs", "filesystem", "sync", subvolPath)
+	require.NoError(t, err)
+
+	after, err := btrfsSubVolumeGeneration(subvolPath)
+	require.NoError(t, err)
+	assert.Greater(t, after, before)
+}
+
+// Two nodes contending for the same subvolume: only the lease holder may operate on it until the lease expires.
+func TestBtrfsAcquireLease(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	newNode := func(name string) *btrfs {
+		d := &btrfs{}
+		d.name = "testpool"
+		d.config = map[string]string{"btrfs.lease_duration": "60"}
+		d.state = &state.State{ServerName: name, OS: &sys.OS{}}
+		return d
+	}
+
+	node1 := newNode("node1")
+	node2 := newNode("node2")
+
+	vol := NewVolume(node1, node1.name, VolumeTypeCustom, ContentTypeFS, "vol1", nil, nil)
+	err := os.MkdirAll(vol.MountPath(), 0711)
+	require.NoError(t, err)
+
+	err = unix.Setxattr(vol.MountPath(), btrfsLeaseXattr, []byte("probe 0"), 0)
+	if err != nil {
+		t.Skipf("Test requires trusted extended attributes: %v", err)
+	}
+
+	err = unix.Removexattr(vol.MountPath(), btrfsLeaseXattr)
+	require.NoError(t, err)
+
+	// The first node leases the volume, the second one is refused while the lease is valid.
+	err = node1.leaseVolume(vol)
+	require.NoError(t, err)
+
+	err = node2.leaseVolume(vol)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `leased by node "node1"`)
+
+	// Snapshots are covered by the lease of their parent volume.
+	snapVol, err := vol.NewSnapshot("snap0")
+	require.NoError(t, err)
+
+	err = node2.leaseVolume(snapVol)
+	require.Error(t, err)
+
+	err = node1.leaseVolume(snapVol)
+	require.NoError(t, err)
+
+	lease, err := btrfsReadLease(vol.MountPath())
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	assert.Equal(t, "node1", lease.Node)
+
+	// Once the lease expires, such as when node1 is dead, node2 takes it over and node1 is refused.
+	later := lease.Expiry.Add(time.Second)
+	err = btrfsAcquireLease(vol.MountPath(), "node2", time.Minute, later)
+	require.NoError(t, err)
+
+	err = btrfsAcquireLease(vol.MountPath(), "node1", time.Minute, later)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `leased by node "node2"`)
+
+	// Concurrent acquisitions of an expired lease by different nodes: only one of them gets it.
+	expired := later.Add(2 * time.Minute)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(node string) {
+			errs <- btrfsAcquireLease(vol.MountPath(), node, time.Minute, expired)
+		}(fmt.Sprintf("racer%d", i))
+	}
+
+	acquired := 0
+	for i := 0; i < cap(errs); i++ {
+		if <-errs == nil {
+			acquired++
+		}
+	}
+
+	assert.Equal(t, 1, acquired)
+
+	// Leases can't be recorded from a user namespace.
+	node1.state.OS.RunningInUserNS = true
+	err = node1.leaseVolume(vol)
+	assert.ErrorIs(t, err, ErrNotSupported)
+	node1.state.OS.RunningInUserNS = false
+
+	// Without a lease duration the check is disabled.
+	node1.config["btrfs.lease_duration"] = ""
+	err = node1.leaseVolume(vol)
+	require.NoError(t, err)
+}
+
+// Test that the metadata of the snapshots directly within the snapshot directory is parsed in listing order.
+func TestParseBtrfsSnapshotsInfo(t *testing.T) {
+	output := `ID 256 gen 20 top level 5 parent_uuid - received_uuid - uuid 7f1a3d1c-0000-0000-0000-000000000001 path containers/c1
+ID 257 gen 15 top level 5 parent_uuid 7f1a3d1c-0000-0000-0000-000000000001 received_uuid - uuid 7f1a3d1c-0000-0000-0000-000000000002 path containers-snapshots/c1/snap0
+ID 258 gen 15 top level 257 parent_uuid - received_uuid - uuid 7f1a3d1c-0000-0000-0000-000000000003 path containers-snapshots/c1/snap0/nested
+ID 259 gen 18 top level 5 parent_uuid - received_uuid 2b9c6e4a-0000-0000-0000-000000000009 uuid 7f1a3d1c-0000-0000-0000-000000000004 path containers-snapshots/c1/snap 1
+ID 260 gen 19 top level 5 parent_uuid - received_uuid - uuid 7f1a3d1c-0000-0000-0000-000000000005 path containers-snapshots/c10/snap0
+`
+
+	snapshots, err := parseBtrfsSnapshotsInfo(output, "containers-snapshots/c1/")
+	require.NoError(t, err)
+	assert.Equal(t, []VolumeSnapshotInfo{
+		{Name: "snap0", Generation: 15, UUID: "7f1a3d1c-0000-0000-0000-000000000002", ParentUUID: "7f1a3d1c-0000-0000-0000-000000000001"},
+		{Name: "snap 1", Generation: 18, UUID: "7f1a3d1c-0000-0000-0000-000000000004", ReceivedUUID: "2b9c6e4a-0000-0000-0000-000000000009"},
+	}, snapshots)
+
+	snapshots, err = parseBtrfsSnapshotsInfo(output, "containers-snapshots/c2/")
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	_, err = parseBtrfsSnapshotsInfo("ID 257 gen x top level 5 path containers-snapshots/c1/snap0\n", "containers-snapshots/c1/")
+	assert.Error(t, err)
+}
+
+// Compare listing the metadata of 100 snapshots with a btrfs call per snapshot and with the single batched call
+// made by VolumeSnapshotsInfo, on real subvolumes.
+func BenchmarkBtrfsSnapshotsInfo(b *testing.B) {
+	dir, err := os.MkdirTemp(btrfsTestDir(b), "snapshots-info.")
+	require.NoError(b, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	d := &btrfs{}
+	volPath := filepath.Join(dir, "c1")
+	snapshotsDir := filepath.Join(dir, "c1-snapshots")
+
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", volPath)
+	require.NoError(b, err)
+	defer func() { _ = d.deleteSubvolume(volPath, false) }()
+
+	err = os.Mkdir(snapshotsDir, 0700)
+	require.NoError(b, err)
+
+	for i := 0; i < 100; i++ {
+		snapPath := filepath.Join(snapshotsDir, fmt.Sprintf("snap%d", i))
+		_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", volPath, snapPath)
+		require.NoError(b, err)
+		defer func() { _ = d.deleteSubvolume(snapPath, false) }()
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	require.NoError(b, err)
+	fsPath, err := parseMountInfoFilesystemPath(f, snapshotsDir)
+	_ = f.Close()
+	require.NoError(b, err)
+
+	prefix := fmt.Sprintf("%s/", strings.TrimPrefix(fsPath, "/"))
+
+	b.Run("per-snapshot", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			entries, err := os.ReadDir(snapshotsDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, entry := range entries {
+				output, err := runBtrfsCommand("subvolume", "show", filepath.Join(snapshotsDir, entry.Name()))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				_, err = parseBtrfsSubVolumeShowGeneration(output)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				parseBtrfsSubVolumeShowUUIDs(output)
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			snapshots, err := btrfsListSnapshotsInfo(runBtrfsCommand, dir, prefix)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if len(snapshots) != 100 {
+				b.Fatalf("Expected 100 snapshots, got %d", len(snapshots))
+			}
+		}
+	})
+}
+
+// Test that the allowed file flags are parsed and set, and that the other flags and combinations are rejected.
+func TestBtrfsFileFlags(t *testing.T) {
+	flags, err := parseBtrfsFileFlags("noatime, nodump,noatime")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"noatime", "nodump"}, flags)
+
+	for _, value := range []string{"secrm", "casefold", "noatime,undelete", "append,immutable", "compress,nocompress", "compress,nodatacow"} {
+		_, err := parseBtrfsFileFlags(value)
+		assert.Error(t, err, value)
+	}
+
+	// The protection flags are only allowed on custom volumes.
+	d := &btrfs{}
+	d.name = "testpool"
+	for _, volType := range []VolumeType{VolumeTypeCustom, VolumeTypeContainer} {
+		vol := NewVolume(d, d.name, volType, ContentTypeFS, "vol1", map[string]string{"btrfs.file_flags": "immutable"}, nil)
+		err = validateVolumeFileFlags(vol)
+		if volType == VolumeTypeCustom {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+
+	// Volumes filled through the generic functions are created with the creation flags only.
+	vol := NewVolume(d, d.name, VolumeTypeCustom, ContentTypeFS, "vol1", map[string]string{"btrfs.file_flags": "immutable,nodatacow,noatime"}, nil)
+	createVol, err := btrfsCreationFileFlagsVolume(vol)
+	require.NoError(t, err)
+	assert.Equal(t, "nodatacow", createVol.ExpandedConfig("btrfs.file_flags"))
+	assert.Equal(t, "immutable,nodatacow,noatime", vol.ExpandedConfig("btrfs.file_flags"))
+
+	// The pool default isn't used in place of an empty list.
+	vol = NewVolume(d, d.name, VolumeTypeCustom, ContentTypeFS, "vol1", nil, map[string]string{"volume.btrfs.file_flags": "immutable"})
+	createVol, err = btrfsCreationFileFlagsVolume(vol)
+	require.NoError(t, err)
+	assert.Equal(t, "", createVol.ExpandedConfig("btrfs.file_flags"))
+
+	// All the flags are supported on btrfs, other filesystems may reject or ignore some of them.
+	dir := os.Getenv("LXD_BTRFS_TEST_DIR")
+	onBtrfs := dir != ""
+	if !onBtrfs {
+		dir = t.TempDir()
+	}
+
+	for name, flag := range btrfsFileFlags {
+		t.Run(name, func(t *testing.T) {
+			path, err := os.MkdirTemp(dir, "flags")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(path) }()
+
+			err = btrfsSetFileFlags(path, flag, 0)
+			if !onBtrfs && (errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL)) {
+				t.Skipf("File flag not supported by the filesystem: %v", err)
+			}
+
+			require.NoError(t, err)
+
+			// Clear the flag so that the directory can be removed.
+			defer func() { _ = btrfsSetFileFlags(path, 0, flag) }()
+
+			flags, err := btrfsGetFileFlags(path)
+			require.NoError(t, err)
+			if !onBtrfs && flags&flag == 0 {
+				t.Skip("File flag ignored by the filesystem")
+			}
+
+			assert.Equal(t, flag, flags&flag)
+		})
+	}
+}
+
+// Test that the subvolumes are reported when the qgroup data is inconsistent and a rescan recommended.
+func TestBtrfsQuotaHealthIssues(t *testing.T) {
+	inconsistent := true
+
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "qgroup show":
+			output := ""
+			if inconsistent {
+				output = "WARNING: qgroup data inconsistent, rescan recommended\n"
+			}
+
+			output += `Qgroupid    Referenced    Exclusive   Path
+--------    ----------    ---------   ----
+0/5              16384        16384   <toplevel>
+0/257          1048576        16384   containers/c1
+0/256          2097152      1048576   images/abc
+0/262            16384        16384   <stale>
+1/100          3145728      1064960   <under>
+`
+			return output, nil
+		case "subvolume list":
+			return "ID 256 gen 8 top level 5 path images/abc\nID 257 gen 10 top level 5 path containers/c1\n", nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	output, err := run("qgroup", "show")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0/256", "0/257", "0/262"}, parseQGroupInconsistencies(output))
+
+	issues, err := btrfsQuotaHealthIssues(run, "/pool")
+	require.NoError(t, err)
+	require.Len(t, issues, 2)
+
+	for i, path := range []string{"images/abc", "containers/c1"} {
+		assert.Equal(t, HealthCheckQuotaConsistency, issues[i].Check)
+		assert.Equal(t, path, issues[i].Path)
+		assert.Contains(t, issues[i].Recommendation, "btrfs quota rescan /pool")
+	}
+
+	// Nothing is reported when the data is consistent.
+	inconsistent = false
+	issues, err = btrfsQuotaHealthIssues(run, "/pool")
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	// Nor when quotas are disabled.
+	noQuota := func(args ...string) (string, error) {
+		return "", fmt.Errorf("ERROR: can't list qgroups: quotas not enabled")
+	}
+
+	issues, err = btrfsQuotaHealthIssues(noQuota, "/pool")
+	require.NoError(t, err)
+	assert.Empty(t, issues)
+
+	// While other failures aren't reported as a healthy pool.
+	failing := func(args ...string) (string, error) { return "", fmt.Errorf("ERROR: can't access '/pool'") }
+	_, err = btrfsQuotaHealthIssues(failing, "/pool")
+	assert.Error(t, err)
+}
+
+// Test that the nested subvolumes of a pool are deleted before their parents and the pool subvolume last.
+func TestBtrfsSubVolumeTeardown(t *testing.T) {
+	poolMount := t.TempDir()
+
+	subvols := map[string]bool{poolMount: true}
+	for _, path := range []string{"containers-snapshots/c1/snap0", "custom/default_vol1", "custom/default_vol1/nested", "custom/default_vol1/nested/deeper", "images/abc"} {
+		fullPath := filepath.Join(poolMount, path)
+		require.NoError(t, os.MkdirAll(fullPath, 0700))
+		subvols[fullPath] = true
+	}
+
+	// Plain directories and files aren't subvolumes.
+	require.NoError(t, os.MkdirAll(filepath.Join(poolMount, "containers"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(poolMount, "custom", "default_vol1", "data"), []byte("data"), 0600))
+
+	deleted := []string{}
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "qgroup show", "property set":
+			return "", nil
+		case "subvolume delete":
+			path := args[2]
+			for subvol := range subvols {
+				if subvol != path && strings.HasPrefix(subvol, path+"/") {
+					return "", fmt.Errorf("Subvolume %q still has child subvolume %q", path, subvol)
+				}
+			}
+
+			delete(subvols, path)
+			deleted = append(deleted, strings.TrimPrefix(path, poolMount))
+
+			return "", nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	isSubvolume := func(path string) bool { return subvols[path] }
+
+	// Refused while an instance is present.
+	require.NoError(t, os.Mkdir(filepath.Join(poolMount, "containers", "c1"), 0700))
+	err := btrfsSubVolumeTeardown(run, isSubvolume, poolMount, PoolLayoutNested)
+	assert.ErrorContains(t, err, "containers/c1")
+	assert.Empty(t, deleted)
+
+	// The instances of flat pools are at the root of the pool.
+	require.NoError(t, os.Mkdir(filepath.Join(poolMount, "virtual-machines_v1"), 0700))
+	err = btrfsSubVolumeTeardown(run, isSubvolume, poolMount, PoolLayoutFlat)
+	assert.ErrorContains(t, err, "virtual-machines_v1")
+	assert.NotContains(t, err.Error(), "containers/c1")
+	assert.Empty(t, deleted)
+
+	require.NoError(t, os.Remove(filepath.Join(poolMount, "virtual-machines_v1")))
+	require.NoError(t, os.Remove(filepath.Join(poolMount, "containers", "c1")))
+	err = btrfsSubVolumeTeardown(run, isSubvolume, poolMount, PoolLayoutNested)
+	require.NoError(t, err)
+	assert.Empty(t, subvols)
+	assert.Equal(t, []string{"/images/abc", "/custom/default_vol1/nested/deeper", "/custom/default_vol1/nested", "/custom/default_vol1", "/containers-snapshots/c1/snap0", ""}, deleted)
+}
+
+// Test that snapshots accessible through an existing mount are bind mounted and the others mounted by ID.
+func TestBtrfsSnapshotMountMethod(t *testing.T) {
+	accessible := map[string]bool{"/pool/containers-snapshots/c1/snap0": true}
+	isSubvolume := func(path string) bool { return accessible[path] }
+
+	assert.Equal(t, btrfsSnapshotMountBind, btrfsSnapshotMountMethod("/pool/containers-snapshots/c1/snap0", isSubvolume))
+	assert.Equal(t, btrfsSnapshotMountSubvolID, btrfsSnapshotMountMethod("/snaps/containers-snapshots/c1/snap1", isSubvolume))
+}
+
+// Test that the subvolume of a snapshot mounted by ID is the one at its full path, whether the pool is the top level
+// subvolume of the filesystem or is nested in it along with other subvolumes ending with the same path.
+func TestBtrfsFindSubvolumeID(t *testing.T) {
+	list := `ID 256 gen 10 top level 5 path lxd/pool
+ID 257 gen 11 top level 256 path lxd/pool/containers-snapshots/c1/snap1
+ID 258 gen 12 top level 5 path containers-snapshots/c1/snap1
+ID 259 gen 13 top level 5 path backup/lxd/pool/containers-snapshots/c1/snap1
+`
+
+	for _, rootID := range []string{"256", "5"} {
+		run := func(args ...string) (string, error) {
+			if args[0] == "inspect-internal" {
+				assert.Equal(t, []string{"inspect-internal", "rootid", "/pool"}, args)
+				return rootID + "\n", nil
+			}
+
+			return list, nil
+		}
+
+		subvols, err := btrfsListSubvolumes(run, "/pool")
+		require.NoError(t, err)
+
+		poolSubvolPath, err := btrfsPoolSubvolumePath(run, "/pool", subvols)
+		require.NoError(t, err)
+
+		id, err := btrfsFindSubvolumeID(subvols, poolSubvolPath, "containers-snapshots/c1/snap1")
+		require.NoError(t, err)
+
+		if rootID == "5" {
+			assert.Equal(t, "", poolSubvolPath)
+			assert.Equal(t, "258", id)
+		} else {
+			assert.Equal(t, "lxd/pool", poolSubvolPath)
+			assert.Equal(t, "257", id)
+		}
+
+		// Partial paths don't match.
+		_, err = btrfsFindSubvolumeID(subvols, poolSubvolPath, "c1/snap1")
+		assert.Error(t, err)
+
+		_, err = btrfsFindSubvolumeID(subvols, poolSubvolPath, "containers-snapshots/c1/snap2")
+		assert.ErrorContains(t, err, "Failed finding subvolume")
+	}
+
+	// The pool's own subvolume must be listed.
+	run := func(args ...string) (string, error) { return "300\n", nil }
+	_, err := btrfsPoolSubvolumePath(run, "/pool", map[string]string{"256": "lxd/pool"})
+	assert.Error(t, err)
+}
+
+// Test that the listed subvolumes of volumes are keyed by their ID.
+func TestBtrfsSubvolumeIDs(t *testing.T) {
+	run := func(args ...string) (string, error) {
+		assert.Equal(t, []string{"subvolume", "list", "/pool"}, args)
+
+		return `ID 250 gen 9 top level 5 path lxd/pool
+ID 256 gen 10 top level 5 path lxd/pool/containers/default_c1
+ID 257 gen 11 top level 256 path lxd/pool/containers-snapshots/default_c1/snap0
+ID 258 gen 12 top level 5 path lxd/pool/custom/default_vol1
+ID 259 gen 13 top level 5 path lxd/pool/stray
+`, nil
+	}
+
+	subvols, err := btrfsListSubvolumes(run, "/pool")
+	require.NoError(t, err)
+
+	paths := []string{
+		"containers/default_c1",
+		"containers-snapshots/default_c1/snap0",
+		"custom/default_vol1",
+		"custom/default_missing",
+	}
+
+	assert.Equal(t, map[string]string{
+		"256": "containers/default_c1",
+		"257": "containers-snapshots/default_c1/snap0",
+		"258": "custom/default_vol1",
+	}, btrfsSubvolumeIDs(subvols, "lxd/pool", paths))
+}
+
+// Test that the volumes whose subvolume is missing or fails to mount are reported while the others pass.
+func TestBtrfsVerifySubvolumeMounts(t *testing.T) {
+	d := &btrfs{}
+
+	subvols := map[string]string{
+		"256": "lxd/pool/containers/default_c1",
+		"257": "lxd/pool/containers-snapshots/default_c1/snap0",
+		"258": "lxd/pool/custom/default_vol1",
+	}
+
+	c1 := NewVolume(d, "pool", VolumeTypeContainer, ContentTypeFS, "default_c1", nil, nil)
+	snap0 := NewVolume(d, "pool", VolumeTypeContainer, ContentTypeFS, "default_c1/snap0", nil, nil)
+	vol1 := NewVolume(d, "pool", VolumeTypeCustom, ContentTypeFS, "default_vol1", nil, nil)
+	missing := NewVolume(d, "pool", VolumeTypeCustom, ContentTypeFS, "default_missing", nil, nil)
+
+	relPath := func(path string) (string, error) {
+		return filepath.Rel(GetPoolMountPath("pool"), path)
+	}
+
+	// The subvolume of the snapshot is deliberately broken.
+	mounted := []string{}
+	mount := func(subvolID string) error {
+		if subvolID == "257" {
+			return fmt.Errorf("Failed mounting subvolume %s: %w", subvolID, unix.EUCLEAN)
+		}
+
+		mounted = append(mounted, subvolID)
+		return nil
+	}
+
+	failures := btrfsVerifySubvolumeMounts([]Volume{c1, snap0, vol1, missing}, subvols, "lxd/pool", relPath, mount)
+	assert.Equal(t, []string{"256", "258"}, mounted)
+	require.Len(t, failures, 2)
+
+	assert.Equal(t, "default_c1/snap0", failures[0].Volume.Name())
+	assert.ErrorIs(t, failures[0].Err, unix.EUCLEAN)
+
+	assert.Equal(t, "default_missing", failures[1].Volume.Name())
+	assert.ErrorContains(t, failures[1].Err, `Failed finding subvolume "custom/default_missing"`)
+
+	// Nothing is reported when all the volumes mount.
+	assert.Empty(t, btrfsVerifySubvolumeMounts([]Volume{c1, vol1}, subvols, "lxd/pool", relPath, mount))
+}
+
+// Test that a directory within a volume is converted to a subvolume and snapshotted on its own.
+func TestBtrfsSnapshotPath(t *testing.T) {
+	volPath := filepath.Join(t.TempDir(), "vol")
+	require.NoError(t, os.MkdirAll(filepath.Join(volPath, "data", "sub"), 0700))
+	require.NoError(t, os.Chmod(filepath.Join(volPath, "data"), 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(volPath, "data", "sub", "file"), []byte("data"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(volPath, "other"), []byte("other"), 0600))
+
+	outsidePath := t.TempDir()
+	require.NoError(t, os.Symlink(outsidePath, filepath.Join(volPath, "outside")))
+
+	// Subvolumes are tracked by inode as they keep their identity when renamed.
+	inode := func(path string) uint64 {
+		var stat unix.Stat_t
+		err := unix.Lstat(path, &stat)
+		if err != nil {
+			return 0
+		}
+
+		return stat.Ino
+	}
+
+	subvols := map[uint64]bool{inode(volPath): true}
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "subvolume create":
+			err := os.Mkdir(args[2], 0700)
+			subvols[inode(args[2])] = true
+			return "", err
+		case "subvolume delete":
+			delete(subvols, inode(args[2]))
+			return "", os.RemoveAll(args[2])
+		case "subvolume snapshot":
+			_, err := shared.RunCommand("cp", "-a", args[3], args[4])
+			subvols[inode(args[4])] = true
+			return "", err
+		case "qgroup show":
+			return "", fmt.Errorf("Quotas not enabled")
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	isSubvolume := func(path string) bool { return subvols[inode(path)] }
+
+	snapPath := filepath.Join(t.TempDir(), "snaps", "snap0")
+	err := btrfsSnapshotPath(run, isSubvolume, volPath, "data", snapPath)
+	require.NoError(t, err)
+
+	// The directory is now a subvolume with the same content and mode, and nothing is left behind.
+	path := filepath.Join(volPath, "data")
+	assert.True(t, isSubvolume(path))
+	assert.True(t, isSubvolume(snapPath))
+
+	for _, dir := range []string{path, snapPath} {
+		content, err := os.ReadFile(filepath.Join(dir, "sub", "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(content))
+
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(volPath)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	assert.Equal(t, []string{"data", "other", "outside"}, names)
+
+	// The snapshot only contains the directory.
+	assert.NoFileExists(t, filepath.Join(snapPath, "other"))
+
+	// The converted directory can be snapshotted again, without being converted again.
+	dataInode := inode(path)
+	snap1Path := filepath.Join(filepath.Dir(snapPath), "snap1")
+	require.NoError(t, os.WriteFile(filepath.Join(path, "sub", "file"), []byte("new"), 0600))
+	require.NoError(t, btrfsSnapshotPath(run, isSubvolume, volPath, "data", snap1Path))
+	assert.Equal(t, dataInode, inode(path))
+
+	content, err := os.ReadFile(filepath.Join(snap1Path, "sub", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+
+	err = btrfsSnapshotPath(run, isSubvolume, volPath, "data", snap1Path)
+	assert.ErrorContains(t, err, "already exists")
+
+	// Paths which aren't directories within the volume are rejected.
+	for relPath, message := range map[string]string{
+		"other":   "isn't a directory",
+		"/":       "isn't a directory within the volume",
+		"outside": "isn't a directory within the volume",
+		"missing": "Failed resolving",
+	} {
+		err = btrfsSnapshotPath(run, isSubvolume, volPath, relPath, filepath.Join(filepath.Dir(snapPath), "snap2"))
+		assert.ErrorContains(t, err, message, relPath)
+	}
+
+	assert.NoDirExists(t, filepath.Join(filepath.Dir(snapPath), "snap2"))
+}
+
+// Test that a subvolume nested in a volume is assigned to the parent qgroups of the volume and gets its limit.
+func TestBtrfsSubVolumeInheritQGroup(t *testing.T) {
+	commands := []string{}
+	run := func(parents string, limit string) btrfsCommandFunc {
+		return func(args ...string) (string, error) {
+			command := strings.Join(args, " ")
+			commands = append(commands, command)
+
+			switch command {
+			case "qgroup show -e -f --raw /pool/containers/c1":
+				return "qgroupid rfer excl max_excl\n-------- ---- ---- --------\n0/257 1000 1000 none\n", nil
+			case "qgroup show -f -p -r --raw /pool/containers/c1":
+				return fmt.Sprintf("qgroupid rfer excl max_rfer parent\n-------- ---- ---- -------- ------\n0/257 1000 1000 %s %s\n", limit, parents), nil
+			case "qgroup show -e -f --raw /pool/containers/c1/data":
+				return "qgroupid rfer excl max_excl\n-------- ---- ---- --------\n0/300 0 0 none\n", nil
+			case "inspect-internal rootid /pool/containers/c1/data":
+				return "300\n", nil
+			}
+
+			if strings.HasPrefix(command, "qgroup assign") || strings.HasPrefix(command, "qgroup limit") {
+				return "", nil
+			}
+
+			return "", fmt.Errorf("Unexpected command %q", command)
+		}
+	}
+
+	err := btrfsSubVolumeInheritQGroup(run("1/100,1/200", "5000"), "/pool/containers/c1", "/pool/containers/c1/data")
+	require.NoError(t, err)
+	assert.Contains(t, commands, "qgroup assign --no-rescan 0/300 1/100 /pool/containers/c1/data")
+	assert.Contains(t, commands, "qgroup assign --no-rescan 0/300 1/200 /pool/containers/c1/data")
+	assert.Contains(t, commands, "qgroup limit 5000 0/300 /pool/containers/c1/data")
+
+	// Nothing is assigned or limited for a volume without parents nor limit.
+	commands = []string{}
+	err = btrfsSubVolumeInheritQGroup(run("---", "none"), "/pool/containers/c1", "/pool/containers/c1/data")
+	require.NoError(t, err)
+	for _, command := range commands {
+		assert.NotContains(t, command, "assign")
+		assert.NotContains(t, command, "limit")
+	}
+
+	// Nothing is done when quotas are disabled.
+	noQuota := func(args ...string) (string, error) { return "", fmt.Errorf("Quotas not enabled") }
+	assert.NoError(t, btrfsSubVolumeInheritQGroup(noQuota, "/pool/containers/c1", "/pool/containers/c1/data"))
+}
+
+// Test that the base image recorded on a volume survives a send and receive of the volume.
+func TestBtrfsBaseImage(t *testing.T) {
+	testDir, err := os.MkdirTemp(btrfsTestDir(t), "base_image.")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(testDir) }()
+
+	subvolPath := filepath.Join(testDir, "vol")
+	snapPath := filepath.Join(testDir, "snap0")
+	recvPath := filepath.Join(testDir, "recv")
+
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", subvolPath)
+	require.NoError(t, err)
+	defer func() { _, _ = shared.RunCommand("btrfs", "subvolume", "delete", subvolPath) }()
+
+	fingerprint, err := btrfsReadBaseImage(subvolPath)
+	require.NoError(t, err)
+	assert.Empty(t, fingerprint)
+
+	base := "d1ae84747b4cec7e4bb07b8ea8b1480be1cc3a6c1ed0140b5bda9e3d66b7e1ab"
+	require.NoError(t, btrfsWriteBaseImage(subvolPath, base))
+
+	// Volumes are sent from a read-only snapshot.
+	_, err = shared.RunCommand("btrfs", "subvolume", "snapshot", "-r", subvolPath, snapPath)
+	require.NoError(t, err)
+	defer func() { _, _ = shared.RunCommand("btrfs", "subvolume", "delete", snapPath) }()
+
+	require.NoError(t, os.Mkdir(recvPath, 0700))
+	_, err = shared.RunCommand("sh", "-c", fmt.Sprintf("btrfs send %q | btrfs receive %q", snapPath, recvPath))
+	require.NoError(t, err)
+	defer func() { _, _ = shared.RunCommand("btrfs", "subvolume", "delete", filepath.Join(recvPath, "snap0")) }()
+
+	fingerprint, err = btrfsReadBaseImage(filepath.Join(recvPath, "snap0"))
+	require.NoError(t, err)
+	assert.Equal(t, base, fingerprint)
+}
+
+// Test that the read-only snapshots left by a previous process are deleted on activation and the others kept.
+func TestBtrfsCleanupOrphanedReadonlySnapshots(t *testing.T) {
+	poolMount := t.TempDir()
+	since := time.Now()
+	old := since.Add(-time.Hour)
+
+	orphan := filepath.Join(poolMount, "backup.123")
+	orphanVolType := filepath.Join(poolMount, "containers", "backup.456")
+	recent := filepath.Join(poolMount, "backup.789")
+
+	subvols := map[string]bool{
+		filepath.Join(orphan, "c1"):                true,
+		filepath.Join(orphanVolType, "c2"):         true,
+		filepath.Join(orphanVolType, "c2", "nest"): true,
+		filepath.Join(recent, "c3"):                true,
+	}
+
+	for path := range subvols {
+		require.NoError(t, os.MkdirAll(path, 0700))
+	}
+
+	// A volume directory which isn't a temporary directory is left alone.
+	require.NoError(t, os.MkdirAll(filepath.Join(poolMount, "containers", "default_c1"), 0700))
+
+	for _, path := range []string{orphan, orphanVolType} {
+		require.NoError(t, os.Chtimes(path, old, old))
+	}
+
+	require.NoError(t, os.Chtimes(recent, since.Add(time.Hour), since.Add(time.Hour)))
+
+	deleted := []string{}
+	run := func(args ...string) (string, error) {
+		if args[0] == "subvolume" && args[1] == "delete" {
+			deleted = append(deleted, args[2])
+			delete(subvols, args[2])
+		}
+
+		return "", nil
+	}
+
+	entries := []captureLoggerEntry{}
+	l := &captureLogger{entries: &entries}
+
+	btrfsCleanupOrphanedReadonlySnapshots(run, func(path string) bool { return subvols[path] }, poolMount, since, l)
+
+	assert.Equal(t, []string{filepath.Join(orphan, "c1"), filepath.Join(orphanVolType, "c2", "nest"), filepath.Join(orphanVolType, "c2")}, deleted)
+	assert.NoDirExists(t, orphan)
+	assert.NoDirExists(t, orphanVolType)
+	assert.DirExists(t, filepath.Join(recent, "c3"))
+	assert.DirExists(t, filepath.Join(poolMount, "containers", "default_c1"))
+
+	require.Len(t, entries, 2)
+	assert.Equal(t, "Deleted orphaned read-only snapshot", entries[0].msg)
+	assert.Equal(t, orphan, entries[0].ctx["path"])
+	assert.Equal(t, orphanVolType, entries[1].ctx["path"])
+}
+
+// Test that the snapshots subvolume bounds the space of the snapshots without limiting the volume.
+func TestBtrfsCreateSnapshotsDir(t *testing.T) {
+	poolPath := t.TempDir()
+	volPath := filepath.Join(poolPath, "containers", "c1")
+	snapshotsPath := filepath.Join(poolPath, "containers-snapshots", "c1")
+	require.NoError(t, os.MkdirAll(volPath, 0711))
+	require.NoError(t, os.MkdirAll(filepath.Dir(snapshotsPath), 0711))
+
+	// Fake btrfs keeping the subvolumes and qgroups in memory.
+	subvols := map[string]string{volPath: "257"}
+	referenced := map[string]int64{"0/257": 4096}
+	limits := map[string]int64{}
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "subvolume delete":
+			delete(subvols, args[2])
+			return "", os.Remove(args[2])
+		case "inspect-internal rootid":
+			return subvols[args[2]] + "\n", nil
+		case "qgroup create":
+			referenced[args[2]] = 0
+			return "", nil
+		case "qgroup destroy":
+			delete(referenced, args[2])
+			delete(limits, args[2])
+			return "", nil
+		case "qgroup limit":
+			if args[2] == "none" {
+				delete(limits, args[3])
+				return "", nil
+			}
+
+			limit, err := strconv.ParseInt(args[2], 10, 64)
+			limits[args[3]] = limit
+			return "", err
+		case "qgroup show":
+			output := "qgroupid         rfer         excl     max_rfer\n--------         ----         ----     --------\n"
+			for qgroup, usage := range referenced {
+				// Only show the qgroup of the subvolume itself when filtering.
+				if shared.StringInSlice("-f", args) && qgroup != "0/"+subvols[args[len(args)-1]] {
+					continue
+				}
+
+				limit := "none"
+				_, ok := limits[qgroup]
+				if ok {
+					limit = fmt.Sprintf("%d", limits[qgroup])
+				}
+
+				output += fmt.Sprintf("%s %d %d %s\n", qgroup, usage, usage, limit)
+			}
+
+			return output, nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	isSubvolume := func(path string) bool {
+		_, ok := subvols[path]
+		return ok
+	}
+
+	createSubvolume := func(path string) error {
+		subvols[path] = "300"
+		return os.Mkdir(path, 0700)
+	}
+
+	// A missing snapshots directory is created as a subvolume with a quota.
+	qgroup, err := btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, snapshotsPath, 8192)
+	require.NoError(t, err)
+	assert.Equal(t, "1/300", qgroup)
+	assert.True(t, isSubvolume(snapshotsPath))
+	assert.Equal(t, map[string]int64{"1/300": 8192}, limits)
+
+	// Snapshots can be taken while their space is below the quota.
+	referenced["1/300"] = 4096
+	qgroup, err = btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, snapshotsPath, 8192)
+	require.NoError(t, err)
+	assert.Equal(t, "1/300", qgroup)
+
+	// Taking a snapshot fails once the quota is exhausted, while the volume isn't limited.
+	referenced["1/300"] = 8192
+	referenced["0/257"] = 1 << 20
+	_, err = btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, snapshotsPath, 8192)
+	assert.ErrorContains(t, err, "have reached their quota of 8192 bytes")
+	assert.NotContains(t, limits, "0/257")
+	assert.True(t, shared.PathExists(volPath))
+
+	// The snapshots subvolume and its qgroup are deleted once empty.
+	require.NoError(t, btrfsDeleteSnapshotsDirIfEmpty(run, isSubvolume, map[string]string{}, snapshotsPath))
+	assert.False(t, shared.PathExists(snapshotsPath))
+	assert.NotContains(t, referenced, "1/300")
+
+	// Without a quota, the snapshots directory is a plain directory.
+	qgroup, err = btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, snapshotsPath, 0)
+	require.NoError(t, err)
+	assert.Empty(t, qgroup)
+	assert.DirExists(t, snapshotsPath)
+	assert.False(t, isSubvolume(snapshotsPath))
+
+	// An existing empty plain directory is turned into a subvolume with a quota.
+	qgroup, err = btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, snapshotsPath, 8192)
+	require.NoError(t, err)
+	assert.Equal(t, "1/300", qgroup)
+	assert.True(t, isSubvolume(snapshotsPath))
+
+	// A changed quota is applied to the existing snapshots subvolumes, and removed once unset.
+	plainPath := filepath.Join(poolPath, "containers-snapshots", "c2")
+	require.NoError(t, os.MkdirAll(filepath.Join(plainPath, "snap0"), 0700))
+	emptyPath := filepath.Join(poolPath, "containers-snapshots", "c3")
+	require.NoError(t, os.Mkdir(emptyPath, 0700))
+
+	unbounded, err := btrfsApplySnapshotsQuota(run, isSubvolume, []string{snapshotsPath, plainPath, emptyPath}, 16384)
+	require.NoError(t, err)
+	assert.Equal(t, []string{plainPath}, unbounded)
+	assert.Equal(t, map[string]int64{"1/300": 16384}, limits)
+
+	_, err = btrfsApplySnapshotsQuota(run, isSubvolume, []string{snapshotsPath}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, limits)
+
+	// An existing plain directory holding snapshots is left unbounded.
+	qgroup, err = btrfsCreateSnapshotsDir(run, isSubvolume, createSubvolume, plainPath, 8192)
+	require.NoError(t, err)
+	assert.Empty(t, qgroup)
+	assert.False(t, isSubvolume(plainPath))
+}
+
+// Test that the snapshots of a volume are bounded by real qgroups and that a changed quota is applied to them.
+func TestBtrfsSnapshotsQuota(t *testing.T) {
+	dir, err := os.MkdirTemp(btrfsTestDir(t), "snapshots-quota.")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	_, err = shared.RunCommand("btrfs", "quota", "enable", dir)
+	require.NoError(t, err)
+
+	d := &btrfs{}
+	volPath := filepath.Join(dir, "vol")
+	snapshotsPath := filepath.Join(dir, "vol-snapshots")
+
+	require.NoError(t, btrfsSubVolumeCreate(volPath, 0700, nil))
+	defer func() { _ = d.deleteSubvolume(volPath, true) }()
+
+	require.NoError(t, os.WriteFile(filepath.Join(volPath, "data"), make([]byte, 1024*1024), 0600))
+
+	createSubvolume := func(path string) error { return btrfsSubVolumeCreate(path, 0700, nil) }
+	qgroup, err := btrfsCreateSnapshotsDir(runBtrfsCommand, btrfsIsSubVolume, createSubvolume, snapshotsPath, 4*1024*1024)
+	require.NoError(t, err)
+	require.NotEmpty(t, qgroup)
+	defer func() {
+		_ = btrfsDeleteSnapshotsDirIfEmpty(runBtrfsCommand, btrfsIsSubVolume, map[string]string{}, snapshotsPath)
+	}()
+
+	snapPath := filepath.Join(snapshotsPath, "snap0")
+	_, err = runBtrfsCommand("subvolume", "snapshot", "-r", "-i", qgroup, volPath, snapPath)
+	require.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(snapPath, true) }()
+
+	_, err = runBtrfsCommand("filesystem", "sync", dir)
+	require.NoError(t, err)
+
+	gotQGroup, usage, limit, err := btrfsSubVolumeQuotaUsage(runBtrfsCommand, snapshotsPath)
+	require.NoError(t, err)
+	assert.Equal(t, qgroup, gotQGroup)
+	assert.Equal(t, int64(4*1024*1024), limit)
+	assert.GreaterOrEqual(t, usage, int64(1024*1024))
+
+	// A lower quota is applied to the existing qgroup, and snapshots are refused once it's reached.
+	unbounded, err := btrfsApplySnapshotsQuota(runBtrfsCommand, btrfsIsSubVolume, []string{snapshotsPath}, 1024*1024)
+	require.NoError(t, err)
+	assert.Empty(t, unbounded)
+
+	_, _, limit, err = btrfsSubVolumeQuotaUsage(runBtrfsCommand, snapshotsPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024), limit)
+
+	_, err = btrfsCreateSnapshotsDir(runBtrfsCommand, btrfsIsSubVolume, createSubvolume, snapshotsPath, 1024*1024)
+	assert.ErrorContains(t, err, "have reached their quota")
+
+	// The quota is lifted once unset.
+	_, err = btrfsApplySnapshotsQuota(runBtrfsCommand, btrfsIsSubVolume, []string{snapshotsPath}, 0)
+	require.NoError(t, err)
+
+	_, _, limit, err = btrfsSubVolumeQuotaUsage(runBtrfsCommand, snapshotsPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), limit)
+}
+
+// Test that the images directory is bounded by a quota once turned into a subvolume, and that an existing plain
+// directory holding images is refused rather than left unbounded.
+func TestBtrfsCreateImagesDir(t *testing.T) {
+	imagesPath := filepath.Join(t.TempDir(), "images")
+	require.NoError(t, os.Mkdir(imagesPath, 0711))
+	require.NoError(t, os.Mkdir(filepath.Join(imagesPath, "img1"), 0711))
+
+	// Fake btrfs keeping the subvolumes and qgroup limits in memory.
+	subvols := map[string]string{}
+	limits := map[string]int64{}
+	run := func(args ...string) (string, error) {
+		switch strings.Join(args[:2], " ") {
+		case "inspect-internal rootid":
+			return subvols[args[2]] + "\n", nil
+		case "qgroup create":
+			return "", nil
+		case "qgroup limit":
+			if args[2] == "none" {
+				delete(limits, args[3])
+				return "", nil
+			}
+
+			limit, err := strconv.ParseInt(args[2], 10, 64)
+			limits[args[3]] = limit
+			return "", err
+		case "qgroup show":
+			output := "qgroupid         rfer         excl     max_rfer\n--------         ----         ----     --------\n"
+			for qgroup, limit := range limits {
+				output += fmt.Sprintf("%s 4096 4096 %d\n", qgroup, limit)
+			}
+
+			return output, nil
+		}
+
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	isSubvolume := func(path string) bool {
+		_, ok := subvols[path]
+		return ok
+	}
+
+	createSubvolume := func(path string) error {
+		subvols[path] = "300"
+		return os.Mkdir(path, 0711)
+	}
+
+	// Without a quota an existing directory is left alone.
+	qgroup, err := btrfsCreateImagesDir(run, isSubvolume, createSubvolume, imagesPath, 0)
+	require.NoError(t, err)
+	assert.Empty(t, qgroup)
+
+	// A directory already holding images can't be bounded.
+	_, err = btrfsCreateImagesDir(run, isSubvolume, createSubvolume, imagesPath, 8192)
+	assert.ErrorContains(t, err, "already holds images")
+	assert.False(t, isSubvolume(imagesPath))
+	assert.DirExists(t, filepath.Join(imagesPath, "img1"))
+
+	// Once empty, the directory is replaced by a subvolume with a quota.
+	require.NoError(t, os.Remove(filepath.Join(imagesPath, "img1")))
+	qgroup, err = btrfsCreateImagesDir(run, isSubvolume, createSubvolume, imagesPath, 8192)
+	require.NoError(t, err)
+	assert.Equal(t, "1/300", qgroup)
+	assert.True(t, isSubvolume(imagesPath))
+	assert.Equal(t, map[string]int64{"1/300": 8192}, limits)
+
+	// The limit of the images subvolume follows the setting and is lifted without it.
+	qgroup, err = btrfsCreateImagesDir(run, isSubvolume, createSubvolume, imagesPath, 16384)
+	require.NoError(t, err)
+	assert.Equal(t, "1/300", qgroup)
+	assert.Equal(t, map[string]int64{"1/300": 16384}, limits)
+
+	qgroup, err = btrfsCreateImagesDir(run, isSubvolume, createSubvolume, imagesPath, 0)
+	require.NoError(t, err)
+	assert.Empty(t, qgroup)
+	assert.Empty(t, limits)
+}
+
+// Test that growing a loop file backed pool makes the added space usable, and that shrinking it is refused.
+func TestBtrfsLoopFileGrow(t *testing.T) {
+	loopPath := filepath.Join(t.TempDir(), "pool.img")
+	require.NoError(t, ensureSparseFile(loopPath, 256*1024*1024))
+
+	run := func(args ...string) (string, error) {
+		return "", fmt.Errorf("Unexpected command %v", args)
+	}
+
+	err := btrfsLoopFileGrow(run, loopPath, "/pool", 128*1024*1024)
+	assert.ErrorIs(t, err, ErrCannotBeShrunk)
+
+	fi, err := os.Stat(loopPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(256*1024*1024), fi.Size())
+
+	// Growing a pool requires a real filesystem on a loop device.
+	btrfsTestDir(t)
+
+	_, err = shared.RunCommand("mkfs.btrfs", "-f", loopPath)
+	if err != nil {
+		t.Skipf("Test requires creating btrfs filesystems: %v", err)
+	}
+
+	loopDevPath, err := loopDeviceSetup(loopPath)
+	if err != nil {
+		t.Skipf("Test requires loop devices: %v", err)
+	}
+
+	defer func() { _ = loopDeviceAutoDetach(loopDevPath) }()
+
+	mountPath := t.TempDir()
+	require.NoError(t, unix.Mount(loopDevPath, mountPath, "btrfs", 0, ""))
+	defer func() { _ = unix.Unmount(mountPath, unix.MNT_DETACH) }()
+
+	require.NoError(t, btrfsLoopFileGrow(runBtrfsCommand, loopPath, mountPath, 1024*1024*1024))
+
+	fi, err = os.Stat(loopPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024*1024), fi.Size())
+
+	// The filesystem has grown past the initial size of the loop file and the space can be written to.
+	var st unix.Statfs_t
+	require.NoError(t, unix.Statfs(mountPath, &st))
+	assert.Greater(t, int64(st.Blocks)*st.Bsize, int64(512*1024*1024))
+
+	f, err := os.Create(filepath.Join(mountPath, "data"))
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	_, err = f.Write(bytes.Repeat([]byte{1}, 384*1024*1024))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+}
+
+// Test that the renames of a send stream are followed to report the final paths of the changes.
+func TestBtrfsSendStreamDiff(t *testing.T) {
+	stream := []byte(btrfsSendStreamMagic + "\x01\x00\x00\x00")
+
+	add := func(cmdType uint16, paths ...string) {
+		payload := []byte{}
+		for i, path := range paths {
+			attrType := uint16(btrfsSendAttrPath)
+			if i > 0 {
+				attrType = btrfsSendAttrPathTo
+			}
+
+			attr := make([]byte, 4)
+			binary.LittleEndian.PutUint16(attr[0:2], attrType)
+			binary.LittleEndian.PutUint16(attr[2:4], uint16(len(path)))
+			payload = append(payload, append(attr, path...)...)
+		}
+
+		cmd := make([]byte, btrfsSendCmdHeaderLen)
+		binary.LittleEndian.PutUint32(cmd[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint16(cmd[4:6], cmdType)
+		stream = append(stream, append(cmd, payload...)...)
+	}
+
+	add(btrfsSendCmdSnapshot, "c1")
+
+	// New file created under a temporary name.
+	add(btrfsSendCmdMkfile, "o257-10-0")
+	add(btrfsSendCmdRename, "o257-10-0", "etc/new")
+	add(btrfsSendCmdWrite, "etc/new")
+
+	// Changed file, and timestamps of its directory.
+	add(btrfsSendCmdWrite, "etc/hostname")
+	add(btrfsSendCmdUtimes, "etc")
+
+	// Deleted file.
+	add(btrfsSendCmdRename, "etc/old", "o258-5-0")
+	add(btrfsSendCmdUnlink, "o258-5-0")
+
+	// New directory populated before getting its name.
+	add(btrfsSendCmdMkdir, "o259-1-0")
+	add(btrfsSendCmdMkfile, "o259-1-0/f")
+	add(btrfsSendCmdRename, "o259-1-0", "opt")
+
+	// Deleted directory emptied under a temporary name.
+	add(btrfsSendCmdRename, "var", "o260-2-0")
+	add(btrfsSendCmdUnlink, "o260-2-0/log")
+	add(btrfsSendCmdRmdir, "o260-2-0")
+
+	// Replaced file.
+	add(btrfsSendCmdUnlink, "bin/sh")
+	add(btrfsSendCmdSymlink, "bin/sh")
+
+	// Moved file.
+	add(btrfsSendCmdRename, "usr/a", "usr/b")
+
+	// Change to the root.
+	add(btrfsSendCmdChmod, "")
+
+	add(btrfsSendCmdEnd)
+
+	diff, err := btrfsSendStreamDiff(bytes.NewReader(stream), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/etc/new", "/opt", "/opt/f", "/usr/b"}, diff.Added)
+	assert.Equal(t, []string{"/bin/sh", "/etc/hostname"}, diff.Modified)
+	assert.Equal(t, []string{"/etc/old", "/usr/a", "/var", "/var/log"}, diff.Deleted)
+
+	_, err = btrfsSendStreamDiff(bytes.NewReader([]byte("not a stream")), nil)
+	assert.Error(t, err)
+}
+
+// Test that the owner changes of a send stream are only reported when the owner differs from the parent's one.
+func TestBtrfsSendStreamDiff_Owner(t *testing.T) {
+	stream := []byte(btrfsSendStreamMagic + "\x01\x00\x00\x00")
+
+	add := func(cmdType uint16, path string, ids ...uint64) {
+		attr := func(attrType uint16, value []byte) []byte {
+			header := make([]byte, 4)
+			binary.LittleEndian.PutUint16(header[0:2], attrType)
+			binary.LittleEndian.PutUint16(header[2:4], uint16(len(value)))
+			return append(header, value...)
+		}
+
+		payload := attr(btrfsSendAttrPath, []byte(path))
+		for i, id := range ids {
+			value := make([]byte, 8)
+			binary.LittleEndian.PutUint64(value, id)
+			payload = append(payload, attr(uint16(btrfsSendAttrUID+i), value)...)
+		}
+
+		cmd := make([]byte, btrfsSendCmdHeaderLen)
+		binary.LittleEndian.PutUint32(cmd[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint16(cmd[4:6], cmdType)
+		stream = append(stream, append(cmd, payload...)...)
+	}
+
+	add(btrfsSendCmdSnapshot, "c1")
+	add(btrfsSendCmdChown, "etc/hostname", 1000000, 1000000)
+	add(btrfsSendCmdChown, "etc/shadow", 1000000, 1000042)
+	add(btrfsSendCmdMkfile, "etc/new")
+	add(btrfsSendCmdChown, "etc/new", 1000000, 1000000)
+	add(btrfsSendCmdEnd, "")
+
+	// The parent is owned by root, the subvolume shifted by a million.
+	checked := []string{}
+	ownerChanged := func(path string, uid int64, gid int64) (bool, error) {
+		checked = append(checked, path)
+		return uid != 1000000 || gid != 1000000, nil
+	}
+
+	diff, err := btrfsSendStreamDiff(bytes.NewReader(stream), ownerChanged)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/etc/hostname", "/etc/shadow"}, checked)
+	assert.Equal(t, []string{"/etc/new"}, diff.Added)
+	assert.Equal(t, []string{"/etc/shadow"}, diff.Modified)
+	assert.Empty(t, diff.Deleted)
+
+	// Without an owner check every owner change is reported.
+	diff, err = btrfsSendStreamDiff(bytes.NewReader(stream), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/etc/hostname", "/etc/shadow"}, diff.Modified)
+}
+
+// Test that the changes made to a snapshot of a subvolume are listed by sending it relative to the subvolume.
+// Needs btrfs-progs and root.
+func TestBtrfsSendDiff(t *testing.T) {
+	dir := btrfsTestDir(t)
+	d := &btrfs{}
+
+	imgPath := filepath.Join(dir, "diff-image")
+	instPath := filepath.Join(dir, "diff-instance")
+	snapPath := filepath.Join(dir, "diff-snapshot")
+
+	_, err := shared.RunCommand("btrfs", "subvolume", "create", imgPath)
+	require.NoError(t, err)
+	defer func() { _ = d.deleteSubvolume(imgPath, false) }()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(imgPath, "rootfs", "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(imgPath, "rootfs", "etc", "hostname"), []byte("image\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(imgPath, "rootfs", "etc", "motd"), []byte("hello\n"), 0644))
+	require.NoError(t, d.setSubvolumeReadonlyProperty(imgPath, true))
+
+	require.NoError(t, d.snapshotSubvolume(imgPath, instPath, false, nil))
+	defer func() { _ = d.deleteSubvolume(instPath, false) }()
+	require.NoError(t, d.setSubvolumeReadonlyProperty(instPath, false))
+
+	isSnapshot, err := btrfsIsSnapshotOf(instPath, imgPath)
+	require.NoError(t, err)
+	assert.True(t, isSnapshot)
+
+	require.NoError(t, os.WriteFile(filepath.Join(instPath, "rootfs", "etc", "hostname"), []byte("c1\n"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(instPath, "rootfs", "etc", "motd")))
+	require.NoError(t, os.MkdirAll(filepath.Join(instPath, "rootfs", "opt"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(instPath, "rootfs", "opt", "app"), []byte("app\n"), 0755))
+
+	require.NoError(t, d.snapshotSubvolume(instPath, snapPath, false, nil))
+	defer func() { _ = d.deleteSubvolume(snapPath, false) }()
+	require.NoError(t, d.setSubvolumeReadonlyProperty(snapPath, true))
+
+	diff, err := btrfsSendDiff(imgPath, snapPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/rootfs/opt", "/rootfs/opt/app"}, diff.Added)
+	assert.Equal(t, []string{"/rootfs/etc/hostname"}, diff.Modified)
+	assert.Equal(t, []string{"/rootfs/etc/motd"}, diff.Deleted)
+
+	// The file by file comparison finds the same changes.
+	diff, err = DiffVolumePaths(imgPath, instPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/rootfs/opt", "/rootfs/opt/app"}, diff.Added)
+	assert.Equal(t, []string{"/rootfs/etc/hostname"}, diff.Modified)
+	assert.Equal(t, []string{"/rootfs/etc/motd"}, diff.Deleted)
+}
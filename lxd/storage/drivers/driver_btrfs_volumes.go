@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,6 +27,7 @@ import (
 	"github.com/lxc/lxd/lxd/storage/filesystem"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/instancewriter"
 	"github.com/lxc/lxd/shared/ioprogress"
 	"github.com/lxc/lxd/shared/logger"
@@ -39,8 +42,18 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 	revert := revert.New()
 	defer revert.Fail()
 
+	// Image volumes are accounted to the images cache when its space is bounded.
+	imagesQGroup := ""
+	if vol.volType == VolumeTypeImage {
+		var err error
+		imagesQGroup, err = d.createImagesDir()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Create the volume itself.
-	_, err := shared.RunCommand("btrfs", "subvolume", "create", volPath)
+	err := btrfsSubVolumeCreate(volPath, d.subvolumeMode(), vol.rootOwner)
 	if err != nil {
 		return err
 	}
@@ -50,6 +63,19 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 		_ = os.Remove(volPath)
 	})
 
+	if imagesQGroup != "" {
+		err = btrfsSubVolumeAssignQGroup(runBtrfsCommand, volPath, imagesQGroup)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set the file flags which only apply to the files created afterwards before filling the volume.
+	err = d.applyFileFlags(vol, true)
+	if err != nil {
+		return err
+	}
+
 	// Create sparse loopback file if volume is block.
 	rootBlockPath := ""
 	if vol.contentType == ContentTypeBlock {
@@ -124,6 +150,11 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 		return err
 	}
 
+	err = d.applyFileFlags(vol, false)
+	if err != nil {
+		return err
+	}
+
 	// Attempt to mark image read-only.
 	if vol.volType == VolumeTypeImage {
 		err = d.setSubvolumeReadonlyProperty(volPath, true)
@@ -138,12 +169,38 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 
 // CreateVolumeFromBackup restores a backup tarball onto the storage device.
 func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (VolumePostHook, revert.Hook, error) {
+	l := d.opLogger(op, vol.name, "restore_backup")
+
 	// Handle the non-optimized tarballs through the generic unpacker.
 	if !*srcBackup.OptimizedStorage {
-		return genericVFSBackupUnpack(d, d.state.OS, vol, srcBackup.Snapshots, srcData, op)
+		unpackVol, err := btrfsCreationFileFlagsVolume(vol)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		postHook, revertHook, err := genericVFSBackupUnpack(d, d.state.OS, unpackVol, srcBackup.Snapshots, srcData, op)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = d.applyFileFlags(vol, false)
+		if err != nil {
+			if revertHook != nil {
+				revertHook()
+			}
+
+			return nil, nil, err
+		}
+
+		return postHook, revertHook, nil
+	}
+
+	exists, _, err := d.volumeExists(vol)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if d.HasVolume(vol) {
+	if exists {
 		return nil, nil, fmt.Errorf("Cannot restore volume, already exists on target")
 	}
 
@@ -156,7 +213,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 		for _, snapName := range srcBackup.Snapshots {
 			fullSnapshotName := GetSnapshotVolumeName(vol.name, snapName)
 			snapVol := NewVolume(d, d.name, vol.volType, vol.contentType, fullSnapshotName, vol.config, vol.poolConfig)
-			_ = d.DeleteVolumeSnapshot(snapVol, op)
+			_ = d.deleteVolumeSnapshot(snapVol, true, op)
 		}
 
 		// And lastly the main volume.
@@ -166,7 +223,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 	revert.Add(revertHook)
 
 	// Find the compression algorithm used for backup source data.
-	_, err := srcData.Seek(0, 0)
+	_, err = srcData.Seek(0, 0)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -179,7 +236,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 	// Load optimized backup header file if specified.
 	var optimizedHeader *BTRFSMetaDataHeader
 	if *srcBackup.OptimizedHeader {
-		optimizedHeader, err = d.loadOptimizedBackupHeader(srcData, GetVolumeMountPath(d.name, vol.volType, ""))
+		optimizedHeader, err = d.loadOptimizedBackupHeader(srcData, getVolumeMountPath(d.name, d.config, vol.volType, ""))
 		if err != nil {
 			return nil, nil, err
 		}
@@ -205,7 +262,13 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 	}
 
 	// Create a temporary directory to unpack the backup into.
-	tmpUnpackDir, err := os.MkdirTemp(GetVolumeMountPath(d.name, vol.volType, ""), "backup.")
+	volumesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
+	tmpParentDir, err := vol.TempDir(volumesPath, volumesPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpUnpackDir, err := os.MkdirTemp(tmpParentDir, "backup.")
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to create temporary directory %q: %w", tmpUnpackDir, err)
 	}
@@ -303,7 +366,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 
 	if len(srcBackup.Snapshots) > 0 {
 		// Create new snapshots directory.
-		err := createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -375,19 +438,34 @@ func (d *btrfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcDat
 		}
 
 		path := filepath.Join(v.MountPath(), subVol.Path)
-		d.logger.Debug("Setting subvolume readonly", logger.Ctx{"name": v.name, "path": path})
+		l.Debug("Setting subvolume readonly", logger.Ctx{"name": v.name, "path": path})
 		err = d.setSubvolumeReadonlyProperty(path, true)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
+	err = d.applyCopiedFileFlags(vol)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	revert.Success()
 	return nil, revertHook, nil
 }
 
 // CreateVolumeFromCopy provides same-pool volume copying functionality.
 func (d *btrfs) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bool, allowInconsistent bool, op *operations.Operation) error {
+	// Containers created from an image with "btrfs.overlay" only keep a read-only snapshot of it as their base.
+	if vol.volType == VolumeTypeContainer && srcVol.volType == VolumeTypeImage && vol.contentType == ContentTypeFS && shared.IsTrue(vol.ExpandedConfig("btrfs.overlay")) {
+		return d.createOverlayVolumeFromImage(vol, srcVol, op)
+	}
+
+	err := btrfsCheckNotOverlay(srcVol.MountPath(), "copy")
+	if err != nil {
+		return err
+	}
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -400,13 +478,22 @@ func (d *btrfs) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bo
 	target := vol.MountPath()
 
 	// Recursively copy the main volume.
-	err = d.snapshotSubvolume(srcVol.MountPath(), target, true)
+	err = d.snapshotSubvolume(srcVol.MountPath(), target, true, vol.rootOwner)
 	if err != nil {
 		return err
 	}
 
 	revert.Add(func() { _ = d.deleteSubvolume(target, true) })
 
+	// Make sure the new volume has its own qgroup (even if the source doesn't have one) so that its usage is
+	// accounted for independently of the source.
+	if !d.state.OS.RunningInUserNS {
+		err = d.ensureQGroup(target)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Restore readonly property on subvolumes in reverse order (except root which should be left writable).
 	subVolCount := len(subVols)
 	for i := range subVols {
@@ -434,6 +521,11 @@ func (d *btrfs) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bo
 		return err
 	}
 
+	err = d.applyCopiedFileFlags(vol)
+	if err != nil {
+		return err
+	}
+
 	var snapshots []string
 
 	// Get snapshot list if copying snapshots.
@@ -448,17 +540,17 @@ func (d *btrfs) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bo
 	// Copy any snapshots needed.
 	if len(snapshots) > 0 {
 		// Create the parent directory.
-		err = createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err = createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
 
 		// Copy the snapshots.
 		for _, snapName := range snapshots {
-			srcSnapshot := GetVolumeMountPath(d.name, srcVol.volType, GetSnapshotVolumeName(srcVol.name, snapName))
-			dstSnapshot := GetVolumeMountPath(d.name, vol.volType, GetSnapshotVolumeName(vol.name, snapName))
+			srcSnapshot := getVolumeMountPath(d.name, d.config, srcVol.volType, GetSnapshotVolumeName(srcVol.name, snapName))
+			dstSnapshot := getVolumeMountPath(d.name, d.config, vol.volType, GetSnapshotVolumeName(vol.name, snapName))
 
-			err = d.snapshotSubvolume(srcSnapshot, dstSnapshot, true)
+			err = d.snapshotSubvolume(srcSnapshot, dstSnapshot, true, nil)
 			if err != nil {
 				return err
 			}
@@ -476,15 +568,162 @@ func (d *btrfs) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bo
 	return nil
 }
 
+// createOverlayVolumeFromImage creates a container volume whose rootfs is a writable overlay on top of a read-only
+// snapshot of the image volume. The image data stays shared with the image and the other containers created from
+// it and unmodified, the writes of the container going to the upper directory of the overlay. The overlay is
+// mounted when the volume is mounted.
+func (d *btrfs) createOverlayVolumeFromImage(vol Volume, imgVol Volume, op *operations.Operation) error {
+	revert := revert.New()
+	defer revert.Fail()
+
+	volPath := vol.MountPath()
+	err := btrfsSubVolumeCreate(volPath, d.subvolumeMode(), vol.rootOwner)
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() { _ = d.deleteSubvolume(volPath, true) })
+
+	// Give the volume its own qgroup so that the quota only applies to the writes of the container.
+	if !d.state.OS.RunningInUserNS {
+		err = d.ensureQGroup(volPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	base, _, _ := btrfsOverlayPaths(volPath)
+	err = os.Mkdir(filepath.Dir(base), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating overlay directory: %w", err)
+	}
+
+	err = d.snapshotSubvolume(imgVol.MountPath(), base, true, nil)
+	if err != nil {
+		return err
+	}
+
+	err = d.setSubvolumeReadonlyProperty(base, true)
+	if err != nil {
+		return err
+	}
+
+	err = btrfsCreateOverlayDirs(volPath)
+	if err != nil {
+		return err
+	}
+
+	// Copy the instance metadata and templates of the image next to the rootfs.
+	for _, name := range []string{"metadata.yaml", "templates"} {
+		srcPath := filepath.Join(imgVol.MountPath(), name)
+		if !shared.PathExists(srcPath) {
+			continue
+		}
+
+		if shared.IsDir(srcPath) {
+			err = shared.DirCopy(srcPath, filepath.Join(volPath, name))
+		} else {
+			err = shared.FileCopy(srcPath, filepath.Join(volPath, name))
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed copying %q from image: %w", name, err)
+		}
+	}
+
+	err = d.SetVolumeQuota(vol, vol.config["size"], false, op)
+	if err != nil {
+		return err
+	}
+
+	err = vol.EnsureMountPath()
+	if err != nil {
+		return err
+	}
+
+	revert.Success()
+	return nil
+}
+
+// CreateVolumeFromStream creates a volume from a btrfs send stream containing only its subvolume, such as one
+// streamed from a remote server, receiving it as it's read. The stream is validated as it's received and its
+// SHA256 checksum (if not empty) is verified before the volume is moved into place. The subvolume is deleted if
+// the stream is invalid, incomplete or doesn't match the checksum.
+func (d *btrfs) CreateVolumeFromStream(vol Volume, r io.Reader, checksum string, op *operations.Operation) error {
+	if vol.contentType != ContentTypeFS {
+		return fmt.Errorf("Only filesystem volumes can be created from a stream: %w", ErrNotSupported)
+	}
+
+	l := d.opLogger(op, vol.name, "receive_stream")
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	hash := sha256.New()
+	verify := func(subvols []btrfsStreamSubvolume) error {
+		// Snapshots would be missing their database records.
+		if len(subvols) != 1 {
+			return fmt.Errorf("Stream must contain a single subvolume, found %d", len(subvols))
+		}
+
+		if checksum != "" {
+			streamChecksum := hex.EncodeToString(hash.Sum(nil))
+			if !strings.EqualFold(streamChecksum, checksum) {
+				return fmt.Errorf("Stream checksum %q doesn't match expected %q", streamChecksum, checksum)
+			}
+		}
+
+		return nil
+	}
+
+	err := d.importVolumeStream(vol, io.TeeReader(r, hash), verify)
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() { _ = d.deleteSubvolume(vol.MountPath(), true) })
+
+	err = d.SetVolumeQuota(vol, vol.ConfigSize(), false, op)
+	if err != nil {
+		return err
+	}
+
+	l.Debug("Created volume from stream")
+
+	revert.Success()
+	return nil
+}
+
 // CreateVolumeFromMigration creates a volume being sent via a migration.
 func (d *btrfs) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "receive_migration")
+
 	// Handle simple rsync and block_and_rsync through generic.
 	if volTargetArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volTargetArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
-		return genericVFSCreateVolumeFromMigration(d, nil, vol, conn, volTargetArgs, preFiller, op)
+		recvVol, err := btrfsCreationFileFlagsVolume(vol)
+		if err != nil {
+			return err
+		}
+
+		err = genericVFSCreateVolumeFromMigration(d, nil, recvVol, conn, volTargetArgs, preFiller, op)
+		if err != nil {
+			return err
+		}
+
+		return d.applyFileFlags(vol, false)
 	} else if volTargetArgs.MigrationType.FSType != migration.MigrationFSType_BTRFS {
 		return ErrNotSupported
 	}
 
+	// Refuse receiving a volume which wouldn't fit rather than filling up the pool. Refreshes only receive the
+	// differences so the estimate of the whole volume doesn't apply to them.
+	if volTargetArgs.SizeEstimate > 0 && !volTargetArgs.Refresh {
+		err := btrfsCheckReceiveSpace(runBtrfsCommand, GetPoolMountPath(d.name), volTargetArgs.SizeEstimate)
+		if err != nil {
+			return err
+		}
+	}
+
 	var migrationHeader BTRFSMetaDataHeader
 
 	// List of subvolumes to be synced. This is sent back to the source.
@@ -502,7 +741,7 @@ func (d *btrfs) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, v
 			return fmt.Errorf("Failed decoding BTRFS migration header: %w", err)
 		}
 
-		d.logger.Debug("Received BTRFS migration meta data header", logger.Ctx{"name": vol.name})
+		l.Debug("Received BTRFS migration meta data header")
 	} else {
 		// Populate the migrationHeader subvolumes with root volumes only to support older LXD sources.
 		for _, snapName := range volTargetArgs.Snapshots {
@@ -555,7 +794,7 @@ func (d *btrfs) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, v
 				volTargetArgs.Snapshots = append(volTargetArgs.Snapshots, migrationSnap.Snapshot)
 			}
 
-			syncSubvolumes = append(syncSubvolumes, BTRFSSubVolume{Path: migrationSnap.Path, Snapshot: migrationSnap.Snapshot, UUID: migrationSnap.UUID})
+			syncSubvolumes = append(syncSubvolumes, BTRFSSubVolume{Path: migrationSnap.Path, Snapshot: migrationSnap.Snapshot, UUID: migrationSnap.UUID, SentUUID: migrationSnap.SentUUID})
 		}
 
 		migrationHeader = BTRFSMetaDataHeader{Subvolumes: syncSubvolumes}
@@ -575,21 +814,63 @@ func (d *btrfs) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, v
 			return fmt.Errorf("Failed closing BTRFS migration header frame: %w", err)
 		}
 
-		d.logger.Debug("Sent BTRFS migration meta data header", logger.Ctx{"name": vol.name, "header": migrationHeader})
+		l.Debug("Sent BTRFS migration meta data header", logger.Ctx{"header": migrationHeader})
 	} else {
 		syncSubvolumes = migrationHeader.Subvolumes
 	}
 
-	return d.createVolumeFromMigrationOptimized(vol, conn, volTargetArgs, preFiller, syncSubvolumes, op)
+	// Keep the snapshots received in a resume directory until the migration completes, so that if it's
+	// interrupted the next migration of the volume can resume after the last snapshot received instead of
+	// starting over. Refreshes are already incremental and don't need it.
+	resumeDir := ""
+	var resumed []btrfsMigrationCheckpointSnapshot
+	if !volTargetArgs.Refresh && !volTargetArgs.VolumeOnly {
+		resumeDir = btrfsMigrationResumePath(d.name, vol.volType, vol.name)
+
+		checkpoint, err := loadBtrfsMigrationCheckpoint(resumeDir)
+		if err != nil {
+			return err
+		}
+
+		if migrationHeader.ResumeFrom != "" {
+			var ok bool
+			resumed, ok = checkpoint.resumeFrom(migrationHeader.ResumeFrom)
+			if !ok {
+				return fmt.Errorf("Cannot resume migration after snapshot %q which wasn't received", migrationHeader.ResumeFrom)
+			}
+
+			l.Info("Resuming interrupted migration", logger.Ctx{"snapshot": migrationHeader.ResumeFrom})
+		}
+
+		// Discard anything left by a previous migration which isn't part of this one.
+		err = d.pruneMigrationResumeDir(resumeDir, resumed, false)
+		if err != nil {
+			return fmt.Errorf("Failed cleaning up migration resume directory %q: %w", resumeDir, err)
+		}
+	}
+
+	// Delete what's left of migrations of other volumes which were interrupted and never resumed.
+	err := d.deleteExpiredMigrationResumeDirs(time.Now(), resumeDir)
+	if err != nil {
+		l.Warn("Failed deleting expired migration resume directories", logger.Ctx{"err": err})
+	}
+
+	return d.createVolumeFromMigrationOptimized(vol, conn, volTargetArgs, preFiller, syncSubvolumes, resumeDir, resumed, op)
 }
 
-func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, subvolumes []BTRFSSubVolume, op *operations.Operation) error {
+// createVolumeFromMigrationOptimized receives the subvolumes of the volume and of its snapshots. If resumeDir isn't
+// empty, the snapshots are received there and recorded as they complete, the resumed ones having been
+// received by a previous migration.
+func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, subvolumes []BTRFSSubVolume, resumeDir string, resumed []btrfsMigrationCheckpointSnapshot, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "receive_migration")
+
 	revert := revert.New()
 	defer revert.Fail()
 
 	type btrfsCopyOp struct {
 		src          string
 		dest         string
+		path         string // Path of the subvolume inside the volume.
 		receivedUUID string
 	}
 
@@ -614,7 +895,7 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 			}
 
 			subVolTargetPath := filepath.Join(v.MountPath(), subVol.Path)
-			d.logger.Debug("Receiving volume", logger.Ctx{"name": v.name, "receivePath": receivePath, "path": subVolTargetPath})
+			l.Debug("Receiving volume", logger.Ctx{"name": v.name, "receivePath": receivePath, "path": subVolTargetPath})
 
 			subVolRecvPath, err := d.receiveSubVolume(conn, receivePath)
 			if err != nil {
@@ -631,10 +912,19 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 				return fmt.Errorf("Failed getting UUID: %w", err)
 			}
 
+			// The main volume is sent from a temporary snapshot whose UUID isn't in the header.
+			if subVol.Snapshot != "" {
+				err = btrfsVerifyReceivedUUID(subVol, subVolRecvPath, UUID)
+				if err != nil {
+					return err
+				}
+			}
+
 			// Record the copy operations we need to do after having received all subvolumes.
 			copyOps = append(copyOps, btrfsCopyOp{
 				src:          subVolRecvPath,
 				dest:         subVolTargetPath,
+				path:         subVol.Path,
 				receivedUUID: UUID,
 			})
 		}
@@ -643,12 +933,17 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 	}
 
 	// Get instances directory (e.g. /var/lib/lxd/storage-pools/btrfs/containers).
-	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	instancesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
 
 	// Create a temporary directory which will act as the parent directory of the received ro snapshot.
-	tmpVolumesMountPoint, err := os.MkdirTemp(instancesPath, "migration.")
+	tmpParentDir, err := vol.TempDir(instancesPath, instancesPath)
 	if err != nil {
-		return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
+		return err
+	}
+
+	tmpVolumesMountPoint, err := os.MkdirTemp(tmpParentDir, "migration.")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", tmpParentDir, err)
 	}
 
 	defer func() { _ = os.RemoveAll(tmpVolumesMountPoint) }()
@@ -658,23 +953,102 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		return fmt.Errorf("Failed to chmod %q: %w", tmpVolumesMountPoint, err)
 	}
 
+	checkpoint := &btrfsMigrationCheckpoint{Snapshots: resumed}
+	snapshotsReceivePath := tmpVolumesMountPoint
+
+	if resumeDir != "" {
+		err = os.MkdirAll(resumeDir, 0700)
+		if err != nil {
+			return fmt.Errorf("Failed creating migration resume directory %q: %w", resumeDir, err)
+		}
+
+		// Keep the snapshots fully received so far if the migration fails.
+		revert.Add(func() {
+			if len(checkpoint.Snapshots) > 0 {
+				_ = d.pruneMigrationResumeDir(resumeDir, checkpoint.Snapshots, false)
+			} else {
+				_ = d.deleteMigrationResumeDir(resumeDir)
+			}
+		})
+
+		err = checkpoint.save(resumeDir)
+		if err != nil {
+			return fmt.Errorf("Failed saving migration checkpoint: %w", err)
+		}
+
+		snapshotsReceivePath = resumeDir
+	}
+
 	// Handle btrfs send/receive migration.
 	if !volTargetArgs.VolumeOnly && len(volTargetArgs.Snapshots) > 0 {
 		// Create the parent directory.
-		err := createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
 
-		revert.Add(func() { _ = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, vol.name) })
+		revert.Add(func() { _ = deleteParentSnapshotDirIfEmpty(d.name, d.config, vol.volType, vol.name) })
+
+		// Use the snapshots received by the interrupted migration being resumed.
+		resumedSnapshots := make(map[string]bool, len(resumed))
+		for _, snap := range resumed {
+			snapVol, _ := vol.NewSnapshot(snap.Name)
+			for _, subVol := range snap.Subvolumes {
+				copyOps = append(copyOps, btrfsCopyOp{
+					src:          filepath.Join(resumeDir, subVol.Received),
+					dest:         filepath.Join(snapVol.MountPath(), subVol.Path),
+					path:         subVol.Path,
+					receivedUUID: subVol.ReceivedUUID,
+				})
+			}
+
+			resumedSnapshots[snap.Name] = true
+		}
 
 		// Transfer the snapshots.
 		for _, snapName := range volTargetArgs.Snapshots {
+			if resumedSnapshots[snapName] {
+				continue
+			}
+
+			received := len(copyOps)
+
 			snapVol, _ := vol.NewSnapshot(snapName)
-			err = receiveVolume(snapVol, tmpVolumesMountPoint)
+			err = receiveVolume(snapVol, snapshotsReceivePath)
 			if err != nil {
 				return err
 			}
+
+			if resumeDir == "" {
+				continue
+			}
+
+			// Record the snapshot as received.
+			snap := btrfsMigrationCheckpointSnapshot{Name: snapName}
+			for _, subVol := range subvolumes {
+				if subVol.Snapshot == snapName && subVol.Path == string(filepath.Separator) {
+					snap.UUID = subVol.UUID
+				}
+			}
+
+			for _, copyOp := range copyOps[received:] {
+				relPath, err := filepath.Rel(resumeDir, copyOp.src)
+				if err != nil {
+					return err
+				}
+
+				snap.Subvolumes = append(snap.Subvolumes, btrfsMigrationCheckpointSubvolume{
+					Path:         copyOp.path,
+					Received:     relPath,
+					ReceivedUUID: copyOp.receivedUUID,
+				})
+			}
+
+			checkpoint.Snapshots = append(checkpoint.Snapshots, snap)
+			err = checkpoint.save(resumeDir)
+			if err != nil {
+				return fmt.Errorf("Failed saving migration checkpoint: %w", err)
+			}
 		}
 	}
 
@@ -692,6 +1066,17 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		}
 	}
 
+	// The received snapshots are about to be moved out of the resume directory, after which the
+	// migration can't be resumed anymore.
+	if resumeDir != "" {
+		checkpoint.Snapshots = nil
+
+		err = os.Remove(filepath.Join(resumeDir, btrfsMigrationCheckpointFile))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed removing migration checkpoint: %w", err)
+		}
+	}
+
 	// Make all received subvolumes read-write and move them to their final destination
 	for _, op := range copyOps {
 		err = d.setSubvolumeReadonlyProperty(op.src, false)
@@ -731,7 +1116,7 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		}
 
 		path := filepath.Join(v.MountPath(), subVol.Path)
-		d.logger.Debug("Setting subvolume readonly", logger.Ctx{"name": v.name, "path": path})
+		l.Debug("Setting subvolume readonly", logger.Ctx{"name": v.name, "path": path})
 		err = d.setSubvolumeReadonlyProperty(path, true)
 		if err != nil {
 			return err
@@ -746,12 +1131,31 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		}
 	}
 
+	err = d.applyCopiedFileFlags(vol)
+	if err != nil {
+		return err
+	}
+
+	if resumeDir != "" {
+		err = d.deleteMigrationResumeDir(resumeDir)
+		if err != nil {
+			l.Warn("Failed deleting migration resume directory", logger.Ctx{"path": resumeDir, "err": err})
+		}
+	}
+
 	revert.Success()
 	return nil
 }
 
 // RefreshVolume provides same-pool volume and specific snapshots syncing functionality.
 func (d *btrfs) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume, allowInconsistent bool, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "refresh")
+
+	err := btrfsCheckNotOverlay(srcVol.MountPath(), "refresh from")
+	if err != nil {
+		return err
+	}
+
 	// Get target snapshots
 	targetSnapshots, err := d.volumeSnapshotsSorted(vol, op)
 	if err != nil {
@@ -763,24 +1167,76 @@ func (d *btrfs) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume,
 		return fmt.Errorf("Failed to get source snapshots: %w", err)
 	}
 
-	// Optimized refresh only makes sense if the source and target have at least one identical snapshot,
-	// as btrfs can then use an incremental streams instead of just copying the datasets.
-	if len(targetSnapshots) == 0 || len(srcSnapshotsAll) == 0 {
-		d.logger.Debug("Performing generic volume refresh")
+	// Optimized refresh relies on the subvolume UUIDs to find a snapshot common to the source and target,
+	// which can't be listed from inside a user namespace.
+	if d.state.OS.RunningInUserNS {
+		l.Debug("Performing generic volume refresh")
 		return genericVFSCopyVolume(d, nil, vol, srcVol, srcSnapshots, true, false, op)
 	}
 
-	d.logger.Debug("Performing optimized volume refresh")
+	l.Debug("Performing optimized volume refresh")
+
+	uuids, err := d.getSubvolumesUUIDs(vol.pool)
+	if err != nil {
+		return fmt.Errorf("Failed to get subvolume UUIDs: %w", err)
+	}
+
+	// The subvolumes are keyed by path, so those of a source volume on another pool can be added alongside.
+	if srcVol.pool != vol.pool {
+		srcUUIDs, err := d.getSubvolumesUUIDs(srcVol.pool)
+		if err != nil {
+			return fmt.Errorf("Failed to get source subvolume UUIDs: %w", err)
+		}
+
+		for path, subvolUUIDs := range srcUUIDs {
+			uuids[path] = subvolUUIDs
+		}
+	}
+
+	snapshotsUUIDs := func(parentVol Volume, snapshots []string) []btrfsSnapshotUUIDs {
+		snapUUIDs := make([]btrfsSnapshotUUIDs, 0, len(snapshots))
+		for _, snapName := range snapshots {
+			snapVol, _ := parentVol.NewSnapshot(snapName)
+			snapUUID := uuids[snapVol.MountPath()]
+			snapUUID.Name = snapName
+			snapUUIDs = append(snapUUIDs, snapUUID)
+		}
+
+		return snapUUIDs
+	}
+
+	// Find the most recent target snapshot which was received from one of the source snapshots, an
+	// incremental stream based on it can then be used instead of sending the whole volume.
+	var origin *Volume
+	commonSnapshot := btrfsCommonSnapshot(snapshotsUUIDs(srcVol, srcSnapshotsAll), snapshotsUUIDs(vol, targetSnapshots))
+	if commonSnapshot != "" {
+		commonVol, err := srcVol.NewSnapshot(commonSnapshot)
+		if err != nil {
+			return fmt.Errorf("Failed to create new snapshot volume: %w", err)
+		}
+
+		origin = &commonVol
+		l.Debug("Found common snapshot for incremental refresh", logger.Ctx{"snapshot": commonSnapshot})
+	} else {
+		l.Debug("No common snapshot found, performing full send")
+	}
 
-	transfer := func(src Volume, target Volume, origin Volume) error {
+	transfer := func(src Volume, target Volume, origin *Volume) error {
 		var sender *exec.Cmd
 
-		srcSubvolPath := filepath.Join(GetPoolMountPath(src.pool), fmt.Sprintf("%s-snapshots/%s", src.volType, src.name))
-		targetSubvolPath := filepath.Join(GetPoolMountPath(target.pool), fmt.Sprintf("%s-snapshots/%s", target.volType, target.name))
-		originSubvolPath := filepath.Join(GetPoolMountPath(origin.pool), fmt.Sprintf("%s-snapshots/%s", origin.volType, origin.name))
+		srcSubvolPath := src.MountPath()
+		targetSubvolPath := target.SnapshotsDir()
 
 		receiver := exec.Command("btrfs", "receive", targetSubvolPath)
-		sender = exec.Command("btrfs", "send", "-p", originSubvolPath, srcSubvolPath)
+		if origin != nil {
+			// Prevent the origin from being removed while it is used for the differential.
+			origin.SendParentRefCountIncrement()
+			defer origin.SendParentRefCountDecrement()
+
+			sender = exec.Command("btrfs", "send", "-p", origin.MountPath(), srcSubvolPath)
+		} else {
+			sender = exec.Command("btrfs", "send", srcSubvolPath)
+		}
 
 		// Configure the pipes.
 		receiver.Stdin, _ = sender.StdoutPipe()
@@ -806,27 +1262,19 @@ func (d *btrfs) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume,
 		return nil
 	}
 
-	// Before refreshing a volume, all extra snapshots (those which exist on the target but
-	// not on the source) are removed. Therefore, the last entry in targetSnapshots represents the
-	// most recent identical snapshot of the source volume and target volume.
-	lastIdenticalSnapshot := targetSnapshots[len(targetSnapshots)-1]
-
-	for i, snap := range srcSnapshots {
-		var srcSnap Volume
-
-		if i == 0 {
-			srcSnap, err = srcVol.NewSnapshot(lastIdenticalSnapshot)
-			if err != nil {
-				return fmt.Errorf("Failed to create new snapshot volume: %w", err)
-			}
-		} else {
-			srcSnap = srcSnapshots[i-1]
-		}
+	err = createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
+	if err != nil {
+		return err
+	}
 
-		err = transfer(snap, vol, srcSnap)
+	// Each snapshot is sent as a differential of the previous one.
+	for i := range srcSnapshots {
+		err = transfer(srcSnapshots[i], vol, origin)
 		if err != nil {
 			return err
 		}
+
+		origin = &srcSnapshots[i]
 	}
 
 	// Create temporary snapshot of the source volume.
@@ -843,12 +1291,7 @@ func (d *btrfs) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume,
 	}
 
 	// Transfer temporary snapshot to target; this creates a new snapshot for target.
-	parentSnap, err := srcVol.NewSnapshot(srcSnapshotsAll[len(srcSnapshotsAll)-1])
-	if err != nil {
-		return err
-	}
-
-	err = transfer(srcSnap, vol, parentSnap)
+	err = transfer(srcSnap, vol, origin)
 	if err != nil {
 		return err
 	}
@@ -858,6 +1301,7 @@ func (d *btrfs) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume,
 		return err
 	}
 
+	// Discard the target volume along with any changes made to it since it was last in sync.
 	err = d.deleteSubvolume(vol.MountPath(), false)
 	if err != nil {
 		return err
@@ -898,21 +1342,20 @@ func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
 		return fmt.Errorf("Cannot remove a volume that has snapshots")
 	}
 
-	// If the volume doesn't exist, then nothing more to do.
-	volPath := GetVolumeMountPath(d.name, vol.volType, vol.name)
-	if !shared.PathExists(volPath) {
-		return nil
+	err = d.deleteVolumeSubvolume(vol, op)
+	if err != nil {
+		return err
 	}
 
-	// Delete the volume (and any subvolumes).
-	err = d.deleteSubvolume(volPath, true)
+	// Delete the snapshots of paths within the volume.
+	err = d.deletePathSnapshots(vol)
 	if err != nil {
 		return err
 	}
 
 	// Although the volume snapshot directory should already be removed, lets remove it here
 	// to just in case the top-level directory is left.
-	err = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, vol.name)
+	err = d.deleteSnapshotsDirIfEmpty(vol.volType, vol.name)
 	if err != nil {
 		return err
 	}
@@ -920,18 +1363,96 @@ func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
 	return nil
 }
 
+// DeleteVolumeWithoutSnapshots deletes a volume which has no snapshots, skipping the listing of its snapshots and
+// the cleanup of its snapshot directories done by DeleteVolume. Returns ErrNotSupported if the volume has a
+// snapshot directory, in which case DeleteVolume must be used.
+func (d *btrfs) DeleteVolumeWithoutSnapshots(vol Volume, op *operations.Operation) error {
+	if shared.PathExists(getVolumeSnapshotDir(d.name, d.config, vol.volType, vol.name)) || shared.PathExists(btrfsPathSnapshotsPath(d.name, d.config, vol.volType, vol.name)) {
+		return ErrNotSupported
+	}
+
+	return d.deleteVolumeSubvolume(vol, op)
+}
+
+// deleteVolumeSubvolume deletes the subvolume of the volume (and any subvolumes below it) unless it is in use.
+func (d *btrfs) deleteVolumeSubvolume(vol Volume, op *operations.Operation) error {
+	// If the volume doesn't exist, then nothing more to do.
+	volPath := getVolumeMountPath(d.name, d.config, vol.volType, vol.name)
+	exists, _, err := d.volumeExists(vol)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	err = d.leaseVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to delete a subvolume which is still mounted, such as the root of an instance which is running.
+	mounts, err := PoolActiveMounts(d.name)
+	if err != nil {
+		return err
+	}
+
+	err = CheckVolumeNotInUse(volPath, false, mounts)
+	if err != nil {
+		return err
+	}
+
+	// Make sure there is enough metadata space for the deletion to succeed.
+	d.ensureMetadataSpace()
+
+	// Delete the volume (and any subvolumes).
+	return d.deleteSubvolumeProgress(volPath, true, btrfsDeleteProgress(op))
+}
+
 // HasVolume indicates whether a specific volume exists on the storage pool.
 func (d *btrfs) HasVolume(vol Volume) bool {
 	return genericVFSHasVolume(vol)
 }
 
+// volumeExists returns whether the volume exists on the pool and whether it is a subvolume, with a single lstat.
+func (d *btrfs) volumeExists(vol Volume) (bool, bool, error) {
+	// VolumeExists only knows where custom volumes are in the nested layout.
+	if vol.volType == VolumeTypeCustom && poolLayout(d.config) == PoolLayoutNested {
+		projectName, volName, found := strings.Cut(vol.name, "_")
+		if found {
+			return VolumeExists(projectName, d.name, volName)
+		}
+	}
+
+	return btrfsPathStat(filesystem.Lstat, vol.MountPath())
+}
+
 // ValidateVolume validates the supplied volume config.
 func (d *btrfs) ValidateVolume(vol Volume, removeUnknownKeys bool) error {
-	return d.validateVolume(vol, nil, removeUnknownKeys)
+	err := d.validateVolume(vol, d.commonVolumeRules(), removeUnknownKeys)
+	if err != nil {
+		return err
+	}
+
+	return validateVolumeFileFlags(vol)
 }
 
 // UpdateVolume applies config changes to the volume.
 func (d *btrfs) UpdateVolume(vol Volume, changedConfig map[string]string) error {
+	_, overlayChanged := changedConfig["btrfs.overlay"]
+	if overlayChanged {
+		return fmt.Errorf("The %q option can only be set when creating the volume", "btrfs.overlay")
+	}
+
+	newFileFlags, fileFlagsChanged := changedConfig["btrfs.file_flags"]
+	if fileFlagsChanged {
+		err := d.updateFileFlags(vol, newFileFlags)
+		if err != nil {
+			return err
+		}
+	}
+
 	newSize, sizeChanged := changedConfig["size"]
 	if sizeChanged {
 		err := d.SetVolumeQuota(vol, newSize, false, nil)
@@ -943,30 +1464,57 @@ func (d *btrfs) UpdateVolume(vol Volume, changedConfig map[string]string) error
 	return nil
 }
 
-// GetVolumeUsage returns the disk space used by the volume.
-func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
-	// Attempt to get the qgroup information.
-	_, usage, err := d.getQGroup(vol.MountPath())
+// GetVolumeUsage returns the disk space used by the volume.
+func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
+	// Attempt to get the qgroup information.
+	_, usage, err := d.getQGroup(vol.MountPath())
+	if err != nil {
+		if err == errBtrfsNoQuota {
+			return -1, ErrNotSupported
+		}
+
+		return -1, err
+	}
+
+	return usage, nil
+}
+
+// GetVolumeGeneration returns the generation of the volume's subvolume, which increases whenever it changes.
+func (d *btrfs) GetVolumeGeneration(vol Volume) (uint64, error) {
+	return btrfsSubVolumeGeneration(vol.MountPath())
+}
+
+// GetVolumeSnapshotUsage returns the disk space a snapshot shares with other subvolumes and uniquely owns.
+// Returns ErrNotSupported if quotas are disabled on the pool as the qgroup values are then unavailable.
+func (d *btrfs) GetVolumeSnapshotUsage(snapVol Volume) (*api.StorageVolumeSnapshotUsage, error) {
+	referenced, exclusive, err := btrfsSubVolumeQGroupUsage(snapVol.MountPath())
 	if err != nil {
 		if err == errBtrfsNoQuota {
-			return -1, ErrNotSupported
+			return nil, ErrNotSupported
 		}
 
-		return -1, err
+		return nil, err
 	}
 
-	return usage, nil
+	return btrfsSnapshotUsage(referenced, exclusive), nil
 }
 
 // SetVolumeQuota applies a size limit on volume.
 // Does nothing if supplied with an empty/zero size for block volumes, and for filesystem volumes removes quota.
 func (d *btrfs) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "set_quota")
+
 	// Convert to bytes.
 	sizeBytes, err := units.ParseByteSizeString(size)
 	if err != nil {
 		return err
 	}
 
+	err = d.leaseVolume(vol)
+	if err != nil {
+		return err
+	}
+
 	// For VM block files, resize the file if needed.
 	if vol.contentType == ContentTypeBlock {
 		// Do nothing if size isn't specified.
@@ -1022,40 +1570,22 @@ func (d *btrfs) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool,
 				return err
 			}
 
+			// Enabling quotas starts a rescan, which is followed in the background as it can take a while
+			// on large pools and the qgroups are usable meanwhile.
+			go func() {
+				err := d.quotaRescan(op)
+				if err != nil {
+					d.logger.Warn("Failed rescanning quotas", logger.Ctx{"err": err})
+				}
+			}()
+
 			// Try again.
 			qgroup, _, err = d.getQGroup(volPath)
 		}
 
 		// If there's no qgroup, attempt to create one.
 		if err == errBtrfsNoQGroup {
-			// Find the volume ID.
-			var output string
-			output, err = shared.RunCommand("btrfs", "subvolume", "show", volPath)
-			if err != nil {
-				return fmt.Errorf("Failed to get subvol information: %w", err)
-			}
-
-			id := ""
-			for _, line := range strings.Split(output, "\n") {
-				line = strings.TrimSpace(line)
-				if strings.HasPrefix(line, "Subvolume ID:") {
-					fields := strings.Split(line, ":")
-					id = strings.TrimSpace(fields[len(fields)-1])
-				}
-			}
-
-			if id == "" {
-				return fmt.Errorf("Failed to find subvolume id for %q", volPath)
-			}
-
-			// Create a qgroup.
-			_, err = shared.RunCommand("btrfs", "qgroup", "create", fmt.Sprintf("0/%s", id), volPath)
-			if err != nil {
-				return err
-			}
-
-			// Try to get the qgroup again.
-			qgroup, _, err = d.getQGroup(volPath)
+			qgroup, err = d.createQGroup(volPath)
 		}
 
 		if err != nil {
@@ -1075,7 +1605,7 @@ func (d *btrfs) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool,
 
 			// Add that to the requested filesystem size (to ignore it from the quota).
 			sizeBytes += blockSize
-			d.logger.Debug("Accounting for VM image file size", logger.Ctx{"sizeBytes": sizeBytes})
+			l.Debug("Accounting for VM image file size", logger.Ctx{"sizeBytes": sizeBytes})
 		}
 
 		// Apply the limit to referenced data in qgroup.
@@ -1129,28 +1659,67 @@ func (d *btrfs) MountVolume(vol Volume, op *operations.Operation) error {
 		}
 	}
 
+	// Mount the writable overlay of containers created with "btrfs.overlay" on their rootfs.
+	if vol.volType == VolumeTypeContainer && btrfsIsOverlayVolume(vol.MountPath()) {
+		_, err := btrfsMountOverlay(vol.MountPath())
+		if err != nil {
+			return err
+		}
+	}
+
 	vol.MountRefCountIncrement() // From here on it is up to caller to call UnmountVolume() when done.
 	return nil
 }
 
 // UnmountVolume simulates unmounting a volume.
-// As driver doesn't have volumes to unmount it returns false indicating the volume was already unmounted.
+// As driver doesn't have volumes to unmount it returns false indicating the volume was already unmounted, except
+// for the containers whose rootfs is an overlay.
 func (d *btrfs) UnmountVolume(vol Volume, keepBlockDev bool, op *operations.Operation) (bool, error) {
+	l := d.opLogger(op, vol.name, "unmount")
+
 	unlock := vol.MountLock()
 	defer unlock()
 
 	refCount := vol.MountRefCountDecrement()
 	if refCount > 0 {
-		d.logger.Debug("Skipping unmount as in use", logger.Ctx{"volName": vol.name, "refCount": refCount})
+		l.Debug("Skipping unmount as in use", logger.Ctx{"refCount": refCount})
 		return false, ErrInUse
 	}
 
+	if vol.volType == VolumeTypeContainer && btrfsIsOverlayVolume(vol.MountPath()) {
+		return btrfsUnmountOverlay(vol.MountPath())
+	}
+
 	return false, nil
 }
 
 // RenameVolume renames a volume and its snapshots.
 func (d *btrfs) RenameVolume(vol Volume, newVolName string, op *operations.Operation) error {
-	return genericVFSRenameVolume(d, vol, newVolName, op)
+	err := d.checkNoProtectionFileFlags(vol, "renamed")
+	if err != nil {
+		return err
+	}
+
+	err = d.leaseVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	err = genericVFSRenameVolume(d, vol, newVolName, op)
+	if err != nil {
+		return err
+	}
+
+	// Move the snapshots of paths within the volume along with it.
+	pathSnapshotsPath := btrfsPathSnapshotsPath(d.name, d.config, vol.volType, vol.name)
+	if shared.PathExists(pathSnapshotsPath) {
+		err = os.Rename(pathSnapshotsPath, btrfsPathSnapshotsPath(d.name, d.config, vol.volType, newVolName))
+		if err != nil {
+			return fmt.Errorf("Failed renaming path snapshots of volume %q: %w", vol.name, err)
+		}
+	}
+
+	return nil
 }
 
 // readonlySnapshot creates a readonly snapshot.
@@ -1177,7 +1746,7 @@ func (d *btrfs) readonlySnapshot(vol Volume) (string, revert.Hook, error) {
 
 	mountPath := filepath.Join(tmpDir, vol.name)
 
-	err = d.snapshotSubvolume(sourcePath, mountPath, true)
+	err = d.snapshotSubvolume(sourcePath, mountPath, true, nil)
 	if err != nil {
 		return "", nil, err
 	}
@@ -1200,6 +1769,13 @@ func (d *btrfs) readonlySnapshot(vol Volume) (string, revert.Hook, error) {
 
 // MigrateVolume sends a volume for migration.
 func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "send_migration")
+
+	err := btrfsCheckNotOverlay(vol.MountPath(), "migrate")
+	if err != nil {
+		return err
+	}
+
 	// Handle simple rsync and block_and_rsync through generic.
 	if volSrcArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volSrcArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
 		// If volume is filesystem type and is not already a snapshot, create a fast snapshot to ensure migration is consistent.
@@ -1228,7 +1804,6 @@ func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *m
 	}
 
 	var snapshots []string
-	var err error
 
 	if !volSrcArgs.VolumeOnly {
 		// Generate restoration header, containing info on the subvolumes and how they should be restored.
@@ -1253,6 +1828,17 @@ func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *m
 		}
 	}
 
+	// Resume an interrupted migration after the last snapshot the target kept from it, sending the following
+	// snapshots as differentials of it. This relies on the subvolume UUIDs of the header to identify it.
+	if !volSrcArgs.Refresh && volSrcArgs.ResumeReceivedUUID != "" && shared.StringInSlice(migration.BTRFSFeatureMigrationHeader, volSrcArgs.MigrationType.Features) {
+		resumeFrom, remaining := btrfsResumeSnapshots(migrationHeader.Subvolumes, volSrcArgs.Snapshots, volSrcArgs.ResumeReceivedUUID)
+		if resumeFrom != "" {
+			l.Info("Resuming interrupted migration", logger.Ctx{"snapshot": resumeFrom})
+			migrationHeader.ResumeFrom = resumeFrom
+			volSrcArgs.Snapshots = remaining
+		}
+	}
+
 	// Send metadata migration header frame with subvolume info if we have negotiated that feature.
 	if shared.StringInSlice(migration.BTRFSFeatureMigrationHeader, volSrcArgs.MigrationType.Features) {
 		headerJSON, err := json.Marshal(migrationHeader)
@@ -1270,7 +1856,7 @@ func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *m
 			return fmt.Errorf("Failed closing BTRFS migration header frame: %w", err)
 		}
 
-		d.logger.Debug("Sent migration meta data header", logger.Ctx{"name": vol.name})
+		l.Debug("Sent migration meta data header")
 	}
 
 	if volSrcArgs.Refresh && shared.StringInSlice(migration.BTRFSFeatureSubvolumeUUIDs, volSrcArgs.MigrationType.Features) {
@@ -1286,7 +1872,7 @@ func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *m
 			return fmt.Errorf("Failed decoding BTRFS migration header: %w", err)
 		}
 
-		d.logger.Debug("Received BTRFS migration meta data header", logger.Ctx{"name": vol.name})
+		l.Debug("Received BTRFS migration meta data header")
 
 		volSrcArgs.Snapshots = []string{}
 
@@ -1298,12 +1884,16 @@ func (d *btrfs) MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *m
 		}
 	}
 
-	return d.migrateVolumeOptimized(vol, conn, volSrcArgs, migrationHeader.Subvolumes, op)
+	return d.migrateVolumeOptimized(vol, conn, volSrcArgs, migrationHeader.Subvolumes, migrationHeader.ResumeFrom, op)
 }
 
-func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, subvolumes []BTRFSSubVolume, op *operations.Operation) error {
+// migrateVolumeOptimized sends the subvolumes of the volume and of its snapshots. If resumeFrom isn't empty, the
+// target already has that snapshot and the ones before it, and the first snapshot sent is a differential of it.
+func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, subvolumes []BTRFSSubVolume, resumeFrom string, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "send_migration")
+
 	// sendVolume sends a volume and its subvolumes (if negotiated subvolumes feature) to recipient.
-	sendVolume := func(v Volume, sourcePrefix string, parentPrefix string) error {
+	sendVolume := func(v Volume, sourcePrefix string, parent *Volume) error {
 		snapName := "" // Default to empty (sending main volume) from migrationHeader.Subvolumes.
 
 		// Detect if we are sending a snapshot by comparing to main volume name.
@@ -1320,6 +1910,14 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 
 		sentVols := 0
 
+		// Prevent the parent from being removed while it is used for the differential.
+		parentPrefix := ""
+		if parent != nil {
+			parentPrefix = parent.MountPath()
+			parent.SendParentRefCountIncrement()
+			defer parent.SendParentRefCountDecrement()
+		}
+
 		// Send volume (and any subvolumes if supported) to target.
 		for _, subVolume := range subvolumes {
 			if subVolume.Snapshot != snapName {
@@ -1357,8 +1955,8 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 				defer func() { _ = d.setSubvolumeReadonlyProperty(sourcePath, false) }()
 			}
 
-			d.logger.Debug("Sending subvolume", logger.Ctx{"name": v.name, "source": sourcePath, "parent": parentPath, "path": subVolume.Path})
-			err := d.sendSubvolume(sourcePath, parentPath, conn, wrapper)
+			l.Debug("Sending subvolume", logger.Ctx{"name": v.name, "source": sourcePath, "parent": parentPath, "path": subVolume.Path})
+			err := d.sendSubvolume(sourcePath, parentPath, conn, wrapper, volSrcArgs.RateLimiter, l)
 			if err != nil {
 				return fmt.Errorf("Failed sending volume %v:%s: %w", v.name, subVolume.Path, err)
 			}
@@ -1375,9 +1973,12 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 	}
 
 	// Transfer the snapshots (and any subvolumes if supported) to target first.
-	lastVolPath := "" // Used as parent for differential transfers.
+	var lastVol *Volume // Used as parent for differential transfers.
 
-	if volSrcArgs.Refresh && !volSrcArgs.VolumeOnly {
+	if resumeFrom != "" {
+		resumeVol, _ := vol.NewSnapshot(resumeFrom)
+		lastVol = &resumeVol
+	} else if volSrcArgs.Refresh && !volSrcArgs.VolumeOnly {
 		snapshots, err := vol.Snapshots(op)
 		if err != nil {
 			return err
@@ -1391,7 +1992,7 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 			_, snapName, _ := api.GetParentAndSnapshotName(snap.name)
 
 			if len(volSrcArgs.Snapshots) > 0 && snapName == volSrcArgs.Snapshots[0] {
-				lastVolPath = snapshots[i-1].MountPath()
+				lastVol = &snapshots[i-1]
 				break
 			}
 		}
@@ -1400,17 +2001,17 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 	if !volSrcArgs.VolumeOnly {
 		for _, snapName := range volSrcArgs.Snapshots {
 			snapVol, _ := vol.NewSnapshot(snapName)
-			err := sendVolume(snapVol, snapVol.MountPath(), lastVolPath)
+			err := sendVolume(snapVol, snapVol.MountPath(), lastVol)
 			if err != nil {
 				return err
 			}
 
-			lastVolPath = snapVol.MountPath()
+			lastVol = &snapVol
 		}
 	}
 
 	// Get instances directory (e.g. /var/lib/lxd/storage-pools/btrfs/containers).
-	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	instancesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
 
 	// Create a temporary directory which will act as the parent directory of the read-only snapshot.
 	tmpVolumesMountPoint, err := os.MkdirTemp(instancesPath, "migration.")
@@ -1427,7 +2028,7 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 
 	// Make recursive read-only snapshot of the subvolume as writable subvolumes cannot be sent.
 	migrationSendSnapshotPrefix := filepath.Join(tmpVolumesMountPoint, ".migration-send")
-	err = d.snapshotSubvolume(vol.MountPath(), migrationSendSnapshotPrefix, true)
+	err = d.snapshotSubvolume(vol.MountPath(), migrationSendSnapshotPrefix, true, nil)
 	if err != nil {
 		return err
 	}
@@ -1435,12 +2036,19 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 	defer func() { _ = d.deleteSubvolume(migrationSendSnapshotPrefix, true) }()
 
 	// Send main volume (and any subvolumes if supported) to target.
-	return sendVolume(vol, migrationSendSnapshotPrefix, lastVolPath)
+	return sendVolume(vol, migrationSendSnapshotPrefix, lastVol)
 }
 
 // BackupVolume copies a volume (and optionally its snapshots) to a specified target path.
 // This driver does not support optimized backups.
 func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots []string, op *operations.Operation) error {
+	l := d.opLogger(op, vol.name, "backup")
+
+	err := btrfsCheckNotOverlay(vol.MountPath(), "back up")
+	if err != nil {
+		return err
+	}
+
 	// Handle the non-optimized tarballs through the generic packer.
 	if !optimized {
 		// Because the generic backup method will not take a consistent backup if files are being modified
@@ -1510,7 +2118,11 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 		args = append(args, path)
 
 		// Create temporary file to store output of btrfs send.
-		backupsPath := shared.VarPath("backups")
+		backupsPath, err := vol.TempDir(shared.VarPath("backups"), "")
+		if err != nil {
+			return err
+		}
+
 		tmpFile, err := os.CreateTemp(backupsPath, fmt.Sprintf("%s_btrfs", backup.WorkingDirPrefix))
 		if err != nil {
 			return fmt.Errorf("Failed to open temporary file for BTRFS backup: %w", err)
@@ -1520,7 +2132,7 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 		defer func() { _ = os.Remove(tmpFile.Name()) }()
 
 		// Write the subvolume to the file.
-		d.logger.Debug("Generating optimized volume file", logger.Ctx{"sourcePath": path, "parent": parent, "file": tmpFile.Name(), "name": fileName})
+		l.Debug("Generating optimized volume file", logger.Ctx{"sourcePath": path, "parent": parent, "file": tmpFile.Name(), "name": fileName})
 		err = shared.RunCommandWithFds(context.TODO(), nil, tmpFile, "btrfs", args...)
 		if err != nil {
 			return err
@@ -1541,7 +2153,7 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 	}
 
 	// addVolume adds a volume and its subvolumes to backup file.
-	addVolume := func(v Volume, sourcePrefix string, parentPrefix string, fileNamePrefix string) error {
+	addVolume := func(v Volume, sourcePrefix string, parent *Volume, fileNamePrefix string) error {
 		snapName := "" // Default to empty (sending main volume) from migrationHeader.Subvolumes.
 
 		// Detect if we are adding a snapshot by comparing to main volume name.
@@ -1552,6 +2164,14 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 
 		sentVols := 0
 
+		// Prevent the parent from being removed while it is used for the differential.
+		parentPrefix := ""
+		if parent != nil {
+			parentPrefix = parent.MountPath()
+			parent.SendParentRefCountIncrement()
+			defer parent.SendParentRefCountDecrement()
+		}
+
 		// Add volume (and any subvolumes if supported) to backup file.
 		for _, subVolume := range optimizedHeader.Subvolumes {
 			if subVolume.Snapshot != snapName {
@@ -1613,7 +2233,7 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 	}
 
 	// Backup snapshots if populated.
-	lastVolPath := "" // Used as parent for differential exports.
+	var lastVol *Volume // Used as parent for differential exports.
 	for _, snapName := range snapshots {
 		snapVol, _ := vol.NewSnapshot(snapName)
 
@@ -1630,17 +2250,17 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 		}
 
 		fileNamePrefix := filepath.Join(snapDir, fileName)
-		err := addVolume(snapVol, snapVol.MountPath(), lastVolPath, fileNamePrefix)
+		err := addVolume(snapVol, snapVol.MountPath(), lastVol, fileNamePrefix)
 		if err != nil {
 			return err
 		}
 
-		lastVolPath = snapVol.MountPath()
+		lastVol = &snapVol
 	}
 
 	// Make a temporary copy of the instance.
 	sourceVolume := vol.MountPath()
-	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	instancesPath := getVolumeMountPath(d.name, d.config, vol.volType, "")
 
 	tmpInstanceMntPoint, err := os.MkdirTemp(instancesPath, "backup.")
 	if err != nil {
@@ -1656,7 +2276,7 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 
 	// Create the read-only snapshot.
 	targetVolume := fmt.Sprintf("%s/.backup", tmpInstanceMntPoint)
-	err = d.snapshotSubvolume(sourceVolume, targetVolume, true)
+	err = d.snapshotSubvolume(sourceVolume, targetVolume, true, nil)
 	if err != nil {
 		return err
 	}
@@ -1680,7 +2300,7 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 		fileNamePrefix = "volume"
 	}
 
-	err = addVolume(vol, targetVolume, lastVolPath, fileNamePrefix)
+	err = addVolume(vol, targetVolume, lastVol, fileNamePrefix)
 	if err != nil {
 		return err
 	}
@@ -1697,58 +2317,110 @@ func (d *btrfs) BackupVolume(vol Volume, tarWriter *instancewriter.InstanceTarWr
 // CreateVolumeSnapshot creates a snapshot of a volume.
 func (d *btrfs) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
 	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
-	srcPath := GetVolumeMountPath(d.name, snapVol.volType, parentName)
+	srcPath := getVolumeMountPath(d.name, d.config, snapVol.volType, parentName)
 	snapPath := snapVol.MountPath()
 
-	// Create the parent directory.
-	err := createParentSnapshotDirIfMissing(d.name, snapVol.volType, parentName)
+	err := btrfsCheckNotOverlay(srcPath, "snapshot")
 	if err != nil {
 		return err
 	}
 
-	err = d.snapshotSubvolume(srcPath, snapPath, true)
+	err = d.leaseVolume(snapVol)
 	if err != nil {
 		return err
 	}
 
-	err = d.setSubvolumeReadonlyProperty(snapPath, true)
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Create the parent directory.
+	snapshotsQGroup, err := d.createSnapshotsDir(snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
 
-	// Set any subvolumes that were readonly in the source also readonly in the snapshot.
-	srcVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
-	subVols, err := d.getSubvolumesMetaData(srcVol)
+	revert.Add(func() { _ = d.deleteSnapshotsDirIfEmpty(snapVol.volType, parentName) })
+
+	// Sync the filesystem as requested by the volume.
+	syncLevel := snapVol.ExpandedConfig("btrfs.snapshot_sync")
+	poolPath := GetPoolMountPath(d.name)
+	err = btrfsHostSyncOps.beforeSnapshot(syncLevel, poolPath)
 	if err != nil {
 		return err
 	}
 
-	for _, subVol := range subVols {
-		if subVol.Readonly {
-			err = d.setSubvolumeReadonlyProperty(filepath.Join(snapPath, subVol.Path), true)
-			if err != nil {
-				return err
+	// Remove the snapshot again if any step following its creation fails.
+	tx := btrfsSnapshotTx{
+		path:    snapPath,
+		create:  func(path string) error { return d.snapshotSubvolumeInQGroup(srcPath, path, true, nil, snapshotsQGroup) },
+		delete:  func(path string) error { return d.deleteSubvolume(path, true) },
+		matches: func(path string) (bool, error) { return btrfsIsCurrentSnapshotOf(path, srcPath) },
+	}
+
+	err = tx.run(func() error {
+		return d.setSubvolumeReadonlyProperty(snapPath, true)
+	}, func() error {
+		// Set any subvolumes that were readonly in the source also readonly in the snapshot.
+		srcVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
+		subVols, err := d.getSubvolumesMetaData(srcVol)
+		if err != nil {
+			return err
+		}
+
+		for _, subVol := range subVols {
+			if subVol.Readonly {
+				err = d.setSubvolumeReadonlyProperty(filepath.Join(snapPath, subVol.Path), true)
+				if err != nil {
+					return err
+				}
 			}
 		}
+
+		return nil
+	}, func() error {
+		// Committed last so that a snapshot which can't be made durable is removed.
+		return btrfsHostSyncOps.afterSnapshot(syncLevel, poolPath)
+	})
+	if err != nil {
+		return err
 	}
 
+	revert.Success()
 	return nil
 }
 
 // DeleteVolumeSnapshot removes a snapshot from the storage device. The volName and snapshotName
 // must be bare names and should not be in the format "volume/snapshot".
 func (d *btrfs) DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
+	return d.deleteVolumeSnapshot(snapVol, false, op)
+}
+
+// deleteVolumeSnapshot removes a snapshot from the storage device.
+// Unless force is true, snapshots in use as the parent of an incremental send are not removed.
+func (d *btrfs) deleteVolumeSnapshot(snapVol Volume, force bool, op *operations.Operation) error {
+	if !force && snapVol.SendParentInUse() {
+		return fmt.Errorf("Cannot remove snapshot %q: %w", snapVol.name, ErrSendParentInUse)
+	}
+
+	err := d.leaseVolume(snapVol)
+	if err != nil {
+		return err
+	}
+
 	snapPath := snapVol.MountPath()
 
+	// Make sure there is enough metadata space for the deletion to succeed.
+	d.ensureMetadataSpace()
+
 	// Delete the snapshot.
-	err := d.deleteSubvolume(snapPath, true)
+	err = d.deleteSubvolumeProgress(snapPath, true, btrfsDeleteProgress(op))
 	if err != nil {
 		return err
 	}
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
 	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
-	err = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	err = d.deleteSnapshotsDirIfEmpty(snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -1763,6 +2435,9 @@ func (d *btrfs) MountVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 
 	snapPath := snapVol.MountPath()
 
+	// Check whether the snapshot is accessible before its mount path gets created.
+	method := btrfsSnapshotMountMethod(snapPath, btrfsIsSubVolume)
+
 	// Don't attempt to modify the permission of an existing custom volume root.
 	// A user inside the instance may have modified this and we don't want to reset it on restart.
 	if !shared.PathExists(snapPath) || snapVol.volType != VolumeTypeCustom {
@@ -1772,7 +2447,13 @@ func (d *btrfs) MountVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 		}
 	}
 
-	_, err := mountReadOnly(snapPath, snapPath)
+	var err error
+	if method == btrfsSnapshotMountBind {
+		_, err = mountReadOnlyFlags(snapPath, snapPath, d.getSnapshotMountFlags())
+	} else {
+		err = d.mountSnapshotBySubvolID(snapPath)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -1781,19 +2462,74 @@ func (d *btrfs) MountVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 	return nil
 }
 
+// mountSnapshotBySubvolID mounts the snapshot subvolume which should be at snapPath read-only from the pool's
+// device by its ID. This is used when the snapshot isn't accessible through an existing mount of the pool.
+func (d *btrfs) mountSnapshotBySubvolID(snapPath string) error {
+	if filesystem.IsMountPoint(snapPath) {
+		return nil
+	}
+
+	poolMount := GetPoolMountPath(d.name)
+
+	relPath, err := relPathUnder(poolMount, snapPath)
+	if err != nil {
+		return err
+	}
+
+	subvols, err := btrfsListSubvolumes(runBtrfsCommand, poolMount)
+	if err != nil {
+		return err
+	}
+
+	poolSubvolPath, err := btrfsPoolSubvolumePath(runBtrfsCommand, poolMount, subvols)
+	if err != nil {
+		return err
+	}
+
+	id, err := btrfsFindSubvolumeID(subvols, poolSubvolPath, relPath)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := PoolActiveMounts(d.name)
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		if mount.Target == poolMount && mount.FSType == "btrfs" {
+			return TryMount(mount.Source, snapPath, "btrfs", d.getSnapshotMountFlags(), fmt.Sprintf("subvolid=%s", id))
+		}
+	}
+
+	return fmt.Errorf("Failed finding the device of storage pool %q to mount %q", d.name, snapPath)
+}
+
 // UnmountVolumeSnapshot removes the read-only mount placed on top of a snapshot.
 func (d *btrfs) UnmountVolumeSnapshot(snapVol Volume, op *operations.Operation) (bool, error) {
+	l := d.opLogger(op, snapVol.name, "unmount")
+
 	unlock := snapVol.MountLock()
 	defer unlock()
 
 	refCount := snapVol.MountRefCountDecrement()
 	if refCount > 0 {
-		d.logger.Debug("Skipping unmount as in use", logger.Ctx{"volName": snapVol.name, "refCount": refCount})
+		l.Debug("Skipping unmount as in use", logger.Ctx{"refCount": refCount})
 		return false, ErrInUse
 	}
 
 	snapPath := snapVol.MountPath()
-	return forceUnmount(snapPath)
+	ourUnmount, err := forceUnmount(snapPath)
+	if err != nil {
+		return false, err
+	}
+
+	// Remove the empty mount path created for a mount by ID, as the snapshot isn't actually there.
+	if btrfsSnapshotMountMethod(snapPath, btrfsIsSubVolume) == btrfsSnapshotMountSubvolID {
+		_ = os.Remove(snapPath)
+	}
+
+	return ourUnmount, nil
 }
 
 // VolumeSnapshots returns a list of snapshots for the volume (in no particular order).
@@ -1806,14 +2542,18 @@ func (d *btrfs) VolumeSnapshots(vol Volume, op *operations.Operation) ([]string,
 func (d *btrfs) volumeSnapshotsSorted(vol Volume, op *operations.Operation) ([]string, error) {
 	stdout := bytes.Buffer{}
 
-	err := shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", GetPoolMountPath(vol.pool))
+	err := shared.RunCommandWithFds(context.TODO(), nil, &stdout, "btrfs", "subvolume", "list", d.PoolAbsPath(""))
 	if err != nil {
 		return nil, err
 	}
 
 	var snapshotNames []string
 
-	snapshotPrefix := fmt.Sprintf("%s-snapshots/%s/", vol.volType, vol.name)
+	snapshotPrefix, err := d.snapshotsListPrefix(vol)
+	if err != nil {
+		return nil, err
+	}
+
 	scanner := bufio.NewScanner(&stdout)
 
 	for scanner.Scan() {
@@ -1838,8 +2578,47 @@ func (d *btrfs) volumeSnapshotsSorted(vol Volume, op *operations.Operation) ([]s
 	return snapshotNames, nil
 }
 
+// VolumeSnapshotsInfo returns the on-disk metadata of the volume's snapshots in creation order. All of them are
+// listed with a single btrfs call rather than one per snapshot.
+func (d *btrfs) VolumeSnapshotsInfo(vol Volume, op *operations.Operation) ([]VolumeSnapshotInfo, error) {
+	snapshotPrefix, err := d.snapshotsListPrefix(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	return btrfsListSnapshotsInfo(runBtrfsCommand, GetPoolMountPath(d.name), snapshotPrefix)
+}
+
+// VolumeSnapshotsCreationTime returns the creation time of each of the supplied snapshots of the volume, read
+// from the metadata of their subvolume. It is zero for the subvolumes which don't record it.
+func (d *btrfs) VolumeSnapshotsCreationTime(vol Volume, snapshots []string) (map[string]time.Time, error) {
+	creationTimes := make(map[string]time.Time, len(snapshots))
+	for _, snapName := range snapshots {
+		snapPath := getVolumeMountPath(d.name, d.config, vol.volType, GetSnapshotVolumeName(vol.name, snapName))
+
+		creationTime, err := btrfsSubVolumeCreationTime(runBtrfsCommand, snapPath)
+		if err != nil {
+			return nil, err
+		}
+
+		creationTimes[snapName] = creationTime
+	}
+
+	return creationTimes, nil
+}
+
 // RestoreVolume restores a volume from a snapshot.
 func (d *btrfs) RestoreVolume(vol Volume, snapshotName string, op *operations.Operation) error {
+	err := d.checkNoProtectionFileFlags(vol, "restored")
+	if err != nil {
+		return err
+	}
+
+	err = d.leaseVolume(vol)
+	if err != nil {
+		return err
+	}
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -1863,7 +2642,7 @@ func (d *btrfs) RestoreVolume(vol Volume, snapshotName string, op *operations.Op
 	revert.Add(func() { _ = os.Rename(backupSubvolume, target) })
 
 	// Restore the snapshot.
-	err = d.snapshotSubvolume(srcVol.MountPath(), target, true)
+	err = d.snapshotSubvolume(srcVol.MountPath(), target, true, nil)
 	if err != nil {
 		return err
 	}
@@ -1884,6 +2663,12 @@ func (d *btrfs) RestoreVolume(vol Volume, snapshotName string, op *operations.Op
 		}
 	}
 
+	// The restored subvolume carries the lease recorded in the snapshot, take it over.
+	err = d.leaseVolume(vol)
+	if err != nil {
+		return err
+	}
+
 	revert.Success()
 
 	// Remove the backup subvolume.
@@ -1892,5 +2677,134 @@ func (d *btrfs) RestoreVolume(vol Volume, snapshotName string, op *operations.Op
 
 // RenameVolumeSnapshot renames a volume snapshot.
 func (d *btrfs) RenameVolumeSnapshot(snapVol Volume, newSnapshotName string, op *operations.Operation) error {
+	err := d.checkNoProtectionFileFlags(snapVol, "renamed")
+	if err != nil {
+		return err
+	}
+
+	err = d.leaseVolume(snapVol)
+	if err != nil {
+		return err
+	}
+
 	return genericVFSRenameVolumeSnapshot(d, snapVol, newSnapshotName, op)
 }
+
+// SetVolumeBaseImage records the fingerprint of the image the volume was created from as an extended attribute of
+// its subvolume, so that it survives a send and receive of the volume.
+func (d *btrfs) SetVolumeBaseImage(vol Volume, fingerprint string) error {
+	if vol.IsSnapshot() {
+		return fmt.Errorf("Volume cannot be a snapshot")
+	}
+
+	return btrfsWriteBaseImage(vol.MountPath(), fingerprint)
+}
+
+// DiffVolume returns the paths added, modified and deleted in the volume compared to parentVol. If the volume is
+// a snapshot of parentVol, the changes are listed by sending the metadata of a temporary read-only snapshot of the
+// volume relative to parentVol, which only goes through what changed since. Otherwise the volumes are compared
+// file by file.
+func (d *btrfs) DiffVolume(vol Volume, parentVol Volume, volIdmap *idmap.IdmapSet, op *operations.Operation) (*VolumeDiff, error) {
+	if vol.contentType != ContentTypeFS || parentVol.contentType != ContentTypeFS {
+		return nil, fmt.Errorf("Only filesystem volumes can be compared")
+	}
+
+	isSnapshot, err := btrfsIsSnapshotOf(vol.MountPath(), parentVol.MountPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if !isSnapshot {
+		d.logger.Debug("Volume isn't a snapshot of its parent, comparing files", logger.Ctx{"volName": vol.name, "parentName": parentVol.name})
+		return DiffVolumePaths(parentVol.MountPath(), vol.MountPath(), volIdmap)
+	}
+
+	// Only read-only subvolumes can be sent.
+	tmpPath := filepath.Join(GetPoolMountPath(d.name), btrfsTmpDir)
+
+	err = os.MkdirAll(tmpPath, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create directory %q: %w", tmpPath, err)
+	}
+
+	tmpDir, err := os.MkdirTemp(tmpPath, "diff.")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temporary directory under %q: %w", tmpPath, err)
+	}
+
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	snapPath := filepath.Join(tmpDir, ".diff")
+	err = d.snapshotSubvolume(vol.MountPath(), snapPath, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = d.deleteSubvolume(snapPath, false) }()
+
+	err = d.setSubvolumeReadonlyProperty(snapPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return btrfsSendDiff(parentVol.MountPath(), snapPath, volIdmap)
+}
+
+// SnapshotVolumePath creates a read-only snapshot named snapshotName of only the directory at path within the
+// volume. The directory is converted to a subvolume so that it can be snapshotted independently of the rest of
+// the volume. Returns the path of the snapshot.
+func (d *btrfs) SnapshotVolumePath(vol Volume, path string, snapshotName string, op *operations.Operation) (string, error) {
+	l := d.opLogger(op, vol.name, "snapshot_path")
+
+	if vol.contentType != ContentTypeFS {
+		return "", fmt.Errorf("Only filesystem volumes can have paths snapshotted: %w", ErrNotSupported)
+	}
+
+	if snapshotName == "" || strings.Contains(snapshotName, "/") {
+		return "", fmt.Errorf("Invalid snapshot name %q", snapshotName)
+	}
+
+	err := d.leaseVolume(vol)
+	if err != nil {
+		return "", err
+	}
+
+	snapPath := filepath.Join(btrfsPathSnapshotsPath(d.name, d.config, vol.volType, vol.name), snapshotName)
+
+	err = btrfsSnapshotPath(runBtrfsCommand, btrfsIsSubVolume, vol.MountPath(), path, snapPath)
+	if err != nil {
+		return "", err
+	}
+
+	l.Debug("Created path snapshot", logger.Ctx{"path": path, "snapshotPath": snapPath})
+
+	return snapPath, nil
+}
+
+// deletePathSnapshots deletes the snapshots of paths within the volume.
+func (d *btrfs) deletePathSnapshots(vol Volume) error {
+	pathSnapshotsPath := btrfsPathSnapshotsPath(d.name, d.config, vol.volType, vol.name)
+
+	entries, err := os.ReadDir(pathSnapshotsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed listing %q: %w", pathSnapshotsPath, err)
+	}
+
+	for _, entry := range entries {
+		err = d.deleteSubvolume(filepath.Join(pathSnapshotsPath, entry.Name()), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(pathSnapshotsPath)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", pathSnapshotsPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/db/operationtype"
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/lxd/sys"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// Test that snapshots used as incremental send parents cannot be deleted.
+func TestBtrfsDeleteVolumeSnapshotSendParent(t *testing.T) {
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+
+	snapVol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1/snap0", nil, nil)
+
+	snapVol.SendParentRefCountIncrement()
+	snapVol.SendParentRefCountIncrement()
+
+	err := d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrSendParentInUse)
+
+	// Still referenced once.
+	snapVol.SendParentRefCountDecrement()
+	err = d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrSendParentInUse)
+
+	// Once dropped to zero the deletion is attempted (and fails here as there's no subvolume on disk).
+	snapVol.SendParentRefCountDecrement()
+	err = d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.False(t, errors.Is(err, ErrSendParentInUse))
+
+	// Forced deletion ignores the ref counter.
+	snapVol.SendParentRefCountIncrement()
+	defer snapVol.SendParentRefCountDecrement()
+	err = d.deleteVolumeSnapshot(snapVol, true, nil)
+	assert.False(t, errors.Is(err, ErrSendParentInUse))
+}
+
+// Test that snapshots recorded in their config as incremental send parents cannot be deleted.
+func TestBtrfsDeleteVolumeSnapshotSendParentConfig(t *testing.T) {
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+
+	config := map[string]string{SendParentRefCountConfigKey: "2"}
+	snapVol := NewVolume(d, d.name, VolumeTypeCustom, ContentTypeFS, "default_vol1/snap0", config, nil)
+
+	err := d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrSendParentInUse)
+
+	// Still referenced once.
+	config[SendParentRefCountConfigKey] = "1"
+	err = d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrSendParentInUse)
+
+	// An unparsable counter keeps the snapshot protected.
+	config[SendParentRefCountConfigKey] = "invalid"
+	err = d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrSendParentInUse)
+
+	// Once dropped to zero (removing the key) the deletion is attempted.
+	delete(config, SendParentRefCountConfigKey)
+	err = d.DeleteVolumeSnapshot(snapVol, nil)
+	assert.False(t, errors.Is(err, ErrSendParentInUse))
+
+	// Forced deletion ignores the recorded counter.
+	config[SendParentRefCountConfigKey] = "1"
+	err = d.deleteVolumeSnapshot(snapVol, true, nil)
+	assert.False(t, errors.Is(err, ErrSendParentInUse))
+}
+
+// captureLoggerEntry is a log line recorded by captureLogger.
+type captureLoggerEntry struct {
+	msg string
+	ctx logger.Ctx
+}
+
+// captureLogger is a logger.Logger recording the message and fields of each log line.
+type captureLogger struct {
+	ctx     logger.Ctx
+	entries *[]captureLoggerEntry
+}
+
+func (l *captureLogger) log(msg string, args ...logger.Ctx) {
+	ctx := logger.Ctx{}
+	for _, c := range append([]logger.Ctx{l.ctx}, args...) {
+		for k, v := range c {
+			ctx[k] = v
+		}
+	}
+
+	*l.entries = append(*l.entries, captureLoggerEntry{msg: msg, ctx: ctx})
+}
+
+func (l *captureLogger) Panic(msg string, args ...logger.Ctx) { l.log(msg, args...) }
+func (l *captureLogger) Fatal(msg string, args ...logger.Ctx) { l.log(msg, args...) }
+func (l *captureLogger) Error(msg string, args ...logger.Ctx) { l.log(msg, args...) }
+func (l *captureLogger) Warn(msg string, args ...logger.Ctx)  { l.log(msg, args...) }
+func (l *captureLogger) Info(msg string, args ...logger.Ctx)  { l.log(msg, args...) }
+func (l *captureLogger) Debug(msg string, args ...logger.Ctx) { l.log(msg, args...) }
+func (l *captureLogger) Trace(msg string, args ...logger.Ctx) { l.log(msg, args...) }
+
+func (l *captureLogger) AddContext(ctx logger.Ctx) logger.Logger {
+	merged := logger.Ctx{}
+	for _, c := range []logger.Ctx{l.ctx, ctx} {
+		for k, v := range c {
+			merged[k] = v
+		}
+	}
+
+	return &captureLogger{ctx: merged, entries: l.entries}
+}
+
+// Test that the log lines of an action on a volume carry the fields correlating them with the operation.
+func TestBtrfsOperationLogFields(t *testing.T) {
+	entries := []captureLoggerEntry{}
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = &captureLogger{ctx: logger.Ctx{"driver": "btrfs"}, entries: &entries}
+
+	op, err := operations.OperationCreate(nil, "default", operations.OperationClassTask, operationtype.VolumeSnapshotDelete, nil, nil, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	snapVol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1/snap0", nil, nil)
+
+	// Still mounted twice, so only the ref counter is decremented.
+	snapVol.MountRefCountIncrement()
+	snapVol.MountRefCountIncrement()
+	defer snapVol.MountRefCountDecrement()
+
+	_, err = d.UnmountVolumeSnapshot(snapVol, op)
+	assert.ErrorIs(t, err, ErrInUse)
+
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Skipping unmount as in use", entries[0].msg)
+	assert.Equal(t, logger.Ctx{
+		"driver":   "btrfs",
+		"op_id":    op.ID(),
+		"pool":     "testpool",
+		"volume":   "c1/snap0",
+		"action":   "unmount",
+		"refCount": uint(1),
+	}, entries[0].ctx)
+
+	// Without an operation, the other fields are still set.
+	entries = entries[:0]
+	snapVol.MountRefCountIncrement()
+
+	_, err = d.UnmountVolumeSnapshot(snapVol, nil)
+	assert.ErrorIs(t, err, ErrInUse)
+
+	require.Len(t, entries, 1)
+	assert.NotContains(t, entries[0].ctx, "op_id")
+	assert.Equal(t, "c1/snap0", entries[0].ctx["volume"])
+}
+
+// Test that volumes with a snapshot directory are left to DeleteVolume.
+func TestBtrfsDeleteVolumeWithoutSnapshots(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+
+	// A missing volume has nothing to delete.
+	assert.NoError(t, d.DeleteVolumeWithoutSnapshots(vol, nil))
+
+	require.NoError(t, os.MkdirAll(vol.MountPath(), 0711))
+	require.NoError(t, createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name))
+	assert.ErrorIs(t, d.DeleteVolumeWithoutSnapshots(vol, nil), ErrNotSupported)
+	assert.DirExists(t, vol.MountPath())
+
+	require.NoError(t, os.Remove(getVolumeSnapshotDir(d.name, d.config, vol.volType, vol.name)))
+	require.NoError(t, os.MkdirAll(btrfsPathSnapshotsPath(d.name, d.config, vol.volType, vol.name), 0700))
+	assert.ErrorIs(t, d.DeleteVolumeWithoutSnapshots(vol, nil), ErrNotSupported)
+	assert.DirExists(t, vol.MountPath())
+}
+
+// Benchmark deleting volumes without snapshots through DeleteVolume against DeleteVolumeWithoutSnapshots.
+func BenchmarkBtrfsDeleteVolumeWithoutSnapshots(b *testing.B) {
+	lxdDir, err := os.MkdirTemp(btrfsTestDir(b), "delete.")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer func() { _ = os.RemoveAll(lxdDir) }()
+
+	b.Setenv("LXD_DIR", lxdDir)
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	for _, dir := range BaseDirectories[VolumeTypeContainer] {
+		err = os.MkdirAll(filepath.Join(GetPoolMountPath(d.name), dir), 0711)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	deletes := map[string]func(vol Volume, op *operations.Operation) error{
+		"DeleteVolume":                 d.DeleteVolume,
+		"DeleteVolumeWithoutSnapshots": d.DeleteVolumeWithoutSnapshots,
+	}
+
+	for _, name := range []string{"DeleteVolume", "DeleteVolumeWithoutSnapshots"} {
+		deleteVolume := deletes[name]
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, fmt.Sprintf("%s%d", name, i), nil, nil)
+				_, err := shared.RunCommand("btrfs", "subvolume", "create", vol.MountPath())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StartTimer()
+
+				err = deleteVolume(vol, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Test that containers whose rootfs is an overlay can't be snapshotted, backed up, copied, migrated or exported,
+// as their data isn't in their subvolume.
+func TestBtrfsOverlayVolumeRefused(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+	d.name = "testpool"
+	d.state = &state.State{OS: &sys.OS{}}
+	d.logger = logger.AddContext(logger.Log, nil)
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	require.NoError(t, os.MkdirAll(filepath.Join(vol.MountPath(), btrfsOverlayDir), 0700))
+
+	snapVol, err := vol.NewSnapshot("snap0")
+	require.NoError(t, err)
+
+	err = d.CreateVolumeSnapshot(snapVol, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+	assert.NoDirExists(t, snapVol.MountPath())
+
+	err = d.BackupVolume(vol, nil, false, nil, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+
+	err = d.BackupVolume(vol, nil, true, nil, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+
+	err = d.MigrateVolume(vol, nil, &migration.VolumeSourceArgs{}, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+
+	copyVol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c2", nil, nil)
+	err = d.CreateVolumeFromCopy(copyVol, vol, false, false, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+	assert.NoDirExists(t, copyVol.MountPath())
+
+	err = d.ExportVolumeOCI(vol, nil, nil, nil, nil)
+	assert.ErrorContains(t, err, "btrfs.overlay")
+
+	// Regular containers aren't refused.
+	require.NoError(t, os.Remove(filepath.Join(vol.MountPath(), btrfsOverlayDir)))
+	assert.NoError(t, btrfsCheckNotOverlay(vol.MountPath(), "snapshot"))
+}
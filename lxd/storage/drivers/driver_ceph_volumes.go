@@ -457,7 +457,7 @@ func (d *ceph) CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots boo
 	lastSnap := ""
 
 	if len(snapshots) > 0 {
-		err := createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
@@ -540,7 +540,7 @@ func (d *ceph) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser, vo
 	// Handle zfs send/receive migration.
 	if len(volTargetArgs.Snapshots) > 0 {
 		// Create the parent directory.
-		err := createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
@@ -811,7 +811,7 @@ func (d *ceph) GetVolumeUsage(vol Volume) (int64, error) {
 	if !isSnap && vol.contentType == ContentTypeFS && filesystem.IsMountPoint(vol.MountPath()) {
 		var stat unix.Statfs_t
 
-		err := unix.Statfs(vol.MountPath(), &stat)
+		err := filesystem.Statfs(vol.MountPath(), &stat)
 		if err != nil {
 			return -1, err
 		}
@@ -1432,7 +1432,7 @@ func (d *ceph) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 	}
 
 	// Create the parent directory.
-	err := createParentSnapshotDirIfMissing(d.name, snapVol.volType, parentName)
+	err := createParentSnapshotDirIfMissing(d.name, d.config, snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -1505,7 +1505,7 @@ func (d *ceph) DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 	}
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
-	err = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	err = deleteParentSnapshotDirIfEmpty(d.name, d.config, snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
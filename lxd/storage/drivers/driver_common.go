@@ -1,12 +1,15 @@
 package drivers
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/url"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/lxc/lxd/lxd/backup"
 	"github.com/lxc/lxd/lxd/migration"
@@ -14,6 +17,8 @@ import (
 	"github.com/lxc/lxd/lxd/revert"
 	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/instancewriter"
 	"github.com/lxc/lxd/shared/logger"
 )
@@ -28,6 +33,17 @@ type common struct {
 	patches     map[string]func() error
 }
 
+// PoolRelPath returns path relative to the pool's mount path ("." for the mount path itself).
+// It fails if path is outside of the pool.
+func (d *common) PoolRelPath(path string) (string, error) {
+	return relPathUnder(GetPoolMountPath(d.name), path)
+}
+
+// PoolAbsPath returns the absolute path of relPath, which is relative to the pool's mount path.
+func (d *common) PoolAbsPath(relPath string) string {
+	return filepath.Join(GetPoolMountPath(d.name), relPath)
+}
+
 func (d *common) init(state *state.State, name string, config map[string]string, logger logger.Logger, volIDFunc func(volType VolumeType, volName string) (int64, error), commonRules *Validators) {
 	d.name = name
 	d.config = config
@@ -170,6 +186,11 @@ func (d *common) validateVolume(vol Volume, driverRules map[string]func(value st
 			continue
 		}
 
+		// Neither is the user-defined metadata of snapshots.
+		if vol.IsSnapshot() && strings.HasPrefix(k, SnapshotMetadataConfigPrefix) {
+			continue
+		}
+
 		if removeUnknownKeys {
 			delete(vol.config, k)
 		} else {
@@ -223,6 +244,17 @@ func (d *common) Logger() logger.Logger {
 	return d.logger
 }
 
+// opLogger returns the logger of the driver with the fields correlating the log lines of an action on a volume:
+// the ID of the operation performing it (if any), the pool, the volume and the action.
+func (d *common) opLogger(op *operations.Operation, volName string, action string) logger.Logger {
+	ctx := logger.Ctx{"pool": d.name, "volume": volName, "action": action}
+	if op != nil {
+		ctx["op_id"] = op.ID()
+	}
+
+	return d.logger.AddContext(ctx)
+}
+
 // Config returns the storage pool config (as a copy, so not modifiable).
 func (d *common) Config() map[string]string {
 	confCopy := make(map[string]string, len(d.config))
@@ -305,6 +337,96 @@ func (d *common) runFiller(vol Volume, devPath string, filler *VolumeFiller, all
 	return nil
 }
 
+// Rebalance spreads the pool data evenly across its devices.
+func (d *common) Rebalance(ctx context.Context, vols []Volume, op *operations.Operation) error {
+	return ErrNotSupported
+}
+
+// EstimateSharing estimates the physical space saved by the supplied volumes sharing data.
+func (d *common) EstimateSharing(vols []Volume) (*SpaceSharingEstimate, error) {
+	return nil, ErrNotSupported
+}
+
+// InstanceTotalFootprint returns the space used by the instance volume and its snapshots combined.
+func (d *common) InstanceTotalFootprint(vol Volume, snapshots []string) (int64, error) {
+	return -1, ErrNotSupported
+}
+
+// EmergencyFree frees space on a pool which has run out of it.
+func (d *common) EmergencyFree(op *operations.Operation) error {
+	return ErrNotSupported
+}
+
+// GetSnapshotsReclaimableSpace returns the space which deleting each of the volume's snapshots would free.
+func (d *common) GetSnapshotsReclaimableSpace(vol Volume, snapshots []string) (*ReclaimableSpaceReport, error) {
+	return nil, ErrNotSupported
+}
+
+// FindStraySubvolumes returns the subvolumes of the pool which don't belong to any of the supplied volumes.
+func (d *common) FindStraySubvolumes(vols []Volume) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// GetSubvolumeIDs returns the supplied volumes which have a subvolume in the pool, keyed by subvolume ID.
+func (d *common) GetSubvolumeIDs(vols []Volume) (map[string]Volume, error) {
+	return nil, ErrNotSupported
+}
+
+// GetQGroupLimits returns the referenced space limit of the qgroup of each of the supplied volumes which has one.
+func (d *common) GetQGroupLimits(vols []Volume) (map[string]int64, error) {
+	return nil, ErrNotSupported
+}
+
+// RepairReadonly makes the supplied volumes which were found writable read-only again.
+func (d *common) RepairReadonly(vols []Volume, op *operations.Operation) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// VerifyMounts mounts each of the supplied volumes read-only and returns the volumes which failed to mount.
+func (d *common) VerifyMounts(vols []Volume, op *operations.Operation) ([]VolumeMountFailure, error) {
+	return nil, ErrNotSupported
+}
+
+// QuiescePool flushes the pending writes of the pool to disk and optionally freezes its filesystem.
+func (d *common) QuiescePool(freeze bool) error {
+	return ErrNotSupported
+}
+
+// ResumePool thaws the filesystem of the pool.
+func (d *common) ResumePool() error {
+	return ErrNotSupported
+}
+
+// ImagesCacheUsage returns the space used by the image volumes of the pool and the limit it is bounded by.
+func (d *common) ImagesCacheUsage() (int64, int64, error) {
+	return -1, -1, ErrNotSupported
+}
+
+// PruneSnapshotDirs removes the empty parent snapshot directories and dangling symlinks of the pool.
+func (d *common) PruneSnapshotDirs(op *operations.Operation) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// ExportVolumeOCI writes the volume to w as an OCI image layer tarball.
+func (d *common) ExportVolumeOCI(vol Volume, w io.Writer, config *OCIImageConfig, idmapSet *idmap.IdmapSet, op *operations.Operation) error {
+	return ErrNotSupported
+}
+
+// ValidateLayout checks that the on-disk layout of the pool matches the expected one.
+func (d *common) ValidateLayout() (*LayoutReport, error) {
+	return nil, ErrNotSupported
+}
+
+// CheckHealth checks the pool for problems which need an action from the administrator.
+func (d *common) CheckHealth() (*PoolHealthReport, error) {
+	return nil, ErrNotSupported
+}
+
+// CheckReadonly checks that the supplied volumes are still read-only.
+func (d *common) CheckReadonly(vols []Volume, repair bool) ([]PoolHealthIssue, error) {
+	return nil, ErrNotSupported
+}
+
 // CreateVolume creates a new storage volume on disk.
 func (d *common) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Operation) error {
 	return ErrNotSupported
@@ -325,6 +447,11 @@ func (d *common) CreateVolumeFromMigration(vol Volume, conn io.ReadWriteCloser,
 	return ErrNotSupported
 }
 
+// CreateVolumeFromStream creates a new volume from a native send stream of it.
+func (d *common) CreateVolumeFromStream(vol Volume, r io.Reader, checksum string, op *operations.Operation) error {
+	return ErrNotSupported
+}
+
 // RefreshVolume updates an existing volume to match the state of another.
 func (d *common) RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume, allowInconsistent bool, op *operations.Operation) error {
 	return ErrNotSupported
@@ -335,6 +462,11 @@ func (d *common) DeleteVolume(vol Volume, op *operations.Operation) error {
 	return ErrNotSupported
 }
 
+// DeleteVolumeWithoutSnapshots destroys the on-disk state of a volume known to have no snapshots.
+func (d *common) DeleteVolumeWithoutSnapshots(vol Volume, op *operations.Operation) error {
+	return ErrNotSupported
+}
+
 // HasVolume indicates whether a specific volume exists on the storage pool.
 func (d *common) HasVolume(vol Volume) bool {
 	return false
@@ -355,6 +487,26 @@ func (d *common) GetVolumeUsage(vol Volume) (int64, error) {
 	return -1, ErrNotSupported
 }
 
+// GetVolumeGeneration returns a token of the volume's content which changes whenever the volume changes.
+func (d *common) GetVolumeGeneration(vol Volume) (uint64, error) {
+	return 0, ErrNotSupported
+}
+
+// VolumeSnapshotsInfo returns the on-disk metadata of the volume's snapshots.
+func (d *common) VolumeSnapshotsInfo(vol Volume, op *operations.Operation) ([]VolumeSnapshotInfo, error) {
+	return nil, ErrNotSupported
+}
+
+// VolumeSnapshotsCreationTime returns the creation time of the volume's snapshots as recorded by the backend.
+func (d *common) VolumeSnapshotsCreationTime(vol Volume, snapshots []string) (map[string]time.Time, error) {
+	return nil, ErrNotSupported
+}
+
+// GetVolumeSnapshotUsage returns the disk space a snapshot shares with its parent volume and uniquely owns.
+func (d *common) GetVolumeSnapshotUsage(snapVol Volume) (*api.StorageVolumeSnapshotUsage, error) {
+	return nil, ErrNotSupported
+}
+
 // SetVolumeQuota applies a size limit on volume.
 func (d *common) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool, op *operations.Operation) error {
 	return ErrNotSupported
@@ -431,6 +583,21 @@ func (d *common) RenameVolumeSnapshot(snapVol Volume, newSnapshotName string, op
 	return ErrNotSupported
 }
 
+// SetVolumeBaseImage records the fingerprint of the image the volume was created from on the volume itself.
+func (d *common) SetVolumeBaseImage(vol Volume, fingerprint string) error {
+	return ErrNotSupported
+}
+
+// DiffVolume returns the paths added, modified and deleted in the volume compared to parentVol.
+func (d *common) DiffVolume(vol Volume, parentVol Volume, volIdmap *idmap.IdmapSet, op *operations.Operation) (*VolumeDiff, error) {
+	return nil, ErrNotSupported
+}
+
+// SnapshotVolumePath snapshots only the directory at path within the volume.
+func (d *common) SnapshotVolumePath(vol Volume, path string, snapshotName string, op *operations.Operation) (string, error) {
+	return "", ErrNotSupported
+}
+
 // ValidateBucket validates the supplied bucket name.
 func (d *common) ValidateBucket(bucket Volume) error {
 	match, err := regexp.MatchString(`^[a-z0-9][\-\.a-z0-9]{2,62}$`, bucket.name)
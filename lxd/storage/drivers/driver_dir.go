@@ -2,6 +2,7 @@ package drivers
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/validate"
 )
 
 type dir struct {
@@ -85,6 +87,16 @@ func (d *dir) Delete(op *operations.Operation) error {
 		return err
 	}
 
+	// Remove the snapshots kept in the pool's directory within snapshots.mount_base.
+	base := d.config["snapshots.mount_base"]
+	if base != "" {
+		snapshotsPath := GetPoolSnapshotsPath(d.name, base)
+		err = os.RemoveAll(snapshotsPath)
+		if err != nil {
+			return fmt.Errorf("Failed removing snapshots directory %q: %w", snapshotsPath, err)
+		}
+	}
+
 	// Unmount the path.
 	_, err = d.Unmount()
 	if err != nil {
@@ -96,11 +108,21 @@ func (d *dir) Delete(op *operations.Operation) error {
 
 // Validate checks that all provide keys are supported and that no conflicting or missing configuration is present.
 func (d *dir) Validate(config map[string]string) error {
-	return d.validatePool(config, nil, nil)
+	rules := map[string]func(value string) error{
+		"snapshots.delete_on_error": validate.Optional(validate.IsOneOf(SnapshotDeletePolicies...)),
+		"snapshots.mount_base":      validate.Optional(validateSnapshotsMountBase),
+	}
+
+	return d.validatePool(config, rules, nil)
 }
 
 // Update applies any driver changes required from a configuration change.
 func (d *dir) Update(changedConfig map[string]string) error {
+	_, changed := changedConfig["snapshots.mount_base"]
+	if changed {
+		return fmt.Errorf("snapshots.mount_base cannot be changed")
+	}
+
 	return nil
 }
 
@@ -145,3 +167,26 @@ func (d *dir) Unmount() (bool, error) {
 func (d *dir) GetResources() (*api.ResourcesStoragePool, error) {
 	return genericVFSGetResources(d)
 }
+
+// PruneSnapshotDirs removes the empty parent snapshot directories and dangling symlinks left behind in the
+// snapshots directories of the pool, such as after bulk snapshot deletions. The snapshots directories relocated
+// with snapshots.mount_base are reached through their links in the pool.
+func (d *dir) PruneSnapshotDirs(op *operations.Operation) ([]string, error) {
+	return pruneSnapshotDirs(GetPoolMountPath(d.name), PoolLayoutNested)
+}
+
+// InstanceTotalFootprint returns the space used by the instance volume and its snapshots combined, walking them
+// once and counting each inode a single time so that files hardlinked between them aren't counted twice.
+func (d *dir) InstanceTotalFootprint(vol Volume, snapshots []string) (int64, error) {
+	paths := []string{vol.MountPath()}
+	for _, snapName := range snapshots {
+		snapVol, err := vol.NewSnapshot(snapName)
+		if err != nil {
+			return -1, err
+		}
+
+		paths = append(paths, snapVol.MountPath())
+	}
+
+	return dirFootprint(paths)
+}
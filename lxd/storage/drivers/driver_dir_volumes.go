@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/lxc/lxd/lxd/backup"
 	"github.com/lxc/lxd/lxd/migration"
@@ -203,7 +204,7 @@ func (d *dir) DeleteVolume(vol Volume, op *operations.Operation) error {
 
 	// Although the volume snapshot directory should already be removed, lets remove it here
 	// to just in case the top-level directory is left.
-	err = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, vol.name)
+	err = deleteParentSnapshotDirIfEmpty(d.name, d.config, vol.volType, vol.name)
 	if err != nil {
 		return err
 	}
@@ -482,16 +483,17 @@ func (d *dir) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) err
 func (d *dir) DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
 	snapPath := snapVol.MountPath()
 
-	// Remove the snapshot from the storage device.
-	err := forceRemoveAll(snapPath)
-	if err != nil && !os.IsNotExist(err) {
+	// Remove the snapshot from the storage device, handling partial failures as per the pool's policy.
+	trashPath := snapshotTrashPath(d.name, snapVol.volType, snapVol.name, time.Now())
+	err := deleteSnapshotTree(snapPath, d.config["snapshots.delete_on_error"], trashPath, forceRemove)
+	if err != nil {
 		return fmt.Errorf("Failed to remove '%s': %w", snapPath, err)
 	}
 
 	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
-	err = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	err = deleteParentSnapshotDirIfEmpty(d.name, d.config, snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -215,7 +215,7 @@ func (d *lvm) DeleteVolume(vol Volume, op *operations.Operation) error {
 
 		// Although the volume snapshot directory should already be removed, lets remove it here to just in
 		// case the top-level directory is left.
-		err = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, vol.name)
+		err = deleteParentSnapshotDirIfEmpty(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
@@ -358,7 +358,7 @@ func (d *lvm) GetVolumeUsage(vol Volume) (int64, error) {
 	// values depending on whether the volume is mounted or not.
 	if vol.contentType == ContentTypeFS && filesystem.IsMountPoint(vol.MountPath()) {
 		var stat unix.Statfs_t
-		err := unix.Statfs(vol.MountPath(), &stat)
+		err := filesystem.Statfs(vol.MountPath(), &stat)
 		if err != nil {
 			return -1, err
 		}
@@ -831,7 +831,7 @@ func (d *lvm) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) err
 	snapPath := snapVol.MountPath()
 
 	// Create the parent directory.
-	err := createParentSnapshotDirIfMissing(d.name, snapVol.volType, parentName)
+	err := createParentSnapshotDirIfMissing(d.name, d.config, snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -912,7 +912,7 @@ func (d *lvm) DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) err
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
 	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
-	err = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	err = deleteParentSnapshotDirIfEmpty(d.name, d.config, snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
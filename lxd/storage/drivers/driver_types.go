@@ -25,3 +25,94 @@ type VolumeFiller struct {
 
 	Fingerprint string // If the Filler will unpack an image, it should be this fingerprint.
 }
+
+// SpaceSharingEstimate represents an estimate of the physical space saved by a set of volumes sharing data.
+type SpaceSharingEstimate struct {
+	Method     string `json:"method" yaml:"method"`         // How the estimate was computed.
+	Referenced int64  `json:"referenced" yaml:"referenced"` // Sum of the space referenced by each volume.
+	Physical   int64  `json:"physical" yaml:"physical"`     // Estimated physical space used by the volumes.
+	Savings    int64  `json:"savings" yaml:"savings"`       // Estimated space saved by sharing.
+}
+
+// Layout problems reported by LayoutDeviation.
+const (
+	LayoutProblemMissing         = "missing"          // Expected entry doesn't exist.
+	LayoutProblemNotDirectory    = "not-directory"    // Entry exists but isn't a directory.
+	LayoutProblemNotSubvolume    = "not-subvolume"    // Entry is a plain directory where a subvolume is expected.
+	LayoutProblemUnexpectedEntry = "unexpected-entry" // Entry which isn't part of the expected layout.
+)
+
+// LayoutDeviation represents a difference between the on-disk layout of a pool and the expected one.
+type LayoutDeviation struct {
+	Path    string `json:"path" yaml:"path"`       // Path relative to the pool mount path.
+	Problem string `json:"problem" yaml:"problem"` // One of the LayoutProblem* values.
+	Message string `json:"message" yaml:"message"` // Human readable description of the deviation.
+}
+
+// LayoutReport represents the result of validating the on-disk layout of a pool.
+type LayoutReport struct {
+	Valid      bool              `json:"valid" yaml:"valid"`
+	Deviations []LayoutDeviation `json:"deviations" yaml:"deviations"`
+}
+
+// Health checks reported by PoolHealthIssue.
+const (
+	HealthCheckQuotaConsistency = "quota-consistency" // Quota accounting matches the data of the subvolumes.
+	HealthCheckReadonly         = "readonly"          // Snapshots and images are still read-only.
+)
+
+// PoolHealthIssue represents a problem found when checking the health of a pool.
+type PoolHealthIssue struct {
+	Check          string `json:"check" yaml:"check"`                   // One of the HealthCheck* values.
+	Path           string `json:"path" yaml:"path"`                     // Path relative to the pool mount path.
+	Message        string `json:"message" yaml:"message"`               // Human readable description of the issue.
+	Recommendation string `json:"recommendation" yaml:"recommendation"` // How to resolve the issue.
+}
+
+// PoolHealthReport represents the result of checking the health of a pool.
+type PoolHealthReport struct {
+	Healthy bool              `json:"healthy" yaml:"healthy"`
+	Issues  []PoolHealthIssue `json:"issues" yaml:"issues"`
+}
+
+// Methods used to compute the space reclaimable by deleting snapshots.
+const (
+	ReclaimableMethodExclusive = "exclusive" // Space exclusively owned by the snapshot.
+	ReclaimableMethodSize      = "size"      // Size of the snapshot, an upper bound as data shared with other snapshots isn't freed.
+)
+
+// SnapshotReclaimableSpace represents the space which would be freed by deleting a snapshot.
+type SnapshotReclaimableSpace struct {
+	Name        string `json:"name" yaml:"name"`               // Snapshot name (without the parent volume name).
+	Reclaimable int64  `json:"reclaimable" yaml:"reclaimable"` // Bytes freed by deleting the snapshot.
+}
+
+// ReclaimableSpaceReport represents the space which would be freed by deleting each snapshot of a volume.
+type ReclaimableSpaceReport struct {
+	Method      string                     `json:"method" yaml:"method"`                               // One of the ReclaimableMethod* values, empty if unavailable.
+	Unavailable string                     `json:"unavailable,omitempty" yaml:"unavailable,omitempty"` // Why the space couldn't be computed.
+	Snapshots   []SnapshotReclaimableSpace `json:"snapshots" yaml:"snapshots"`                         // Sorted by reclaimable space, largest first.
+}
+
+// VolumeSnapshotInfo represents the on-disk metadata of a volume snapshot.
+type VolumeSnapshotInfo struct {
+	Name         string `json:"name" yaml:"name"`                                       // The snapshot name.
+	Generation   uint64 `json:"generation" yaml:"generation"`                           // Token of the content, changes whenever it does.
+	UUID         string `json:"uuid,omitempty" yaml:"uuid,omitempty"`                   // UUID of the snapshot.
+	ParentUUID   string `json:"parent_uuid,omitempty" yaml:"parent_uuid,omitempty"`     // UUID of the volume it was taken from.
+	ReceivedUUID string `json:"received_uuid,omitempty" yaml:"received_uuid,omitempty"` // UUID it was received from, if migrated.
+}
+
+// VolumeMountFailure represents a volume which failed to mount when verifying the volumes of a pool.
+type VolumeMountFailure struct {
+	Volume Volume
+	Err    error
+}
+
+// VolumeDiff represents the paths (relative to the volume and starting with "/") added, modified and deleted in a
+// volume compared to another one.
+type VolumeDiff struct {
+	Added    []string `json:"added" yaml:"added"`
+	Modified []string `json:"modified" yaml:"modified"`
+	Deleted  []string `json:"deleted" yaml:"deleted"`
+}
@@ -387,7 +387,7 @@ func (d *zfs) CreateVolumeFromBackup(vol Volume, srcBackup backup.Info, srcData
 
 		if len(srcBackup.Snapshots) > 0 {
 			// Create new snapshots directory.
-			err := createParentSnapshotDirIfMissing(d.name, v.volType, v.name)
+			err := createParentSnapshotDirIfMissing(d.name, d.config, v.volType, v.name)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -907,7 +907,7 @@ func (d *zfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWriteCl
 	// Handle zfs send/receive migration.
 	if len(volTargetArgs.Snapshots) > 0 {
 		// Create the parent directory.
-		err := createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
 		if err != nil {
 			return err
 		}
@@ -1334,7 +1334,7 @@ func (d *zfs) GetVolumeUsage(vol Volume) (int64, error) {
 		// Shortcut for mounted refquota filesystems.
 		if key == "referenced" && vol.contentType == ContentTypeFS && filesystem.IsMountPoint(vol.MountPath()) {
 			var stat unix.Statfs_t
-			err := unix.Statfs(vol.MountPath(), &stat)
+			err := filesystem.Statfs(vol.MountPath(), &stat)
 			if err != nil {
 				return -1, err
 			}
@@ -2274,7 +2274,7 @@ func (d *zfs) CreateVolumeSnapshot(vol Volume, op *operations.Operation) error {
 	defer revert.Fail()
 
 	// Create the parent directory.
-	err := createParentSnapshotDirIfMissing(d.name, vol.volType, parentName)
+	err := createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -2341,7 +2341,7 @@ func (d *zfs) DeleteVolumeSnapshot(vol Volume, op *operations.Operation) error {
 	}
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
-	err = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, parentName)
+	err = deleteParentSnapshotDirIfEmpty(d.name, d.config, vol.volType, parentName)
 	if err != nil {
 		return err
 	}
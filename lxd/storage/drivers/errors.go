@@ -16,9 +16,21 @@ var ErrCannotBeShrunk = fmt.Errorf("Cannot be shrunk")
 // ErrInUse indicates operation cannot proceed as resource is in use.
 var ErrInUse = fmt.Errorf("In use")
 
+// ErrVolumeInUse indicates a volume cannot be removed as it is the root of a running instance or is mounted.
+var ErrVolumeInUse = fmt.Errorf("Volume in use by a running instance")
+
+// ErrSendParentInUse indicates a snapshot cannot be removed as it is in use as the parent of an incremental send.
+var ErrSendParentInUse = fmt.Errorf("Snapshot in use as incremental send parent")
+
+// ErrSnapshotMinimum indicates a snapshot cannot be removed as the minimum number of snapshots must be kept.
+var ErrSnapshotMinimum = fmt.Errorf("Minimum number of snapshots reached")
+
 // ErrSnapshotDoesNotMatchIncrementalSource in the "Snapshot does not match incremental source" error.
 var ErrSnapshotDoesNotMatchIncrementalSource = fmt.Errorf("Snapshot does not match incremental source")
 
+// ErrReceivedUUIDMismatch indicates a received subvolume isn't the one the sender announced.
+var ErrReceivedUUIDMismatch = fmt.Errorf("Received subvolume UUID mismatch")
+
 // ErrDeleteSnapshots is a special error used to tell the backend to delete more recent snapshots.
 type ErrDeleteSnapshots struct {
 	Snapshots []string
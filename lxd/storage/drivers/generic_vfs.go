@@ -63,8 +63,8 @@ func genericVFSRenameVolume(d Driver, vol Volume, newVolName string, op *operati
 	defer revert.Fail()
 
 	// Rename the volume itself.
-	srcVolumePath := GetVolumeMountPath(d.Name(), vol.volType, vol.name)
-	dstVolumePath := GetVolumeMountPath(d.Name(), vol.volType, newVolName)
+	srcVolumePath := getVolumeMountPath(d.Name(), d.Config(), vol.volType, vol.name)
+	dstVolumePath := getVolumeMountPath(d.Name(), d.Config(), vol.volType, newVolName)
 
 	if shared.PathExists(srcVolumePath) {
 		err := os.Rename(srcVolumePath, dstVolumePath)
@@ -76,8 +76,8 @@ func genericVFSRenameVolume(d Driver, vol Volume, newVolName string, op *operati
 	}
 
 	// And if present, the snapshots too.
-	srcSnapshotDir := GetVolumeSnapshotDir(d.Name(), vol.volType, vol.name)
-	dstSnapshotDir := GetVolumeSnapshotDir(d.Name(), vol.volType, newVolName)
+	srcSnapshotDir := getVolumeSnapshotDir(d.Name(), d.Config(), vol.volType, vol.name)
+	dstSnapshotDir := getVolumeSnapshotDir(d.Name(), d.Config(), vol.volType, newVolName)
 
 	if shared.PathExists(srcSnapshotDir) {
 		err := os.Rename(srcSnapshotDir, dstSnapshotDir)
@@ -94,7 +94,7 @@ func genericVFSRenameVolume(d Driver, vol Volume, newVolName string, op *operati
 
 // genericVFSVolumeSnapshots is a generic VolumeSnapshots implementation for VFS-only drivers.
 func genericVFSVolumeSnapshots(d Driver, vol Volume, op *operations.Operation) ([]string, error) {
-	snapshotDir := GetVolumeSnapshotDir(d.Name(), vol.volType, vol.name)
+	snapshotDir := getVolumeSnapshotDir(d.Name(), d.Config(), vol.volType, vol.name)
 	snapshots := []string{}
 
 	ents, err := os.ReadDir(snapshotDir)
@@ -131,7 +131,7 @@ func genericVFSRenameVolumeSnapshot(d Driver, snapVol Volume, newSnapshotName st
 
 	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
 	oldPath := snapVol.MountPath()
-	newPath := GetVolumeMountPath(d.Name(), snapVol.volType, GetSnapshotVolumeName(parentName, newSnapshotName))
+	newPath := getVolumeMountPath(d.Name(), d.Config(), snapVol.volType, GetSnapshotVolumeName(parentName, newSnapshotName))
 
 	if shared.PathExists(oldPath) {
 		err := os.Rename(oldPath, newPath)
@@ -812,7 +812,7 @@ func genericVFSBackupUnpack(d Driver, sysOS *sys.OS, vol Volume, snapshots []str
 
 	if len(snapshots) > 0 {
 		// Create new snapshots directory.
-		err := createParentSnapshotDirIfMissing(d.Name(), vol.volType, vol.name)
+		err := createParentSnapshotDirIfMissing(d.Name(), d.Config(), vol.volType, vol.name)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -1073,12 +1073,26 @@ func genericVFSListVolumes(d Driver) ([]Volume, error) {
 		}
 
 		volTypePath := filepath.Join(poolMountPath, BaseDirectories[volType][0])
+
+		// In the flat layout, volumes of all types are stored at the top of the pool prefixed by type.
+		namePrefix := ""
+		if poolLayout(poolConfig) == PoolLayoutFlat {
+			volTypePath = poolMountPath
+			namePrefix = fmt.Sprintf("%s_", BaseDirectories[volType][0])
+		}
+
 		ents, err := os.ReadDir(volTypePath)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to list directory %q for volume type %q: %w", volTypePath, volType, err)
 		}
 
 		for _, ent := range ents {
+			if !strings.HasPrefix(ent.Name(), namePrefix) {
+				continue
+			}
+
+			volName := strings.TrimPrefix(ent.Name(), namePrefix)
+
 			contentType := ContentTypeFS
 			if volType == VolumeTypeVM {
 				contentType = ContentTypeBlock
@@ -1086,7 +1100,7 @@ func genericVFSListVolumes(d Driver) ([]Volume, error) {
 				contentType = ContentTypeBlock
 			}
 
-			vols = append(vols, NewVolume(d, poolName, volType, contentType, ent.Name(), make(map[string]string), poolConfig))
+			vols = append(vols, NewVolume(d, poolName, volType, contentType, volName, make(map[string]string), poolConfig))
 		}
 	}
 
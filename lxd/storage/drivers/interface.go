@@ -1,8 +1,10 @@
 package drivers
 
 import (
+	"context"
 	"io"
 	"net/url"
+	"time"
 
 	"github.com/lxc/lxd/lxd/backup"
 	"github.com/lxc/lxd/lxd/migration"
@@ -10,6 +12,7 @@ import (
 	"github.com/lxc/lxd/lxd/revert"
 	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/lxc/lxd/shared/instancewriter"
 	"github.com/lxc/lxd/shared/logger"
 )
@@ -47,6 +50,69 @@ type Driver interface {
 	Update(changedConfig map[string]string) error
 	ApplyPatch(name string) error
 
+	// Rebalance spreads the pool data evenly across its devices, optionally relocating the supplied volumes.
+	Rebalance(ctx context.Context, vols []Volume, op *operations.Operation) error
+
+	// EstimateSharing estimates the physical space saved by the supplied volumes sharing data.
+	EstimateSharing(vols []Volume) (*SpaceSharingEstimate, error)
+
+	// InstanceTotalFootprint returns the space used by the instance volume and its snapshots combined, counting
+	// the data they share once.
+	InstanceTotalFootprint(vol Volume, snapshots []string) (int64, error)
+
+	// EmergencyFree frees space on a pool which has run out of it to allow recovering.
+	EmergencyFree(op *operations.Operation) error
+
+	// GetSnapshotsReclaimableSpace returns the space which deleting each of the volume's snapshots would free.
+	GetSnapshotsReclaimableSpace(vol Volume, snapshots []string) (*ReclaimableSpaceReport, error)
+
+	// FindStraySubvolumes returns the subvolumes of the pool (relative to its mount path) which don't belong to
+	// any of the supplied volumes.
+	FindStraySubvolumes(vols []Volume) ([]string, error)
+
+	// GetSubvolumeIDs returns the supplied volumes which have a subvolume in the pool, keyed by subvolume ID.
+	GetSubvolumeIDs(vols []Volume) (map[string]Volume, error)
+
+	// GetQGroupLimits returns the referenced space limit of the qgroup of each of the supplied volumes which
+	// has one, keyed by "<type>/<name>".
+	GetQGroupLimits(vols []Volume) (map[string]int64, error)
+
+	// RepairReadonly makes the supplied volumes which were found writable read-only again and returns the paths
+	// (relative to the pool's mount path) that were corrected.
+	RepairReadonly(vols []Volume, op *operations.Operation) ([]string, error)
+
+	// VerifyMounts mounts each of the supplied volumes (snapshots included) read-only and unmounts it straight
+	// away, returning the volumes which failed to mount.
+	VerifyMounts(vols []Volume, op *operations.Operation) ([]VolumeMountFailure, error)
+
+	// QuiescePool flushes the pending writes of the pool to disk and freezes its filesystem if freeze is set.
+	QuiescePool(freeze bool) error
+
+	// ResumePool thaws the filesystem of the pool frozen by QuiescePool.
+	ResumePool() error
+
+	// ImagesCacheUsage returns the space used by the image volumes of the pool and the limit it is bounded by,
+	// which is 0 if the images cache isn't bounded.
+	ImagesCacheUsage() (int64, int64, error)
+
+	// PruneSnapshotDirs removes the empty parent snapshot directories and dangling symlinks left in the snapshots
+	// area of the pool and returns the removed paths (relative to the pool's mount path).
+	PruneSnapshotDirs(op *operations.Operation) ([]string, error)
+
+	// ExportVolumeOCI writes a consistent copy of the volume to w as an OCI image layer tarball, or as an OCI
+	// image layout including config if set. The ownership of the files is unshifted with idmapSet if set.
+	ExportVolumeOCI(vol Volume, w io.Writer, config *OCIImageConfig, idmapSet *idmap.IdmapSet, op *operations.Operation) error
+
+	// ValidateLayout checks that the on-disk layout of the pool matches the expected one without modifying it.
+	ValidateLayout() (*LayoutReport, error)
+
+	// CheckHealth checks the pool for problems which need an action from the administrator.
+	CheckHealth() (*PoolHealthReport, error)
+
+	// CheckReadonly returns an issue for each of the supplied volumes, expected to be read-only, which was
+	// found writable, making it read-only again if repair is true.
+	CheckReadonly(vols []Volume, repair bool) ([]PoolHealthIssue, error)
+
 	// Buckets.
 	ValidateBucket(bucket Volume) error
 	GetBucketURL(bucketName string) *url.URL
@@ -65,13 +131,23 @@ type Driver interface {
 	CreateVolumeFromCopy(vol Volume, srcVol Volume, copySnapshots bool, allowInconsistent bool, op *operations.Operation) error
 	RefreshVolume(vol Volume, srcVol Volume, srcSnapshots []Volume, allowInconsistent bool, op *operations.Operation) error
 	DeleteVolume(vol Volume, op *operations.Operation) error
+
+	// DeleteVolumeWithoutSnapshots deletes a volume known to have no snapshots without the snapshot checks and
+	// cleanup of DeleteVolume.
+	DeleteVolumeWithoutSnapshots(vol Volume, op *operations.Operation) error
+
 	RenameVolume(vol Volume, newName string, op *operations.Operation) error
 	UpdateVolume(vol Volume, changedConfig map[string]string) error
 	GetVolumeUsage(vol Volume) (int64, error)
+	GetVolumeGeneration(vol Volume) (uint64, error)
 	SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool, op *operations.Operation) error
 	GetVolumeDiskPath(vol Volume) (string, error)
 	ListVolumes() ([]Volume, error)
 
+	// CreateVolumeFromStream creates a new volume from a native send stream of it, verifying the SHA256
+	// checksum of the stream (if not empty) before finalizing the volume.
+	CreateVolumeFromStream(vol Volume, r io.Reader, checksum string, op *operations.Operation) error
+
 	// MountVolume mounts a storage volume (if not mounted) and increments reference counter.
 	MountVolume(vol Volume, op *operations.Operation) error
 
@@ -90,8 +166,24 @@ type Driver interface {
 	DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) error
 	RenameVolumeSnapshot(snapVol Volume, newSnapshotName string, op *operations.Operation) error
 	VolumeSnapshots(vol Volume, op *operations.Operation) ([]string, error)
+	VolumeSnapshotsInfo(vol Volume, op *operations.Operation) ([]VolumeSnapshotInfo, error)
+
+	// VolumeSnapshotsCreationTime returns the creation time of each of the supplied snapshots of the volume as
+	// recorded by the storage backend, keyed by snapshot name.
+	VolumeSnapshotsCreationTime(vol Volume, snapshots []string) (map[string]time.Time, error)
+	GetVolumeSnapshotUsage(snapVol Volume) (*api.StorageVolumeSnapshotUsage, error)
 	RestoreVolume(vol Volume, snapshotName string, op *operations.Operation) error
 
+	// SetVolumeBaseImage records the fingerprint of the image the volume was created from on the volume itself.
+	SetVolumeBaseImage(vol Volume, fingerprint string) error
+
+	// DiffVolume returns the paths added, modified and deleted in the volume compared to parentVol, the owners in
+	// the volume being shifted out of volIdmap if not nil.
+	DiffVolume(vol Volume, parentVol Volume, volIdmap *idmap.IdmapSet, op *operations.Operation) (*VolumeDiff, error)
+
+	// SnapshotVolumePath snapshots only the directory at path within the volume and returns the snapshot's path.
+	SnapshotVolumePath(vol Volume, path string, snapshotName string, op *operations.Operation) (string, error)
+
 	// Migration.
 	MigrationTypes(contentType ContentType, refresh bool) []migration.Type
 	MigrateVolume(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, op *operations.Operation) error
@@ -1,6 +1,8 @@
 package drivers
 
 import (
+	"os/exec"
+
 	"github.com/lxc/lxd/lxd/state"
 	"github.com/lxc/lxd/shared/logger"
 )
@@ -15,6 +17,11 @@ var drivers = map[string]func() driver{
 	"zfs":        func() driver { return &zfs{} },
 }
 
+// requiredTools contains the binaries which must be available for a driver to be loaded.
+var requiredTools = map[string][]string{
+	"btrfs": {"btrfs"},
+}
+
 // Validators contains functions used for validating a drivers's config.
 type Validators struct {
 	PoolRules   func() map[string]func(string) error
@@ -88,3 +95,16 @@ func RemoteDriverNames() []string {
 
 	return driverNames
 }
+
+// MissingTools returns the binaries required by the driver which can't be found in PATH.
+func MissingTools(driverName string) []string {
+	missing := []string{}
+	for _, tool := range requiredTools[driverName] {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			missing = append(missing, tool)
+		}
+	}
+
+	return missing
+}
@@ -1,17 +1,24 @@
 package drivers
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/lxc/lxd/lxd/operations"
+	"github.com/lxc/lxd/lxd/project"
+	"github.com/lxc/lxd/lxd/revert"
 	"github.com/lxc/lxd/lxd/storage/filesystem"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
@@ -60,6 +67,119 @@ func forceRemoveAll(path string) error {
 	return nil
 }
 
+// Policies for snapshot deletions which fail part way through (snapshots.delete_on_error).
+const (
+	// SnapshotDeleteAbort stops at the first failure, leaving the rest of the snapshot in place.
+	SnapshotDeleteAbort = "abort"
+
+	// SnapshotDeleteContinue removes everything it can and reports all the failures.
+	SnapshotDeleteContinue = "continue"
+
+	// SnapshotDeleteQuarantine moves whatever couldn't be removed to the pool's trash directory.
+	SnapshotDeleteQuarantine = "quarantine"
+)
+
+// SnapshotDeletePolicies lists the supported values of snapshots.delete_on_error.
+var SnapshotDeletePolicies = []string{SnapshotDeleteAbort, SnapshotDeleteContinue, SnapshotDeleteQuarantine}
+
+// SnapshotMetadataConfigPrefix is the prefix of the snapshot config keys holding user-defined metadata.
+const SnapshotMetadataConfigPrefix = "snapshot.metadata."
+
+// SendParentRefCountConfigKey is the snapshot config key recording how many incremental sends made outside of LXD,
+// such as those of backup tooling, rely on the snapshot as their parent.
+const SendParentRefCountConfigKey = "volatile.send_parent.refcount"
+
+// SendParentRefCount returns the number of incremental sends recorded in the snapshot config as relying on the
+// snapshot as their parent.
+func SendParentRefCount(config map[string]string) (uint, error) {
+	value := config[SendParentRefCountConfigKey]
+	if value == "" {
+		return 0, nil
+	}
+
+	count, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid send parent ref counter %q: %w", value, err)
+	}
+
+	return uint(count), nil
+}
+
+// snapshotTrashPath returns the path in the pool's trash directory that the leftovers of a snapshot are moved to.
+func snapshotTrashPath(poolName string, volType VolumeType, snapName string, now time.Time) string {
+	name := fmt.Sprintf("%s_%d", strings.Replace(snapName, shared.SnapshotDelimiter, "_", -1), now.UnixNano())
+
+	return filepath.Join(GetPoolMountPath(poolName), "trash", string(volType), name)
+}
+
+// forceRemove removes a single path, clearing any immutable/append-only attribute if needed.
+func forceRemove(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		_, _ = shared.RunCommand("chattr", "-ai", path)
+		err = os.Remove(path)
+	}
+
+	return err
+}
+
+// deleteSnapshotTree removes path and everything below it (children before their parents) using remove.
+// When some entries can't be removed, the abort policy returns the first failure, the continue policy carries on
+// and returns all the failures, and the quarantine policy moves the leftovers to trashPath and succeeds.
+func deleteSnapshotTree(path string, policy string, trashPath string, remove func(path string) error) error {
+	paths := []string{}
+	err := filepath.Walk(path, func(entryPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		paths = append(paths, entryPath)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed listing %q: %w", path, err)
+	}
+
+	failures := []string{}
+	for i := len(paths) - 1; i >= 0; i-- {
+		err := remove(paths[i])
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+
+		if policy == "" || policy == SnapshotDeleteAbort {
+			return fmt.Errorf("Failed removing %q: %w", paths[i], err)
+		}
+
+		failures = append(failures, fmt.Sprintf("%q: %v", paths[i], err))
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	if policy == SnapshotDeleteQuarantine {
+		err := os.MkdirAll(filepath.Dir(trashPath), 0700)
+		if err == nil {
+			err = os.Rename(path, trashPath)
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed moving leftovers of %q to %q after failing to remove %s: %w", path, trashPath, strings.Join(failures, ", "), err)
+		}
+
+		logger.Warn("Moved snapshot leftovers to trash", logger.Ctx{"path": path, "trash": trashPath, "failures": failures})
+
+		return nil
+	}
+
+	return fmt.Errorf("Failed removing %d entries of %q: %s", len(failures), path, strings.Join(failures, ", "))
+}
+
 // forceUnmount unmounts stacked mounts until no mountpoint remains.
 func forceUnmount(path string) (bool, error) {
 	unmounted := false
@@ -86,6 +206,11 @@ func forceUnmount(path string) (bool, error) {
 
 // mountReadOnly performs a read-only bind-mount.
 func mountReadOnly(srcPath string, dstPath string) (bool, error) {
+	return mountReadOnlyFlags(srcPath, dstPath, 0)
+}
+
+// mountReadOnlyFlags is like mountReadOnly but applies the additional mount flags when making the mount read-only.
+func mountReadOnlyFlags(srcPath string, dstPath string, flags uintptr) (bool, error) {
 	// Check if already mounted.
 	if filesystem.IsMountPoint(dstPath) {
 		return false, nil
@@ -98,7 +223,7 @@ func mountReadOnly(srcPath string, dstPath string) (bool, error) {
 	}
 
 	// Make it read-only.
-	err = TryMount("", dstPath, "none", unix.MS_BIND|unix.MS_RDONLY|unix.MS_REMOUNT, "")
+	err = TryMount("", dstPath, "none", flags|unix.MS_BIND|unix.MS_RDONLY|unix.MS_REMOUNT, "")
 	if err != nil {
 		_, _ = forceUnmount(dstPath)
 		return false, err
@@ -111,14 +236,14 @@ func mountReadOnly(srcPath string, dstPath string) (bool, error) {
 func sameMount(srcPath string, dstPath string) bool {
 	// Get the source vfs path information
 	var srcFsStat unix.Statfs_t
-	err := unix.Statfs(srcPath, &srcFsStat)
+	err := filesystem.Statfs(srcPath, &srcFsStat)
 	if err != nil {
 		return false
 	}
 
 	// Get the destination vfs path information
 	var dstFsStat unix.Statfs_t
-	err = unix.Statfs(dstPath, &dstFsStat)
+	err = filesystem.Statfs(dstPath, &dstFsStat)
 	if err != nil {
 		return false
 	}
@@ -130,14 +255,14 @@ func sameMount(srcPath string, dstPath string) bool {
 
 	// Get the source path information
 	var srcStat unix.Stat_t
-	err = unix.Stat(srcPath, &srcStat)
+	err = filesystem.Stat(srcPath, &srcStat)
 	if err != nil {
 		return false
 	}
 
 	// Get the destination path information
 	var dstStat unix.Stat_t
-	err = unix.Stat(dstPath, &dstStat)
+	err = filesystem.Stat(dstPath, &dstStat)
 	if err != nil {
 		return false
 	}
@@ -192,233 +317,900 @@ func TryUnmount(path string, flags int) error {
 	return nil
 }
 
-// tryExists waits up to 10s for a file to exist.
-func tryExists(path string) bool {
-	// Attempt 20 checks over 10s
-	for i := 0; i < 20; i++ {
-		if shared.PathExists(path) {
-			return true
-		}
-
-		time.Sleep(500 * time.Millisecond)
-	}
-
-	return false
+// MountInfo represents a single entry from /proc/self/mountinfo.
+type MountInfo struct {
+	Source  string `json:"source" yaml:"source"`
+	Target  string `json:"target" yaml:"target"`
+	FSType  string `json:"fstype" yaml:"fstype"`
+	Options string `json:"options" yaml:"options"`
 }
 
-// fsUUID returns the filesystem UUID for the given block path.
-func fsUUID(path string) (string, error) {
-	val, err := shared.RunCommand("blkid", "-s", "UUID", "-o", "value", path)
+// PoolActiveMounts returns all the mounts currently active on or below the mount path of the given pool.
+func PoolActiveMounts(poolName string) ([]MountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("Failed opening mountinfo: %w", err)
 	}
 
-	return strings.TrimSpace(val), nil
+	defer func() { _ = f.Close() }()
+
+	return parseMountInfo(f, GetPoolMountPath(poolName))
 }
 
-// fsProbe returns the filesystem type for the given block path.
-func fsProbe(path string) (string, error) {
-	val, err := shared.RunCommand("blkid", "-s", "TYPE", "-o", "value", path)
-	if err != nil {
-		return "", err
-	}
+// PoolDiskDevices returns the "major:minor" of the disks holding the data of the given pool, resolved from the
+// devices backing the pool mount, all of them for multi-device btrfs pools. Loop devices are followed to the disk
+// holding their backing file and partitions to their disk, as those are the devices the I/O ends up on and which
+// the I/O cgroup controller can throttle.
+func PoolDiskDevices(poolName string) ([]string, error) {
+	poolMntPath := GetPoolMountPath(poolName)
 
-	return strings.TrimSpace(val), nil
-}
+	devices, err := PoolBackingDevices(poolMntPath)
+	if err != nil {
+		if !errors.Is(err, ErrNotSupported) {
+			return nil, err
+		}
 
-// GetPoolMountPath returns the mountpoint of the given pool.
-// {LXD_DIR}/storage-pools/<pool>.
-func GetPoolMountPath(poolName string) string {
-	return shared.VarPath("storage-pools", poolName)
-}
+		// Pools which aren't mounted from a block device (such as dir) use the disk of the filesystem they're on.
+		disk, err := diskDeviceForPath(poolMntPath)
+		if err != nil {
+			return nil, err
+		}
 
-// GetVolumeMountPath returns the mount path for a specific volume based on its pool and type and
-// whether it is a snapshot or not. For VolumeTypeImage the volName is the image fingerprint.
-func GetVolumeMountPath(poolName string, volType VolumeType, volName string) string {
-	if shared.IsSnapshot(volName) {
-		return shared.VarPath("storage-pools", poolName, fmt.Sprintf("%s-snapshots", string(volType)), volName)
+		return []string{disk}, nil
 	}
 
-	return shared.VarPath("storage-pools", poolName, string(volType), volName)
-}
+	disks := make([]string, 0, len(devices))
+	for _, device := range devices {
+		var major, minor uint32
+		_, err := fmt.Sscanf(device.Device, "%d:%d", &major, &minor)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid block device number %q of %q: %w", device.Device, device.Path, err)
+		}
 
-// GetVolumeSnapshotDir gets the snapshot mount directory for the parent volume.
-func GetVolumeSnapshotDir(poolName string, volType VolumeType, volName string) string {
-	parent, _, _ := api.GetParentAndSnapshotName(volName)
-	return shared.VarPath("storage-pools", poolName, fmt.Sprintf("%s-snapshots", string(volType)), parent)
-}
+		disk, err := diskDevice(major, minor)
+		if err != nil {
+			return nil, err
+		}
 
-// GetSnapshotVolumeName returns the full volume name for a parent volume and snapshot name.
-func GetSnapshotVolumeName(parentName, snapshotName string) string {
-	return fmt.Sprintf("%s%s%s", parentName, shared.SnapshotDelimiter, snapshotName)
-}
+		// Devices of a multi-device btrfs pool may be partitions of the same disk.
+		if !shared.StringInSlice(disk, disks) {
+			disks = append(disks, disk)
+		}
+	}
 
-// createParentSnapshotDirIfMissing creates the parent directory for volume snapshots.
-func createParentSnapshotDirIfMissing(poolName string, volType VolumeType, volName string) error {
-	snapshotsPath := GetVolumeSnapshotDir(poolName, volType, volName)
+	return disks, nil
+}
 
-	// If it's missing, create it.
-	if !shared.PathExists(snapshotsPath) {
-		err := os.Mkdir(snapshotsPath, 0700)
-		if err != nil {
-			return fmt.Errorf("Failed to create parent snapshot directory %q: %w", snapshotsPath, err)
-		}
+// diskDeviceForPath returns the "major:minor" of the disk holding path.
+func diskDeviceForPath(path string) (string, error) {
+	var stat unix.Stat_t
+	err := filesystem.Stat(path, &stat)
+	if err != nil {
+		return "", fmt.Errorf("Failed getting file stat %q: %w", path, err)
+	}
 
-		return nil
+	major, minor := unix.Major(stat.Dev), unix.Minor(stat.Dev)
+	if major == 0 {
+		return "", fmt.Errorf("Path %q isn't backed by a block device", path)
 	}
 
-	return nil
+	return diskDevice(major, minor)
 }
 
-// deleteParentSnapshotDirIfEmpty removes the parent snapshot directory if it is empty.
-// It accepts the pool name, volume type and parent volume name.
-func deleteParentSnapshotDirIfEmpty(poolName string, volType VolumeType, volName string) error {
-	snapshotsPath := GetVolumeSnapshotDir(poolName, volType, volName)
+// diskDevice returns the "major:minor" of the disk the I/O of the given block device ends up on.
+func diskDevice(major uint32, minor uint32) (string, error) {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join(sysDevBlockPath, fmt.Sprintf("%d:%d", major, minor)))
+	if err != nil {
+		return "", fmt.Errorf("Failed resolving block device %d:%d: %w", major, minor, err)
+	}
 
-	// If it exists, try to delete it.
-	if shared.PathExists(snapshotsPath) {
-		isEmpty, err := shared.PathIsEmpty(snapshotsPath)
+	// Loop devices submit their I/O to the disk holding their backing file.
+	backingFile, err := os.ReadFile(filepath.Join(sysPath, "loop", "backing_file"))
+	if err == nil {
+		return diskDeviceForPath(strings.TrimSpace(string(backingFile)))
+	}
+
+	// Partitions can't be throttled on their own.
+	if shared.PathExists(filepath.Join(sysPath, "partition")) {
+		disk, err := os.ReadFile(filepath.Join(filepath.Dir(sysPath), "dev"))
 		if err != nil {
-			return err
+			return "", fmt.Errorf("Failed getting disk of partition %d:%d: %w", major, minor, err)
 		}
 
-		if isEmpty {
-			err := os.Remove(snapshotsPath)
-			if err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("Failed to remove '%s': %w", snapshotsPath, err)
-			}
-		}
+		return strings.TrimSpace(string(disk)), nil
 	}
 
-	return nil
+	return fmt.Sprintf("%d:%d", major, minor), nil
 }
 
-// ensureSparseFile creates a sparse empty file at specified location with specified size.
-// If the path already exists, the file is truncated to the requested size.
-func ensureSparseFile(filePath string, sizeBytes int64) error {
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+// BackingDevice represents a block device backing a pool mount.
+type BackingDevice struct {
+	Path        string `json:"path" yaml:"path"`                                     // Path of the block device.
+	Device      string `json:"device" yaml:"device"`                                 // The "major:minor" of the block device.
+	BackingFile string `json:"backing_file,omitempty" yaml:"backing_file,omitempty"` // Backing file of loop devices.
+}
+
+// PoolBackingDevices returns the block devices backing the filesystem mounted at poolMount: the device it is
+// mounted from, each device of multi-device btrfs filesystems, and loop devices along with their backing file.
+// ErrNotSupported is returned if nothing is mounted at poolMount or the filesystem isn't backed by block devices.
+func PoolBackingDevices(poolMount string) ([]BackingDevice, error) {
+	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
-		return fmt.Errorf("Failed to open %s: %w", filePath, err)
+		return nil, fmt.Errorf("Failed opening mountinfo: %w", err)
 	}
 
 	defer func() { _ = f.Close() }()
 
-	err = f.Truncate(sizeBytes)
+	mounts, err := parseMountInfo(f, poolMount)
 	if err != nil {
-		return fmt.Errorf("Failed to create sparse file %s: %w", filePath, err)
+		return nil, err
 	}
 
-	return f.Close()
-}
+	btrfsDevices := func(poolMount string) ([]string, error) {
+		output, err := shared.RunCommand("btrfs", "filesystem", "show", poolMount)
+		if err != nil {
+			return nil, fmt.Errorf("Failed listing devices of %q: %w", poolMount, err)
+		}
 
-// roundVolumeBlockFileSizeBytes parses the supplied size string and then rounds it to the nearest multiple of
-// MinBlockBoundary bytes that is equal to or larger than sizeBytes.
-func roundVolumeBlockFileSizeBytes(sizeBytes int64) int64 {
-	// Qemu requires image files to be in traditional storage block boundaries.
-	// We use 8k here to ensure our images are compatible with all of our backend drivers.
-	if sizeBytes < MinBlockBoundary {
-		sizeBytes = MinBlockBoundary
+		return btrfsFilesystemDevices(output), nil
 	}
 
-	roundedSizeBytes := int64(sizeBytes/MinBlockBoundary) * MinBlockBoundary
+	return poolBackingDevices(mounts, poolMount, btrfsDevices, blockDevNumber)
+}
 
-	// Ensure the rounded size is at least the size specified in sizeBytes.
-	if roundedSizeBytes < sizeBytes {
-		roundedSizeBytes += MinBlockBoundary
+// poolBackingDevices returns the block devices backing the filesystem mounted at poolMount according to mounts,
+// using btrfsDevices to list the devices of btrfs filesystems and deviceNumber to get the "major:minor" of a
+// block device.
+func poolBackingDevices(mounts []MountInfo, poolMount string, btrfsDevices func(poolMount string) ([]string, error), deviceNumber func(devPath string) (string, error)) ([]BackingDevice, error) {
+	poolMount = filepath.Clean(poolMount)
+
+	var mount *MountInfo
+	for i := range mounts {
+		// The last mount on top of the path is the visible one.
+		if mounts[i].Target == poolMount {
+			mount = &mounts[i]
+		}
 	}
 
-	// Round the size to closest MinBlockBoundary bytes to avoid qemu boundary issues.
-	return roundedSizeBytes
-}
+	if mount == nil {
+		return nil, fmt.Errorf("Nothing is mounted at %q: %w", poolMount, ErrNotSupported)
+	}
 
-// ensureVolumeBlockFile creates new block file or enlarges the raw block file for a volume to the specified size.
-// Returns true if resize took place, false if not. Requested size is rounded to nearest block size using
-// roundVolumeBlockFileSizeBytes() before decision whether to resize is taken. Accepts unsupportedResizeTypes
-// list that indicates which volume types it should not attempt to resize (when allowUnsafeResize=false) and
-// instead return ErrNotSupported.
-func ensureVolumeBlockFile(vol Volume, path string, sizeBytes int64, allowUnsafeResize bool, unsupportedResizeTypes ...VolumeType) (bool, error) {
-	if sizeBytes <= 0 {
-		return false, fmt.Errorf("Size cannot be zero")
+	// Sources such as "tmpfs" or "none" aren't devices.
+	if !filepath.IsAbs(mount.Source) {
+		return nil, fmt.Errorf("%q isn't mounted from a block device: %w", poolMount, ErrNotSupported)
 	}
 
-	// Get rounded block size to avoid qemu boundary issues.
-	sizeBytes = roundVolumeBlockFileSizeBytes(sizeBytes)
+	devPaths := []string{mount.Source}
+	if mount.FSType == "btrfs" {
+		paths, err := btrfsDevices(poolMount)
+		if err != nil {
+			return nil, err
+		}
 
-	if shared.PathExists(path) {
-		fi, err := os.Stat(path)
+		// Keep the mount source if the devices couldn't be listed.
+		if len(paths) > 0 {
+			devPaths = paths
+		}
+	}
+
+	devices := make([]BackingDevice, 0, len(devPaths))
+	for _, devPath := range devPaths {
+		number, err := deviceNumber(devPath)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 
-		oldSizeBytes := fi.Size()
-		if sizeBytes == oldSizeBytes {
-			return false, nil
+		device := BackingDevice{Path: devPath, Device: number}
+
+		backingFile, err := os.ReadFile(filepath.Join(sysDevBlockPath, number, "loop", "backing_file"))
+		if err == nil {
+			device.BackingFile = strings.TrimSpace(string(backingFile))
 		}
 
-		// Only perform pre-resize checks if we are not in "unsafe" mode.
-		// In unsafe mode we expect the caller to know what they are doing and understand the risks.
-		if !allowUnsafeResize {
-			// Reject if would try and resize a volume type that is not supported.
-			// This needs to come before the ErrCannotBeShrunk check below so that any resize attempt
-			// is blocked with ErrNotSupported error.
-			for _, unsupportedType := range unsupportedResizeTypes {
-				if unsupportedType == vol.volType {
-					return false, ErrNotSupported
-				}
-			}
+		devices = append(devices, device)
+	}
 
-			if sizeBytes < oldSizeBytes {
-				return false, fmt.Errorf("Block volumes cannot be shrunk: %w", ErrCannotBeShrunk)
-			}
+	return devices, nil
+}
 
-			if vol.MountInUse() {
-				return false, ErrInUse // We don't allow online resizing of block volumes.
+// parseMountInfo parses mountinfo formatted data and returns the entries whose target is at or below prefix.
+func parseMountInfo(r io.Reader, prefix string) ([]MountInfo, error) {
+	// Mount paths in mountinfo have spaces, tabs, newlines and backslashes octal escaped.
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+	prefix = filepath.Clean(prefix)
+	mounts := []MountInfo{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format: ID parentID major:minor root target options [optional fields...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		target := filepath.Clean(unescape.Replace(fields[4]))
+		if target != prefix && !strings.HasPrefix(target, prefix+"/") {
+			continue
+		}
+
+		// Find the separator marking the end of the optional fields.
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
 			}
 		}
 
-		err = ensureSparseFile(path, sizeBytes)
-		if err != nil {
-			return false, fmt.Errorf("Failed resizing disk image %q to size %d: %w", path, sizeBytes, err)
+		if sep < 0 || len(fields) < sep+3 {
+			continue
 		}
 
-		return true, nil
+		mounts = append(mounts, MountInfo{
+			Source:  unescape.Replace(fields[sep+2]),
+			Target:  target,
+			FSType:  fields[sep+1],
+			Options: fields[5],
+		})
 	}
 
-	// If path doesn't exist, then there has been no filler function supplied to create it from another source.
-	// So instead create an empty volume (use for PXE booting a VM).
-	err := ensureSparseFile(path, sizeBytes)
+	err := scanner.Err()
 	if err != nil {
-		return false, fmt.Errorf("Failed creating disk image %q as size %d: %w", path, sizeBytes, err)
+		return nil, fmt.Errorf("Failed parsing mountinfo: %w", err)
 	}
 
-	return false, nil
+	return mounts, nil
 }
 
-// mkfsOptions represents options for filesystem creation.
-type mkfsOptions struct {
-	Label string
-}
+// parseMountInfoFilesystemPath returns the path of path within the filesystem holding it, resolved from the
+// mount of /proc/self/mountinfo (as read from r) it is on: the mounted root directory of the filesystem joined with
+// the path relative to the mount target.
+func parseMountInfoFilesystemPath(r io.Reader, path string) (string, error) {
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+	path = filepath.Clean(path)
+	found := false
+	var fsPath, bestTarget string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format: ID parentID major:minor root target options [optional fields...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
 
-// makeFSType creates the provided filesystem.
-func makeFSType(path string, fsType string, options *mkfsOptions) (string, error) {
-	var err error
-	var msg string
+		target := filepath.Clean(unescape.Replace(fields[4]))
+		rel, err := relPathUnder(target, path)
+		if err != nil {
+			continue
+		}
 
-	fsOptions := options
-	if fsOptions == nil {
-		fsOptions = &mkfsOptions{}
+		// The deepest mount holds the path, the last one when several are stacked on the same target.
+		if found && len(target) < len(bestTarget) {
+			continue
+		}
+
+		found = true
+		bestTarget = target
+		fsPath = filepath.Join(unescape.Replace(fields[3]), rel)
 	}
 
-	cmd := []string{fmt.Sprintf("mkfs.%s", fsType)}
-	if fsOptions.Label != "" {
-		cmd = append(cmd, "-L", fsOptions.Label)
+	err := scanner.Err()
+	if err != nil {
+		return "", fmt.Errorf("Failed parsing mountinfo: %w", err)
 	}
 
-	if fsType == "ext4" {
-		cmd = append(cmd, "-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0")
+	if !found {
+		return "", fmt.Errorf("Failed finding the mount of %q", path)
 	}
 
-	// Always add the path to the device as the last argument for wider compatibility with versions of mkfs.
+	return fsPath, nil
+}
+
+// PoolCleanupStaleMounts lazily unmounts the mounts below the mount path of the pool which aren't at or below one
+// of the active paths (the mount paths of the volumes in use by instances and operations), such as the mounts
+// left behind by a crash which would block deleting the volumes. It returns the mounts it unmounted.
+func PoolCleanupStaleMounts(poolName string, activePaths []string) ([]MountInfo, error) {
+	return cleanupStaleMounts(GetPoolMountPath(poolName), activePaths)
+}
+
+// cleanupStaleMounts lazily unmounts the stale mounts below mountPath.
+func cleanupStaleMounts(mountPath string, activePaths []string) ([]MountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening mountinfo: %w", err)
+	}
+
+	mounts, err := parseMountInfo(f, mountPath)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	unmounted := []MountInfo{}
+	for _, mount := range staleMounts(mounts, mountPath, activePaths) {
+		err = unix.Unmount(mount.Target, unix.MNT_DETACH)
+		if err != nil && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+			return unmounted, fmt.Errorf("Failed unmounting stale mount %q: %w", mount.Target, err)
+		}
+
+		logger.Info("Unmounted stale mount", logger.Ctx{"target": mount.Target, "source": mount.Source, "fstype": mount.FSType})
+		unmounted = append(unmounted, mount)
+	}
+
+	return unmounted, nil
+}
+
+// staleMounts returns the mounts strictly below mountPath which aren't at or below one of the active paths,
+// deepest first so that nested mounts are unmounted before the mounts they are on.
+func staleMounts(mounts []MountInfo, mountPath string, activePaths []string) []MountInfo {
+	mountPath = filepath.Clean(mountPath)
+
+	stale := []MountInfo{}
+	for _, mount := range mounts {
+		target := filepath.Clean(mount.Target)
+		if !strings.HasPrefix(target, mountPath+"/") {
+			continue // The pool's own mount.
+		}
+
+		active := false
+		for _, path := range activePaths {
+			path = filepath.Clean(path)
+			if target == path || strings.HasPrefix(target, path+"/") {
+				active = true
+				break
+			}
+		}
+
+		if !active {
+			stale = append(stale, mount)
+		}
+	}
+
+	sort.SliceStable(stale, func(i, j int) bool {
+		return strings.Count(stale[i].Target, "/") > strings.Count(stale[j].Target, "/")
+	})
+
+	return stale
+}
+
+// CheckVolumeNotInUse returns ErrVolumeInUse if the volume at volPath is the root of a running instance or if any
+// of the mounts is at or below volPath, which would happen if it was still the mount source of an instance.
+func CheckVolumeNotInUse(volPath string, running bool, mounts []MountInfo) error {
+	if running {
+		return fmt.Errorf("Volume %q is the root of a running instance: %w", volPath, ErrVolumeInUse)
+	}
+
+	volPath = filepath.Clean(volPath)
+	for _, mount := range mounts {
+		if mount.Target == volPath || strings.HasPrefix(mount.Target, volPath+"/") {
+			return fmt.Errorf("Volume %q is still mounted on %q: %w", volPath, mount.Target, ErrVolumeInUse)
+		}
+	}
+
+	return nil
+}
+
+// tryExists waits up to 10s for a file to exist.
+func tryExists(path string) bool {
+	// Attempt 20 checks over 10s
+	for i := 0; i < 20; i++ {
+		if shared.PathExists(path) {
+			return true
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return false
+}
+
+// fsUUID returns the filesystem UUID for the given block path.
+func fsUUID(path string) (string, error) {
+	val, err := shared.RunCommand("blkid", "-s", "UUID", "-o", "value", path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(val), nil
+}
+
+// fsProbe returns the filesystem type for the given block path.
+func fsProbe(path string) (string, error) {
+	val, err := shared.RunCommand("blkid", "-s", "TYPE", "-o", "value", path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(val), nil
+}
+
+// GetPoolMountPath returns the mountpoint of the given pool.
+// {LXD_DIR}/storage-pools/<pool>.
+func GetPoolMountPath(poolName string) string {
+	return shared.VarPath("storage-pools", poolName)
+}
+
+// relPathUnder returns path relative to base ("." for base itself), failing if path isn't under base.
+// Both paths are cleaned first so trailing slashes don't matter.
+func relPathUnder(base string, path string) (string, error) {
+	relPath, err := filepath.Rel(base, path)
+	if err != nil {
+		return "", err
+	}
+
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("Path %q isn't under %q", path, base)
+	}
+
+	return relPath, nil
+}
+
+// PoolLayoutNested stores volumes in a directory per volume type (and snapshots in a directory per volume).
+const PoolLayoutNested = "nested"
+
+// PoolLayoutFlat stores all volumes and snapshot directories as siblings at the top of the pool.
+const PoolLayoutFlat = "flat"
+
+// poolLayout returns the volume layout used by the pool with the given config.
+func poolLayout(poolConfig map[string]string) string {
+	if poolConfig["btrfs.layout"] == PoolLayoutFlat {
+		return PoolLayoutFlat
+	}
+
+	return PoolLayoutNested
+}
+
+// GetPoolSnapshotsPath returns the directory holding the snapshot directories of the given pool when its
+// "snapshots.mount_base" is base, that is the pool's own directory within it, or the pool's mount path if unset.
+// The snapshot directories in the pool's mount path are then symlinks to the ones in this directory.
+func GetPoolSnapshotsPath(poolName string, base string) string {
+	if base == "" {
+		return GetPoolMountPath(poolName)
+	}
+
+	return filepath.Join(base, poolName)
+}
+
+// LinkPoolSnapshotsDir creates the snapshot directory dirName of the pool in the pool's directory within its
+// "snapshots.mount_base" and links it from the pool's mount path, so that the snapshot paths stay the same.
+func LinkPoolSnapshotsDir(poolName string, base string, dirName string) error {
+	target := filepath.Join(GetPoolSnapshotsPath(poolName, base), dirName)
+	err := os.MkdirAll(target, 0711)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %q: %w", target, err)
+	}
+
+	path := filepath.Join(GetPoolMountPath(poolName), dirName)
+	link, err := os.Readlink(path)
+	if err == nil && link == target {
+		return nil
+	}
+
+	if err == nil || shared.PathExists(path) {
+		return fmt.Errorf("Snapshot directory %q already exists and doesn't link to %q", path, target)
+	}
+
+	err = os.Symlink(target, path)
+	if err != nil {
+		return fmt.Errorf("Failed to link %q to %q: %w", path, target, err)
+	}
+
+	return nil
+}
+
+// getPoolEntryPath returns the path of an entry inside one of the volume type directories of the pool with the
+// given config. In the flat layout the directory name is used as a prefix of the entry instead, e.g.
+// "containers_c1" rather than "containers/c1". An empty entry name returns the directory to use for the volume type.
+func getPoolEntryPath(poolName string, poolConfig map[string]string, dirName string, entryName string) string {
+	return shared.VarPath("storage-pools", poolName, poolLayoutEntryPath(poolLayout(poolConfig), dirName, entryName))
+}
+
+// poolLayoutEntryPath returns the path, relative to the pool, of an entry inside one of the pool's volume type
+// directories in the given layout (see getPoolEntryPath).
+func poolLayoutEntryPath(layout string, dirName string, entryName string) string {
+	if layout == PoolLayoutFlat {
+		if entryName == "" {
+			return ""
+		}
+
+		return fmt.Sprintf("%s_%s", dirName, entryName)
+	}
+
+	return filepath.Join(dirName, entryName)
+}
+
+// splitPoolLayoutEntryPath splits relPath, relative to the pool, into the name of the entry of the dirName volume
+// type directory it is in and the path within that entry, in the given layout. It returns false if relPath isn't
+// within an entry of dirName.
+func splitPoolLayoutEntryPath(layout string, dirName string, relPath string) (string, string, bool) {
+	relPath = filepath.Clean(relPath)
+
+	if layout == PoolLayoutFlat {
+		first, rest, _ := strings.Cut(relPath, "/")
+		if !strings.HasPrefix(first, dirName+"_") || first == dirName+"_" {
+			return "", "", false
+		}
+
+		return strings.TrimPrefix(first, dirName+"_"), rest, true
+	}
+
+	if !strings.HasPrefix(relPath, dirName+"/") {
+		return "", "", false
+	}
+
+	entryName, rest, _ := strings.Cut(strings.TrimPrefix(relPath, dirName+"/"), "/")
+
+	return entryName, rest, true
+}
+
+// listPoolLayoutEntries returns the names of the entries of the dirName volume type directory of the pool
+// mounted at poolMount in the given layout, sorted. A missing directory has no entries.
+func listPoolLayoutEntries(poolMount string, layout string, dirName string) ([]string, error) {
+	dir := filepath.Join(poolMount, poolLayoutEntryPath(layout, dirName, ""))
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed listing %q: %w", dir, err)
+	}
+
+	names := make([]string, 0, len(ents))
+	for _, ent := range ents {
+		if layout != PoolLayoutFlat {
+			names = append(names, ent.Name())
+			continue
+		}
+
+		entryName, _, ok := splitPoolLayoutEntryPath(layout, dirName, ent.Name())
+		if ok {
+			names = append(names, entryName)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// validateSnapshotsMountBase validates the "snapshots.mount_base" pool option, which must be an absolute path
+// outside of the LXD storage pools directory.
+func validateSnapshotsMountBase(value string) error {
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("Must be an absolute path")
+	}
+
+	_, err := relPathUnder(shared.VarPath("storage-pools"), value)
+	if err == nil {
+		return fmt.Errorf("Must be outside of %q", shared.VarPath("storage-pools"))
+	}
+
+	return nil
+}
+
+// GetVolumeMountPath returns the mount path for a specific volume based on its pool and type and
+// whether it is a snapshot or not. For VolumeTypeImage the volName is the image fingerprint.
+// The pool is assumed to use PoolLayoutNested, use Volume.MountPath for volumes of pools which may not.
+func GetVolumeMountPath(poolName string, volType VolumeType, volName string) string {
+	return getVolumeMountPath(poolName, nil, volType, volName)
+}
+
+// getVolumeMountPath returns the mount path for a specific volume of the pool with the given config.
+func getVolumeMountPath(poolName string, poolConfig map[string]string, volType VolumeType, volName string) string {
+	if shared.IsSnapshot(volName) {
+		return getPoolEntryPath(poolName, poolConfig, fmt.Sprintf("%s-snapshots", string(volType)), volName)
+	}
+
+	return getPoolEntryPath(poolName, poolConfig, string(volType), volName)
+}
+
+// GetVolumeSnapshotDir gets the snapshot mount directory for the parent volume.
+// The pool is assumed to use PoolLayoutNested, use Volume.SnapshotsDir for volumes of pools which may not.
+func GetVolumeSnapshotDir(poolName string, volType VolumeType, volName string) string {
+	return getVolumeSnapshotDir(poolName, nil, volType, volName)
+}
+
+// getVolumeSnapshotDir gets the snapshot mount directory for the parent volume of the pool with the given config.
+func getVolumeSnapshotDir(poolName string, poolConfig map[string]string, volType VolumeType, volName string) string {
+	parent, _, _ := api.GetParentAndSnapshotName(volName)
+	return getPoolEntryPath(poolName, poolConfig, fmt.Sprintf("%s-snapshots", string(volType)), parent)
+}
+
+// GetSnapshotVolumeName returns the full volume name for a parent volume and snapshot name.
+func GetSnapshotVolumeName(parentName, snapshotName string) string {
+	return fmt.Sprintf("%s%s%s", parentName, shared.SnapshotDelimiter, snapshotName)
+}
+
+// createParentSnapshotDirIfMissing creates the parent directory for volume snapshots.
+func createParentSnapshotDirIfMissing(poolName string, poolConfig map[string]string, volType VolumeType, volName string) error {
+	snapshotsPath := getVolumeSnapshotDir(poolName, poolConfig, volType, volName)
+
+	// If it's missing, create it.
+	if !shared.PathExists(snapshotsPath) {
+		err := os.Mkdir(snapshotsPath, 0700)
+		if err != nil {
+			return fmt.Errorf("Failed to create parent snapshot directory %q: %w", snapshotsPath, err)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// CheckSnapshotMinimum returns ErrSnapshotMinimum if removing one of the volume's snapshots would leave fewer
+// than minimum snapshots. The snapshots are counted on the storage device rather than in the database.
+func CheckSnapshotMinimum(d Driver, parentVol Volume, minimum int, op *operations.Operation) error {
+	snapshots, err := d.VolumeSnapshots(parentVol, op)
+	if err != nil {
+		return fmt.Errorf("Failed listing snapshots of %q: %w", parentVol.name, err)
+	}
+
+	if len(snapshots) <= minimum {
+		return fmt.Errorf("Cannot remove snapshot of %q, at least %d must be kept: %w", parentVol.name, minimum, ErrSnapshotMinimum)
+	}
+
+	return nil
+}
+
+// deleteParentSnapshotDirIfEmpty removes the parent snapshot directory if it is empty.
+// It accepts the pool name and config, volume type and parent volume name.
+func deleteParentSnapshotDirIfEmpty(poolName string, poolConfig map[string]string, volType VolumeType, volName string) error {
+	snapshotsPath := getVolumeSnapshotDir(poolName, poolConfig, volType, volName)
+
+	// If it exists, try to delete it.
+	if shared.PathExists(snapshotsPath) {
+		isEmpty, err := shared.PathIsEmpty(snapshotsPath)
+		if err != nil {
+			return err
+		}
+
+		if isEmpty {
+			err := os.Remove(snapshotsPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed to remove '%s': %w", snapshotsPath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dirFootprint returns the disk space used by the trees at paths combined. Each inode is only counted once, so
+// that files hardlinked between the trees (or within one) aren't counted twice.
+func dirFootprint(paths []string) (int64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+
+	var footprint int64
+	seen := map[inode]bool{}
+
+	for _, path := range paths {
+		err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			stat, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				footprint += fi.Size()
+				return nil
+			}
+
+			key := inode{dev: uint64(stat.Dev), ino: stat.Ino}
+			if seen[key] {
+				return nil
+			}
+
+			seen[key] = true
+			footprint += stat.Blocks * 512
+
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("Failed walking %q: %w", path, err)
+		}
+	}
+
+	return footprint, nil
+}
+
+// pruneSnapshotDirs removes the empty parent snapshot directories and the dangling symlinks found directly in the
+// snapshots directories of the pool mounted at poolPath in the given layout, returning the removed paths relative
+// to poolPath sorted. The snapshots themselves (and their content) are never looked into, so empty snapshots are
+// kept.
+func pruneSnapshotDirs(poolPath string, layout string) ([]string, error) {
+	pruned := []string{}
+
+	for _, dirs := range BaseDirectories {
+		if len(dirs) < 2 {
+			continue // No snapshots directory for this volume type.
+		}
+
+		names, err := listPoolLayoutEntries(poolPath, layout, dirs[1])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			relPath := poolLayoutEntryPath(layout, dirs[1], name)
+			entryPath := filepath.Join(poolPath, relPath)
+
+			info, err := os.Lstat(entryPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+
+				return nil, fmt.Errorf("Failed checking %q: %w", entryPath, err)
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				_, err := os.Stat(entryPath)
+				if err == nil || !os.IsNotExist(err) {
+					continue
+				}
+			} else if info.IsDir() {
+				isEmpty, err := shared.PathIsEmpty(entryPath)
+				if err != nil {
+					return nil, err
+				}
+
+				if !isEmpty {
+					continue
+				}
+			} else {
+				continue
+			}
+
+			err = os.Remove(entryPath)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("Failed to remove %q: %w", entryPath, err)
+			}
+
+			pruned = append(pruned, relPath)
+		}
+	}
+
+	sort.Strings(pruned)
+
+	return pruned, nil
+}
+
+// ensureSparseFile creates a sparse empty file at specified location with specified size.
+// If the path already exists, the file is truncated to the requested size.
+func ensureSparseFile(filePath string, sizeBytes int64) error {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %w", filePath, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	err = f.Truncate(sizeBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to create sparse file %s: %w", filePath, err)
+	}
+
+	return f.Close()
+}
+
+// roundVolumeBlockFileSizeBytes parses the supplied size string and then rounds it to the nearest multiple of
+// MinBlockBoundary bytes that is equal to or larger than sizeBytes.
+func roundVolumeBlockFileSizeBytes(sizeBytes int64) int64 {
+	// Qemu requires image files to be in traditional storage block boundaries.
+	// We use 8k here to ensure our images are compatible with all of our backend drivers.
+	if sizeBytes < MinBlockBoundary {
+		sizeBytes = MinBlockBoundary
+	}
+
+	roundedSizeBytes := int64(sizeBytes/MinBlockBoundary) * MinBlockBoundary
+
+	// Ensure the rounded size is at least the size specified in sizeBytes.
+	if roundedSizeBytes < sizeBytes {
+		roundedSizeBytes += MinBlockBoundary
+	}
+
+	// Round the size to closest MinBlockBoundary bytes to avoid qemu boundary issues.
+	return roundedSizeBytes
+}
+
+// ensureVolumeBlockFile creates new block file or enlarges the raw block file for a volume to the specified size.
+// Returns true if resize took place, false if not. Requested size is rounded to nearest block size using
+// roundVolumeBlockFileSizeBytes() before decision whether to resize is taken. Accepts unsupportedResizeTypes
+// list that indicates which volume types it should not attempt to resize (when allowUnsafeResize=false) and
+// instead return ErrNotSupported.
+func ensureVolumeBlockFile(vol Volume, path string, sizeBytes int64, allowUnsafeResize bool, unsupportedResizeTypes ...VolumeType) (bool, error) {
+	if sizeBytes <= 0 {
+		return false, fmt.Errorf("Size cannot be zero")
+	}
+
+	// Get rounded block size to avoid qemu boundary issues.
+	sizeBytes = roundVolumeBlockFileSizeBytes(sizeBytes)
+
+	if shared.PathExists(path) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+
+		oldSizeBytes := fi.Size()
+		if sizeBytes == oldSizeBytes {
+			return false, nil
+		}
+
+		// Only perform pre-resize checks if we are not in "unsafe" mode.
+		// In unsafe mode we expect the caller to know what they are doing and understand the risks.
+		if !allowUnsafeResize {
+			// Reject if would try and resize a volume type that is not supported.
+			// This needs to come before the ErrCannotBeShrunk check below so that any resize attempt
+			// is blocked with ErrNotSupported error.
+			for _, unsupportedType := range unsupportedResizeTypes {
+				if unsupportedType == vol.volType {
+					return false, ErrNotSupported
+				}
+			}
+
+			if sizeBytes < oldSizeBytes {
+				return false, fmt.Errorf("Block volumes cannot be shrunk: %w", ErrCannotBeShrunk)
+			}
+
+			if vol.MountInUse() {
+				return false, ErrInUse // We don't allow online resizing of block volumes.
+			}
+		}
+
+		err = ensureSparseFile(path, sizeBytes)
+		if err != nil {
+			return false, fmt.Errorf("Failed resizing disk image %q to size %d: %w", path, sizeBytes, err)
+		}
+
+		return true, nil
+	}
+
+	// If path doesn't exist, then there has been no filler function supplied to create it from another source.
+	// So instead create an empty volume (use for PXE booting a VM).
+	err := ensureSparseFile(path, sizeBytes)
+	if err != nil {
+		return false, fmt.Errorf("Failed creating disk image %q as size %d: %w", path, sizeBytes, err)
+	}
+
+	return false, nil
+}
+
+// mkfsOptions represents options for filesystem creation.
+type mkfsOptions struct {
+	Label string
+}
+
+// makeFSType creates the provided filesystem.
+func makeFSType(path string, fsType string, options *mkfsOptions) (string, error) {
+	var err error
+	var msg string
+
+	fsOptions := options
+	if fsOptions == nil {
+		fsOptions = &mkfsOptions{}
+	}
+
+	cmd := []string{fmt.Sprintf("mkfs.%s", fsType)}
+	if fsOptions.Label != "" {
+		cmd = append(cmd, "-L", fsOptions.Label)
+	}
+
+	if fsType == "ext4" {
+		cmd = append(cmd, "-E", "nodiscard,lazy_itable_init=0,lazy_journal_init=0")
+	}
+
+	// Always add the path to the device as the last argument for wider compatibility with versions of mkfs.
 	cmd = append(cmd, path)
 
 	msg, err = shared.TryRunCommand(cmd[0], cmd[1:]...)
@@ -491,6 +1283,19 @@ func resolveMountOptions(options string) (uintptr, string) {
 	return mountFlags, strings.Join(tmp, ",")
 }
 
+// validateMountFlags checks that the provided mount options are all known mount flags.
+// Filesystem specific options aren't allowed as they can't be applied to bind mounts.
+func validateMountFlags(value string) error {
+	for _, opt := range strings.Split(value, ",") {
+		_, ok := mountOptions[opt]
+		if !ok {
+			return fmt.Errorf("Unsupported mount option %q", opt)
+		}
+	}
+
+	return nil
+}
+
 // filesystemTypeCanBeShrunk indicates if filesystems of fsType can be shrunk.
 func filesystemTypeCanBeShrunk(fsType string) bool {
 	if fsType == "" {
@@ -671,132 +1476,459 @@ func regenerateFilesystemXFSUUID(devPath string) error {
 	return nil
 }
 
-// copyDevice copies one device path to another using dd running at low priority.
-// It expects outputPath to exist already, so will not create it.
-func copyDevice(inputPath string, outputPath string) error {
-	cmd := []string{
-		"nice", "-n19", // Run dd with low priority to reduce CPU impact on other processes.
-		"dd", fmt.Sprintf("if=%s", inputPath), fmt.Sprintf("of=%s", outputPath),
-		"bs=16M",       // Use large buffer to reduce syscalls and speed up copy.
-		"conv=nocreat", // Don't create output file if missing (expect caller to have created output file).
+// copyDevice copies one device path to another using dd running at low priority.
+// It expects outputPath to exist already, so will not create it.
+func copyDevice(inputPath string, outputPath string) error {
+	cmd := []string{
+		"nice", "-n19", // Run dd with low priority to reduce CPU impact on other processes.
+		"dd", fmt.Sprintf("if=%s", inputPath), fmt.Sprintf("of=%s", outputPath),
+		"bs=16M",       // Use large buffer to reduce syscalls and speed up copy.
+		"conv=nocreat", // Don't create output file if missing (expect caller to have created output file).
+	}
+
+	// Check for Direct I/O support.
+	from, err := os.OpenFile(inputPath, unix.O_DIRECT|unix.O_RDONLY, 0)
+	if err == nil {
+		cmd = append(cmd, "iflag=direct")
+		_ = from.Close()
+	}
+
+	to, err := os.OpenFile(outputPath, unix.O_DIRECT|unix.O_RDONLY, 0)
+	if err == nil {
+		cmd = append(cmd, "oflag=direct")
+		_ = to.Close()
+	}
+
+	_, err = shared.RunCommand(cmd[0], cmd[1:]...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loopFilePath returns the loop file path for a storage pool.
+func loopFilePath(poolName string) string {
+	return filepath.Join(shared.VarPath("disks"), fmt.Sprintf("%s.img", poolName))
+}
+
+// ShiftBtrfsRootfs shifts the BTRFS root filesystem.
+func ShiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
+	return shiftBtrfsRootfs(path, diskIdmap, true)
+}
+
+// UnshiftBtrfsRootfs unshifts the BTRFS root filesystem.
+func UnshiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
+	return shiftBtrfsRootfs(path, diskIdmap, false)
+}
+
+// shiftBtrfsRootfs shiftfs a filesystem that main include read-only subvolumes.
+func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool) error {
+	var err error
+	roSubvols := []string{}
+	subvols, _ := BTRFSSubVolumesGet(path)
+	sort.Strings(subvols)
+	for _, subvol := range subvols {
+		subvol = filepath.Join(path, subvol)
+
+		if !BTRFSSubVolumeIsRo(subvol) {
+			continue
+		}
+
+		roSubvols = append(roSubvols, subvol)
+		_ = BTRFSSubVolumeMakeRw(subvol)
+	}
+
+	if shift {
+		err = diskIdmap.ShiftRootfs(path, nil)
+	} else {
+		err = diskIdmap.UnshiftRootfs(path, nil)
+	}
+
+	for _, subvol := range roSubvols {
+		_ = BTRFSSubVolumeMakeRo(subvol)
+	}
+
+	return err
+}
+
+// BTRFSSubVolumesGet gets subvolumes.
+func BTRFSSubVolumesGet(path string) ([]string, error) {
+	result := []string{}
+
+	// Unprivileged users can't get to fs internals
+	_ = filepath.Walk(path, func(fpath string, fi os.FileInfo, err error) error {
+		// Skip walk errors
+		if err != nil {
+			return nil
+		}
+
+		relPath, err := relPathUnder(path, fpath)
+		if err != nil {
+			return nil
+		}
+
+		// Ignore the base path
+		if relPath == "." {
+			return nil
+		}
+
+		// Subvolumes can only be directories
+		if !fi.IsDir() {
+			return nil
+		}
+
+		// Check if a btrfs subvolume
+		if btrfsIsSubVolume(fpath) {
+			result = append(result, relPath)
+		}
+
+		return nil
+	})
+
+	return result, nil
+}
+
+// btrfsIsSubvolume checks if a given path is a subvolume.
+func btrfsIsSubVolume(subvolPath string) bool {
+	fs := unix.Stat_t{}
+	err := filesystem.Lstat(subvolPath, &fs)
+	if err != nil {
+		return false
+	}
+
+	// Check if BTRFS_FIRST_FREE_OBJECTID
+	if fs.Ino != 256 {
+		return false
+	}
+
+	return true
+}
+
+// lstatFunc has the signature of filesystem.Lstat.
+type lstatFunc func(path string, stat *unix.Stat_t) error
+
+// btrfsPathStat returns whether path exists and whether it is a btrfs subvolume using a single call to lstat, for
+// use in place of shared.PathExists followed by btrfsIsSubVolume.
+func btrfsPathStat(lstat lstatFunc, path string) (bool, bool, error) {
+	fs := unix.Stat_t{}
+	err := lstat(path, &fs)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, false, nil
+		}
+
+		return false, false, fmt.Errorf("Failed checking %q: %w", path, err)
+	}
+
+	// Check if BTRFS_FIRST_FREE_OBJECTID
+	return true, fs.Ino == 256, nil
+}
+
+// VolumeExists returns whether the custom volume of the project exists on the pool and whether it is a btrfs
+// subvolume, with a single lstat of its mount path. The pool is assumed to use PoolLayoutNested.
+func VolumeExists(projectName string, poolName string, volName string) (bool, bool, error) {
+	return btrfsPathStat(filesystem.Lstat, GetVolumeMountPath(poolName, VolumeTypeCustom, project.StorageVolume(projectName, volName)))
+}
+
+// btrfsSubVolumeDiagnose returns a descriptive error explaining why the path isn't recognized as a subvolume by
+// btrfsIsSubVolume, or nil if it is one.
+func btrfsSubVolumeDiagnose(subvolPath string) error {
+	fs := unix.Stat_t{}
+	err := filesystem.Lstat(subvolPath, &fs)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("Subvolume %q doesn't exist: %w", subvolPath, os.ErrNotExist)
+		}
+
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("Permission denied checking subvolume %q: %w", subvolPath, os.ErrPermission)
+		}
+
+		return fmt.Errorf("Failed checking subvolume %q: %w", subvolPath, err)
+	}
+
+	switch fs.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		// Checked below.
+	case unix.S_IFLNK:
+		return fmt.Errorf("Expected subvolume %q is a symlink", subvolPath)
+	case unix.S_IFREG:
+		return fmt.Errorf("Expected subvolume %q is a file", subvolPath)
+	default:
+		return fmt.Errorf("Expected subvolume %q isn't a directory (mode %o)", subvolPath, fs.Mode)
+	}
+
+	// Check if BTRFS_FIRST_FREE_OBJECTID
+	if fs.Ino == 256 {
+		return nil
+	}
+
+	fsType, err := filesystem.Detect(subvolPath)
+	if err == nil && fsType != "btrfs" {
+		return fmt.Errorf("Expected subvolume %q is a directory on a %q file system", subvolPath, fsType)
+	}
+
+	return fmt.Errorf("Expected subvolume %q is a plain directory (inode %d rather than 256)", subvolPath, fs.Ino)
+}
+
+// btrfsSubVolumeError adds the reason why the path isn't a subvolume (if it isn't) to an error returned by an
+// operation on it. The operation's error is wrapped so that callers can still check it.
+func btrfsSubVolumeError(subvolPath string, err error) error {
+	diagErr := btrfsSubVolumeDiagnose(subvolPath)
+	if diagErr == nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", err, diagErr.Error())
+}
+
+// btrfsSubVolumeDefaultMode is the mode of created subvolumes (and of their missing parent directories).
+const btrfsSubVolumeDefaultMode = os.FileMode(0711)
+
+// validateSubVolumeMode checks that the value is an octal permission mode.
+func validateSubVolumeMode(value string) error {
+	_, err := parseSubVolumeMode(value)
+	return err
+}
+
+// parseSubVolumeMode parses an octal permission mode, returning the default mode if empty.
+func parseSubVolumeMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return btrfsSubVolumeDefaultMode, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid mode %q (expects octal permissions like 0711)", value)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// mkdirAllMode creates the directory and any missing parents with the given mode. Unlike os.MkdirAll the
+// created directories get the exact mode regardless of the process umask.
+func mkdirAllMode(path string, mode os.FileMode) error {
+	// Find the directories which are going to be created.
+	missing := []string{}
+	for dir := filepath.Clean(path); !shared.PathExists(dir); dir = filepath.Dir(dir) {
+		missing = append(missing, dir)
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	err := os.MkdirAll(path, mode)
+	if err != nil {
+		return fmt.Errorf("Failed creating directory %q: %w", path, err)
+	}
+
+	for _, dir := range missing {
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return fmt.Errorf("Failed setting mode of %q: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// btrfsSubVolumeCreate creates a subvolume, and any missing parent directories, with the given mode.
+// The mode is set explicitly so that it doesn't depend on the process umask. If owner isn't nil, the root of the
+// subvolume is given its ownership.
+func btrfsSubVolumeCreate(subvolPath string, mode os.FileMode, owner *volumeOwner) error {
+	err := mkdirAllMode(filepath.Dir(subvolPath), mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", subvolPath)
+	if err != nil {
+		// Explain what's in the way if the path already exists.
+		if shared.PathExists(subvolPath) {
+			err = btrfsSubVolumeError(subvolPath, err)
+		}
+
+		return fmt.Errorf("Failed creating subvolume %q: %w", subvolPath, err)
+	}
+
+	err = os.Chmod(subvolPath, mode)
+	if err != nil {
+		_, _ = shared.RunCommand("btrfs", "subvolume", "delete", subvolPath)
+		return fmt.Errorf("Failed setting mode of subvolume %q: %w", subvolPath, err)
+	}
+
+	err = btrfsSubVolumeChown(subvolPath, owner)
+	if err != nil {
+		_, _ = shared.RunCommand("btrfs", "subvolume", "delete", subvolPath)
+		return err
+	}
+
+	return nil
+}
+
+// btrfsSubVolumeChown gives the root of the subvolume the ownership of owner, if not nil. It does nothing if the
+// root already has it, such as for snapshots of already shifted subvolumes.
+func btrfsSubVolumeChown(subvolPath string, owner *volumeOwner) error {
+	if owner == nil {
+		return nil
 	}
 
-	// Check for Direct I/O support.
-	from, err := os.OpenFile(inputPath, unix.O_DIRECT|unix.O_RDONLY, 0)
-	if err == nil {
-		cmd = append(cmd, "iflag=direct")
-		_ = from.Close()
+	st := unix.Stat_t{}
+	err := filesystem.Lstat(subvolPath, &st)
+	if err != nil {
+		return fmt.Errorf("Failed getting ownership of subvolume %q: %w", subvolPath, err)
 	}
 
-	to, err := os.OpenFile(outputPath, unix.O_DIRECT|unix.O_RDONLY, 0)
-	if err == nil {
-		cmd = append(cmd, "oflag=direct")
-		_ = to.Close()
+	if int(st.Uid) == owner.uid && int(st.Gid) == owner.gid {
+		return nil
 	}
 
-	_, err = shared.RunCommand(cmd[0], cmd[1:]...)
+	err = os.Lchown(subvolPath, owner.uid, owner.gid)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed setting ownership of subvolume %q: %w", subvolPath, err)
 	}
 
 	return nil
 }
 
-// loopFilePath returns the loop file path for a storage pool.
-func loopFilePath(poolName string) string {
-	return filepath.Join(shared.VarPath("disks"), fmt.Sprintf("%s.img", poolName))
+// sysDevBlockPath is the sysfs directory listing block devices by their major:minor numbers.
+var sysDevBlockPath = "/sys/dev/block"
+
+// blockDevSysPath returns the sysfs directory of the given block device.
+// ErrNotSupported is returned if the path isn't a block device.
+func blockDevSysPath(devPath string) (string, error) {
+	number, err := blockDevNumber(devPath)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(sysDevBlockPath, number), nil
 }
 
-// ShiftBtrfsRootfs shifts the BTRFS root filesystem.
-func ShiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
-	return shiftBtrfsRootfs(path, diskIdmap, true)
+// blockDevNumber returns the "major:minor" of the given block device.
+// ErrNotSupported is returned if the path isn't a block device.
+func blockDevNumber(devPath string) (string, error) {
+	st := unix.Stat_t{}
+	err := filesystem.Stat(devPath, &st)
+	if err != nil {
+		return "", fmt.Errorf("Failed getting device information for %q: %w", devPath, err)
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%q isn't a block device: %w", devPath, ErrNotSupported)
+	}
+
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
 }
 
-// UnshiftBtrfsRootfs unshifts the BTRFS root filesystem.
-func UnshiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet) error {
-	return shiftBtrfsRootfs(path, diskIdmap, false)
+// setBlockDevReadAhead sets the read-ahead of the block device with the given sysfs directory.
+// Partitions don't have a request queue of their own, so the read-ahead of their parent device is set instead.
+func setBlockDevReadAhead(sysPath string, readAheadKB uint64) error {
+	sysPath, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return fmt.Errorf("Failed resolving %q: %w", sysPath, err)
+	}
+
+	readAheadPath := filepath.Join(sysPath, "queue", "read_ahead_kb")
+	if !shared.PathExists(readAheadPath) {
+		readAheadPath = filepath.Join(filepath.Dir(sysPath), "queue", "read_ahead_kb")
+	}
+
+	err = os.WriteFile(readAheadPath, []byte(fmt.Sprintf("%d\n", readAheadKB)), 0)
+	if err != nil {
+		return fmt.Errorf("Failed writing %q: %w", readAheadPath, err)
+	}
+
+	return nil
 }
 
-// shiftBtrfsRootfs shiftfs a filesystem that main include read-only subvolumes.
-func shiftBtrfsRootfs(path string, diskIdmap *idmap.IdmapSet, shift bool) error {
-	var err error
-	roSubvols := []string{}
-	subvols, _ := BTRFSSubVolumesGet(path)
-	sort.Strings(subvols)
-	for _, subvol := range subvols {
-		subvol = filepath.Join(path, subvol)
+// btrfsEnsureSubVolume makes sure that the given path is a subvolume. If a plain directory is found in its
+// place (e.g. left behind by a failed receive), its content is copied into a new subvolume which is then
+// swapped in. An error is returned if the conversion isn't safe to perform.
+func btrfsEnsureSubVolume(subvolPath string) error {
+	if btrfsIsSubVolume(subvolPath) {
+		return nil
+	}
 
-		if !BTRFSSubVolumeIsRo(subvol) {
-			continue
-		}
+	fi, err := os.Lstat(subvolPath)
+	if err != nil {
+		return fmt.Errorf("Failed checking subvolume %q: %w", subvolPath, err)
+	}
 
-		roSubvols = append(roSubvols, subvol)
-		_ = BTRFSSubVolumeMakeRw(subvol)
+	if !fi.IsDir() {
+		return fmt.Errorf("Cannot convert %q into a subvolume as it isn't a directory", subvolPath)
 	}
 
-	if shift {
-		err = diskIdmap.ShiftRootfs(path, nil)
-	} else {
-		err = diskIdmap.UnshiftRootfs(path, nil)
+	if filesystem.IsMountPoint(subvolPath) {
+		return fmt.Errorf("Cannot convert %q into a subvolume as it is a mount point", subvolPath)
 	}
 
-	for _, subvol := range roSubvols {
-		_ = BTRFSSubVolumeMakeRo(subvol)
+	fsType, err := filesystem.Detect(subvolPath)
+	if err != nil {
+		return fmt.Errorf("Failed detecting file system of %q: %w", subvolPath, err)
 	}
 
-	return err
-}
+	if fsType != "btrfs" {
+		return fmt.Errorf("Cannot convert %q into a subvolume as it is on a %q file system", subvolPath, fsType)
+	}
 
-// BTRFSSubVolumesGet gets subvolumes.
-func BTRFSSubVolumesGet(path string) ([]string, error) {
-	result := []string{}
+	// Nested subvolumes wouldn't be carried over by the copy.
+	subvols, err := BTRFSSubVolumesGet(subvolPath)
+	if err != nil {
+		return err
+	}
 
-	if !strings.HasSuffix(path, "/") {
-		path = path + "/"
+	if len(subvols) > 0 {
+		return fmt.Errorf("Cannot convert %q into a subvolume as it contains subvolumes", subvolPath)
 	}
 
-	// Unprivileged users can't get to fs internals
-	_ = filepath.Walk(path, func(fpath string, fi os.FileInfo, err error) error {
-		// Skip walk errors
-		if err != nil {
-			return nil
+	newPath := fmt.Sprintf("%s.subvol", subvolPath)
+	oldPath := fmt.Sprintf("%s.old", subvolPath)
+	for _, path := range []string{newPath, oldPath} {
+		if shared.PathExists(path) {
+			return fmt.Errorf("Cannot convert %q into a subvolume as %q already exists", subvolPath, path)
 		}
+	}
 
-		// Ignore the base path
-		if strings.TrimRight(fpath, "/") == strings.TrimRight(path, "/") {
-			return nil
-		}
+	revert := revert.New()
+	defer revert.Fail()
 
-		// Subvolumes can only be directories
-		if !fi.IsDir() {
-			return nil
-		}
+	_, err = shared.RunCommand("btrfs", "subvolume", "create", newPath)
+	if err != nil {
+		return fmt.Errorf("Failed creating subvolume %q: %w", newPath, err)
+	}
 
-		// Check if a btrfs subvolume
-		if btrfsIsSubVolume(fpath) {
-			result = append(result, strings.TrimPrefix(fpath, path))
-		}
+	revert.Add(func() { _, _ = shared.RunCommand("btrfs", "subvolume", "delete", newPath) })
 
-		return nil
-	})
+	// Copy the content and attributes of the directory, sharing extents where possible.
+	_, err = shared.RunCommand("cp", "-a", "--reflink=auto", fmt.Sprintf("%s/.", subvolPath), newPath)
+	if err != nil {
+		return fmt.Errorf("Failed copying %q into subvolume %q: %w", subvolPath, newPath, err)
+	}
 
-	return result, nil
-}
+	// Swap the new subvolume in place of the directory.
+	err = os.Rename(subvolPath, oldPath)
+	if err != nil {
+		return fmt.Errorf("Failed renaming %q to %q: %w", subvolPath, oldPath, err)
+	}
 
-// btrfsIsSubvolume checks if a given path is a subvolume.
-func btrfsIsSubVolume(subvolPath string) bool {
-	fs := unix.Stat_t{}
-	err := unix.Lstat(subvolPath, &fs)
+	revert.Add(func() { _ = os.Rename(oldPath, subvolPath) })
+
+	err = os.Rename(newPath, subvolPath)
 	if err != nil {
-		return false
+		return fmt.Errorf("Failed renaming %q to %q: %w", newPath, subvolPath, err)
 	}
 
-	// Check if BTRFS_FIRST_FREE_OBJECTID
-	if fs.Ino != 256 {
-		return false
+	revert.Success()
+
+	err = os.RemoveAll(oldPath)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", oldPath, err)
 	}
 
-	return true
+	return nil
 }
 
 // BTRFSSubVolumeIsRo returns if subvolume is read only.
@@ -874,7 +2006,7 @@ func OperationLockName(operationName string, poolName string, volType VolumeType
 // This is based on the free space available in LXD's VarPath().
 func loopFileSizeDefault() (uint64, error) {
 	st := unix.Statfs_t{}
-	err := unix.Statfs(shared.VarPath(), &st)
+	err := filesystem.Statfs(shared.VarPath(), &st)
 	if err != nil {
 		return 0, fmt.Errorf("Couldn't statfs %q: %w", shared.VarPath(), err)
 	}
@@ -910,8 +2042,253 @@ func loopDeviceSetup(sourcePath string) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
+// loopDeviceFind returns the path of the loop device backed by the file at backingPath, or an empty string if the
+// file isn't attached to a loop device.
+func loopDeviceFind(backingPath string) (string, error) {
+	backingPath, err := filepath.EvalSymlinks(backingPath)
+	if err != nil {
+		return "", err
+	}
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return "", err
+	}
+
+	for _, backingFile := range backingFiles {
+		content, err := os.ReadFile(backingFile)
+		if err != nil {
+			continue // The loop device was detached meanwhile.
+		}
+
+		if strings.TrimSpace(string(content)) == backingPath {
+			return filepath.Join("/dev", filepath.Base(filepath.Dir(filepath.Dir(backingFile)))), nil
+		}
+	}
+
+	return "", nil
+}
+
+// loopDeviceSetCapacity makes the loop device at loopDevPath pick up the current size of its backing file.
+func loopDeviceSetCapacity(loopDevPath string) error {
+	f, err := os.Open(loopDevPath)
+	if err != nil {
+		return fmt.Errorf("Failed opening loop device %q: %w", loopDevPath, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	err = unix.IoctlSetInt(int(f.Fd()), unix.LOOP_SET_CAPACITY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed updating capacity of loop device %q: %w", loopDevPath, err)
+	}
+
+	return nil
+}
+
 // loopFileAutoDetach enables auto detach mode for a loop device.
 func loopDeviceAutoDetach(loopDevPath string) error {
 	_, err := shared.RunCommand("losetup", "--detach", loopDevPath)
 	return err
 }
+
+// validateTempDir checks that a "temp_dir" value is an existing writable directory.
+func validateTempDir(value string) error {
+	if !filepath.IsAbs(value) {
+		return fmt.Errorf("Path %q must be absolute", value)
+	}
+
+	if !shared.IsDir(value) {
+		return fmt.Errorf("Path %q isn't a directory", value)
+	}
+
+	err := unix.Access(value, unix.W_OK)
+	if err != nil {
+		return fmt.Errorf("Directory %q isn't writable: %w", value, err)
+	}
+
+	return nil
+}
+
+// poolTempDir returns the directory to stage data in for a pool, which is its "temp_dir" if set and fallback
+// otherwise. If renameTarget isn't empty, the staged data will be renamed into it and so the directory must be
+// on the same filesystem.
+func poolTempDir(poolConfig map[string]string, fallback string, renameTarget string) (string, error) {
+	tempDir := poolConfig["temp_dir"]
+	if tempDir == "" {
+		return fallback, nil
+	}
+
+	if renameTarget != "" {
+		var tempDirStat, targetStat unix.Stat_t
+
+		err := filesystem.Stat(tempDir, &tempDirStat)
+		if err != nil {
+			return "", fmt.Errorf("Failed getting info of temp_dir %q: %w", tempDir, err)
+		}
+
+		err = filesystem.Stat(renameTarget, &targetStat)
+		if err != nil {
+			return "", fmt.Errorf("Failed getting info of %q: %w", renameTarget, err)
+		}
+
+		if tempDirStat.Dev != targetStat.Dev {
+			return "", fmt.Errorf("The temp_dir %q must be on the same filesystem as %q", tempDir, renameTarget)
+		}
+	}
+
+	return tempDir, nil
+}
+
+// SortReclaimableSpace sorts the snapshots by reclaimable space, largest first, and then by name.
+func SortReclaimableSpace(snapshots []SnapshotReclaimableSpace) {
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].Reclaimable != snapshots[j].Reclaimable {
+			return snapshots[i].Reclaimable > snapshots[j].Reclaimable
+		}
+
+		return snapshots[i].Name < snapshots[j].Name
+	})
+}
+
+// MigrationSizeEstimate returns an estimate of the space the volume and the snapshots being sent with it take on
+// the target: the usage of the volume plus the exclusive space of the snapshots when the driver can report it.
+// It returns 0 if the usage of the volume is unknown.
+func MigrationSizeEstimate(d Driver, vol Volume, snapshots []string) int64 {
+	estimate, err := d.GetVolumeUsage(vol)
+	if err != nil || estimate <= 0 {
+		return 0
+	}
+
+	if len(snapshots) > 0 {
+		report, err := d.GetSnapshotsReclaimableSpace(vol, snapshots)
+		if err == nil && report.Method != "" {
+			for _, snap := range report.Snapshots {
+				estimate += snap.Reclaimable
+			}
+		}
+	}
+
+	return estimate
+}
+
+// DiffVolumePaths compares the trees at oldPath and newPath file by file and returns the paths which were added,
+// modified or deleted at newPath. An entry is modified if its type, permissions or ownership changed, if the
+// target of a symlink changed or if the size or modification time of a regular file changed. The owners of the
+// entries at newPath are shifted out of newIdmap, if not nil, before being compared, so that a shifted container
+// compares with its image. The root of the trees itself isn't reported.
+func DiffVolumePaths(oldPath string, newPath string, newIdmap *idmap.IdmapSet) (*VolumeDiff, error) {
+	diff := &VolumeDiff{Added: []string{}, Modified: []string{}, Deleted: []string{}}
+
+	// walk calls fn with the path relative to rootPath of each entry of the tree, the root excluded.
+	walk := func(rootPath string, fn func(relPath string, fi os.FileInfo) error) error {
+		return filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relPath, err := filepath.Rel(rootPath, path)
+			if err != nil {
+				return err
+			}
+
+			if relPath == "." {
+				return nil
+			}
+
+			return fn("/"+relPath, fi)
+		})
+	}
+
+	err := walk(newPath, func(relPath string, fi os.FileInfo) error {
+		oldFi, err := os.Lstat(filepath.Join(oldPath, relPath))
+		if err != nil {
+			if os.IsNotExist(err) {
+				diff.Added = append(diff.Added, relPath)
+				return nil
+			}
+
+			return err
+		}
+
+		modified, err := diffVolumePathModified(filepath.Join(oldPath, relPath), oldFi, filepath.Join(newPath, relPath), fi, newIdmap)
+		if err != nil {
+			return err
+		}
+
+		if modified {
+			diff.Modified = append(diff.Modified, relPath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed comparing %q with %q: %w", newPath, oldPath, err)
+	}
+
+	err = walk(oldPath, func(relPath string, fi os.FileInfo) error {
+		_, err := os.Lstat(filepath.Join(newPath, relPath))
+		if err != nil {
+			if os.IsNotExist(err) {
+				diff.Deleted = append(diff.Deleted, relPath)
+				return nil
+			}
+
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed comparing %q with %q: %w", oldPath, newPath, err)
+	}
+
+	return diff, nil
+}
+
+// diffVolumePathModified returns whether the entry at newPath, whose owner is shifted out of newIdmap if not nil,
+// differs from the entry of the same path at oldPath.
+func diffVolumePathModified(oldPath string, oldFi os.FileInfo, newPath string, newFi os.FileInfo, newIdmap *idmap.IdmapSet) (bool, error) {
+	if oldFi.Mode() != newFi.Mode() {
+		return true, nil
+	}
+
+	newStat, ok := newFi.Sys().(*syscall.Stat_t)
+	if ok && diffVolumeOwnerChanged(oldFi, int64(newStat.Uid), int64(newStat.Gid), newIdmap) {
+		return true, nil
+	}
+
+	switch {
+	case newFi.Mode().IsRegular():
+		return oldFi.Size() != newFi.Size() || !oldFi.ModTime().Equal(newFi.ModTime()), nil
+	case newFi.Mode()&os.ModeSymlink != 0:
+		oldTarget, err := os.Readlink(oldPath)
+		if err != nil {
+			return false, err
+		}
+
+		newTarget, err := os.Readlink(newPath)
+		if err != nil {
+			return false, err
+		}
+
+		return oldTarget != newTarget, nil
+	}
+
+	return false, nil
+}
+
+// diffVolumeOwnerChanged returns whether the owner of the entry described by oldFi differs from uid and gid, once
+// shifted out of idmapSet if not nil.
+func diffVolumeOwnerChanged(oldFi os.FileInfo, uid int64, gid int64, idmapSet *idmap.IdmapSet) bool {
+	oldStat, ok := oldFi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	if idmapSet != nil {
+		uid, gid = idmapSet.ShiftFromNs(uid, gid)
+	}
+
+	return int64(oldStat.Uid) != uid || int64(oldStat.Gid) != gid
+}
@@ -0,0 +1,267 @@
+package drivers
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/idmap"
+	"github.com/lxc/lxd/shared/instancewriter"
+)
+
+// OCI media types and whiteout markers used when exporting volumes as OCI image layers.
+const (
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociWhiteoutPrefix    = ".wh."
+	ociWhiteoutOpaque    = ".wh..wh..opq"
+)
+
+// ociLayoutBlob is the content of the oci-layout file of an OCI image layout.
+var ociLayoutBlob = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+
+// OCIImageConfig is the minimal OCI image configuration to include alongside an exported layer.
+type OCIImageConfig struct {
+	Architecture string   `json:"architecture" yaml:"architecture"`
+	OS           string   `json:"os" yaml:"os"`
+	Entrypoint   []string `json:"entrypoint" yaml:"entrypoint"`
+	Cmd          []string `json:"cmd" yaml:"cmd"`
+	Env          []string `json:"env" yaml:"env"`
+	WorkingDir   string   `json:"working_dir" yaml:"working_dir"`
+}
+
+// ociDescriptor references a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociImage is the OCI image configuration blob.
+type ociImage struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Entrypoint []string `json:"Entrypoint,omitempty"`
+		Cmd        []string `json:"Cmd,omitempty"`
+		Env        []string `json:"Env,omitempty"`
+		WorkingDir string   `json:"WorkingDir,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ociManifest is the OCI image manifest blob.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociIndex is the index.json of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociLayerWrite writes the content of rootPath to w as an uncompressed OCI image layer tarball, unshifting the
+// ownership of the files with idmapSet if set. Overlay whiteouts (0:0 character devices) are converted to ".wh.<name>" files and overlay opaque directories get
+// a ".wh..wh..opq" marker. Files whose name starts with ".wh." can't be represented in a layer and are refused.
+func ociLayerWrite(w io.Writer, rootPath string, idmapSet *idmap.IdmapSet) error {
+	tarWriter := instancewriter.NewRootfsTarWriter(w, idmapSet)
+
+	err := filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := relPathUnder(rootPath, path)
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		if strings.HasPrefix(fi.Name(), ociWhiteoutPrefix) {
+			return fmt.Errorf("Cannot export %q as its name is reserved for OCI whiteouts", name)
+		}
+
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			_, _, major, minor, _, _, err := shared.GetFileStat(path)
+			if err != nil {
+				return fmt.Errorf("Failed to get file stat %q: %w", path, err)
+			}
+
+			if major == 0 && minor == 0 {
+				whiteoutName := filepath.Join(filepath.Dir(name), ociWhiteoutPrefix+fi.Name())
+
+				return ociWriteMarker(tarWriter, whiteoutName, fi.ModTime())
+			}
+		}
+
+		err = tarWriter.WriteFile(name, path, fi, false)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			opaque := make([]byte, 1)
+			n, err := unix.Lgetxattr(path, "trusted.overlay.opaque", opaque)
+			if err == nil && n == 1 && opaque[0] == 'y' {
+				return ociWriteMarker(tarWriter, filepath.Join(name, ociWhiteoutOpaque), fi.ModTime())
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed writing OCI layer of %q: %w", rootPath, err)
+	}
+
+	return tarWriter.Close()
+}
+
+// ociWriteMarker adds an empty whiteout marker file to the layer.
+func ociWriteMarker(tarWriter *instancewriter.InstanceTarWriter, name string, modTime time.Time) error {
+	fi := instancewriter.FileInfo{
+		FileName:    name,
+		FileSize:    0,
+		FileMode:    0600,
+		FileModTime: modTime,
+	}
+
+	return tarWriter.WriteFileFromReader(bytes.NewReader(nil), &fi)
+}
+
+// ociExport writes the content of rootPath to w as an OCI image layer tarball. If config is set, an OCI image
+// layout tarball (index, manifest, config and layer) is written instead, staging the layer in tmpDir to get its
+// digest before streaming it.
+func ociExport(w io.Writer, rootPath string, config *OCIImageConfig, idmapSet *idmap.IdmapSet, tmpDir string) error {
+	if config == nil {
+		return ociLayerWrite(w, rootPath, idmapSet)
+	}
+
+	layerFile, err := os.CreateTemp(tmpDir, "oci-layer.")
+	if err != nil {
+		return fmt.Errorf("Failed creating OCI layer file: %w", err)
+	}
+
+	defer func() {
+		_ = layerFile.Close()
+		_ = os.Remove(layerFile.Name())
+	}()
+
+	layerHash := sha256.New()
+	err = ociLayerWrite(io.MultiWriter(layerFile, layerHash), rootPath, idmapSet)
+	if err != nil {
+		return err
+	}
+
+	layerSize, err := layerFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	layerDigest := fmt.Sprintf("sha256:%x", layerHash.Sum(nil))
+
+	image := ociImage{Architecture: config.Architecture, OS: config.OS}
+	image.Config.Entrypoint = config.Entrypoint
+	image.Config.Cmd = config.Cmd
+	image.Config.Env = config.Env
+	image.Config.WorkingDir = config.WorkingDir
+	image.RootFS.Type = "layers"
+	image.RootFS.DiffIDs = []string{layerDigest} // The layer is uncompressed.
+
+	imageBlob, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+
+	manifestBlob, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config:        ociDescriptor{MediaType: ociMediaTypeConfig, Digest: ociDigest(imageBlob), Size: int64(len(imageBlob))},
+		Layers:        []ociDescriptor{{MediaType: ociMediaTypeLayer, Digest: layerDigest, Size: layerSize}},
+	})
+	if err != nil {
+		return err
+	}
+
+	indexBlob, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeIndex,
+		Manifests:     []ociDescriptor{{MediaType: ociMediaTypeManifest, Digest: ociDigest(manifestBlob), Size: int64(len(manifestBlob))}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = layerFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(w)
+	modTime := time.Now()
+
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		err = tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: modTime})
+		if err != nil {
+			return err
+		}
+	}
+
+	entries := []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{"oci-layout", int64(len(ociLayoutBlob)), bytes.NewReader(ociLayoutBlob)},
+		{"index.json", int64(len(indexBlob)), bytes.NewReader(indexBlob)},
+		{ociBlobPath(ociDigest(manifestBlob)), int64(len(manifestBlob)), bytes.NewReader(manifestBlob)},
+		{ociBlobPath(ociDigest(imageBlob)), int64(len(imageBlob)), bytes.NewReader(imageBlob)},
+		{ociBlobPath(layerDigest), layerSize, layerFile},
+	}
+
+	for _, entry := range entries {
+		err = tarWriter.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: entry.name, Mode: 0644, Size: entry.size, ModTime: modTime})
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tarWriter, entry.r)
+		if err != nil {
+			return fmt.Errorf("Failed writing %q: %w", entry.name, err)
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// ociDigest returns the sha256 digest of an OCI blob.
+func ociDigest(blob []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+}
+
+// ociBlobPath returns the path of a blob within an OCI image layout.
+func ociBlobPath(digest string) string {
+	return filepath.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
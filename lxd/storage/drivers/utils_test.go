@@ -1,9 +1,25 @@
 package drivers
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/lxd/lxd/storage/filesystem"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/idmap"
 )
 
 // Test GetVolumeMountPath.
@@ -35,3 +51,1186 @@ func TestGetVolumeMountPath(t *testing.T) {
 	expected = GetPoolMountPath(poolName) + "/virtual-machines/testvol"
 	assert.Equal(t, expected, path)
 }
+
+// Test the mount paths and snapshot directories of volumes of pools using the flat layout.
+func TestGetVolumeMountPathFlatLayout(t *testing.T) {
+	poolName := "testpool-flat"
+	poolConfig := map[string]string{"btrfs.layout": PoolLayoutFlat}
+
+	// Test container volume.
+	vol := NewVolume(nil, poolName, VolumeTypeContainer, ContentTypeFS, "c1", nil, poolConfig)
+	expected := GetPoolMountPath(poolName) + "/containers_c1"
+	assert.Equal(t, expected, vol.MountPath())
+
+	// Test container volume snapshot.
+	snapVol, err := vol.NewSnapshot("snap0")
+	require.NoError(t, err)
+	expected = GetPoolMountPath(poolName) + "/containers-snapshots_c1/snap0"
+	assert.Equal(t, expected, snapVol.MountPath())
+
+	// Test snapshot directory.
+	expected = GetPoolMountPath(poolName) + "/containers-snapshots_c1"
+	assert.Equal(t, expected, snapVol.SnapshotsDir())
+	assert.Equal(t, expected, vol.SnapshotsDir())
+
+	// Test volume type directory.
+	assert.Equal(t, GetPoolMountPath(poolName), getVolumeMountPath(poolName, poolConfig, VolumeTypeCustom, ""))
+
+	// Pools using the nested layout, or not setting one, use nested paths.
+	for _, config := range []map[string]string{{"btrfs.layout": PoolLayoutNested}, nil} {
+		snapVol = NewVolume(nil, poolName, VolumeTypeContainer, ContentTypeFS, "c1/snap0", nil, config)
+		expected = GetPoolMountPath(poolName) + "/containers-snapshots/c1/snap0"
+		assert.Equal(t, expected, snapVol.MountPath())
+	}
+}
+
+// Test that volumes and snapshots created in either pool layout can be listed back.
+func TestPoolLayoutRoundTrip(t *testing.T) {
+	for _, layout := range []string{PoolLayoutNested, PoolLayoutFlat} {
+		t.Run(layout, func(t *testing.T) {
+			t.Setenv("LXD_DIR", t.TempDir())
+
+			d := &mock{}
+			d.name = "testpool"
+			d.config = map[string]string{"btrfs.layout": layout}
+
+			for _, volType := range []VolumeType{VolumeTypeCustom, VolumeTypeImage, VolumeTypeContainer, VolumeTypeVM} {
+				for _, dir := range BaseDirectories[volType] {
+					err := os.MkdirAll(filepath.Join(GetPoolMountPath(d.name), dir), 0711)
+					assert.NoError(t, err)
+				}
+			}
+
+			vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, d.config)
+			err := os.MkdirAll(vol.MountPath(), 0711)
+			assert.NoError(t, err)
+
+			snapVol, err := vol.NewSnapshot("snap0")
+			assert.NoError(t, err)
+
+			err = createParentSnapshotDirIfMissing(d.name, d.config, vol.volType, vol.name)
+			assert.NoError(t, err)
+
+			err = os.MkdirAll(snapVol.MountPath(), 0711)
+			assert.NoError(t, err)
+
+			snapshots, err := genericVFSVolumeSnapshots(d, vol, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"snap0"}, snapshots)
+
+			vols, err := genericVFSListVolumes(d)
+			assert.NoError(t, err)
+			assert.Len(t, vols, 1)
+			assert.Equal(t, "c1", vols[0].Name())
+			assert.Equal(t, VolumeTypeContainer, vols[0].Type())
+
+			err = os.Remove(snapVol.MountPath())
+			assert.NoError(t, err)
+
+			err = deleteParentSnapshotDirIfEmpty(d.name, d.config, vol.volType, vol.name)
+			assert.NoError(t, err)
+			assert.NoDirExists(t, vol.SnapshotsDir())
+		})
+	}
+}
+
+// Test that the snapshots of pools sharing a snapshots mount base are kept apart, reached through the pool and
+// pruned and deleted with their pool.
+func TestSnapshotsMountBase(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+	base := t.TempDir()
+
+	pools := []*dir{}
+	for _, poolName := range []string{"pool1", "pool2"} {
+		d := &dir{}
+		d.name = poolName
+		d.config = map[string]string{"source": GetPoolMountPath(poolName), "snapshots.mount_base": base}
+		pools = append(pools, d)
+
+		assert.Equal(t, filepath.Join(base, poolName), GetPoolSnapshotsPath(poolName, base))
+		assert.Equal(t, GetPoolMountPath(poolName), GetPoolSnapshotsPath(poolName, ""))
+
+		err := os.MkdirAll(GetPoolMountPath(poolName), 0711)
+		require.NoError(t, err)
+
+		for _, dirName := range BaseDirectories[VolumeTypeContainer] {
+			if !strings.HasSuffix(dirName, "-snapshots") {
+				err = os.MkdirAll(filepath.Join(GetPoolMountPath(poolName), dirName), 0711)
+				require.NoError(t, err)
+				continue
+			}
+
+			err = LinkPoolSnapshotsDir(poolName, base, dirName)
+			require.NoError(t, err)
+
+			// Linking again on the next mount is fine.
+			err = LinkPoolSnapshotsDir(poolName, base, dirName)
+			require.NoError(t, err)
+		}
+
+		vol := NewVolume(d, poolName, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+		err = os.MkdirAll(vol.MountPath(), 0711)
+		require.NoError(t, err)
+
+		snapVol, err := vol.NewSnapshot("snap0")
+		require.NoError(t, err)
+
+		err = createParentSnapshotDirIfMissing(poolName, d.config, vol.volType, vol.name)
+		require.NoError(t, err)
+
+		err = os.MkdirAll(snapVol.MountPath(), 0711)
+		require.NoError(t, err)
+
+		// The snapshot is stored in the pool's directory within the base.
+		assert.DirExists(t, filepath.Join(base, poolName, "containers-snapshots", "c1", "snap0"))
+
+		snapshots, err := genericVFSVolumeSnapshots(d, vol, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"snap0"}, snapshots)
+	}
+
+	// An existing snapshot directory isn't replaced by a link.
+	err := os.MkdirAll(shared.VarPath("storage-pools", "pool3", "containers-snapshots"), 0711)
+	require.NoError(t, err)
+	err = LinkPoolSnapshotsDir("pool3", base, "containers-snapshots")
+	assert.ErrorContains(t, err, "already exists")
+
+	// The empty parent snapshot directories are pruned from the base.
+	err = os.MkdirAll(filepath.Join(base, "pool1", "containers-snapshots", "c2"), 0711)
+	require.NoError(t, err)
+
+	pruned, err := pools[0].PruneSnapshotDirs(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"containers-snapshots/c2"}, pruned)
+	assert.NoDirExists(t, filepath.Join(base, "pool1", "containers-snapshots", "c2"))
+
+	// Deleting a pool leaves the snapshots of the other one alone.
+	err = pools[0].Delete(nil)
+	require.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(base, "pool1"))
+	assert.DirExists(t, filepath.Join(base, "pool2", "containers-snapshots", "c1", "snap0"))
+}
+
+// Test validateSnapshotsMountBase.
+func TestValidateSnapshotsMountBase(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	assert.NoError(t, validateSnapshotsMountBase("/srv/snapshots"))
+	assert.Error(t, validateSnapshotsMountBase("snapshots"))
+	assert.Error(t, validateSnapshotsMountBase(shared.VarPath("storage-pools", "testpool", "snapshots")))
+}
+
+// Test that CheckSnapshotMinimum allows deleting down to the minimum and blocks at it.
+func TestCheckSnapshotMinimum(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+	d.name = "testpool"
+
+	vol := NewVolume(d, d.name, VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)
+	snapNames := []string{"snap0", "snap1", "snap2"}
+	for _, snapName := range snapNames {
+		snapVol, err := vol.NewSnapshot(snapName)
+		assert.NoError(t, err)
+
+		err = os.MkdirAll(snapVol.MountPath(), 0711)
+		assert.NoError(t, err)
+	}
+
+	// Deleting down to the minimum is allowed.
+	assert.NoError(t, CheckSnapshotMinimum(d, vol, 1, nil))
+	assert.NoError(t, os.Remove(GetVolumeMountPath(d.name, vol.volType, "c1/snap2")))
+	assert.NoError(t, CheckSnapshotMinimum(d, vol, 1, nil))
+	assert.NoError(t, os.Remove(GetVolumeMountPath(d.name, vol.volType, "c1/snap1")))
+
+	// Blocked once at the minimum.
+	assert.ErrorIs(t, CheckSnapshotMinimum(d, vol, 1, nil), ErrSnapshotMinimum)
+
+	// A higher minimum blocks earlier.
+	assert.ErrorIs(t, CheckSnapshotMinimum(d, vol, 2, nil), ErrSnapshotMinimum)
+}
+
+// Test that btrfsEnsureSubVolume refuses to convert paths which can't safely be turned into a subvolume.
+func TestBtrfsEnsureSubVolume(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	fsType, err := filesystem.Detect(tmpDir)
+	if err != nil || fsType == "btrfs" {
+		t.Skip("Test requires a non-btrfs temporary directory")
+	}
+
+	// A plain directory masquerading as a subvolume.
+	subvolPath := filepath.Join(tmpDir, "containers", "c1")
+	err = os.MkdirAll(filepath.Join(subvolPath, "rootfs"), 0711)
+	assert.NoError(t, err)
+	assert.False(t, btrfsIsSubVolume(subvolPath))
+
+	err = btrfsEnsureSubVolume(subvolPath)
+	assert.ErrorContains(t, err, "file system")
+	assert.DirExists(t, filepath.Join(subvolPath, "rootfs"))
+	assert.NoDirExists(t, subvolPath+".subvol")
+
+	// A file in place of the subvolume.
+	filePath := filepath.Join(tmpDir, "containers", "c2")
+	err = os.WriteFile(filePath, []byte("test"), 0600)
+	assert.NoError(t, err)
+
+	err = btrfsEnsureSubVolume(filePath)
+	assert.ErrorContains(t, err, "isn't a directory")
+
+	// A missing path.
+	err = btrfsEnsureSubVolume(filepath.Join(tmpDir, "containers", "c3"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// Test that btrfsSubVolumeDiagnose explains why paths aren't subvolumes.
+func TestBtrfsSubVolumeDiagnose(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// A missing path.
+	err := btrfsSubVolumeDiagnose(filepath.Join(tmpDir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorContains(t, err, "doesn't exist")
+
+	// A file.
+	filePath := filepath.Join(tmpDir, "file")
+	require.NoError(t, os.WriteFile(filePath, []byte("test"), 0600))
+	assert.ErrorContains(t, btrfsSubVolumeDiagnose(filePath), "is a file")
+
+	// A symlink to a directory.
+	linkPath := filepath.Join(tmpDir, "link")
+	require.NoError(t, os.Symlink(tmpDir, linkPath))
+	assert.ErrorContains(t, btrfsSubVolumeDiagnose(linkPath), "is a symlink")
+
+	// A plain directory.
+	dirPath := filepath.Join(tmpDir, "dir")
+	require.NoError(t, os.Mkdir(dirPath, 0700))
+
+	fi := unix.Stat_t{}
+	require.NoError(t, unix.Lstat(dirPath, &fi))
+	if fi.Ino != 256 {
+		fsType, err := filesystem.Detect(dirPath)
+		require.NoError(t, err)
+
+		if fsType == "btrfs" {
+			assert.ErrorContains(t, btrfsSubVolumeDiagnose(dirPath), "is a plain directory")
+		} else {
+			assert.ErrorContains(t, btrfsSubVolumeDiagnose(dirPath), fmt.Sprintf("on a %q file system", fsType))
+		}
+	}
+
+	// The diagnosis is added to the operation's error.
+	opErr := fmt.Errorf("Operation failed")
+	err = btrfsSubVolumeError(filePath, opErr)
+	assert.ErrorContains(t, err, "Operation failed: ")
+	assert.ErrorContains(t, err, "is a file")
+	assert.ErrorIs(t, err, opErr)
+
+	// A path which can't be checked.
+	if os.Geteuid() == 0 {
+		t.Skip("Permission checks don't apply to root")
+	}
+
+	lockedDir := filepath.Join(tmpDir, "locked")
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "locked"), 0700))
+	require.NoError(t, os.Mkdir(filepath.Join(lockedDir, "subvol"), 0700))
+	require.NoError(t, os.Chmod(lockedDir, 0))
+	defer func() { _ = os.Chmod(lockedDir, 0700) }()
+
+	err = btrfsSubVolumeDiagnose(filepath.Join(lockedDir, "subvol"))
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorContains(t, err, "Permission denied")
+}
+
+// Test that setBlockDevReadAhead writes the read-ahead of disks and of the parent disk of partitions.
+func TestSetBlockDevReadAhead(t *testing.T) {
+	sysDir := t.TempDir()
+
+	// Mimic the sysfs layout of a disk with a partition, linked from /sys/dev/block.
+	diskPath := filepath.Join(sysDir, "devices", "sda")
+	err := os.MkdirAll(filepath.Join(diskPath, "queue"), 0755)
+	assert.NoError(t, err)
+
+	err = os.Mkdir(filepath.Join(diskPath, "sda1"), 0755)
+	assert.NoError(t, err)
+
+	readAheadPath := filepath.Join(diskPath, "queue", "read_ahead_kb")
+	err = os.WriteFile(readAheadPath, []byte("128\n"), 0644)
+	assert.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(sysDir, "dev", "block"), 0755)
+	assert.NoError(t, err)
+
+	err = os.Symlink(diskPath, filepath.Join(sysDir, "dev", "block", "8:0"))
+	assert.NoError(t, err)
+
+	err = os.Symlink(filepath.Join(diskPath, "sda1"), filepath.Join(sysDir, "dev", "block", "8:1"))
+	assert.NoError(t, err)
+
+	// Disk.
+	err = setBlockDevReadAhead(filepath.Join(sysDir, "dev", "block", "8:0"), 4096)
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(readAheadPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "4096\n", string(content))
+
+	// Partition.
+	err = setBlockDevReadAhead(filepath.Join(sysDir, "dev", "block", "8:1"), 512)
+	assert.NoError(t, err)
+
+	content, err = os.ReadFile(readAheadPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "512\n", string(content))
+
+	// Non block devices are skipped.
+	_, err = blockDevSysPath(readAheadPath)
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+// Test that loop devices and partitions are resolved to the disk their I/O ends up on.
+func TestDiskDevice(t *testing.T) {
+	defer func(path string) { sysDevBlockPath = path }(sysDevBlockPath)
+
+	sysDir := t.TempDir()
+	sysDevBlockPath = filepath.Join(sysDir, "dev", "block")
+
+	// The backing file of the loop device, on whichever device holds the test directory.
+	backingFile := filepath.Join(t.TempDir(), "pool.img")
+	err := os.WriteFile(backingFile, nil, 0600)
+	require.NoError(t, err)
+
+	var st unix.Stat_t
+	err = unix.Stat(backingFile, &st)
+	require.NoError(t, err)
+
+	// Mimic the sysfs layout of a loop device and of a disk with the partition holding the backing file.
+	diskPath := filepath.Join(sysDir, "devices", "vdb")
+	partPath := filepath.Join(diskPath, "vdb1")
+	loopPath := filepath.Join(sysDir, "devices", "loop0")
+
+	require.NoError(t, os.MkdirAll(partPath, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(loopPath, "loop"), 0755))
+	require.NoError(t, os.MkdirAll(sysDevBlockPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(diskPath, "dev"), []byte("252:16\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(partPath, "partition"), []byte("1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(loopPath, "loop", "backing_file"), []byte(backingFile+"\n"), 0644))
+	require.NoError(t, os.Symlink(diskPath, filepath.Join(sysDevBlockPath, "252:16")))
+	require.NoError(t, os.Symlink(loopPath, filepath.Join(sysDevBlockPath, "7:0")))
+	require.NoError(t, os.Symlink(partPath, filepath.Join(sysDevBlockPath, fmt.Sprintf("%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))))))
+
+	// Disk.
+	dev, err := diskDevice(252, 16)
+	require.NoError(t, err)
+	assert.Equal(t, "252:16", dev)
+
+	// Partition.
+	dev, err = diskDevice(unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	require.NoError(t, err)
+	assert.Equal(t, "252:16", dev)
+
+	// Loop device, followed to the disk of its backing file.
+	dev, err = diskDevice(7, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "252:16", dev)
+
+	// Unknown device.
+	_, err = diskDevice(7, 1)
+	assert.Error(t, err)
+}
+
+// Test that the block devices backing a pool mount are found for each kind of backing.
+func TestPoolBackingDevices(t *testing.T) {
+	defer func(path string) { sysDevBlockPath = path }(sysDevBlockPath)
+
+	sysDevBlockPath = t.TempDir()
+
+	// Mimic the sysfs layout of a loop device.
+	backingFile := "/var/lib/lxd/disks/pool1.img"
+	require.NoError(t, os.MkdirAll(filepath.Join(sysDevBlockPath, "7:0", "loop"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(sysDevBlockPath, "7:0", "loop", "backing_file"), []byte(backingFile+"\n"), 0644))
+
+	numbers := map[string]string{
+		"/dev/sda1":  "8:1",
+		"/dev/sdb":   "8:16",
+		"/dev/sdc":   "8:32",
+		"/dev/loop0": "7:0",
+	}
+
+	deviceNumber := func(devPath string) (string, error) {
+		number, ok := numbers[devPath]
+		if !ok {
+			return "", fmt.Errorf("%q isn't a block device: %w", devPath, ErrNotSupported)
+		}
+
+		return number, nil
+	}
+
+	btrfsDevices := map[string][]string{
+		"/pools/multi": {"/dev/sdb", "/dev/sdc"},
+		"/pools/loop":  {"/dev/loop0"},
+	}
+
+	listBtrfsDevices := func(poolMount string) ([]string, error) {
+		return btrfsDevices[poolMount], nil
+	}
+
+	mounts := []MountInfo{
+		{Source: "/dev/sda1", Target: "/pools/direct", FSType: "ext4"},
+		{Source: "/dev/sdb", Target: "/pools/multi", FSType: "btrfs"},
+		{Source: "/dev/loop0", Target: "/pools/loop", FSType: "btrfs"},
+		{Source: "/dev/loop0", Target: "/pools/loop/containers/c1", FSType: "btrfs"},
+		{Source: "tmpfs", Target: "/pools/tmpfs", FSType: "tmpfs"},
+	}
+
+	tests := []struct {
+		name      string
+		poolMount string
+		expected  []BackingDevice
+	}{
+		{
+			name:      "direct",
+			poolMount: "/pools/direct",
+			expected:  []BackingDevice{{Path: "/dev/sda1", Device: "8:1"}},
+		},
+		{
+			name:      "multi-device btrfs",
+			poolMount: "/pools/multi/",
+			expected:  []BackingDevice{{Path: "/dev/sdb", Device: "8:16"}, {Path: "/dev/sdc", Device: "8:32"}},
+		},
+		{
+			name:      "loop file",
+			poolMount: "/pools/loop",
+			expected:  []BackingDevice{{Path: "/dev/loop0", Device: "7:0", BackingFile: backingFile}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			devices, err := poolBackingDevices(mounts, test.poolMount, listBtrfsDevices, deviceNumber)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, devices)
+		})
+	}
+
+	// Filesystems which aren't backed by block devices.
+	_, err := poolBackingDevices(mounts, "/pools/tmpfs", listBtrfsDevices, deviceNumber)
+	assert.ErrorIs(t, err, ErrNotSupported)
+
+	// Paths which aren't mounted.
+	_, err = poolBackingDevices(mounts, "/pools/missing", listBtrfsDevices, deviceNumber)
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+// Test parseMountInfo.
+func TestParseMountInfo(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+90 22 0:45 / /var/lib/lxd/storage-pools/pool1 rw,relatime shared:50 - btrfs /dev/loop0 rw,user_subvol_rm_allowed
+91 90 0:45 /containers-snapshots/c1/snap0 /var/lib/lxd/storage-pools/pool1/containers-snapshots/c1/snap0 ro,relatime shared:50 - btrfs /dev/loop0 rw
+92 90 0:46 / /var/lib/lxd/storage-pools/pool1/custom/my\040vol rw - btrfs /dev/loop0 rw
+93 22 0:47 / /var/lib/lxd/storage-pools/pool10 rw - btrfs /dev/loop1 rw
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(mountInfo), "/var/lib/lxd/storage-pools/pool1")
+	assert.NoError(t, err)
+	assert.Equal(t, []MountInfo{
+		{Source: "/dev/loop0", Target: "/var/lib/lxd/storage-pools/pool1", FSType: "btrfs", Options: "rw,relatime"},
+		{Source: "/dev/loop0", Target: "/var/lib/lxd/storage-pools/pool1/containers-snapshots/c1/snap0", FSType: "btrfs", Options: "ro,relatime"},
+		{Source: "/dev/loop0", Target: "/var/lib/lxd/storage-pools/pool1/custom/my vol", FSType: "btrfs", Options: "rw"},
+	}, mounts)
+
+	// Test no matching mounts.
+	mounts, err = parseMountInfo(strings.NewReader(mountInfo), "/var/lib/lxd/storage-pools/pool2")
+	assert.NoError(t, err)
+	assert.Empty(t, mounts)
+}
+
+// Test that paths are resolved within the filesystem of the deepest mount holding them.
+func TestParseMountInfoFilesystemPath(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+90 22 0:45 / /var/lib/lxd/storage-pools/pool1 rw,relatime shared:50 - btrfs /dev/loop0 rw
+94 22 0:45 /lxd/snapshots /srv/lxd\040snapshots rw,relatime shared:50 - btrfs /dev/loop0 rw
+`
+
+	path, err := parseMountInfoFilesystemPath(strings.NewReader(mountInfo), "/srv/lxd snapshots/containers-snapshots/c1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/lxd/snapshots/containers-snapshots/c1", path)
+
+	path, err = parseMountInfoFilesystemPath(strings.NewReader(mountInfo), "/var/lib/lxd/storage-pools/pool1/custom")
+	assert.NoError(t, err)
+	assert.Equal(t, "/custom", path)
+
+	path, err = parseMountInfoFilesystemPath(strings.NewReader(mountInfo), "/srv/other")
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/other", path)
+
+	_, err = parseMountInfoFilesystemPath(strings.NewReader(""), "/srv/other")
+	assert.Error(t, err)
+}
+
+// Test that data is staged in the pool's temp_dir and that it must be on the same filesystem for renames.
+func TestVolumeTempDir(t *testing.T) {
+	fallback := t.TempDir()
+	tempDir := t.TempDir()
+
+	// Unset temp_dir falls back to the pool directory.
+	vol := NewVolume(nil, "pool1", VolumeTypeCustom, ContentTypeFS, "vol1", nil, map[string]string{})
+	dir, err := vol.TempDir(fallback, fallback)
+	assert.NoError(t, err)
+	assert.Equal(t, fallback, dir)
+
+	// Staging happens in the configured temp_dir.
+	vol = NewVolume(nil, "pool1", VolumeTypeCustom, ContentTypeFS, "vol1", nil, map[string]string{"temp_dir": tempDir})
+	dir, err = vol.TempDir(fallback, "")
+	assert.NoError(t, err)
+	assert.Equal(t, tempDir, dir)
+
+	dir, err = vol.TempDir(fallback, fallback)
+	assert.NoError(t, err)
+	assert.Equal(t, tempDir, dir)
+
+	// Renaming from another filesystem isn't possible.
+	vol = NewVolume(nil, "pool1", VolumeTypeCustom, ContentTypeFS, "vol1", nil, map[string]string{"temp_dir": "/proc"})
+	_, err = vol.TempDir(fallback, fallback)
+	assert.ErrorContains(t, err, "must be on the same filesystem")
+
+	// But staging without a rename is.
+	dir, err = vol.TempDir(fallback, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "/proc", dir)
+
+	// Validation.
+	assert.NoError(t, validateTempDir(tempDir))
+	assert.Error(t, validateTempDir("relative/path"))
+	assert.Error(t, validateTempDir(filepath.Join(tempDir, "missing")))
+}
+
+// Test that mkdirAllMode applies the mode to all created directories regardless of the umask.
+func TestMkdirAllMode(t *testing.T) {
+	oldUmask := unix.Umask(0077)
+	defer unix.Umask(oldUmask)
+
+	root := t.TempDir()
+	assert.NoError(t, os.Chmod(root, 0700))
+
+	path := filepath.Join(root, "a", "b", "c")
+	err := mkdirAllMode(path, 0755)
+	assert.NoError(t, err)
+
+	for _, dir := range []string{"a", "a/b", "a/b/c"} {
+		info, err := os.Stat(filepath.Join(root, dir))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), dir)
+	}
+
+	// Existing directories are left alone.
+	info, err := os.Stat(root)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+// Test parseSubVolumeMode.
+func TestParseSubVolumeMode(t *testing.T) {
+	mode, err := parseSubVolumeMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, btrfsSubVolumeDefaultMode, mode)
+
+	mode, err = parseSubVolumeMode("0750")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), mode)
+
+	for _, value := range []string{"0800", "01777", "rwx", "-1"} {
+		_, err = parseSubVolumeMode(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// Test each snapshot.delete_on_error policy with a removal failing part way through.
+func TestDeleteSnapshotTree(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		root := t.TempDir()
+		snapPath := filepath.Join(root, "snap0")
+
+		for _, dir := range []string{"a", "b"} {
+			assert.NoError(t, os.MkdirAll(filepath.Join(snapPath, dir), 0700))
+		}
+
+		for _, file := range []string{"a/1", "a/2", "b/1", "c"} {
+			assert.NoError(t, os.WriteFile(filepath.Join(snapPath, file), []byte("data"), 0600))
+		}
+
+		return snapPath, filepath.Join(root, "trash", "containers", "snap0")
+	}
+
+	// Fail to remove b/1, and therefore b and the snapshot root too.
+	failingRemove := func(path string) error {
+		if strings.HasSuffix(path, "/b/1") {
+			return os.ErrPermission
+		}
+
+		return os.Remove(path)
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		snapPath, trashPath := setup(t)
+
+		err := deleteSnapshotTree(snapPath, SnapshotDeleteAbort, trashPath, failingRemove)
+		assert.ErrorIs(t, err, os.ErrPermission)
+
+		// Entries after the failure are left in place.
+		assert.FileExists(t, filepath.Join(snapPath, "b", "1"))
+		assert.FileExists(t, filepath.Join(snapPath, "a", "1"))
+		assert.NoFileExists(t, filepath.Join(snapPath, "c"))
+		assert.NoDirExists(t, trashPath)
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		snapPath, trashPath := setup(t)
+
+		err := deleteSnapshotTree(snapPath, SnapshotDeleteContinue, trashPath, failingRemove)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "b/1")
+
+		// Everything else that could be removed is gone.
+		assert.FileExists(t, filepath.Join(snapPath, "b", "1"))
+		assert.NoDirExists(t, filepath.Join(snapPath, "a"))
+		assert.NoFileExists(t, filepath.Join(snapPath, "c"))
+		assert.NoDirExists(t, trashPath)
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		snapPath, trashPath := setup(t)
+
+		err := deleteSnapshotTree(snapPath, SnapshotDeleteQuarantine, trashPath, failingRemove)
+		assert.NoError(t, err)
+
+		// The leftovers are moved out of the way.
+		assert.NoDirExists(t, snapPath)
+		assert.FileExists(t, filepath.Join(trashPath, "b", "1"))
+		assert.NoDirExists(t, filepath.Join(trashPath, "a"))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		snapPath, trashPath := setup(t)
+
+		assert.NoError(t, deleteSnapshotTree(snapPath, SnapshotDeleteAbort, trashPath, os.Remove))
+		assert.NoDirExists(t, snapPath)
+
+		// Missing snapshots are already deleted.
+		assert.NoError(t, deleteSnapshotTree(snapPath, SnapshotDeleteAbort, trashPath, os.Remove))
+	})
+}
+
+// Test conversions between absolute and pool relative paths.
+func TestPoolRelPath(t *testing.T) {
+	d := &common{name: "testpool"}
+	poolMount := GetPoolMountPath("testpool")
+
+	for _, path := range []string{poolMount + "/containers/c1", poolMount + "/containers/c1/", poolMount + "//containers/c1"} {
+		relPath, err := d.PoolRelPath(path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, "containers/c1", relPath, path)
+		assert.Equal(t, poolMount+"/containers/c1", d.PoolAbsPath(relPath))
+	}
+
+	for _, path := range []string{poolMount, poolMount + "/"} {
+		relPath, err := d.PoolRelPath(path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, ".", relPath, path)
+	}
+
+	for _, path := range []string{GetPoolMountPath("testpool2") + "/containers/c1", filepath.Dir(poolMount), "containers/c1"} {
+		_, err := d.PoolRelPath(path)
+		assert.Error(t, err, path)
+	}
+
+	// Relative paths with a leading or trailing slash.
+	assert.Equal(t, poolMount+"/custom/default_vol1", d.PoolAbsPath("/custom/default_vol1/"))
+	assert.Equal(t, poolMount, d.PoolAbsPath(""))
+}
+
+// ociTestRoot creates a small filesystem tree to export as an OCI layer.
+func ociTestRoot(t *testing.T) string {
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("c1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr", "bin", "busybox"), []byte("binary"), 0755))
+	require.NoError(t, os.Symlink("busybox", filepath.Join(root, "usr", "bin", "sh")))
+
+	return root
+}
+
+// ociTestReadTar returns the headers and content of the entries of a tarball.
+func ociTestReadTar(t *testing.T, r io.Reader) (map[string]*tar.Header, map[string][]byte) {
+	headers := map[string]*tar.Header{}
+	contents := map[string][]byte{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = content
+	}
+
+	return headers, contents
+}
+
+// Test the structure and content of a volume exported as an OCI layer.
+func TestOCILayerWrite(t *testing.T) {
+	root := ociTestRoot(t)
+
+	// Overlay whiteouts need CAP_MKNOD.
+	whiteout := unix.Mknod(filepath.Join(root, "etc", "removed"), unix.S_IFCHR|0600, 0) == nil
+
+	var layer bytes.Buffer
+	require.NoError(t, ociLayerWrite(&layer, root, nil))
+
+	headers, contents := ociTestReadTar(t, &layer)
+
+	// Paths are relative and the root itself isn't included.
+	expected := []string{"etc", "etc/hostname", "usr", "usr/bin", "usr/bin/busybox", "usr/bin/sh"}
+	if whiteout {
+		expected = append(expected, "etc/.wh.removed")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	assert.ElementsMatch(t, expected, names)
+
+	assert.Equal(t, byte(tar.TypeDir), headers["etc"].Typeflag)
+	assert.Equal(t, byte(tar.TypeReg), headers["etc/hostname"].Typeflag)
+	assert.Equal(t, "c1\n", string(contents["etc/hostname"]))
+	assert.Equal(t, int64(0755), headers["usr/bin/busybox"].Mode&0777)
+	assert.Equal(t, byte(tar.TypeSymlink), headers["usr/bin/sh"].Typeflag)
+	assert.Equal(t, "busybox", headers["usr/bin/sh"].Linkname)
+
+	if whiteout {
+		assert.Equal(t, byte(tar.TypeReg), headers["etc/.wh.removed"].Typeflag)
+		assert.Empty(t, contents["etc/.wh.removed"])
+	}
+
+	// Files named like whiteouts can't be represented.
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc", ".wh.hosts"), nil, 0644))
+	assert.Error(t, ociLayerWrite(io.Discard, root, nil))
+}
+
+// Test that the ownership of the files of an unprivileged container is unshifted in the layer.
+func TestOCILayerWriteUnshift(t *testing.T) {
+	root := ociTestRoot(t)
+
+	// Changing the ownership of files needs CAP_CHOWN.
+	err := os.Lchown(filepath.Join(root, "etc", "hostname"), 1001000, 1001000)
+	if err != nil {
+		t.Skipf("Failed changing file ownership: %v", err)
+	}
+
+	idmapSet := &idmap.IdmapSet{Idmap: []idmap.IdmapEntry{
+		{Isuid: true, Hostid: 1000000, Nsid: 0, Maprange: 65536},
+		{Isgid: true, Hostid: 1000000, Nsid: 0, Maprange: 65536},
+	}}
+
+	var layer bytes.Buffer
+	require.NoError(t, ociLayerWrite(&layer, root, idmapSet))
+
+	headers, _ := ociTestReadTar(t, &layer)
+	assert.Equal(t, 1000, headers["etc/hostname"].Uid)
+	assert.Equal(t, 1000, headers["etc/hostname"].Gid)
+}
+
+// Test that an export with a config produces a consistent OCI image layout.
+func TestOCIExportConfig(t *testing.T) {
+	root := ociTestRoot(t)
+	config := &OCIImageConfig{Architecture: "amd64", OS: "linux", Cmd: []string{"/usr/bin/sh"}}
+
+	var export bytes.Buffer
+	require.NoError(t, ociExport(&export, root, config, nil, t.TempDir()))
+
+	_, contents := ociTestReadTar(t, &export)
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(contents["oci-layout"]))
+
+	blob := func(desc ociDescriptor) []byte {
+		content, ok := contents[ociBlobPath(desc.Digest)]
+		require.True(t, ok, desc.Digest)
+		assert.Equal(t, desc.Digest, fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+		assert.Equal(t, desc.Size, int64(len(content)))
+
+		return content
+	}
+
+	index := ociIndex{}
+	require.NoError(t, json.Unmarshal(contents["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+
+	manifest := ociManifest{}
+	require.NoError(t, json.Unmarshal(blob(index.Manifests[0]), &manifest))
+	assert.Equal(t, ociMediaTypeConfig, manifest.Config.MediaType)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, ociMediaTypeLayer, manifest.Layers[0].MediaType)
+
+	image := ociImage{}
+	require.NoError(t, json.Unmarshal(blob(manifest.Config), &image))
+	assert.Equal(t, "amd64", image.Architecture)
+	assert.Equal(t, "linux", image.OS)
+	assert.Equal(t, []string{"/usr/bin/sh"}, image.Config.Cmd)
+	assert.Equal(t, []string{manifest.Layers[0].Digest}, image.RootFS.DiffIDs)
+
+	_, layerContents := ociTestReadTar(t, bytes.NewReader(blob(manifest.Layers[0])))
+	assert.Equal(t, "c1\n", string(layerContents["etc/hostname"]))
+}
+
+// Test that the volume of a running instance, or one still mounted, can't be deleted.
+func TestCheckVolumeNotInUse(t *testing.T) {
+	poolMount := GetPoolMountPath("testpool")
+	volPath := filepath.Join(poolMount, "containers", "default_c1")
+
+	// Simulate a running instance whose root is mounted from the volume.
+	mounts := []MountInfo{
+		{Source: "/dev/sdb", Target: filepath.Join(poolMount, "containers", "default_c10"), FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: filepath.Join(volPath, "rootfs"), FSType: "btrfs"},
+	}
+
+	err := CheckVolumeNotInUse(volPath, true, nil)
+	assert.ErrorIs(t, err, ErrVolumeInUse)
+
+	err = CheckVolumeNotInUse(volPath, false, mounts)
+	assert.ErrorIs(t, err, ErrVolumeInUse)
+
+	err = CheckVolumeNotInUse(volPath+"/", false, mounts)
+	assert.ErrorIs(t, err, ErrVolumeInUse)
+
+	// Once stopped and unmounted the volume can be deleted, mounts of other volumes with a common prefix don't count.
+	assert.NoError(t, CheckVolumeNotInUse(volPath, false, mounts[:1]))
+}
+
+func TestStaleMounts(t *testing.T) {
+	poolMount := GetPoolMountPath("testpool")
+	c1 := filepath.Join(poolMount, "containers", "default_c1")
+	c2 := filepath.Join(poolMount, "containers", "default_c2")
+
+	mounts := []MountInfo{
+		{Source: "/dev/sdb", Target: poolMount, FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: c1, FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: filepath.Join(c1, "rootfs", "mnt"), FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: c2 + "0", FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: c2, FSType: "btrfs"},
+		{Source: "/dev/sdb", Target: filepath.Join(c2, "rootfs"), FSType: "btrfs"},
+	}
+
+	// The pool's own mount and the mounts at or below the active volumes are kept, nested stale mounts come first.
+	stale := staleMounts(mounts, poolMount, []string{c1})
+	assert.Equal(t, []MountInfo{mounts[5], mounts[3], mounts[4]}, stale)
+
+	assert.Empty(t, staleMounts(mounts[:3], poolMount, []string{c1 + "/"}))
+}
+
+// Test that a bind mount left below the pool mount path is detected and unmounted.
+func TestCleanupStaleMounts(t *testing.T) {
+	poolMount := t.TempDir()
+	active := filepath.Join(poolMount, "containers", "default_c1")
+	stale := filepath.Join(poolMount, "containers", "default_c2")
+	src := t.TempDir()
+
+	for _, path := range []string{active, stale} {
+		require.NoError(t, os.MkdirAll(path, 0700))
+
+		err := unix.Mount(src, path, "none", unix.MS_BIND, "")
+		if err != nil {
+			t.Skipf("Test requires creating bind mounts: %v", err)
+		}
+
+		path := path
+		t.Cleanup(func() { _ = unix.Unmount(path, unix.MNT_DETACH) })
+	}
+
+	unmounted, err := cleanupStaleMounts(poolMount, []string{active})
+	require.NoError(t, err)
+	require.Len(t, unmounted, 1)
+	assert.Equal(t, stale, unmounted[0].Target)
+
+	f, err := os.Open("/proc/self/mountinfo")
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	mounts, err := parseMountInfo(f, poolMount)
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	assert.Equal(t, active, mounts[0].Target)
+}
+
+// Test that the empty parent snapshot directories and dangling symlinks are pruned, leaving snapshots alone.
+func TestPruneSnapshotDirs(t *testing.T) {
+	poolPath := t.TempDir()
+
+	for _, dir := range []string{
+		"containers-snapshots/c1",
+		"containers-snapshots/c2/snap0/rootfs",
+		"virtual-machines-snapshots/v1",
+		"custom-snapshots/default_vol1",
+		"custom-snapshots/default_vol2/snap0", // An empty custom volume snapshot.
+		"custom",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(poolPath, dir), 0700))
+	}
+
+	links := map[string]string{
+		"containers-snapshots/c3":             filepath.Join(poolPath, "containers-snapshots", "missing"),
+		"virtual-machines-snapshots/v2":       "/nonexistent",
+		"custom-snapshots/default_vol3":       filepath.Join(poolPath, "custom"),
+		"containers-snapshots/c2/snap0/link1": "/nonexistent", // Part of a snapshot.
+	}
+
+	for link, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(poolPath, link)))
+	}
+
+	pruned, err := pruneSnapshotDirs(poolPath, PoolLayoutNested)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"containers-snapshots/c1",
+		"containers-snapshots/c3",
+		"custom-snapshots/default_vol1",
+		"virtual-machines-snapshots/v1",
+		"virtual-machines-snapshots/v2",
+	}, pruned)
+
+	for _, path := range pruned {
+		_, err := os.Lstat(filepath.Join(poolPath, path))
+		assert.True(t, os.IsNotExist(err), path)
+	}
+
+	assert.DirExists(t, filepath.Join(poolPath, "custom-snapshots", "default_vol2", "snap0"))
+
+	// Valid symlinks and symlinks within snapshots are kept.
+	for _, link := range []string{"custom-snapshots/default_vol3", "containers-snapshots/c2/snap0/link1"} {
+		_, err = os.Lstat(filepath.Join(poolPath, link))
+		assert.NoError(t, err, link)
+	}
+
+	// Nothing is left to prune.
+	pruned, err = pruneSnapshotDirs(poolPath, PoolLayoutNested)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	// The flat layout keeps the parent snapshot directories at the root of the pool, next to the volumes.
+	poolPath = t.TempDir()
+	for _, dir := range []string{
+		"containers_c1",
+		"containers-snapshots_c1",
+		"containers-snapshots_c2/snap0",
+		"custom-snapshots_default_vol1",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(poolPath, dir), 0700))
+	}
+
+	require.NoError(t, os.Symlink("/nonexistent", filepath.Join(poolPath, "virtual-machines-snapshots_v1")))
+
+	pruned, err = pruneSnapshotDirs(poolPath, PoolLayoutFlat)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"containers-snapshots_c1",
+		"custom-snapshots_default_vol1",
+		"virtual-machines-snapshots_v1",
+	}, pruned)
+
+	assert.DirExists(t, filepath.Join(poolPath, "containers_c1"))
+	assert.DirExists(t, filepath.Join(poolPath, "containers-snapshots_c2", "snap0"))
+}
+
+// Test that the files hardlinked between a volume and its snapshot are counted once.
+func TestDirFootprint(t *testing.T) {
+	volPath := filepath.Join(t.TempDir(), "c1")
+	snapPath := filepath.Join(t.TempDir(), "snap0")
+	require.NoError(t, os.Mkdir(volPath, 0700))
+	require.NoError(t, os.Mkdir(snapPath, 0700))
+
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+	require.NoError(t, os.WriteFile(filepath.Join(volPath, "shared"), data, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(volPath, "c1-only"), data[:4096], 0600))
+	require.NoError(t, os.Link(filepath.Join(volPath, "shared"), filepath.Join(snapPath, "shared")))
+
+	sharedSize, err := dirFootprint([]string{filepath.Join(volPath, "shared")})
+	require.NoError(t, err)
+
+	volSize, err := dirFootprint([]string{volPath})
+	require.NoError(t, err)
+
+	snapSize, err := dirFootprint([]string{snapPath})
+	require.NoError(t, err)
+
+	footprint, err := dirFootprint([]string{volPath, snapPath})
+	require.NoError(t, err)
+
+	assert.Less(t, footprint, volSize+snapSize)
+	assert.Equal(t, volSize+snapSize-sharedSize, footprint)
+
+	// A tree walked twice is counted once.
+	footprint, err = dirFootprint([]string{volPath, volPath})
+	require.NoError(t, err)
+	assert.Equal(t, volSize, footprint)
+}
+
+// Test that existence and subvolume-ness are reported from a single lstat.
+func TestBtrfsPathStat(t *testing.T) {
+	dir := t.TempDir()
+
+	calls := 0
+	lstat := func(path string, stat *unix.Stat_t) error {
+		calls++
+		return unix.Lstat(path, stat)
+	}
+
+	exists, isSubvol, err := btrfsPathStat(lstat, filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.False(t, isSubvol)
+
+	exists, isSubvol, err = btrfsPathStat(lstat, dir)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.False(t, isSubvol)
+	assert.Equal(t, 2, calls)
+
+	// Errors other than the path not existing are reported.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0600))
+	_, _, err = btrfsPathStat(lstat, filepath.Join(dir, "file", "child"))
+	assert.Error(t, err)
+}
+
+// Test that VolumeExists finds custom volumes in the nested layout of the pool.
+func TestVolumeExists(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	exists, _, err := VolumeExists("default", "pool1", "vol1")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, os.MkdirAll(GetVolumeMountPath("pool1", VolumeTypeCustom, "default_vol1"), 0711))
+
+	exists, isSubvol, err := VolumeExists("default", "pool1", "vol1")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.False(t, isSubvol)
+
+	// Volumes are looked up in the project.
+	exists, _, err = VolumeExists("project1", "pool1", "vol1")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// Benchmark checking whether a path is an existing subvolume with separate existence and subvolume checks against
+// btrfsPathStat, reporting the number of lstat calls per check.
+func BenchmarkBtrfsPathStat(b *testing.B) {
+	path := b.TempDir()
+
+	calls := 0
+	lstat := func(path string, stat *unix.Stat_t) error {
+		calls++
+		return unix.Lstat(path, stat)
+	}
+
+	// Same checks as shared.PathExists followed by btrfsIsSubVolume.
+	pathExists := func(path string) bool {
+		stat := unix.Stat_t{}
+		return lstat(path, &stat) == nil
+	}
+
+	isSubVolume := func(path string) bool {
+		stat := unix.Stat_t{}
+		return lstat(path, &stat) == nil && stat.Ino == 256
+	}
+
+	b.Run("Separate", func(b *testing.B) {
+		calls = 0
+		for i := 0; i < b.N; i++ {
+			if pathExists(path) {
+				_ = isSubVolume(path)
+			}
+		}
+
+		b.ReportMetric(float64(calls)/float64(b.N), "lstat/op")
+	})
+
+	b.Run("Combined", func(b *testing.B) {
+		calls = 0
+		for i := 0; i < b.N; i++ {
+			_, _, err := btrfsPathStat(lstat, path)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.ReportMetric(float64(calls)/float64(b.N), "lstat/op")
+	})
+}
+
+// Test that comparing trees file by file reports the added, modified and deleted paths.
+func TestDiffVolumePaths(t *testing.T) {
+	oldPath := t.TempDir()
+	newPath := t.TempDir()
+
+	write := func(root string, path string, content string, mode os.FileMode) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, path), []byte(content), mode))
+	}
+
+	for _, root := range []string{oldPath, newPath} {
+		write(root, "etc/hostname", "c1\n", 0644)
+		write(root, "etc/unchanged", "same\n", 0644)
+		write(root, "usr/bin/tool", "#!/bin/sh\n", 0755)
+		require.NoError(t, os.Symlink("tool", filepath.Join(root, "usr/bin/link")))
+	}
+
+	// Give the files the same modification time in both trees.
+	mtime := time.Now().Add(-time.Hour)
+	for _, path := range []string{"etc/hostname", "etc/unchanged", "usr/bin/tool"} {
+		require.NoError(t, os.Chtimes(filepath.Join(oldPath, path), mtime, mtime))
+		require.NoError(t, os.Chtimes(filepath.Join(newPath, path), mtime, mtime))
+	}
+
+	write(oldPath, "var/old", "old\n", 0644)
+	write(newPath, "etc/hostname", "c2\n", 0644)
+	require.NoError(t, os.Chmod(filepath.Join(newPath, "usr/bin/tool"), 0700))
+	require.NoError(t, os.Remove(filepath.Join(newPath, "usr/bin/link")))
+	require.NoError(t, os.Symlink("other", filepath.Join(newPath, "usr/bin/link")))
+	write(newPath, "opt/app/config", "new\n", 0644)
+
+	diff, err := DiffVolumePaths(oldPath, newPath, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/opt", "/opt/app", "/opt/app/config"}, diff.Added)
+	assert.Equal(t, []string{"/etc/hostname", "/usr/bin/link", "/usr/bin/tool"}, diff.Modified)
+	assert.Equal(t, []string{"/var", "/var/old"}, diff.Deleted)
+}
+
+// Test that the owners of a shifted tree are compared once shifted back.
+func TestDiffVolumeOwnerChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("content\n"), 0644))
+
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+
+	uid := int64(os.Getuid())
+	gid := int64(os.Getgid())
+	idmapSet := &idmap.IdmapSet{Idmap: []idmap.IdmapEntry{
+		{Isuid: true, Isgid: true, Hostid: 1000000, Nsid: 0, Maprange: 1000000000},
+	}}
+
+	assert.False(t, diffVolumeOwnerChanged(fi, uid, gid, nil))
+	assert.True(t, diffVolumeOwnerChanged(fi, uid+1000000, gid+1000000, nil))
+	assert.False(t, diffVolumeOwnerChanged(fi, uid+1000000, gid+1000000, idmapSet))
+	assert.True(t, diffVolumeOwnerChanged(fi, uid+1000001, gid+1000000, idmapSet))
+}
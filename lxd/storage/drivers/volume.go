@@ -71,12 +71,13 @@ const ContentTypeBlock = ContentType("block")
 type VolumePostHook func(vol Volume) error
 
 // BaseDirectories maps volume types to the expected directories.
+// The second directory holds the volume snapshots and the third one the snapshots of paths within the volumes.
 var BaseDirectories = map[VolumeType][]string{
 	VolumeTypeBucket:    {"buckets"},
-	VolumeTypeContainer: {"containers", "containers-snapshots"},
-	VolumeTypeCustom:    {"custom", "custom-snapshots"},
+	VolumeTypeContainer: {"containers", "containers-snapshots", "containers-path-snapshots"},
+	VolumeTypeCustom:    {"custom", "custom-snapshots", "custom-path-snapshots"},
 	VolumeTypeImage:     {"images"},
-	VolumeTypeVM:        {"virtual-machines", "virtual-machines-snapshots"},
+	VolumeTypeVM:        {"virtual-machines", "virtual-machines-snapshots", "virtual-machines-path-snapshots"},
 }
 
 // Volume represents a storage volume, and provides functions to mount and unmount it.
@@ -88,8 +89,16 @@ type Volume struct {
 	contentType          ContentType
 	config               map[string]string
 	driver               Driver
-	mountCustomPath      string // Mount the filesystem volume at a custom location.
-	mountFilesystemProbe bool   // Probe filesystem type when mounting volume (when needed).
+	mountCustomPath      string       // Mount the filesystem volume at a custom location.
+	mountFilesystemProbe bool         // Probe filesystem type when mounting volume (when needed).
+	rootOwner            *volumeOwner // Ownership given to the root directory when creating the volume.
+}
+
+// volumeOwner represents the ownership given to the root directory of a volume, such as the ids the root user of
+// an unprivileged instance is mapped to.
+type volumeOwner struct {
+	uid int
+	gid int
 }
 
 // NewVolume instantiates a new Volume struct.
@@ -130,6 +139,13 @@ func (v Volume) ExpandedConfig(key string) string {
 	return v.poolConfig[fmt.Sprintf("volume.%s", key)]
 }
 
+// TempDir returns the directory to stage data for the volume in, which is the pool's "temp_dir" if set and
+// fallback otherwise. If renameTarget isn't empty, it must be on the same filesystem as the staged data will be
+// renamed into it.
+func (v Volume) TempDir(fallback string, renameTarget string) (string, error) {
+	return poolTempDir(v.poolConfig, fallback, renameTarget)
+}
+
 // NewSnapshot instantiates a new Volume struct representing a snapshot of the parent volume.
 func (v Volume) NewSnapshot(snapshotName string) (Volume, error) {
 	if v.IsSnapshot() {
@@ -156,7 +172,12 @@ func (v Volume) MountPath() string {
 		return v.mountCustomPath
 	}
 
-	return GetVolumeMountPath(v.pool, v.volType, v.name)
+	return getVolumeMountPath(v.pool, v.poolConfig, v.volType, v.name)
+}
+
+// SnapshotsDir returns the directory holding the snapshots of the volume, or of its parent for a snapshot.
+func (v Volume) SnapshotsDir() string {
+	return getVolumeSnapshotDir(v.pool, v.poolConfig, v.volType, v.name)
 }
 
 // mountLockName returns the lock name to use for mount/unmount operations on a volume.
@@ -184,6 +205,36 @@ func (v Volume) MountInUse() bool {
 	return refcount.Get(v.mountLockName()) > 0
 }
 
+// sendParentRefName returns the ref counter name used to track a path being used as an incremental send parent.
+func sendParentRefName(path string) string {
+	return fmt.Sprintf("SendParent/%s", path)
+}
+
+// SendParentRefCountIncrement increments the send parent ref counter for the volume and returns the new value.
+// This must be called by anything in LXD relying on the volume remaining available as the parent for incremental
+// sends. The counter is kept in memory as these sends don't outlive the process, the sends made by external tooling
+// are recorded in the snapshot config instead (see SendParentRefCountConfigKey).
+func (v Volume) SendParentRefCountIncrement() uint {
+	return refcount.Increment(sendParentRefName(v.MountPath()), 1)
+}
+
+// SendParentRefCountDecrement decrements the send parent ref counter for the volume and returns the new value.
+func (v Volume) SendParentRefCountDecrement() uint {
+	return refcount.Decrement(sendParentRefName(v.MountPath()), 1)
+}
+
+// SendParentInUse returns whether the volume has a send parent ref counter >0, either in memory or in its config.
+// A config value which can't be parsed is considered as in use.
+func (v Volume) SendParentInUse() bool {
+	if refcount.Get(sendParentRefName(v.MountPath())) > 0 {
+		return true
+	}
+
+	count, err := SendParentRefCount(v.config)
+
+	return err != nil || count > 0
+}
+
 // EnsureMountPath creates the volume's mount path if missing, then sets the correct permission for the type.
 // If permission setting fails and the volume is a snapshot then the error is ignored as snapshots are read only.
 func (v Volume) EnsureMountPath() error {
@@ -197,7 +248,7 @@ func (v Volume) EnsureMountPath() error {
 		if v.IsSnapshot() {
 			// Create the parent directory if needed.
 			parentName, _, _ := api.GetParentAndSnapshotName(v.name)
-			err := createParentSnapshotDirIfMissing(v.pool, v.volType, parentName)
+			err := createParentSnapshotDirIfMissing(v.pool, v.poolConfig, v.volType, parentName)
 			if err != nil {
 				return err
 			}
@@ -211,12 +262,20 @@ func (v Volume) EnsureMountPath() error {
 		revert.Add(func() { _ = os.Remove(volPath) })
 	}
 
-	// Set very restrictive mode 0100 for non-custom, non-bucket and non-image volumes.
+	// Set very restrictive mode 0100 for non-custom, non-bucket and non-image volumes, unless the mode of the
+	// subvolumes is set on the pool.
 	mode := os.FileMode(0711)
 	if v.volType != VolumeTypeCustom && v.volType != VolumeTypeImage && v.volType != VolumeTypeBucket {
 		mode = os.FileMode(0100)
 	}
 
+	if v.poolConfig["btrfs.subvolume_mode"] != "" {
+		subvolMode, err := parseSubVolumeMode(v.poolConfig["btrfs.subvolume_mode"])
+		if err == nil {
+			mode = subvolMode
+		}
+	}
+
 	fInfo, err := os.Lstat(volPath)
 	if err != nil {
 		return fmt.Errorf("Error getting mount directory info %q: %w", volPath, err)
@@ -532,3 +591,8 @@ func (v Volume) ConfigSizeFromSource(srcVol Volume) (string, error) {
 func (v *Volume) SetMountFilesystemProbe(probe bool) {
 	v.mountFilesystemProbe = probe
 }
+
+// SetRootOwner sets the ownership given to the root directory of the volume when creating it.
+func (v *Volume) SetRootOwner(uid int, gid int) {
+	v.rootOwner = &volumeOwner{uid: uid, gid: gid}
+}
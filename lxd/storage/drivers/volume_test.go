@@ -2,9 +2,11 @@ package drivers
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // Test Volume_ConfigSizeFromSource.
@@ -110,3 +112,35 @@ func Test_Volume_ConfigSizeFromSource(t *testing.T) {
 		assert.Equal(t, test.err, err)
 	}
 }
+
+// Test that the mount path of volumes keeps the mode of the subvolumes set on the pool.
+func Test_Volume_EnsureMountPathMode(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+
+	tests := []struct {
+		volType    VolumeType
+		poolConfig map[string]string
+		mode       os.FileMode
+	}{
+		{volType: VolumeTypeContainer, mode: 0100},
+		{volType: VolumeTypeCustom, mode: 0711},
+		{volType: VolumeTypeContainer, poolConfig: map[string]string{"btrfs.subvolume_mode": "0751"}, mode: 0751},
+		{volType: VolumeTypeCustom, poolConfig: map[string]string{"btrfs.subvolume_mode": "0700"}, mode: 0700},
+	}
+
+	for i, test := range tests {
+		vol := NewVolume(d, "pool", test.volType, ContentTypeFS, fmt.Sprintf("vol%d", i), nil, test.poolConfig)
+		require.NoError(t, os.MkdirAll(GetVolumeMountPath("pool", test.volType, ""), 0711))
+
+		// Applied both when creating the mount path and on an existing one.
+		for j := 0; j < 2; j++ {
+			require.NoError(t, vol.EnsureMountPath())
+
+			info, err := os.Stat(vol.MountPath())
+			require.NoError(t, err)
+			assert.Equal(t, test.mode, info.Mode().Perm(), vol.MountPath())
+		}
+	}
+}
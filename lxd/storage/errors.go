@@ -9,3 +9,39 @@ var ErrNilValue = fmt.Errorf("Nil value provided")
 
 // ErrBackupSnapshotsMismatch is the "Backup snapshots mismatch" error.
 var ErrBackupSnapshotsMismatch = fmt.Errorf("Backup snapshots mismatch")
+
+// ErrRateLimited is the "Rate limited" error.
+var ErrRateLimited = fmt.Errorf("Rate limited")
+
+// ErrInstanceHasSnapshots is the "Cannot remove an instance volume that has snapshots" error.
+var ErrInstanceHasSnapshots = fmt.Errorf("Cannot remove an instance volume that has snapshots")
+
+// ErrPoolBusy indicates a pool maintenance operation cannot proceed as another one is in progress on the pool.
+type ErrPoolBusy struct {
+	Pool      string
+	Operation string
+}
+
+func (e ErrPoolBusy) Error() string {
+	return fmt.Sprintf("Storage pool %q is busy with another operation: %s", e.Pool, e.Operation)
+}
+
+// ErrConfirmationRequired is the "Confirmation required" error.
+var ErrConfirmationRequired = fmt.Errorf("Confirmation required")
+
+// ErrSnapshotsDeletePartial indicates that deleting a set of snapshots which were all found deletable failed part
+// way through, as deletions can't be rolled back.
+type ErrSnapshotsDeletePartial struct {
+	Deleted   []string // Snapshots deleted before the failure.
+	Failed    string   // Snapshot which failed to be deleted.
+	Remaining []string // Snapshots which weren't attempted after the failure.
+	Err       error
+}
+
+func (e ErrSnapshotsDeletePartial) Error() string {
+	return fmt.Sprintf("Failed deleting snapshot %q after deleting %d snapshots %v, %d snapshots %v were left: %v", e.Failed, len(e.Deleted), e.Deleted, len(e.Remaining), e.Remaining, e.Err)
+}
+
+func (e ErrSnapshotsDeletePartial) Unwrap() error {
+	return e.Err
+}
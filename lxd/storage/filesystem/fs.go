@@ -22,7 +22,7 @@ const (
 func StatVFS(path string) (*unix.Statfs_t, error) {
 	var st unix.Statfs_t
 
-	err := unix.Statfs(path, &st)
+	err := Statfs(path, &st)
 	if err != nil {
 		return nil, err
 	}
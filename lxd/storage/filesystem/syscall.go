@@ -0,0 +1,40 @@
+package filesystem
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// The raw syscalls wrapped below, replaced in tests.
+var (
+	unixLstat  = unix.Lstat
+	unixStat   = unix.Stat
+	unixStatfs = unix.Statfs
+)
+
+// RetryEINTR calls fn again for as long as it fails with EINTR, which the syscalls can return when interrupted by
+// the delivery of a signal (frequent due to the preemption signals of the Go runtime).
+func RetryEINTR(fn func() error) error {
+	for {
+		err := fn()
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+// Lstat is unix.Lstat retried on EINTR.
+func Lstat(path string, st *unix.Stat_t) error {
+	return RetryEINTR(func() error { return unixLstat(path, st) })
+}
+
+// Stat is unix.Stat retried on EINTR.
+func Stat(path string, st *unix.Stat_t) error {
+	return RetryEINTR(func() error { return unixStat(path, st) })
+}
+
+// Statfs is unix.Statfs retried on EINTR.
+func Statfs(path string, st *unix.Statfs_t) error {
+	return RetryEINTR(func() error { return unixStatfs(path, st) })
+}
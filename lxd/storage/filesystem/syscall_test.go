@@ -0,0 +1,43 @@
+package filesystem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// Test that syscalls interrupted by a signal are retried until they succeed.
+func TestRetryEINTR(t *testing.T) {
+	calls := 0
+	unixLstat = func(path string, st *unix.Stat_t) error {
+		calls++
+		if calls < 3 {
+			return unix.EINTR
+		}
+
+		return unix.Lstat(path, st)
+	}
+
+	defer func() { unixLstat = unix.Lstat }()
+
+	path := t.TempDir()
+
+	st := unix.Stat_t{}
+	err := Lstat(path, &st)
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, uint32(unix.S_IFDIR), st.Mode&unix.S_IFMT)
+
+	// Other errors are returned right away.
+	calls = 10
+	unixLstat = func(path string, st *unix.Stat_t) error {
+		calls++
+		return unix.ENOENT
+	}
+
+	err = Lstat(path, &st)
+	assert.ErrorIs(t, err, unix.ENOENT)
+	assert.Equal(t, 11, calls)
+}
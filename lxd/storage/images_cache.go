@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lxc/lxd/lxd/locking"
+)
+
+// imagesCachePruneThreshold is the percentage of the limit of the images cache of a pool above which its least
+// recently used images are pruned.
+const imagesCachePruneThreshold = 90
+
+// imagesCacheEntry represents an image volume of the images cache of a pool.
+type imagesCacheEntry struct {
+	Fingerprint string
+	LastUsedAt  time.Time
+	Usage       int64
+}
+
+// imagesCacheNeedsPruning returns whether an images cache using usage bytes of its limit must be pruned. An images
+// cache which isn't bounded (whose limit isn't greater than 0) is never pruned.
+func imagesCacheNeedsPruning(usage int64, limit int64) bool {
+	return limit > 0 && usage >= limit*imagesCachePruneThreshold/100
+}
+
+// pruneImages deletes images from an images cache using usage bytes of its limit, least recently used first, until
+// its usage with the incoming bytes of a new image drops below imagesCachePruneThreshold percent of the limit, and
+// returns the fingerprints of the deleted images. Each image is deleted by deleteImage while holding its lock taken
+// with tryLock, the images whose lock is held (such as being copied from) being skipped. Nothing is pruned while
+// the usage is below the threshold or if the cache isn't bounded.
+func pruneImages(images []imagesCacheEntry, usage int64, incoming int64, limit int64, tryLock func(fingerprint string) (locking.UnlockFunc, bool), deleteImage func(fingerprint string) error) ([]string, error) {
+	sorted := make([]imagesCacheEntry, len(images))
+	copy(sorted, images)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].LastUsedAt.Equal(sorted[j].LastUsedAt) {
+			return sorted[i].Fingerprint < sorted[j].Fingerprint
+		}
+
+		return sorted[i].LastUsedAt.Before(sorted[j].LastUsedAt)
+	})
+
+	pruned := []string{}
+	for _, image := range sorted {
+		if !imagesCacheNeedsPruning(usage+incoming, limit) {
+			break
+		}
+
+		unlock, ok := tryLock(image.Fingerprint)
+		if !ok {
+			continue
+		}
+
+		err := deleteImage(image.Fingerprint)
+		unlock()
+		if err != nil {
+			return pruned, fmt.Errorf("Failed pruning image %q from images cache: %w", image.Fingerprint, err)
+		}
+
+		pruned = append(pruned, image.Fingerprint)
+		usage -= image.Usage
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/locking"
+)
+
+// Test that the least recently used images are pruned once the usage of the images cache reaches the threshold
+// of its limit.
+func TestPruneImages(t *testing.T) {
+	now := time.Now()
+	images := []imagesCacheEntry{
+		{Fingerprint: "recent", LastUsedAt: now, Usage: 300},
+		{Fingerprint: "oldest", LastUsedAt: now.Add(-3 * time.Hour), Usage: 200},
+		{Fingerprint: "old", LastUsedAt: now.Add(-2 * time.Hour), Usage: 200},
+		{Fingerprint: "unused", Usage: 100},
+	}
+
+	tryLock := func(fingerprint string) (locking.UnlockFunc, bool) {
+		return locking.TryLock("TestPruneImages_" + fingerprint)
+	}
+
+	prune := func(usage int64, incoming int64, limit int64) []string {
+		deleted := []string{}
+		pruned, err := pruneImages(images, usage, incoming, limit, tryLock, func(fingerprint string) error {
+			deleted = append(deleted, fingerprint)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, deleted, pruned)
+
+		return pruned
+	}
+
+	// Below the threshold nothing is pruned.
+	assert.Empty(t, prune(800, 0, 1000))
+	assert.Empty(t, prune(899, 0, 1000))
+
+	// At the threshold the least recently used images are pruned until the usage drops below it.
+	assert.Equal(t, []string{"unused"}, prune(900, 0, 1000))
+	assert.Equal(t, []string{"unused", "oldest"}, prune(1000, 0, 1000))
+	assert.Equal(t, []string{"unused", "oldest", "old"}, prune(1200, 0, 1000))
+
+	// The incoming image counts towards the threshold.
+	assert.Equal(t, []string{"unused"}, prune(800, 150, 1000))
+
+	// Without a limit the cache isn't pruned.
+	assert.Empty(t, prune(1200, 0, 0))
+
+	// An image in use is skipped in favour of the next least recently used one.
+	unlock := locking.Lock("TestPruneImages_unused")
+	assert.Equal(t, []string{"oldest"}, prune(900, 0, 1000))
+	unlock()
+
+	// The image lock is released after pruning.
+	unlock, ok := tryLock("oldest")
+	require.True(t, ok)
+	unlock()
+}
+
+// Test that a failure to delete an image stops the pruning and is reported along with the images pruned so far.
+func TestPruneImages_Failure(t *testing.T) {
+	images := []imagesCacheEntry{
+		{Fingerprint: "img1", Usage: 100},
+		{Fingerprint: "img2", Usage: 100},
+	}
+
+	tryLock := func(fingerprint string) (locking.UnlockFunc, bool) {
+		return locking.TryLock("TestPruneImages_Failure_" + fingerprint)
+	}
+
+	pruned, err := pruneImages(images, 1000, 0, 1000, tryLock, func(fingerprint string) error {
+		if fingerprint == "img2" {
+			return fmt.Errorf("Volume busy")
+		}
+
+		return nil
+	})
+	assert.ErrorContains(t, err, `Failed pruning image "img2" from images cache: Volume busy`)
+	assert.Equal(t, []string{"img1"}, pruned)
+}
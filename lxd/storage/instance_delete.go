@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"github.com/lxc/lxd/lxd/locking"
+)
+
+// deleteVolumeWithoutSnapshots deletes a volume with remove once snapshots reports that it has none. As the
+// snapshots are recorded in the database before being created on disk while holding the lock named lockName, the
+// check is repeated while holding that lock: a snapshot being created concurrently is then either seen by the
+// check or fails to find the deleted volume. Returns ErrInstanceHasSnapshots if the volume has snapshots.
+func deleteVolumeWithoutSnapshots(lockName string, snapshots func() ([]string, error), remove func() error) error {
+	names, err := snapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		return ErrInstanceHasSnapshots
+	}
+
+	unlock := locking.Lock(lockName)
+	defer unlock()
+
+	names, err = snapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		return ErrInstanceHasSnapshots
+	}
+
+	return remove()
+}
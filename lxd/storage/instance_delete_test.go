@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/lxd/locking"
+)
+
+// Test that a volume without snapshots is deleted after checking it again under the lock.
+func TestDeleteVolumeWithoutSnapshots(t *testing.T) {
+	checks := 0
+	snapshots := func() ([]string, error) {
+		checks++
+		return nil, nil
+	}
+
+	removed := false
+	err := deleteVolumeWithoutSnapshots("TestDeleteVolumeWithoutSnapshots", snapshots, func() error {
+		removed = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	assert.Equal(t, 2, checks)
+
+	// A volume with snapshots isn't deleted.
+	removed = false
+	err = deleteVolumeWithoutSnapshots("TestDeleteVolumeWithoutSnapshots", func() ([]string, error) { return []string{"c1/snap0"}, nil }, func() error {
+		removed = true
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrInstanceHasSnapshots)
+	assert.False(t, removed)
+
+	// Failing to list the snapshots is reported.
+	err = deleteVolumeWithoutSnapshots("TestDeleteVolumeWithoutSnapshots", func() ([]string, error) { return nil, fmt.Errorf("Database unavailable") }, func() error {
+		removed = true
+		return nil
+	})
+	assert.EqualError(t, err, "Database unavailable")
+	assert.False(t, removed)
+}
+
+// Test that a snapshot created while the volume is being deleted, being recorded before taking the lock it is
+// created under, either prevents the deletion or fails to find the volume.
+func TestDeleteVolumeWithoutSnapshots_ConcurrentCreation(t *testing.T) {
+	lockName := "TestDeleteVolumeWithoutSnapshots_ConcurrentCreation"
+
+	mu := sync.Mutex{}
+	records := []string{}
+	volumeExists := true
+
+	snapshots := func() ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]string{}, records...), nil
+	}
+
+	remove := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		volumeExists = false
+		return nil
+	}
+
+	// Record the snapshot and create it on disk while holding the lock, as CreateInstanceSnapshot does,
+	// removing the record if the volume is gone.
+	createSnapshot := func(name string, locked func()) error {
+		mu.Lock()
+		records = append(records, name)
+		mu.Unlock()
+
+		unlock := locking.Lock(lockName)
+		defer unlock()
+
+		if locked != nil {
+			locked()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !volumeExists {
+			records = records[:len(records)-1]
+			return fmt.Errorf("Volume not found")
+		}
+
+		return nil
+	}
+
+	// The snapshot is recorded after the first check of the deletion and still being created when it runs.
+	recorded := make(chan struct{})
+	create := make(chan struct{})
+	created := make(chan error)
+	go func() {
+		created <- createSnapshot("c1/snap0", func() {
+			close(recorded)
+			<-create
+		})
+	}()
+
+	first := true
+	racySnapshots := func() ([]string, error) {
+		if first {
+			first = false
+			return nil, nil
+		}
+
+		return snapshots()
+	}
+
+	<-recorded
+	deleted := make(chan error)
+	go func() { deleted <- deleteVolumeWithoutSnapshots(lockName, racySnapshots, remove) }()
+
+	close(create)
+	assert.NoError(t, <-created)
+	assert.ErrorIs(t, <-deleted, ErrInstanceHasSnapshots)
+	assert.True(t, volumeExists)
+
+	// A snapshot which gets the lock after the deletion fails as the volume is gone, leaving no record.
+	records = records[:0]
+	assert.NoError(t, deleteVolumeWithoutSnapshots(lockName, snapshots, remove))
+	assert.False(t, volumeExists)
+
+	assert.EqualError(t, createSnapshot("c1/snap1", nil), "Volume not found")
+	assert.Empty(t, records)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"io"
 	"net/url"
 	"time"
@@ -23,6 +24,15 @@ type MountInfo struct {
 	DiskPath string // The location of the block disk (if supported).
 }
 
+// SnapshotInfo represents the metadata of a volume snapshot, from its database record and from the pool.
+type SnapshotInfo struct {
+	Name         string                      `json:"name" yaml:"name"`                         // The snapshot name.
+	CreationDate time.Time                   `json:"created_at" yaml:"created_at"`             // Creation date of the database record.
+	ExpiryDate   time.Time                   `json:"expires_at" yaml:"expires_at"`             // Expiry date of the database record.
+	Recorded     bool                        `json:"recorded" yaml:"recorded"`                 // Whether the snapshot has a database record.
+	Volume       *drivers.VolumeSnapshotInfo `json:"volume,omitempty" yaml:"volume,omitempty"` // On-disk metadata, nil if the snapshot is missing from the pool.
+}
+
 // Type represents a LXD storage pool type.
 type Type interface {
 	ValidateName(name string) error
@@ -43,6 +53,29 @@ type Pool interface {
 	ToAPI() api.StoragePool
 
 	GetResources() (*api.ResourcesStoragePool, error)
+	Rebalance(ctx context.Context, projectName string, volNames []string, op *operations.Operation) error
+	EstimateSharing(projectName string, volNames []string) (*drivers.SpaceSharingEstimate, error)
+	EmergencyFree(op *operations.Operation) error
+	ValidateLayout() (*drivers.LayoutReport, error)
+	CheckHealth(repairReadonly bool) (*drivers.PoolHealthReport, error)
+	GetSnapshotsReclaimableSpace(projectName string, volName string) (*drivers.ReclaimableSpaceReport, error)
+	OrderVolumeSnapshots(projectName string, volName string, order string) ([]string, error)
+	FindSnapshotsWithPath(projectName string, volName string, path string) ([]SnapshotIndexMatch, error)
+	SnapshotVolumePath(projectName string, volName string, path string, snapshotName string, op *operations.Operation) (string, error)
+	FindStraySubvolumes() ([]string, error)
+	GetSubvolumeVolumes() (map[string]SubvolumeVolume, error)
+	ConfigState() (*PoolConfigState, error)
+	ConfigDrift(baseline PoolConfigState) ([]PoolConfigDifference, error)
+	VerifyVolumeMounts(op *operations.Operation) (*VolumeMountReport, error)
+	Quiesce(freeze bool, timeout time.Duration) error
+	Resume() error
+	GetSnapshotTimeEstimate(projectName string, volName string) (time.Duration, error)
+	RepairImagesReadonly(op *operations.Operation) ([]string, error)
+	PruneSnapshotDirs(op *operations.Operation) ([]string, error)
+	RebuildSnapshotSymlinks(op *operations.Operation) (*SnapshotSymlinksRebuild, error)
+	CleanupStaleMounts(insts []instance.Instance) ([]drivers.MountInfo, error)
+	ExportVolumeOCI(projectName string, volName string, w io.Writer, config *drivers.OCIImageConfig, op *operations.Operation) error
+	GetProjectVolumeUsage(projectName string, volName string) (int64, error)
 	IsUsed() (bool, error)
 	Delete(clientType request.ClientType, op *operations.Operation) error
 	Update(clientType request.ClientType, newDesc string, newConfig map[string]string, op *operations.Operation) error
@@ -57,6 +90,7 @@ type Pool interface {
 
 	// Instances.
 	CreateInstance(inst instance.Instance, op *operations.Operation) error
+	CreateInstanceFromStream(inst instance.Instance, r io.Reader, checksum string, op *operations.Operation) error
 	CreateInstanceFromBackup(srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (func(instance.Instance) error, revert.Hook, error)
 	CreateInstanceFromCopy(inst instance.Instance, src instance.Instance, snapshots bool, allowInconsistent bool, op *operations.Operation) error
 	CreateInstanceFromImage(inst instance.Instance, fingerprint string, op *operations.Operation) error
@@ -74,15 +108,21 @@ type Pool interface {
 	BackupInstance(inst instance.Instance, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots bool, op *operations.Operation) error
 
 	GetInstanceUsage(inst instance.Instance) (int64, error)
+	GetInstanceGeneration(inst instance.Instance) (uint64, error)
+	GetInstanceSnapshotsInfo(inst instance.Instance) ([]SnapshotInfo, error)
+	InstanceTotalFootprint(inst instance.Instance) (int64, error)
 	SetInstanceQuota(inst instance.Instance, size string, vmStateSize string, op *operations.Operation) error
+	DiffInstanceWithImage(inst instance.Instance, op *operations.Operation) (*drivers.VolumeDiff, error)
 
 	MountInstance(inst instance.Instance, op *operations.Operation) (*MountInfo, error)
 	UnmountInstance(inst instance.Instance, op *operations.Operation) error
 
 	// Instance snapshots.
 	CreateInstanceSnapshot(inst instance.Instance, src instance.Instance, op *operations.Operation) error
+	CheckInstanceSnapshotRate(inst instance.Instance) error
 	RenameInstanceSnapshot(inst instance.Instance, newName string, op *operations.Operation) error
-	DeleteInstanceSnapshot(inst instance.Instance, op *operations.Operation) error
+	DeleteInstanceSnapshot(inst instance.Instance, force bool, op *operations.Operation) error
+	CheckInstanceSnapshotsDelete(snapshots []instance.Instance, op *operations.Operation) error
 	RestoreInstanceSnapshot(inst instance.Instance, src instance.Instance, op *operations.Operation) error
 	MountInstanceSnapshot(inst instance.Instance, op *operations.Operation) (*MountInfo, error)
 	UnmountInstanceSnapshot(inst instance.Instance, op *operations.Operation) error
@@ -111,6 +151,7 @@ type Pool interface {
 	DeleteCustomVolume(projectName string, volName string, op *operations.Operation) error
 	GetCustomVolumeDisk(projectName string, volName string) (string, error)
 	GetCustomVolumeUsage(projectName string, volName string) (int64, error)
+	GetCustomVolumeGeneration(projectName string, volName string) (uint64, error)
 	MountCustomVolume(projectName string, volName string, op *operations.Operation) error
 	UnmountCustomVolume(projectName string, volName string, op *operations.Operation) (bool, error)
 	ImportCustomVolume(projectName string, poolVol *backupConfig.Config, op *operations.Operation) error
@@ -122,8 +163,15 @@ type Pool interface {
 	RenameCustomVolumeSnapshot(projectName string, volName string, newSnapshotName string, op *operations.Operation) error
 	DeleteCustomVolumeSnapshot(projectName string, volName string, op *operations.Operation) error
 	UpdateCustomVolumeSnapshot(projectName string, volName string, newDesc string, newConfig map[string]string, newExpiryDate time.Time, op *operations.Operation) error
+	SetCustomVolumeSnapshotMetadata(projectName string, volName string, metadata map[string]string, op *operations.Operation) error
+	ArchiveCustomVolumeSnapshot(projectName string, volName string, archivePoolName string, op *operations.Operation) (string, error)
+	RestoreCustomVolumeSnapshotArchive(projectName string, archivePoolName string, archiveVolName string, volName string, op *operations.Operation) error
+	GetCustomVolumeSnapshotUsage(projectName string, volName string) (*api.StorageVolumeSnapshotUsage, error)
 	RestoreCustomVolume(projectName string, volName string, snapshotName string, op *operations.Operation) error
 
+	// Volume snapshot send parents.
+	UpdateVolumeSnapshotSendParentRefCount(projectName string, volName string, volType drivers.VolumeType, increment bool, op *operations.Operation) (uint, error)
+
 	// Custom volume migration.
 	MigrationTypes(contentType drivers.ContentType, refresh bool) []migration.Type
 	CreateCustomVolumeFromMigration(projectName string, conn io.ReadWriteCloser, args migration.VolumeTargetArgs, op *operations.Operation) error
@@ -142,6 +142,7 @@ func LoadByName(state *state.State, name string) (Pool, error) {
 		pool.name = name
 		pool.state = state
 		pool.logger = logger.AddContext(logger.Log, logger.Ctx{"driver": "mock", "pool": pool.name})
+
 		driver, err := drivers.Load(state, "mock", "", nil, pool.logger, nil, nil)
 		if err != nil {
 			return nil, err
@@ -223,6 +224,33 @@ func IsAvailable(poolName string) bool {
 	return !found
 }
 
+// UnavailableReason returns the reason the pool is unavailable, or an empty string if it's available or the
+// reason isn't known.
+func UnavailableReason(poolName string) string {
+	unavailablePoolsMu.Lock()
+	defer unavailablePoolsMu.Unlock()
+
+	return unavailablePools[poolName]
+}
+
+// CheckRequiredTools checks that the binaries required by the pool's driver are available. If not, the pool is
+// marked as unavailable with the returned error as the reason, so that it is reported as such rather than failing
+// when used. The pool becomes available again once mounted.
+func CheckRequiredTools(poolName string, driverName string) error {
+	missingTools := drivers.MissingTools(driverName)
+	if len(missingTools) == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("Required tool %q is missing", missingTools[0])
+
+	unavailablePoolsMu.Lock()
+	unavailablePools[poolName] = err.Error()
+	unavailablePoolsMu.Unlock()
+
+	return err
+}
+
 // Patch applies specified patch to all storage pools.
 // All storage pools must be available locally before any storage pools are patched.
 func Patch(s *state.State, patchName string) error {
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a btrfs pool is marked as unavailable, along with the reason, when the btrfs tool is missing.
+func TestCheckRequiredTools(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	t.Cleanup(func() {
+		unavailablePoolsMu.Lock()
+		delete(unavailablePools, "pool1")
+		delete(unavailablePools, "pool2")
+		unavailablePoolsMu.Unlock()
+	})
+
+	err := CheckRequiredTools("pool1", "btrfs")
+	require.Error(t, err)
+	assert.Equal(t, `Required tool "btrfs" is missing`, err.Error())
+	assert.False(t, IsAvailable("pool1"))
+	assert.Equal(t, `Required tool "btrfs" is missing`, UnavailableReason("pool1"))
+
+	// Drivers without required tools are left alone.
+	err = CheckRequiredTools("pool2", "dir")
+	require.NoError(t, err)
+	assert.True(t, IsAvailable("pool2"))
+	assert.Empty(t, UnavailableReason("pool2"))
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/lxc/lxd/lxd/locking"
+)
+
+// poolMaintenanceLocks records the maintenance operation in progress on each pool, keyed by pool name.
+// Pool-wide maintenance operations (such as rebalancing or deleting the pool) are serialized through it, while
+// per-volume operations don't use it and so are unaffected.
+var poolMaintenanceLocks = map[string]string{}
+
+// poolMaintenanceLocksMu is used to access poolMaintenanceLocks safely.
+var poolMaintenanceLocksMu sync.Mutex
+
+// lockPoolMaintenance acquires the maintenance lock of the pool for the named operation.
+// It doesn't wait for the lock and returns ErrPoolBusy if another operation holds it.
+// On success, it returns an unlock function which needs to be called to release the lock.
+func lockPoolMaintenance(poolName string, operation string) (locking.UnlockFunc, error) {
+	poolMaintenanceLocksMu.Lock()
+	defer poolMaintenanceLocksMu.Unlock()
+
+	current, ok := poolMaintenanceLocks[poolName]
+	if ok {
+		return nil, ErrPoolBusy{Pool: poolName, Operation: current}
+	}
+
+	poolMaintenanceLocks[poolName] = operation
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			poolMaintenanceLocksMu.Lock()
+			delete(poolMaintenanceLocks, poolName)
+			poolMaintenanceLocksMu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that a second maintenance operation is rejected while the first holds the lock.
+func TestLockPoolMaintenance(t *testing.T) {
+	unlock, err := lockPoolMaintenance("pool1", "rebalance")
+	assert.NoError(t, err)
+
+	_, err = lockPoolMaintenance("pool1", "delete")
+	var busyErr ErrPoolBusy
+	assert.True(t, errors.As(err, &busyErr))
+	assert.Equal(t, "pool1", busyErr.Pool)
+	assert.Equal(t, "rebalance", busyErr.Operation)
+
+	// Other pools aren't affected.
+	unlockOther, err := lockPoolMaintenance("pool2", "delete")
+	assert.NoError(t, err)
+	unlockOther()
+
+	// Unlocking is idempotent and allows the next operation.
+	unlock()
+	unlock()
+
+	unlock, err = lockPoolMaintenance("pool1", "delete")
+	assert.NoError(t, err)
+	unlock()
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/lxd/locking"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// PoolQuiesceDefaultTimeout is how long a pool stays quiesced when no timeout is given, unless resumed earlier.
+const PoolQuiesceDefaultTimeout = 10 * time.Minute
+
+// poolQuiesce represents a quiesced pool.
+type poolQuiesce struct {
+	resumed chan struct{}      // Closed once the pool is resumed.
+	unlock  locking.UnlockFunc // Releases the maintenance lock of the pool, held while it is quiesced.
+	expiry  *time.Timer        // Resumes the pool once the quiesce times out.
+}
+
+// poolQuiesces records the quiesced pools, keyed by pool name.
+var poolQuiesces = map[string]*poolQuiesce{}
+
+// poolQuiescesMu is used to access poolQuiesces safely.
+var poolQuiescesMu sync.Mutex
+
+// poolQuiesceMu serializes quiescing and resuming pools, which can take a while, without holding up the
+// operations checking whether their pool is quiesced.
+var poolQuiesceMu sync.Mutex
+
+// quiescePool marks the pool as quiesced, so that new operations wait for it to be resumed, and then runs quiesce
+// to bring the pool to a consistent state, freezing its filesystem if freeze is set. The maintenance lock of the
+// pool is held until it is resumed, ErrPoolBusy being returned if another maintenance operation (including
+// quiescing) is in progress. The pool is resumed straight away if quiesce fails, and automatically once timeout
+// has passed, using thaw, so that a client which goes away doesn't block the pool forever.
+func quiescePool(poolName string, freeze bool, timeout time.Duration, quiesce func(freeze bool) error, thaw func() error) error {
+	poolQuiesceMu.Lock()
+	defer poolQuiesceMu.Unlock()
+
+	unlock, err := lockPoolMaintenance(poolName, "quiesce")
+	if err != nil {
+		return err
+	}
+
+	q := &poolQuiesce{resumed: make(chan struct{}), unlock: unlock}
+
+	poolQuiescesMu.Lock()
+	poolQuiesces[poolName] = q
+	poolQuiescesMu.Unlock()
+
+	err = quiesce(freeze)
+	if err != nil {
+		// Partially applied quiesces (such as a freeze followed by a failure) are reverted.
+		_ = thaw()
+		q.resume(poolName)
+		return err
+	}
+
+	q.expiry = time.AfterFunc(timeout, func() { expirePoolQuiesce(poolName, q, thaw) })
+
+	return nil
+}
+
+// expirePoolQuiesce resumes the pool if it is still quiesced by q once its quiesce timed out. The operations are
+// let through even if thaw fails, it being retried by resumePool.
+func expirePoolQuiesce(poolName string, q *poolQuiesce, thaw func() error) {
+	poolQuiesceMu.Lock()
+	defer poolQuiesceMu.Unlock()
+
+	poolQuiescesMu.Lock()
+	current := poolQuiesces[poolName]
+	poolQuiescesMu.Unlock()
+
+	if current != q {
+		return
+	}
+
+	err := thaw()
+	if err != nil {
+		logger.Error("Failed thawing storage pool after its quiesce timed out", logger.Ctx{"pool": poolName, "err": err})
+	} else {
+		logger.Warn("Resumed storage pool after its quiesce timed out", logger.Ctx{"pool": poolName})
+	}
+
+	q.resume(poolName)
+}
+
+// resumePool runs thaw and then lets the operations waiting for the pool to be resumed proceed. The pool stays
+// quiesced if thaw fails. As the quiesce state doesn't survive a restart of LXD while the filesystem may still be
+// frozen, thaw is run even if the pool isn't known to be quiesced.
+func resumePool(poolName string, thaw func() error) error {
+	poolQuiesceMu.Lock()
+	defer poolQuiesceMu.Unlock()
+
+	err := thaw()
+	if err != nil {
+		return fmt.Errorf("Failed resuming storage pool %q: %w", poolName, err)
+	}
+
+	poolQuiescesMu.Lock()
+	q, ok := poolQuiesces[poolName]
+	poolQuiescesMu.Unlock()
+
+	if ok {
+		q.expiry.Stop()
+		q.resume(poolName)
+	}
+
+	return nil
+}
+
+// resume removes the quiesced pool and releases the operations waiting for it as well as its maintenance lock.
+func (q *poolQuiesce) resume(poolName string) {
+	poolQuiescesMu.Lock()
+	delete(poolQuiesces, poolName)
+	poolQuiescesMu.Unlock()
+
+	close(q.resumed)
+	q.unlock()
+}
+
+// waitPoolResumed blocks while the pool is quiesced.
+func waitPoolResumed(poolName string) {
+	for {
+		poolQuiescesMu.Lock()
+		q, ok := poolQuiesces[poolName]
+		poolQuiescesMu.Unlock()
+
+		if !ok {
+			return
+		}
+
+		<-q.resumed
+	}
+}
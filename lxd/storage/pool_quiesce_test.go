@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that operations block while a pool is quiesced and proceed once it is resumed.
+func TestQuiescePool(t *testing.T) {
+	frozen := false
+	thaws := 0
+	thaw := func() error {
+		thaws++
+		return nil
+	}
+
+	err := quiescePool("pool1", true, time.Hour, func(freeze bool) error {
+		frozen = freeze
+		return nil
+	}, thaw)
+	require.NoError(t, err)
+	assert.True(t, frozen)
+
+	done := make(chan struct{})
+	go func() {
+		waitPoolResumed("pool1")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Operation proceeded while the pool is quiesced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Other pools aren't affected.
+	waitPoolResumed("pool2")
+
+	// Pools can't be quiesced twice, nor undergo other maintenance meanwhile.
+	err = quiescePool("pool1", false, time.Hour, func(freeze bool) error { return nil }, thaw)
+	var busyErr ErrPoolBusy
+	assert.True(t, errors.As(err, &busyErr))
+	assert.Equal(t, "quiesce", busyErr.Operation)
+
+	_, err = lockPoolMaintenance("pool1", "delete")
+	assert.True(t, errors.As(err, &busyErr))
+
+	// The pool stays quiesced if it can't be thawed.
+	err = resumePool("pool1", func() error { return fmt.Errorf("Thaw failed") })
+	assert.Error(t, err)
+
+	select {
+	case <-done:
+		t.Fatal("Operation proceeded while the pool is quiesced")
+	default:
+	}
+
+	err = resumePool("pool1", thaw)
+	require.NoError(t, err)
+	assert.Equal(t, 1, thaws)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Operation didn't proceed once the pool was resumed")
+	}
+
+	// The maintenance lock is released.
+	unlock, err := lockPoolMaintenance("pool1", "delete")
+	require.NoError(t, err)
+	unlock()
+
+	// Pools which aren't known to be quiesced, such as after a restart, are still thawed.
+	err = resumePool("pool1", thaw)
+	require.NoError(t, err)
+	assert.Equal(t, 2, thaws)
+}
+
+// Test that a pool which fails to be quiesced is thawed and resumed straight away.
+func TestQuiescePool_Failure(t *testing.T) {
+	thawed := false
+	err := quiescePool("pool1", true, time.Hour, func(freeze bool) error { return fmt.Errorf("Sync failed") }, func() error {
+		thawed = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.True(t, thawed)
+
+	waitPoolResumed("pool1")
+
+	unlock, err := lockPoolMaintenance("pool1", "delete")
+	require.NoError(t, err)
+	unlock()
+}
+
+// Test that a pool which isn't resumed is thawed and resumed once its quiesce times out.
+func TestQuiescePool_Timeout(t *testing.T) {
+	thawed := make(chan struct{})
+	err := quiescePool("pool1", true, 100*time.Millisecond, func(freeze bool) error { return nil }, func() error {
+		close(thawed)
+		return nil
+	})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		waitPoolResumed("pool1")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Operation didn't proceed once the quiesce timed out")
+	}
+
+	<-thawed
+
+	unlock, err := lockPoolMaintenance("pool1", "delete")
+	require.NoError(t, err)
+	unlock()
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/project"
+	"github.com/lxc/lxd/lxd/response"
+	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// projectVolume identifies a volume used by a project on a pool.
+type projectVolume struct {
+	Pool    string
+	Project string // Project the volume belongs to, which differs from the project for shared custom volumes.
+	Name    string // Specified as "<type>/<name>".
+}
+
+// ProjectStorageUsage returns the space used (in bytes) on this member by the instances and custom volumes of
+// the project, keyed by storage pool name. Pools and volumes whose usage can't be retrieved are logged and skipped.
+func ProjectStorageUsage(s *state.State, projectName string) (map[string]int64, error) {
+	// Custom volumes may belong to the default project if the project doesn't have its own.
+	customProjectName, err := project.StorageVolumeProject(s.DB.Cluster, projectName, db.StoragePoolVolumeTypeCustom)
+	if err != nil {
+		return nil, err
+	}
+
+	poolNames, err := s.DB.Cluster.GetStoragePoolNames()
+	if err != nil && !response.IsNotFoundError(err) {
+		return nil, fmt.Errorf("Failed loading storage pools: %w", err)
+	}
+
+	containerType := db.StoragePoolVolumeTypeContainer
+	vmType := db.StoragePoolVolumeTypeVM
+	customType := db.StoragePoolVolumeTypeCustom
+	filters := []db.StorageVolumeFilter{
+		{Type: &containerType, Project: &projectName},
+		{Type: &vmType, Project: &projectName},
+		{Type: &customType, Project: &customProjectName},
+	}
+
+	pools := make(map[string]Pool, len(poolNames))
+	vols := []projectVolume{}
+	for _, poolName := range poolNames {
+		pool, err := LoadByName(s, poolName)
+		if err != nil {
+			logger.Warn("Failed loading storage pool for project usage", logger.Ctx{"project": projectName, "pool": poolName, "err": err})
+			continue
+		}
+
+		pools[poolName] = pool
+
+		err = s.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+			dbVols, err := tx.GetStoragePoolVolumes(ctx, pool.ID(), true, filters...)
+			if err != nil {
+				return fmt.Errorf("Failed loading storage volumes: %w", err)
+			}
+
+			for _, dbVol := range dbVols {
+				if shared.IsSnapshot(dbVol.Name) {
+					continue
+				}
+
+				vols = append(vols, projectVolume{Pool: poolName, Project: dbVol.Project, Name: fmt.Sprintf("%s/%s", dbVol.Type, dbVol.Name)})
+			}
+
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Failed listing storage volumes for project usage", logger.Ctx{"project": projectName, "pool": poolName, "err": err})
+			continue
+		}
+	}
+
+	return sumProjectVolumesUsage(vols, func(vol projectVolume) (int64, error) {
+		return pools[vol.Pool].GetProjectVolumeUsage(vol.Project, vol.Name)
+	}), nil
+}
+
+// sumProjectVolumesUsage sums the usage of the volumes per pool. Volumes whose usage isn't available are skipped
+// and other failures are logged, so that a single broken volume doesn't hide the usage of the rest of the pool.
+func sumProjectVolumesUsage(vols []projectVolume, usage func(vol projectVolume) (int64, error)) map[string]int64 {
+	result := map[string]int64{}
+	for _, vol := range vols {
+		used, err := usage(vol)
+		if err != nil {
+			if !errors.Is(err, drivers.ErrNotSupported) {
+				logger.Warn("Failed getting volume usage", logger.Ctx{"project": vol.Project, "pool": vol.Pool, "volume": vol.Name, "err": err})
+			}
+
+			continue
+		}
+
+		result[vol.Pool] += used
+	}
+
+	return result
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/lxd/storage/drivers"
+)
+
+// Test that usage is summed per pool for instances spread across two pools of a project.
+func TestSumProjectVolumesUsage(t *testing.T) {
+	vols := []projectVolume{
+		{Pool: "pool1", Project: "p1", Name: "container/c1"},
+		{Pool: "pool1", Project: "p1", Name: "virtual-machine/v1"},
+		{Pool: "pool2", Project: "p1", Name: "container/c2"},
+		{Pool: "pool2", Project: "default", Name: "custom/vol1"},
+		{Pool: "pool2", Project: "p1", Name: "container/c3"},
+	}
+
+	usages := map[string]int64{
+		"pool1/container/c1":       100,
+		"pool1/virtual-machine/v1": 2000,
+		"pool2/container/c2":       30,
+		"pool2/custom/vol1":        400,
+	}
+
+	usage := sumProjectVolumesUsage(vols, func(vol projectVolume) (int64, error) {
+		used, ok := usages[vol.Pool+"/"+vol.Name]
+		if !ok {
+			return -1, drivers.ErrNotSupported
+		}
+
+		return used, nil
+	})
+
+	assert.Equal(t, map[string]int64{"pool1": 2100, "pool2": 430}, usage)
+}
+
+// Test that a volume whose usage fails doesn't prevent reporting the usage of the other volumes of the pool.
+func TestSumProjectVolumesUsage_Failure(t *testing.T) {
+	vols := []projectVolume{
+		{Pool: "pool1", Project: "p1", Name: "container/c1"},
+		{Pool: "pool1", Project: "p1", Name: "container/broken"},
+		{Pool: "pool2", Project: "p1", Name: "container/broken"},
+	}
+
+	usage := sumProjectVolumesUsage(vols, func(vol projectVolume) (int64, error) {
+		if vol.Name == "container/broken" {
+			return -1, fmt.Errorf("Failed getting qgroup")
+		}
+
+		return 100, nil
+	})
+
+	assert.Equal(t, map[string]int64{"pool1": 100}, usage)
+}
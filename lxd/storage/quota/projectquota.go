@@ -10,6 +10,7 @@ import (
 
 	"golang.org/x/sys/unix"
 
+	"github.com/lxc/lxd/lxd/storage/filesystem"
 	"github.com/lxc/lxd/shared"
 )
 
@@ -170,7 +171,7 @@ var errNoDevice = fmt.Errorf("Couldn't find backing device for mountpoint")
 func devForPath(path string) (string, error) {
 	// Get major/minor
 	var stat unix.Stat_t
-	err := unix.Lstat(path, &stat)
+	err := filesystem.Lstat(path, &stat)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// RecoveryBundleVersion is the version of the recovery bundle format written by this version of LXD.
+// It must be increased whenever a change to the format can't be read by older versions.
+const RecoveryBundleVersion = 1
+
+// RecoveryBundle is the configuration of a storage pool and of its volumes, without their data, allowing to
+// recreate the pool structure before restoring its data after a disaster.
+type RecoveryBundle struct {
+	Version   int       `json:"version" yaml:"version"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+
+	Pool    api.StoragePoolsPost   `json:"pool" yaml:"pool"`
+	Volumes []RecoveryBundleVolume `json:"volumes" yaml:"volumes"`
+
+	// QGroupLimits are the referenced data limits of the subvolumes of btrfs pools, keyed by path relative to
+	// the pool mount path.
+	QGroupLimits drivers.BTRFSQGroupLimits `json:"qgroup_limits,omitempty" yaml:"qgroup_limits,omitempty"`
+}
+
+// RecoveryBundleVolume is a storage volume of a recovery bundle.
+type RecoveryBundleVolume struct {
+	Project     string                   `json:"project" yaml:"project"`
+	Name        string                   `json:"name" yaml:"name"`
+	Type        string                   `json:"type" yaml:"type"`
+	ContentType string                   `json:"content_type" yaml:"content_type"`
+	Description string                   `json:"description" yaml:"description"`
+	Config      map[string]string        `json:"config" yaml:"config"`
+	CreatedAt   time.Time                `json:"created_at" yaml:"created_at"`
+	Snapshots   []RecoveryBundleSnapshot `json:"snapshots" yaml:"snapshots"`
+}
+
+// RecoveryBundleSnapshot is a snapshot of a storage volume of a recovery bundle.
+type RecoveryBundleSnapshot struct {
+	Name        string            `json:"name" yaml:"name"`
+	Description string            `json:"description" yaml:"description"`
+	Config      map[string]string `json:"config" yaml:"config"`
+	CreatedAt   time.Time         `json:"created_at" yaml:"created_at"`
+	ExpiresAt   *time.Time        `json:"expires_at" yaml:"expires_at"`
+}
+
+// Validate checks that the bundle can be imported by this version of LXD.
+func (b *RecoveryBundle) Validate() error {
+	if b.Version < 1 || b.Version > RecoveryBundleVersion {
+		return fmt.Errorf("Unsupported recovery bundle version %d (supported up to %d)", b.Version, RecoveryBundleVersion)
+	}
+
+	if b.Pool.Name == "" || b.Pool.Driver == "" {
+		return fmt.Errorf("Recovery bundle is missing the storage pool name or driver")
+	}
+
+	seen := make(map[string]bool, len(b.Volumes))
+	for _, vol := range b.Volumes {
+		if vol.Project == "" || vol.Name == "" || vol.Type == "" {
+			return fmt.Errorf("Recovery bundle has a volume without project, name or type")
+		}
+
+		key := fmt.Sprintf("%s/%s/%s", vol.Project, vol.Type, vol.Name)
+		if seen[key] {
+			return fmt.Errorf("Recovery bundle has volume %q of type %q in project %q more than once", vol.Name, vol.Type, vol.Project)
+		}
+
+		seen[key] = true
+	}
+
+	return nil
+}
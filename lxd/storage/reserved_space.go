@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/units"
+)
+
+// reservedSpace returns the space in bytes kept for LXD's own operations on a pool by its "reserved_space" key.
+func reservedSpace(poolConfig map[string]string) (int64, error) {
+	value := poolConfig["reserved_space"]
+	if value == "" {
+		return 0, nil
+	}
+
+	return units.ParseByteSizeString(value)
+}
+
+// applyReservedSpace removes the reserved space from the free space reported in the pool resources.
+func applyReservedSpace(res *api.ResourcesStoragePool, reserved int64) {
+	if reserved <= 0 || res.Space.Total == 0 {
+		return
+	}
+
+	free := uint64(0)
+	if res.Space.Total > res.Space.Used {
+		free = res.Space.Total - res.Space.Used
+	}
+
+	if uint64(reserved) >= free {
+		res.Space.Total = res.Space.Used
+	} else {
+		res.Space.Total -= uint64(reserved)
+	}
+}
+
+// reservedSpaceAllows returns an error if taking size more bytes on a pool with the given resources would leave
+// less free space than reserved. Operations not taking any space (a negative size) are always allowed so that a
+// pool within its reserve can still be cleaned up.
+func reservedSpaceAllows(res *api.ResourcesStoragePool, reserved int64, size int64) error {
+	if reserved <= 0 || size < 0 || res.Space.Total == 0 {
+		return nil
+	}
+
+	free := int64(0)
+	if res.Space.Total > res.Space.Used {
+		free = int64(res.Space.Total - res.Space.Used)
+	}
+
+	if free-size < reserved {
+		return api.StatusErrorf(http.StatusInsufficientStorage, "Not enough space left on the storage pool outside of its reserved space (%s free, %s requested, %s reserved)", units.GetByteSizeStringIEC(free, 2), units.GetByteSizeStringIEC(size, 2), units.GetByteSizeStringIEC(reserved, 2))
+	}
+
+	return nil
+}
+
+// checkReservedSpace returns an error if a user request taking size more bytes on the pool would eat into its
+// reserved space. Pools whose driver can't report their free space aren't checked.
+func (b *lxdBackend) checkReservedSpace(size int64) error {
+	reserved, err := reservedSpace(b.db.Config)
+	if err != nil || reserved <= 0 {
+		return err
+	}
+
+	res, err := b.driver.GetResources()
+	if err != nil {
+		if errors.Is(err, drivers.ErrNotSupported) {
+			return nil
+		}
+
+		return fmt.Errorf("Failed getting free space of storage pool: %w", err)
+	}
+
+	return reservedSpaceAllows(res, reserved, size)
+}
+
+// reservedSpaceGrowth returns the bytes a volume takes by growing from oldSize to newSize, or -1 if it doesn't grow.
+// A volume without a size defaults to the pool's volume.size (poolSize) and, if that isn't set either, is unbounded
+// so it's counted as 0 bytes to still be refused once the pool is within its reserve.
+func reservedSpaceGrowth(oldSize string, newSize string, poolSize string) (int64, error) {
+	if newSize == "" {
+		newSize = poolSize
+	}
+
+	if newSize == "" {
+		return 0, nil
+	}
+
+	if newSize == oldSize {
+		return -1, nil
+	}
+
+	newBytes, err := units.ParseByteSizeString(newSize)
+	if err != nil {
+		return -1, err
+	}
+
+	oldBytes := int64(0)
+	if oldSize != "" {
+		oldBytes, err = units.ParseByteSizeString(oldSize)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	if newBytes <= oldBytes {
+		return -1, nil
+	}
+
+	return newBytes - oldBytes, nil
+}
+
+// checkReservedSpaceGrowth checks the reserved space for a volume growing from oldSize to newSize, newSize
+// defaulting to the pool's volume.size.
+func (b *lxdBackend) checkReservedSpaceGrowth(oldSize string, newSize string) error {
+	size, err := reservedSpaceGrowth(oldSize, newSize, b.db.Config["volume.size"])
+	if err != nil {
+		return err
+	}
+
+	return b.checkReservedSpace(size)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+// Test that user allocations are refused within the reserve while operations freeing space still proceed.
+func TestReservedSpaceAllows(t *testing.T) {
+	reserved, err := reservedSpace(map[string]string{"reserved_space": "1GiB"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1073741824), reserved)
+
+	// 10GiB pool with 1.5GiB free.
+	res := &api.ResourcesStoragePool{Space: api.ResourcesStoragePoolSpace{Total: 10737418240, Used: 9126805504}}
+
+	// Creating a 256MiB volume leaves more than the reserve.
+	assert.NoError(t, reservedSpaceAllows(res, reserved, 268435456))
+
+	// Creating a 1GiB volume would eat into the reserve.
+	err = reservedSpaceAllows(res, reserved, 1073741824)
+	assert.Error(t, err)
+	assert.True(t, api.StatusErrorCheck(err, http.StatusInsufficientStorage))
+
+	// Once within the reserve, even volumes without a size are refused but deletes proceed.
+	res.Space.Used = 9900000000
+	assert.Error(t, reservedSpaceAllows(res, reserved, 0))
+	assert.NoError(t, reservedSpaceAllows(res, reserved, -536870912))
+
+	// Nothing is refused without a reserve.
+	assert.NoError(t, reservedSpaceAllows(res, 0, 1073741824))
+
+	// The reserve isn't reported as free.
+	applyReservedSpace(res, reserved)
+	assert.Equal(t, res.Space.Used, res.Space.Total)
+
+	res = &api.ResourcesStoragePool{Space: api.ResourcesStoragePoolSpace{Total: 10737418240, Used: 1073741824}}
+	applyReservedSpace(res, reserved)
+	assert.Equal(t, uint64(9663676416), res.Space.Total)
+}
+
+// Test that volumes without a size are checked with the pool's default size, or as unbounded without one.
+func TestReservedSpaceGrowth(t *testing.T) {
+	size, err := reservedSpaceGrowth("", "1GiB", "10GiB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1073741824), size)
+
+	size, err = reservedSpaceGrowth("", "", "10GiB")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10737418240), size)
+
+	size, err = reservedSpaceGrowth("", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	size, err = reservedSpaceGrowth("1GiB", "2GiB", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1073741824), size)
+
+	size, err = reservedSpaceGrowth("2GiB", "1GiB", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), size)
+
+	_, err = reservedSpaceGrowth("", "lots", "")
+	assert.Error(t, err)
+}
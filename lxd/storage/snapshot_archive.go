@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// Config keys recording the origin of the custom volumes holding archived snapshots.
+const (
+	// SnapshotArchiveSourceKey is the source of an archived snapshot, as "<pool>/<volume>/<snapshot>".
+	SnapshotArchiveSourceKey = "volatile.archive.source"
+
+	// SnapshotArchiveCreatedKey is the creation date of an archived snapshot (RFC3339).
+	SnapshotArchiveCreatedKey = "volatile.archive.created_at"
+)
+
+// SnapshotArchiveVolumeName returns the name of the custom volume holding the archive of the snapshot of the pool
+// on an archive pool. The source pool is included as an archive pool can be shared by several pools, and the
+// lengths of the pool and volume names are appended so that names containing "-" can't collide.
+func SnapshotArchiveVolumeName(poolName string, snapVolName string) string {
+	parentName, snapName, _ := api.GetParentAndSnapshotName(snapVolName)
+
+	return fmt.Sprintf("%s-%s-%s-%d-%d", poolName, parentName, snapName, len(poolName), len(parentName))
+}
+
+// SnapshotsToArchive returns the names of the snapshots created longer ago than age (an expiry expression such
+// as "30d") at now, oldest first. An empty age doesn't archive anything.
+func SnapshotsToArchive(age string, snapshots []shared.SnapshotRetentionEntry, now time.Time) ([]string, error) {
+	if age == "" {
+		return nil, nil
+	}
+
+	sorted := make([]shared.SnapshotRetentionEntry, len(snapshots))
+	copy(sorted, snapshots)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].CreationDate.Equal(sorted[j].CreationDate) {
+			return sorted[i].Name < sorted[j].Name
+		}
+
+		return sorted[i].CreationDate.Before(sorted[j].CreationDate)
+	})
+
+	names := []string{}
+	for _, snap := range sorted {
+		archiveDate, err := shared.GetExpiry(snap.CreationDate, age)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid snapshot archive age %q: %w", age, err)
+		}
+
+		if archiveDate.After(now) {
+			break // All remaining snapshots are newer.
+		}
+
+		names = append(names, snap.Name)
+	}
+
+	return names, nil
+}
+
+// snapshotArchiveConfig returns the config of the archive volume of a snapshot, recording where it comes from.
+// The snapshot schedule and archive policy are left out so that the archive volume doesn't get snapshots itself.
+func snapshotArchiveConfig(config map[string]string, poolName string, snapVolName string, createdAt time.Time) map[string]string {
+	archiveConfig := make(map[string]string, len(config)+2)
+	for key, value := range config {
+		if key == "snapshots.schedule" || strings.HasPrefix(key, "snapshots.archive.") {
+			continue
+		}
+
+		archiveConfig[key] = value
+	}
+
+	archiveConfig[SnapshotArchiveSourceKey] = fmt.Sprintf("%s/%s", poolName, snapVolName)
+	archiveConfig[SnapshotArchiveCreatedKey] = createdAt.UTC().Format(time.RFC3339)
+
+	return archiveConfig
+}
+
+// snapshotArchiveRestoreConfig returns the config of a volume restored from a snapshot archive, without the
+// keys recording the origin of the archive.
+func snapshotArchiveRestoreConfig(config map[string]string) map[string]string {
+	restoreConfig := make(map[string]string, len(config))
+	for key, value := range config {
+		if strings.HasPrefix(key, "volatile.archive.") {
+			continue
+		}
+
+		restoreConfig[key] = value
+	}
+
+	return restoreConfig
+}
+
+// ParseSnapshotArchiveSource returns the pool, volume and snapshot names an archive volume was created from.
+func ParseSnapshotArchiveSource(config map[string]string) (string, string, string, error) {
+	fields := strings.SplitN(config[SnapshotArchiveSourceKey], "/", 3)
+	if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+		return "", "", "", fmt.Errorf("Volume isn't a snapshot archive")
+	}
+
+	return fields[0], fields[1], fields[2], nil
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// Test that only the snapshots older than the archive age are selected, oldest first.
+func TestSnapshotsToArchive(t *testing.T) {
+	now := time.Date(2023, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+	snapshots := []shared.SnapshotRetentionEntry{
+		{Name: "vol1/snap2", CreationDate: now.AddDate(0, 0, -10)},
+		{Name: "vol1/snap0", CreationDate: now.AddDate(0, -2, 0)},
+		{Name: "vol1/snap3", CreationDate: now.Add(-time.Hour)},
+		{Name: "vol1/snap1", CreationDate: now.AddDate(0, -1, -1)},
+	}
+
+	names, err := SnapshotsToArchive("30d", snapshots, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol1/snap0", "vol1/snap1"}, names)
+
+	names, err = SnapshotsToArchive("1w", snapshots, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vol1/snap0", "vol1/snap1", "vol1/snap2"}, names)
+
+	names, err = SnapshotsToArchive("", snapshots, now)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = SnapshotsToArchive("30 days", snapshots, now)
+	assert.Error(t, err)
+}
+
+// Test that an aged snapshot's archive records where it comes from and restores to the snapshot's config.
+func TestSnapshotArchiveConfig(t *testing.T) {
+	createdAt := time.Date(2023, time.March, 1, 8, 30, 0, 0, time.UTC)
+	snapConfig := map[string]string{
+		"size":                   "10GiB",
+		"snapshots.expiry":       "90d",
+		"snapshots.schedule":     "@daily",
+		"snapshots.archive.age":  "30d",
+		"snapshots.archive.pool": "archive",
+	}
+
+	archiveName := SnapshotArchiveVolumeName("fast", "vol1/snap0")
+	assert.Equal(t, "fast-vol1-snap0-4-4", archiveName)
+
+	// Names containing the separator don't collide.
+	assert.NotEqual(t, SnapshotArchiveVolumeName("fast-vol1", "snap0/snap1"), SnapshotArchiveVolumeName("fast", "vol1-snap0/snap1"))
+	assert.NotEqual(t, SnapshotArchiveVolumeName("fast", "vol1-snap0/snap1"), SnapshotArchiveVolumeName("fast", "vol1/snap0-snap1"))
+
+	archiveConfig := snapshotArchiveConfig(snapConfig, "fast", "vol1/snap0", createdAt)
+	assert.Equal(t, map[string]string{
+		"size":                    "10GiB",
+		"snapshots.expiry":        "90d",
+		SnapshotArchiveSourceKey:  "fast/vol1/snap0",
+		SnapshotArchiveCreatedKey: "2023-03-01T08:30:00Z",
+	}, archiveConfig)
+
+	// The snapshot config isn't modified.
+	assert.Len(t, snapConfig, 5)
+
+	poolName, volName, snapName, err := ParseSnapshotArchiveSource(archiveConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fast", "vol1", "snap0"}, []string{poolName, volName, snapName})
+
+	assert.Equal(t, map[string]string{"size": "10GiB", "snapshots.expiry": "90d"}, snapshotArchiveRestoreConfig(archiveConfig))
+
+	// Regular volumes aren't snapshot archives.
+	_, _, _, err = ParseSnapshotArchiveSource(map[string]string{"size": "10GiB"})
+	assert.Error(t, err)
+
+	_, _, _, err = ParseSnapshotArchiveSource(map[string]string{SnapshotArchiveSourceKey: "fast/vol1"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/lxd/state"
+)
+
+// snapshotInstantEstimate is the estimated time taken by the snapshots which don't copy the volume's data.
+const snapshotInstantEstimate = 100 * time.Millisecond
+
+// snapshotDefaultThroughput is the copy throughput (in bytes per second) assumed until one has been measured.
+const snapshotDefaultThroughput = 100 * 1024 * 1024
+
+// snapshotThroughputs records the copy throughput (in bytes per second) measured on each pool, keyed by pool name.
+var snapshotThroughputs = map[string]float64{}
+
+// snapshotThroughputsMu is used to access snapshotThroughputs safely.
+var snapshotThroughputsMu sync.Mutex
+
+// recordSnapshotThroughput records the throughput of a snapshot of size bytes copied in elapsed on the pool. It is
+// averaged with the throughput measured before so that a single unusual snapshot doesn't skew the estimates.
+func recordSnapshotThroughput(poolName string, size int64, elapsed time.Duration) {
+	if size <= 0 || elapsed <= 0 {
+		return
+	}
+
+	throughput := float64(size) / elapsed.Seconds()
+
+	snapshotThroughputsMu.Lock()
+	defer snapshotThroughputsMu.Unlock()
+
+	previous, ok := snapshotThroughputs[poolName]
+	if ok {
+		throughput = (previous + throughput) / 2
+	}
+
+	snapshotThroughputs[poolName] = throughput
+}
+
+// forgetSnapshotThroughput removes the copy throughput measured on the pool, such as once it's deleted.
+func forgetSnapshotThroughput(poolName string) {
+	snapshotThroughputsMu.Lock()
+	defer snapshotThroughputsMu.Unlock()
+
+	delete(snapshotThroughputs, poolName)
+}
+
+// snapshotThroughput returns the copy throughput measured on the pool, or the default one if none was measured.
+func snapshotThroughput(poolName string) float64 {
+	snapshotThroughputsMu.Lock()
+	defer snapshotThroughputsMu.Unlock()
+
+	throughput, ok := snapshotThroughputs[poolName]
+	if !ok {
+		return snapshotDefaultThroughput
+	}
+
+	return throughput
+}
+
+// snapshotsCopyData returns whether the snapshots of the driver are copies of the volume's data, rather than
+// near-instant copy-on-write or reflinked snapshots.
+func snapshotsCopyData(driverName string) bool {
+	return driverName == "dir"
+}
+
+// snapshotTimeEstimate returns the estimated time taken by a snapshot of a volume using size bytes, copied at
+// throughput if the snapshots copy the volume's data.
+func snapshotTimeEstimate(copiesData bool, size int64, throughput float64) time.Duration {
+	if !copiesData {
+		return snapshotInstantEstimate
+	}
+
+	return snapshotInstantEstimate + time.Duration(float64(size)/throughput*float64(time.Second))
+}
+
+// SnapshotTimeEstimate returns the estimated time taken by a snapshot of the instance or custom volume (specified
+// as "<type>/<name>") of the pool, so that clients can warn before slow snapshots.
+func SnapshotTimeEstimate(s *state.State, projectName string, poolName string, volName string) (time.Duration, error) {
+	pool, err := LoadByName(s, poolName)
+	if err != nil {
+		return -1, err
+	}
+
+	return pool.GetSnapshotTimeEstimate(projectName, volName)
+}
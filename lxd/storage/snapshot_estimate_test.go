@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that copy-on-write snapshots are estimated near-instant and copied ones proportionally to the volume size.
+func TestSnapshotTimeEstimate(t *testing.T) {
+	const size = 10 * snapshotDefaultThroughput
+
+	btrfs := snapshotTimeEstimate(snapshotsCopyData("btrfs"), size, snapshotDefaultThroughput)
+	assert.Less(t, btrfs, time.Second)
+
+	dir := snapshotTimeEstimate(snapshotsCopyData("dir"), size, snapshotDefaultThroughput)
+	assert.Equal(t, snapshotInstantEstimate+10*time.Second, dir)
+
+	dirDouble := snapshotTimeEstimate(snapshotsCopyData("dir"), 2*size, snapshotDefaultThroughput)
+	assert.Equal(t, 2*(dir-snapshotInstantEstimate), dirDouble-snapshotInstantEstimate)
+}
+
+// Test that the measured throughput replaces the default one and is averaged with the previous measurements.
+func TestSnapshotThroughput(t *testing.T) {
+	defer forgetSnapshotThroughput("pool1")
+
+	assert.Equal(t, float64(snapshotDefaultThroughput), snapshotThroughput("pool1"))
+
+	recordSnapshotThroughput("pool1", 1000, time.Second)
+	assert.Equal(t, float64(1000), snapshotThroughput("pool1"))
+
+	recordSnapshotThroughput("pool1", 3000, time.Second)
+	assert.Equal(t, float64(2000), snapshotThroughput("pool1"))
+
+	// Empty snapshots don't tell anything about the throughput.
+	recordSnapshotThroughput("pool1", 0, time.Second)
+	assert.Equal(t, float64(2000), snapshotThroughput("pool1"))
+
+	// The default throughput is used again once the pool is gone.
+	forgetSnapshotThroughput("pool1")
+	assert.Equal(t, float64(snapshotDefaultThroughput), snapshotThroughput("pool1"))
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared"
+)
+
+// snapshotIndexSuffix is the suffix of the file indexes of snapshots.
+const snapshotIndexSuffix = ".index.gz"
+
+// SnapshotIndexEntry represents a file recorded in the index of a snapshot.
+type SnapshotIndexEntry struct {
+	Path    string    `json:"path" yaml:"path"`         // Path of the file within the snapshot's rootfs.
+	Size    int64     `json:"size" yaml:"size"`         // Size of the file in bytes.
+	ModTime time.Time `json:"mod_time" yaml:"mod_time"` // Modification time of the file.
+}
+
+// SnapshotIndexMatch represents a snapshot whose index contains a searched path.
+type SnapshotIndexMatch struct {
+	Snapshot string             `json:"snapshot" yaml:"snapshot"` // Snapshot name (without the parent volume name).
+	File     SnapshotIndexEntry `json:"file" yaml:"file"`         // File as recorded in the snapshot.
+}
+
+// snapshotIndexDir returns the directory holding the file indexes of the snapshots of the volume.
+func snapshotIndexDir(poolName string, volType drivers.VolumeType, volName string) string {
+	return shared.VarPath("snapshot-indexes", poolName, string(volType), volName)
+}
+
+// snapshotIndexPath returns the path of the file index of the snapshot of the volume.
+func snapshotIndexPath(poolName string, volType drivers.VolumeType, volName string, snapName string) string {
+	return filepath.Join(snapshotIndexDir(poolName, volType, volName), snapName+snapshotIndexSuffix)
+}
+
+// snapshotIndexLockName returns the name of the lock held while writing, moving or removing the file index of the
+// snapshot of the volume.
+func snapshotIndexLockName(poolName string, volType drivers.VolumeType, volName string, snapName string) string {
+	return drivers.OperationLockName("SnapshotIndex", poolName, volType, "", drivers.GetSnapshotVolumeName(volName, snapName))
+}
+
+// copySnapshotIndex copies the snapshot index at srcPath to dstPath. Snapshots which weren't indexed are skipped.
+func copySnapshotIndex(srcPath string, dstPath string) error {
+	if !shared.PathExists(srcPath) {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(dstPath), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating snapshot index directory: %w", err)
+	}
+
+	err = shared.FileCopy(srcPath, dstPath)
+	if err != nil {
+		return fmt.Errorf("Failed copying snapshot index: %w", err)
+	}
+
+	return nil
+}
+
+// writeSnapshotIndex walks rootPath and writes the path (relative to rootPath and starting with "/"), size and
+// modification time of each entry to the gzip compressed index at indexPath, one line per entry. The index is
+// written to a temporary file first so that an incomplete index is never left at indexPath.
+func writeSnapshotIndex(rootPath string, indexPath string) error {
+	err := os.MkdirAll(filepath.Dir(indexPath), 0700)
+	if err != nil {
+		return fmt.Errorf("Failed creating snapshot index directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(indexPath), ".index.")
+	if err != nil {
+		return fmt.Errorf("Failed creating snapshot index: %w", err)
+	}
+
+	defer func() { _ = os.Remove(f.Name()) }()
+	defer func() { _ = f.Close() }()
+
+	gz := gzip.NewWriter(f)
+	w := bufio.NewWriter(gz)
+
+	err = filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+
+		// Ignore the base path.
+		if relPath == "." {
+			return nil
+		}
+
+		_, err = fmt.Fprintf(w, "%d\t%d\t%s\n", fi.Size(), fi.ModTime().Unix(), strconv.Quote("/"+relPath))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed indexing %q: %w", rootPath, err)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("Failed writing snapshot index: %w", err)
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("Failed writing snapshot index: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed writing snapshot index: %w", err)
+	}
+
+	err = os.Rename(f.Name(), indexPath)
+	if err != nil {
+		return fmt.Errorf("Failed saving snapshot index %q: %w", indexPath, err)
+	}
+
+	return nil
+}
+
+// lookupSnapshotIndex returns the entry of path in the index at indexPath, or nil if the index doesn't contain
+// it or doesn't exist.
+func lookupSnapshotIndex(indexPath string, path string) (*SnapshotIndexEntry, error) {
+	f, err := os.Open(indexPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed opening snapshot index %q: %w", indexPath, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading snapshot index %q: %w", indexPath, err)
+	}
+
+	// Entries are looked for by their quoted path to avoid unquoting every line.
+	quotedPath := strconv.Quote(path)
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Expect "<size>\t<mtime>\t<quoted path>".
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) != 3 || fields[2] != quotedPath {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing size of %q in snapshot index %q: %w", path, indexPath, err)
+		}
+
+		mtime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing modification time of %q in snapshot index %q: %w", path, indexPath, err)
+		}
+
+		return &SnapshotIndexEntry{Path: path, Size: size, ModTime: time.Unix(mtime, 0)}, nil
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading snapshot index %q: %w", indexPath, err)
+	}
+
+	return nil, nil
+}
+
+// findInSnapshotIndexes returns the snapshots, in the order of snapNames, whose index in indexDir contains path.
+// Snapshots without an index are skipped.
+func findInSnapshotIndexes(indexDir string, snapNames []string, path string) ([]SnapshotIndexMatch, error) {
+	path = filepath.Join("/", path)
+
+	matches := []SnapshotIndexMatch{}
+	for _, snapName := range snapNames {
+		entry, err := lookupSnapshotIndex(filepath.Join(indexDir, snapName+snapshotIndexSuffix), path)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry != nil {
+			matches = append(matches, SnapshotIndexMatch{Snapshot: snapName, File: *entry})
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that a path is only found in the indexes of the snapshots which contained it.
+func TestFindInSnapshotIndexes(t *testing.T) {
+	dir := t.TempDir()
+	indexDir := filepath.Join(dir, "indexes")
+	mtime := time.Unix(1700000000, 0)
+
+	snapshots := map[string]map[string]string{
+		"snap0": {"etc/hostname": "c1\n", "etc/removed": "gone\n"},
+		"snap1": {"etc/hostname": "c1-renamed\n", "etc/with\ttab": "\n"},
+		"snap2": {"etc/hostname": "c1-renamed\n"},
+	}
+
+	for snapName, files := range snapshots {
+		rootPath := filepath.Join(dir, snapName, "rootfs")
+		for path, content := range files {
+			fullPath := filepath.Join(rootPath, path)
+			require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+			require.NoError(t, os.WriteFile(fullPath, []byte(content), 0644))
+			require.NoError(t, os.Chtimes(fullPath, mtime, mtime))
+		}
+
+		require.NoError(t, writeSnapshotIndex(rootPath, filepath.Join(indexDir, snapName+snapshotIndexSuffix)))
+	}
+
+	// The snapshot which wasn't indexed is skipped.
+	snapNames := []string{"snap0", "snap1", "snap2", "snap3"}
+
+	matches, err := findInSnapshotIndexes(indexDir, snapNames, "/etc/hostname")
+	require.NoError(t, err)
+	require.Len(t, matches, 3)
+
+	for i, snapName := range []string{"snap0", "snap1", "snap2"} {
+		assert.Equal(t, snapName, matches[i].Snapshot)
+		assert.Equal(t, "/etc/hostname", matches[i].File.Path)
+		assert.True(t, mtime.Equal(matches[i].File.ModTime))
+	}
+
+	assert.Equal(t, int64(3), matches[0].File.Size)
+	assert.Equal(t, int64(11), matches[1].File.Size)
+
+	// Paths are relative to the rootfs.
+	matches, err = findInSnapshotIndexes(indexDir, snapNames, "etc/removed")
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "snap0", matches[0].Snapshot)
+
+	// Directories are indexed too.
+	matches, err = findInSnapshotIndexes(indexDir, snapNames, "/etc")
+	require.NoError(t, err)
+	assert.Len(t, matches, 3)
+
+	// Special characters in paths are preserved.
+	matches, err = findInSnapshotIndexes(indexDir, snapNames, "/etc/with\ttab")
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "snap1", matches[0].Snapshot)
+
+	matches, err = findInSnapshotIndexes(indexDir, snapNames, "/etc/missing")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(indexDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+// Test that copying the indexes of snapshots keeps them searchable and skips the snapshots which weren't indexed.
+func TestCopySnapshotIndex(t *testing.T) {
+	dir := t.TempDir()
+	rootPath := filepath.Join(dir, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootPath, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootPath, "etc", "hostname"), []byte("c1\n"), 0644))
+
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+	require.NoError(t, writeSnapshotIndex(rootPath, filepath.Join(srcDir, "snap0"+snapshotIndexSuffix)))
+
+	for _, snapName := range []string{"snap0", "snap1"} {
+		require.NoError(t, copySnapshotIndex(filepath.Join(srcDir, snapName+snapshotIndexSuffix), filepath.Join(dstDir, snapName+snapshotIndexSuffix)))
+	}
+
+	matches, err := findInSnapshotIndexes(dstDir, []string{"snap0", "snap1"}, "/etc/hostname")
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, "snap0", matches[0].Snapshot)
+	assert.NoFileExists(t, filepath.Join(dstDir, "snap1"+snapshotIndexSuffix))
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Snapshot orders supported when listing the snapshots of a volume.
+const (
+	SnapshotOrderName         = "name"          // By name.
+	SnapshotOrderCreationTime = "creation_time" // By creation time, oldest first.
+	SnapshotOrderSize         = "size"          // By reclaimable space, largest first.
+)
+
+// SnapshotOrders lists the supported snapshot orders.
+var SnapshotOrders = []string{SnapshotOrderName, SnapshotOrderCreationTime, SnapshotOrderSize}
+
+// sortSnapshots sorts the snapshot names in the given order, using creationTimes or sizes (keyed by snapshot
+// name) as the sort key. Snapshots with the same key are sorted by name.
+func sortSnapshots(snapshots []string, order string, creationTimes map[string]time.Time, sizes map[string]int64) error {
+	var less func(i, j int) bool
+
+	switch order {
+	case SnapshotOrderName:
+		less = func(i, j int) bool { return false }
+	case SnapshotOrderCreationTime:
+		less = func(i, j int) bool { return creationTimes[snapshots[i]].Before(creationTimes[snapshots[j]]) }
+	case SnapshotOrderSize:
+		less = func(i, j int) bool { return sizes[snapshots[i]] > sizes[snapshots[j]] }
+	default:
+		return fmt.Errorf("Invalid snapshot order %q", order)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if less(i, j) {
+			return true
+		}
+
+		if less(j, i) {
+			return false
+		}
+
+		return snapshots[i] < snapshots[j]
+	})
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that each snapshot order sorts the snapshots by its key, falling back to the name on ties.
+func TestSortSnapshots(t *testing.T) {
+	created := time.Date(2023, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+	creationTimes := map[string]time.Time{
+		"daily":   created.Add(2 * time.Hour),
+		"weekly":  created,
+		"hourly":  created.Add(3 * time.Hour),
+		"monthly": created.Add(2 * time.Hour),
+	}
+
+	sizes := map[string]int64{
+		"daily":   4096,
+		"weekly":  1 << 20,
+		"hourly":  0,
+		"monthly": 4096,
+	}
+
+	tests := []struct {
+		order    string
+		expected []string
+	}{
+		{order: SnapshotOrderName, expected: []string{"daily", "hourly", "monthly", "weekly"}},
+		{order: SnapshotOrderCreationTime, expected: []string{"weekly", "daily", "monthly", "hourly"}},
+		{order: SnapshotOrderSize, expected: []string{"weekly", "daily", "monthly", "hourly"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.order, func(t *testing.T) {
+			snapshots := []string{"hourly", "monthly", "weekly", "daily"}
+
+			err := sortSnapshots(snapshots, test.order, creationTimes, sizes)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, snapshots)
+		})
+	}
+
+	err := sortSnapshots([]string{"daily"}, "random", creationTimes, sizes)
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// snapshotCreateBucket is the token bucket limiting the rate at which the snapshots of an instance are created.
+// It holds up to the number of snapshots allowed per minute and is refilled continuously at that rate.
+type snapshotCreateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// snapshotCreateBuckets records the token bucket of each instance, keyed by project and instance name.
+var snapshotCreateBuckets = map[string]*snapshotCreateBucket{}
+
+// snapshotCreateBucketsMu is used to access snapshotCreateBuckets safely.
+var snapshotCreateBucketsMu sync.Mutex
+
+// snapshotCreateRefill returns the token bucket of the instance identified by key, refilled with the tokens
+// accumulated since it was last used. snapshotCreateBucketsMu must be held.
+func snapshotCreateRefill(key string, rate uint64, now time.Time) *snapshotCreateBucket {
+	capacity := float64(rate)
+
+	bucket, ok := snapshotCreateBuckets[key]
+	if !ok {
+		bucket = &snapshotCreateBucket{tokens: capacity, last: now}
+		snapshotCreateBuckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last)
+	if elapsed > 0 {
+		bucket.tokens += elapsed.Minutes() * capacity
+		if bucket.tokens > capacity {
+			bucket.tokens = capacity
+		}
+
+		bucket.last = now
+	}
+
+	return bucket
+}
+
+// snapshotCreateAllowed takes a token from the bucket of the instance identified by key, returning false if it's
+// empty as more than rate snapshots per minute were created. A rate of 0 doesn't limit the snapshots.
+func snapshotCreateAllowed(key string, rate uint64, now time.Time) bool {
+	snapshotCreateBucketsMu.Lock()
+	defer snapshotCreateBucketsMu.Unlock()
+
+	if rate == 0 {
+		delete(snapshotCreateBuckets, key)
+		return true
+	}
+
+	bucket := snapshotCreateRefill(key, rate, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// snapshotCreateAvailable returns whether the bucket of the instance identified by key has a token left, without
+// taking it.
+func snapshotCreateAvailable(key string, rate uint64, now time.Time) bool {
+	snapshotCreateBucketsMu.Lock()
+	defer snapshotCreateBucketsMu.Unlock()
+
+	if rate == 0 {
+		return true
+	}
+
+	return snapshotCreateRefill(key, rate, now).tokens >= 1
+}
+
+// snapshotCreateRefund gives back the token taken by snapshotCreateAllowed for a snapshot which failed.
+func snapshotCreateRefund(key string, rate uint64) {
+	snapshotCreateBucketsMu.Lock()
+	defer snapshotCreateBucketsMu.Unlock()
+
+	bucket, ok := snapshotCreateBuckets[key]
+	if !ok || rate == 0 {
+		return
+	}
+
+	bucket.tokens++
+	if bucket.tokens > float64(rate) {
+		bucket.tokens = float64(rate)
+	}
+}
+
+// snapshotCreateForget removes the token bucket of the instance identified by key.
+func snapshotCreateForget(key string) {
+	snapshotCreateBucketsMu.Lock()
+	delete(snapshotCreateBuckets, key)
+	snapshotCreateBucketsMu.Unlock()
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that snapshots requested faster than the rate are rejected until the bucket refills.
+func TestSnapshotCreateAllowed(t *testing.T) {
+	key := "default/c1"
+	defer snapshotCreateForget(key)
+
+	now := time.Now()
+
+	// A burst of up to the rate is allowed.
+	for i := 0; i < 3; i++ {
+		assert.True(t, snapshotCreateAllowed(key, 3, now), i)
+	}
+
+	assert.False(t, snapshotCreateAllowed(key, 3, now))
+	assert.False(t, snapshotCreateAllowed(key, 3, now.Add(10*time.Second)))
+
+	// A token is added every 20 seconds.
+	now = now.Add(20 * time.Second)
+	assert.True(t, snapshotCreateAllowed(key, 3, now))
+	assert.False(t, snapshotCreateAllowed(key, 3, now))
+
+	// The bucket doesn't hold more than the rate.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, snapshotCreateAllowed(key, 3, now), i)
+	}
+
+	assert.False(t, snapshotCreateAllowed(key, 3, now))
+
+	// Other instances have their own bucket.
+	otherKey := "default/c2"
+	defer snapshotCreateForget(otherKey)
+	assert.True(t, snapshotCreateAllowed(otherKey, 3, now))
+
+	// No limit is applied without a rate.
+	for i := 0; i < 10; i++ {
+		assert.True(t, snapshotCreateAllowed(key, 0, now), i)
+	}
+}
+
+// Test that checking the bucket doesn't take a token, and that refunded tokens can be used again.
+func TestSnapshotCreateRefund(t *testing.T) {
+	key := "default/c1"
+	defer snapshotCreateForget(key)
+
+	now := time.Now()
+
+	assert.True(t, snapshotCreateAvailable(key, 1, now))
+	assert.True(t, snapshotCreateAvailable(key, 1, now))
+	assert.True(t, snapshotCreateAllowed(key, 1, now))
+	assert.False(t, snapshotCreateAvailable(key, 1, now))
+	assert.False(t, snapshotCreateAllowed(key, 1, now))
+
+	snapshotCreateRefund(key, 1)
+	assert.True(t, snapshotCreateAvailable(key, 1, now))
+	assert.True(t, snapshotCreateAllowed(key, 1, now))
+
+	// Refunds don't fill the bucket above the rate.
+	snapshotCreateRefund(key, 1)
+	snapshotCreateRefund(key, 1)
+	assert.True(t, snapshotCreateAllowed(key, 1, now))
+	assert.False(t, snapshotCreateAllowed(key, 1, now))
+}
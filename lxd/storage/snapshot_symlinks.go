@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SnapshotSymlinksRebuild represents the changes made when rebuilding the instance snapshot symlinks of a pool.
+type SnapshotSymlinksRebuild struct {
+	Created  []string `json:"created" yaml:"created"`   // Symlinks which were missing.
+	Replaced []string `json:"replaced" yaml:"replaced"` // Symlinks which were pointing elsewhere or weren't symlinks.
+	Removed  []string `json:"removed" yaml:"removed"`   // Symlinks which shouldn't exist.
+}
+
+// reconcileSnapshotSymlinks makes the entries of the symlinks directory match the expected symlinks, given as
+// the target of each entry name. Entries which aren't expected are only removed if owned returns true for them,
+// being given the entry name and its symlink target (empty if it isn't a symlink), so that the symlinks of the
+// other pools are left alone. The changes made are added to the result.
+func reconcileSnapshotSymlinks(symlinksPath string, expected map[string]string, owned func(name string, target string) bool, result *SnapshotSymlinksRebuild) error {
+	entries, err := os.ReadDir(symlinksPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed listing %q: %w", symlinksPath, err)
+	}
+
+	existing := make(map[string]bool, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+		snapshotSymlink := filepath.Join(symlinksPath, name)
+		existing[name] = true
+
+		target := ""
+		if entry.Type()&os.ModeSymlink != 0 {
+			target, err = os.Readlink(snapshotSymlink)
+			if err != nil {
+				return fmt.Errorf("Failed reading symlink %q: %w", snapshotSymlink, err)
+			}
+		}
+
+		expectedTarget, ok := expected[name]
+		if ok && target == expectedTarget {
+			continue
+		}
+
+		if !ok && !owned(name, target) {
+			continue
+		}
+
+		err = os.Remove(snapshotSymlink)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove symlink %q: %w", snapshotSymlink, err)
+		}
+
+		if !ok {
+			result.Removed = append(result.Removed, snapshotSymlink)
+			continue
+		}
+
+		err = os.Symlink(expectedTarget, snapshotSymlink)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink from %q to %q: %w", expectedTarget, snapshotSymlink, err)
+		}
+
+		result.Replaced = append(result.Replaced, snapshotSymlink)
+	}
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		if !existing[name] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	if len(names) > 0 {
+		err = os.MkdirAll(symlinksPath, 0700)
+		if err != nil {
+			return fmt.Errorf("Failed creating %q: %w", symlinksPath, err)
+		}
+	}
+
+	for _, name := range names {
+		snapshotSymlink := filepath.Join(symlinksPath, name)
+
+		err = os.Symlink(expected[name], snapshotSymlink)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink from %q to %q: %w", expected[name], snapshotSymlink, err)
+		}
+
+		result.Created = append(result.Created, snapshotSymlink)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that missing, stale and corrupted snapshot symlinks are reconciled while those of other pools are kept.
+func TestReconcileSnapshotSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	symlinksPath := filepath.Join(dir, "snapshots")
+	poolPath := filepath.Join(dir, "storage-pools", "pool1")
+	otherPoolPath := filepath.Join(dir, "storage-pools", "pool2")
+
+	require.NoError(t, os.MkdirAll(symlinksPath, 0700))
+
+	target := func(name string) string {
+		return filepath.Join(poolPath, "containers-snapshots", name)
+	}
+
+	expected := map[string]string{
+		"c1": target("c1"), // Missing.
+		"c2": target("c2"), // Pointing to the wrong place.
+		"c3": target("c3"), // Not a symlink.
+		"c4": target("c4"), // Correct.
+	}
+
+	require.NoError(t, os.Symlink(target("wrong"), filepath.Join(symlinksPath, "c2")))
+	require.NoError(t, os.WriteFile(filepath.Join(symlinksPath, "c3"), []byte("corrupted"), 0600))
+	require.NoError(t, os.Symlink(target("c4"), filepath.Join(symlinksPath, "c4")))
+	require.NoError(t, os.Symlink(target("deleted"), filepath.Join(symlinksPath, "deleted")))
+	require.NoError(t, os.Symlink("/nowhere", filepath.Join(symlinksPath, "c5")))
+	require.NoError(t, os.Symlink(filepath.Join(otherPoolPath, "containers-snapshots", "other"), filepath.Join(symlinksPath, "other")))
+
+	// The symlinks of the pool's instances and the ones pointing into the pool are owned.
+	owned := func(name string, target string) bool {
+		return name == "c5" || strings.HasPrefix(target, poolPath+"/")
+	}
+
+	result := &SnapshotSymlinksRebuild{}
+	err := reconcileSnapshotSymlinks(symlinksPath, expected, owned, result)
+	require.NoError(t, err)
+
+	symlink := func(name string) string {
+		return filepath.Join(symlinksPath, name)
+	}
+
+	assert.Equal(t, []string{symlink("c1")}, result.Created)
+	assert.ElementsMatch(t, []string{symlink("c2"), symlink("c3")}, result.Replaced)
+	assert.ElementsMatch(t, []string{symlink("c5"), symlink("deleted")}, result.Removed)
+
+	entries, err := os.ReadDir(symlinksPath)
+	require.NoError(t, err)
+
+	found := map[string]string{}
+	for _, entry := range entries {
+		linkTarget, err := os.Readlink(symlink(entry.Name()))
+		require.NoError(t, err, entry.Name())
+		found[entry.Name()] = linkTarget
+	}
+
+	expected["other"] = filepath.Join(otherPoolPath, "containers-snapshots", "other")
+	assert.Equal(t, expected, found)
+
+	// Once reconciled, rebuilding again changes nothing.
+	result = &SnapshotSymlinksRebuild{}
+	err = reconcileSnapshotSymlinks(symlinksPath, expected, owned, result)
+	require.NoError(t, err)
+	assert.Empty(t, result.Created)
+	assert.Empty(t, result.Replaced)
+	assert.Empty(t, result.Removed)
+
+	// The symlinks directory is created if missing.
+	result = &SnapshotSymlinksRebuild{}
+	err = reconcileSnapshotSymlinks(filepath.Join(dir, "virtual-machines-snapshots"), map[string]string{"v1": target("v1")}, owned, result)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "virtual-machines-snapshots", "v1")}, result.Created)
+}
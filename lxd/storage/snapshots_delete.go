@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// checkSnapshotsDeletable checks that each of the snapshots, named "<parent>/<snapshot>", is one of the snapshots
+// of its parent in existing (keyed by parent name) and isn't in use, and that deleting them all leaves each parent
+// with at least minimum snapshots. Returns an error listing all the reasons the snapshots can't be deleted.
+func checkSnapshotsDeletable(snapshots []string, existing map[string][]string, inUse func(snapshot string) bool, minimum int) error {
+	problems := []string{}
+	parents := []string{}
+	deleting := map[string]int{}
+
+	for _, snapshot := range snapshots {
+		parentName, snapName, isSnap := api.GetParentAndSnapshotName(snapshot)
+		if !isSnap {
+			problems = append(problems, fmt.Sprintf("%q isn't a snapshot", snapshot))
+			continue
+		}
+
+		if !shared.StringInSlice(snapName, existing[parentName]) {
+			problems = append(problems, fmt.Sprintf("Snapshot %q doesn't exist", snapshot))
+			continue
+		}
+
+		if inUse(snapshot) {
+			problems = append(problems, fmt.Sprintf("Snapshot %q is in use", snapshot))
+			continue
+		}
+
+		if deleting[parentName] == 0 {
+			parents = append(parents, parentName)
+		}
+
+		deleting[parentName]++
+	}
+
+	if minimum > 0 {
+		for _, parentName := range parents {
+			if len(existing[parentName])-deleting[parentName] < minimum {
+				problems = append(problems, fmt.Sprintf("Deleting %d snapshots of %q would leave fewer than the %d which must be kept", deleting[parentName], parentName, minimum))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("None of the snapshots were deleted: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// DeleteSnapshotsAtomically deletes the snapshots in order using remove, once check confirmed that all of them
+// can be deleted, so that they are deleted together or not at all. Deletions can't be rolled back, so if one still
+// fails, an ErrSnapshotsDeletePartial tells which snapshots were deleted and which were left.
+func DeleteSnapshotsAtomically(snapshots []string, check func(snapshots []string) error, remove func(snapshot string) error) error {
+	uniqueSnapshots := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if !shared.StringInSlice(snapshot, uniqueSnapshots) {
+			uniqueSnapshots = append(uniqueSnapshots, snapshot)
+		}
+	}
+
+	err := check(uniqueSnapshots)
+	if err != nil {
+		return err
+	}
+
+	for i, snapshot := range uniqueSnapshots {
+		err = remove(snapshot)
+		if err != nil {
+			return ErrSnapshotsDeletePartial{
+				Deleted:   uniqueSnapshots[:i],
+				Failed:    snapshot,
+				Remaining: uniqueSnapshots[i+1:],
+				Err:       err,
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that missing, in use and protected snapshots are all reported.
+func TestCheckSnapshotsDeletable(t *testing.T) {
+	existing := map[string][]string{
+		"c1": {"snap0", "snap1", "snap2"},
+		"c2": {"snap0"},
+	}
+
+	inUse := func(snapshot string) bool { return snapshot == "c2/snap0" }
+
+	err := checkSnapshotsDeletable([]string{"c1/snap0", "c1/snap1"}, existing, inUse, 0)
+	assert.NoError(t, err)
+
+	err = checkSnapshotsDeletable([]string{"c1/snap0", "c1/snap1"}, existing, inUse, 1)
+	assert.NoError(t, err)
+
+	// Each deletion would be allowed on its own but not both of them.
+	err = checkSnapshotsDeletable([]string{"c1/snap0", "c1/snap1"}, existing, inUse, 2)
+	assert.ErrorContains(t, err, `Deleting 2 snapshots of "c1" would leave fewer than the 2 which must be kept`)
+
+	err = checkSnapshotsDeletable([]string{"c1/snap3", "c2/snap0", "c1"}, existing, inUse, 0)
+	assert.ErrorContains(t, err, `Snapshot "c1/snap3" doesn't exist`)
+	assert.ErrorContains(t, err, `Snapshot "c2/snap0" is in use`)
+	assert.ErrorContains(t, err, `"c1" isn't a snapshot`)
+}
+
+// Test that no snapshot is deleted when one of them is protected, and that a failure after the check reports what
+// was deleted and what was left.
+func TestDeleteSnapshotsAtomically(t *testing.T) {
+	existing := map[string][]string{"c1": {"snap0", "snap1", "snap2", "snap3"}}
+
+	var deleted []string
+	remove := func(snapshot string) error {
+		if snapshot == "c1/snap2" && len(deleted) > 0 {
+			return fmt.Errorf("Device busy")
+		}
+
+		deleted = append(deleted, snapshot)
+		return nil
+	}
+
+	check := func(minimum int) func(snapshots []string) error {
+		return func(snapshots []string) error {
+			return checkSnapshotsDeletable(snapshots, existing, func(string) bool { return false }, minimum)
+		}
+	}
+
+	// Deleting three snapshots would leave one where two must be kept.
+	err := DeleteSnapshotsAtomically([]string{"c1/snap0", "c1/snap1", "c1/snap2"}, check(2), remove)
+	assert.ErrorContains(t, err, `would leave fewer than the 2 which must be kept`)
+	assert.Empty(t, deleted)
+
+	err = DeleteSnapshotsAtomically([]string{"c1/snap0", "c1/snap0", "c1/snap1"}, check(2), remove)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c1/snap0", "c1/snap1"}, deleted)
+
+	err = DeleteSnapshotsAtomically([]string{"c1/snap3", "c1/snap2", "c1/snap1"}, check(0), remove)
+
+	var partialErr ErrSnapshotsDeletePartial
+	require.True(t, errors.As(err, &partialErr))
+	assert.Equal(t, []string{"c1/snap3"}, partialErr.Deleted)
+	assert.Equal(t, "c1/snap2", partialErr.Failed)
+	assert.Equal(t, []string{"c1/snap1"}, partialErr.Remaining)
+	assert.EqualError(t, partialErr.Err, "Device busy")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 
 	"github.com/lxc/lxd/lxd/db"
@@ -11,6 +12,7 @@ import (
 	"github.com/lxc/lxd/lxd/instance/instancetype"
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/lxd/storage/drivers"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/version"
@@ -41,12 +43,12 @@ func InstancePath(instanceType instancetype.Type, projectName, instanceName stri
 func InstanceImportingFilePath(instanceType instancetype.Type, poolName, projectName, instanceName string) string {
 	fullName := project.Instance(projectName, instanceName)
 
-	typeDir := "containers"
+	volType := drivers.VolumeTypeContainer
 	if instanceType == instancetype.VM {
-		typeDir = "virtual-machines"
+		volType = drivers.VolumeTypeVM
 	}
 
-	return shared.VarPath("storage-pools", poolName, typeDir, fullName, ".importing")
+	return filepath.Join(drivers.GetVolumeMountPath(poolName, volType, fullName), ".importing")
 }
 
 // GetStoragePoolMountPoint returns the mountpoint of the given pool.
@@ -59,19 +61,19 @@ func GetStoragePoolMountPoint(poolName string) string {
 // GetSnapshotMountPoint returns the mountpoint of the given container snapshot.
 // ${LXD_DIR}/storage-pools/<pool>/containers-snapshots/<snapshot_name>.
 func GetSnapshotMountPoint(projectName, poolName string, snapshotName string) string {
-	return shared.VarPath("storage-pools", poolName, "containers-snapshots", project.Instance(projectName, snapshotName))
+	return drivers.GetVolumeMountPath(poolName, drivers.VolumeTypeContainer, project.Instance(projectName, snapshotName))
 }
 
 // GetImageMountPoint returns the mountpoint of the given image.
 // ${LXD_DIR}/storage-pools/<pool>/images/<fingerprint>.
 func GetImageMountPoint(poolName string, fingerprint string) string {
-	return shared.VarPath("storage-pools", poolName, "images", fingerprint)
+	return drivers.GetVolumeMountPath(poolName, drivers.VolumeTypeImage, fingerprint)
 }
 
 // GetStoragePoolVolumeSnapshotMountPoint returns the mountpoint of the given pool volume snapshot.
 // ${LXD_DIR}/storage-pools/<pool>/custom-snapshots/<custom volume name>/<snapshot name>.
 func GetStoragePoolVolumeSnapshotMountPoint(poolName string, snapshotName string) string {
-	return shared.VarPath("storage-pools", poolName, "custom-snapshots", snapshotName)
+	return drivers.GetVolumeMountPath(poolName, drivers.VolumeTypeCustom, snapshotName)
 }
 
 // CreateContainerMountpoint creates the provided container mountpoint and symlink.
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lxc/lxd/lxd/storage/drivers"
+)
+
+// usageHistorySize is the number of usage samples kept for each pool.
+const usageHistorySize = 288
+
+// UsageSample represents the usage of a storage pool and its volumes at a point in time.
+type UsageSample struct {
+	Timestamp time.Time `json:"timestamp" yaml:"timestamp"`
+
+	// Space used by the pool and its total size (bytes).
+	Used  uint64 `json:"used" yaml:"used"`
+	Total uint64 `json:"total" yaml:"total"`
+
+	// Space used by each volume (bytes), keyed by "<volume type>/<volume name>".
+	Volumes map[string]int64 `json:"volumes" yaml:"volumes"`
+}
+
+// usageHistory is a fixed-size ring buffer of usage samples.
+type usageHistory struct {
+	samples []UsageSample
+	next    int
+	full    bool
+}
+
+// newUsageHistory returns a usageHistory keeping up to size samples.
+func newUsageHistory(size int) *usageHistory {
+	return &usageHistory{samples: make([]UsageSample, size)}
+}
+
+// add records a sample, evicting the oldest one if the buffer is full.
+func (h *usageHistory) add(sample UsageSample) {
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the recorded samples ordered from oldest to newest.
+func (h *usageHistory) list() []UsageSample {
+	if !h.full {
+		return append([]UsageSample{}, h.samples[:h.next]...)
+	}
+
+	return append(append([]UsageSample{}, h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// last returns the most recent sample and whether one was recorded.
+func (h *usageHistory) last() (UsageSample, bool) {
+	if !h.full && h.next == 0 {
+		return UsageSample{}, false
+	}
+
+	return h.samples[(h.next+len(h.samples)-1)%len(h.samples)], true
+}
+
+// usageHistories holds the usage history of each pool.
+var usageHistories = map[string]*usageHistory{}
+
+// usageHistoriesMu is used to access usageHistories safely.
+var usageHistoriesMu sync.Mutex
+
+// usageHistoryInterval returns the interval between usage samples configured on the pool.
+// A zero interval means that usage history is disabled.
+func usageHistoryInterval(pool Pool) (time.Duration, error) {
+	value := pool.Driver().Config()["usage_history.interval"]
+	if value == "" {
+		return 0, nil
+	}
+
+	minutes, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid usage_history.interval value %q: %w", value, err)
+	}
+
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// SampleUsage records the current usage of the pool and its volumes if the pool's configured sampling
+// interval has elapsed since the last sample.
+func SampleUsage(pool Pool, now time.Time) error {
+	interval, err := usageHistoryInterval(pool)
+	if err != nil {
+		return err
+	}
+
+	if interval == 0 {
+		// Drop any history left over from when sampling was enabled.
+		usageHistoriesMu.Lock()
+		delete(usageHistories, pool.Name())
+		usageHistoriesMu.Unlock()
+
+		return nil
+	}
+
+	usageHistoriesMu.Lock()
+	history, ok := usageHistories[pool.Name()]
+	if !ok {
+		history = newUsageHistory(usageHistorySize)
+		usageHistories[pool.Name()] = history
+	}
+
+	last, found := history.last()
+	usageHistoriesMu.Unlock()
+
+	if found && now.Sub(last.Timestamp) < interval {
+		return nil
+	}
+
+	sample, err := poolUsageSample(pool.Driver(), now)
+	if err != nil {
+		return err
+	}
+
+	usageHistoriesMu.Lock()
+	history.add(*sample)
+	usageHistoriesMu.Unlock()
+
+	return nil
+}
+
+// poolUsageSample collects the current usage of the pool and of each volume found on it.
+func poolUsageSample(d drivers.Driver, now time.Time) (*UsageSample, error) {
+	res, err := d.GetResources()
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting pool resources: %w", err)
+	}
+
+	vols, err := d.ListVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing volumes: %w", err)
+	}
+
+	sample := &UsageSample{
+		Timestamp: now,
+		Used:      res.Space.Used,
+		Total:     res.Space.Total,
+		Volumes:   make(map[string]int64, len(vols)),
+	}
+
+	for _, vol := range vols {
+		usage, err := d.GetVolumeUsage(vol)
+		if err != nil {
+			// Drivers that can't report usage for a volume are just not tracked.
+			if errors.Is(err, drivers.ErrNotSupported) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Failed getting usage of volume %q: %w", vol.Name(), err)
+		}
+
+		sample.Volumes[fmt.Sprintf("%s/%s", vol.Type(), vol.Name())] = usage
+	}
+
+	return sample, nil
+}
+
+// UsageHistory returns the recorded usage samples of the pool, ordered from oldest to newest.
+func UsageHistory(poolName string) []UsageSample {
+	usageHistoriesMu.Lock()
+	defer usageHistoriesMu.Unlock()
+
+	history, ok := usageHistories[poolName]
+	if !ok {
+		return []UsageSample{}
+	}
+
+	return history.list()
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that usage samples are recorded in order and the oldest ones evicted once full.
+func TestUsageHistory(t *testing.T) {
+	history := newUsageHistory(3)
+	start := time.Unix(0, 0)
+
+	_, found := history.last()
+	assert.False(t, found)
+	assert.Empty(t, history.list())
+
+	for i := 0; i < 2; i++ {
+		history.add(UsageSample{Timestamp: start.Add(time.Duration(i) * time.Minute), Used: uint64(i)})
+	}
+
+	samples := history.list()
+	assert.Len(t, samples, 2)
+	assert.Equal(t, uint64(0), samples[0].Used)
+	assert.Equal(t, uint64(1), samples[1].Used)
+
+	// Fill past the buffer size.
+	for i := 2; i < 5; i++ {
+		history.add(UsageSample{Timestamp: start.Add(time.Duration(i) * time.Minute), Used: uint64(i)})
+	}
+
+	samples = history.list()
+	assert.Len(t, samples, 3)
+	assert.Equal(t, uint64(2), samples[0].Used)
+	assert.Equal(t, uint64(3), samples[1].Used)
+	assert.Equal(t, uint64(4), samples[2].Used)
+
+	last, found := history.last()
+	assert.True(t, found)
+	assert.Equal(t, uint64(4), last.Used)
+}
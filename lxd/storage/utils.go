@@ -7,7 +7,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"golang.org/x/sys/unix"
 
@@ -252,6 +254,19 @@ func VolumeDBCreate(pool Pool, projectName string, volumeName string, volumeDesc
 		volumeConfig = map[string]string{}
 	}
 
+	// A new snapshot isn't the parent of any incremental send yet, even when its config comes from a copied one.
+	_, found := volumeConfig[drivers.SendParentRefCountConfigKey]
+	if found {
+		newConfig := make(map[string]string, len(volumeConfig))
+		for k, v := range volumeConfig {
+			if k != drivers.SendParentRefCountConfigKey {
+				newConfig[k] = v
+			}
+		}
+
+		volumeConfig = newConfig
+	}
+
 	volType, err := VolumeDBTypeToType(volDBType)
 	if err != nil {
 		return err
@@ -326,6 +341,41 @@ func VolumeDBSnapshotsGet(pool Pool, projectName string, volume string, volumeTy
 	return snapshots, nil
 }
 
+// snapshotsInfo cross-references the database records of the snapshots of a volume with their on-disk metadata.
+// The recorded snapshots are returned first, in the order of the records, followed by the ones only found on disk.
+func snapshotsInfo(dbSnapshots []db.StorageVolumeArgs, volSnapshots []drivers.VolumeSnapshotInfo) []SnapshotInfo {
+	onDisk := make(map[string]*drivers.VolumeSnapshotInfo, len(volSnapshots))
+	for i := range volSnapshots {
+		onDisk[volSnapshots[i].Name] = &volSnapshots[i]
+	}
+
+	infos := make([]SnapshotInfo, 0, len(dbSnapshots))
+	recorded := make(map[string]bool, len(dbSnapshots))
+
+	for _, dbSnapshot := range dbSnapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(dbSnapshot.Name)
+		recorded[snapName] = true
+
+		infos = append(infos, SnapshotInfo{
+			Name:         snapName,
+			CreationDate: dbSnapshot.CreationDate,
+			ExpiryDate:   dbSnapshot.ExpiryDate,
+			Recorded:     true,
+			Volume:       onDisk[snapName],
+		})
+	}
+
+	for i := range volSnapshots {
+		if recorded[volSnapshots[i].Name] {
+			continue
+		}
+
+		infos = append(infos, SnapshotInfo{Name: volSnapshots[i].Name, Volume: &volSnapshots[i]})
+	}
+
+	return infos
+}
+
 // BucketDBCreate creates a bucket in the database.
 // The supplied bucket's config may be modified with defaults for the storage pool being used.
 // Returns bucket DB record ID.
@@ -398,6 +448,12 @@ func poolAndVolumeCommonRules(vol *drivers.Volume) map[string]func(string) error
 		},
 		"snapshots.schedule": validate.Optional(validate.IsCron([]string{"@hourly", "@daily", "@midnight", "@weekly", "@monthly", "@annually", "@yearly"})),
 		"snapshots.pattern":  validate.IsAny,
+		"snapshots.archive.age": func(value string) error {
+			// Validate expression
+			_, err := shared.GetExpiry(time.Time{}, value)
+			return err
+		},
+		"snapshots.archive.pool": validate.IsAny,
 	}
 
 	// security.shifted and security.unmapped are only relevant for custom filesystem volumes.
@@ -416,6 +472,10 @@ func validatePoolCommonRules() map[string]func(string) error {
 		"volatile.initial_source": validate.IsAny,
 		"rsync.bwlimit":           validate.Optional(validate.IsSize),
 		"rsync.compression":       validate.Optional(validate.IsBool),
+		"usage_history.interval":  validate.Optional(validate.IsUint32),
+		"reserved_space":          validate.Optional(validate.IsSize),
+		"cleanup_stale_mounts":    validate.Optional(validate.IsBool),
+		"limits.network":          validate.Optional(validate.IsSize),
 	}
 
 	// Add to pool config rules (prefixed with volume.*) which are common for pool and volume.
@@ -447,11 +507,27 @@ func validateVolumeCommonRules(vol drivers.Volume) map[string]func(string) error
 		rules["block.filesystem"] = validate.IsAny
 	}
 
+	// The volatile.archive.* keys record the origin of custom volumes holding archived snapshots.
+	if vol.Type() == drivers.VolumeTypeCustom {
+		rules[SnapshotArchiveSourceKey] = validate.IsAny
+		rules[SnapshotArchiveCreatedKey] = validate.IsAny
+	}
+
+	// The base image is recorded on instance volumes.
+	if vol.Type() == drivers.VolumeTypeContainer || vol.Type() == drivers.VolumeTypeVM {
+		rules[VolumeBaseImageKey] = validate.IsAny
+	}
+
 	// volatile.rootfs.size is only used for image volumes.
 	if vol.Type() == drivers.VolumeTypeImage {
 		rules["volatile.rootfs.size"] = validate.Optional(validate.IsInt64)
 	}
 
+	// Snapshots record the incremental sends made outside of LXD which rely on them as their parent.
+	if vol.IsSnapshot() {
+		rules[drivers.SendParentRefCountConfigKey] = validate.Optional(validate.IsUint32)
+	}
+
 	return rules
 }
 
@@ -632,7 +708,12 @@ func ImageUnpack(imageFile string, vol drivers.Volume, destBlockFile string, blo
 		}
 	} else {
 		// Dealing with unified tarballs require an initial unpack to a temporary directory.
-		tempDir, err := os.MkdirTemp(shared.VarPath("images"), "lxd_image_unpack_")
+		tempParentDir, err := vol.TempDir(shared.VarPath("images"), "")
+		if err != nil {
+			return -1, err
+		}
+
+		tempDir, err := os.MkdirTemp(tempParentDir, "lxd_image_unpack_")
 		if err != nil {
 			return -1, err
 		}
@@ -1045,3 +1126,74 @@ func CompareSnapshots(sourceSnapshots []ComparableSnapshot, targetSnapshots []Co
 
 	return syncFromSource, deleteFromTarget
 }
+
+// walkUsage returns the disk space used by the files below path, counting hard linked files once.
+func walkUsage(path string) (int64, error) {
+	var usage int64
+	seen := map[uint64]bool{}
+
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			usage += fi.Size()
+			return nil
+		}
+
+		if stat.Nlink > 1 {
+			if seen[stat.Ino] {
+				return nil
+			}
+
+			seen[stat.Ino] = true
+		}
+
+		usage += stat.Blocks * 512
+
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("Failed walking %q: %w", path, err)
+	}
+
+	return usage, nil
+}
+
+// SnapshotMetadata returns the user-defined metadata stored in the config of a snapshot, or nil if it has none.
+func SnapshotMetadata(config map[string]string) map[string]string {
+	var metadata map[string]string
+	for k, v := range config {
+		if !strings.HasPrefix(k, drivers.SnapshotMetadataConfigPrefix) {
+			continue
+		}
+
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+
+		metadata[strings.TrimPrefix(k, drivers.SnapshotMetadataConfigPrefix)] = v
+	}
+
+	return metadata
+}
+
+// ValidateSnapshotMetadata checks that the keys of the user-defined metadata of a snapshot are made only of
+// letters, digits, dots, dashes and underscores.
+func ValidateSnapshotMetadata(metadata map[string]string) error {
+	for k := range metadata {
+		if k == "" {
+			return fmt.Errorf("Snapshot metadata keys cannot be empty")
+		}
+
+		for _, r := range k {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("._-", r) {
+				return fmt.Errorf("Invalid snapshot metadata key %q", k)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	backupConfig "github.com/lxc/lxd/lxd/backup/config"
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/lxd/state"
+	"github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/lxd/sys"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// Test that the snapshot records are matched with the on-disk snapshots, reporting the ones missing on either side.
+func TestSnapshotsInfo(t *testing.T) {
+	created := time.Date(2023, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+	dbSnapshots := []db.StorageVolumeArgs{
+		{Name: "c1/snap0", CreationDate: created},
+		{Name: "c1/snap1", CreationDate: created.Add(time.Hour)},
+		{Name: "c1/snap2", CreationDate: created.Add(2 * time.Hour)},
+	}
+
+	volSnapshots := []drivers.VolumeSnapshotInfo{
+		{Name: "snap0", Generation: 10},
+		{Name: "snap2", Generation: 12},
+		{Name: "stray", Generation: 13},
+	}
+
+	infos := snapshotsInfo(dbSnapshots, volSnapshots)
+	require.Len(t, infos, 4)
+
+	assert.Equal(t, "snap0", infos[0].Name)
+	assert.True(t, infos[0].Recorded)
+	assert.Equal(t, created, infos[0].CreationDate)
+	require.NotNil(t, infos[0].Volume)
+	assert.Equal(t, uint64(10), infos[0].Volume.Generation)
+
+	// Recorded but missing from the pool.
+	assert.Equal(t, "snap1", infos[1].Name)
+	assert.True(t, infos[1].Recorded)
+	assert.Nil(t, infos[1].Volume)
+
+	assert.Equal(t, "snap2", infos[2].Name)
+	require.NotNil(t, infos[2].Volume)
+	assert.Equal(t, uint64(12), infos[2].Volume.Generation)
+
+	// On disk but without a record.
+	assert.Equal(t, "stray", infos[3].Name)
+	assert.False(t, infos[3].Recorded)
+	assert.True(t, infos[3].CreationDate.IsZero())
+	require.NotNil(t, infos[3].Volume)
+}
+
+// Test that the metadata of snapshots is extracted from their config and that its keys are validated.
+func TestSnapshotMetadata(t *testing.T) {
+	config := map[string]string{
+		"size":                        "10GiB",
+		"user.foo":                    "bar",
+		"snapshot.metadata.ticket":    "1234",
+		"snapshot.metadata.reason.of": "upgrade",
+	}
+
+	assert.Equal(t, map[string]string{"ticket": "1234", "reason.of": "upgrade"}, SnapshotMetadata(config))
+	assert.Nil(t, SnapshotMetadata(map[string]string{"size": "10GiB"}))
+
+	require.NoError(t, ValidateSnapshotMetadata(map[string]string{"ticket_id": "1", "reason-2.x": ""}))
+	assert.Error(t, ValidateSnapshotMetadata(map[string]string{"": "1"}))
+	assert.Error(t, ValidateSnapshotMetadata(map[string]string{"with space": "1"}))
+}
+
+// migrationTestFrameConn is one end of an in-memory migration connection, each Close ending the frame written.
+type migrationTestFrameConn struct {
+	in    chan []byte
+	out   chan []byte
+	buf   bytes.Buffer
+	frame *bytes.Reader
+}
+
+// newMigrationTestFrameConns returns the two ends of an in-memory migration connection.
+func newMigrationTestFrameConns() (*migrationTestFrameConn, *migrationTestFrameConn) {
+	a := make(chan []byte, 4)
+	b := make(chan []byte, 4)
+
+	return &migrationTestFrameConn{in: a, out: b}, &migrationTestFrameConn{in: b, out: a}
+}
+
+func (c *migrationTestFrameConn) Read(p []byte) (int, error) {
+	if c.frame == nil {
+		c.frame = bytes.NewReader(<-c.in)
+	}
+
+	n, err := c.frame.Read(p)
+	if err == io.EOF {
+		c.frame = nil
+	}
+
+	return n, err
+}
+
+func (c *migrationTestFrameConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *migrationTestFrameConn) Close() error {
+	c.out <- append([]byte{}, c.buf.Bytes()...)
+	c.buf.Reset()
+
+	return nil
+}
+
+// Test that the metadata of a custom volume snapshot sent in a migration index header is received by the target
+// and kept by the validation of the config the target snapshot record is created with.
+func TestSnapshotMetadataMigration(t *testing.T) {
+	metadata := map[string]string{"ticket": "1234", "reason": "before upgrade"}
+
+	snapConfig := map[string]string{"size": "10GiB"}
+	for k, v := range metadata {
+		snapConfig[drivers.SnapshotMetadataConfigPrefix+k] = v
+	}
+
+	info := &migration.Info{Config: &backupConfig.Config{
+		Volume:          &api.StorageVolume{Name: "vol1", Type: "custom", ContentType: "filesystem"},
+		VolumeSnapshots: []*api.StorageVolumeSnapshot{{Name: "snap0", Config: snapConfig}},
+	}}
+
+	b := &lxdBackend{}
+	l := logger.AddContext(logger.Log, nil)
+	srcConn, dstConn := newMigrationTestFrameConns()
+
+	chSrc := make(chan error, 1)
+	go func() {
+		_, err := b.migrationIndexHeaderSend(l, 1, srcConn, info)
+		chSrc <- err
+	}()
+
+	received, err := b.migrationIndexHeaderReceive(l, 1, dstConn, false, "")
+	require.NoError(t, err)
+	require.NoError(t, <-chSrc)
+
+	require.NotNil(t, received.Config)
+	require.Len(t, received.Config.VolumeSnapshots, 1)
+	assert.Equal(t, metadata, SnapshotMetadata(received.Config.VolumeSnapshots[0].Config))
+
+	// The target strips the config keys its driver doesn't know about before creating the snapshot record.
+	driver, err := drivers.Load(&state.State{OS: &sys.OS{}}, "dir", "pool1", nil, l, nil, commonRules())
+	require.NoError(t, err)
+
+	vol := drivers.NewVolume(driver, "pool1", drivers.VolumeTypeCustom, drivers.ContentTypeFS, "default_vol1/snap0", received.Config.VolumeSnapshots[0].Config, nil)
+	require.NoError(t, driver.ValidateVolume(vol, true))
+	assert.Equal(t, metadata, SnapshotMetadata(vol.Config()))
+}
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -160,7 +161,23 @@ func storagePoolsGet(d *Daemon, r *http.Request) response.Response {
 		} else {
 			pool, err := storagePools.LoadByName(d.State(), poolName)
 			if err != nil {
-				return response.SmartError(err)
+				// Report the pools which can't be loaded as they're unavailable rather than failing.
+				reason := storagePools.UnavailableReason(poolName)
+				if reason == "" {
+					return response.SmartError(err)
+				}
+
+				poolAPI, err := storagePoolUnavailableAPI(d.State(), poolName, reason)
+				if err != nil {
+					return response.SmartError(err)
+				}
+
+				if !rbac.UserIsAdmin(r) {
+					poolAPI.Config = nil
+				}
+
+				resultMap = append(resultMap, *poolAPI)
+				continue
 			}
 
 			// Get all users of the storage pool.
@@ -185,6 +202,7 @@ func storagePoolsGet(d *Daemon, r *http.Request) response.Response {
 			} else {
 				// Use local status if not clustered. To allow seeing unavailable pools.
 				poolAPI.Status = pool.LocalStatus()
+				poolAPI.StatusReason = storagePools.UnavailableReason(poolName)
 			}
 
 			resultMap = append(resultMap, poolAPI)
@@ -593,7 +611,22 @@ func storagePoolGet(d *Daemon, r *http.Request) response.Response {
 	// Get the existing storage pool.
 	pool, err := storagePools.LoadByName(d.State(), poolName)
 	if err != nil {
-		return response.SmartError(err)
+		// Report the pool as unavailable rather than failing if that's why it can't be loaded.
+		reason := storagePools.UnavailableReason(poolName)
+		if reason == "" {
+			return response.SmartError(err)
+		}
+
+		poolAPI, err := storagePoolUnavailableAPI(d.State(), poolName, reason)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		if !rbac.UserIsAdmin(r) {
+			poolAPI.Config = nil
+		}
+
+		return response.SyncResponse(true, poolAPI)
 	}
 
 	// Get all users of the storage pool.
@@ -618,6 +651,7 @@ func storagePoolGet(d *Daemon, r *http.Request) response.Response {
 	} else {
 		// Use local status if not clustered or memberSpecific. To allow seeing unavailable pools.
 		poolAPI.Status = pool.LocalStatus()
+		poolAPI.StatusReason = storagePools.UnavailableReason(poolName)
 	}
 
 	etag := []any{pool.Name, pool.Driver, poolAPI.Config}
@@ -875,6 +909,11 @@ func doStoragePoolUpdate(d *Daemon, pool storagePools.Pool, req api.StoragePoolP
 //
 // Removes the storage pool.
 //
+// The removal can optionally be guarded by first requesting a confirmation
+// code with the dry-run parameter and passing it as the confirm parameter.
+// When the confirm parameter is set, the pool is only removed if it matches
+// the pool name or an unused and unexpired confirmation code.
+//
 // ---
 // produces:
 //   - application/json
@@ -884,6 +923,16 @@ func doStoragePoolUpdate(d *Daemon, pool storagePools.Pool, req api.StoragePoolP
 //     description: Project name
 //     type: string
 //     example: default
+//   - in: query
+//     name: confirm
+//     description: Pool name or confirmation code
+//     type: string
+//     example: local
+//   - in: query
+//     name: dry-run
+//     description: Only check the pool can be removed and return a confirmation code
+//     type: boolean
+//     example: true
 // responses:
 //   "200":
 //     $ref: "#/responses/EmptySyncResponse"
@@ -918,6 +967,24 @@ func storagePoolDelete(d *Daemon, r *http.Request) response.Response {
 			return response.BadRequest(fmt.Errorf("The storage pool is currently in use"))
 		}
 
+		if shared.IsTrue(queryParam(r, "dry-run")) {
+			confirmation, err := storagePools.NewConfirmationCode(pool.Name(), "delete", time.Now())
+			if err != nil {
+				return response.SmartError(err)
+			}
+
+			return response.SyncResponse(true, confirmation)
+		}
+
+		// Confirmation is opt-in so that existing clients can still delete pools.
+		confirm := queryParam(r, "confirm")
+		if confirm != "" {
+			err = storagePools.CheckConfirmation(pool.Name(), "delete", confirm, time.Now())
+			if err != nil {
+				return response.BadRequest(err)
+			}
+		}
+
 		// Get the cluster notifier
 		notifier, err = cluster.NewNotifier(d.State(), d.endpoints.NetworkCert(), d.serverCert(), cluster.NotifyAll)
 		if err != nil {
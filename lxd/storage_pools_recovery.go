@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lxc/lxd/lxd/cluster"
+	"github.com/lxc/lxd/lxd/cluster/request"
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/project"
+	"github.com/lxc/lxd/lxd/response"
+	"github.com/lxc/lxd/lxd/revert"
+	"github.com/lxc/lxd/lxd/state"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	storageDrivers "github.com/lxc/lxd/lxd/storage/drivers"
+	"github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/logger"
+)
+
+// storagePoolRecoveryBundleExport returns the recovery bundle of a storage pool: its configuration, the config of
+// all its volumes and snapshots and, for btrfs pools with quotas enabled, the qgroup limits of its subvolumes.
+func storagePoolRecoveryBundleExport(s *state.State, poolName string) (*storagePools.RecoveryBundle, error) {
+	poolID, dbPool, _, err := s.DB.Cluster.GetStoragePoolInAnyState(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &storagePools.RecoveryBundle{
+		Version:   storagePools.RecoveryBundleVersion,
+		CreatedAt: time.Now().UTC(),
+		Pool: api.StoragePoolsPost{
+			Name:           dbPool.Name,
+			Driver:         dbPool.Driver,
+			StoragePoolPut: api.StoragePoolPut{Config: dbPool.Config, Description: dbPool.Description},
+		},
+		Volumes: []storagePools.RecoveryBundleVolume{},
+	}
+
+	var dbVolumes []*db.StorageVolume
+	err = s.DB.Cluster.Transaction(context.TODO(), func(ctx context.Context, tx *db.ClusterTx) error {
+		dbVolumes, err = tx.GetStoragePoolVolumes(ctx, poolID, true)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading volumes of storage pool %q: %w", poolName, err)
+	}
+
+	// Add the volumes first so that their snapshots can be attached to them whatever the ordering.
+	volumes := map[string]*storagePools.RecoveryBundleVolume{}
+	for _, dbVol := range dbVolumes {
+		if shared.IsSnapshot(dbVol.Name) {
+			continue
+		}
+
+		bundle.Volumes = append(bundle.Volumes, storagePools.RecoveryBundleVolume{
+			Project:     dbVol.Project,
+			Name:        dbVol.Name,
+			Type:        dbVol.Type,
+			ContentType: dbVol.ContentType,
+			Description: dbVol.Description,
+			Config:      dbVol.Config,
+			CreatedAt:   dbVol.CreatedAt,
+			Snapshots:   []storagePools.RecoveryBundleSnapshot{},
+		})
+	}
+
+	sort.Slice(bundle.Volumes, func(i, j int) bool {
+		a, b := bundle.Volumes[i], bundle.Volumes[j]
+		if a.Project != b.Project {
+			return a.Project < b.Project
+		}
+
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+
+		return a.Name < b.Name
+	})
+
+	for i := range bundle.Volumes {
+		vol := &bundle.Volumes[i]
+		volumes[fmt.Sprintf("%s/%s/%s", vol.Project, vol.Type, vol.Name)] = vol
+	}
+
+	for _, dbVol := range dbVolumes {
+		parentName, snapName, isSnap := api.GetParentAndSnapshotName(dbVol.Name)
+		if !isSnap {
+			continue
+		}
+
+		vol, ok := volumes[fmt.Sprintf("%s/%s/%s", dbVol.Project, dbVol.Type, parentName)]
+		if !ok {
+			continue
+		}
+
+		snap := storagePools.RecoveryBundleSnapshot{
+			Name:        snapName,
+			Description: dbVol.Description,
+			Config:      dbVol.Config,
+			CreatedAt:   dbVol.CreatedAt,
+		}
+
+		expiry, err := s.DB.Cluster.GetStorageVolumeSnapshotExpiry(dbVol.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading expiry of snapshot %q: %w", dbVol.Name, err)
+		}
+
+		if !expiry.IsZero() {
+			snap.ExpiresAt = &expiry
+		}
+
+		vol.Snapshots = append(vol.Snapshots, snap)
+	}
+
+	for i := range bundle.Volumes {
+		snapshots := bundle.Volumes[i].Snapshots
+		sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt) })
+	}
+
+	if dbPool.Driver == "btrfs" && !s.OS.MockMode {
+		limits, err := storageDrivers.QGroupExport(storageDrivers.GetPoolMountPath(poolName))
+		if err != nil && !errors.Is(err, storageDrivers.ErrNotSupported) {
+			return nil, fmt.Errorf("Failed exporting qgroup limits of storage pool %q: %w", poolName, err)
+		}
+
+		if len(limits) > 0 {
+			bundle.QGroupLimits = limits
+		}
+	}
+
+	return bundle, nil
+}
+
+// storagePoolRecoveryBundleImport recreates the storage pool of a recovery bundle along with its volumes and their
+// snapshots, empty, so that the data can then be restored into them. Custom volumes get their database records back
+// straight away while the records of instance volumes are left to be recreated when their instances are recovered.
+// Image volumes are only recreated for the images still known to the server, the others being recreated when the
+// images are next used. The qgroup limits are applied once all the subvolumes exist.
+func storagePoolRecoveryBundleImport(s *state.State, bundle *storagePools.RecoveryBundle) error {
+	err := bundle.Validate()
+	if err != nil {
+		return err
+	}
+
+	clustered, err := cluster.Enabled(s.DB.Node)
+	if err != nil {
+		return err
+	}
+
+	if clustered {
+		return fmt.Errorf("Recovery bundles can only be imported on standalone servers")
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	err = storagePoolCreateGlobal(s, bundle.Pool, request.ClientTypeNormal)
+	if err != nil {
+		return fmt.Errorf("Failed creating storage pool %q: %w", bundle.Pool.Name, err)
+	}
+
+	revert.Add(func() {
+		pool, err := storagePools.LoadByName(s, bundle.Pool.Name)
+		if err == nil {
+			_ = pool.Delete(request.ClientTypeNormal, nil)
+		}
+
+		_ = dbStoragePoolDeleteAndUpdateCache(s, bundle.Pool.Name)
+	})
+
+	pool, err := storagePools.LoadByName(s, bundle.Pool.Name)
+	if err != nil {
+		return err
+	}
+
+	poolID, err := s.DB.Cluster.GetStoragePoolID(bundle.Pool.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, vol := range bundle.Volumes {
+		volDBType, err := storagePools.VolumeTypeNameToDBType(vol.Type)
+		if err != nil {
+			return err
+		}
+
+		volType, err := storagePools.VolumeDBTypeToType(volDBType)
+		if err != nil {
+			return err
+		}
+
+		volDBContentType, err := storagePools.VolumeContentTypeNameToContentType(vol.ContentType)
+		if err != nil {
+			return err
+		}
+
+		if volType == storageDrivers.VolumeTypeImage {
+			_, _, err = s.DB.Cluster.GetImageFromAnyProject(vol.Name)
+			if response.IsNotFoundError(err) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("Failed loading image %q: %w", vol.Name, err)
+			}
+
+			err = pool.EnsureImage(vol.Name, nil)
+			if err != nil {
+				logger.Warn("Failed recreating image volume of recovery bundle", logger.Ctx{"pool": bundle.Pool.Name, "fingerprint": vol.Name, "err": err})
+			}
+
+			continue
+		}
+
+		volStorageName := project.StorageVolume(vol.Project, vol.Name)
+		if volType.IsInstance() {
+			volStorageName = project.Instance(vol.Project, vol.Name)
+		}
+
+		driverVol := storageDrivers.NewVolume(pool.Driver(), pool.Name(), volType, storageDrivers.ContentType(vol.ContentType), volStorageName, vol.Config, pool.Driver().Config())
+
+		err = pool.Driver().ValidateVolume(driverVol, false)
+		if err != nil {
+			return fmt.Errorf("Invalid config of %s volume %q in project %q: %w", vol.Type, vol.Name, vol.Project, err)
+		}
+
+		if volType == storageDrivers.VolumeTypeCustom {
+			_, err = s.DB.Cluster.CreateStoragePoolVolume(vol.Project, vol.Name, vol.Description, volDBType, poolID, vol.Config, volDBContentType, vol.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("Failed creating volume %q in project %q: %w", vol.Name, vol.Project, err)
+			}
+		}
+
+		err = pool.Driver().CreateVolume(driverVol, nil, nil)
+		if err != nil {
+			return fmt.Errorf("Failed creating %s volume %q in project %q: %w", vol.Type, vol.Name, vol.Project, err)
+		}
+
+		for _, snap := range vol.Snapshots {
+			snapName := storageDrivers.GetSnapshotVolumeName(vol.Name, snap.Name)
+
+			if volType == storageDrivers.VolumeTypeCustom {
+				var expiry time.Time
+				if snap.ExpiresAt != nil {
+					expiry = *snap.ExpiresAt
+				}
+
+				_, err = s.DB.Cluster.CreateStorageVolumeSnapshot(vol.Project, snapName, snap.Description, volDBType, poolID, snap.Config, snap.CreatedAt, expiry)
+				if err != nil {
+					return fmt.Errorf("Failed creating snapshot %q in project %q: %w", snapName, vol.Project, err)
+				}
+			}
+
+			snapVol, err := driverVol.NewSnapshot(snap.Name)
+			if err != nil {
+				return err
+			}
+
+			err = pool.Driver().CreateVolumeSnapshot(snapVol, nil)
+			if err != nil {
+				return fmt.Errorf("Failed creating %s snapshot %q in project %q: %w", vol.Type, snapName, vol.Project, err)
+			}
+		}
+	}
+
+	if len(bundle.QGroupLimits) > 0 && bundle.Pool.Driver == "btrfs" && !s.OS.MockMode {
+		err = storageDrivers.QGroupImport(storageDrivers.GetPoolMountPath(bundle.Pool.Name), bundle.QGroupLimits)
+		if err != nil {
+			logger.Warn("Failed applying qgroup limits of recovery bundle", logger.Ctx{"pool": bundle.Pool.Name, "err": err})
+		}
+	}
+
+	revert.Success()
+	return nil
+}
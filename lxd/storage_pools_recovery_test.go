@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/lxc/lxd/lxd/cluster/request"
+	"github.com/lxc/lxd/lxd/db"
+	storagePools "github.com/lxc/lxd/lxd/storage"
+	"github.com/lxc/lxd/shared/api"
+)
+
+type storagePoolRecoveryTestSuite struct {
+	lxdTestSuite
+}
+
+// Exporting a populated pool and importing the bundle into a fresh daemon recreates the same custom volumes, the
+// records of the instance volumes being left to the recovery of their instances.
+func (suite *storagePoolRecoveryTestSuite) TestStoragePoolRecoveryBundle_RoundTrip() {
+	req := api.StoragePoolsPost{
+		Name:   "recoveryPool",
+		Driver: "mock",
+		StoragePoolPut: api.StoragePoolPut{
+			Description: "Pool to recover",
+		},
+	}
+
+	err := storagePoolCreateGlobal(suite.d.State(), req, request.ClientTypeNormal)
+	suite.Req.Nil(err)
+
+	poolID, err := suite.d.db.Cluster.GetStoragePoolID(req.Name)
+	suite.Req.Nil(err)
+
+	createdAt := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	expiry := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	_, err = suite.d.db.Cluster.CreateStoragePoolVolume("default", "data", "Data volume", db.StoragePoolVolumeTypeCustom, poolID, map[string]string{"size": "10GiB", "user.owner": "alice"}, db.StoragePoolVolumeContentTypeFS, createdAt)
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStorageVolumeSnapshot("default", "data/snap0", "First snapshot", db.StoragePoolVolumeTypeCustom, poolID, map[string]string{"size": "10GiB"}, createdAt.Add(time.Hour), expiry)
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStorageVolumeSnapshot("default", "data/snap1", "", db.StoragePoolVolumeTypeCustom, poolID, map[string]string{"size": "10GiB"}, createdAt.Add(2*time.Hour), time.Time{})
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStoragePoolVolume("default", "disk", "", db.StoragePoolVolumeTypeCustom, poolID, map[string]string{"size": "5GiB"}, db.StoragePoolVolumeContentTypeBlock, createdAt)
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStoragePoolVolume("default", "c1", "", db.StoragePoolVolumeTypeContainer, poolID, map[string]string{}, db.StoragePoolVolumeContentTypeFS, createdAt)
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStorageVolumeSnapshot("default", "c1/snap0", "", db.StoragePoolVolumeTypeContainer, poolID, map[string]string{}, createdAt.Add(time.Hour), time.Time{})
+	suite.Req.Nil(err)
+
+	_, err = suite.d.db.Cluster.CreateStoragePoolVolume("default", "b7f1b454fff2d5bf5c1bbc9ba22ad68df0c0a5d5d3a8ccf199b6ac9ba26d1a9d", "", db.StoragePoolVolumeTypeImage, poolID, map[string]string{}, db.StoragePoolVolumeContentTypeFS, createdAt)
+	suite.Req.Nil(err)
+
+	bundle, err := storagePoolRecoveryBundleExport(suite.d.State(), req.Name)
+	suite.Req.Nil(err)
+	suite.Req.Equal(1, bundle.Version)
+	suite.Req.Len(bundle.Volumes, 4)
+	suite.Req.Len(bundle.Volumes[1].Snapshots, 2)
+	suite.Req.Equal("snap0", bundle.Volumes[1].Snapshots[0].Name)
+	suite.Req.NotNil(bundle.Volumes[1].Snapshots[0].ExpiresAt)
+	suite.Req.Nil(bundle.Volumes[1].Snapshots[1].ExpiresAt)
+
+	// Start over with a fresh daemon.
+	suite.TearDownTest()
+	suite.SetupTest()
+
+	err = storagePoolRecoveryBundleImport(suite.d.State(), bundle)
+	suite.Req.Nil(err)
+
+	imported, err := storagePoolRecoveryBundleExport(suite.d.State(), req.Name)
+	suite.Req.Nil(err)
+
+	customVolumes := []storagePools.RecoveryBundleVolume{}
+	for _, vol := range bundle.Volumes {
+		if vol.Type == db.StoragePoolVolumeTypeNameCustom {
+			customVolumes = append(customVolumes, vol)
+		}
+	}
+
+	suite.Req.Len(customVolumes, 2)
+	suite.Req.Equal(bundle.Pool, imported.Pool)
+	suite.Req.Equal(customVolumes, imported.Volumes)
+
+	// The pool now exists so the bundle can't be imported again.
+	err = storagePoolRecoveryBundleImport(suite.d.State(), bundle)
+	suite.Req.NotNil(err)
+}
+
+// Bundles of unknown versions are refused without creating anything.
+func (suite *storagePoolRecoveryTestSuite) TestStoragePoolRecoveryBundle_UnsupportedVersion() {
+	bundle, err := storagePoolRecoveryBundleExport(suite.d.State(), lxdTestSuiteDefaultStoragePool)
+	suite.Req.Nil(err)
+
+	bundle.Version = 2
+	bundle.Pool.Name = "newPool"
+
+	err = storagePoolRecoveryBundleImport(suite.d.State(), bundle)
+	suite.Req.NotNil(err)
+
+	_, err = suite.d.db.Cluster.GetStoragePoolID("newPool")
+	suite.Req.NotNil(err)
+}
+
+func TestStoragePoolRecoveryTestSuite(t *testing.T) {
+	suite.Run(t, new(storagePoolRecoveryTestSuite))
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/lxc/lxd/lxd/cluster/request"
 	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/response"
 	"github.com/lxc/lxd/lxd/revert"
 	"github.com/lxc/lxd/lxd/state"
 	storagePools "github.com/lxc/lxd/lxd/storage"
+	"github.com/lxc/lxd/lxd/task"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/logger"
 )
@@ -172,3 +175,50 @@ func dbStoragePoolDeleteAndUpdateCache(s *state.State, poolName string) error {
 
 	return err
 }
+
+// sampleStoragePoolsUsage records the usage of the local storage pools which have usage history enabled.
+func sampleStoragePoolsUsage(s *state.State) {
+	poolNames, err := s.DB.Cluster.GetCreatedStoragePoolNames()
+	if err != nil && !response.IsNotFoundError(err) {
+		logger.Error("Failed to get storage pools", logger.Ctx{"err": err})
+		return
+	}
+
+	now := time.Now()
+	for _, poolName := range poolNames {
+		pool, err := storagePools.LoadByName(s, poolName)
+		if err != nil {
+			logger.Error("Failed to get storage pool", logger.Ctx{"pool": poolName, "err": err})
+			continue
+		}
+
+		err = storagePools.SampleUsage(pool, now)
+		if err != nil {
+			logger.Warn("Failed to sample storage pool usage", logger.Ctx{"pool": poolName, "err": err})
+		}
+	}
+}
+
+func storagePoolsUsageHistoryTask(d *Daemon) (task.Func, task.Schedule) {
+	f := func(ctx context.Context) {
+		sampleStoragePoolsUsage(d.State())
+	}
+
+	// Check every minute, each pool is sampled according to its own usage_history.interval.
+	return f, task.Every(time.Minute)
+}
+
+// storagePoolUnavailableAPI returns the API representation of a pool which can't be loaded as it's unavailable on
+// this server for the given reason, based on its database record.
+func storagePoolUnavailableAPI(s *state.State, poolName string, reason string) (*api.StoragePool, error) {
+	_, poolAPI, _, err := s.DB.Cluster.GetStoragePoolInAnyState(poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	poolAPI.UsedBy = []string{}
+	poolAPI.Status = api.StoragePoolStatusUnvailable
+	poolAPI.StatusReason = reason
+
+	return poolAPI, nil
+}
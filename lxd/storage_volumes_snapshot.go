@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,6 +16,7 @@ import (
 	"github.com/flosch/pongo2"
 	"github.com/gorilla/mux"
 
+	"github.com/lxc/lxd/lxd/cluster"
 	"github.com/lxc/lxd/lxd/db"
 	dbCluster "github.com/lxc/lxd/lxd/db/cluster"
 	"github.com/lxc/lxd/lxd/db/operationtype"
@@ -21,7 +24,9 @@ import (
 	"github.com/lxc/lxd/lxd/operations"
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/response"
+	"github.com/lxc/lxd/lxd/state"
 	storagePools "github.com/lxc/lxd/lxd/storage"
+	storageDrivers "github.com/lxc/lxd/lxd/storage/drivers"
 	"github.com/lxc/lxd/lxd/task"
 	"github.com/lxc/lxd/lxd/util"
 	"github.com/lxc/lxd/shared"
@@ -47,6 +52,12 @@ var storagePoolVolumeSnapshotTypeCmd = APIEndpoint{
 	Put:    APIEndpointAction{Handler: storagePoolVolumeSnapshotTypePut, AccessHandler: allowProjectPermission("storage-volumes", "manage-storage-volumes")},
 }
 
+var storagePoolVolumeSnapshotTypeSendParentCmd = APIEndpoint{
+	Path: "storage-pools/{pool}/volumes/{type}/{name}/snapshots/{snapshotName}/send-parent",
+
+	Post: APIEndpointAction{Handler: storagePoolVolumeSnapshotTypeSendParentPost, AccessHandler: allowProjectPermission("storage-volumes", "manage-storage-volumes")},
+}
+
 // swagger:operation POST /1.0/storage-pools/{name}/volumes/{type}/{volume}/snapshots storage storage_pool_volumes_type_snapshots_post
 //
 // Create a storage volume snapshot
@@ -160,6 +171,15 @@ func storagePoolVolumeSnapshotsTypePost(d *Daemon, r *http.Request) response.Res
 		return response.BadRequest(err)
 	}
 
+	if len(req.Metadata) > 0 && volumeType != db.StoragePoolVolumeTypeCustom {
+		return response.BadRequest(fmt.Errorf("Only custom volume snapshots can have metadata"))
+	}
+
+	err = storagePools.ValidateSnapshotMetadata(req.Metadata)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
 	// Get a snapshot name.
 	if req.Name == "" {
 		i := d.db.Cluster.GetNextStorageVolumeSnapshotIndex(poolName, volumeName, volumeType, "snap%d")
@@ -223,7 +243,16 @@ func storagePoolVolumeSnapshotsTypePost(d *Daemon, r *http.Request) response.Res
 
 	// Create the snapshot.
 	snapshot := func(op *operations.Operation) error {
-		return pool.CreateCustomVolumeSnapshot(projectName, volumeName, req.Name, expiry, op)
+		err := pool.CreateCustomVolumeSnapshot(projectName, volumeName, req.Name, expiry, op)
+		if err != nil {
+			return err
+		}
+
+		if len(req.Metadata) > 0 {
+			return pool.SetCustomVolumeSnapshotMetadata(projectName, fmt.Sprintf("%s/%s", volumeName, req.Name), req.Metadata, op)
+		}
+
+		return nil
 	}
 
 	resources := map[string][]string{}
@@ -257,6 +286,11 @@ func storagePoolVolumeSnapshotsTypePost(d *Daemon, r *http.Request) response.Res
 //     description: Cluster member name
 //     type: string
 //     example: lxd01
+//   - in: query
+//     name: order
+//     description: Order of the snapshots (name, creation_time or size)
+//     type: string
+//     example: creation_time
 // responses:
 //   "200":
 //     description: API endpoints
@@ -311,6 +345,11 @@ func storagePoolVolumeSnapshotsTypePost(d *Daemon, r *http.Request) response.Res
 //     description: Cluster member name
 //     type: string
 //     example: lxd01
+//   - in: query
+//     name: order
+//     description: Order of the snapshots (name, creation_time or size)
+//     type: string
+//     example: creation_time
 // responses:
 //   "200":
 //     description: API endpoints
@@ -388,6 +427,39 @@ func storagePoolVolumeSnapshotsTypeGet(d *Daemon, r *http.Request) response.Resp
 		return response.SmartError(err)
 	}
 
+	// Sort the snapshots server-side if requested.
+	order := queryParam(r, "order")
+	if order != "" {
+		if !shared.StringInSlice(order, storagePools.SnapshotOrders) {
+			return response.BadRequest(fmt.Errorf("Invalid snapshot order %q, expected one of: %s", order, strings.Join(storagePools.SnapshotOrders, ", ")))
+		}
+
+		pool, err := storagePools.LoadByName(d.State(), poolName)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		orderedNames, err := pool.OrderVolumeSnapshots(projectName, fmt.Sprintf("%s/%s", volumeTypeName, volumeName), order)
+		if err != nil {
+			if errors.Is(err, storageDrivers.ErrNotSupported) {
+				return response.NotImplemented(fmt.Errorf("Storage pool %q cannot order snapshots by %s: %w", poolName, order, err))
+			}
+
+			return response.SmartError(err)
+		}
+
+		positions := make(map[string]int, len(orderedNames))
+		for i, snapName := range orderedNames {
+			positions[snapName] = i
+		}
+
+		sort.SliceStable(volumes, func(i, j int) bool {
+			_, iName, _ := api.GetParentAndSnapshotName(volumes[i].Name)
+			_, jName, _ := api.GetParentAndSnapshotName(volumes[j].Name)
+			return positions[iName] < positions[jName]
+		})
+	}
+
 	// Prepare the response.
 	resultString := []string{}
 	resultMap := []*api.StorageVolumeSnapshot{}
@@ -418,6 +490,7 @@ func storagePoolVolumeSnapshotsTypeGet(d *Daemon, r *http.Request) response.Resp
 			tmp.Description = vol.Description
 			tmp.Name = vol.Name
 			tmp.CreatedAt = vol.CreatedAt
+			tmp.Metadata = storagePools.SnapshotMetadata(vol.Config)
 
 			expiryDate := volume.ExpiryDate
 			if expiryDate.Unix() > 0 {
@@ -685,8 +758,22 @@ func storagePoolVolumeSnapshotTypeGet(d *Daemon, r *http.Request) response.Respo
 	snapshot.ExpiresAt = &expiry
 	snapshot.ContentType = dbVolume.ContentType
 	snapshot.CreatedAt = dbVolume.CreatedAt
+	snapshot.Metadata = storagePools.SnapshotMetadata(dbVolume.Config)
 
-	etag := []any{snapshot.Description, expiry}
+	if volumeType == db.StoragePoolVolumeTypeCustom {
+		pool, err := storagePools.LoadByName(d.State(), poolName)
+		if err != nil {
+			return response.SmartError(err)
+		}
+
+		// Leave the usage unset when the pool can't report it (e.g. btrfs quotas disabled).
+		snapshot.Usage, err = pool.GetCustomVolumeSnapshotUsage(projectName, fullSnapshotName)
+		if err != nil && !errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.SmartError(err)
+		}
+	}
+
+	etag := []any{snapshot.Description, expiry, snapshot.Metadata}
 	return response.SyncResponseETag(true, &snapshot, etag)
 }
 
@@ -800,7 +887,7 @@ func storagePoolVolumeSnapshotTypePut(d *Daemon, r *http.Request) response.Respo
 	}
 
 	// Validate the ETag
-	etag := []any{dbVolume.Description, expiry}
+	etag := []any{dbVolume.Description, expiry, storagePools.SnapshotMetadata(dbVolume.Config)}
 	err = util.EtagCheck(r, etag)
 	if err != nil {
 		return response.PreconditionFailed(err)
@@ -923,7 +1010,7 @@ func storagePoolVolumeSnapshotTypePatch(d *Daemon, r *http.Request) response.Res
 	}
 
 	// Validate the ETag
-	etag := []any{dbVolume.Description, expiry}
+	etag := []any{dbVolume.Description, expiry, storagePools.SnapshotMetadata(dbVolume.Config)}
 	err = util.EtagCheck(r, etag)
 	if err != nil {
 		return response.PreconditionFailed(err)
@@ -932,6 +1019,7 @@ func storagePoolVolumeSnapshotTypePatch(d *Daemon, r *http.Request) response.Res
 	req := api.StorageVolumeSnapshotPut{
 		Description: dbVolume.Description,
 		ExpiresAt:   &expiry,
+		Metadata:    storagePools.SnapshotMetadata(dbVolume.Config),
 	}
 
 	err = json.NewDecoder(r.Body).Decode(&req)
@@ -948,6 +1036,11 @@ func doStoragePoolVolumeSnapshotUpdate(d *Daemon, r *http.Request, poolName stri
 		expiry = *req.ExpiresAt
 	}
 
+	err := storagePools.ValidateSnapshotMetadata(req.Metadata)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
 	pool, err := storagePools.LoadByName(d.State(), poolName)
 	if err != nil {
 		return response.SmartError(err)
@@ -963,7 +1056,16 @@ func doStoragePoolVolumeSnapshotUpdate(d *Daemon, r *http.Request, poolName stri
 		if err != nil {
 			return response.SmartError(err)
 		}
+
+		err = pool.SetCustomVolumeSnapshotMetadata(projectName, volName, req.Metadata, op)
+		if err != nil {
+			return response.SmartError(err)
+		}
 	} else {
+		if len(req.Metadata) > 0 {
+			return response.BadRequest(fmt.Errorf("Only custom volume snapshots can have metadata"))
+		}
+
 		inst, err := instance.LoadByProjectAndName(d.State(), projectName, volName)
 		if err != nil {
 			return response.SmartError(err)
@@ -1083,6 +1185,150 @@ func storagePoolVolumeSnapshotTypeDelete(d *Daemon, r *http.Request) response.Re
 	return operations.OperationResponse(op)
 }
 
+// swagger:operation POST /1.0/storage-pools/{name}/volumes/{type}/{volume}/snapshots/{snapshot}/send-parent storage storage_pool_volumes_type_snapshot_send_parent_post
+//
+// Update the send parent ref counter of the storage volume snapshot
+//
+// Increments or decrements the number of incremental sends made outside of LXD (for example by backup tooling)
+// which rely on the snapshot as their parent. The snapshot can't be deleted while the counter is above zero.
+//
+// ---
+// consumes:
+//   - application/json
+// produces:
+//   - application/json
+// parameters:
+//   - in: query
+//     name: project
+//     description: Project name
+//     type: string
+//     example: default
+//   - in: query
+//     name: target
+//     description: Cluster member name
+//     type: string
+//     example: lxd01
+//   - in: body
+//     name: send parent
+//     description: Send parent ref counter update
+//     required: true
+//     schema:
+//       $ref: "#/definitions/StorageVolumeSnapshotSendParentPost"
+// responses:
+//   "200":
+//     description: Send parent ref counter
+//     schema:
+//       type: object
+//       description: Sync response
+//       properties:
+//         type:
+//           type: string
+//           description: Response type
+//           example: sync
+//         status:
+//           type: string
+//           description: Status description
+//           example: Success
+//         status_code:
+//           type: integer
+//           description: Status code
+//           example: 200
+//         metadata:
+//           $ref: "#/definitions/StorageVolumeSnapshotSendParent"
+//   "400":
+//     $ref: "#/responses/BadRequest"
+//   "403":
+//     $ref: "#/responses/Forbidden"
+//   "404":
+//     $ref: "#/responses/NotFound"
+//   "500":
+//     $ref: "#/responses/InternalServerError"
+func storagePoolVolumeSnapshotTypeSendParentPost(d *Daemon, r *http.Request) response.Response {
+	// Get the name of the storage pool the volume is supposed to be attached to.
+	poolName, err := url.PathUnescape(mux.Vars(r)["pool"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Get the name of the volume type.
+	volumeTypeName, err := url.PathUnescape(mux.Vars(r)["type"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Get the name of the storage volume.
+	volumeName, err := url.PathUnescape(mux.Vars(r)["name"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Get the name of the storage volume snapshot.
+	snapshotName, err := url.PathUnescape(mux.Vars(r)["snapshotName"])
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Convert the volume type name to our internal integer representation.
+	volumeType, err := storagePools.VolumeTypeNameToDBType(volumeTypeName)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	// Check that the storage volume type can have snapshots.
+	if !shared.IntInSlice(volumeType, []int{db.StoragePoolVolumeTypeCustom, db.StoragePoolVolumeTypeContainer, db.StoragePoolVolumeTypeVM}) {
+		return response.BadRequest(fmt.Errorf("Invalid storage volume type %q", volumeTypeName))
+	}
+
+	// Get the project name.
+	projectName, err := project.StorageVolumeProject(d.State().DB.Cluster, projectParam(r), volumeType)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	req := api.StorageVolumeSnapshotSendParentPost{}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return response.BadRequest(err)
+	}
+
+	if !shared.StringInSlice(req.Action, []string{"increment", "decrement"}) {
+		return response.BadRequest(fmt.Errorf("Invalid action %q", req.Action))
+	}
+
+	// Forward if needed.
+	resp := forwardedResponseIfTargetIsRemote(d, r)
+	if resp != nil {
+		return resp
+	}
+
+	fullSnapshotName := fmt.Sprintf("%s/%s", volumeName, snapshotName)
+	resp = forwardedResponseIfVolumeIsRemote(d, r, poolName, projectName, fullSnapshotName, volumeType)
+	if resp != nil {
+		return resp
+	}
+
+	volType, err := storagePools.VolumeDBTypeToType(volumeType)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	pool, err := storagePools.LoadByName(d.State(), poolName)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Use an empty operation for this sync response to pass the requestor
+	op := &operations.Operation{}
+	op.SetRequestor(r)
+
+	count, err := pool.UpdateVolumeSnapshotSendParentRefCount(projectName, fullSnapshotName, volType, req.Action == "increment", op)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	return response.SyncResponse(true, api.StorageVolumeSnapshotSendParent{RefCount: uint64(count)})
+}
+
 func pruneExpireCustomVolumeSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	f := func(ctx context.Context) {
 		// Get the list of expired custom volume snapshots.
@@ -1156,6 +1402,151 @@ func pruneExpiredCustomVolumeSnapshots(ctx context.Context, d *Daemon, expiredSn
 	return nil
 }
 
+func archiveCustomVolumeSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
+	f := func(ctx context.Context) {
+		s := d.State()
+
+		volumes, err := customVolumesToArchive(ctx, s)
+		if err != nil {
+			logger.Error("Failed to get custom volumes to archive snapshots of", logger.Ctx{"err": err})
+			return
+		}
+
+		if len(volumes) == 0 {
+			return
+		}
+
+		opRun := func(op *operations.Operation) error {
+			return archiveCustomVolumeSnapshots(ctx, d, volumes, time.Now(), op)
+		}
+
+		op, err := operations.OperationCreate(s, "", operations.OperationClassTask, operationtype.CustomVolumeSnapshotsArchive, nil, nil, opRun, nil, nil, nil)
+		if err != nil {
+			logger.Error("Failed to start archive custom volume snapshots operation", logger.Ctx{"err": err})
+			return
+		}
+
+		logger.Info("Archiving custom volume snapshots")
+		err = op.Start()
+		if err != nil {
+			logger.Error("Failed to archive custom volume snapshots", logger.Ctx{"err": err})
+		}
+
+		_, _ = op.Wait(ctx)
+		logger.Info("Done archiving custom volume snapshots")
+	}
+
+	first := true
+	schedule := func() (time.Duration, error) {
+		interval := time.Hour
+
+		if first {
+			first = false
+			return interval, task.ErrSkip
+		}
+
+		return interval, nil
+	}
+
+	return f, schedule
+}
+
+// customVolumesToArchive returns the local custom volumes with a snapshot archiving policy.
+func customVolumesToArchive(ctx context.Context, s *state.State) ([]db.StorageVolumeArgs, error) {
+	clustered, err := cluster.Enabled(s.DB.Node)
+	if err != nil {
+		return nil, fmt.Errorf("Failed checking whether the server is clustered: %w", err)
+	}
+
+	var volumes []db.StorageVolumeArgs
+	err = s.DB.Cluster.Transaction(ctx, func(ctx context.Context, tx *db.ClusterTx) error {
+		allVolumes, err := tx.GetStoragePoolVolumesWithType(ctx, db.StoragePoolVolumeTypeCustom)
+		if err != nil {
+			return fmt.Errorf("Failed getting volumes for custom volume snapshot archive task: %w", err)
+		}
+
+		localNodeID := s.DB.Cluster.GetNodeID()
+		for _, v := range allVolumes {
+			if v.Config["snapshots.archive.pool"] == "" || v.Config["snapshots.archive.age"] == "" {
+				continue
+			}
+
+			// Snapshots of remote volumes are only archived when not clustered, to avoid racing members.
+			if v.NodeID == localNodeID || (v.NodeID < 0 && !clustered) {
+				volumes = append(volumes, v)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return volumes, nil
+}
+
+// archiveCustomVolumeSnapshots moves the snapshots of the volumes older than their snapshots.archive.age to
+// their snapshots.archive.pool, oldest first. Failures are logged and the remaining snapshots are still archived.
+func archiveCustomVolumeSnapshots(ctx context.Context, d *Daemon, volumes []db.StorageVolumeArgs, now time.Time, op *operations.Operation) error {
+	total := 0
+	failed := 0
+
+	for _, v := range volumes {
+		l := logger.AddContext(logger.Log, logger.Ctx{"project": v.ProjectName, "pool": v.PoolName, "volume": v.Name})
+
+		pool, err := storagePools.LoadByName(d.State(), v.PoolName)
+		if err != nil {
+			l.Error("Failed loading pool to archive custom volume snapshots", logger.Ctx{"err": err})
+			failed++
+			total++
+			continue
+		}
+
+		snapshots, err := storagePools.VolumeDBSnapshotsGet(pool, v.ProjectName, v.Name, storageDrivers.VolumeTypeCustom)
+		if err != nil {
+			l.Error("Failed getting custom volume snapshots to archive", logger.Ctx{"err": err})
+			failed++
+			total++
+			continue
+		}
+
+		entries := make([]shared.SnapshotRetentionEntry, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			entries = append(entries, shared.SnapshotRetentionEntry{Name: snapshot.Name, CreationDate: snapshot.CreationDate})
+		}
+
+		names, err := storagePools.SnapshotsToArchive(v.Config["snapshots.archive.age"], entries, now)
+		if err != nil {
+			l.Error("Invalid snapshot archive age", logger.Ctx{"err": err})
+			continue
+		}
+
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			total++
+
+			archiveName, err := pool.ArchiveCustomVolumeSnapshot(v.ProjectName, name, v.Config["snapshots.archive.pool"], op)
+			if err != nil {
+				l.Error("Failed archiving custom volume snapshot", logger.Ctx{"snapshot": name, "err": err})
+				failed++
+				continue
+			}
+
+			l.Debug("Archived custom volume snapshot", logger.Ctx{"snapshot": name, "archivePool": v.Config["snapshots.archive.pool"], "archive": archiveName})
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed archiving %d of %d custom volume snapshots", failed, total)
+	}
+
+	return nil
+}
+
 func autoCreateCustomVolumeSnapshotsTask(d *Daemon) (task.Func, task.Schedule) {
 	f := func(ctx context.Context) {
 		s := d.State()
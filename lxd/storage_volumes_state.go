@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -14,6 +15,7 @@ import (
 	"github.com/lxc/lxd/lxd/project"
 	"github.com/lxc/lxd/lxd/response"
 	storagePools "github.com/lxc/lxd/lxd/storage"
+	storageDrivers "github.com/lxc/lxd/lxd/storage/drivers"
 	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/lxc/lxd/shared/units"
@@ -112,14 +114,20 @@ func storagePoolVolumeTypeStateGet(d *Daemon, r *http.Request) response.Response
 		return response.SmartError(err)
 	}
 
-	// Fetch the current usage.
+	// Fetch the current usage and generation.
 	var used int64
+	var generation uint64
 	if volumeType == db.StoragePoolVolumeTypeCustom {
 		// Custom volumes.
 		used, err = pool.GetCustomVolumeUsage(projectName, volumeName)
 		if err != nil {
 			return response.SmartError(err)
 		}
+
+		generation, err = pool.GetCustomVolumeGeneration(projectName, volumeName)
+		if err != nil && !errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.SmartError(err)
+		}
 	} else {
 		resp, err := forwardedResponseIfInstanceIsRemote(d, r, projectName, volumeName, instancetype.Any)
 		if err != nil {
@@ -140,11 +148,17 @@ func storagePoolVolumeTypeStateGet(d *Daemon, r *http.Request) response.Response
 		if err != nil {
 			return response.SmartError(err)
 		}
+
+		generation, err = pool.GetInstanceGeneration(inst)
+		if err != nil && !errors.Is(err, storageDrivers.ErrNotSupported) {
+			return response.SmartError(err)
+		}
 	}
 
 	// Prepare the state struct.
 	state := api.StorageVolumeState{}
 	state.Usage = &api.StorageVolumeStateUsage{}
+	state.Generation = generation
 
 	// Only fill 'used' field if receiving a valid value.
 	if used >= 0 {
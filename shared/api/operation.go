@@ -14,6 +14,17 @@ const OperationClassWebsocket = "websocket"
 // OperationClassToken represents the Token OperationClass.
 const OperationClassToken = "token"
 
+// OperationPut represents the settings of a running LXD background operation which can be changed
+//
+// swagger:model
+//
+// API extension: operation_update.
+type OperationPut struct {
+	// Operation specific settings to change
+	// Example: {"limits.network": "10MB"}
+	Config map[string]string `json:"config" yaml:"config"`
+}
+
 // Operation represents a LXD background operation
 //
 // swagger:model
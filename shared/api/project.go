@@ -80,6 +80,13 @@ type ProjectState struct {
 	// Read only: true
 	// Example: {"containers": {"limit": 10, "usage": 4}, "cpu": {"limit": 20, "usage": 16}}
 	Resources map[string]ProjectStateResource `json:"resources" yaml:"resources"`
+
+	// Disk space used on the server by the project's instances and custom volumes (bytes), per storage pool
+	// Read only: true
+	// Example: {"default": 3221225472, "fast": 1073741824}
+	//
+	// API extension: project_storage_usage
+	StorageUsage map[string]int64 `json:"storage_usage" yaml:"storage_usage"`
 }
 
 // ProjectStateResource represents the state of a particular resource in a LXD project
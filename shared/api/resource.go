@@ -757,6 +757,42 @@ type ResourcesStoragePool struct {
 
 	// DIsk inode usage
 	Inodes ResourcesStoragePoolInodes `json:"inodes,omitempty" yaml:"inodes,omitempty"`
+
+	// Error counters of the devices backing the pool
+	//
+	// API extension: resources_storage_pool_devices
+	Devices []ResourcesStoragePoolDevice `json:"devices,omitempty" yaml:"devices,omitempty"`
+}
+
+// ResourcesStoragePoolDevice represents the error counters of a device backing a given storage pool
+//
+// swagger:model
+//
+// API extension: resources_storage_pool_devices.
+type ResourcesStoragePoolDevice struct {
+	// Path of the device
+	// Example: /dev/sdb
+	Device string `json:"device" yaml:"device"`
+
+	// Number of failed reads
+	// Example: 0
+	ReadErrors uint64 `json:"read_errors" yaml:"read_errors"`
+
+	// Number of failed writes
+	// Example: 0
+	WriteErrors uint64 `json:"write_errors" yaml:"write_errors"`
+
+	// Number of failed flushes
+	// Example: 0
+	FlushErrors uint64 `json:"flush_errors" yaml:"flush_errors"`
+
+	// Number of checksum mismatches
+	// Example: 2
+	CorruptionErrors uint64 `json:"corruption_errors" yaml:"corruption_errors"`
+
+	// Number of blocks with an unexpected generation (lost writes)
+	// Example: 0
+	GenerationErrors uint64 `json:"generation_errors" yaml:"generation_errors"`
 }
 
 // ResourcesStoragePoolSpace represents the space available to a given storage pool
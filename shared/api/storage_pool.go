@@ -59,6 +59,13 @@ type StoragePool struct {
 	// API extension: clustering
 	Status string `json:"status" yaml:"status"`
 
+	// Reason the pool is unavailable on the server (if known)
+	// Read only: true
+	// Example: Required tool "btrfs" is missing
+	//
+	// API extension: storage_pool_unavailable_reason
+	StatusReason string `json:"status_reason,omitempty" yaml:"status_reason,omitempty"`
+
 	// Cluster members on which the storage pool has been defined
 	// Read only: true
 	// Example: ["lxd01", "lxd02", "lxd03"]
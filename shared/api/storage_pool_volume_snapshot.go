@@ -19,6 +19,12 @@ type StorageVolumeSnapshotsPost struct {
 	//
 	// API extension: custom_volume_snapshot_expiry
 	ExpiresAt *time.Time `json:"expires_at" yaml:"expires_at"`
+
+	// User-defined metadata of the snapshot
+	// Example: {"ticket": "1234"}
+	//
+	// API extension: storage_volume_snapshot_metadata
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
 }
 
 // StorageVolumeSnapshotPost represents the fields required to rename/move a LXD storage volume snapshot
@@ -58,6 +64,26 @@ type StorageVolumeSnapshot struct {
 	// Example: 2021-03-23T20:00:00-04:00
 	// API extension: storage_volumes_created_at
 	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+
+	// Disk usage of the snapshot (null if unavailable)
+	//
+	// API extension: storage_volume_snapshot_usage
+	Usage *StorageVolumeSnapshotUsage `json:"usage" yaml:"usage"`
+}
+
+// StorageVolumeSnapshotUsage represents the disk usage of a storage volume snapshot
+//
+// swagger:model
+//
+// API extension: storage_volume_snapshot_usage.
+type StorageVolumeSnapshotUsage struct {
+	// Space shared with the volume or other snapshots in bytes
+	// Example: 1693552640
+	Shared int64 `json:"shared" yaml:"shared"`
+
+	// Space only referenced by the snapshot in bytes
+	// Example: 52428800
+	Exclusive int64 `json:"exclusive" yaml:"exclusive"`
 }
 
 // StorageVolumeSnapshotPut represents the modifiable fields of a LXD storage volume
@@ -75,9 +101,37 @@ type StorageVolumeSnapshotPut struct {
 	//
 	// API extension: custom_volume_snapshot_expiry
 	ExpiresAt *time.Time `json:"expires_at" yaml:"expires_at"`
+
+	// User-defined metadata of the snapshot
+	// Example: {"ticket": "1234"}
+	//
+	// API extension: storage_volume_snapshot_metadata
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
 }
 
 // Writable converts a full StorageVolumeSnapshot struct into a StorageVolumeSnapshotPut struct (filters read-only fields).
 func (storageVolumeSnapshot *StorageVolumeSnapshot) Writable() StorageVolumeSnapshotPut {
 	return storageVolumeSnapshot.StorageVolumeSnapshotPut
 }
+
+// StorageVolumeSnapshotSendParentPost represents the fields required to update the send parent ref counter of a LXD storage volume snapshot
+//
+// swagger:model
+//
+// API extension: storage_volume_snapshot_send_parent.
+type StorageVolumeSnapshotSendParentPost struct {
+	// Whether to increment or decrement the counter (increment or decrement)
+	// Example: increment
+	Action string `json:"action" yaml:"action"`
+}
+
+// StorageVolumeSnapshotSendParent represents the send parent ref counter of a LXD storage volume snapshot
+//
+// swagger:model
+//
+// API extension: storage_volume_snapshot_send_parent.
+type StorageVolumeSnapshotSendParent struct {
+	// Number of incremental sends relying on the snapshot as their parent
+	// Example: 1
+	RefCount uint64 `json:"refcount" yaml:"refcount"`
+}
@@ -8,6 +8,12 @@ package api
 type StorageVolumeState struct {
 	// Volume usage
 	Usage *StorageVolumeStateUsage `json:"usage" yaml:"usage"`
+
+	// Token of the volume content which changes whenever the volume changes (only on supported drivers)
+	// Example: 1024
+	//
+	// API extension: storage_volume_state_generation
+	Generation uint64 `json:"generation,omitempty" yaml:"generation,omitempty"`
 }
 
 // StorageVolumeStateUsage represents the disk usage of a volume
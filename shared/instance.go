@@ -127,6 +127,9 @@ var InstanceConfigKeysAny = map[string]func(value string) error{
 	"security.devlxd":            validate.Optional(validate.IsBool),
 	"security.protection.delete": validate.Optional(validate.IsBool),
 
+	"snapshots.consistency":      validate.Optional(validate.IsOneOf("crash", "application")),
+	"snapshots.create_rate":      validate.Optional(validate.IsUint32),
+	"snapshots.index":            validate.Optional(validate.IsBool),
 	"snapshots.schedule":         validate.Optional(validate.IsCron([]string{"@hourly", "@daily", "@midnight", "@weekly", "@monthly", "@annually", "@yearly", "@startup", "@never"})),
 	"snapshots.schedule.stopped": validate.Optional(validate.IsBool),
 	"snapshots.pattern":          validate.IsAny,
@@ -135,6 +138,10 @@ var InstanceConfigKeysAny = map[string]func(value string) error{
 		_, err := GetExpiry(time.Time{}, value)
 		return err
 	},
+	"snapshots.retention": func(value string) error {
+		_, err := ParseSnapshotRetention(value)
+		return err
+	},
 
 	// Volatile keys.
 	"volatile.apply_template":         validate.IsAny,
@@ -190,7 +197,15 @@ var InstanceConfigKeysContainer = map[string]func(value string) error{
 
 		return nil
 	},
-	"limits.cpu.priority":   validate.Optional(validate.IsPriority),
+	"limits.cpu.priority": validate.Optional(validate.IsPriority),
+	"limits.disk.read": func(value string) error {
+		_, _, err := ParseDiskLimit(value)
+		return err
+	},
+	"limits.disk.write": func(value string) error {
+		_, _, err := ParseDiskLimit(value)
+		return err
+	},
 	"limits.hugepages.64KB": validate.Optional(validate.IsSize),
 	"limits.hugepages.1MB":  validate.Optional(validate.IsSize),
 	"limits.hugepages.2MB":  validate.Optional(validate.IsSize),
@@ -373,6 +388,33 @@ func ConfigKeyChecker(key string, instanceType instancetype.Type) (func(value st
 	return nil, fmt.Errorf("Unknown configuration key: %s", key)
 }
 
+// ParseDiskLimit parses a disk limit, either a rate in bytes per second (various suffixes supported) or a number of
+// operations per second (e.g. "500iops"). It returns the bytes and operations per second, 0 meaning unlimited.
+func ParseDiskLimit(value string) (int64, int64, error) {
+	var err error
+
+	bps := int64(0)
+	iops := int64(0)
+
+	if value == "" {
+		return bps, iops, nil
+	}
+
+	if strings.HasSuffix(value, "iops") {
+		iops, err = strconv.ParseInt(strings.TrimSuffix(value, "iops"), 10, 64)
+		if err != nil {
+			return -1, -1, err
+		}
+	} else {
+		bps, err = units.ParseByteSizeString(value)
+		if err != nil {
+			return -1, -1, err
+		}
+	}
+
+	return bps, iops, nil
+}
+
 // InstanceIncludeWhenCopying is used to decide whether to include a config item or not when copying an instance.
 // The remoteCopy argument indicates if the copy is remote (i.e between LXD nodes) as this affects the keys kept.
 func InstanceIncludeWhenCopying(configKey string, remoteCopy bool) bool {
@@ -16,9 +16,10 @@ import (
 
 // InstanceTarWriter provides a TarWriter implementation that handles ID shifting and hardlink tracking.
 type InstanceTarWriter struct {
-	tarWriter *tar.Writer
-	idmapSet  *idmap.IdmapSet
-	linkMap   map[uint64]string
+	tarWriter  *tar.Writer
+	idmapSet   *idmap.IdmapSet
+	linkMap    map[uint64]string
+	unshiftAll bool
 }
 
 // NewInstanceTarWriter returns a ContainerTarWriter for the provided target Writer and id map.
@@ -30,6 +31,14 @@ func NewInstanceTarWriter(writer io.Writer, idmapSet *idmap.IdmapSet) *InstanceT
 	return ctw
 }
 
+// NewRootfsTarWriter returns an InstanceTarWriter for writing the content of an instance's rootfs at the root of
+// the tarball (rather than under rootfs/), unshifting the ids of all the files with the provided id map.
+func NewRootfsTarWriter(writer io.Writer, idmapSet *idmap.IdmapSet) *InstanceTarWriter {
+	ctw := NewInstanceTarWriter(writer, idmapSet)
+	ctw.unshiftAll = true
+	return ctw
+}
+
 // ResetHardLinkMap resets the hard link map. Use when copying multiple instances (or snapshots) into a tarball.
 // So that the hard link map doesn't work across different instances/snapshots.
 func (ctw *InstanceTarWriter) ResetHardLinkMap() {
@@ -77,7 +86,7 @@ func (ctw *InstanceTarWriter) WriteFile(name string, srcPath string, fi os.FileI
 	}
 
 	// Unshift the id under rootfs/ for unpriv containers.
-	if strings.HasPrefix(hdr.Name, "rootfs") && ctw.idmapSet != nil {
+	if (ctw.unshiftAll || strings.HasPrefix(hdr.Name, "rootfs")) && ctw.idmapSet != nil {
 		hUID, hGID := ctw.idmapSet.ShiftFromNs(int64(hdr.Uid), int64(hdr.Gid))
 		hdr.Uid = int(hUID)
 		hdr.Gid = int(hGID)
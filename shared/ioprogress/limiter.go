@@ -0,0 +1,127 @@
+package ioprogress
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the throughput of one or more streams to a number of bytes per second.
+// The limit can be changed at any time, including while streams are waiting on it.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   int64 // Bytes per second, 0 for unlimited.
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // Closed when the limit changes to wake up waiting streams.
+}
+
+// NewRateLimiter returns a RateLimiter allowing limit bytes per second (0 for unlimited).
+func NewRateLimiter(limit int64) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Limit returns the current limit in bytes per second.
+func (l *RateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+// SetLimit changes the limit to limit bytes per second (0 for unlimited).
+func (l *RateLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.limit = limit
+
+	if l.limit > 0 && l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// refill adds the tokens accumulated since the last refill, allowing bursts of at most one second of data.
+// Must be called with the lock held.
+func (l *RateLimiter) refill(now time.Time) {
+	if l.limit > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+
+	l.last = now
+}
+
+// Wait blocks until n bytes can be transferred within the limit.
+// The lock isn't held while waiting so that the limit can be changed meanwhile.
+func (l *RateLimiter) Wait(n int) {
+	remaining := float64(n)
+
+	for remaining > 0 {
+		l.mu.Lock()
+		if l.limit <= 0 {
+			l.mu.Unlock()
+			return
+		}
+
+		l.refill(time.Now())
+
+		take := l.tokens
+		if take > remaining {
+			take = remaining
+		}
+
+		l.tokens -= take
+		remaining -= take
+
+		if remaining <= 0 {
+			l.mu.Unlock()
+			return
+		}
+
+		// Wait for the tokens needed by the rest of the data, at most a full bucket at a time.
+		need := remaining
+		if need > float64(l.limit) {
+			need = float64(l.limit)
+		}
+
+		wait := time.Duration(need / float64(l.limit) * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// RateLimitedReader is a wrapper around ReadCloser which limits its throughput.
+type RateLimitedReader struct {
+	io.ReadCloser
+	Limiter *RateLimiter
+}
+
+// Read in RateLimitedReader is the same as io.Read but waits for the data read to fit within the limit.
+// The wait happens after the read returns so a blocked reader never holds up changes to the limit.
+func (lr *RateLimitedReader) Read(p []byte) (int, error) {
+	n, err := lr.ReadCloser.Read(p)
+
+	if lr.Limiter != nil && n > 0 {
+		lr.Limiter.Wait(n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,90 @@
+package ioprogress
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the throughput of a RateLimitedReader stays within the configured limit.
+func TestRateLimitedReader(t *testing.T) {
+	limit := int64(1024 * 1024)
+	data := make([]byte, 512*1024)
+
+	reader := &RateLimitedReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(data)),
+		Limiter:    NewRateLimiter(limit),
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, reader)
+	elapsed := time.Since(start)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// 512KiB at 1MiB/s should take about half a second.
+	rate := float64(n) / elapsed.Seconds()
+	assert.LessOrEqual(t, rate, float64(limit)*1.1)
+	assert.Greater(t, elapsed, 400*time.Millisecond)
+}
+
+// Test that changing the limit mid-transfer wakes up waiting streams.
+func TestRateLimiterSetLimit(t *testing.T) {
+	limiter := NewRateLimiter(1024)
+	reader := &RateLimitedReader{
+		ReadCloser: io.NopCloser(bytes.NewReader(make([]byte, 1024*1024))),
+		Limiter:    limiter,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, reader)
+		done <- err
+	}()
+
+	// At 1KiB/s the transfer would take over 15 minutes.
+	time.Sleep(100 * time.Millisecond)
+	limiter.SetLimit(0)
+	assert.Equal(t, int64(0), limiter.Limit())
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer didn't speed up after removing the limit")
+	}
+}
+
+// Test that a blocked reader doesn't prevent the limit from being changed.
+func TestRateLimiterBlockedReader(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	limiter := NewRateLimiter(1024)
+	reader := &RateLimitedReader{ReadCloser: pipeReader, Limiter: limiter}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		close(done)
+	}()
+
+	changed := make(chan struct{})
+	go func() {
+		limiter.SetLimit(2048)
+		close(changed)
+	}()
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Changing the limit blocked on the reader")
+	}
+
+	assert.Equal(t, int64(2048), limiter.Limit())
+
+	_ = pipeWriter.Close()
+	<-done
+}
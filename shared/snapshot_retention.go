@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotRetentionPeriods lists the periods supported by snapshot retention rules.
+var SnapshotRetentionPeriods = []string{"hourly", "daily", "weekly", "monthly", "yearly"}
+
+// SnapshotRetentionRule keeps the newest snapshot of each of the last Count periods.
+type SnapshotRetentionRule struct {
+	Count  int
+	Period string
+}
+
+// SnapshotRetentionEntry is a snapshot considered by the snapshot retention rules.
+type SnapshotRetentionEntry struct {
+	Name         string
+	CreationDate time.Time
+}
+
+// ParseSnapshotRetention parses a snapshot retention policy like "keep 7 daily, 4 weekly, 12 monthly".
+// An empty policy returns no rules.
+func ParseSnapshotRetention(value string) ([]SnapshotRetentionRule, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	rules := []SnapshotRetentionRule{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part), "keep "))
+
+		fields := strings.Fields(part)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid retention rule %q (expects rule like \"7 daily\")", part)
+		}
+
+		count, err := strconv.Atoi(fields[0])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("Invalid retention count %q", fields[0])
+		}
+
+		if !StringInSlice(fields[1], SnapshotRetentionPeriods) {
+			return nil, fmt.Errorf("Invalid retention period %q (must be one of %s)", fields[1], strings.Join(SnapshotRetentionPeriods, ", "))
+		}
+
+		for _, rule := range rules {
+			if rule.Period == fields[1] {
+				return nil, fmt.Errorf("Duplicate retention period %q", fields[1])
+			}
+		}
+
+		rules = append(rules, SnapshotRetentionRule{Count: count, Period: fields[1]})
+	}
+
+	return rules, nil
+}
+
+// snapshotRetentionPeriodStart returns the start of the period containing t, offset by the given number of periods.
+// Periods are computed in UTC and weeks start on Monday.
+func snapshotRetentionPeriodStart(t time.Time, period string, offset int) time.Time {
+	t = t.UTC()
+	y, m, d := t.Date()
+
+	switch period {
+	case "hourly":
+		return time.Date(y, m, d, t.Hour()+offset, 0, 0, 0, time.UTC)
+	case "daily":
+		return time.Date(y, m, d+offset, 0, 0, 0, 0, time.UTC)
+	case "weekly":
+		monday := d - (int(t.Weekday())+6)%7
+		return time.Date(y, m, monday+(offset*7), 0, 0, 0, 0, time.UTC)
+	case "monthly":
+		return time.Date(y, m+time.Month(offset), 1, 0, 0, 0, 0, time.UTC)
+	case "yearly":
+		return time.Date(y+offset, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Time{}
+}
+
+// SnapshotRetentionExpired returns the names of the snapshots which aren't kept by any of the retention rules.
+// Each rule keeps the newest snapshot of each of its last Count periods up to now (the current period included).
+// Snapshots created after now are always kept. The result only depends on the snapshots and now, ties between
+// snapshots with the same creation date being broken by name. The returned names are sorted oldest first.
+func SnapshotRetentionExpired(rules []SnapshotRetentionRule, snapshots []SnapshotRetentionEntry, now time.Time) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	sorted := make([]SnapshotRetentionEntry, len(snapshots))
+	copy(sorted, snapshots)
+
+	// Newest first.
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].CreationDate.Equal(sorted[j].CreationDate) {
+			return sorted[i].Name > sorted[j].Name
+		}
+
+		return sorted[i].CreationDate.After(sorted[j].CreationDate)
+	})
+
+	keep := make(map[string]bool, len(sorted))
+
+	for _, snap := range sorted {
+		if snap.CreationDate.After(now) {
+			keep[snap.Name] = true
+		}
+	}
+
+	for _, rule := range rules {
+		cutoff := snapshotRetentionPeriodStart(now, rule.Period, -(rule.Count - 1))
+		seen := make(map[time.Time]bool, rule.Count)
+
+		for _, snap := range sorted {
+			if snap.CreationDate.After(now) {
+				continue
+			}
+
+			start := snapshotRetentionPeriodStart(snap.CreationDate, rule.Period, 0)
+			if start.Before(cutoff) {
+				break // All remaining snapshots are older.
+			}
+
+			if seen[start] {
+				continue
+			}
+
+			seen[start] = true
+			keep[snap.Name] = true
+		}
+	}
+
+	expired := []string{}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if !keep[sorted[i].Name] {
+			expired = append(expired, sorted[i].Name)
+		}
+	}
+
+	return expired
+}
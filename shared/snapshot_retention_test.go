@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSnapshotRetention(t *testing.T) {
+	rules, err := ParseSnapshotRetention("keep 7 daily, 4 weekly, 12 monthly")
+	require.NoError(t, err)
+	assert.Equal(t, []SnapshotRetentionRule{{7, "daily"}, {4, "weekly"}, {12, "monthly"}}, rules)
+
+	rules, err = ParseSnapshotRetention("24 hourly,keep 2 yearly")
+	require.NoError(t, err)
+	assert.Equal(t, []SnapshotRetentionRule{{24, "hourly"}, {2, "yearly"}}, rules)
+
+	rules, err = ParseSnapshotRetention("")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	for _, value := range []string{"keep", "keep 7", "keep 0 daily", "keep -1 daily", "keep 7 days", "7 daily, 3 daily", "7 daily,"} {
+		_, err = ParseSnapshotRetention(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// Test the retention selection against two years of hourly snapshots.
+func TestSnapshotRetentionExpired(t *testing.T) {
+	// Thursday.
+	now := time.Date(2023, time.June, 15, 12, 30, 0, 0, time.UTC)
+
+	snapshots := []SnapshotRetentionEntry{}
+	for ts := now.AddDate(-2, 0, 0); !ts.After(now); ts = ts.Add(time.Hour) {
+		snapshots = append(snapshots, SnapshotRetentionEntry{Name: ts.Format("2006-01-02T15"), CreationDate: ts})
+	}
+
+	rules, err := ParseSnapshotRetention("keep 7 daily, 4 weekly, 12 monthly")
+	require.NoError(t, err)
+
+	expired := SnapshotRetentionExpired(rules, snapshots, now)
+
+	expectedKept := []string{
+		// Daily: the newest of each of the last 7 days.
+		"2023-06-15T12", "2023-06-14T23", "2023-06-13T23", "2023-06-12T23", "2023-06-11T23", "2023-06-10T23", "2023-06-09T23",
+		// Weekly: the newest of the weeks starting on Monday June 12th, June 5th, May 29th and May 22nd.
+		"2023-06-04T23", "2023-05-28T23",
+		// Monthly: the newest of each of the last 12 months.
+		"2023-05-31T23", "2023-04-30T23", "2023-03-31T23", "2023-02-28T23", "2023-01-31T23", "2022-12-31T23",
+		"2022-11-30T23", "2022-10-31T23", "2022-09-30T23", "2022-08-31T23", "2022-07-31T23",
+	}
+
+	assert.Len(t, expired, len(snapshots)-len(expectedKept))
+
+	expiredNames := make(map[string]bool, len(expired))
+	for _, name := range expired {
+		expiredNames[name] = true
+	}
+
+	for _, name := range expectedKept {
+		assert.False(t, expiredNames[name], fmt.Sprintf("Snapshot %q should be kept", name))
+	}
+
+	// Expired snapshots are returned oldest first.
+	assert.Equal(t, snapshots[0].Name, expired[0])
+
+	// The selection doesn't depend on the order of the snapshots.
+	shuffled := make([]SnapshotRetentionEntry, len(snapshots))
+	copy(shuffled, snapshots)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	assert.Equal(t, expired, SnapshotRetentionExpired(rules, shuffled, now))
+
+	// No rules doesn't expire anything.
+	assert.Empty(t, SnapshotRetentionExpired(nil, snapshots, now))
+}
+
+// Test that ties are broken by name and that snapshots newer than the clock are kept.
+func TestSnapshotRetentionExpiredTies(t *testing.T) {
+	now := time.Date(2023, time.June, 15, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2023, time.June, 14, 8, 0, 0, 0, time.UTC)
+
+	snapshots := []SnapshotRetentionEntry{
+		{Name: "snap1", CreationDate: day},
+		{Name: "snap0", CreationDate: day},
+		{Name: "snap2", CreationDate: day.Add(-time.Hour)},
+		{Name: "future", CreationDate: now.Add(time.Hour)},
+	}
+
+	expired := SnapshotRetentionExpired([]SnapshotRetentionRule{{Count: 2, Period: "daily"}}, snapshots, now)
+	assert.Equal(t, []string{"snap2", "snap0"}, expired)
+}
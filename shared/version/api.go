@@ -355,6 +355,50 @@ var APIExtensions = []string{
 	"init_preseed",
 	"storage_volumes_created_at",
 	"cpu_hotplug",
+	"storage_btrfs_raid_profiles",
+	"storage_btrfs_layout",
+	"snapshots_min_per_instance",
+	"storage_usage_history",
+	"storage_btrfs_readahead",
+	"storage_volume_snapshot_usage",
+	"storage_btrfs_temp_dir",
+	"operation_update",
+	"storage_btrfs_snapshot_mount_options",
+	"resources_storage_pool_devices",
+	"storage_btrfs_quota_rescan_timeout",
+	"project_storage_usage",
+	"snapshots_retention",
+	"storage_btrfs_subvolume_mode",
+	"storage_snapshots_delete_on_error",
+	"storage_btrfs_delete_progress",
+	"storage_btrfs_commit_interval",
+	"storage_btrfs_default_subvolume",
+	"storage_volume_snapshots_archive",
+	"instances_limits_disk_io",
+	"storage_pool_reserved_space",
+	"storage_btrfs_manage_qgroups",
+	"storage_btrfs_migration_resume",
+	"storage_pool_cleanup_stale_mounts",
+	"storage_btrfs_snapshot_sync",
+	"storage_btrfs_overlay",
+	"storage_volume_state_generation",
+	"storage_snapshots_mount_base",
+	"storage_btrfs_lease",
+	"storage_btrfs_file_flags",
+	"storage_pool_delete_confirmation",
+	"snapshots_create_rate",
+	"snapshots_index",
+	"storage_pool_unavailable_reason",
+	"storage_volume_snapshot_metadata",
+	"storage_btrfs_cleanup_readonly_snapshots",
+	"storage_btrfs_snapshots_quota",
+	"storage_btrfs_loop_grow",
+	"storage_volume_snapshots_order",
+	"storage_volume_base_image",
+	"instance_snapshots_consistency",
+	"storage_btrfs_images_quota",
+	"storage_snapshots_concurrency",
+	"storage_volume_snapshot_send_parent",
 }
 
 // APIExtensionsCount returns the number of available API extensions.
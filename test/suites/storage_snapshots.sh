@@ -98,6 +98,36 @@ test_storage_volume_snapshots() {
   lxc storage volume delete "${storage_pool}" "vol1"
   lxc storage volume delete "${storage_pool}" "vol1-snap0"
 
+  # Check snapshots are archived to another pool and can be restored from there.
+  # shellcheck disable=2039,3043
+  local archive_pool archive
+  archive_pool="${storage_pool}-archive"
+  archive="${storage_pool}-vol2-snap0-${#storage_pool}-4"
+
+  lxc storage create "${archive_pool}" "$lxd_backend"
+  lxc storage volume create "${storage_pool}" vol2
+  lxc launch testimage c1 -s "${storage_pool}"
+  lxc storage volume attach "${storage_pool}" vol2 c1 /mnt
+  lxc file push "${TEST_DIR}/testfile" c1/mnt/testfile
+  lxc storage volume detach "${storage_pool}" vol2 c1
+  lxc storage volume snapshot "${storage_pool}" vol2 snap0
+  lxc storage volume set "${storage_pool}" vol2 snapshots.archive.pool "${archive_pool}"
+  lxc storage volume set "${storage_pool}" vol2 snapshots.archive.age 1S
+  sleep 2
+  lxc query -X POST "/internal/storage-pools/${storage_pool}/snapshot-archive"
+  ! lxc storage volume show "${storage_pool}" vol2/snap0 || false
+  lxc storage volume show "${archive_pool}" "${archive}" | grep -q "volatile.archive.source: ${storage_pool}/vol2/snap0"
+
+  lxc query -X POST -d "{\"archive_pool\": \"${archive_pool}\", \"archive\": \"${archive}\", \"name\": \"vol3\"}" "/internal/storage-pools/${storage_pool}/snapshot-archive-restore"
+  ! lxc storage volume show "${storage_pool}" vol3 | grep -q "volatile.archive" || false
+  lxc storage volume attach "${storage_pool}" vol3 c1 /mnt
+  [ "$(lxc exec c1 -- cat /mnt/testfile)" = 'foobar' ]
+
+  lxc delete -f c1
+  lxc storage volume delete "${storage_pool}" vol2
+  lxc storage volume delete "${storage_pool}" vol3
+  lxc storage volume delete "${archive_pool}" "${archive}"
+  lxc storage delete "${archive_pool}"
 
   lxc storage delete "${storage_pool}"
 